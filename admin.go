@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin endpoints are only enabled when ADMIN_TOKEN is set
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// METRICS_TOKEN lets a scraper read /metrics without the admin token
+var metricsToken = os.Getenv("METRICS_TOKEN")
+
+// RequireAdmin middleware checks the "Authorization: Bearer <ADMIN_TOKEN>" header, which
+// may also carry an API key with the admin scope
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			c.String(http.StatusNotFound, "Not found")
+			c.Abort()
+			return
+		}
+		token := bearerToken(c)
+		if k := apiKeys.authenticate(token); k != nil && k.Scope == SCOPE_ADMIN {
+			c.Set(API_KEY_CONTEXT, k)
+		} else if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			audit.record(c, "admin.auth_failed", "", c.Request.Method+" "+c.Request.URL.Path, "")
+			challengeBasic(c)
+			c.String(http.StatusUnauthorized, "Unauthorized")
+			c.Abort()
+			return
+		}
+		c.Set(ADMIN_ACTOR, true)
+		c.Next()
+	}
+}
+
+// RequireMetrics middleware lets "Authorization: Bearer <METRICS_TOKEN>" through and
+// otherwise asks for what RequireAdmin does
+func RequireMetrics() gin.HandlerFunc {
+	admin := RequireAdmin()
+	return func(c *gin.Context) {
+		if metricsToken != "" && subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(metricsToken)) == 1 {
+			c.Next()
+			return
+		}
+		admin(c)
+	}
+}
+
+// isAdminToken reports whether token is the ADMIN_TOKEN
+func isAdminToken(token string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// handleMetrics writes server metrics in Prometheus text format
+func handleMetrics(c *gin.Context) {
+	var b strings.Builder
+	if audioCache != nil {
+		entries, size := audioCache.Stats()
+		fmt.Fprintf(&b, "# TYPE go_music_cache_hits_total counter\ngo_music_cache_hits_total %d\n", audioCache.hits.Load())
+		fmt.Fprintf(&b, "# TYPE go_music_cache_misses_total counter\ngo_music_cache_misses_total %d\n", audioCache.misses.Load())
+		fmt.Fprintf(&b, "# TYPE go_music_cache_evictions_total counter\ngo_music_cache_evictions_total %d\n", audioCache.evictions.Load())
+		fmt.Fprintf(&b, "# TYPE go_music_cache_entries gauge\ngo_music_cache_entries %d\n", entries)
+		fmt.Fprintf(&b, "# TYPE go_music_cache_bytes gauge\ngo_music_cache_bytes %d\n", size)
+		fmt.Fprintf(&b, "# TYPE go_music_cache_max_bytes gauge\ngo_music_cache_max_bytes %d\n", audioCache.maxBytes)
+	}
+	writeCacheLayerMetrics(&b)
+	s3Meter.writeMetrics(&b)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
+
+// handleCachePurge empties the audio disk cache, or the cache layer named by ?layer=
+func handleCachePurge(c *gin.Context) {
+	if name := c.Query("layer"); name != "" {
+		l := findCacheLayer(name)
+		if l == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown or disabled cache layer"})
+			return
+		}
+		l.Purge()
+		audit.record(c, "cache.purge", "", name, "")
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	if audioCache == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "cache disabled"})
+		return
+	}
+	audioCache.Purge()
+	audit.record(c, "cache.purge", "", "audio", "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
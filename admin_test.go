@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMetricsAuth checks that /metrics answers only ADMIN_TOKEN, admin keys and
+// METRICS_TOKEN
+func TestMetricsAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(admin, metrics string) { adminToken, metricsToken = admin, metrics }(adminToken, metricsToken)
+	adminToken, metricsToken = "admin-secret", "metrics-secret"
+	read := addTestAPIKey(t, "metrics-read", "alice", SCOPE_READ)
+	r := gin.New()
+	registerRoutes(r)
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{read, http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"admin-secret", http.StatusOK},
+		{"metrics-secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("token %q: status %d, want %d", tt.token, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	API_KEYS_OBJECT  = "api-keys.json"
+	API_KEY_PREFIX   = "gm_" // keys are gm_<id>_<secret>
+	API_KEY_CONTEXT  = "apiKey"
+	MAX_API_KEY_NAME = 100
+
+	// Scopes; a key without one has the access of its user on the JSON API and /audio
+	SCOPE_READ   = "read"   // safe methods of the JSON API, and streaming
+	SCOPE_STREAM = "stream" // /audio only
+	SCOPE_ADMIN  = "admin"  // everything, including /admin
+)
+
+// apiKey lets scripts act as a user; only a hash of the secret is stored
+type apiKey struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Name    string    `json:"name,omitempty"`
+	Scope   string    `json:"scope,omitempty"`
+	Hash    string    `json:"hash,omitempty"` // sha256 of the whole key, hex
+	Created time.Time `json:"created"`
+	Groups  []string  `json:"-"` // of a single sign-on, for FOLDER_ACL
+}
+
+type apiKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]*apiKey
+	doc  stateDoc
+}
+
+var apiKeys = &apiKeyStore{keys: make(map[string]*apiKey), doc: stateDoc{name: API_KEYS_OBJECT}}
+
+// BASIC_AUTH=true also takes credentials as HTTP Basic auth, for clients such as car head
+// units and VLC that can't send a bearer token: the user name is the key's user and the
+// password the key, or ADMIN_TOKEN with any user name. Refusals then ask for Basic auth.
+var basicAuth = os.Getenv("BASIC_AUTH") == "true"
+
+// load reads the API keys object from the state store; a missing object means no keys
+func (ks *apiKeyStore) load(ctx context.Context) error {
+	return ks.doc.load(ctx, &ks.mu, ks)
+}
+
+func (ks *apiKeyStore) decode(data []byte) error {
+	var list []apiKey
+	if data != nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	keys := make(map[string]*apiKey, len(list))
+	for i := range list {
+		keys[list[i].ID] = &list[i]
+	}
+	ks.keys = keys
+	return nil
+}
+
+func (ks *apiKeyStore) encode() (interface{}, error) {
+	list := make([]apiKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		list = append(list, *k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, nil
+}
+
+// list returns the keys of user, or all keys when user is empty, without their hashes
+func (ks *apiKeyStore) list(user string) []apiKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	out := []apiKey{}
+	for _, k := range ks.keys {
+		if user == "" || k.User == user {
+			cp := *k
+			cp.Hash = ""
+			out = append(out, cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// create stores a new key and returns it with its secret, which is never shown again
+func (ks *apiKeyStore) create(ctx context.Context, user, name, scope string) (apiKey, string, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 24)
+	rand.Read(id)
+	rand.Read(secret)
+	k := apiKey{ID: hex.EncodeToString(id), User: user, Name: name, Scope: scope, Created: time.Now().UTC()}
+	token := API_KEY_PREFIX + k.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(token))
+	k.Hash = hex.EncodeToString(sum[:])
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	err := ks.doc.update(ctx, ks, func() bool {
+		stored := k
+		ks.keys[k.ID] = &stored
+		return true
+	})
+	if err != nil {
+		return apiKey{}, "", err
+	}
+	k.Hash = ""
+	return k, token, nil
+}
+
+func (ks *apiKeyStore) revoke(ctx context.Context, id string) (bool, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	found := false
+	err := ks.doc.update(ctx, ks, func() bool {
+		_, found = ks.keys[id]
+		delete(ks.keys, id)
+		return found
+	})
+	if err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+// authenticate returns the key a bearer token stands for, or nil. A single sign-on
+// session stands for a key of its user that isn't stored. A key revoked by another
+// instance sharing the state store works here until the next STATE_REFRESH.
+func (ks *apiKeyStore) authenticate(token string) *apiKey {
+	if strings.HasPrefix(token, OIDC_SESSION_PREFIX) {
+		return oidcSessionKeyFor(token)
+	}
+	rest, ok := strings.CutPrefix(token, API_KEY_PREFIX)
+	if !ok {
+		return nil
+	}
+	id, _, _ := strings.Cut(rest, "_")
+	ks.mu.Lock()
+	k, ok := ks.keys[id]
+	ks.mu.Unlock()
+	if !ok {
+		// Another instance may just have created the key
+		ks.doc.refreshOnMiss()
+		ks.mu.Lock()
+		k, ok = ks.keys[id]
+		ks.mu.Unlock()
+	}
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(k.Hash)) != 1 {
+		return nil
+	}
+	return k
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or with BASIC_AUTH
+// the password of Basic auth. A key sent with another user's name is made invalid.
+func bearerToken(c *gin.Context) string {
+	if basicAuth {
+		if user, password, ok := c.Request.BasicAuth(); ok {
+			if strings.HasPrefix(password, API_KEY_PREFIX) {
+				if k := apiKeys.authenticate(password); k != nil && k.User != user {
+					return API_KEY_PREFIX
+				}
+			}
+			return password
+		}
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// challengeBasic asks for Basic auth on a refusal when BASIC_AUTH is on
+func challengeBasic(c *gin.Context) {
+	if basicAuth {
+		c.Header("WWW-Authenticate", `Basic realm="go-music", charset="UTF-8"`)
+	}
+}
+
+// readOnlyPosts are POST routes of the JSON API that change nothing
+var readOnlyPosts = map[string]bool{"/api/v1/tracks/resolve": true, "/graphql": true}
+
+// readOnlyFuncs are the dffunc calls of POST /api a read key may make; the others
+// register devices, send them commands or publish playback
+var readOnlyFuncs = map[string]bool{
+	"dir": true, "searchTitle": true, "searchTitleIn": true, "searchDir": true, "getAllMp3": true,
+	"getAllMp3InDir": true, "getAllMp3InDirs": true, "getAllDirs": true, "getDirStats": true,
+	"getChapters": true, "resolveTracks": true, "listDevices": true, "getCollections": true,
+	"getCollection": true, "getAllMp3InCollection": true, "getSmartPlaylists": true,
+	"getAllMp3InSmartPlaylist": true, "shuffle": true, "getLibraries": true, "searchAsync": true,
+	"searchJob": true, "getCapabilities": true,
+}
+
+// writableGets are GET routes that change state: /ws carries queue, party and remote
+// control messages once upgraded
+var writableGets = map[string]bool{"/ws": true}
+
+// safeRequest reports whether a request only reads, which is all a read key may do
+func safeRequest(c *gin.Context) bool {
+	route := strings.TrimPrefix(c.FullPath(), basePath)
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return !writableGets[route]
+	case http.MethodPost:
+		if route == "/api" {
+			return readOnlyFuncs[c.PostForm("dffunc")]
+		}
+		return readOnlyPosts[route]
+	}
+	return false
+}
+
+// APIKey middleware accepts an API key in the Authorization header and enforces its
+// scope. Requests without a key are passed on unchanged, except guest writes; a wrong
+// key is refused. stream lets stream keys through, for routes that serve audio.
+func APIKey(stream bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if !strings.HasPrefix(token, API_KEY_PREFIX) {
+			if !stream && !safeRequest(c) && isGuest(c) {
+				// Guests only read; signing in unlocks the rest
+				challengeBasic(c)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in required"})
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+		k := apiKeys.authenticate(token)
+		if k == nil {
+			audit.record(c, "apikey.auth_failed", "", c.Request.Method+" "+c.Request.URL.Path, "")
+			challengeBasic(c)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+			c.Abort()
+			return
+		}
+		if !stream && (k.Scope == SCOPE_STREAM || (k.Scope == SCOPE_READ && !safeRequest(c))) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key scope " + k.Scope + " does not allow this request"})
+			c.Abort()
+			return
+		}
+		c.Set(API_KEY_CONTEXT, k)
+		c.Next()
+	}
+}
+
+// handleListAPIKeys lists API keys without their secrets (GET /admin/api-keys?user=)
+func handleListAPIKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": apiKeys.list(c.Query("user"))})
+}
+
+// handleCreateAPIKey creates a key for a user (POST /admin/api-keys, {"user","name","scope"})
+func handleCreateAPIKey(c *gin.Context) {
+	var req struct {
+		User  string `json:"user"`
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.User) == "" || len(req.User) > MAX_RATING_USER || len(req.Name) > MAX_API_KEY_NAME {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user required"})
+		return
+	}
+	switch req.Scope {
+	case "", SCOPE_READ, SCOPE_STREAM, SCOPE_ADMIN:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be read, stream or admin"})
+		return
+	}
+	k, token, err := apiKeys.create(c.Request.Context(), strings.TrimSpace(req.User), req.Name, req.Scope)
+	if err != nil {
+		log.Printf("API key save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save API keys"})
+		return
+	}
+	audit.record(c, "apikey.create", "", k.User, k.ID+" "+k.Scope)
+	c.JSON(http.StatusOK, gin.H{"key": k, "token": token})
+}
+
+// handleRevokeAPIKey deletes a key (DELETE /admin/api-keys/:id)
+func handleRevokeAPIKey(c *gin.Context) {
+	found, err := apiKeys.revoke(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		log.Printf("API key save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save API keys"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown API key"})
+		return
+	}
+	audit.record(c, "apikey.revoke", "", c.Param("id"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
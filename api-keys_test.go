@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// addTestAPIKey stores a key of user with scope and returns its token
+func addTestAPIKey(t *testing.T, id, user, scope string) string {
+	t.Helper()
+	token := API_KEY_PREFIX + id + "_secret"
+	sum := sha256.Sum256([]byte(token))
+	apiKeys.mu.Lock()
+	apiKeys.keys[id] = &apiKey{ID: id, User: user, Scope: scope, Hash: hex.EncodeToString(sum[:])}
+	apiKeys.mu.Unlock()
+	t.Cleanup(func() {
+		apiKeys.mu.Lock()
+		delete(apiKeys.keys, id)
+		apiKeys.mu.Unlock()
+	})
+	return token
+}
+
+// TestAPIKeyScopes checks that read and stream keys are refused outside their scope on
+// the dffunc endpoint, /events and /ws, where requests act as the key's user
+func TestAPIKeyScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	read := addTestAPIKey(t, "read1", "alice", SCOPE_READ)
+	stream := addTestAPIKey(t, "stream1", "alice", SCOPE_STREAM)
+	r := gin.New()
+	registerRoutes(r)
+
+	dffunc := func(name string) string { return url.Values{"dffunc": {name}, "dfdata": {"{}"}}.Encode() }
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		token  string
+	}{
+		{"stream key browsing", http.MethodPost, "/api", dffunc("dir"), stream},
+		{"stream key searching", http.MethodPost, "/api", dffunc("searchTitle"), stream},
+		{"stream key registering a device", http.MethodPost, "/api", dffunc("registerDevice"), stream},
+		{"read key registering a device", http.MethodPost, "/api", dffunc("registerDevice"), read},
+		{"read key sending a command", http.MethodPost, "/api", dffunc("sendDeviceCommand"), read},
+		{"read key publishing playback", http.MethodPost, "/api", dffunc("nowPlaying"), read},
+		{"stream key events", http.MethodGet, "/events", "", stream},
+		{"stream key sync", http.MethodGet, "/ws", "", stream},
+		{"read key sync", http.MethodGet, "/ws", "", read},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+// TestSafeRequest checks which requests a read key may make
+func TestSafeRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	read := addTestAPIKey(t, "read2", "alice", SCOPE_READ)
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.POST("/api", APIKey(false), ok)
+	r.GET("/events", APIKey(false), ok)
+	r.GET("/ws", APIKey(false), ok)
+	tests := []struct {
+		method, path, dffunc string
+		want                 int
+	}{
+		{http.MethodPost, "/api", "dir", http.StatusNoContent},
+		{http.MethodPost, "/api", "getAllMp3InCollection", http.StatusNoContent},
+		{http.MethodPost, "/api", "pollDeviceCommands", http.StatusForbidden},
+		{http.MethodPost, "/api", "", http.StatusForbidden},
+		{http.MethodGet, "/events", "", http.StatusNoContent},
+		{http.MethodGet, "/ws", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		body := url.Values{"dffunc": {tt.dffunc}}.Encode()
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+read)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s dffunc=%q: status %d, want %d", tt.method, tt.path, tt.dffunc, w.Code, tt.want)
+		}
+	}
+}
+
+// TestReadOnlyFuncsKnown checks that the read-only dffunc list names dispatched functions
+func TestReadOnlyFuncsKnown(t *testing.T) {
+	known := make(map[string]bool)
+	for _, name := range dffuncNames {
+		known[name] = true
+	}
+	for name := range readOnlyFuncs {
+		if !known[name] {
+			t.Errorf("readOnlyFuncs names %q, which handleRequest doesn't dispatch", name)
+		}
+	}
+}
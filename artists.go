@@ -0,0 +1,418 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Album kinds an artist page is sectioned by, in page order. Appearances are albums of
+// other artists and Various Artists compilations the artist is on.
+const (
+	ALBUM_STUDIO      = "album"
+	ALBUM_LIVE        = "live"
+	ALBUM_COMPILATION = "compilation"
+	ALBUM_APPEARANCE  = "appearance"
+
+	SAME_RECORDING_SECONDS = 3 // durations of copies of one recording differ by at most this
+	VARIOUS_ARTISTS        = "Various Artists"
+	VARIOUS_ARTISTS_MIN    = 3 // an album without album artist by this many track artists is a compilation
+)
+
+// Roles an artist has on a track
+const (
+	ROLE_ARTIST       = "artist"
+	ROLE_ALBUM_ARTIST = "albumArtist"
+	ROLE_FEATURED     = "featured"
+)
+
+var (
+	liveAlbum      = regexp.MustCompile(`(?i)\blive\b|\bunplugged\b|\bin concert\b`)
+	discFolder     = regexp.MustCompile(`(?i)^(cd|dis[ck])\s*\d+$`)
+	variousArtists = regexp.MustCompile(`(?i)^(various( artists)?|va|v\.\s?a\.?)$`)
+	featuring      = regexp.MustCompile(`(?i)\s*[(\[]?\b(?:feat\.?|ft\.|featuring)\s+([^)\]]+)[)\]]?`)
+	featuredSplit  = regexp.MustCompile(`\s*(?:,|&)\s*`)
+)
+
+// artistTrack is a track of an artist page
+type artistTrack struct {
+	Key      string   `json:"key"`
+	URL      string   `json:"url"`
+	Title    string   `json:"title"`
+	Artist   string   `json:"artist,omitempty"`
+	Track    int      `json:"track,omitempty"`
+	Disc     int      `json:"disc,omitempty"`
+	Duration int      `json:"duration,omitempty"`
+	Role     string   `json:"role,omitempty"`   // of the artist asked for
+	AlsoOn   []string `json:"alsoOn,omitempty"` // keys of the same recording left out of other albums
+	tags     trackTags
+}
+
+// artistAlbum is an album as tags and folders group tracks
+type artistAlbum struct {
+	Title  string        `json:"title"`
+	Artist string        `json:"artist,omitempty"` // album artist
+	Year   int           `json:"year,omitempty"`
+	Kind   string        `json:"kind"`
+	Folder string        `json:"folder"`
+	Tracks []artistTrack `json:"tracks"`
+}
+
+// albumFolder is the folder an album's tracks share; CD1, Disc 2 and so on belong to
+// the folder above
+func albumFolder(key string) string {
+	dir := path.Dir(key)
+	if discFolder.MatchString(path.Base(dir)) {
+		dir = path.Dir(dir)
+	}
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// sameArtist compares artist names ignoring case and surrounding space
+func sameArtist(a, b string) bool {
+	return a != "" && strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// artistNames splits the multiple values of an artist tag
+func artistNames(s string) []string {
+	var names []string
+	for _, n := range strings.Split(s, ";") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// trackCredits returns the artists a track credits: its main artists without the
+// featured ones, its album artists and the artists featured in its artist or title tag
+func trackCredits(t trackTags) (main, album, featured []string) {
+	for _, n := range artistNames(t.Artist) {
+		if m := featuring.FindStringSubmatchIndex(n); m != nil {
+			featured = append(featured, featuredSplit.Split(n[m[2]:m[3]], -1)...)
+			n = strings.TrimSpace(n[:m[0]] + n[m[1]:])
+		}
+		if n != "" {
+			main = append(main, n)
+		}
+	}
+	if m := featuring.FindStringSubmatch(t.Title); m != nil {
+		featured = append(featured, featuredSplit.Split(m[1], -1)...)
+	}
+	for _, n := range artistNames(t.AlbumArtist) {
+		if !variousArtists.MatchString(n) {
+			album = append(album, n)
+		}
+	}
+	return main, album, featured
+}
+
+// artistRole returns how t credits artist and the spelling it uses, or "" when it
+// does not
+func artistRole(t trackTags, artist string) (role, spelling string) {
+	main, album, featured := trackCredits(t)
+	for _, credit := range []struct {
+		role  string
+		names []string
+	}{{ROLE_ARTIST, main}, {ROLE_ALBUM_ARTIST, album}, {ROLE_FEATURED, featured}} {
+		for _, n := range credit.names {
+			if sameArtist(n, artist) {
+				return credit.role, n
+			}
+		}
+	}
+	return "", ""
+}
+
+// libraryAlbums groups the tagged tracks of lib that the request may see into albums.
+// Tracks of one album share its title and folder.
+func libraryAlbums(c *gin.Context, lib *library) []*artistAlbum {
+	ctx := c.Request.Context()
+	all := tagsIndex.all(lib)
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		if isListed(key, false) && folderVisible(ctx, key, false) && streamPolicy(key) != STREAM_BLOCK {
+			keys = append(keys, key)
+		}
+	}
+	sortNames(keys)
+	durations := manifest.durations(lib, keys)
+	albums := make(map[string]*artistAlbum)
+	var order []*artistAlbum
+	for i, key := range keys {
+		t := all[key]
+		folder := albumFolder(key)
+		title := t.Album
+		if title == "" {
+			title = path.Base(folder)
+		}
+		id := strings.ToLower(title) + "\x00" + folder
+		a := albums[id]
+		if a == nil {
+			a = &artistAlbum{Title: title, Folder: folder, Kind: ALBUM_STUDIO}
+			albums[id] = a
+			order = append(order, a)
+		}
+		if a.Artist == "" {
+			a.Artist = t.AlbumArtist
+		}
+		if t.Year > 0 && (a.Year == 0 || t.Year < a.Year) {
+			a.Year = t.Year
+		}
+		if t.Compilation {
+			a.Kind = ALBUM_COMPILATION
+		}
+		title = t.Title
+		if title == "" {
+			title = strings.TrimSuffix(path.Base(key), path.Ext(key))
+		}
+		a.Tracks = append(a.Tracks, artistTrack{Key: key, URL: audioURL(lib, key, nil), Title: title, Artist: t.Artist, Track: t.Track, Disc: t.Disc, Duration: durations[i], tags: t})
+	}
+	for _, a := range order {
+		if variousArtists.MatchString(a.Artist) {
+			a.Artist, a.Kind = VARIOUS_ARTISTS, ALBUM_COMPILATION
+		}
+		if a.Artist == "" {
+			// No album artist: the artists of its tracks, Various Artists when they are many
+			var artists []string
+			for _, t := range a.Tracks {
+				main, _, _ := trackCredits(t.tags)
+				for _, n := range main {
+					if !slices.ContainsFunc(artists, func(s string) bool { return sameArtist(s, n) }) {
+						artists = append(artists, n)
+					}
+				}
+			}
+			if len(artists) >= VARIOUS_ARTISTS_MIN {
+				a.Artist, a.Kind = VARIOUS_ARTISTS, ALBUM_COMPILATION
+			} else {
+				a.Artist = strings.Join(artists, "; ")
+			}
+		}
+		if a.Kind == ALBUM_STUDIO && liveAlbum.MatchString(a.Title) {
+			a.Kind = ALBUM_LIVE
+		}
+		sort.SliceStable(a.Tracks, func(i, j int) bool {
+			ti, tj := a.Tracks[i], a.Tracks[j]
+			if ti.Disc != tj.Disc {
+				return ti.Disc < tj.Disc
+			}
+			return ti.Track < tj.Track
+		})
+	}
+	return order
+}
+
+// sameRecording reports whether two tracks are copies of one recording: the same
+// MusicBrainz recording, or the same title and artist at the same length
+func sameRecording(a, b artistTrack) bool {
+	if a.tags.RecordingID != "" && b.tags.RecordingID != "" {
+		return a.tags.RecordingID == b.tags.RecordingID
+	}
+	if !strings.EqualFold(a.Title, b.Title) || !sameArtist(a.Artist, b.Artist) || a.Duration == 0 || b.Duration == 0 {
+		return false
+	}
+	return max(a.Duration-b.Duration, b.Duration-a.Duration) <= SAME_RECORDING_SECONDS
+}
+
+// albumRank orders the albums a recording is kept on: studio albums before live ones,
+// compilations and appearances, then the earliest
+func albumRank(a *artistAlbum) int {
+	switch a.Kind {
+	case ALBUM_STUDIO:
+		return 0
+	case ALBUM_LIVE:
+		return 1
+	case ALBUM_COMPILATION:
+		return 2
+	}
+	return 3
+}
+
+// dedupeRecordings keeps every recording on the first album it is on, in rank order,
+// and notes the copies it drops. It returns how many were dropped.
+func dedupeRecordings(albums []*artistAlbum) int {
+	sort.SliceStable(albums, func(i, j int) bool {
+		if ri, rj := albumRank(albums[i]), albumRank(albums[j]); ri != rj {
+			return ri < rj
+		}
+		return albums[i].Year < albums[j].Year
+	})
+	var kept []*artistTrack
+	dropped := 0
+	for _, a := range albums {
+		tracks := a.Tracks[:0]
+		for _, t := range a.Tracks {
+			var same *artistTrack
+			for _, k := range kept {
+				if sameRecording(*k, t) {
+					same = k
+					break
+				}
+			}
+			if same != nil {
+				same.AlsoOn = append(same.AlsoOn, t.Key)
+				dropped++
+				continue
+			}
+			tracks = append(tracks, t)
+		}
+		a.Tracks = tracks
+		for i := range a.Tracks {
+			kept = append(kept, &a.Tracks[i])
+		}
+	}
+	return dropped
+}
+
+// artistAlbums returns the albums crediting artist and the spelling they use. Albums
+// of the artist keep all their tracks; on others, which become appearances, only the
+// tracks crediting the artist are kept. Various Artists is nobody's page.
+func artistAlbums(c *gin.Context, lib *library, artist string) ([]*artistAlbum, string) {
+	if variousArtists.MatchString(artist) {
+		return nil, ""
+	}
+	var albums []*artistAlbum
+	spelling := ""
+	for _, a := range libraryAlbums(c, lib) {
+		own := false
+		for _, n := range artistNames(a.Artist) {
+			if sameArtist(n, artist) {
+				own = true
+				if spelling == "" {
+					spelling = n
+				}
+			}
+		}
+		tracks := a.Tracks[:0]
+		for _, t := range a.Tracks {
+			role, n := artistRole(t.tags, artist)
+			if role == "" && !own {
+				continue
+			}
+			if spelling == "" {
+				spelling = n
+			}
+			t.Role = role
+			tracks = append(tracks, t)
+		}
+		if len(tracks) > 0 {
+			a.Tracks = tracks
+			if !own {
+				a.Kind = ALBUM_APPEARANCE
+			}
+			albums = append(albums, a)
+		}
+	}
+	return albums, spelling
+}
+
+// sortAlbums orders albums by year, then title
+func sortAlbums(albums []*artistAlbum) {
+	sort.SliceStable(albums, func(i, j int) bool {
+		if albums[i].Year != albums[j].Year {
+			return albums[i].Year < albums[j].Year
+		}
+		return naturalLess(albums[i].Title, albums[j].Title)
+	})
+}
+
+// handleArtist returns the albums of an artist with their tracks, sectioned into
+// studio albums, live albums, compilations and appearances, each recording once
+// (GET /api/v1/artists/:name)
+func handleArtist(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("name"))
+	lib := libraryFrom(c.Request.Context())
+	albums, spelling := artistAlbums(c, lib, name)
+	if len(albums) == 0 {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_ARTIST)
+		return
+	}
+	dropped := dedupeRecordings(albums)
+	sections := []gin.H{}
+	count := 0
+	for _, kind := range []string{ALBUM_STUDIO, ALBUM_LIVE, ALBUM_COMPILATION, ALBUM_APPEARANCE} {
+		var list []*artistAlbum
+		for _, a := range albums {
+			if a.Kind == kind && len(a.Tracks) > 0 {
+				list = append(list, a)
+				count += len(a.Tracks)
+			}
+		}
+		if len(list) > 0 {
+			sortAlbums(list)
+			sections = append(sections, gin.H{"kind": kind, "albums": list})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"artist": spelling, "library": lib.Name, "tracks": count, "duplicates": dropped, "sections": sections})
+}
+
+// handleArtistTracks lists every track crediting an artist across albums and folders,
+// with the artist's role on it, featured appearances included and copies of one
+// recording kept (GET /api/v1/artists/:name/tracks)
+func handleArtistTracks(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("name"))
+	lib := libraryFrom(c.Request.Context())
+	albums, spelling := artistAlbums(c, lib, name)
+	if len(albums) == 0 {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_ARTIST)
+		return
+	}
+	sortAlbums(albums)
+	type albumTrack struct {
+		artistTrack
+		Album     string `json:"album"`
+		AlbumKind string `json:"albumKind"`
+		Year      int    `json:"year,omitempty"`
+	}
+	tracks := []albumTrack{}
+	for _, a := range albums {
+		for _, t := range a.Tracks {
+			tracks = append(tracks, albumTrack{artistTrack: t, Album: a.Title, AlbumKind: a.Kind, Year: a.Year})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"artist": spelling, "library": lib.Name, "tracks": tracks})
+}
+
+// handleListArtists lists the artists of the tagged tracks with how many tracks each
+// has (GET /api/v1/artists)
+func handleListArtists(c *gin.Context) {
+	lib := libraryFrom(c.Request.Context())
+	counts := make(map[string]int)
+	names := make(map[string]string) // folded name -> first spelling seen
+	for _, a := range libraryAlbums(c, lib) {
+		for _, t := range a.Tracks {
+			seen := map[string]bool{}
+			main, album, _ := trackCredits(t.tags)
+			for _, n := range append(main, album...) {
+				id := strings.ToLower(n)
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				if _, ok := names[id]; !ok {
+					names[id] = n
+				}
+				counts[id]++
+			}
+		}
+	}
+	list := make([]gin.H, 0, len(names))
+	ids := make([]string, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sortNames(ids)
+	for _, id := range ids {
+		list = append(list, gin.H{"name": names[id], "tracks": counts[id]})
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "artists": list})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MAX_ARTWORK_BYTES        = 16 << 20 // larger images are refused
+	MAX_CACHED_ARTWORK_BYTES = 4 << 20  // larger images are served without caching
+)
+
+// artworkNames are preferred cover file names, before any other image in the folder
+var artworkNames = []string{"cover", "folder", "front", "album"}
+
+// pickArtwork chooses the cover image among the files of a folder
+func pickArtwork(files []string) string {
+	var images []string
+	for _, f := range files {
+		if artworkExts[strings.ToLower(path.Ext(f))] {
+			images = append(images, f)
+		}
+	}
+	for _, want := range artworkNames {
+		for _, f := range images {
+			if strings.EqualFold(strings.TrimSuffix(f, path.Ext(f)), want) {
+				return f
+			}
+		}
+	}
+	if len(images) > 0 {
+		return images[0]
+	}
+	return ""
+}
+
+// handleArtwork serves the cover image of a folder (GET /artwork/*path), resized to one
+// of artworkSizes with ?size=. Cached images are stored as "<content type>\n<bytes>".
+func handleArtwork(c *gin.Context) {
+	dir := strings.Trim(c.Param("path"), "/")
+	ctx := c.Request.Context()
+	lib := libraryFrom(ctx)
+	if dir != "" && (!isListed(dir, true) || !folderVisible(ctx, dir, true)) {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	width, err := artworkSize(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	cacheKey := lib.Name + "\x00" + dir
+	if data, ok := artworkCache.Get(cacheKey); ok && width == 0 {
+		c.Header("Cache-Control", "public, max-age=3600")
+		if ctype, img, found := bytes.Cut(data, []byte("\n")); found {
+			c.Data(http.StatusOK, string(ctype), img)
+			return
+		}
+	}
+
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+	_, files, err := s3List(ctx, prefix, "/")
+	if err != nil {
+		log.Printf("Artwork listing error: %v", err)
+		c.String(http.StatusInternalServerError, "Listing failed")
+		return
+	}
+	name := pickArtwork(files)
+	if name == "" {
+		c.String(http.StatusNotFound, "No artwork")
+		return
+	}
+	if width > 0 && serveThumbnail(c, prefix+name, width) {
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+	body, size, ctype, err := s3GetAudioFile(ctx, prefix+name)
+	if err != nil {
+		c.String(http.StatusNotFound, "No artwork")
+		return
+	}
+	defer body.Close()
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		ctype = t
+	}
+	// The object size can be missing, so the read is bounded too
+	var img []byte
+	if size <= MAX_ARTWORK_BYTES {
+		img, err = io.ReadAll(io.LimitReader(body, MAX_ARTWORK_BYTES+1))
+		if err != nil {
+			c.String(http.StatusBadGateway, "Artwork read failed")
+			return
+		}
+	}
+	if size > MAX_ARTWORK_BYTES || len(img) > MAX_ARTWORK_BYTES {
+		log.Printf("Artwork %s exceeds %d bytes", prefix+name, MAX_ARTWORK_BYTES)
+		c.String(http.StatusNotFound, "Artwork too large")
+		return
+	}
+	if len(img) <= MAX_CACHED_ARTWORK_BYTES {
+		artworkCache.Set(cacheKey, append([]byte(ctype+"\n"), img...))
+	}
+	c.Data(http.StatusOK, ctype, img)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// diskCache is a size-bounded on-disk LRU cache for audio objects. Files are named
+// <key hash>.<ETag hash>, so a copy of an overwritten object is never served.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List               // front = most recently used
+	entries map[string]*list.Element // key hash -> element
+
+	size      int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type cacheEntry struct {
+	id   string // key hash
+	tag  string // ETag hash
+	size int64
+}
+
+// file is the name of the entry's cache file
+func (e *cacheEntry) file() string {
+	return e.id + "." + e.tag
+}
+
+var audioCache *diskCache
+
+// newDiskCache creates the cache directory and indexes files left from a previous run
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	dc := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if filepath.Ext(f.Name()) == ".tmp" {
+			os.Remove(filepath.Join(dir, f.Name())) // left half-written by a previous run
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	// Oldest first, so the most recently written files end up at the front
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		id, tag, ok := strings.Cut(info.Name(), ".")
+		if !ok {
+			os.Remove(filepath.Join(dir, info.Name())) // written before entries carried the ETag
+			continue
+		}
+		if el, ok := dc.entries[id]; ok {
+			dc.removeLocked(el) // an older version of the same object
+		}
+		dc.entries[id] = dc.lru.PushFront(&cacheEntry{id: id, tag: tag, size: info.Size()})
+		dc.size += info.Size()
+	}
+	dc.mu.Lock()
+	dc.evictLocked()
+	dc.mu.Unlock()
+	return dc, nil
+}
+
+// hashName maps an S3 key or ETag to a flat cache file name part
+func hashName(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Get opens the cached copy of key if it is of the object version etag. A copy of
+// another version is dropped.
+func (dc *diskCache) Get(key, etag string) (*os.File, bool) {
+	id, tag := hashName(key), hashName(etag)
+	dc.mu.Lock()
+	el, ok := dc.entries[id]
+	if ok && el.Value.(*cacheEntry).tag != tag {
+		dc.removeLocked(el)
+		ok = false
+	}
+	if ok {
+		dc.lru.MoveToFront(el)
+	}
+	dc.mu.Unlock()
+	if !ok {
+		dc.misses.Add(1)
+		return nil, false
+	}
+	f, err := os.Open(filepath.Join(dc.dir, id+"."+tag))
+	if err != nil {
+		dc.Delete(key)
+		dc.misses.Add(1)
+		return nil, false
+	}
+	dc.hits.Add(1)
+	return f, true
+}
+
+// Has reports whether version etag of key is cached, without counting a hit or miss
+func (dc *diskCache) Has(key, etag string) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	el, ok := dc.entries[hashName(key)]
+	return ok && el.Value.(*cacheEntry).tag == hashName(etag)
+}
+
+// Fill wraps an S3 body of version etag of key so that a complete read also stores the
+// object in the cache. Partial reads (client disconnects) are discarded.
+func (dc *diskCache) Fill(key, etag string, body io.ReadCloser, size int64) io.ReadCloser {
+	if size <= 0 || size > dc.maxBytes {
+		return body
+	}
+	tmp, err := os.CreateTemp(dc.dir, "*.tmp")
+	if err != nil {
+		log.Printf("Cache temp file error: %v", err)
+		return body
+	}
+	return &cacheFiller{dc: dc, key: key, etag: etag, body: body, tmp: tmp, want: size}
+}
+
+// Delete removes the cached copy of key, e.g. after the object was moved or deleted
+func (dc *diskCache) Delete(key string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if el, ok := dc.entries[hashName(key)]; ok {
+		dc.removeLocked(el)
+	}
+}
+
+// Purge removes every cached file
+func (dc *diskCache) Purge() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for id, el := range dc.entries {
+		os.Remove(filepath.Join(dc.dir, el.Value.(*cacheEntry).file()))
+		dc.lru.Remove(el)
+		delete(dc.entries, id)
+	}
+	dc.size = 0
+}
+
+// Stats returns the current entry count and size in bytes
+func (dc *diskCache) Stats() (entries int, size int64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return len(dc.entries), dc.size
+}
+
+func (dc *diskCache) commit(key, etag string, tmpPath string, size int64) {
+	e := &cacheEntry{id: hashName(key), tag: hashName(etag), size: size}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if el, ok := dc.entries[e.id]; ok {
+		dc.removeLocked(el)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dc.dir, e.file())); err != nil {
+		log.Printf("Cache commit error: %v", err)
+		os.Remove(tmpPath)
+		return
+	}
+	dc.entries[e.id] = dc.lru.PushFront(e)
+	dc.size += size
+	dc.evictLocked()
+}
+
+// removeLocked drops an entry and its file
+func (dc *diskCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	os.Remove(filepath.Join(dc.dir, e.file()))
+	dc.size -= e.size
+	dc.lru.Remove(el)
+	delete(dc.entries, e.id)
+}
+
+func (dc *diskCache) evictLocked() {
+	for dc.size > dc.maxBytes {
+		el := dc.lru.Back()
+		if el == nil {
+			return
+		}
+		dc.removeLocked(el)
+		dc.evictions.Add(1)
+	}
+}
+
+// cacheFiller tees an S3 body into a temp file and commits it on a complete read
+type cacheFiller struct {
+	dc      *diskCache
+	key     string
+	etag    string
+	body    io.ReadCloser
+	tmp     *os.File
+	want    int64
+	written int64
+	failed  bool
+}
+
+func (cf *cacheFiller) Read(p []byte) (int, error) {
+	n, err := cf.body.Read(p)
+	if n > 0 && !cf.failed {
+		if _, werr := cf.tmp.Write(p[:n]); werr != nil {
+			cf.failed = true
+		}
+		cf.written += int64(n)
+	}
+	return n, err
+}
+
+func (cf *cacheFiller) Close() error {
+	err := cf.body.Close()
+	cf.tmp.Close()
+	if cf.failed || cf.written != cf.want {
+		os.Remove(cf.tmp.Name())
+		return err
+	}
+	cf.dc.commit(cf.key, cf.etag, cf.tmp.Name(), cf.written)
+	return err
+}
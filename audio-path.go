@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	AUDIO_PATH_STRICT  = "strict"
+	AUDIO_PATH_LENIENT = "lenient"
+)
+
+// AUDIO_PATH_MODE selects how /audio/*path is resolved: "strict" (default) or "lenient"
+var audioPathMode = os.Getenv("AUDIO_PATH_MODE")
+
+func initAudioPathMode() error {
+	switch audioPathMode {
+	case "":
+		audioPathMode = AUDIO_PATH_STRICT
+	case AUDIO_PATH_STRICT, AUDIO_PATH_LENIENT:
+	default:
+		return fmt.Errorf("invalid AUDIO_PATH_MODE: %q", audioPathMode)
+	}
+	return nil
+}
+
+// isNoSuchKey reports whether err is an S3 "object not found" error or a missing
+// STATE_STORE document; CopyObject's missing source is only told by its error code
+func isNoSuchKey(err error) bool {
+	var nsk *types.NoSuchKey
+	var nf *types.NotFound
+	var apiErr smithy.APIError
+	return errors.As(err, &nsk) || errors.As(err, &nf) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey") ||
+		errors.Is(err, fs.ErrNotExist)
+}
+
+// foldPathSegment normalizes a key segment for lenient comparison
+func foldPathSegment(seg string) string {
+	if unescaped, err := url.PathUnescape(seg); err == nil {
+		seg = unescaped
+	}
+	return strings.ToLower(norm.NFC.String(seg))
+}
+
+// resolveLenientKey walks the requested key segment by segment and returns the
+// existing S3 key that matches it ignoring escaping, case and Unicode normalization
+func resolveLenientKey(ctx context.Context, key string) (string, bool) {
+	segments := strings.Split(key, "/")
+	resolved := ""
+	for i, seg := range segments {
+		want := foldPathSegment(seg)
+		dirs, files, err := s3List(ctx, resolved, "/")
+		if err != nil {
+			return "", false
+		}
+		candidates := dirs
+		if i == len(segments)-1 {
+			candidates = files
+		}
+		match := ""
+		for _, cand := range candidates {
+			if cand == seg {
+				match = cand
+				break
+			}
+			if match == "" && foldPathSegment(cand) == want {
+				match = cand
+			}
+		}
+		if match == "" {
+			return "", false
+		}
+		resolved += match
+		if i < len(segments)-1 {
+			resolved += "/"
+		}
+	}
+	return resolved, true
+}
+
+// audioPath builds the escaped /audio path (below BASE_PATH) for a key
+func audioPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return basePath + "/audio/" + strings.Join(segments, "/")
+}
+
+// audioURL builds the escaped /audio URL (below BASE_PATH) for a key in lib
+func audioURL(lib *library, key string, query url.Values) string {
+	if lib != defaultLibrary() {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("lib", lib.Name)
+	}
+	u := audioPath(key)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// fakeS3 serves GetObject and ListObjectsV2 for path-style requests from objects, keyed
+// by "bucket/key", and records the last object requested. ETags are "etag" unless etags
+// names one.
+type fakeS3 struct {
+	objects map[string]string
+	etags   map[string]string
+	got     string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, bucket, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		return
+	}
+	f.got = bucket + "/" + key
+	body, ok := f.objects[f.got]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/mpeg")
+	etag, ok := f.etags[f.got]
+	if !ok {
+		etag = "etag"
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	fmt.Fprint(w, body)
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix, delimiter string) {
+	var b strings.Builder
+	b.WriteString(`<ListBucketResult><IsTruncated>false</IsTruncated>`)
+	seen := map[string]bool{}
+	for name := range f.objects {
+		key, ok := strings.CutPrefix(name, bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			if dir := key[:len(prefix)+i+1]; !seen[dir] {
+				seen[dir] = true
+				fmt.Fprintf(&b, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, html.EscapeString(dir))
+			}
+			continue
+		}
+		fmt.Fprintf(&b, `<Contents><Key>%s</Key><Size>1</Size></Contents>`, html.EscapeString(key))
+	}
+	b.WriteString(`</ListBucketResult>`)
+	fmt.Fprint(w, b.String())
+}
+
+// useFakeS3 points the S3 client at f until the test ends
+func useFakeS3(t *testing.T, f *fakeS3) {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	prev := s3Client
+	s3Client = s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	t.Cleanup(func() {
+		s3Client = prev
+		srv.Close()
+	})
+}
+
+// TestAudioURLRoundTrip checks that handleAudio fetches the object of the key and
+// library a URL built by audioURL was built from
+func TestAudioURLRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	music := &library{Name: "Music", Bucket: "music"}
+	lossless := &library{Name: "Lossless & Hi-Res", Bucket: "hires", Prefix: "flac/"}
+	defer func(prev []*library) { libraries = prev }(libraries)
+	libraries = []*library{music, lossless}
+
+	tests := []struct {
+		name  string
+		lib   *library
+		key   string
+		query url.Values
+	}{
+		{"plain", music, "Artist/Album/01 Track.mp3", nil},
+		{"hash", music, "Artist/#1 Hits/Track #2.mp3", nil},
+		{"question mark", music, "Who?/What?.mp3", nil},
+		{"plus", music, "C++ Band/a+b=c.flac", nil},
+		{"percent", music, "100% Pure/50%25 off.mp3", nil},
+		{"emoji", music, "🎵 Mix/Party 🎉.ogg", nil},
+		{"cjk", music, "坂本龍一/戦場のメリークリスマス.mp3", nil},
+		{"other library", lossless, "Who?/#1+🎉/音楽.flac", nil},
+		{"extra query", lossless, "a&b=c/x?y#z.mp3", url.Values{"normalize": {"1"}}},
+	}
+	fake := &fakeS3{objects: map[string]string{}}
+	for _, tt := range tests {
+		fake.objects[tt.lib.Bucket+"/"+tt.lib.Prefix+tt.key] = tt.name
+	}
+	useFakeS3(t, fake)
+	r := gin.New()
+	r.GET("/audio/*path", Library(), handleAudio)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := audioURL(tt.lib, tt.key, tt.query)
+			if strings.ContainsAny(strings.SplitN(u, "?", 2)[0], "#? ") {
+				t.Errorf("audioURL(%q) = %q leaves a reserved character in the path", tt.key, u)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u, nil))
+			if w.Code != http.StatusOK || w.Body.String() != tt.name {
+				t.Fatalf("GET %s: status %d, body %q, S3 object %q", u, w.Code, w.Body.String(), fake.got)
+			}
+		})
+	}
+}
+
+// TestLenientRedirectKeepsQuery checks that the lenient redirect to the stored key keeps
+// the library and stream options of the request
+func TestLenientRedirectKeepsQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	music := &library{Name: "Music", Bucket: "music"}
+	lossless := &library{Name: "Lossless", Bucket: "hires", Prefix: "flac/"}
+	defer func(prev []*library, mode string) { libraries, audioPathMode = prev, mode }(libraries, audioPathMode)
+	libraries = []*library{music, lossless}
+	audioPathMode = AUDIO_PATH_LENIENT
+	useFakeS3(t, &fakeS3{objects: map[string]string{"hires/flac/Café/Été.flac": "x"}})
+	r := gin.New()
+	r.GET("/audio/*path", Library(), handleAudio)
+
+	u := "/audio/caf%C3%A9/%C3%A9t%C3%A9.FLAC?lib=Lossless&normalize=album&t=30"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u, nil))
+	want := basePath + "/audio/Caf%C3%A9/%C3%89t%C3%A9.flac?lib=Lossless&normalize=album&t=30"
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+		t.Errorf("GET %s: status %d, Location %q; want %d, %q", u, w.Code, w.Header().Get("Location"), http.StatusMovedPermanently, want)
+	}
+}
+
+// TestAudioHidesMetaDir checks that server state under META_DIR is not found through
+// /audio, by its own path or through a library whose prefix lies above S3_PREFIX
+func TestAudioHidesMetaDir(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	music := &library{Name: "Music", Bucket: "music", Prefix: "songs/"}
+	whole := &library{Name: "Whole bucket", Bucket: "music"}
+	defer func(prev []*library, bucket, prefix string) { libraries, s3Bucket, s3Prefix = prev, bucket, prefix }(libraries, s3Bucket, s3Prefix)
+	libraries = []*library{music, whole}
+	s3Bucket, s3Prefix = "music", "songs/"
+	useFakeS3(t, &fakeS3{objects: map[string]string{
+		"music/songs/.go-music/webhooks.json": `{"secret":"s"}`,
+		"music/songs/Artist/a.mp3":            "track",
+	}})
+
+	for _, validate := range []bool{false, true} {
+		r := gin.New()
+		if validate {
+			r.Use(ValidatePath())
+		}
+		r.GET("/audio/*path", Library(), handleAudio)
+		for _, tt := range []struct {
+			path string
+			want int
+		}{
+			{"/audio/.go-music/webhooks.json", http.StatusNotFound},
+			{"/audio/songs/.go-music/webhooks.json?lib=Whole+bucket", http.StatusNotFound},
+			{"/audio/Artist/a.mp3", http.StatusOK},
+		} {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.want || strings.Contains(w.Body.String(), "secret") {
+				t.Errorf("GET %s (ValidatePath %t): status %d, body %q; want %d", tt.path, validate, w.Code, w.Body.String(), tt.want)
+			}
+		}
+	}
+}
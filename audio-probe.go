@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	PROBE_HEAD_BYTES = 128 << 10 // read from the start of a file
+	PROBE_TAIL_BYTES = 64 << 10  // read from the end for formats that keep length info there
+)
+
+var errProbeUnsupported = errors.New("unsupported or unrecognized audio header")
+
+// audioInfo is what probing an audio header yields
+type audioInfo struct {
+	Duration time.Duration
+	Bitrate  int // kbit/s
+}
+
+// probeNeedsTail reports whether the format of key needs the end of the file as well
+func probeNeedsTail(key string) bool {
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".ogg", ".mp4", ".m4a":
+		return true
+	}
+	return false
+}
+
+// probeAudio computes duration and bitrate from the head (and optionally tail) bytes of a file of the given size
+func probeAudio(key string, head, tail []byte, size int64) (audioInfo, error) {
+	var info audioInfo
+	var err error
+	switch strings.ToLower(filepath.Ext(key)) {
+	case ".mp3":
+		info, err = probeMP3(head, size)
+	case ".wav":
+		info, err = probeWAV(head)
+	case ".ogg":
+		info, err = probeOgg(head, tail)
+	case ".mp4", ".m4a":
+		info, err = probeMP4(head, tail)
+	default:
+		err = errProbeUnsupported
+	}
+	if err != nil {
+		return audioInfo{}, err
+	}
+	if info.Bitrate == 0 && info.Duration > 0 {
+		info.Bitrate = int(float64(size*8) / info.Duration.Seconds() / 1000)
+	}
+	return info, nil
+}
+
+// MPEG audio bitrates in kbit/s, indexed [version is MPEG1][layer-1][index]
+var mp3Bitrates = [2][3][16]int{
+	{ // MPEG2 / 2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+	{ // MPEG1
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+}
+
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG2.5
+	{0, 0, 0},             // reserved
+	{22050, 24000, 16000}, // MPEG2
+	{44100, 48000, 32000}, // MPEG1
+}
+
+// probeMP3 reads the first frame header, using a Xing/Info or VBRI frame count when present
+func probeMP3(head []byte, size int64) (audioInfo, error) {
+	start := 0
+	if len(head) >= 10 && string(head[:3]) == "ID3" {
+		tagSize := int(head[6]&0x7f)<<21 | int(head[7]&0x7f)<<14 | int(head[8]&0x7f)<<7 | int(head[9]&0x7f)
+		start = 10 + tagSize
+	}
+	for i := start; i+4 <= len(head); i++ {
+		if head[i] != 0xff || head[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := int(head[i+1]>>3) & 3
+		layer := 4 - int(head[i+1]>>1)&3
+		brIndex := int(head[i+2] >> 4)
+		srIndex := int(head[i+2]>>2) & 3
+		mono := head[i+3]>>6 == 3
+		if version == 1 || layer == 4 || brIndex == 0 || brIndex == 15 || srIndex == 3 {
+			continue
+		}
+		mpeg1 := version == 3
+		v := 0
+		if mpeg1 {
+			v = 1
+		}
+		bitrate := mp3Bitrates[v][layer-1][brIndex]
+		sampleRate := mp3SampleRates[version][srIndex]
+		samplesPerFrame := 1152
+		if layer == 1 {
+			samplesPerFrame = 384
+		} else if layer == 3 && !mpeg1 {
+			samplesPerFrame = 576
+		}
+
+		sideInfo := 32
+		switch {
+		case mpeg1 && mono, !mpeg1 && !mono:
+			sideInfo = 17
+		case !mpeg1 && mono:
+			sideInfo = 9
+		}
+		frames := 0
+		if x := i + 4 + sideInfo; x+12 <= len(head) && (string(head[x:x+4]) == "Xing" || string(head[x:x+4]) == "Info") {
+			if binary.BigEndian.Uint32(head[x+4:])&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(head[x+8:]))
+			}
+		} else if x := i + 4 + 32; x+18 <= len(head) && string(head[x:x+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(head[x+14:]))
+		}
+		if frames > 0 {
+			secs := float64(frames) * float64(samplesPerFrame) / float64(sampleRate)
+			return audioInfo{Duration: time.Duration(secs * float64(time.Second))}, nil
+		}
+		// Constant bitrate: the audio data size gives the length
+		secs := float64(size-int64(i)) * 8 / float64(bitrate*1000)
+		return audioInfo{Duration: time.Duration(secs * float64(time.Second)), Bitrate: bitrate}, nil
+	}
+	return audioInfo{}, errProbeUnsupported
+}
+
+// probeWAV reads the fmt and data chunks of a RIFF/WAVE header
+func probeWAV(head []byte) (audioInfo, error) {
+	if len(head) < 12 || string(head[:4]) != "RIFF" || string(head[8:12]) != "WAVE" {
+		return audioInfo{}, errProbeUnsupported
+	}
+	byteRate := 0
+	for p := 12; p+8 <= len(head); {
+		id := string(head[p : p+4])
+		n := int(binary.LittleEndian.Uint32(head[p+4:]))
+		switch id {
+		case "fmt ":
+			if p+16 <= len(head) {
+				byteRate = int(binary.LittleEndian.Uint32(head[p+16:]))
+			}
+		case "data":
+			if byteRate == 0 {
+				return audioInfo{}, errProbeUnsupported
+			}
+			secs := float64(n) / float64(byteRate)
+			return audioInfo{Duration: time.Duration(secs * float64(time.Second)), Bitrate: byteRate * 8 / 1000}, nil
+		}
+		p += 8 + n + n&1
+	}
+	return audioInfo{}, errProbeUnsupported
+}
+
+// probeOgg takes the sample rate from the Vorbis/Opus header and the length from the last page's granule position
+func probeOgg(head, tail []byte) (audioInfo, error) {
+	rate, preSkip := 0, 0
+	if i := bytes.Index(head, []byte("\x01vorbis")); i >= 0 && i+16 <= len(head) {
+		rate = int(binary.LittleEndian.Uint32(head[i+12:]))
+	} else if i := bytes.Index(head, []byte("OpusHead")); i >= 0 && i+12 <= len(head) {
+		rate = 48000 // Opus granule positions always count 48 kHz samples
+		preSkip = int(binary.LittleEndian.Uint16(head[i+10:]))
+	}
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if rate == 0 || last < 0 || last+14 > len(tail) {
+		return audioInfo{}, errProbeUnsupported
+	}
+	granule := int64(binary.LittleEndian.Uint64(tail[last+6:]))
+	if granule <= int64(preSkip) {
+		return audioInfo{}, errProbeUnsupported
+	}
+	secs := float64(granule-int64(preSkip)) / float64(rate)
+	return audioInfo{Duration: time.Duration(secs * float64(time.Second))}, nil
+}
+
+// probeMP4 reads the movie header (mvhd), which sits either at the start or at the end of the file
+func probeMP4(head, tail []byte) (audioInfo, error) {
+	for _, buf := range [][]byte{head, tail} {
+		i := bytes.Index(buf, []byte("mvhd"))
+		if i < 0 || i+5 > len(buf) {
+			continue
+		}
+		p := i + 4
+		var timescale, duration uint64
+		if buf[p] == 1 {
+			if p+32 > len(buf) {
+				continue
+			}
+			timescale = uint64(binary.BigEndian.Uint32(buf[p+20:]))
+			duration = binary.BigEndian.Uint64(buf[p+24:])
+		} else {
+			if p+20 > len(buf) {
+				continue
+			}
+			timescale = uint64(binary.BigEndian.Uint32(buf[p+12:]))
+			duration = uint64(binary.BigEndian.Uint32(buf[p+16:]))
+		}
+		if timescale == 0 {
+			continue
+		}
+		secs := float64(duration) / float64(timescale)
+		return audioInfo{Duration: time.Duration(secs * float64(time.Second))}, nil
+	}
+	return audioInfo{}, errProbeUnsupported
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AUDIT_FILE           = "file"
+	AUDIT_S3             = "s3"
+	AUDIT_FLUSH_INTERVAL = time.Minute // S3 batches are written at least this often
+	AUDIT_FLUSH_SIZE     = 100         // or as soon as this many entries are pending
+	AUDIT_DAY_FORMAT     = "2006-01-02"
+	DEFAULT_AUDIT_LIMIT  = 1000
+	ADMIN_ACTOR          = "admin" // set on the context by RequireAdmin
+)
+
+// AUDIT_LOG records administrative and user actions: "file" appends one JSON line per
+// action to AUDIT_LOG_DIR/audit-<day>.jsonl, "s3" writes batches as audit/<day>/ documents
+// in the STATE_STORE, by default under META_DIR in the bucket
+var (
+	auditMode = os.Getenv("AUDIT_LOG")
+	auditDir  = os.Getenv("AUDIT_LOG_DIR")
+)
+
+func initAuditLog() error {
+	switch auditMode {
+	case "", "off":
+		auditMode = ""
+	case AUDIT_FILE:
+		if auditDir == "" {
+			auditDir = "audit"
+		}
+		if err := os.MkdirAll(auditDir, 0o700); err != nil {
+			return fmt.Errorf("AUDIT_LOG_DIR: %w", err)
+		}
+	case AUDIT_S3:
+	default:
+		return fmt.Errorf("invalid AUDIT_LOG: %q, expected file or s3", auditMode)
+	}
+	return nil
+}
+
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"` // e.g. track.delete, share.create, admin.auth_failed
+	Actor   string    `json:"actor"`  // "admin" or the user name
+	IP      string    `json:"ip"`
+	Library string    `json:"library,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// auditLog is append-only: entries are never changed or removed by the server
+type auditLog struct {
+	mu      sync.Mutex
+	pending []auditEntry // S3 mode, not yet written
+}
+
+var audit = &auditLog{}
+
+// record adds an action taken by the client of c
+func (a *auditLog) record(c *gin.Context, action, library, target, detail string) {
+	if auditMode == "" {
+		return
+	}
+	actor := requestUser(c) // the key's user for API key requests
+	if _, byKey := c.Get(API_KEY_CONTEXT); !byKey && c.GetBool(ADMIN_ACTOR) {
+		actor = ADMIN_ACTOR
+	}
+	e := auditEntry{Time: time.Now().UTC(), Action: action, Actor: actor, IP: c.ClientIP(), Library: library, Target: target, Detail: detail}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if auditMode == AUDIT_FILE {
+		if err := appendAuditFile(e); err != nil {
+			log.Printf("Audit log write error: %v", err)
+		}
+		return
+	}
+	a.pending = append(a.pending, e)
+	if len(a.pending) >= AUDIT_FLUSH_SIZE {
+		go a.flush(context.Background())
+	}
+}
+
+func auditFileName(day string) string {
+	return filepath.Join(auditDir, "audit-"+day+".jsonl")
+}
+
+func appendAuditFile(e auditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditFileName(e.Time.Format(AUDIT_DAY_FORMAT)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flush writes the pending entries as one object per day. Objects are never rewritten,
+// so several servers can share the bucket.
+func (a *auditLog) flush(ctx context.Context) {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+	byDay := make(map[string][]auditEntry)
+	for _, e := range pending {
+		day := e.Time.Format(AUDIT_DAY_FORMAT)
+		byDay[day] = append(byDay[day], e)
+	}
+	for day, entries := range byDay {
+		name := fmt.Sprintf("audit/%s/%d.json", day, time.Now().UnixNano())
+		if err := s3PutJSON(ctx, name, entries); err != nil {
+			log.Printf("Audit log write error, keeping %d entries: %v", len(entries), err)
+			a.mu.Lock()
+			a.pending = append(entries, a.pending...)
+			a.mu.Unlock()
+		}
+	}
+}
+
+// run flushes S3 batches periodically
+func (a *auditLog) run(ctx context.Context) {
+	if auditMode != AUDIT_S3 {
+		return
+	}
+	ticker := time.NewTicker(AUDIT_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.flush(ctx)
+		}
+	}
+}
+
+// entries returns the entries of one day, oldest first
+func (a *auditLog) entries(ctx context.Context, day string) ([]auditEntry, error) {
+	var out []auditEntry
+	if auditMode == AUDIT_FILE {
+		f, err := os.Open(auditFileName(day))
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			var e auditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				out = append(out, e)
+			}
+		}
+		return out, scanner.Err()
+	}
+	names, err := state.list(ctx, "audit/"+day+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		var batch []auditEntry
+		if err := s3GetJSON(ctx, name, &batch); err != nil {
+			return nil, err
+		}
+		out = append(out, batch...)
+	}
+	a.mu.Lock()
+	for _, e := range a.pending {
+		if e.Time.Format(AUDIT_DAY_FORMAT) == day {
+			out = append(out, e)
+		}
+	}
+	a.mu.Unlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// handleAuditLog queries the audit log (GET /admin/audit?day=2024-05-01&action=track.&actor=admin&limit=100)
+func handleAuditLog(c *gin.Context) {
+	if auditMode == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "audit log disabled, set AUDIT_LOG"})
+		return
+	}
+	day := c.DefaultQuery("day", time.Now().UTC().Format(AUDIT_DAY_FORMAT))
+	if _, err := time.Parse(AUDIT_DAY_FORMAT, day); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "day must be YYYY-MM-DD"})
+		return
+	}
+	limit := DEFAULT_AUDIT_LIMIT
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	entries, err := audit.entries(c.Request.Context(), day)
+	if err != nil {
+		log.Printf("Audit log read error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to read audit log"})
+		return
+	}
+	action, actor := c.Query("action"), c.Query("actor")
+	matched := []auditEntry{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Action, action) && (actor == "" || e.Actor == actor) {
+			matched = append(matched, e)
+		}
+	}
+	// The most recent entries are the interesting ones
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	c.JSON(http.StatusOK, gin.H{"day": day, "entries": matched})
+}
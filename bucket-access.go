@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+var (
+	s3RequesterPays = os.Getenv("S3_REQUESTER_PAYS") == "true"
+	s3SSE           = os.Getenv("S3_SSE")            // "aws:kms" or "AES256" for objects the server writes
+	s3SSEKMSKeyID   = os.Getenv("S3_SSE_KMS_KEY_ID") // optional, the bucket default key otherwise
+
+	// SSE-C key (base64, 32 bytes) used for every object read or written. Never printed.
+	s3SSECustomerKey    string
+	s3SSECustomerKeyMD5 string
+)
+
+func initBucketAccess() error {
+	switch s3SSE {
+	case "", string(types.ServerSideEncryptionAes256):
+	case string(types.ServerSideEncryptionAwsKms), string(types.ServerSideEncryptionAwsKmsDsse):
+	default:
+		return fmt.Errorf("invalid S3_SSE: %q, expected aws:kms, aws:kms:dsse or AES256", s3SSE)
+	}
+	if s3SSEKMSKeyID != "" && !strings.HasPrefix(s3SSE, "aws:kms") {
+		return fmt.Errorf("S3_SSE_KMS_KEY_ID needs S3_SSE=aws:kms")
+	}
+	if v := os.Getenv("S3_SSE_CUSTOMER_KEY"); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("invalid S3_SSE_CUSTOMER_KEY: expected a base64 encoded 256-bit key")
+		}
+		if s3SSE != "" {
+			return fmt.Errorf("S3_SSE and S3_SSE_CUSTOMER_KEY are mutually exclusive")
+		}
+		sum := md5.Sum(key)
+		s3SSECustomerKey = v
+		s3SSECustomerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return nil
+}
+
+// bucketAccessDescription summarizes the bucket access options for printConfig
+func bucketAccessDescription() string {
+	var opts []string
+	if s3RequesterPays {
+		opts = append(opts, "requester pays")
+	}
+	if s3SSE != "" {
+		opts = append(opts, "SSE "+s3SSE)
+	}
+	if s3SSECustomerKey != "" {
+		opts = append(opts, "SSE-C")
+	}
+	if len(opts) == 0 {
+		return "default"
+	}
+	return strings.Join(opts, ", ")
+}
+
+// addBucketAccessMiddleware sets the requester-pays and encryption parameters on every S3
+// operation, so call sites don't have to
+func addBucketAccessMiddleware(stack *middleware.Stack) error {
+	if !s3RequesterPays && s3SSE == "" && s3SSECustomerKey == "" {
+		return nil
+	}
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("GoMusicBucketAccess",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			applyBucketAccess(in.Parameters)
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+}
+
+func applyBucketAccess(params interface{}) {
+	var payer types.RequestPayer
+	if s3RequesterPays {
+		payer = types.RequestPayerRequester
+	}
+	var alg, key, keyMD5 *string
+	if s3SSECustomerKey != "" {
+		alg, key, keyMD5 = aws.String("AES256"), aws.String(s3SSECustomerKey), aws.String(s3SSECustomerKeyMD5)
+	}
+	var kmsKey *string
+	if s3SSEKMSKeyID != "" {
+		kmsKey = aws.String(s3SSEKMSKeyID)
+	}
+	switch in := params.(type) {
+	case *s3.GetObjectInput:
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+	case *s3.HeadObjectInput:
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+	case *s3.PutObjectInput:
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+		in.ServerSideEncryption, in.SSEKMSKeyId = types.ServerSideEncryption(s3SSE), kmsKey
+	case *s3.CopyObjectInput:
+		// Renames copy within the bucket, so the source uses the same customer key
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+		in.CopySourceSSECustomerAlgorithm, in.CopySourceSSECustomerKey, in.CopySourceSSECustomerKeyMD5 = alg, key, keyMD5
+		in.ServerSideEncryption, in.SSEKMSKeyId = types.ServerSideEncryption(s3SSE), kmsKey
+	case *s3.CreateMultipartUploadInput:
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+		in.ServerSideEncryption, in.SSEKMSKeyId = types.ServerSideEncryption(s3SSE), kmsKey
+	case *s3.UploadPartInput:
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+	case *s3.CompleteMultipartUploadInput:
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+	case *s3.ListPartsInput:
+		in.RequestPayer = payer
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = alg, key, keyMD5
+	case *s3.AbortMultipartUploadInput:
+		in.RequestPayer = payer
+	case *s3.DeleteObjectInput:
+		in.RequestPayer = payer
+	case *s3.ListObjectsV2Input:
+		in.RequestPayer = payer
+	}
+}
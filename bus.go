@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Internal event types published on the event bus
+const (
+	EVENT_SCAN_PROGRESS      = "scan"       // directory walk progress
+	EVENT_LIBRARY_CHANGED    = "library"    // a full listing differs from the previous one
+	EVENT_PLAY_STARTED       = "nowplaying" // a client started playing a track
+	EVENT_COLLECTION_CHANGED = "collection" // a collection was created, replaced or removed
+	EVENT_SEARCH             = "search"     // a search finished
+	EVENT_SEARCH_JOB         = "searchjob"  // a background search finished
+	EVENT_QUEUE_CHANGED      = "queue"      // a user's play queue changed
+	EVENT_PLAY_FINISHED      = "played"     // a client played a track to its end
+	EVENT_LIBRARY_SCANNED    = "scanned"    // a duration scan of a library finished
+	EVENT_TRACKS_ADDED       = "added"      // a scan found tracks that weren't there before, or an upload added one
+	EVENT_ERROR              = "error"      // a scan failed or a request ended in a server error
+	EVENT_REPORT             = "report"     // a listening report was sent
+
+	EVENT_ALL        = "*" // subscribe to every event type
+	EVENT_QUEUE_SIZE = 64  // events buffered per subscriber before dropping
+)
+
+// Event is a message passed between subsystems
+type Event struct {
+	Type string
+	Time time.Time
+	Data map[string]interface{}
+}
+
+// subscription delivers events to one handler from its own goroutine,
+// so a slow subscriber never blocks publishers or other subscribers
+type subscription struct {
+	name  string
+	queue chan Event
+}
+
+// EventBus fans internal events out to subscribed subsystems
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[string][]*subscription
+}
+
+var eventBus = &EventBus{subs: make(map[string][]*subscription)}
+
+// Subscribe registers fn for events of the given type (or EVENT_ALL)
+func (b *EventBus) Subscribe(name, eventType string, fn func(Event)) {
+	sub := &subscription{name: name, queue: make(chan Event, EVENT_QUEUE_SIZE)}
+	go func() {
+		for ev := range sub.queue {
+			fn(ev)
+		}
+	}()
+	b.mu.Lock()
+	b.subs[eventType] = append(b.subs[eventType], sub)
+	b.mu.Unlock()
+}
+
+// Publish delivers an event to all matching subscribers without blocking
+func (b *EventBus) Publish(eventType string, data map[string]interface{}) {
+	ev := Event{Type: eventType, Time: time.Now(), Data: data}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, key := range []string{eventType, EVENT_ALL} {
+		for _, sub := range b.subs[key] {
+			select {
+			case sub.queue <- ev:
+			default:
+				log.Printf("Event bus: dropping %s event for slow subscriber %s", eventType, sub.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CACHE_HEADER_BYTES = 8 // stored values start with their expiry in unix nanoseconds, 0 = none
+	CACHE_IO_TIMEOUT   = 5 * time.Second
+	REDIS_MAX_IDLE     = 4
+)
+
+var errCacheMiss = errors.New("not cached")
+
+// Cache is a size-bounded key/value cache
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+	Purge()
+	Stats() cacheStats
+}
+
+// cacheStats is what admin endpoints and metrics report per layer
+type cacheStats struct {
+	Layer     string `json:"layer"`
+	Backend   string `json:"backend"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"maxBytes"`
+	TTL       string `json:"ttl,omitempty"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+}
+
+// cacheStore holds the values of a layer; the layer keeps the index, limits and counters
+type cacheStore interface {
+	load(name string) ([]byte, error)
+	save(name string, data []byte, ttl time.Duration) error
+	remove(name string)
+}
+
+// Cache layers, configured by CACHE_<LAYER>=backend[:maxMB[:ttl]] with backend one of
+// memory, disk, redis, s3 or off. A nil layer is disabled and always misses.
+var (
+	listingCache   *cacheLayer // directory listings
+	artworkCache   *cacheLayer // folder cover images
+	thumbnailCache *cacheLayer // resized cover images
+	metadataCache  *cacheLayer // object HEAD results
+	transcodeCache *cacheLayer // converted audio
+	responseCache  *cacheLayer // browse, search and getAll responses
+
+	cacheLayers []*cacheLayer
+
+	cacheLayerDir = os.Getenv("CACHE_LAYER_DIR") // disk layers, default <tmp>/go-music-cache
+	redisAddr     = os.Getenv("CACHE_REDIS_ADDR")
+	redisPassword = os.Getenv("CACHE_REDIS_PASSWORD")
+)
+
+var cacheLayerConfig = []struct {
+	name string
+	dst  **cacheLayer
+	def  string
+}{
+	{"listings", &listingCache, "memory:16:30s"},
+	{"artwork", &artworkCache, "memory:32:1h"},
+	{"thumbnails", &thumbnailCache, "disk:256:720h"},
+	{"metadata", &metadataCache, "memory:8:1m"},
+	{"transcodes", &transcodeCache, "off"},
+	{"responses", &responseCache, "memory:32:30s"},
+}
+
+func initCacheLayers() error {
+	if cacheLayerDir == "" {
+		cacheLayerDir = filepath.Join(os.TempDir(), "go-music-cache")
+	}
+	for _, cfg := range cacheLayerConfig {
+		env := "CACHE_" + strings.ToUpper(cfg.name)
+		spec := os.Getenv(env)
+		if spec == "" {
+			spec = cfg.def
+		}
+		layer, err := newCacheLayer(cfg.name, spec)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", env, err)
+		}
+		if layer != nil {
+			*cfg.dst = layer
+			cacheLayers = append(cacheLayers, layer)
+		}
+	}
+	eventBus.Subscribe("listing-cache", EVENT_LIBRARY_CHANGED, func(ev Event) {
+		listingCache.Purge()
+		responseCache.Purge()
+	})
+	return nil
+}
+
+// newCacheLayer parses backend[:maxMB[:ttl]]; "off" returns nil
+func newCacheLayer(name, spec string) (*cacheLayer, error) {
+	parts := strings.Split(spec, ":")
+	backend := strings.TrimSpace(parts[0])
+	if backend == "off" {
+		return nil, nil
+	}
+	l := &cacheLayer{name: name, backend: backend, maxBytes: 64 << 20, lru: list.New(), entries: make(map[string]*list.Element)}
+	if len(parts) > 1 {
+		mb, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || mb <= 0 {
+			return nil, fmt.Errorf("size %q is not a positive number of MB", parts[1])
+		}
+		l.maxBytes = mb << 20
+	}
+	if len(parts) > 2 {
+		ttl, err := time.ParseDuration(parts[2])
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid ttl %q", parts[2])
+		}
+		l.ttl = ttl
+	}
+	switch backend {
+	case "memory":
+		l.store = &memoryStore{values: make(map[string][]byte)}
+	case "disk":
+		ds := &diskStore{dir: filepath.Join(cacheLayerDir, name)}
+		l.store = ds
+		if err := l.indexDisk(ds); err != nil {
+			return nil, err
+		}
+	case "redis":
+		if redisAddr == "" {
+			return nil, fmt.Errorf("redis backend needs CACHE_REDIS_ADDR")
+		}
+		l.store = &redisStore{addr: redisAddr, password: redisPassword, prefix: "go-music:" + name + ":"}
+	case "s3":
+		// Objects left by a previous run are not indexed; expire META_DIR/cache/ with a lifecycle rule
+		l.store = &s3Store{prefix: "cache/" + name + "/"}
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expected memory, disk, redis, s3 or off", backend)
+	}
+	return l, nil
+}
+
+// cacheLayer is an LRU index with a byte limit and TTL over a cacheStore
+type cacheLayer struct {
+	name    string
+	backend string
+	store   cacheStore
+
+	mu       sync.Mutex
+	lru      *list.List               // front = most recently used
+	entries  map[string]*list.Element // hashed key -> element
+	size     int64
+	maxBytes int64
+	ttl      time.Duration
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type layerEntry struct {
+	name    string
+	size    int64
+	expires time.Time // zero = no expiry
+}
+
+var _ Cache = (*cacheLayer)(nil)
+
+// layerName hashes a cache key into a name every store accepts
+func layerName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the value of key unless it is missing or expired
+func (l *cacheLayer) Get(key string) ([]byte, bool) {
+	if l == nil {
+		return nil, false
+	}
+	name := layerName(key)
+	l.mu.Lock()
+	el, ok := l.entries[name]
+	if ok {
+		if e := el.Value.(*layerEntry); !e.expires.IsZero() && time.Now().After(e.expires) {
+			l.removeLocked(el)
+			ok = false
+			defer l.store.remove(name)
+		} else {
+			l.lru.MoveToFront(el)
+		}
+	}
+	l.mu.Unlock()
+	if !ok {
+		l.misses.Add(1)
+		return nil, false
+	}
+	data, err := l.store.load(name)
+	if err == nil && len(data) >= CACHE_HEADER_BYTES {
+		exp := int64(binary.BigEndian.Uint64(data))
+		if exp == 0 || time.Now().UnixNano() < exp {
+			l.hits.Add(1)
+			return data[CACHE_HEADER_BYTES:], true
+		}
+	}
+	if err != nil && !errors.Is(err, errCacheMiss) {
+		log.Printf("Cache %s read error: %v", l.name, err)
+	}
+	l.drop(name)
+	l.misses.Add(1)
+	return nil, false
+}
+
+// Set stores value under key; values larger than the layer are not cached
+func (l *cacheLayer) Set(key string, value []byte) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	ttl := l.ttl
+	l.mu.Unlock()
+	l.SetTTL(key, value, ttl)
+}
+
+// SetTTL stores value under key with its own TTL instead of the layer's, 0 = no expiry
+func (l *cacheLayer) SetTTL(key string, value []byte, ttl time.Duration) {
+	if l == nil {
+		return
+	}
+	size := int64(len(value) + CACHE_HEADER_BYTES)
+	l.mu.Lock()
+	maxBytes := l.maxBytes
+	l.mu.Unlock()
+	if size > maxBytes {
+		return
+	}
+	var expires time.Time
+	data := make([]byte, CACHE_HEADER_BYTES, size)
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+		binary.BigEndian.PutUint64(data, uint64(expires.UnixNano()))
+	}
+	data = append(data, value...)
+	name := layerName(key)
+	if err := l.store.save(name, data, ttl); err != nil {
+		log.Printf("Cache %s write error: %v", l.name, err)
+		return
+	}
+	l.mu.Lock()
+	if el, ok := l.entries[name]; ok {
+		l.removeLocked(el)
+	}
+	l.entries[name] = l.lru.PushFront(&layerEntry{name: name, size: size, expires: expires})
+	l.size += size
+	victims := l.evictLocked()
+	l.mu.Unlock()
+	l.removeAll(victims)
+}
+
+// Delete removes key
+func (l *cacheLayer) Delete(key string) {
+	if l == nil {
+		return
+	}
+	l.drop(layerName(key))
+}
+
+// Purge removes every entry
+func (l *cacheLayer) Purge() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	var names []string
+	for name, el := range l.entries {
+		names = append(names, name)
+		l.removeLocked(el)
+	}
+	l.mu.Unlock()
+	l.removeAll(names)
+}
+
+func (l *cacheLayer) Stats() cacheStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := cacheStats{Layer: l.name, Backend: l.backend, Entries: len(l.entries), Bytes: l.size, MaxBytes: l.maxBytes,
+		Hits: l.hits.Load(), Misses: l.misses.Load(), Evictions: l.evictions.Load()}
+	if l.ttl > 0 {
+		st.TTL = l.ttl.String()
+	}
+	return st
+}
+
+// TTL is the expiry of new entries, 0 when they don't expire
+func (l *cacheLayer) TTL() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ttl
+}
+
+// setLimits changes the size limit and TTL at runtime; the TTL applies to new entries
+func (l *cacheLayer) setLimits(maxBytes int64, ttl time.Duration) {
+	l.mu.Lock()
+	l.maxBytes, l.ttl = maxBytes, ttl
+	victims := l.evictLocked()
+	l.mu.Unlock()
+	l.removeAll(victims)
+}
+
+func (l *cacheLayer) drop(name string) {
+	l.mu.Lock()
+	el, ok := l.entries[name]
+	if ok {
+		l.removeLocked(el)
+	}
+	l.mu.Unlock()
+	if ok {
+		l.store.remove(name)
+	}
+}
+
+func (l *cacheLayer) removeLocked(el *list.Element) {
+	e := el.Value.(*layerEntry)
+	l.lru.Remove(el)
+	delete(l.entries, e.name)
+	l.size -= e.size
+}
+
+// evictLocked drops least recently used entries over the limit and returns their names,
+// so that slow stores are cleaned up outside the lock
+func (l *cacheLayer) evictLocked() []string {
+	var victims []string
+	for l.size > l.maxBytes {
+		el := l.lru.Back()
+		if el == nil {
+			break
+		}
+		victims = append(victims, el.Value.(*layerEntry).name)
+		l.removeLocked(el)
+		l.evictions.Add(1)
+	}
+	return victims
+}
+
+func (l *cacheLayer) removeAll(names []string) {
+	for _, name := range names {
+		l.store.remove(name)
+	}
+}
+
+// indexDisk picks up files left from a previous run, oldest first
+func (l *cacheLayer) indexDisk(ds *diskStore) error {
+	if err := os.MkdirAll(ds.dir, 0o755); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return err
+	}
+	var infos []os.FileInfo
+	for _, f := range files {
+		if info, err := f.Info(); err == nil && !f.IsDir() && filepath.Ext(f.Name()) != ".tmp" {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		l.entries[info.Name()] = l.lru.PushFront(&layerEntry{name: info.Name(), size: info.Size()})
+		l.size += info.Size()
+	}
+	l.removeAll(l.evictLocked())
+	return nil
+}
+
+// memoryStore keeps values in the process
+type memoryStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+func (m *memoryStore) load(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if v, ok := m.values[name]; ok {
+		return v, nil
+	}
+	return nil, errCacheMiss
+}
+
+func (m *memoryStore) save(name string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	m.values[name] = data
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) remove(name string) {
+	m.mu.Lock()
+	delete(m.values, name)
+	m.mu.Unlock()
+}
+
+// diskStore keeps one file per value
+type diskStore struct {
+	dir string
+}
+
+func (d *diskStore) load(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if os.IsNotExist(err) {
+		return nil, errCacheMiss
+	}
+	return data, err
+}
+
+func (d *diskStore) save(name string, data []byte, ttl time.Duration) error {
+	tmp, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), filepath.Join(d.dir, name))
+}
+
+func (d *diskStore) remove(name string) {
+	os.Remove(filepath.Join(d.dir, name))
+}
+
+// s3Store keeps values as metadata objects under META_DIR/cache/<layer>/
+type s3Store struct {
+	prefix string
+}
+
+func (s *s3Store) load(name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CACHE_IO_TIMEOUT)
+	defer cancel()
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(metaKey(s.prefix + name)),
+	})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, errCacheMiss
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) save(name string, data []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), CACHE_IO_TIMEOUT)
+	defer cancel()
+	_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(metaKey(s.prefix + name)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *s3Store) remove(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), CACHE_IO_TIMEOUT)
+	defer cancel()
+	if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(metaKey(s.prefix + name)),
+	}); err != nil {
+		log.Printf("Cache object delete error: %v", err)
+	}
+}
+
+// redisStore talks the Redis protocol over a small pool of connections
+type redisStore struct {
+	addr     string
+	password string
+	prefix   string
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (rs *redisStore) load(name string) ([]byte, error) {
+	reply, err := rs.do("GET", rs.prefix+name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, errCacheMiss
+	}
+	return data, nil
+}
+
+func (rs *redisStore) save(name string, data []byte, ttl time.Duration) error {
+	args := []string{"SET", rs.prefix + name, string(data)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := rs.do(args...)
+	return err
+}
+
+func (rs *redisStore) remove(name string) {
+	if _, err := rs.do("DEL", rs.prefix+name); err != nil {
+		log.Printf("Cache redis delete error: %v", err)
+	}
+}
+
+// do sends one command and reads its reply: string, int64, []byte or nil
+func (rs *redisStore) do(args ...string) (interface{}, error) {
+	conn, err := rs.conn()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(CACHE_IO_TIMEOUT))
+	reply, err := conn.command(args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			conn.Close()
+			return nil, err
+		}
+	}
+	rs.mu.Lock()
+	if len(rs.idle) < REDIS_MAX_IDLE {
+		rs.idle = append(rs.idle, conn)
+		conn = nil
+	}
+	rs.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (rs *redisStore) conn() (*redisConn, error) {
+	rs.mu.Lock()
+	if n := len(rs.idle); n > 0 {
+		conn := rs.idle[n-1]
+		rs.idle = rs.idle[:n-1]
+		rs.mu.Unlock()
+		return conn, nil
+	}
+	rs.mu.Unlock()
+	nc, err := net.DialTimeout("tcp", rs.addr, CACHE_IO_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if rs.password != "" {
+		conn.SetDeadline(time.Now().Add(CACHE_IO_TIMEOUT))
+		if _, err := conn.command("AUTH", rs.password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) command(args ...string) (interface{}, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := rc.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // $-1 is a missing key
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// findCacheLayer returns the enabled layer with the given name
+func findCacheLayer(name string) *cacheLayer {
+	for _, l := range cacheLayers {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// handleCacheLayers reports every enabled layer (GET /admin/cache/layers)
+func handleCacheLayers(c *gin.Context) {
+	stats := make([]cacheStats, 0, len(cacheLayers))
+	for _, l := range cacheLayers {
+		stats = append(stats, l.Stats())
+	}
+	c.JSON(http.StatusOK, gin.H{"layers": stats})
+}
+
+// handleSetCacheLayer changes a layer's size limit or TTL until restart
+// (PUT /admin/cache/layers/:name, {"maxMB":64,"ttl":"5m"})
+func handleSetCacheLayer(c *gin.Context) {
+	l := findCacheLayer(c.Param("name"))
+	if l == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown or disabled cache layer"})
+		return
+	}
+	var req struct {
+		MaxMB *int64  `json:"maxMB"`
+		TTL   *string `json:"ttl"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	st := l.Stats()
+	maxBytes := st.MaxBytes
+	if req.MaxMB != nil {
+		if *req.MaxMB < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "maxMB must not be negative"})
+			return
+		}
+		maxBytes = *req.MaxMB << 20
+	}
+	l.mu.Lock()
+	ttl := l.ttl
+	l.mu.Unlock()
+	if req.TTL != nil {
+		d, err := time.ParseDuration(*req.TTL)
+		if *req.TTL == "" {
+			d, err = 0, nil
+		}
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ttl"})
+			return
+		}
+		ttl = d
+	}
+	l.setLimits(maxBytes, ttl)
+	log.Printf("Cache %s limits set to %d MB, ttl %s", l.name, maxBytes>>20, ttl)
+	c.JSON(http.StatusOK, l.Stats())
+}
+
+// writeCacheLayerMetrics adds per-layer counters to the Prometheus output
+func writeCacheLayerMetrics(b *strings.Builder) {
+	if len(cacheLayers) == 0 {
+		return
+	}
+	stats := make([]cacheStats, len(cacheLayers))
+	for i, l := range cacheLayers {
+		stats[i] = l.Stats()
+	}
+	for _, m := range []struct {
+		name, kind string
+		value      func(cacheStats) int64
+	}{
+		{"go_music_cache_layer_hits_total", "counter", func(s cacheStats) int64 { return s.Hits }},
+		{"go_music_cache_layer_misses_total", "counter", func(s cacheStats) int64 { return s.Misses }},
+		{"go_music_cache_layer_evictions_total", "counter", func(s cacheStats) int64 { return s.Evictions }},
+		{"go_music_cache_layer_entries", "gauge", func(s cacheStats) int64 { return int64(s.Entries) }},
+		{"go_music_cache_layer_bytes", "gauge", func(s cacheStats) int64 { return s.Bytes }},
+		{"go_music_cache_layer_max_bytes", "gauge", func(s cacheStats) int64 { return s.MaxBytes }},
+	} {
+		fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.kind)
+		for _, s := range stats {
+			fmt.Fprintf(b, "%s{layer=%q,backend=%q} %d\n", m.name, s.Layer, s.Backend, m.value(s))
+		}
+	}
+}
@@ -0,0 +1,884 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	CAST_MDNS_ADDR          = "224.0.0.251:5353"
+	CAST_SERVICE            = "_googlecast._tcp.local."
+	CAST_DISCOVERY_INTERVAL = time.Minute
+	CAST_DISCOVERY_WAIT     = 2 * time.Second // for answers to one query
+	CAST_DEVICE_EXPIRY      = 5 * time.Minute // unseen devices drop off the list
+	CAST_TIMEOUT            = 10 * time.Second
+	CAST_HEARTBEAT          = 5 * time.Second
+	CAST_MAX_MESSAGE        = 64 << 10 // the protocol's limit
+	CAST_MAX_ITEMS          = 50       // tracks in one load, to stay under the message limit
+	CAST_MEDIA_RECEIVER     = "CC1AD845"
+
+	CAST_NS_CONNECTION = "urn:x-cast:com.google.cast.tp.connection"
+	CAST_NS_HEARTBEAT  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	CAST_NS_RECEIVER   = "urn:x-cast:com.google.cast.receiver"
+	CAST_NS_MEDIA      = "urn:x-cast:com.google.cast.media"
+	CAST_SENDER        = "sender-go-music"
+	CAST_RECEIVER      = "receiver-0"
+)
+
+// CAST=true discovers Chromecast and other Google Cast devices on the LAN over mDNS and
+// lets API clients cast tracks or playlists to them. The server holds the connection and
+// drives the device, so the phone that started playback can lock its screen. Devices
+// fetch the /audio URLs without credentials, so it is refused with USER_HOMES. They are
+// given this server's address as the client saw it; CAST_URL (e.g.
+// "http://192.168.1.10:8080") overrides it when that address isn't reachable from the LAN.
+var (
+	castEnabled = os.Getenv("CAST") == "true"
+	castURL     = strings.TrimRight(os.Getenv("CAST_URL"), "/")
+)
+
+func initCast() error {
+	if !castEnabled {
+		return nil
+	}
+	if userHomes {
+		return fmt.Errorf("CAST cannot be used with USER_HOMES, cast devices don't sign in")
+	}
+	if castURL != "" && !strings.HasPrefix(castURL, "http://") && !strings.HasPrefix(castURL, "https://") {
+		return fmt.Errorf("CAST_URL must be an http:// or https:// URL")
+	}
+	return nil
+}
+
+// --- DISCOVERY ---
+
+type castDevice struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Model string `json:"model,omitempty"`
+	Addr  string `json:"address"`
+	seen  time.Time
+}
+
+type castRegistry struct {
+	mu       sync.Mutex
+	devices  map[string]*castDevice
+	sessions map[string]*castSession
+}
+
+var castDevices = &castRegistry{devices: make(map[string]*castDevice), sessions: make(map[string]*castSession)}
+
+// runCastDiscovery queries for cast devices until ctx is done
+func runCastDiscovery(ctx context.Context) {
+	for {
+		devices, err := discoverCast(ctx, CAST_DISCOVERY_WAIT)
+		if err != nil {
+			log.Printf("Cast discovery error: %v", err)
+		}
+		castDevices.seen(devices, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(CAST_DISCOVERY_INTERVAL):
+		}
+	}
+}
+
+// discoverCast sends one mDNS query and collects the devices answering within wait.
+// The query comes from an ephemeral port, so answers are sent back by unicast.
+func discoverCast(ctx context.Context, wait time.Duration) ([]castDevice, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	group, _ := net.ResolveUDPAddr("udp4", CAST_MDNS_ADDR)
+	query, err := castQuery()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(query, group); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	found := make(map[string]castDevice)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // the deadline
+		}
+		if !ipAllowed(src.IP.String()) {
+			continue
+		}
+		for _, dev := range parseCastAnswer(buf[:n]) {
+			found[dev.ID] = dev
+		}
+	}
+	devices := make([]castDevice, 0, len(found))
+	for _, dev := range found {
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// castQuery asks for the cast service, preferring a unicast answer
+func castQuery() ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.StartQuestions()
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(CAST_SERVICE),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET | 1<<15, // the QU bit
+	}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseCastAnswer reads the devices of an mDNS response: the PTR names an instance,
+// its SRV the host and port, its TXT the id, friendly name and model, and A the address
+func parseCastAnswer(msg []byte) []castDevice {
+	var p dnsmessage.Parser
+	if h, err := p.Start(msg); err != nil || !h.Response {
+		return nil
+	}
+	if p.SkipAllQuestions() != nil {
+		return nil
+	}
+	var instances []string
+	srv := make(map[string]dnsmessage.SRVResource)
+	txt := make(map[string]map[string]string)
+	addrs := make(map[string]net.IP)
+	record := func(h dnsmessage.ResourceHeader) error {
+		name := strings.ToLower(h.Name.String())
+		switch h.Type {
+		case dnsmessage.TypePTR:
+			r, err := p.PTRResource()
+			if err == nil && name == CAST_SERVICE {
+				instances = append(instances, strings.ToLower(r.PTR.String()))
+			}
+			return err
+		case dnsmessage.TypeSRV:
+			r, err := p.SRVResource()
+			srv[name] = r
+			return err
+		case dnsmessage.TypeTXT:
+			r, err := p.TXTResource()
+			kv := make(map[string]string)
+			for _, s := range r.TXT {
+				if k, v, ok := strings.Cut(s, "="); ok {
+					kv[k] = v
+				}
+			}
+			txt[name] = kv
+			return err
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			addrs[name] = net.IP(r.A[:])
+			return err
+		}
+		_, err := p.UnknownResource()
+		return err
+	}
+	// Responders put the SRV, TXT and A records in either section
+	for additional := false; ; {
+		var h dnsmessage.ResourceHeader
+		var err error
+		if additional {
+			h, err = p.AdditionalHeader()
+		} else {
+			h, err = p.AnswerHeader()
+		}
+		if err == dnsmessage.ErrSectionDone && !additional {
+			if p.SkipAllAuthorities() != nil {
+				break
+			}
+			additional = true
+			continue
+		}
+		if err != nil || record(h) != nil {
+			break
+		}
+	}
+	var devices []castDevice
+	for _, inst := range instances {
+		s, ok := srv[inst]
+		ip := addrs[strings.ToLower(s.Target.String())]
+		if !ok || ip == nil {
+			continue
+		}
+		kv := txt[inst]
+		dev := castDevice{ID: kv["id"], Name: kv["fn"], Model: kv["md"], Addr: net.JoinHostPort(ip.String(), strconv.Itoa(int(s.Port)))}
+		if dev.ID == "" {
+			dev.ID = strings.TrimSuffix(inst, "."+CAST_SERVICE)
+		}
+		if dev.Name == "" {
+			dev.Name = dev.ID
+		}
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// seen records the devices found by a discovery and forgets those gone for a while
+func (r *castRegistry) seen(devices []castDevice, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, dev := range devices {
+		dev.seen = now
+		r.devices[dev.ID] = &dev
+	}
+	for id, dev := range r.devices {
+		if now.Sub(dev.seen) > CAST_DEVICE_EXPIRY {
+			delete(r.devices, id)
+		}
+	}
+}
+
+// list returns the known devices by name
+func (r *castRegistry) list() []castDevice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	devices := make([]castDevice, 0, len(r.devices))
+	for _, dev := range r.devices {
+		devices = append(devices, *dev)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices
+}
+
+// session returns the open connection to a device, connecting if there is none
+func (r *castRegistry) session(id string) (*castSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dev, ok := r.devices[id]
+	if !ok {
+		return nil, errCastUnknown
+	}
+	if s, ok := r.sessions[id]; ok && s.alive() {
+		return s, nil
+	}
+	s, err := dialCast(*dev)
+	if err != nil {
+		return nil, err
+	}
+	r.sessions[id] = s
+	return s, nil
+}
+
+// --- PROTOCOL ---
+
+var (
+	errCastUnknown = errors.New("unknown cast device")
+	errCastIdle    = errors.New("nothing loaded on the cast device")
+)
+
+// castMessage is the CastMessage protobuf of the Cast v2 protocol, with a UTF-8 payload
+type castMessage struct {
+	source, destination, namespace, payload string
+}
+
+// marshal encodes m as a length-prefixed frame
+func (m castMessage) marshal() []byte {
+	b := make([]byte, 4, 4+len(m.payload)+128)
+	b = protowire.AppendTag(b, 1, protowire.VarintType) // protocol_version CASTV2_1_0
+	b = protowire.AppendVarint(b, 0)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, m.source)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, m.destination)
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendString(b, m.namespace)
+	b = protowire.AppendTag(b, 5, protowire.VarintType) // payload_type STRING
+	b = protowire.AppendVarint(b, 0)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendString(b, m.payload)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+// readCastMessage reads one frame; binary payloads come back empty
+func readCastMessage(r io.Reader) (castMessage, error) {
+	var m castMessage
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return m, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > CAST_MAX_MESSAGE {
+		return m, fmt.Errorf("cast message of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return m, err
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return m, protowire.ParseError(n)
+			}
+			switch num {
+			case 2:
+				m.source = v
+			case 3:
+				m.destination = v
+			case 4:
+				m.namespace = v
+			case 6:
+				m.payload = v
+			}
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return m, nil
+}
+
+// castReply is a message answering a request
+type castReply struct {
+	Type string `json:"type"`
+	raw  []byte
+}
+
+// castSession is a connection to a device, with the media receiver app once launched
+type castSession struct {
+	dev     castDevice
+	conn    net.Conn
+	wmu     sync.Mutex // one frame at a time
+	mu      sync.Mutex
+	lastID  int
+	waiting map[int]chan castReply
+	done    chan struct{}
+
+	transport    string // of the media receiver, "" until it runs
+	mediaSession int
+	media        json.RawMessage // the last media status
+	volume       float64
+	muted        bool
+}
+
+// dialCast connects to a device. Devices present certificates of Google's device CA
+// for no hostname, so they aren't verified; only the LAN address identifies them.
+func dialCast(dev castDevice) (*castSession, error) {
+	dialer := &net.Dialer{Timeout: CAST_TIMEOUT}
+	conn, err := tls.DialWithDialer(dialer, "tcp", dev.Addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	s := &castSession{dev: dev, conn: conn, waiting: make(map[int]chan castReply), done: make(chan struct{})}
+	if err := s.send(CAST_NS_CONNECTION, CAST_RECEIVER, map[string]interface{}{"type": "CONNECT"}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go s.read()
+	go s.heartbeat()
+	return s, nil
+}
+
+func (s *castSession) alive() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *castSession) close() {
+	s.conn.Close()
+}
+
+// send writes a message without waiting for an answer
+func (s *castSession) send(namespace, destination string, payload map[string]interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if len(data) > CAST_MAX_MESSAGE-1024 {
+		return fmt.Errorf("cast message of %d bytes", len(data))
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(CAST_TIMEOUT))
+	_, err = s.conn.Write(castMessage{source: CAST_SENDER, destination: destination, namespace: namespace, payload: string(data)}.marshal())
+	return err
+}
+
+// request sends a message with a request ID and waits for the answer carrying it
+func (s *castSession) request(ctx context.Context, namespace, destination string, payload map[string]interface{}) (castReply, error) {
+	s.mu.Lock()
+	s.lastID++
+	id := s.lastID
+	ch := make(chan castReply, 1)
+	s.waiting[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.waiting, id)
+		s.mu.Unlock()
+	}()
+	payload["requestId"] = id
+	if err := s.send(namespace, destination, payload); err != nil {
+		s.close()
+		return castReply{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, CAST_TIMEOUT)
+	defer cancel()
+	select {
+	case reply := <-ch:
+		switch reply.Type {
+		case "LOAD_FAILED", "LOAD_CANCELLED", "INVALID_REQUEST", "INVALID_PLAYER_STATE", "LAUNCH_ERROR":
+			return reply, fmt.Errorf("cast device answered %s", reply.Type)
+		}
+		return reply, nil
+	case <-s.done:
+		return castReply{}, errors.New("cast device closed the connection")
+	case <-ctx.Done():
+		return castReply{}, ctx.Err()
+	}
+}
+
+// read handles incoming messages until the connection fails
+func (s *castSession) read() {
+	defer close(s.done)
+	defer s.conn.Close()
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(3 * CAST_HEARTBEAT))
+		m, err := readCastMessage(s.conn)
+		if err != nil {
+			return
+		}
+		var head struct {
+			Type      string `json:"type"`
+			RequestID int    `json:"requestId"`
+		}
+		if json.Unmarshal([]byte(m.payload), &head) != nil {
+			continue
+		}
+		switch {
+		case m.namespace == CAST_NS_HEARTBEAT && head.Type == "PING":
+			s.send(CAST_NS_HEARTBEAT, m.source, map[string]interface{}{"type": "PONG"})
+		case m.namespace == CAST_NS_CONNECTION && head.Type == "CLOSE":
+			if m.source == CAST_RECEIVER {
+				return
+			}
+			s.mu.Lock()
+			if m.source == s.transport {
+				s.transport, s.mediaSession, s.media = "", 0, nil
+			}
+			s.mu.Unlock()
+		case head.Type == "RECEIVER_STATUS":
+			s.receiverStatus([]byte(m.payload))
+		case head.Type == "MEDIA_STATUS":
+			s.mediaStatus([]byte(m.payload))
+		}
+		if head.RequestID != 0 {
+			s.mu.Lock()
+			ch := s.waiting[head.RequestID]
+			s.mu.Unlock()
+			if ch != nil {
+				select {
+				case ch <- castReply{Type: head.Type, raw: []byte(m.payload)}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// heartbeat pings the device so it keeps the connection
+func (s *castSession) heartbeat() {
+	ticker := time.NewTicker(CAST_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.send(CAST_NS_HEARTBEAT, CAST_RECEIVER, map[string]interface{}{"type": "PING"}) != nil {
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+// receiverStatus notes the volume and whether the media receiver runs
+func (s *castSession) receiverStatus(payload []byte) {
+	var st struct {
+		Status struct {
+			Applications []struct {
+				AppID       string `json:"appId"`
+				TransportID string `json:"transportId"`
+			} `json:"applications"`
+			Volume struct {
+				Level *float64 `json:"level"`
+				Muted *bool    `json:"muted"`
+			} `json:"volume"`
+		} `json:"status"`
+	}
+	if json.Unmarshal(payload, &st) != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.Status.Volume.Level != nil {
+		s.volume = *st.Status.Volume.Level
+	}
+	if st.Status.Volume.Muted != nil {
+		s.muted = *st.Status.Volume.Muted
+	}
+	transport := ""
+	for _, app := range st.Status.Applications {
+		if app.AppID == CAST_MEDIA_RECEIVER {
+			transport = app.TransportID
+		}
+	}
+	if transport != s.transport {
+		s.transport, s.mediaSession, s.media = transport, 0, nil
+	}
+}
+
+// mediaStatus keeps the latest status of the media session
+func (s *castSession) mediaStatus(payload []byte) {
+	var st struct {
+		Status []json.RawMessage `json:"status"`
+	}
+	if json.Unmarshal(payload, &st) != nil || len(st.Status) == 0 {
+		return
+	}
+	var head struct {
+		MediaSessionID int `json:"mediaSessionId"`
+	}
+	json.Unmarshal(st.Status[0], &head)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mediaSession, s.media = head.MediaSessionID, st.Status[0]
+}
+
+// launch starts the default media receiver unless it runs, and connects to it
+func (s *castSession) launch(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	transport := s.transport
+	s.mu.Unlock()
+	if transport != "" {
+		return transport, nil
+	}
+	if _, err := s.request(ctx, CAST_NS_RECEIVER, CAST_RECEIVER, map[string]interface{}{"type": "LAUNCH", "appId": CAST_MEDIA_RECEIVER}); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	transport = s.transport
+	s.mu.Unlock()
+	if transport == "" {
+		return "", errors.New("cast device did not start the media receiver")
+	}
+	return transport, s.send(CAST_NS_CONNECTION, transport, map[string]interface{}{"type": "CONNECT"})
+}
+
+// castItem is a track as the media receiver queues it
+type castItem struct {
+	url, contentType, title, artist, album string
+	duration                               int
+}
+
+// load replaces what the device plays with items, starting at start
+func (s *castSession) load(ctx context.Context, items []castItem, start int) error {
+	transport, err := s.launch(ctx)
+	if err != nil {
+		return err
+	}
+	queue := make([]map[string]interface{}, len(items))
+	for i, it := range items {
+		metadata := map[string]interface{}{"metadataType": 3, "title": it.title} // a music track
+		if it.artist != "" {
+			metadata["artist"] = it.artist
+		}
+		if it.album != "" {
+			metadata["albumName"] = it.album
+		}
+		media := map[string]interface{}{"contentId": it.url, "contentType": it.contentType, "streamType": "BUFFERED", "metadata": metadata}
+		if it.duration > 0 {
+			media["duration"] = it.duration
+		}
+		queue[i] = map[string]interface{}{"media": media, "autoplay": true, "preloadTime": 10}
+	}
+	_, err = s.request(ctx, CAST_NS_MEDIA, transport, map[string]interface{}{
+		"type": "QUEUE_LOAD", "items": queue, "startIndex": start, "repeatMode": "REPEAT_OFF",
+	})
+	return err
+}
+
+// control sends a playback command for the loaded media
+func (s *castSession) control(ctx context.Context, payload map[string]interface{}) error {
+	s.mu.Lock()
+	transport, session := s.transport, s.mediaSession
+	s.mu.Unlock()
+	if transport == "" || session == 0 {
+		return errCastIdle
+	}
+	payload["mediaSessionId"] = session
+	_, err := s.request(ctx, CAST_NS_MEDIA, transport, payload)
+	return err
+}
+
+// setVolume sets the device volume, 0 to 1
+func (s *castSession) setVolume(ctx context.Context, level float64) error {
+	_, err := s.request(ctx, CAST_NS_RECEIVER, CAST_RECEIVER, map[string]interface{}{"type": "SET_VOLUME", "volume": map[string]interface{}{"level": level}})
+	return err
+}
+
+// status asks the media receiver for its status and reports it with the volume
+func (s *castSession) status(ctx context.Context) gin.H {
+	s.mu.Lock()
+	transport := s.transport
+	s.mu.Unlock()
+	if transport != "" {
+		s.request(ctx, CAST_NS_MEDIA, transport, map[string]interface{}{"type": "GET_STATUS"})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := gin.H{"device": s.dev, "volume": int(s.volume*100 + 0.5), "muted": s.muted, "playerState": "IDLE"}
+	var st struct {
+		PlayerState string  `json:"playerState"`
+		CurrentTime float64 `json:"currentTime"`
+		Media       struct {
+			ContentID string  `json:"contentId"`
+			Duration  float64 `json:"duration"`
+			Metadata  struct {
+				Title string `json:"title"`
+			} `json:"metadata"`
+		} `json:"media"`
+	}
+	if s.media != nil && json.Unmarshal(s.media, &st) == nil {
+		resp["playerState"] = st.PlayerState
+		resp["currentTime"] = st.CurrentTime
+		if st.Media.ContentID != "" {
+			resp["media"] = gin.H{"url": st.Media.ContentID, "title": st.Media.Metadata.Title, "duration": st.Media.Duration}
+		}
+	}
+	return resp
+}
+
+// --- HANDLERS ---
+
+// RequireCast hides the cast endpoints unless CAST is on
+func RequireCast() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !castEnabled {
+			c.String(http.StatusNotFound, "Not found")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// castFailed answers an error of a device
+func castFailed(c *gin.Context, err error) {
+	switch err {
+	case errCastUnknown:
+		apiError(c, http.StatusNotFound, MSG_CAST_UNKNOWN)
+	case errCastIdle:
+		apiError(c, http.StatusConflict, MSG_CAST_IDLE)
+	default:
+		log.Printf("Cast error: %v", err)
+		apiError(c, http.StatusBadGateway, MSG_CAST_FAILED)
+	}
+}
+
+// handleListCastDevices lists the devices found on the LAN (GET /api/v1/cast)
+func handleListCastDevices(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"devices": castDevices.list()})
+}
+
+// handleCastStatus reports what a device plays (GET /api/v1/cast/:device)
+func handleCastStatus(c *gin.Context) {
+	s, err := castDevices.session(c.Param("device"))
+	if err != nil {
+		castFailed(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, s.status(c.Request.Context()))
+}
+
+// handleCastLoad casts tracks of the library, or one of the user's playlists, to a
+// device (POST /api/v1/cast/:device/load, {"tracks":[...]} or {"playlist":"..."},
+// optionally "start" with the index to begin at)
+func handleCastLoad(c *gin.Context) {
+	if kioskMode {
+		apiError(c, http.StatusForbidden, MSG_KIOSK_UNAVAILABLE)
+		return
+	}
+	var req struct {
+		Tracks   []string `json:"tracks"`
+		Playlist string   `json:"playlist"`
+		Start    int      `json:"start"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (len(req.Tracks) == 0 && req.Playlist == "") {
+		apiError(c, http.StatusBadRequest, MSG_TRACK_REQUIRED)
+		return
+	}
+	ctx := c.Request.Context()
+	lib := libraryFrom(ctx)
+	keys := req.Tracks
+	if req.Playlist != "" {
+		p, ok := playlists.get(requestUser(c), req.Playlist)
+		if !ok {
+			apiError(c, http.StatusNotFound, MSG_UNKNOWN_PLAYLIST)
+			return
+		}
+		if lib = findLibrary(p.Library); lib == nil {
+			apiError(c, http.StatusNotFound, MSG_UNKNOWN_LIBRARY)
+			return
+		}
+		ctx = withLibrary(ctx, lib)
+		if prefixes, ok := requestAccess(c); ok {
+			ctx = withAccess(ctx, prefixes)
+		}
+		keys = p.Tracks
+	}
+	if len(keys) > CAST_MAX_ITEMS {
+		apiError(c, http.StatusBadRequest, MSG_QUEUE_FULL, CAST_MAX_ITEMS)
+		return
+	}
+	if req.Start < 0 || req.Start >= len(keys) {
+		apiError(c, http.StatusBadRequest, MSG_INDEX_OUT_OF_RANGE)
+		return
+	}
+	for i, t := range keys {
+		key := strings.TrimPrefix(t, "/")
+		if code := checkKey(key); code != "" {
+			rejectInput(c, newInputError(c, "tracks", code))
+			return
+		}
+		if !isAudioFile(key) || !isListed(key, false) || !folderVisible(ctx, key, false) || streamPolicy(key) == STREAM_BLOCK {
+			apiError(c, http.StatusBadRequest, MSG_TRACK_NOT_ALLOWED)
+			return
+		}
+		keys[i] = key
+	}
+	s, err := castDevices.session(c.Param("device"))
+	if err != nil {
+		castFailed(c, err)
+		return
+	}
+	base := castURL
+	if base == "" {
+		base = externalURL(c, "")
+	}
+	durations := manifest.durations(lib, keys)
+	items := make([]castItem, len(keys))
+	for i, key := range keys {
+		name := path.Base(key)
+		ctype, _ := servedContentType(lib, key)
+		it := castItem{url: base + strings.TrimPrefix(audioURL(lib, key, nil), basePath), contentType: ctype,
+			title: strings.TrimSuffix(name, path.Ext(name)), duration: durations[i]}
+		if tags, ok := tagsIndex.get(lib, key); ok && !tags.empty() {
+			if tags.Title != "" {
+				it.title = tags.Title
+			}
+			it.artist, it.album = tags.Artist, tags.Album
+		}
+		items[i] = it
+	}
+	if err := s.load(c.Request.Context(), items, req.Start); err != nil {
+		castFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s.status(c.Request.Context()))
+}
+
+// handleCastControl changes playback on a device (POST /api/v1/cast/:device/control,
+// {"action":"play"}; seek takes "position" in seconds and volume "volume" 0 to 100)
+func handleCastControl(c *gin.Context) {
+	if kioskMode {
+		apiError(c, http.StatusForbidden, MSG_KIOSK_UNAVAILABLE)
+		return
+	}
+	var req struct {
+		Action   string   `json:"action"`
+		Position *float64 `json:"position"`
+		Volume   *int     `json:"volume"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, MSG_INVALID_REQUEST)
+		return
+	}
+	var payload map[string]interface{}
+	switch req.Action {
+	case "play", "pause", "stop":
+		payload = map[string]interface{}{"type": strings.ToUpper(req.Action)}
+	case "next", "previous":
+		jump := 1
+		if req.Action == "previous" {
+			jump = -1
+		}
+		payload = map[string]interface{}{"type": "QUEUE_UPDATE", "jump": jump}
+	case "seek":
+		if req.Position == nil || *req.Position < 0 {
+			apiError(c, http.StatusBadRequest, MSG_CAST_POSITION)
+			return
+		}
+		payload = map[string]interface{}{"type": "SEEK", "currentTime": *req.Position}
+	case "volume":
+		if req.Volume == nil || *req.Volume < 0 || *req.Volume > 100 {
+			apiError(c, http.StatusBadRequest, MSG_CAST_VOLUME)
+			return
+		}
+	default:
+		apiError(c, http.StatusBadRequest, MSG_CAST_ACTION)
+		return
+	}
+	s, err := castDevices.session(c.Param("device"))
+	if err != nil {
+		castFailed(c, err)
+		return
+	}
+	if payload == nil {
+		err = s.setVolume(c.Request.Context(), float64(*req.Volume)/100)
+	} else {
+		err = s.control(c.Request.Context(), payload)
+	}
+	if err != nil {
+		castFailed(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s.status(c.Request.Context()))
+}
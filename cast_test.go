@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseCastAnswer(t *testing.T) {
+	name := func(s string) dnsmessage.Name { return dnsmessage.MustNewName(s) }
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.StartAnswers()
+	b.PTRResource(dnsmessage.ResourceHeader{Name: name(CAST_SERVICE), Class: dnsmessage.ClassINET},
+		dnsmessage.PTRResource{PTR: name("Chromecast-abc." + CAST_SERVICE)})
+	b.PTRResource(dnsmessage.ResourceHeader{Name: name(CAST_SERVICE), Class: dnsmessage.ClassINET},
+		dnsmessage.PTRResource{PTR: name("Gone-def." + CAST_SERVICE)}) // no address
+	b.StartAdditionals()
+	b.SRVResource(dnsmessage.ResourceHeader{Name: name("Chromecast-abc." + CAST_SERVICE), Class: dnsmessage.ClassINET},
+		dnsmessage.SRVResource{Port: 8009, Target: name("abc.local.")})
+	b.TXTResource(dnsmessage.ResourceHeader{Name: name("Chromecast-abc." + CAST_SERVICE), Class: dnsmessage.ClassINET},
+		dnsmessage.TXTResource{TXT: []string{"id=abc123", "md=Chromecast Audio", "fn=Kitchen speaker"}})
+	b.AResource(dnsmessage.ResourceHeader{Name: name("abc.local."), Class: dnsmessage.ClassINET},
+		dnsmessage.AResource{A: [4]byte{192, 168, 1, 20}})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseCastAnswer(msg)
+	want := []castDevice{{ID: "abc123", Name: "Kitchen speaker", Model: "Chromecast Audio", Addr: "192.168.1.20:8009"}}
+	if len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if query, err := castQuery(); err != nil || parseCastAnswer(query) != nil {
+		t.Errorf("a query parsed as an answer: %v", err)
+	}
+}
+
+func TestCastMessage(t *testing.T) {
+	m := castMessage{source: CAST_SENDER, destination: CAST_RECEIVER, namespace: CAST_NS_RECEIVER, payload: `{"type":"GET_STATUS","requestId":1}`}
+	got, err := readCastMessage(bytes.NewReader(m.marshal()))
+	if err != nil || got != m {
+		t.Errorf("got %+v, %v; want %+v", got, err, m)
+	}
+}
+
+// fakeCastDevice answers like a device running the default media receiver
+func fakeCastDevice(t *testing.T) string {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)},
+		&x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		state := map[string]interface{}{"mediaSessionId": 1, "playerState": "IDLE"}
+		for {
+			m, err := readCastMessage(conn)
+			if err != nil {
+				return
+			}
+			var req map[string]interface{}
+			json.Unmarshal([]byte(m.payload), &req)
+			reply := map[string]interface{}{"requestId": req["requestId"]}
+			switch req["type"] {
+			case "LAUNCH":
+				reply["type"] = "RECEIVER_STATUS"
+				reply["status"] = map[string]interface{}{"applications": []interface{}{map[string]interface{}{"appId": CAST_MEDIA_RECEIVER, "transportId": "web-5"}},
+					"volume": map[string]interface{}{"level": 0.5, "muted": false}}
+			case "QUEUE_LOAD":
+				state["playerState"] = "PLAYING"
+				state["media"] = req["items"].([]interface{})[0].(map[string]interface{})["media"]
+			case "PAUSE":
+				state["playerState"] = "PAUSED"
+			case "GET_STATUS":
+			default:
+				continue
+			}
+			if reply["type"] == nil {
+				reply["type"] = "MEDIA_STATUS"
+				reply["status"] = []interface{}{state}
+			}
+			data, _ := json.Marshal(reply)
+			conn.Write(castMessage{source: m.destination, destination: m.source, namespace: m.namespace, payload: string(data)}.marshal())
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestCastLoad casts a track to a fake device and pauses it
+func TestCastLoad(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(libs []*library, on bool) { libraries, castEnabled = libs, on }(libraries, castEnabled)
+	libraries = []*library{{Name: "Music", Bucket: "music"}}
+	castEnabled = true
+	useFakeS3(t, &fakeS3{objects: map[string]string{"music/Jazz/a.mp3": "a"}})
+	castDevices.seen([]castDevice{{ID: "dev1", Name: "Kitchen", Addr: fakeCastDevice(t)}}, time.Now())
+	defer func() {
+		if s := castDevices.sessions["dev1"]; s != nil {
+			s.close()
+		}
+		castDevices.seen(nil, time.Now().Add(2*CAST_DEVICE_EXPIRY))
+	}()
+	r := gin.New()
+	registerRoutes(r)
+
+	tests := []struct {
+		name, path, body string
+		code             int
+		want             string
+	}{
+		{"list", "", "", http.StatusOK, `{"devices":[{"id":"dev1","name":"Kitchen","address":"127.0.0.1:`},
+		{"load", "/dev1/load", `{"tracks":["Jazz/a.mp3"]}`, http.StatusOK, `"media":{"duration":0,"title":"a","url":"http://music.example/audio/Jazz/a.mp3"},"muted":false,"playerState":"PLAYING","volume":50}`},
+		{"pause", "/dev1/control", `{"action":"pause"}`, http.StatusOK, `"playerState":"PAUSED"`},
+		{"seek without position", "/dev1/control", `{"action":"seek"}`, http.StatusBadRequest, `"code":"cast_position"`},
+		{"unknown action", "/dev1/control", `{"action":"rewind"}`, http.StatusBadRequest, `"code":"cast_action"`},
+		{"unknown device", "/dev2/control", `{"action":"play"}`, http.StatusNotFound, `"code":"cast_unknown"`},
+		{"not audio", "/dev1/load", `{"tracks":["Jazz/cover.jpg"]}`, http.StatusBadRequest, `"code":"track_not_allowed"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://music.example/api/v1/cast"+tt.path, nil)
+			if tt.body != "" {
+				req = httptest.NewRequest(http.MethodPost, "http://music.example/api/v1/cast"+tt.path, strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/json")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("status %d, body %s\nwant %d, %s", w.Code, w.Body.String(), tt.code, tt.want)
+			}
+		})
+	}
+}
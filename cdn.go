@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CDN mode configuration from environment variables
+var (
+	cdnMode             = os.Getenv("CDN_MODE") == "true"
+	cdnInvalidationHook = os.Getenv("CDN_INVALIDATION_WEBHOOK") // POSTed to when the library changes
+	cdnCookieKeyPairID  = os.Getenv("CDN_COOKIE_KEY_PAIR_ID")   // CloudFront key pair / public key ID
+	cdnCookiePrivateKey = os.Getenv("CDN_COOKIE_PRIVATE_KEY")   // path to the PEM encoded RSA key
+	cdnCookieDomain     = os.Getenv("CDN_COOKIE_DOMAIN")        // e.g. ".example.com"
+	cdnCookieTTL        = 12 * time.Hour                        // CDN_COOKIE_TTL_HOURS
+	cdnCookieSigner     *rsa.PrivateKey
+)
+
+const (
+	CDN_IMMUTABLE_CACHE = "public, max-age=31536000, immutable"
+	CDN_REDIRECT_CACHE  = "public, max-age=60"
+)
+
+func initCDN() error {
+	if !cdnMode {
+		return nil
+	}
+	if v := os.Getenv("CDN_COOKIE_TTL_HOURS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid CDN_COOKIE_TTL_HOURS: %q", v)
+		}
+		cdnCookieTTL = time.Duration(n) * time.Hour
+	}
+	if (cdnCookieKeyPairID == "") != (cdnCookiePrivateKey == "") {
+		return fmt.Errorf("CDN_COOKIE_KEY_PAIR_ID and CDN_COOKIE_PRIVATE_KEY must be set together")
+	}
+	if cdnCookiePrivateKey != "" {
+		data, err := os.ReadFile(cdnCookiePrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to read CDN_COOKIE_PRIVATE_KEY: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("CDN_COOKIE_PRIVATE_KEY is not PEM encoded")
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			parsed, err2 := x509.ParsePKCS8PrivateKey(block.Bytes)
+			rsaKey, ok := parsed.(*rsa.PrivateKey)
+			if err2 != nil || !ok {
+				return fmt.Errorf("CDN_COOKIE_PRIVATE_KEY must be an RSA key: %w", err)
+			}
+			key = rsaKey
+		}
+		cdnCookieSigner = key
+	}
+	if cdnInvalidationHook != "" {
+		eventBus.Subscribe("cdn-invalidation", EVENT_LIBRARY_CHANGED, func(ev Event) {
+			notifyCDNInvalidation(ev)
+		})
+	}
+	return nil
+}
+
+// normalizeETag strips quotes so ETags can be used in query strings
+func normalizeETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// handleCDNAudio makes /audio URLs cache friendly: unversioned requests are redirected
+// to a URL keyed by the object ETag, versioned ones are marked immutable.
+// It returns true when the response has been written.
+func handleCDNAudio(c *gin.Context, key string) bool {
+	etag, _, _, err := s3HeadAudioFile(c.Request.Context(), key)
+	if err != nil {
+		return false // let the regular handler report the error
+	}
+	etag = normalizeETag(etag)
+	if c.Query("v") != etag {
+		c.Header("Cache-Control", CDN_REDIRECT_CACHE)
+		c.Redirect(http.StatusFound, audioURL(libraryFrom(c.Request.Context()), key, url.Values{"v": {etag}}))
+		return true
+	}
+	c.Header("ETag", `"`+etag+`"`)
+	c.Header("Cache-Control", CDN_IMMUTABLE_CACHE)
+	if normalizeETag(c.GetHeader("If-None-Match")) == etag {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// cloudFrontEncode applies CloudFront's URL-safe base64 variant
+func cloudFrontEncode(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+// setCDNSignedCookies issues CloudFront signed cookies granting access to the audio route
+func setCDNSignedCookies(c *gin.Context) {
+	if cdnCookieSigner == nil {
+		return
+	}
+	expires := time.Now().Add(cdnCookieTTL)
+	policy, err := json.Marshal(map[string]interface{}{
+		"Statement": []interface{}{map[string]interface{}{
+			"Resource": externalURL(c, "/audio/*"),
+			"Condition": map[string]interface{}{
+				"DateLessThan": map[string]int64{"AWS:EpochTime": expires.Unix()},
+			},
+		}},
+	})
+	if err != nil {
+		return
+	}
+	digest := sha1.Sum(policy)
+	sig, err := rsa.SignPKCS1v15(nil, cdnCookieSigner, crypto.SHA1, digest[:])
+	if err != nil {
+		log.Printf("CDN cookie signing error: %v", err)
+		return
+	}
+	maxAge := int(cdnCookieTTL.Seconds())
+	path := basePath + "/"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("CloudFront-Policy", cloudFrontEncode(policy), maxAge, path, cdnCookieDomain, true, true)
+	c.SetCookie("CloudFront-Signature", cloudFrontEncode(sig), maxAge, path, cdnCookieDomain, true, true)
+	c.SetCookie("CloudFront-Key-Pair-Id", cdnCookieKeyPairID, maxAge, path, cdnCookieDomain, true, true)
+}
+
+// notifyCDNInvalidation posts library change events to CDN_INVALIDATION_WEBHOOK
+func notifyCDNInvalidation(ev Event) {
+	body, err := json.Marshal(map[string]interface{}{
+		"event": ev.Type,
+		"time":  ev.Time.Unix(),
+		"data":  ev.Data,
+		"paths": []string{basePath + "/api*"},
+	})
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cdnInvalidationHook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("CDN invalidation hook error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("CDN invalidation hook returned %s", resp.Status)
+	}
+}
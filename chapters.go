@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CHAPTERS_SUFFIX    = ".chapters.txt" // sidecar next to the track, e.g. "Book.chapters.txt" for Book.m4b
+	MAX_CHAPTERS_BYTES = 64 << 10
+	MP4_CHAPTER_BYTES  = 1 << 20 // chpl atoms are looked for this far from either end of the file
+)
+
+// chapter is one chapter of a track; times are seconds as played
+type chapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end,omitempty"` // start of the next chapter, 0 for the last one when the length is unknown
+	URL   string  `json:"url,omitempty"` // stream URL with a media fragment seeking to Start
+}
+
+type trackChapters struct {
+	Source   string    `json:"source"` // sidecar, chap or chpl
+	Chapters []chapter `json:"chapters"`
+}
+
+// A sidecar line is "[hh:]mm:ss[.fff] Title", as used by podcast and video chapter lists
+var chapterLine = regexp.MustCompile(`^(?:(\d+):)?(\d{1,2}):(\d{1,2}(?:\.\d{1,3})?)\s+(.*)$`)
+
+func parseChapterSidecar(text string) []chapter {
+	var out []chapter
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		m := chapterLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		h, _ := strconv.Atoi(m[1])
+		mins, _ := strconv.Atoi(m[2])
+		secs, _ := strconv.ParseFloat(m[3], 64)
+		out = append(out, chapter{Title: strings.TrimSpace(m[4]), Start: float64(h*3600+mins*60) + secs})
+	}
+	return out
+}
+
+// id3Chapters reads CHAP frames: element ID, start and end in ms, byte offsets and
+// subframes, of which TIT2 holds the title
+func id3Chapters(tag []byte) []chapter {
+	if len(tag) < 10 {
+		return nil
+	}
+	version := tag[3]
+	var out []chapter
+	for _, f := range id3AllFrames(tag, "CHAP")["CHAP"] {
+		i := bytes.IndexByte(f, 0)
+		if i < 0 || i+17 > len(f) {
+			continue
+		}
+		ch := chapter{
+			Start: float64(binary.BigEndian.Uint32(f[i+1:])) / 1000,
+			End:   float64(binary.BigEndian.Uint32(f[i+5:])) / 1000,
+			Title: string(f[:i]),
+		}
+		sub := f[i+17:]
+		for len(sub) >= 10 {
+			n := int(binary.BigEndian.Uint32(sub[4:]))
+			if version == 4 {
+				n = int(sub[4]&0x7f)<<21 | int(sub[5]&0x7f)<<14 | int(sub[6]&0x7f)<<7 | int(sub[7]&0x7f)
+			}
+			if n < 1 || 10+n > len(sub) {
+				break
+			}
+			if string(sub[:4]) == "TIT2" {
+				body := sub[10 : 10+n]
+				text, _ := id3Cut(body[0], body[1:])
+				ch.Title = id3Text(body[0], text)
+			}
+			sub = sub[10+n:]
+		}
+		out = append(out, ch)
+	}
+	return out
+}
+
+// mp4Chapters reads a Nero chpl atom: version, flags, a chapter count and per chapter
+// the start in 100ns units and a length-prefixed UTF-8 title
+func mp4Chapters(buf []byte) []chapter {
+	i := bytes.Index(buf, []byte("chpl"))
+	if i < 0 {
+		return nil
+	}
+	p := i + 4
+	if p+4 > len(buf) {
+		return nil
+	}
+	if buf[p] == 1 {
+		p += 4
+	}
+	p += 4
+	if p >= len(buf) {
+		return nil
+	}
+	count := int(buf[p])
+	p++
+	var out []chapter
+	for n := 0; n < count && p+9 <= len(buf); n++ {
+		start := binary.BigEndian.Uint64(buf[p:])
+		size := int(buf[p+8])
+		p += 9
+		if p+size > len(buf) {
+			break
+		}
+		out = append(out, chapter{Title: string(buf[p : p+size]), Start: float64(start) / 1e7})
+		p += size
+	}
+	return out
+}
+
+// readChapters finds the chapters of key: a sidecar wins over embedded chapters
+func readChapters(ctx context.Context, key string) (trackChapters, error) {
+	lib := libraryFrom(ctx)
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + strings.TrimSuffix(key, path.Ext(key)) + CHAPTERS_SUFFIX),
+	})
+	if err == nil {
+		data, rerr := io.ReadAll(io.LimitReader(resp.Body, MAX_CHAPTERS_BYTES))
+		resp.Body.Close()
+		if rerr != nil {
+			return trackChapters{}, rerr
+		}
+		if chapters := parseChapterSidecar(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))); len(chapters) > 0 {
+			return trackChapters{Source: "sidecar", Chapters: chapters}, nil
+		}
+	} else if !isNoSuchKey(err) {
+		return trackChapters{}, err
+	}
+	switch strings.ToLower(path.Ext(key)) {
+	case ".mp3":
+		tag, err := readID3Tag(ctx, key)
+		if err != nil {
+			return trackChapters{}, err
+		}
+		if chapters := id3Chapters(tag); len(chapters) > 0 {
+			return trackChapters{Source: "chap", Chapters: chapters}, nil
+		}
+	case ".mp4", ".m4a", ".m4b":
+		for _, rng := range []string{fmt.Sprintf("bytes=0-%d", MP4_CHAPTER_BYTES-1), fmt.Sprintf("bytes=-%d", MP4_CHAPTER_BYTES)} {
+			buf, err := s3GetRange(ctx, key, rng)
+			if err != nil {
+				return trackChapters{}, err
+			}
+			if chapters := mp4Chapters(buf); len(chapters) > 0 {
+				return trackChapters{Source: "chpl", Chapters: chapters}, nil
+			}
+		}
+	}
+	return trackChapters{}, nil
+}
+
+// loadChapters returns the chapters of key, sorted, with end times filled in. A missing
+// result is cached as well, so files aren't read again on every request.
+func loadChapters(ctx context.Context, key string) (trackChapters, error) {
+	lib := libraryFrom(ctx)
+	cacheKey := "chapters\x00" + lib.Name + "\x00" + key
+	var tc trackChapters
+	if data, ok := metadataCache.Get(cacheKey); ok && json.Unmarshal(data, &tc) == nil {
+		return tc, nil
+	}
+	tc, err := readChapters(ctx, key)
+	if err != nil {
+		return tc, err
+	}
+	sort.SliceStable(tc.Chapters, func(i, j int) bool { return tc.Chapters[i].Start < tc.Chapters[j].Start })
+	var length float64 // untrimmed, like the chapter times
+	if m, ok := manifest.entry(lib, key); ok {
+		length = float64(m.DurationMs) / 1000
+	}
+	for i := range tc.Chapters {
+		if i+1 < len(tc.Chapters) {
+			tc.Chapters[i].End = tc.Chapters[i+1].Start
+		} else if tc.Chapters[i].End <= tc.Chapters[i].Start {
+			tc.Chapters[i].End = 0
+		}
+	}
+	if n := len(tc.Chapters); n > 0 && tc.Chapters[n-1].End == 0 && length > tc.Chapters[n-1].Start {
+		tc.Chapters[n-1].End = length
+	}
+	if data, err := json.Marshal(tc); err == nil {
+		metadataCache.Set(cacheKey, data)
+	}
+	return tc, nil
+}
+
+// handleGetChapters returns the chapters of a track. Times follow the track's trim
+// points, as played, and each chapter links to the stream seeking to its start.
+func handleGetChapters(c *gin.Context, key string) {
+	key = strings.TrimPrefix(key, "/")
+	if !isAudioFile(key) || !isListed(key, false) || !folderVisible(c.Request.Context(), key, false) {
+		echoReqHtml(c, []interface{}{"error", msg(c, MSG_UNKNOWN_TRACK)}, "getChaptersData")
+		return
+	}
+	ctx := c.Request.Context()
+	lib := libraryFrom(ctx)
+	tc, err := loadChapters(ctx, key)
+	if err != nil {
+		if isNoSuchKey(err) {
+			echoReqHtml(c, []interface{}{"error", msg(c, MSG_UNKNOWN_TRACK)}, "getChaptersData")
+			return
+		}
+		log.Printf("Chapters error for %s: %v", key, err)
+		echoReqHtml(c, []interface{}{"error", "Reading chapters failed"}, "getChaptersData")
+		return
+	}
+	chapters := make([]chapter, 0, len(tc.Chapters))
+	t, trimmed := trims.get(lib, key)
+	trimmed = trimmed && ffmpegPath != ""
+	for _, ch := range tc.Chapters {
+		if trimmed {
+			if (t.End > 0 && ch.Start >= t.End) || (ch.End > 0 && ch.End <= t.Start) {
+				continue
+			}
+			ch.Start = max(0, ch.Start-t.Start)
+			if ch.End > 0 {
+				if t.End > 0 {
+					ch.End = min(ch.End, t.End)
+				}
+				ch.End -= t.Start
+			}
+		}
+		ch.URL = audioURL(lib, key, nil) + "#t=" + strconv.FormatFloat(ch.Start, 'f', -1, 64)
+		chapters = append(chapters, ch)
+	}
+	echoReqHtml(c, []interface{}{"ok", key, tc.Source, chapters}, "getChaptersData")
+}
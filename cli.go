@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// usage prints the available subcommands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, `Usage: go-music [command] [flags]
+
+Commands:
+  serve            start the HTTP server (default)
+  scan             walk the bucket, report directory and track counts, and exit
+  check            verify the library's objects and headers, exit 1 on problems
+  validate-config  check the environment configuration and exit
+  migrate-state    copy the server's state from STATE_STORE into another store
+  version          print build information
+
+Run "go-music <command> -h" for command flags.`)
+}
+
+// runVersion prints build information
+func runVersion(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+	fmt.Println("go-music build date: ", buildDate)
+	fmt.Println("go-music commit: ", commitHash)
+	fmt.Println("go-music version: ", version)
+}
+
+// runValidateConfig checks the configuration, optionally verifying bucket access
+func runValidateConfig(args []string) {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	checkBucket := fs.Bool("check-bucket", false, "also verify that the bucket is reachable")
+	fs.Parse(args)
+
+	if err := initConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printConfig(os.Stdout)
+	if *checkBucket {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s3Bucket)}); err != nil {
+			fmt.Fprintf(os.Stderr, "Bucket check failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Bucket reachable: yes")
+	}
+	fmt.Println("Configuration OK")
+}
+
+// runScan walks the bucket once and reports what the server would index
+func runScan(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only scan below this directory (relative to S3_PREFIX)")
+	libName := fs.String("library", "", "library to scan (default: the BUCKET/S3_PREFIX library)")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	durations := fs.Bool("durations", false, "also probe new or changed tracks and update the duration manifest")
+	fs.Parse(args)
+
+	if err := initConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	lib := findLibrary(*libName)
+	if lib == nil {
+		fmt.Fprintf(os.Stderr, "Unknown library %q\n", *libName)
+		os.Exit(1)
+	}
+	ctx := withLibrary(context.Background(), lib)
+	start := time.Now()
+	dirs, err := s3ListAllDirs(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Directory scan failed: %v\n", err)
+		os.Exit(1)
+	}
+	files, err := s3ListAllAudioFiles(ctx, *prefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Track scan failed: %v\n", err)
+		os.Exit(1)
+	}
+	probed, failed := 0, 0
+	if *durations {
+		if err := manifest.load(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Manifest load failed: %v\n", err)
+			os.Exit(1)
+		}
+		if probed, failed, err = manifest.scan(ctx, lib); err != nil {
+			fmt.Fprintf(os.Stderr, "Duration scan failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"directories": len(dirs),
+			"tracks":      len(files),
+			"probed":      probed,
+			"unreadable":  failed,
+			"elapsedMs":   elapsed.Milliseconds(),
+		})
+		return
+	}
+	fmt.Printf("Directories: %d\nTracks: %d\n", len(dirs), len(files))
+	if *durations {
+		fmt.Printf("Probed: %d (%d unreadable)\n", probed, failed)
+	}
+	fmt.Printf("Elapsed: %s\n", elapsed)
+}
+
+// runCheck runs the integrity checker once and exits non-zero when it finds problems
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	libName := fs.String("library", "", "library to check (default: the BUCKET/S3_PREFIX library)")
+	sample := fs.Int("sample", DEFAULT_CHECK_SAMPLE, "files whose headers are read, -1 for all")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+
+	if err := initConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	lib := findLibrary(*libName)
+	if lib == nil {
+		fmt.Fprintf(os.Stderr, "Unknown library %q\n", *libName)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+	if err := manifest.load(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Manifest load failed: %v\n", err)
+		os.Exit(1)
+	}
+	report, err := libraryIntegrity(ctx, lib, *sample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Check failed: %v\n", err)
+		os.Exit(1)
+	}
+	checklist := report["checklist"].([]*healthCheck)
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		fmt.Printf("Tracks: %d\nHeaders read: %d\n", report["tracks"], report["sampled"])
+		for _, h := range checklist {
+			fmt.Printf("\n%s: %d\n  %s\n", h.Check, h.Count, h.Action)
+			for _, ex := range h.Examples {
+				fmt.Printf("  - %s\n", ex)
+			}
+			if h.Count > len(h.Examples) {
+				fmt.Printf("  ... and %d more\n", h.Count-len(h.Examples))
+			}
+		}
+		if len(checklist) == 0 {
+			fmt.Println("No problems found")
+		}
+	}
+	if len(checklist) > 0 {
+		os.Exit(1)
+	}
+}
+
+// runMigrateState copies every document from the configured STATE_STORE into another
+// store. Stop the servers first, or writes made during the copy may be lost.
+func runMigrateState(args []string) {
+	fs := flag.NewFlagSet("migrate-state", flag.ExitOnError)
+	to := fs.String("to", "", "destination store: s3, dir:<path>, sqlite:<path>, postgres://... or dynamodb:<table>")
+	fs.Parse(args)
+
+	if err := initConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	dst, err := parseStateStore(*to)
+	if err != nil || *to == "" {
+		fmt.Fprintf(os.Stderr, "Invalid -to %q: want s3, dir:<path>, sqlite:<path>, postgres://... or dynamodb:<table>\n", *to)
+		os.Exit(2)
+	}
+	if dst.String() == state.String() {
+		fmt.Fprintf(os.Stderr, "STATE_STORE is already %s\n", dst)
+		os.Exit(2)
+	}
+	ctx := context.Background()
+	switch dst := dst.(type) {
+	case *dynamoState:
+		if err := dst.create(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Table create failed: %v\n", err)
+			os.Exit(1)
+		}
+	case *sqlState:
+		if err := dst.migrate(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Schema migration failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	names, err := state.list(ctx, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Listing %s failed: %v\n", state, err)
+		os.Exit(1)
+	}
+	for _, name := range names {
+		data, err := state.get(ctx, name)
+		if err == nil {
+			err = dst.put(ctx, name, data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Copying %s failed: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Copied %d documents from %s to %s\n", len(names), state, dst)
+	fmt.Printf("Set STATE_STORE=%s and restart the servers\n", dst)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// collection groups several album folders in a fixed order (boxed sets, series)
+type collection struct {
+	Name    string   `json:"name"`
+	Folders []string `json:"folders"`
+}
+
+type collectionStore struct {
+	mu          sync.Mutex
+	collections map[string]*collection
+	doc         stateDoc
+}
+
+var collections = &collectionStore{collections: make(map[string]*collection), doc: stateDoc{name: COLLECTIONS_OBJECT}}
+
+const COLLECTIONS_OBJECT = "collections.json"
+
+// load reads the collections object from the state store; a missing object means no collections
+func (cs *collectionStore) load(ctx context.Context) error {
+	return cs.doc.load(ctx, &cs.mu, cs)
+}
+
+func (cs *collectionStore) decode(data []byte) error {
+	var list []collection
+	if data != nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	cols := make(map[string]*collection, len(list))
+	for i := range list {
+		cols[list[i].Name] = &list[i]
+	}
+	cs.collections = cols
+	return nil
+}
+
+func (cs *collectionStore) encode() (interface{}, error) {
+	return cs.listLocked(), nil
+}
+
+func (cs *collectionStore) listLocked() []collection {
+	out := make([]collection, 0, len(cs.collections))
+	for _, col := range cs.collections {
+		out = append(out, *col)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (cs *collectionStore) list() []collection {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.listLocked()
+}
+
+func (cs *collectionStore) get(name string) (collection, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	col, ok := cs.collections[name]
+	if !ok {
+		return collection{}, false
+	}
+	return *col, true
+}
+
+func (cs *collectionStore) put(ctx context.Context, col collection) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.doc.update(ctx, cs, func() bool {
+		stored := col
+		cs.collections[col.Name] = &stored
+		return true
+	})
+}
+
+func (cs *collectionStore) remove(ctx context.Context, name string) (bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	found := false
+	err := cs.doc.update(ctx, cs, func() bool {
+		_, found = cs.collections[name]
+		delete(cs.collections, name)
+		return found
+	})
+	return found, err
+}
+
+// --- COLLECTION HANDLERS ---
+func handleGetCollections(c *gin.Context) {
+	list := collections.list()
+	names := make([]string, len(list))
+	counts := make([]string, len(list))
+	for i, col := range list {
+		names[i] = col.Name
+		counts[i] = strconv.Itoa(len(col.Folders))
+	}
+	echoReqHtml(c, []interface{}{"ok", names, counts}, "getCollectionsData")
+}
+
+func handleGetCollection(c *gin.Context, name string) {
+	col, ok := collections.get(name)
+	if !ok {
+		echoReqHtml(c, []interface{}{"error", "Unknown collection", []string{}}, "getCollectionData")
+		return
+	}
+	echoReqHtml(c, []interface{}{"ok", col.Name, col.Folders}, "getCollectionData")
+}
+
+// collectionTracks lists the tracks of every folder in collection order
+func collectionTracks(ctx context.Context, col collection) ([]string, error) {
+	seen := make(map[string]bool)
+	var tracks []string
+	for _, folder := range col.Folders {
+		files, err := s3ListAllAudioFiles(ctx, folder)
+		if err != nil {
+			return nil, err
+		}
+		sortNames(files)
+		for _, f := range files {
+			if !seen[f] {
+				seen[f] = true
+				tracks = append(tracks, f)
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// handleGetAllMp3InCollection returns the tracks of every folder in collection order
+func handleGetAllMp3InCollection(c *gin.Context, name string) {
+	col, ok := collections.get(name)
+	if !ok {
+		echoReqHtml(c, []interface{}{"error", "Unknown collection"}, "getAllMp3Data")
+		return
+	}
+	tracks, err := collectionTracks(c.Request.Context(), col)
+	if err != nil {
+		log.Printf("S3 get all mp3 in collection error: %v", err)
+		echoReqHtml(c, []interface{}{"error", "Failed to scan S3 directory"}, "getAllMp3Data")
+		return
+	}
+	tracks, page := paginate(c, tracks, maxListResult)
+	echoReqHtml(c, []interface{}{"ok", tracks, page, manifest.durations(libraryFrom(c.Request.Context()), tracks)}, "getAllMp3Data")
+}
+
+// handlePutCollection creates or replaces a collection (PUT /admin/collections/:name)
+func handlePutCollection(c *gin.Context) {
+	var req struct {
+		Folders []string `json:"folders"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Folders) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "folders required"})
+		return
+	}
+	col := collection{Name: c.Param("name")}
+	for _, f := range req.Folders {
+		f = strings.Trim(f, "/")
+		if f != "" {
+			col.Folders = append(col.Folders, f+"/")
+		}
+	}
+	if err := collections.put(c.Request.Context(), col); err != nil {
+		log.Printf("Collection save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save collections"})
+		return
+	}
+	eventBus.Publish(EVENT_COLLECTION_CHANGED, map[string]interface{}{"name": col.Name, "action": "put"})
+	audit.record(c, "collection.put", "", col.Name, strings.Join(col.Folders, ", "))
+	c.JSON(http.StatusOK, col)
+}
+
+// handleDeleteCollection removes a collection (DELETE /admin/collections/:name)
+func handleDeleteCollection(c *gin.Context) {
+	found, err := collections.remove(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		log.Printf("Collection save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save collections"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown collection"})
+		return
+	}
+	eventBus.Publish(EVENT_COLLECTION_CHANGED, map[string]interface{}{"name": c.Param("name"), "action": "delete"})
+	audit.record(c, "collection.delete", "", c.Param("name"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_COMPRESSION_LEVEL = gzip.DefaultCompression
+	COMPRESSION_MIN_SIZE      = 1 << 10 // smaller bodies are sent as they are
+)
+
+// COMPRESSION_LEVEL is the gzip/deflate level for text responses, 1-9; 0 disables compression
+var compressionLevel = DEFAULT_COMPRESSION_LEVEL
+
+func initCompression() error {
+	if v := os.Getenv("COMPRESSION_LEVEL"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 9 {
+			return fmt.Errorf("invalid COMPRESSION_LEVEL: %q, expected 0-9", v)
+		}
+		compressionLevel = n
+	}
+	return nil
+}
+
+// compressibleType reports whether a response of this content type is worth compressing;
+// audio, images and other already compressed formats are not
+func compressibleType(ctype string) bool {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	ctype = strings.TrimSpace(strings.ToLower(ctype))
+	return strings.HasPrefix(ctype, "text/") || strings.HasSuffix(ctype, "json") || strings.HasSuffix(ctype, "xml") ||
+		ctype == "application/javascript" || ctype == "application/x-ndjson" || ctype == "image/svg+xml"
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, or "" for none
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q <= 0 {
+			continue // explicitly refused
+		}
+		switch name = strings.ToLower(name); name {
+		case "*":
+			name = "gzip"
+		case "gzip", "deflate":
+		default:
+			continue
+		}
+		// gzip wins ties, it is what every client supports best
+		if q > bestQ || (q == bestQ && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the start of the body until it knows the content type and
+// whether the body is large enough, then either compresses or passes the rest through
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	buf      []byte
+	decided  bool
+	enc      io.WriteCloser // nil when passing through
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < COMPRESSION_MIN_SIZE && compressibleType(w.Header().Get("Content-Type")) {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// decide starts compressing if the response qualifies, and writes out the held back bytes
+func (w *compressWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	status := w.Status()
+	if compressibleType(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if len(w.buf) >= COMPRESSION_MIN_SIZE && compressibleType(h.Get("Content-Type")) && h.Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.enc, _ = gzip.NewWriterLevel(w.ResponseWriter, compressionLevel)
+		} else {
+			w.enc, _ = zlib.NewWriterLevel(w.ResponseWriter, compressionLevel)
+		}
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what has been compressed so far, for streamed listings
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) finish() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.enc != nil {
+		w.enc.Close()
+	}
+}
+
+// Compress middleware gzip or deflate encodes text and JSON responses for clients that
+// accept it. Audio, artwork and ranged responses are passed through untouched.
+func Compress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if compressionLevel == 0 || c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" {
+			c.Next()
+			return
+		}
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = w
+		defer w.finish()
+		c.Next()
+	}
+}
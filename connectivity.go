@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_S3_DNS_CACHE_TTL = 5 * time.Minute
+	CONNECTIVITY_PROBE_AGE   = 30 * time.Second
+	CONNECTIVITY_PROBE_TIME  = 5 * time.Second
+	S3_DIAL_TIMEOUT          = 10 * time.Second
+)
+
+// Connectivity states reported to clients
+const (
+	S3_STATUS_UNKNOWN = "unknown"
+	S3_STATUS_OK      = "ok"
+	S3_STATUS_DNS     = "dns"
+	S3_STATUS_AUTH    = "auth"
+	S3_STATUS_NETWORK = "network"
+)
+
+// s3StatusMessages explains the failure states; the S3 error itself names endpoints,
+// buckets and request IDs, so it only goes to the log
+var s3StatusMessages = map[string]string{
+	S3_STATUS_DNS:     "S3 endpoint could not be resolved",
+	S3_STATUS_AUTH:    "S3 refused the server credentials",
+	S3_STATUS_NETWORK: "S3 could not be reached",
+}
+
+// API error codes that mean S3 answered but refused our credentials
+var s3AuthErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+	"Forbidden":             true,
+}
+
+type dnsEntry struct {
+	addrs    []string
+	resolved time.Time
+}
+
+// dnsCache resolves S3 endpoints once per TTL and keeps serving the last good
+// addresses when a later lookup fails, so a flaky resolver doesn't take playback down
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsEntry
+	dialer  net.Dialer
+}
+
+var s3DNS = &dnsCache{ttl: DEFAULT_S3_DNS_CACHE_TTL, entries: make(map[string]dnsEntry), dialer: net.Dialer{Timeout: S3_DIAL_TIMEOUT, KeepAlive: 30 * time.Second}}
+
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	e, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && time.Since(e.resolved) < d.ttl {
+		return e.addrs, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			log.Printf("DNS lookup for %s failed, using cached addresses: %v", host, err)
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+	d.mu.Lock()
+	d.entries[host] = dnsEntry{addrs: addrs, resolved: time.Now()}
+	d.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext dials the cached addresses of host in turn until one connects
+func (d *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return nil, lastErr
+}
+
+// s3Endpoints returns the host names S3 requests will be sent to
+func s3Endpoints() []string {
+	for _, v := range []string{s3Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")} {
+		if v != "" {
+			if u, err := url.Parse(v); err == nil && u.Hostname() != "" {
+				return []string{u.Hostname()}
+			}
+		}
+	}
+	regional := "s3." + s3Region + ".amazonaws.com"
+	hosts := []string{regional}
+	if s3ForcePathStyle {
+		return hosts
+	}
+	seen := map[string]bool{}
+	for _, lib := range libraries {
+		if !seen[lib.Bucket] {
+			seen[lib.Bucket] = true
+			hosts = append(hosts, lib.Bucket+"."+regional)
+		}
+	}
+	return hosts
+}
+
+// preResolve fills the DNS cache at startup so a resolver outage later is survivable
+func (d *dnsCache) preResolve(hosts []string) {
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), CONNECTIVITY_PROBE_TIME)
+		if _, err := d.lookup(ctx, host); err != nil {
+			log.Printf("Pre-resolving %s failed: %v", host, err)
+		}
+		cancel()
+	}
+}
+
+// s3HTTPClient routes S3 traffic through the DNS cache
+func s3HTTPClient() *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.DialContext = s3DNS.DialContext
+	})
+}
+
+// initS3DNSCache reads S3_DNS_CACHE_TTL and resolves the S3 endpoints in the background
+func initS3DNSCache() error {
+	if v := os.Getenv("S3_DNS_CACHE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid S3_DNS_CACHE_TTL: %q", v)
+		}
+		s3DNS.ttl = ttl
+	}
+	go s3DNS.preResolve(s3Endpoints())
+	return nil
+}
+
+// s3Connectivity remembers the outcome of the most recent S3 call
+type s3Connectivity struct {
+	mu          sync.Mutex
+	status      string
+	lastSuccess time.Time
+	lastFailure time.Time
+	probing     bool
+}
+
+var s3Conn = &s3Connectivity{status: S3_STATUS_UNKNOWN}
+
+// classifyS3Error maps an S3 call error to a connectivity state, "" if the call says nothing about connectivity
+func classifyS3Error(err error) string {
+	if err == nil {
+		return S3_STATUS_OK
+	}
+	if errors.Is(err, context.Canceled) {
+		return ""
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return S3_STATUS_DNS
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if s3AuthErrorCodes[apiErr.ErrorCode()] {
+			return S3_STATUS_AUTH
+		}
+		// Any other API error (NoSuchKey, ...) means S3 answered
+		return S3_STATUS_OK
+	}
+	var respErr *awshttp.ResponseError
+	// Send failures are wrapped in a ResponseError too, with no status code
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() != 0 {
+		if respErr.HTTPStatusCode() == http.StatusForbidden {
+			return S3_STATUS_AUTH
+		}
+		return S3_STATUS_OK
+	}
+	return S3_STATUS_NETWORK
+}
+
+func (s *s3Connectivity) record(err error) {
+	state := classifyS3Error(err)
+	if state == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == S3_STATUS_OK {
+		if s.status != S3_STATUS_OK && s.status != S3_STATUS_UNKNOWN {
+			log.Printf("S3 connectivity restored")
+		}
+		s.status, s.lastSuccess = state, time.Now()
+		return
+	}
+	if s.status != state {
+		log.Printf("S3 connectivity %s: %v", state, err)
+	}
+	s.status, s.lastFailure = state, time.Now()
+}
+
+// addConnectivityMiddleware records the final outcome of every S3 operation
+func addConnectivityMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("GoMusicConnectivity",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleInitialize(ctx, in)
+			s3Conn.record(err)
+			return out, md, err
+		}), middleware.Before)
+}
+
+// probe checks the bucket when no S3 call has reported back recently
+func (s *s3Connectivity) probe() {
+	s.mu.Lock()
+	last := s.lastSuccess
+	if s.lastFailure.After(last) {
+		last = s.lastFailure
+	}
+	if s.probing || time.Since(last) < CONNECTIVITY_PROBE_AGE {
+		s.mu.Unlock()
+		return
+	}
+	s.probing = true
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECTIVITY_PROBE_TIME)
+	// The connectivity middleware records the outcome
+	s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s3Bucket)})
+	cancel()
+	s.mu.Lock()
+	s.probing = false
+	s.mu.Unlock()
+}
+
+// handleConnectivity reports whether S3 is reachable so the UI can explain failures
+func handleConnectivity(c *gin.Context) {
+	s3Conn.probe()
+	s3Conn.mu.Lock()
+	resp := gin.H{
+		"status":    s3Conn.status,
+		"reachable": s3Conn.status == S3_STATUS_OK,
+		"message":   s3StatusMessages[s3Conn.status],
+	}
+	if !s3Conn.lastSuccess.IsZero() {
+		resp["lastSuccess"] = s3Conn.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	if !s3Conn.lastFailure.IsZero() {
+		resp["lastFailure"] = s3Conn.lastFailure.UTC().Format(time.RFC3339)
+	}
+	s3Conn.mu.Unlock()
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORS configuration from environment variables (disabled when CORS_ALLOWED_ORIGINS is empty)
+var (
+	corsAllowedOrigins   = splitList(os.Getenv("CORS_ALLOWED_ORIGINS")) // e.g. "https://a.example,https://b.example" or "*"
+	corsAllowedMethods   = os.Getenv("CORS_ALLOWED_METHODS")            // default "GET,POST,PUT,DELETE,OPTIONS"
+	corsAllowedHeaders   = os.Getenv("CORS_ALLOWED_HEADERS")            // default "Authorization,Content-Type,Range"
+	corsAllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+	corsMaxAge           = 600 // CORS_MAX_AGE: preflight cache in seconds
+)
+
+// splitList splits a comma separated setting, dropping empty items
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// initCORS parses CORS_MAX_AGE and refuses a wildcard origin together with credentials:
+// every site could then make credentialed requests as the signed-in user
+func initCORS() error {
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid CORS_MAX_AGE: %q", v)
+		}
+		corsMaxAge = n
+	}
+	if !corsAllowCredentials {
+		return nil
+	}
+	for _, origin := range corsAllowedOrigins {
+		if origin == "*" {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS=* cannot be combined with CORS_ALLOW_CREDENTIALS=true; list the origins")
+		}
+	}
+	return nil
+}
+
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range corsAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS middleware adds cross-origin headers for allowed origins and answers preflight requests
+func CORS() gin.HandlerFunc {
+	methods := corsAllowedMethods
+	if methods == "" {
+		methods = "GET,POST,PUT,DELETE,OPTIONS" // /api/v1 updates and deletes resources
+	}
+	headers := corsAllowedHeaders
+	if headers == "" {
+		headers = "Authorization,Content-Type,Range"
+	}
+	maxAge := strconv.Itoa(corsMaxAge)
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || len(corsAllowedOrigins) == 0 {
+			c.Next()
+			return
+		}
+		c.Header("Vary", "Origin")
+		if !corsOriginAllowed(origin) {
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+		// Echo the origin rather than "*"; Vary: Origin keeps shared caches apart
+		c.Header("Access-Control-Allow-Origin", origin)
+		if corsAllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+		c.Header("Access-Control-Expose-Headers", "Content-Length,Content-Range,Accept-Ranges")
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Access-Control-Allow-Methods", methods)
+			c.Header("Access-Control-Allow-Headers", headers)
+			c.Header("Access-Control-Max-Age", maxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
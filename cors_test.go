@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestCORSMaxAge checks that an unusable CORS_MAX_AGE stops startup
+func TestCORSMaxAge(t *testing.T) {
+	defer func(n int) { corsMaxAge = n }(corsMaxAge)
+	for _, v := range []string{"ten", "-1", "1.5"} {
+		t.Setenv("CORS_MAX_AGE", v)
+		if err := initCORS(); err == nil {
+			t.Errorf("CORS_MAX_AGE=%s accepted", v)
+		}
+	}
+	t.Setenv("CORS_MAX_AGE", "60")
+	if err := initCORS(); err != nil || corsMaxAge != 60 {
+		t.Errorf("CORS_MAX_AGE=60: %v, max age %d", err, corsMaxAge)
+	}
+}
+
+// TestCORSPreflightMethods checks that the default preflight answer allows the methods
+// /api/v1 uses
+func TestCORSPreflightMethods(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(origins []string, methods string) { corsAllowedOrigins, corsAllowedMethods = origins, methods }(corsAllowedOrigins, corsAllowedMethods)
+	corsAllowedOrigins, corsAllowedMethods = []string{"https://app.example"}, ""
+	r := gin.New()
+	r.Use(CORS())
+	r.OPTIONS("/api/v1/playlists/1", func(c *gin.Context) {})
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/v1/playlists/1", nil)
+	req.Header.Set("Origin", "https://app.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	allowed := strings.Split(w.Header().Get("Access-Control-Allow-Methods"), ",")
+	for _, m := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		if !containsString(allowed, m) {
+			t.Errorf("preflight allows %v, missing %s", allowed, m)
+		}
+	}
+}
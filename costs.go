@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	S3_FEATURE_OTHER = "other" // S3 calls made without a feature label
+	DAYS_PER_MONTH   = 30
+)
+
+// S3 pricing for the cost estimate, in USD: S3_PRICE_WRITES per 1000 PUT, COPY and LIST
+// calls, S3_PRICE_READS per 1000 GET and HEAD calls, S3_PRICE_GB_OUT per GB downloaded.
+// The defaults are S3 Standard in us-east-1; set S3_PRICE_GB_OUT=0 when the server runs in
+// the bucket's region. S3_DAILY_CALL_QUOTA stops full library scans for the rest of the
+// UTC day once that many calls were made.
+var (
+	s3PriceWrites    = 0.005
+	s3PriceReads     = 0.0004
+	s3PriceGBOut     = 0.09
+	s3DailyCallQuota int64
+)
+
+var errS3BudgetExceeded = errors.New("daily S3 call quota exceeded")
+
+func initS3Costs() error {
+	for _, opt := range []struct {
+		name string
+		dst  *float64
+	}{{"S3_PRICE_WRITES", &s3PriceWrites}, {"S3_PRICE_READS", &s3PriceReads}, {"S3_PRICE_GB_OUT", &s3PriceGBOut}} {
+		if v := os.Getenv(opt.name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 {
+				return fmt.Errorf("invalid %s: %q", opt.name, v)
+			}
+			*opt.dst = f
+		}
+	}
+	if v := os.Getenv("S3_DAILY_CALL_QUOTA"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid S3_DAILY_CALL_QUOTA: %q", v)
+		}
+		s3DailyCallQuota = n
+	}
+	return nil
+}
+
+type s3FeatureCtxKey struct{}
+
+// withS3Feature labels the S3 calls made with ctx for the usage statistics
+func withS3Feature(ctx context.Context, feature string) context.Context {
+	return context.WithValue(ctx, s3FeatureCtxKey{}, feature)
+}
+
+func s3FeatureFrom(ctx context.Context) string {
+	if f, ok := ctx.Value(s3FeatureCtxKey{}).(string); ok {
+		return f
+	}
+	return S3_FEATURE_OTHER
+}
+
+// S3Feature middleware labels the S3 calls of a request with its route
+func S3Feature() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if route := c.FullPath(); route != "" {
+			c.Request = c.Request.WithContext(withS3Feature(c.Request.Context(), strings.TrimPrefix(route, basePath)))
+		}
+		c.Next()
+	}
+}
+
+// s3Usage counts the calls and bytes of one feature
+type s3Usage struct {
+	Writes   int64 `json:"writes"` // PUT, COPY and LIST calls
+	Reads    int64 `json:"reads"`  // GET and HEAD calls
+	Other    int64 `json:"other"`  // DELETE and calls S3 doesn't bill
+	BytesOut int64 `json:"bytesOut"`
+	BytesIn  int64 `json:"bytesIn"`
+}
+
+func (u *s3Usage) add(o s3Usage) {
+	u.Writes += o.Writes
+	u.Reads += o.Reads
+	u.Other += o.Other
+	u.BytesOut += o.BytesOut
+	u.BytesIn += o.BytesIn
+}
+
+func (u s3Usage) calls() int64 {
+	return u.Writes + u.Reads + u.Other
+}
+
+// cost estimates what the usage is billed in USD
+func (u s3Usage) cost() float64 {
+	return float64(u.Writes)/1000*s3PriceWrites + float64(u.Reads)/1000*s3PriceReads + float64(u.BytesOut)/(1<<30)*s3PriceGBOut
+}
+
+// s3UsageMeter keeps S3 usage per feature since startup and for the current UTC day
+type s3UsageMeter struct {
+	mu       sync.Mutex
+	total    map[string]*s3Usage
+	day      string
+	today    s3Usage
+	exceeded bool // the quota was reached today
+}
+
+var s3Meter = &s3UsageMeter{total: make(map[string]*s3Usage)}
+
+// record adds one call of feature, rolling the daily count over at UTC midnight
+func (m *s3UsageMeter) record(feature string, u s3Usage) {
+	day := time.Now().UTC().Format(time.DateOnly)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if day != m.day {
+		m.day, m.today, m.exceeded = day, s3Usage{}, false
+	}
+	t := m.total[feature]
+	if t == nil {
+		t = &s3Usage{}
+		m.total[feature] = t
+	}
+	t.add(u)
+	m.today.add(u)
+	if s3DailyCallQuota > 0 && !m.exceeded && m.today.calls() >= s3DailyCallQuota {
+		m.exceeded = true
+		log.Printf("S3 budget: %d calls today, full library scans are paused until midnight UTC", m.today.calls())
+		eventBus.Publish(EVENT_ERROR, map[string]interface{}{"source": "budget", "message": errS3BudgetExceeded.Error(), "calls": m.today.calls()})
+	}
+}
+
+// guardScan labels ctx for a full library scan, or fails once the daily quota is used up
+func (m *s3UsageMeter) guardScan(ctx context.Context, feature string) (context.Context, error) {
+	m.mu.Lock()
+	exceeded := m.exceeded && m.day == time.Now().UTC().Format(time.DateOnly)
+	m.mu.Unlock()
+	if exceeded {
+		return ctx, errS3BudgetExceeded
+	}
+	return withS3Feature(ctx, feature), nil
+}
+
+// monthlyEstimate extrapolates the cost since startup to a month
+func (m *s3UsageMeter) monthlyEstimate(total s3Usage) float64 {
+	uptime := time.Since(startTime)
+	if uptime < time.Minute {
+		return 0
+	}
+	return total.cost() * float64(DAYS_PER_MONTH*24*time.Hour) / float64(uptime)
+}
+
+// report summarizes the usage for diagnostics
+func (m *s3UsageMeter) report() gin.H {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total s3Usage
+	features := gin.H{}
+	for name, u := range m.total {
+		total.add(*u)
+		features[name] = gin.H{"usage": *u, "costUSD": u.cost()}
+	}
+	return gin.H{
+		"features":            features,
+		"total":               total,
+		"costUSD":             total.cost(),
+		"estimatedMonthlyUSD": m.monthlyEstimate(total),
+		"today":               gin.H{"day": m.day, "calls": m.today.calls(), "quota": s3DailyCallQuota, "exceeded": m.exceeded},
+	}
+}
+
+// writeMetrics appends the usage in Prometheus text format
+func (m *s3UsageMeter) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.total))
+	for name := range m.total {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var total s3Usage
+	fmt.Fprintln(w, "# TYPE go_music_s3_requests_total counter")
+	for _, name := range names {
+		u := m.total[name]
+		total.add(*u)
+		fmt.Fprintf(w, "go_music_s3_requests_total{feature=%q,class=\"write\"} %d\n", name, u.Writes)
+		fmt.Fprintf(w, "go_music_s3_requests_total{feature=%q,class=\"read\"} %d\n", name, u.Reads)
+		fmt.Fprintf(w, "go_music_s3_requests_total{feature=%q,class=\"other\"} %d\n", name, u.Other)
+	}
+	fmt.Fprintln(w, "# TYPE go_music_s3_bytes_total counter")
+	for _, name := range names {
+		u := m.total[name]
+		fmt.Fprintf(w, "go_music_s3_bytes_total{feature=%q,direction=\"out\"} %d\n", name, u.BytesOut)
+		fmt.Fprintf(w, "go_music_s3_bytes_total{feature=%q,direction=\"in\"} %d\n", name, u.BytesIn)
+	}
+	fmt.Fprintf(w, "# TYPE go_music_s3_estimated_monthly_cost_usd gauge\ngo_music_s3_estimated_monthly_cost_usd %g\n", m.monthlyEstimate(total))
+	fmt.Fprintf(w, "# TYPE go_music_s3_calls_today gauge\ngo_music_s3_calls_today %d\n", m.today.calls())
+}
+
+// addS3UsageMiddleware counts every S3 operation that is sent, with the bytes it moves
+func addS3UsageMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("GoMusicS3Usage",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			var u s3Usage
+			switch p := in.Parameters.(type) {
+			case *s3.GetObjectInput, *s3.HeadObjectInput, *s3.HeadBucketInput:
+				u.Reads = 1
+			case *s3.PutObjectInput:
+				u.Writes = 1
+				// Read the length before the upload drains the body
+				if p.ContentLength != nil {
+					u.BytesIn = *p.ContentLength
+				} else if r, ok := p.Body.(interface{ Len() int }); ok {
+					u.BytesIn = int64(r.Len())
+				}
+			case *s3.CopyObjectInput, *s3.ListObjectsV2Input:
+				u.Writes = 1
+			default:
+				u.Other = 1
+			}
+			out, md, err := next.HandleInitialize(ctx, in)
+			if res, ok := out.Result.(*s3.GetObjectOutput); ok {
+				u.BytesOut = aws.ToInt64(res.ContentLength)
+			}
+			s3Meter.record(s3FeatureFrom(ctx), u)
+			return out, md, err
+		}), middleware.Before)
+}
+
+// guardWalk applies the daily quota to a dffunc that walks the library, labelling its
+// calls with the function; a refused request is answered with an error array for callback
+func guardWalk(c *gin.Context, callback string, tail ...interface{}) bool {
+	ctx, err := s3Meter.guardScan(c.Request.Context(), s3FeatureFrom(c.Request.Context()))
+	if err != nil {
+		echoReqHtml(c, append([]interface{}{"error", msg(c, MSG_S3_QUOTA)}, tail...), callback)
+		return false
+	}
+	c.Request = c.Request.WithContext(ctx)
+	return true
+}
+
+// budgetExceeded answers a request whose scan was refused by the daily quota
+func budgetExceeded(c *gin.Context, err error) bool {
+	if !errors.Is(err, errS3BudgetExceeded) {
+		return false
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	return true
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	CUE_EXT           = ".cue"
+	CUE_FRAMES        = 75       // CD frames per second in INDEX positions
+	MAX_CUE_SHEET     = 64 << 10 // larger files are not cue sheets worth parsing
+	CUE_TRACK_MARKER  = ".cue."  // virtual track names are "<sheet>.cue.NN - Title.<ext>"
+	CUE_TITLE_MAX_LEN = 120
+)
+
+// cueTrack is one track of a cue sheet
+type cueTrack struct {
+	Number int     `json:"number"`
+	Title  string  `json:"title"`
+	File   string  `json:"file"`  // library-relative key of the image it is cut from
+	Start  float64 `json:"start"` // seconds
+	End    float64 `json:"end"`   // seconds, 0 = end of the file
+}
+
+// cueDurations remembers virtual track lengths in seconds for manifest.durations
+var cueDurations sync.Map
+
+func isCueSheet(key string) bool {
+	return strings.EqualFold(path.Ext(key), CUE_EXT)
+}
+
+// cueTrackName names a virtual track; it keeps the image's extension so it lists and
+// plays like any other file of that type
+func cueTrackName(sheet string, t cueTrack) string {
+	title := strings.NewReplacer("/", "-", "\\", "-").Replace(t.Title)
+	if r := []rune(title); len(r) > CUE_TITLE_MAX_LEN {
+		title = string(r[:CUE_TITLE_MAX_LEN])
+	}
+	if title == "" {
+		title = fmt.Sprintf("Track %02d", t.Number)
+	}
+	return fmt.Sprintf("%s.%02d - %s%s", sheet, t.Number, strings.TrimSpace(title), path.Ext(t.File))
+}
+
+// parseCueTrackKey splits a virtual track key into its cue sheet key and track number
+func parseCueTrackKey(key string) (string, int, bool) {
+	i := strings.LastIndex(strings.ToLower(key), CUE_TRACK_MARKER)
+	if i < 0 || strings.Contains(key[i:], "/") {
+		return "", 0, false
+	}
+	rest := key[i+len(CUE_TRACK_MARKER):]
+	num, _, ok := strings.Cut(rest, " - ")
+	n, err := strconv.Atoi(num)
+	if !ok || err != nil || n <= 0 {
+		return "", 0, false
+	}
+	return key[:i+len(CUE_EXT)], n, true
+}
+
+// parseCueTime reads an INDEX position, mm:ss:ff
+func parseCueTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid cue time %q", s)
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid cue time %q", s)
+		}
+		v[i] = n
+	}
+	return float64(v[0]*60+v[1]) + float64(v[2])/CUE_FRAMES, nil
+}
+
+// cueField returns the value of a cue command, unquoting it
+func cueField(line string) string {
+	_, v, _ := strings.Cut(line, " ")
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, `"`) {
+		if end := strings.LastIndex(v, `"`); end > 0 {
+			return v[1:end]
+		}
+	}
+	return v
+}
+
+// parseCueSheet reads the tracks of a cue sheet stored at key. Sheets that are not
+// UTF-8 are read as Windows-1252, which most rippers on Windows wrote.
+func parseCueSheet(key string, data []byte) ([]cueTrack, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		decoded, err := charmap.Windows1252.NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	}
+	dir := path.Dir(key)
+	var tracks []cueTrack
+	var file string
+	var cur *cueTrack
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		cmd, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "FILE":
+			v := cueField(line)
+			// FILE "name" WAVE: drop the type when the name wasn't quoted
+			if !strings.HasPrefix(strings.TrimSpace(line[len(cmd):]), `"`) {
+				if i := strings.LastIndex(v, " "); i > 0 {
+					v = v[:i]
+				}
+			}
+			file = path.Join(dir, strings.ReplaceAll(v, "\\", "/"))
+			cur = nil
+		case "TRACK":
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.EqualFold(fields[2], "AUDIO") || file == "" {
+				cur = nil
+				continue
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid track number in %q", line)
+			}
+			tracks = append(tracks, cueTrack{Number: n, File: file, Start: -1})
+			cur = &tracks[len(tracks)-1]
+		case "TITLE":
+			if cur != nil {
+				cur.Title = cueField(line)
+			}
+		case "INDEX":
+			fields := strings.Fields(line)
+			if cur == nil || len(fields) < 3 || fields[1] != "01" {
+				continue
+			}
+			start, err := parseCueTime(fields[2])
+			if err != nil {
+				return nil, err
+			}
+			cur.Start = start
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	var valid []cueTrack
+	for _, t := range tracks {
+		if t.Start >= 0 {
+			valid = append(valid, t)
+		}
+	}
+	// A track ends where the next one of the same file starts
+	for i := range valid {
+		if i+1 < len(valid) && valid[i+1].File == valid[i].File && valid[i+1].Start > valid[i].Start {
+			valid[i].End = valid[i+1].Start
+		}
+	}
+	return valid, nil
+}
+
+// loadCueSheet fetches and parses a cue sheet of the request's library, using the metadata cache
+func loadCueSheet(ctx context.Context, key string) ([]cueTrack, error) {
+	lib := libraryFrom(ctx)
+	cacheKey := "cue\x00" + lib.Name + "\x00" + key
+	var tracks []cueTrack
+	if data, ok := metadataCache.Get(cacheKey); ok && json.Unmarshal(data, &tracks) == nil {
+		return tracks, nil
+	}
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_CUE_SHEET+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_CUE_SHEET {
+		return nil, fmt.Errorf("cue sheet too large")
+	}
+	tracks, err = parseCueSheet(key, data)
+	if err != nil {
+		return nil, err
+	}
+	if data, err := json.Marshal(tracks); err == nil {
+		metadataCache.Set(cacheKey, data)
+	}
+	return tracks, nil
+}
+
+// expandCueSheets replaces audio files that a cue sheet among keys splits with the
+// sheet's virtual tracks. Sheets whose image is not in keys are ignored.
+func expandCueSheets(ctx context.Context, keys []string) []string {
+	present := make(map[string]bool, len(keys))
+	var sheets []string
+	for _, k := range keys {
+		if isCueSheet(k) {
+			sheets = append(sheets, k)
+		} else {
+			present[k] = true
+		}
+	}
+	if len(sheets) == 0 {
+		return keys
+	}
+	sort.Strings(sheets)
+	lib := libraryFrom(ctx)
+	parsed := make([][]cueTrack, len(sheets))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, walkConcurrency)
+	for i, sheet := range sheets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			tracks, err := loadCueSheet(ctx, sheet)
+			if err != nil {
+				log.Printf("Cue sheet %s: %v", sheet, err)
+				return
+			}
+			parsed[i] = tracks
+		}()
+	}
+	wg.Wait()
+
+	// The first sheet in key order claims an image when several reference it
+	virtual := make(map[string][]string) // image key -> virtual track keys
+	owner := make(map[string]string)
+	for i, sheet := range sheets {
+		for _, t := range parsed[i] {
+			if !present[t.File] {
+				continue
+			}
+			if o, ok := owner[t.File]; ok && o != sheet {
+				continue
+			}
+			owner[t.File] = sheet
+			name := cueTrackName(sheet, t)
+			virtual[t.File] = append(virtual[t.File], name)
+			if d := cueTrackLength(lib, t); d > 0 {
+				cueDurations.Store(lib.Name+"\x00"+name, d)
+			}
+		}
+	}
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if tracks, ok := virtual[k]; ok {
+			out = append(out, tracks...)
+		} else {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// cueTrackLength is the length of a virtual track in whole seconds, 0 if unknown
+func cueTrackLength(lib *library, t cueTrack) int {
+	end := t.End
+	if end == 0 {
+		e, ok := manifest.entry(lib, t.File)
+		if !ok || e.DurationMs == 0 {
+			return 0
+		}
+		end = float64(e.DurationMs) / 1000
+	}
+	if end <= t.Start {
+		return 0
+	}
+	return int(end - t.Start + 0.5)
+}
+
+// serveCueTrack streams the part of an image a virtual track covers. With ffmpeg the
+// cut is exact; without it MP3 images are cut at byte offsets estimated from the bitrate.
+func serveCueTrack(c *gin.Context, sheet string, number int) {
+	ctx := c.Request.Context()
+	tracks, err := loadCueSheet(ctx, sheet)
+	if err != nil {
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	var track *cueTrack
+	for i := range tracks {
+		if tracks[i].Number == number {
+			track = &tracks[i]
+			break
+		}
+	}
+	if track == nil || !isListed(track.File, false) {
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	if ffmpegPath != "" {
+		serveObject(c, track.File, &trimPoint{Start: track.Start, End: track.End})
+		return
+	}
+	e, ok := manifest.entry(libraryFrom(ctx), track.File)
+	if strings.ToLower(path.Ext(track.File)) != ".mp3" || !ok || e.Bitrate == 0 || streamPolicy(track.File) != STREAM_DIRECT {
+		c.String(http.StatusNotImplemented, "Splitting this track needs ffmpeg")
+		return
+	}
+	bytesPerSecond := float64(e.Bitrate) * 125
+	rng := fmt.Sprintf("bytes=%d-", int64(track.Start*bytesPerSecond))
+	if track.End > 0 {
+		rng += strconv.FormatInt(int64(track.End*bytesPerSecond)-1, 10)
+	}
+	lib := libraryFrom(ctx)
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + track.File),
+		Range:  aws.String(rng),
+	})
+	if err != nil {
+		log.Printf("S3 cue track error: %v", err)
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	body := throttleReadCloser(resp.Body)
+	defer body.Close()
+	c.Header("Accept-Ranges", "none")
+	c.DataFromReader(http.StatusOK, aws.ToInt64(resp.ContentLength), "audio/mpeg", body, nil)
+}
+
+// expandCueFiles is expandCueSheets for file names relative to dir
+func expandCueFiles(ctx context.Context, dir string, files []string) []string {
+	keys := make([]string, len(files))
+	for i, f := range files {
+		keys[i] = dir + f
+	}
+	keys = expandCueSheets(ctx, keys)
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = strings.TrimPrefix(k, dir)
+	}
+	return out
+}
+
+// s3ListAllTracks lists audio files under prefix like s3ListAllAudioFiles, with images
+// split by a cue sheet replaced by their virtual tracks
+func s3ListAllTracks(ctx context.Context, prefix string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "s3ListAllTracks", trace.WithAttributes(attribute.String("s3.prefix", prefix)))
+	defer span.End()
+	var keys []string
+	err := s3WalkObjects(ctx, prefix, func(key string) bool {
+		return isAudioFile(key) || isCueSheet(key)
+	}, func(page []audioObject) error {
+		for _, obj := range page {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	staleKey := libraryFrom(ctx).Name + "\x00tracks\x00" + prefix
+	if err != nil {
+		var cached []string
+		if lastGoodIndex.recall(staleKey, err, &cached) {
+			return filterVisible(ctx, "", cached, false), nil
+		}
+		return nil, err
+	}
+	if prefix == "" {
+		var audio []string
+		for _, k := range keys {
+			if !isCueSheet(k) {
+				audio = append(audio, k)
+			}
+		}
+		noteLibrarySnapshot(libraryFrom(ctx), "files", audio)
+	}
+	var files []string
+	for _, k := range expandCueSheets(ctx, keys) {
+		if !isCueSheet(k) {
+			files = append(files, k)
+		}
+	}
+	lastGoodIndex.remember(staleKey, files)
+	return filterVisible(ctx, "", files, false), nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LIVE_STREAM_CONTEXT = "liveStream"
+	RECENT_ERRORS       = 50 // error events kept for the dashboard
+)
+
+var errStreamClosed = errors.New("stream closed by an admin")
+
+// liveStream is an /audio or /radio response in progress
+type liveStream struct {
+	id      string
+	user    string
+	ip      string
+	started time.Time
+	cancel  context.CancelFunc
+	sent    atomic.Int64
+	closed  atomic.Bool
+
+	mu      sync.Mutex
+	library string
+	track   string
+	size    int64 // Content-Length of the response, 0 when not known
+}
+
+// streamInfo is a liveStream as listed to admins
+type streamInfo struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	IP       string    `json:"ip"`
+	Library  string    `json:"library,omitempty"`
+	Track    string    `json:"track"`
+	Started  time.Time `json:"started"`
+	Sent     int64     `json:"sent"`
+	Size     int64     `json:"size,omitempty"`
+	Progress float64   `json:"progress,omitempty"` // share of Size sent
+}
+
+func (s *liveStream) info() streamInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := streamInfo{ID: s.id, User: s.user, IP: s.ip, Library: s.library, Track: s.track, Started: s.started, Sent: s.sent.Load(), Size: s.size}
+	if info.Size > 0 {
+		info.Progress = min(1, float64(info.Sent)/float64(info.Size))
+	}
+	return info
+}
+
+// streamWriter counts the bytes of a live stream and fails writes once it is closed
+type streamWriter struct {
+	gin.ResponseWriter
+	stream *liveStream
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	s := w.stream
+	if s.closed.Load() {
+		return 0, errStreamClosed
+	}
+	if s.sent.Load() == 0 {
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			s.mu.Lock()
+			s.size = n
+			s.mu.Unlock()
+		}
+	}
+	n, err := w.ResponseWriter.Write(p)
+	s.sent.Add(int64(n))
+	return n, err
+}
+
+func (w *streamWriter) WriteString(str string) (int, error) {
+	return w.Write([]byte(str))
+}
+
+// open registers the stream of a request, named after its path until the handler
+// names the track
+func (sc *streamCounter) open(c *gin.Context) *liveStream {
+	id := make([]byte, 8)
+	rand.Read(id)
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	s := &liveStream{
+		id:      hex.EncodeToString(id),
+		user:    requestUser(c),
+		ip:      c.ClientIP(),
+		started: time.Now(),
+		cancel:  cancel,
+		track:   strings.TrimPrefix(c.Request.URL.Path, basePath+"/"),
+	}
+	c.Request = c.Request.WithContext(ctx)
+	c.Writer = &streamWriter{ResponseWriter: c.Writer, stream: s}
+	c.Set(LIVE_STREAM_CONTEXT, s)
+	sc.mu.Lock()
+	sc.streams[s.id] = s
+	sc.mu.Unlock()
+	return s
+}
+
+func (sc *streamCounter) close(s *liveStream) {
+	s.cancel()
+	sc.mu.Lock()
+	delete(sc.streams, s.id)
+	sc.mu.Unlock()
+}
+
+// list returns the live streams, oldest first
+func (sc *streamCounter) list() []streamInfo {
+	sc.mu.Lock()
+	streams := make([]*liveStream, 0, len(sc.streams))
+	for _, s := range sc.streams {
+		streams = append(streams, s)
+	}
+	sc.mu.Unlock()
+	out := make([]streamInfo, len(streams))
+	for i, s := range streams {
+		out[i] = s.info()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// disconnect ends a live stream: its writes fail and its S3 read or transcode is cancelled
+func (sc *streamCounter) disconnect(id string) (streamInfo, bool) {
+	sc.mu.Lock()
+	s, ok := sc.streams[id]
+	sc.mu.Unlock()
+	if !ok {
+		return streamInfo{}, false
+	}
+	s.closed.Store(true)
+	s.cancel()
+	return s.info(), true
+}
+
+// noteStreamTrack names the track a live stream is playing
+func noteStreamTrack(c *gin.Context, lib *library, key string) {
+	if v, ok := c.Get(LIVE_STREAM_CONTEXT); ok {
+		s := v.(*liveStream)
+		s.mu.Lock()
+		s.library, s.track = lib.Name, key
+		s.mu.Unlock()
+	}
+}
+
+// errorLog keeps the latest error events of the bus
+type errorLog struct {
+	mu     sync.Mutex
+	events []gin.H
+}
+
+var recentErrors = &errorLog{}
+
+func (l *errorLog) attach(bus *EventBus) {
+	bus.Subscribe("dashboard", EVENT_ERROR, func(ev Event) {
+		entry := gin.H{"time": ev.Time.UTC().Format(time.RFC3339)}
+		for k, v := range ev.Data {
+			entry[k] = v
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(l.events) == RECENT_ERRORS {
+			l.events = l.events[1:]
+		}
+		l.events = append(l.events, entry)
+	})
+}
+
+// list returns the kept errors, newest first
+func (l *errorLog) list() []gin.H {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]gin.H, len(l.events))
+	for i, e := range l.events {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
+
+// indexStatus reports when each library was last listed and scanned, and the inventory in use
+func indexStatus() gin.H {
+	listings := []gin.H{}
+	librarySigMu.Lock()
+	for _, snap := range librarySignatures {
+		listings = append(listings, gin.H{"library": snap.library, "kind": snap.kind, "count": snap.count, "scanned": snap.scanned.UTC().Format(time.RFC3339), "ageSec": int64(time.Since(snap.scanned).Seconds())})
+	}
+	librarySigMu.Unlock()
+	sort.Slice(listings, func(i, j int) bool {
+		return listings[i]["library"].(string)+listings[i]["kind"].(string) < listings[j]["library"].(string)+listings[j]["kind"].(string)
+	})
+	return gin.H{"listings": listings, "manifest": manifest.status(), "inventory": inventory.status()}
+}
+
+// cacheStatus reports the audio disk cache and every cache layer
+func cacheStatus() gin.H {
+	layers := make([]cacheStats, 0, len(cacheLayers))
+	for _, l := range cacheLayers {
+		layers = append(layers, l.Stats())
+	}
+	out := gin.H{"layers": layers}
+	if audioCache != nil {
+		entries, size := audioCache.Stats()
+		out["audio"] = gin.H{"entries": entries, "bytes": size, "maxBytes": audioCache.maxBytes, "hits": audioCache.hits.Load(), "misses": audioCache.misses.Load()}
+	}
+	return out
+}
+
+// --- DASHBOARD HANDLERS ---
+
+// handleDashboard reports streams, sessions, index freshness, caches and recent errors
+// in one response for the admin page (GET /admin/dashboard)
+func handleDashboard(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"streams":    activeStreams.list(),
+		"sessions":   gin.H{"sync": syncClients.sessions(), "events": sseClients.count()},
+		"index":      indexStatus(),
+		"caches":     cacheStatus(),
+		"errors":     recentErrors.list(),
+		"uptimeSec":  int64(time.Since(startTime).Seconds()),
+		"goroutines": runtime.NumGoroutine(),
+	})
+}
+
+// handleListStreams lists the audio and radio streams in progress (GET /admin/streams)
+func handleListStreams(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, activeStreams.list())
+}
+
+// handleDisconnectStream ends a stream in progress (DELETE /admin/streams/:id)
+func handleDisconnectStream(c *gin.Context) {
+	s, ok := activeStreams.disconnect(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown stream"})
+		return
+	}
+	audit.record(c, "stream.disconnect", s.Library, s.Track, s.User+" "+s.IP)
+	c.JSON(http.StatusOK, s)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEVICE_TTL            = 2 * time.Minute // devices that stop polling are dropped
+	MAX_DEVICE_COMMANDS   = 50              // pending commands kept per device
+	MAX_DEVICES           = 1000            // registered devices in total
+	MAX_OWNER_DEVICES     = 20              // registered devices per API key user or device group
+	MAX_IP_DEVICES        = 20              // registered devices per client IP
+	DEVICE_REGISTER_RATE  = 0.1             // new registrations per second per IP
+	DEVICE_REGISTER_BURST = 5
+)
+
+var (
+	errTooManyDevices    = errors.New("Too many devices")
+	errDeviceRateLimited = errors.New("Too many registrations, try again later")
+	errUnknownGroup      = errors.New("Unknown device group")
+)
+
+// device is a registered playback client that can receive commands. The server issues
+// its secret, which polling and refreshing must present, and its owner: the API key
+// user that registered it, or else a device group whose secret the first device of the
+// group received and others join with.
+type device struct {
+	ID           string
+	Owner        string // only requests proving this owner can list the device and send it commands
+	Name         string
+	Capabilities []string
+	LastSeen     time.Time
+	secret       string
+	ip           string
+	pending      []deviceCommand
+}
+
+// deviceCommand is a playback command targeted at a device
+type deviceCommand struct {
+	From    string `json:"from"`
+	Command string `json:"command"`
+	Arg     string `json:"arg"`
+}
+
+type deviceRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*device
+	limiter *ipRateLimiter // paces new registrations per client IP
+}
+
+var devices = &deviceRegistry{
+	devices: make(map[string]*device),
+	limiter: &ipRateLimiter{rate: DEVICE_REGISTER_RATE, burst: DEVICE_REGISTER_BURST, buckets: make(map[string]*tokenBucket)},
+}
+
+func newDeviceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newDeviceSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sameSecret(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// deviceOwner returns the owner a request acts as: its API key user, or the device
+// group whose secret it presents. It is empty when the request proves neither.
+func deviceOwner(c *gin.Context, group string) string {
+	if user, ok := homeUser(c); ok {
+		return "user:" + user
+	}
+	if group != "" {
+		return "group:" + group
+	}
+	return ""
+}
+
+// register refreshes the device id when secret matches, or adds a new device of owner
+// and returns its id and secret. An empty owner starts a new device group, whose
+// secret is returned as group. New devices are rate limited per ip and capped per
+// owner, per ip and in total.
+func (r *deviceRegistry) register(owner, ip, id, secret, name string, capabilities []string) (newID, newSecret, group string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked()
+	if d, ok := r.devices[id]; ok && sameSecret(secret, d.secret) {
+		d.Name = name
+		d.Capabilities = capabilities
+		d.LastSeen = time.Now()
+		return id, secret, strings.TrimPrefix(d.Owner, "group:"), nil
+	}
+	if strings.HasPrefix(owner, "group:") && !r.ownerKnownLocked(owner) {
+		return "", "", "", errUnknownGroup
+	}
+	owned, fromIP := 0, 0
+	for _, d := range r.devices {
+		if owner != "" && d.Owner == owner {
+			owned++
+		}
+		if d.ip == ip {
+			fromIP++
+		}
+	}
+	if len(r.devices) >= MAX_DEVICES || owned >= MAX_OWNER_DEVICES || fromIP >= MAX_IP_DEVICES {
+		return "", "", "", errTooManyDevices
+	}
+	if ok, _ := r.limiter.allow(ip); !ok {
+		return "", "", "", errDeviceRateLimited
+	}
+	if owner == "" {
+		owner = "group:" + newDeviceSecret()
+	}
+	d := &device{ID: newDeviceID(), Owner: owner, Name: name, Capabilities: capabilities, LastSeen: time.Now(), secret: newDeviceSecret(), ip: ip}
+	r.devices[d.ID] = d
+	return d.ID, d.secret, strings.TrimPrefix(owner, "group:"), nil
+}
+
+func (r *deviceRegistry) ownerKnownLocked(owner string) bool {
+	for _, d := range r.devices {
+		if sameSecret(owner, d.Owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the registered devices of owner sorted by name
+func (r *deviceRegistry) list(owner string) []device {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked()
+	out := make([]device, 0)
+	for _, d := range r.devices {
+		if sameSecret(owner, d.Owner) {
+			out = append(out, *d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// send queues a command for the target device, which must belong to owner
+func (r *deviceRegistry) send(owner, target string, cmd deviceCommand) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[target]
+	if !ok || !sameSecret(owner, d.Owner) {
+		return false
+	}
+	d.queue(cmd)
+	return true
+}
+
+// broadcast queues a command for every device named name, whoever registered it, and
+// returns how many got it. Only admin-defined schedules use it.
+func (r *deviceRegistry) broadcast(name string, cmd deviceCommand) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked()
+	sent := 0
+	for _, d := range r.devices {
+		if strings.EqualFold(d.Name, name) {
+			d.queue(cmd)
+			sent++
+		}
+	}
+	return sent
+}
+
+func (d *device) queue(cmd deviceCommand) {
+	d.pending = append(d.pending, cmd)
+	if len(d.pending) > MAX_DEVICE_COMMANDS {
+		d.pending = d.pending[len(d.pending)-MAX_DEVICE_COMMANDS:]
+	}
+}
+
+// poll returns and clears the pending commands of the device id, which must present
+// its secret
+func (r *deviceRegistry) poll(id, secret string) ([]deviceCommand, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[id]
+	if !ok || !sameSecret(secret, d.secret) {
+		return nil, false
+	}
+	d.LastSeen = time.Now()
+	cmds := d.pending
+	d.pending = nil
+	return cmds, true
+}
+
+func (r *deviceRegistry) expireLocked() {
+	for id, d := range r.devices {
+		if time.Since(d.LastSeen) > DEVICE_TTL {
+			delete(r.devices, id)
+		}
+	}
+}
+
+// --- DEVICE HANDLERS ---
+func handleRegisterDevice(c *gin.Context, data string) {
+	var req struct {
+		ID           string   `json:"id"`
+		Secret       string   `json:"secret"`
+		Group        string   `json:"group"`
+		Name         string   `json:"name"`
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := json.Unmarshal([]byte(data), &req); err != nil || strings.TrimSpace(req.Name) == "" {
+		echoReqHtml(c, []interface{}{"error", "Invalid device data"}, "getDeviceRegistration")
+		return
+	}
+	id, secret, group, err := devices.register(deviceOwner(c, req.Group), c.ClientIP(), req.ID, req.Secret, strings.TrimSpace(req.Name), req.Capabilities)
+	if err != nil {
+		echoReqHtml(c, []interface{}{"error", err.Error()}, "getDeviceRegistration")
+		return
+	}
+	if strings.HasPrefix(group, "user:") {
+		group = "" // devices of a key user need no group secret
+	}
+	echoReqHtml(c, []interface{}{"ok", id, secret, group}, "getDeviceRegistration")
+}
+
+// handleListDevices lists the devices of the request's key user, or of the device
+// group whose secret is data
+func handleListDevices(c *gin.Context, group string) {
+	owner := deviceOwner(c, group)
+	if owner == "" {
+		echoReqHtml(c, []interface{}{"error", errUnknownGroup.Error()}, "getDevices")
+		return
+	}
+	list := devices.list(owner)
+	ids := make([]string, len(list))
+	names := make([]string, len(list))
+	caps := make([]string, len(list))
+	for i, d := range list {
+		ids[i] = d.ID
+		names[i] = d.Name
+		caps[i] = strings.Join(d.Capabilities, ",")
+	}
+	echoReqHtml(c, []interface{}{"ok", ids, names, caps}, "getDevices")
+}
+
+func handleSendDeviceCommand(c *gin.Context, data string) {
+	var req struct {
+		Group   string `json:"group"`
+		From    string `json:"from"`
+		Target  string `json:"target"`
+		Command string `json:"command"`
+		Arg     string `json:"arg"`
+	}
+	if err := json.Unmarshal([]byte(data), &req); err != nil || req.Target == "" || req.Command == "" {
+		echoReqHtml(c, []interface{}{"error", "Invalid command data"}, "getDeviceCommandResult")
+		return
+	}
+	owner := deviceOwner(c, req.Group)
+	if owner == "" || !devices.send(owner, req.Target, deviceCommand{From: req.From, Command: req.Command, Arg: req.Arg}) {
+		echoReqHtml(c, []interface{}{"error", "Unknown device"}, "getDeviceCommandResult")
+		return
+	}
+	echoReqHtml(c, []interface{}{"ok", req.Target}, "getDeviceCommandResult")
+}
+
+func handlePollDeviceCommands(c *gin.Context, data string) {
+	var req struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+	cmds, ok := []deviceCommand(nil), false
+	if json.Unmarshal([]byte(data), &req) == nil {
+		cmds, ok = devices.poll(req.ID, req.Secret)
+	}
+	if !ok {
+		echoReqHtml(c, []interface{}{"error", "Unknown device"}, "getDeviceCommands")
+		return
+	}
+	from := make([]string, len(cmds))
+	commands := make([]string, len(cmds))
+	args := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		from[i] = cmd.From
+		commands[i] = cmd.Command
+		args[i] = cmd.Arg
+	}
+	echoReqHtml(c, []interface{}{"ok", commands, args, from}, "getDeviceCommands")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRegistry() *deviceRegistry {
+	return &deviceRegistry{
+		devices: make(map[string]*device),
+		limiter: &ipRateLimiter{rate: 1000, burst: 1000, buckets: make(map[string]*tokenBucket)},
+	}
+}
+
+// TestDeviceSecrets checks that only the device secret polls and refreshes a device and
+// only its group reaches it
+func TestDeviceSecrets(t *testing.T) {
+	r := newTestRegistry()
+	id, secret, group, err := r.register("", "1.1.1.1", "", "", "Kitchen", nil)
+	if err != nil || group == "" {
+		t.Fatalf("register: %v, group %q", err, group)
+	}
+	if _, _, _, err := r.register("group:guess", "2.2.2.2", "", "", "Phone", nil); err != errUnknownGroup {
+		t.Errorf("joining an unissued group: %v, want %v", err, errUnknownGroup)
+	}
+	if r.send("group:other", id, deviceCommand{Command: "pause"}) {
+		t.Error("another group sent a command")
+	}
+	if !r.send("group:"+group, id, deviceCommand{Command: "pause"}) {
+		t.Error("own group could not send a command")
+	}
+	if _, ok := r.poll(id, ""); ok {
+		t.Error("polled without the device secret")
+	}
+	if cmds, ok := r.poll(id, secret); !ok || len(cmds) != 1 {
+		t.Errorf("poll = %v, %v; want one command", cmds, ok)
+	}
+	if other, _, _, _ := r.register("", "3.3.3.3", id, "wrong", "Evil", nil); other == id {
+		t.Error("registering without the secret took over the device")
+	}
+	if got := r.list("group:" + group); len(got) != 1 || got[0].Name != "Kitchen" {
+		t.Errorf("list = %v, want only Kitchen", got)
+	}
+}
+
+// TestDeviceCaps checks that one client IP cannot fill the registry
+func TestDeviceCaps(t *testing.T) {
+	r := newTestRegistry()
+	for i := 0; i < MAX_IP_DEVICES; i++ {
+		if _, _, _, err := r.register("", "1.1.1.1", "", "", "Spam", nil); err != nil {
+			t.Fatalf("register %d: %v", i, err)
+		}
+	}
+	if _, _, _, err := r.register("", "1.1.1.1", "", "", "Spam", nil); err != errTooManyDevices {
+		t.Errorf("register past the IP cap: %v, want %v", err, errTooManyDevices)
+	}
+	if _, _, _, err := r.register("", "2.2.2.2", "", "", "Kitchen", nil); err != nil {
+		t.Errorf("another IP: %v", err)
+	}
+	for _, d := range r.devices {
+		d.LastSeen = time.Now().Add(-2 * DEVICE_TTL)
+	}
+	if _, _, _, err := r.register("", "1.1.1.1", "", "", "Spam", nil); err != nil {
+		t.Errorf("register after expiry: %v", err)
+	}
+}
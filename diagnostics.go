@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const DIAGNOSTICS_TIMEOUT = 5 * time.Second
+
+var startTime = time.Now()
+
+// credentialSource describes where AWS credentials come from without revealing them
+func credentialSource() string {
+	if s3AssumeRoleARN != "" {
+		return "assume role " + s3AssumeRoleARN + " with " + baseCredentialSource()
+	}
+	return baseCredentialSource()
+}
+
+func baseCredentialSource() string {
+	switch {
+	case os.Getenv("AWS_ACCESS_KEY_ID") != "":
+		return "environment"
+	case os.Getenv("AWS_PROFILE") != "":
+		return "profile " + os.Getenv("AWS_PROFILE")
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		return "web identity"
+	default:
+		return "default provider chain"
+	}
+}
+
+// handleDiagnostics reports bucket reachability, configuration, index and build info (GET /api/v1/diagnostics)
+func handleDiagnostics(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), DIAGNOSTICS_TIMEOUT)
+	defer cancel()
+	start := time.Now()
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s3Bucket)})
+	bucket := gin.H{
+		"name":      s3Bucket,
+		"region":    s3Region,
+		"prefix":    s3Prefix,
+		"reachable": err == nil,
+		"latencyMs": time.Since(start).Milliseconds(),
+		"breaker":   s3Breaker.state(),
+	}
+	if err != nil {
+		bucket["status"] = classifyS3Error(err)
+		bucket["error"] = err.Error()
+	}
+
+	libs := make([]gin.H, len(libraries))
+	for i, lib := range libraries {
+		libs[i] = gin.H{"name": lib.Name, "bucket": lib.Bucket, "prefix": lib.Prefix}
+	}
+	index := gin.H{}
+	librarySigMu.Lock()
+	for id, snap := range librarySignatures {
+		index[id] = gin.H{"library": snap.library, "kind": snap.kind, "count": snap.count, "scanned": snap.scanned.UTC().Format(time.RFC3339)}
+	}
+	librarySigMu.Unlock()
+
+	resp := gin.H{
+		"bucket":      bucket,
+		"credentials": credentialSource(),
+		"libraries":   libs,
+		"index":       index,
+		"collections": len(collections.list()),
+		"s3Usage":     s3Meter.report(),
+		"build": gin.H{
+			"version":   version,
+			"commit":    commitHash,
+			"date":      buildDate,
+			"goVersion": runtime.Version(),
+		},
+		"uptimeSec": int64(time.Since(startTime).Seconds()),
+	}
+	if audioCache != nil {
+		entries, size := audioCache.Stats()
+		resp["cache"] = gin.H{"entries": entries, "bytes": size, "maxBytes": audioCache.maxBytes}
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, resp)
+}
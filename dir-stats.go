@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dirStats sums up the tracks under a folder, subfolders included
+type dirStats struct {
+	Name     string     `json:"name,omitempty"`
+	Tracks   int        `json:"tracks"`
+	Size     int64      `json:"size"`
+	Duration int        `json:"duration"`         // seconds, of the tracks the manifest knows
+	Unknown  int        `json:"unknownDuration"`  // tracks not scanned for their length yet
+	Newest   *time.Time `json:"newest,omitempty"` // latest modification of a track
+}
+
+func (s *dirStats) add(obj audioObject, duration int) {
+	s.Tracks++
+	s.Size += obj.Size
+	if duration > 0 {
+		s.Duration += duration
+	} else {
+		s.Unknown++
+	}
+	if s.Newest == nil || obj.Modified.After(*s.Newest) {
+		modified := obj.Modified
+		s.Newest = &modified
+	}
+}
+
+// handleGetDirStats reports the totals of dir and of each of its subfolders, largest
+// first, from one listing of the objects under dir
+func handleGetDirStats(c *gin.Context, dir string) {
+	ctx := c.Request.Context()
+	lib := libraryFrom(ctx)
+	var total dirStats
+	byFolder := make(map[string]*dirStats)
+	err := s3WalkAudioObjects(ctx, dir, func(page []audioObject) error {
+		keys := make([]string, len(page))
+		for i, obj := range page {
+			keys[i] = obj.Key
+		}
+		durations := manifest.durations(lib, keys)
+		for i, obj := range page {
+			if isMetaDir(obj.Key) {
+				continue
+			}
+			total.add(obj, durations[i])
+			name, _, nested := strings.Cut(strings.TrimPrefix(obj.Key, dir), "/")
+			if !nested {
+				continue // tracks directly in dir only count towards the total
+			}
+			s, ok := byFolder[name]
+			if !ok {
+				s = &dirStats{Name: name}
+				byFolder[name] = s
+			}
+			s.add(obj, durations[i])
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("S3 dir stats error: %v", err)
+		echoReqHtml(c, []interface{}{"error", "Failed to scan S3 directory"}, "getDirStatsData")
+		return
+	}
+	folders := make([]dirStats, 0, len(byFolder))
+	for _, s := range byFolder {
+		folders = append(folders, *s)
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		if folders[i].Size != folders[j].Size {
+			return folders[i].Size > folders[j].Size
+		}
+		return folders[i].Name < folders[j].Name
+	})
+	echoReqHtml(c, []interface{}{"ok", dir, total, folders}, "getDirStatsData")
+}
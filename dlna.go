@@ -0,0 +1,752 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SSDP_ADDR           = "239.255.255.250:1900"
+	SSDP_MAX_AGE        = 1800
+	SSDP_NOTIFY_EVERY   = 10 * time.Minute
+	SSDP_MAX_DELAY      = 3 * time.Second // caps the MX a searcher asks for
+	SSDP_MAX_PENDING    = 32              // search responses waiting for their delay
+	DLNA_MAX_BODY       = 64 << 10
+	DLNA_MAX_COUNT      = 500 // objects in one Browse response
+	DLNA_DEVICE_TYPE    = "urn:schemas-upnp-org:device:MediaServer:1"
+	DLNA_CONTENT_DIR    = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	DLNA_CONNECTION_MGR = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+	// UPnP error codes of the control protocol
+	UPNP_INVALID_ACTION = 401
+	UPNP_INVALID_ARGS   = 402
+	UPNP_NO_SUCH_OBJECT = 701
+	UPNP_CANNOT_PROCESS = 720
+)
+
+// DLNA=true advertises the libraries on the LAN as a UPnP MediaServer, so smart TVs,
+// Sonos and AV receivers find them over SSDP and browse folders through ContentDirectory
+// without a custom client. Renderers play the same /audio URLs as the web player, without
+// credentials, so it is refused with USER_HOMES. The device description is announced at
+// this server's LAN address and LISTEN_ADDR port; DLNA_URL (e.g.
+// "http://192.168.1.10:8080") overrides that when a proxy or a unix socket is in front.
+// DLNA_NAME is the name shown on renderers. IP_ALLOW and IP_DENY apply to searches.
+var (
+	dlnaEnabled = os.Getenv("DLNA") == "true"
+	dlnaURL     = strings.TrimRight(os.Getenv("DLNA_URL"), "/")
+	dlnaName    = os.Getenv("DLNA_NAME")
+	dlnaScheme  = "http"
+	dlnaPort    string
+	dlnaUUID    string
+)
+
+func initDLNA() error {
+	if !dlnaEnabled {
+		return nil
+	}
+	if userHomes {
+		return fmt.Errorf("DLNA cannot be used with USER_HOMES, renderers don't sign in")
+	}
+	if dlnaName == "" {
+		dlnaName = "go-music"
+		if host, err := os.Hostname(); err == nil {
+			dlnaName += " (" + host + ")"
+		}
+	}
+	sum := sha1.Sum([]byte("go-music dlna\x00" + dlnaName + "\x00" + s3Bucket + "\x00" + s3Prefix))
+	sum[6] = sum[6]&0x0f | 0x50 // version 5, name-based
+	sum[8] = sum[8]&0x3f | 0x80
+	dlnaUUID = fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+	if dlnaURL != "" {
+		u, err := url.Parse(dlnaURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("DLNA_URL must be an http:// or https:// URL")
+		}
+		return nil
+	}
+	addr := listenAddr
+	if tlsCert != "" || autocertDomains != "" {
+		dlnaScheme = "https"
+		if addr == "" {
+			addr = ":443"
+		}
+	} else if addr == "" {
+		addr = ":8080"
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("DLNA needs DLNA_URL when LISTEN_ADDR is %q", addr)
+	}
+	dlnaPort = port
+	return nil
+}
+
+// dlnaLocation is the device description URL for clients reaching this host at local
+func dlnaLocation(local net.IP) string {
+	if dlnaURL != "" {
+		return dlnaURL + "/dlna/device.xml"
+	}
+	return dlnaScheme + "://" + net.JoinHostPort(local.String(), dlnaPort) + basePath + "/dlna/device.xml"
+}
+
+// ssdpTargets are the search targets and notification types the device answers to
+func ssdpTargets() []string {
+	return []string{"upnp:rootdevice", "uuid:" + dlnaUUID, DLNA_DEVICE_TYPE, DLNA_CONTENT_DIR, DLNA_CONNECTION_MGR}
+}
+
+// ssdpUSN is the unique service name of target
+func ssdpUSN(target string) string {
+	if target == "uuid:"+dlnaUUID {
+		return target
+	}
+	return "uuid:" + dlnaUUID + "::" + target
+}
+
+// ssdpResponses builds the answers to an M-SEARCH for st, none when nothing matches
+func ssdpResponses(st, location string, now time.Time) []string {
+	var targets []string
+	for _, t := range ssdpTargets() {
+		if st == "ssdp:all" || st == t {
+			targets = append(targets, t)
+		}
+	}
+	responses := make([]string, len(targets))
+	for i, t := range targets {
+		responses[i] = "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=" + strconv.Itoa(SSDP_MAX_AGE) + "\r\n" +
+			"DATE: " + now.UTC().Format(http.TimeFormat) + "\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + location + "\r\n" +
+			"SERVER: " + ssdpServer() + "\r\n" +
+			"ST: " + t + "\r\n" +
+			"USN: " + ssdpUSN(t) + "\r\n\r\n"
+	}
+	return responses
+}
+
+// ssdpNotify builds the alive or byebye announcement of target
+func ssdpNotify(target, nts, location string) string {
+	msg := "NOTIFY * HTTP/1.1\r\nHOST: " + SSDP_ADDR + "\r\n" +
+		"NT: " + target + "\r\nNTS: " + nts + "\r\nUSN: " + ssdpUSN(target) + "\r\n"
+	if nts == "ssdp:alive" {
+		msg += "CACHE-CONTROL: max-age=" + strconv.Itoa(SSDP_MAX_AGE) + "\r\n" +
+			"LOCATION: " + location + "\r\nSERVER: " + ssdpServer() + "\r\n"
+	}
+	return msg + "\r\n"
+}
+
+func ssdpServer() string {
+	if version == "" {
+		return "Linux/1.0 UPnP/1.0 go-music/dev" // the token needs a version
+	}
+	return "Linux/1.0 UPnP/1.0 go-music/" + version
+}
+
+// runDLNA answers SSDP searches and announces the device until ctx is done
+func runDLNA(ctx context.Context) {
+	group, _ := net.ResolveUDPAddr("udp4", SSDP_ADDR)
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("SSDP listener failed: %v", err)
+		return
+	}
+	log.Printf("DLNA MediaServer %q announced on %s", dlnaName, SSDP_ADDR)
+	go func() {
+		ssdpAnnounce(group, "ssdp:alive")
+		ticker := time.NewTicker(SSDP_NOTIFY_EVERY)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ssdpAnnounce(group, "ssdp:alive")
+			case <-ctx.Done():
+				ssdpAnnounce(group, "ssdp:byebye")
+				conn.Close()
+				return
+			}
+		}
+	}()
+	pending := make(chan struct{}, SSDP_MAX_PENDING)
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("SSDP read error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !ipAllowed(src.IP.String()) {
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		st := req.Header.Get("St")
+		delay := SSDP_MAX_DELAY
+		if mx, err := strconv.Atoi(req.Header.Get("Mx")); err == nil && time.Duration(mx)*time.Second < delay {
+			delay = time.Duration(mx) * time.Second
+		}
+		select {
+		case pending <- struct{}{}:
+		default:
+			continue // searches are flooding in
+		}
+		time.AfterFunc(rand.N(delay+time.Millisecond), func() {
+			defer func() { <-pending }()
+			ssdpRespond(src, st)
+		})
+	}
+}
+
+// ssdpRespond sends the answers to a search by unicast, from the address src reaches
+func ssdpRespond(src *net.UDPAddr, st string) {
+	conn, err := net.DialUDP("udp4", nil, src)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	for _, msg := range ssdpResponses(st, dlnaLocation(local), time.Now()) {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return
+		}
+	}
+}
+
+// ssdpAnnounce multicasts a notification for each target
+func ssdpAnnounce(group *net.UDPAddr, nts string) {
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("SSDP announce failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	location := dlnaLocation(conn.LocalAddr().(*net.UDPAddr).IP)
+	for _, t := range ssdpTargets() {
+		conn.Write([]byte(ssdpNotify(t, nts, location)))
+	}
+}
+
+// RequireDLNA answers 404 unless DLNA=true
+func RequireDLNA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !dlnaEnabled {
+			c.String(http.StatusNotFound, "Not found")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleDLNADevice serves the device description (GET /dlna/device.xml)
+func handleDLNADevice(c *gin.Context) {
+	service := func(typ, name string) string {
+		return "<service><serviceType>" + typ + "</serviceType>" +
+			"<serviceId>urn:upnp-org:serviceId:" + name + "</serviceId>" +
+			"<SCPDURL>" + basePath + "/dlna/" + name + ".xml</SCPDURL>" +
+			"<controlURL>" + basePath + "/dlna/control/" + name + "</controlURL>" +
+			"<eventSubURL>" + basePath + "/dlna/event/" + name + "</eventSubURL></service>"
+	}
+	doc := xml.Header + `<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">` +
+		"<specVersion><major>1</major><minor>0</minor></specVersion><device>" +
+		"<deviceType>" + DLNA_DEVICE_TYPE + "</deviceType>" +
+		"<friendlyName>" + html.EscapeString(dlnaName) + "</friendlyName>" +
+		"<manufacturer>go-music</manufacturer><modelName>go-music</modelName>" +
+		"<modelNumber>" + html.EscapeString(version) + "</modelNumber>" +
+		"<UDN>uuid:" + dlnaUUID + "</UDN><dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC><serviceList>" +
+		service(DLNA_CONTENT_DIR, "ContentDirectory") + service(DLNA_CONNECTION_MGR, "ConnectionManager") +
+		"</serviceList></device></root>"
+	c.Data(http.StatusOK, `text/xml; charset="utf-8"`, []byte(doc))
+}
+
+// upnpAction describes an action of a service: its arguments, each "name" for inputs
+// or "-name" for outputs, and the state variable each relates to
+type upnpAction struct {
+	name string
+	args [][2]string
+}
+
+var contentDirectoryActions = []upnpAction{
+	{"Browse", [][2]string{{"ObjectID", "A_ARG_TYPE_ObjectID"}, {"BrowseFlag", "A_ARG_TYPE_BrowseFlag"},
+		{"Filter", "A_ARG_TYPE_Filter"}, {"StartingIndex", "A_ARG_TYPE_Index"}, {"RequestedCount", "A_ARG_TYPE_Count"},
+		{"SortCriteria", "A_ARG_TYPE_SortCriteria"}, {"-Result", "A_ARG_TYPE_Result"}, {"-NumberReturned", "A_ARG_TYPE_Count"},
+		{"-TotalMatches", "A_ARG_TYPE_Count"}, {"-UpdateID", "A_ARG_TYPE_UpdateID"}}},
+	{"GetSearchCapabilities", [][2]string{{"-SearchCaps", "SearchCapabilities"}}},
+	{"GetSortCapabilities", [][2]string{{"-SortCaps", "SortCapabilities"}}},
+	{"GetSystemUpdateID", [][2]string{{"-Id", "SystemUpdateID"}}},
+}
+
+var connectionManagerActions = []upnpAction{
+	{"GetProtocolInfo", [][2]string{{"-Source", "SourceProtocolInfo"}, {"-Sink", "SinkProtocolInfo"}}},
+	{"GetCurrentConnectionIDs", [][2]string{{"-ConnectionIDs", "CurrentConnectionIDs"}}},
+	{"GetCurrentConnectionInfo", [][2]string{{"ConnectionID", "A_ARG_TYPE_ConnectionID"}, {"-RcsID", "A_ARG_TYPE_RcsID"},
+		{"-AVTransportID", "A_ARG_TYPE_AVTransportID"}, {"-ProtocolInfo", "A_ARG_TYPE_ProtocolInfo"},
+		{"-PeerConnectionManager", "A_ARG_TYPE_ConnectionManager"}, {"-PeerConnectionID", "A_ARG_TYPE_ConnectionID"},
+		{"-Direction", "A_ARG_TYPE_Direction"}, {"-Status", "A_ARG_TYPE_ConnectionStatus"}}},
+}
+
+// State variables of each service: name, data type and allowed values
+var contentDirectoryVars = [][3]string{
+	{"A_ARG_TYPE_ObjectID", "string", ""}, {"A_ARG_TYPE_BrowseFlag", "string", "BrowseMetadata,BrowseDirectChildren"},
+	{"A_ARG_TYPE_Filter", "string", ""}, {"A_ARG_TYPE_Index", "ui4", ""}, {"A_ARG_TYPE_Count", "ui4", ""},
+	{"A_ARG_TYPE_SortCriteria", "string", ""}, {"A_ARG_TYPE_Result", "string", ""}, {"A_ARG_TYPE_UpdateID", "ui4", ""},
+	{"SearchCapabilities", "string", ""}, {"SortCapabilities", "string", ""}, {"SystemUpdateID", "ui4", ""},
+}
+
+var connectionManagerVars = [][3]string{
+	{"SourceProtocolInfo", "string", ""}, {"SinkProtocolInfo", "string", ""}, {"CurrentConnectionIDs", "string", ""},
+	{"A_ARG_TYPE_ConnectionStatus", "string", "OK,ContentFormatMismatch,InsufficientBandwidth,UnreliableChannel,Unknown"},
+	{"A_ARG_TYPE_ConnectionManager", "string", ""}, {"A_ARG_TYPE_Direction", "string", "Input,Output"},
+	{"A_ARG_TYPE_ProtocolInfo", "string", ""}, {"A_ARG_TYPE_ConnectionID", "i4", ""},
+	{"A_ARG_TYPE_AVTransportID", "i4", ""}, {"A_ARG_TYPE_RcsID", "i4", ""},
+}
+
+// scpd renders a service description
+func scpd(actions []upnpAction, vars [][3]string) string {
+	var b strings.Builder
+	b.WriteString(xml.Header + `<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><actionList>`)
+	for _, a := range actions {
+		b.WriteString("<action><name>" + a.name + "</name><argumentList>")
+		for _, arg := range a.args {
+			name, dir := arg[0], "in"
+			if out, ok := strings.CutPrefix(name, "-"); ok {
+				name, dir = out, "out"
+			}
+			b.WriteString("<argument><name>" + name + "</name><direction>" + dir + "</direction><relatedStateVariable>" + arg[1] + "</relatedStateVariable></argument>")
+		}
+		b.WriteString("</argumentList></action>")
+	}
+	b.WriteString("</actionList><serviceStateTable>")
+	for _, v := range vars {
+		b.WriteString(`<stateVariable sendEvents="no"><name>` + v[0] + "</name><dataType>" + v[1] + "</dataType>")
+		if v[2] != "" {
+			b.WriteString("<allowedValueList>")
+			for _, value := range strings.Split(v[2], ",") {
+				b.WriteString("<allowedValue>" + value + "</allowedValue>")
+			}
+			b.WriteString("</allowedValueList>")
+		}
+		b.WriteString("</stateVariable>")
+	}
+	b.WriteString("</serviceStateTable></scpd>")
+	return b.String()
+}
+
+// handleDLNAService serves a service description (GET /dlna/ContentDirectory.xml and
+// /dlna/ConnectionManager.xml)
+func handleDLNAService(actions []upnpAction, vars [][3]string) gin.HandlerFunc {
+	doc := []byte(scpd(actions, vars))
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, `text/xml; charset="utf-8"`, doc)
+	}
+}
+
+// handleDLNASubscribe accepts event subscriptions (SUBSCRIBE and UNSUBSCRIBE
+// /dlna/event/:service). No state variable is evented, so no event is ever sent.
+func handleDLNASubscribe(c *gin.Context) {
+	if c.Request.Method == "SUBSCRIBE" {
+		sid := c.GetHeader("SID")
+		if sid == "" {
+			sid = "uuid:" + newDeviceID()
+		}
+		c.Header("SID", sid)
+		c.Header("TIMEOUT", "Second-"+strconv.Itoa(SSDP_MAX_AGE))
+	}
+	c.Status(http.StatusOK)
+}
+
+type soapEnvelope struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// upnpError is answered as a SOAP fault
+type upnpError struct {
+	code int
+	msg  string
+}
+
+func (e upnpError) Error() string { return e.msg }
+
+// handleDLNAControl runs a SOAP action (POST /dlna/control/:service)
+func handleDLNAControl(c *gin.Context) {
+	service := c.Param("service")
+	var urn string
+	switch service {
+	case "ContentDirectory":
+		urn = DLNA_CONTENT_DIR
+	case "ConnectionManager":
+		urn = DLNA_CONNECTION_MGR
+	default:
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	var env soapEnvelope
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, DLNA_MAX_BODY)).Decode(&env); err != nil {
+		soapFault(c, upnpError{UPNP_INVALID_ACTION, "Invalid Action"})
+		return
+	}
+	action := env.Body.Action.XMLName.Local
+	if _, name, ok := strings.Cut(strings.Trim(c.GetHeader("SOAPACTION"), `"`), "#"); ok && name != action {
+		soapFault(c, upnpError{UPNP_INVALID_ACTION, "Invalid Action"})
+		return
+	}
+	args := make(map[string]string)
+	for _, arg := range env.Body.Action.Args {
+		args[arg.XMLName.Local] = arg.Value
+	}
+	var out [][2]string
+	var err error
+	if service == "ContentDirectory" {
+		out, err = contentDirectoryAction(c, action, args)
+	} else {
+		out, err = connectionManagerAction(action, args)
+	}
+	if err != nil {
+		var ue upnpError
+		if !errors.As(err, &ue) {
+			log.Printf("DLNA %s error: %v", action, err)
+			ue = upnpError{UPNP_CANNOT_PROCESS, "Cannot process the request"}
+		}
+		soapFault(c, ue)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(xml.Header + `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	b.WriteString("<u:" + action + `Response xmlns:u="` + urn + `">`)
+	for _, kv := range out {
+		b.WriteString("<" + kv[0] + ">" + html.EscapeString(kv[1]) + "</" + kv[0] + ">")
+	}
+	b.WriteString("</u:" + action + "Response></s:Body></s:Envelope>")
+	c.Header("EXT", "")
+	c.Data(http.StatusOK, `text/xml; charset="utf-8"`, []byte(b.String()))
+}
+
+// soapFault answers a UPnP error
+func soapFault(c *gin.Context, e upnpError) {
+	doc := xml.Header + `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		"<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>" +
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` + strconv.Itoa(e.code) + "</errorCode>" +
+		"<errorDescription>" + html.EscapeString(e.msg) + "</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>"
+	c.Data(http.StatusInternalServerError, `text/xml; charset="utf-8"`, []byte(doc))
+}
+
+func connectionManagerAction(action string, args map[string]string) ([][2]string, error) {
+	switch action {
+	case "GetProtocolInfo":
+		var source []string
+		for _, ext := range audioExtensions {
+			if ctype, _ := servedContentType(defaultLibrary(), "x."+ext); ctype != "" {
+				source = append(source, "http-get:*:"+ctype+":*")
+			}
+		}
+		return [][2]string{{"Source", strings.Join(source, ",")}, {"Sink", ""}}, nil
+	case "GetCurrentConnectionIDs":
+		return [][2]string{{"ConnectionIDs", "0"}}, nil
+	case "GetCurrentConnectionInfo":
+		if args["ConnectionID"] != "0" {
+			return nil, upnpError{706, "Invalid connection reference"}
+		}
+		return [][2]string{{"RcsID", "-1"}, {"AVTransportID", "-1"}, {"ProtocolInfo", ""},
+			{"PeerConnectionManager", ""}, {"PeerConnectionID", "-1"}, {"Direction", "Output"}, {"Status", "OK"}}, nil
+	}
+	return nil, upnpError{UPNP_INVALID_ACTION, "Invalid Action"}
+}
+
+func contentDirectoryAction(c *gin.Context, action string, args map[string]string) ([][2]string, error) {
+	switch action {
+	case "GetSearchCapabilities":
+		return [][2]string{{"SearchCaps", ""}}, nil
+	case "GetSortCapabilities":
+		return [][2]string{{"SortCaps", ""}}, nil
+	case "GetSystemUpdateID":
+		return [][2]string{{"Id", "1"}}, nil
+	case "Browse":
+		return dlnaBrowse(c, args)
+	}
+	return nil, upnpError{UPNP_INVALID_ACTION, "Invalid Action"}
+}
+
+// DIDL-Lite objects; containers are libraries and folders, items are tracks
+type didlLite struct {
+	XMLName    xml.Name        `xml:"DIDL-Lite"`
+	Xmlns      string          `xml:"xmlns,attr"`
+	DC         string          `xml:"xmlns:dc,attr"`
+	UPnP       string          `xml:"xmlns:upnp,attr"`
+	Containers []didlContainer `xml:"container"`
+	Items      []didlItem      `xml:"item"`
+}
+
+type didlContainer struct {
+	ID         string `xml:"id,attr"`
+	ParentID   string `xml:"parentID,attr"`
+	Restricted string `xml:"restricted,attr"`
+	Title      string `xml:"dc:title"`
+	Class      string `xml:"upnp:class"`
+}
+
+type didlItem struct {
+	ID          string  `xml:"id,attr"`
+	ParentID    string  `xml:"parentID,attr"`
+	Restricted  string  `xml:"restricted,attr"`
+	Title       string  `xml:"dc:title"`
+	Creator     string  `xml:"dc:creator,omitempty"`
+	Artist      string  `xml:"upnp:artist,omitempty"`
+	Album       string  `xml:"upnp:album,omitempty"`
+	Genre       string  `xml:"upnp:genre,omitempty"`
+	TrackNumber int     `xml:"upnp:originalTrackNumber,omitempty"`
+	AlbumArt    string  `xml:"upnp:albumArtURI,omitempty"`
+	Class       string  `xml:"upnp:class"`
+	Res         didlRes `xml:"res"`
+}
+
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Duration     string `xml:"duration,attr,omitempty"`
+	URL          string `xml:",chardata"`
+}
+
+// dlnaObject is what an object ID names: the root, or a folder ("" or ending in '/')
+// or track of a library
+type dlnaObject struct {
+	lib  *library
+	path string
+}
+
+// dlnaID is the object ID of p in lib. With a single library its root is the root.
+func dlnaID(lib *library, p string) string {
+	if p == "" && len(libraries) == 1 {
+		return "0"
+	}
+	return url.PathEscape(lib.Name) + "/" + p
+}
+
+// dlnaParent is the object ID of the folder holding p
+func dlnaParent(lib *library, p string) string {
+	if p == "" {
+		return "0"
+	}
+	parent := path.Dir(strings.TrimSuffix(p, "/"))
+	if parent == "." {
+		return dlnaID(lib, "")
+	}
+	return dlnaID(lib, parent+"/")
+}
+
+// parseDLNAID reads an object ID, the root having no library with several of them
+func parseDLNAID(id string) (dlnaObject, bool) {
+	if id == "0" {
+		if len(libraries) == 1 {
+			return dlnaObject{lib: libraries[0]}, true
+		}
+		return dlnaObject{}, true
+	}
+	name, p, ok := strings.Cut(id, "/")
+	if !ok {
+		return dlnaObject{}, false
+	}
+	name, err := url.PathUnescape(name)
+	lib := findLibrary(name)
+	if err != nil || lib == nil || (p != "" && (checkKey(strings.TrimSuffix(p, "/")) != "" || isServerOwned(lib, strings.TrimSuffix(p, "/")))) {
+		return dlnaObject{}, false
+	}
+	return dlnaObject{lib: lib, path: p}, true
+}
+
+// dlnaBrowse answers Browse with the metadata of an object or a page of its children
+func dlnaBrowse(c *gin.Context, args map[string]string) ([][2]string, error) {
+	obj, ok := parseDLNAID(args["ObjectID"])
+	if !ok {
+		return nil, upnpError{UPNP_NO_SUCH_OBJECT, "No such object"}
+	}
+	start, err1 := strconv.Atoi(args["StartingIndex"])
+	count, err2 := strconv.Atoi(args["RequestedCount"])
+	if err1 != nil || err2 != nil || start < 0 || count < 0 {
+		return nil, upnpError{UPNP_INVALID_ARGS, "Invalid Args"}
+	}
+	if count == 0 || count > DLNA_MAX_COUNT {
+		count = DLNA_MAX_COUNT
+	}
+	didl := didlLite{Xmlns: "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/",
+		DC: "http://purl.org/dc/elements/1.1/", UPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/"}
+	var total int
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		if err := dlnaMetadata(c, obj, &didl); err != nil {
+			return nil, err
+		}
+		total = 1
+	case "BrowseDirectChildren":
+		var err error
+		if total, err = dlnaChildren(c, obj, start, count, &didl); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, upnpError{UPNP_INVALID_ARGS, "Invalid Args"}
+	}
+	result, err := xml.Marshal(didl)
+	if err != nil {
+		return nil, err
+	}
+	return [][2]string{{"Result", string(result)}, {"NumberReturned", strconv.Itoa(len(didl.Containers) + len(didl.Items))},
+		{"TotalMatches", strconv.Itoa(total)}, {"UpdateID", "1"}}, nil
+}
+
+// dlnaContext scopes a request to lib and the folders it may see
+func dlnaContext(c *gin.Context, lib *library) context.Context {
+	ctx := withLibrary(c.Request.Context(), lib)
+	if prefixes, ok := requestAccess(c); ok {
+		ctx = withAccess(ctx, prefixes)
+	}
+	return ctx
+}
+
+func dlnaMetadata(c *gin.Context, obj dlnaObject, didl *didlLite) error {
+	switch {
+	case obj.lib == nil || (obj.path == "" && len(libraries) == 1):
+		didl.Containers = append(didl.Containers, didlContainer{ID: "0", ParentID: "-1", Restricted: "1",
+			Title: dlnaName, Class: "object.container.storageFolder"})
+	case obj.path == "":
+		didl.Containers = append(didl.Containers, didlContainer{ID: dlnaID(obj.lib, ""), ParentID: "0", Restricted: "1",
+			Title: obj.lib.Name, Class: "object.container.storageFolder"})
+	case strings.HasSuffix(obj.path, "/"):
+		ctx := dlnaContext(c, obj.lib)
+		dir := strings.TrimSuffix(obj.path, "/")
+		if !isListed(dir, true) || !folderVisible(ctx, dir, true) {
+			return upnpError{UPNP_NO_SUCH_OBJECT, "No such object"}
+		}
+		didl.Containers = append(didl.Containers, didlContainer{ID: dlnaID(obj.lib, obj.path), ParentID: dlnaParent(obj.lib, obj.path),
+			Restricted: "1", Title: path.Base(dir), Class: "object.container.storageFolder"})
+	default:
+		ctx := dlnaContext(c, obj.lib)
+		if !isAudioFile(obj.path) || !isListed(obj.path, false) || !folderVisible(ctx, obj.path, false) {
+			return upnpError{UPNP_NO_SUCH_OBJECT, "No such object"}
+		}
+		object := obj.path
+		if sheet, _, ok := parseCueTrackKey(obj.path); ok {
+			object = sheet
+		}
+		if _, _, _, err := s3HeadAudioFile(ctx, object); err != nil {
+			return upnpError{UPNP_NO_SUCH_OBJECT, "No such object"}
+		}
+		didl.Items = dlnaItems(c, obj.lib, []string{obj.path}, "")
+	}
+	return nil
+}
+
+// dlnaChildren lists a page of the children of obj, returning how many there are
+func dlnaChildren(c *gin.Context, obj dlnaObject, start, count int, didl *didlLite) (int, error) {
+	if obj.lib == nil {
+		for i, lib := range libraries {
+			if i >= start && len(didl.Containers) < count {
+				didl.Containers = append(didl.Containers, didlContainer{ID: dlnaID(lib, ""), ParentID: "0",
+					Restricted: "1", Title: lib.Name, Class: "object.container.storageFolder"})
+			}
+		}
+		return len(libraries), nil
+	}
+	if obj.path != "" && !strings.HasSuffix(obj.path, "/") {
+		return 0, nil // a track has no children
+	}
+	ctx := dlnaContext(c, obj.lib)
+	if obj.path != "" && (!isListed(strings.TrimSuffix(obj.path, "/"), true) || !folderVisible(ctx, strings.TrimSuffix(obj.path, "/"), true)) {
+		return 0, upnpError{UPNP_NO_SUCH_OBJECT, "No such object"}
+	}
+	dirs, files, err := s3List(ctx, obj.path, "/")
+	if err != nil {
+		return 0, err
+	}
+	artwork := ""
+	if art := pickArtwork(files); art != "" && obj.path != "" {
+		segments := strings.Split(strings.TrimSuffix(obj.path, "/"), "/")
+		for i, seg := range segments {
+			segments[i] = url.PathEscape(seg)
+		}
+		artwork = "/artwork/" + strings.Join(segments, "/")
+		if obj.lib != defaultLibrary() {
+			artwork += "?" + url.Values{"lib": {obj.lib.Name}}.Encode()
+		}
+		artwork = externalURL(c, artwork)
+	}
+	order := requestOrder(c)
+	order.sortDirs(dirs)
+	var tracks []string
+	for _, f := range expandCueFiles(ctx, obj.path, files) {
+		if isAudioFile(f) {
+			tracks = append(tracks, f)
+		}
+	}
+	order.sortTracks(ctx, obj.path, tracks)
+	for i := start; i < len(dirs) && len(didl.Containers) < count; i++ {
+		didl.Containers = append(didl.Containers, didlContainer{ID: dlnaID(obj.lib, obj.path+dirs[i]+"/"), ParentID: dlnaID(obj.lib, obj.path),
+			Restricted: "1", Title: dirs[i], Class: "object.container.storageFolder"})
+	}
+	if first := max(start-len(dirs), 0); first < len(tracks) {
+		page := tracks[first:min(len(tracks), first+count-len(didl.Containers))]
+		keys := make([]string, len(page))
+		for i, f := range page {
+			keys[i] = obj.path + f
+		}
+		didl.Items = dlnaItems(c, obj.lib, keys, artwork)
+	}
+	return len(dirs) + len(tracks), nil
+}
+
+// dlnaItems describes tracks with their tags, duration and stream URL
+func dlnaItems(c *gin.Context, lib *library, keys []string, artwork string) []didlItem {
+	durations := manifest.durations(lib, keys)
+	items := make([]didlItem, len(keys))
+	for i, key := range keys {
+		name := path.Base(key)
+		ctype, direct := servedContentType(lib, key)
+		protocol := "http-get:*:" + ctype + ":DLNA.ORG_OP=00"
+		if direct {
+			protocol = "http-get:*:" + ctype + ":DLNA.ORG_OP=01" // byte ranges
+		}
+		item := didlItem{ID: dlnaID(lib, key), ParentID: dlnaParent(lib, key), Restricted: "1",
+			Title: strings.TrimSuffix(name, path.Ext(name)), AlbumArt: artwork, Class: "object.item.audioItem.musicTrack",
+			Res: didlRes{ProtocolInfo: protocol, URL: externalURL(c, strings.TrimPrefix(audioURL(lib, key, nil), basePath))}}
+		if d := durations[i]; d > 0 {
+			item.Res.Duration = fmt.Sprintf("%d:%02d:%02d.000", d/3600, d/60%60, d%60)
+		}
+		if tags, ok := tagsIndex.get(lib, key); ok && !tags.empty() {
+			if tags.Title != "" {
+				item.Title = tags.Title
+			}
+			item.Creator, item.Artist, item.Album, item.Genre, item.TrackNumber = tags.Artist, tags.Artist, tags.Album, tags.Genre, tags.Track
+		}
+		items[i] = item
+	}
+	return items
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSSDPResponses(t *testing.T) {
+	defer func(id string) { dlnaUUID = id }(dlnaUUID)
+	dlnaUUID = "0f2e"
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		st   string
+		usns []string
+	}{
+		{"ssdp:all", []string{"uuid:0f2e::upnp:rootdevice", "uuid:0f2e", "uuid:0f2e::" + DLNA_DEVICE_TYPE, "uuid:0f2e::" + DLNA_CONTENT_DIR, "uuid:0f2e::" + DLNA_CONNECTION_MGR}},
+		{"upnp:rootdevice", []string{"uuid:0f2e::upnp:rootdevice"}},
+		{"uuid:0f2e", []string{"uuid:0f2e"}},
+		{DLNA_CONTENT_DIR, []string{"uuid:0f2e::" + DLNA_CONTENT_DIR}},
+		{"urn:schemas-upnp-org:device:MediaRenderer:1", nil},
+	}
+	for _, tt := range tests {
+		responses := ssdpResponses(tt.st, "http://10.0.0.2:8080/dlna/device.xml", now)
+		if len(responses) != len(tt.usns) {
+			t.Fatalf("ST %s: %d responses, want %d", tt.st, len(responses), len(tt.usns))
+		}
+		for i, res := range responses {
+			if !strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(res, "\r\n\r\n") ||
+				!strings.Contains(res, "\r\nUSN: "+tt.usns[i]+"\r\n") ||
+				!strings.Contains(res, "\r\nLOCATION: http://10.0.0.2:8080/dlna/device.xml\r\n") ||
+				!strings.Contains(res, "\r\nDATE: Fri, 02 Jan 2026 03:04:05 GMT\r\n") {
+				t.Errorf("ST %s: response %q", tt.st, res)
+			}
+		}
+	}
+}
+
+// TestDLNABrowse browses a fake bucket through the ContentDirectory control URL
+func TestDLNABrowse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(libs []*library, on bool) { libraries, dlnaEnabled = libs, on }(libraries, dlnaEnabled)
+	libraries = []*library{{Name: "Music", Bucket: "music"}}
+	dlnaEnabled = true
+	useFakeS3(t, &fakeS3{objects: map[string]string{"music/Jazz/a.mp3": "a", "music/Jazz/cover.jpg": "c", "music/Jazz/Sub/b.mp3": "b", "music/c.mp3": "c"}})
+	r := gin.New()
+	registerRoutes(r)
+
+	browse := func(id, flag string, start, count int) (int, string) {
+		body := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+			`<u:Browse xmlns:u="` + DLNA_CONTENT_DIR + `"><ObjectID>` + id + `</ObjectID><BrowseFlag>` + flag + `</BrowseFlag>` +
+			`<Filter>*</Filter><StartingIndex>` + strconv.Itoa(start) + `</StartingIndex><RequestedCount>` + strconv.Itoa(count) + `</RequestedCount>` +
+			`<SortCriteria></SortCriteria></u:Browse></s:Body></s:Envelope>`
+		req := httptest.NewRequest(http.MethodPost, "/dlna/control/ContentDirectory", strings.NewReader(body))
+		req.Host = "10.0.0.2:8080"
+		req.Header.Set("SOAPACTION", `"`+DLNA_CONTENT_DIR+`#Browse"`)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	tests := []struct {
+		name, id, flag string
+		start, count   int
+		code           int
+		want           []string
+	}{
+		{"root", "0", "BrowseDirectChildren", 0, 0, http.StatusOK, []string{
+			`&lt;container id=&#34;Music/Jazz/&#34; parentID=&#34;0&#34; restricted=&#34;1&#34;&gt;&lt;dc:title&gt;Jazz&lt;/dc:title&gt;`,
+			`&lt;item id=&#34;Music/c.mp3&#34; parentID=&#34;0&#34;`,
+			`<NumberReturned>2</NumberReturned><TotalMatches>2</TotalMatches>`}},
+		{"folder page", "Music/Jazz/", "BrowseDirectChildren", 1, 1, http.StatusOK, []string{
+			`&lt;dc:title&gt;a&lt;/dc:title&gt;&lt;upnp:albumArtURI&gt;http://10.0.0.2:8080/artwork/Jazz&lt;/upnp:albumArtURI&gt;`,
+			`protocolInfo=&#34;http-get:*:audio/mpeg:DLNA.ORG_OP=01&#34;&gt;http://10.0.0.2:8080/audio/Jazz/a.mp3&lt;/res&gt;`,
+			`<NumberReturned>1</NumberReturned><TotalMatches>2</TotalMatches>`}},
+		{"track metadata", "Music/Jazz/Sub/b.mp3", "BrowseMetadata", 0, 0, http.StatusOK, []string{
+			`&lt;item id=&#34;Music/Jazz/Sub/b.mp3&#34; parentID=&#34;Music/Jazz/Sub/&#34;`}},
+		{"missing track", "Music/Jazz/x.mp3", "BrowseMetadata", 0, 0, http.StatusInternalServerError, []string{
+			`<errorCode>701</errorCode>`}},
+		{"unknown library", "Nope/", "BrowseDirectChildren", 0, 0, http.StatusInternalServerError, []string{
+			`<errorCode>701</errorCode>`}},
+		{"bad flag", "0", "BrowseAll", 0, 0, http.StatusInternalServerError, []string{
+			`<errorCode>402</errorCode>`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := browse(tt.id, tt.flag, tt.start, tt.count)
+			if code != tt.code {
+				t.Fatalf("status %d, body %s", code, body)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %s\nmissing %s", body, want)
+				}
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		dlnaEnabled = false
+		defer func() { dlnaEnabled = true }()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dlna/device.xml", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status %d, want 404", w.Code)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_SHUTDOWN_DRAIN = 30 * time.Second
+	SHUTDOWN_TIMEOUT       = 5 * time.Second // for the remaining idle connections once streams are done
+	DRAIN_POLL_INTERVAL    = 250 * time.Millisecond
+)
+
+// SHUTDOWN_DRAIN is how long active audio streams may keep playing after
+// SIGTERM/SIGINT before the server closes them; 0 stops immediately
+var shutdownDrain = DEFAULT_SHUTDOWN_DRAIN
+
+var (
+	draining      atomic.Bool
+	drainDeadline atomic.Int64 // unix nanoseconds
+)
+
+func initShutdownDrain() error {
+	if v := os.Getenv("SHUTDOWN_DRAIN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid SHUTDOWN_DRAIN: %q", v)
+		}
+		shutdownDrain = d
+	}
+	return nil
+}
+
+// Drain middleware refuses new requests with 503 and a Retry-After while the server drains
+func Drain() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !draining.Load() {
+			c.Next()
+			return
+		}
+		secs := int(math.Ceil(time.Until(time.Unix(0, drainDeadline.Load())).Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(secs))
+		c.Header("Connection", "close")
+		c.String(http.StatusServiceUnavailable, "Server is restarting")
+		c.Abort()
+	}
+}
+
+// serveUntilSignal runs serve until it fails or a shutdown signal arrives, then drains srv
+func serveUntilSignal(srv *http.Server, serve func() error) error {
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		log.Printf("Received %s, draining for up to %s", s, shutdownDrain)
+	}
+	drainServer(srv, sig)
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// drainServer keeps serving active streams until they finish, the drain window
+// ends or a second signal arrives, then shuts the server down
+func drainServer(srv *http.Server, sig <-chan os.Signal) {
+	drainDeadline.Store(time.Now().Add(shutdownDrain).UnixNano())
+	draining.Store(true)
+	srv.SetKeepAlivesEnabled(false)
+
+	deadline := time.NewTimer(shutdownDrain)
+	defer deadline.Stop()
+	ticker := time.NewTicker(DRAIN_POLL_INTERVAL)
+	defer ticker.Stop()
+wait:
+	for activeStreams.total() > 0 {
+		select {
+		case <-deadline.C:
+			log.Printf("Drain window over, closing %d active stream(s)", activeStreams.total())
+			break wait
+		case s := <-sig:
+			log.Printf("Received %s again, closing %d active stream(s)", s, activeStreams.total())
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		// Long-lived connections such as /events never go idle
+		srv.Close()
+	}
+	log.Printf("Server stopped")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DUPLICATES_TIMEOUT    = 5 * time.Minute
+	MAX_DUPLICATE_DELETES = 500 // deletions applied per request
+)
+
+// Why the copies of a group are considered the same track
+const (
+	DUPLICATE_IDENTICAL = "identical" // same size and ETag
+	DUPLICATE_NAME      = "name"      // same normalized file name, ignoring track numbers and extension
+	DUPLICATE_AUDIO     = "audio"     // same length, loudness and peak per the manifest and loudness index
+	DUPLICATE_ACOUSTIC  = "acoustic"  // same AcoustID track, or nearly the same Chromaprint fingerprint
+)
+
+var trackNumberRe = regexp.MustCompile(`^(?:\d{1,3}|[a-d]\d{1,2})(?:\s*[-.)_]\s*|\s+)`)
+
+type duplicateCopy struct {
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	Duration int    `json:"duration,omitempty"`
+}
+
+type duplicateGroup struct {
+	Reason string          `json:"reason"`
+	Copies []duplicateCopy `json:"copies"`
+}
+
+// duplicateName reduces a file name to what names of the same track have in common
+func duplicateName(key string) string {
+	name, _ := normalizeComponent(path.Base(key), true)
+	if name == "" {
+		name = path.Base(key)
+	}
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return strings.ToLower(trackNumberRe.ReplaceAllString(name, ""))
+}
+
+// duplicateReport groups the tracks of the request's library that are likely copies of
+// each other. A set of copies found for several reasons is reported once, under the first.
+func duplicateReport(ctx context.Context) ([]duplicateGroup, error) {
+	lib := libraryFrom(ctx)
+	ctx, err := s3Meter.guardScan(ctx, "duplicates")
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s3ListAudioObjects(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+	durations := manifest.durations(lib, keys)
+
+	byReason := map[string]map[string][]int{DUPLICATE_IDENTICAL: {}, DUPLICATE_NAME: {}, DUPLICATE_AUDIO: {}}
+	loudness.mu.RLock()
+	measured := loudness.libraries[lib.Name]
+	for i, obj := range objects {
+		id := fmt.Sprintf("%d\x00%s", obj.Size, obj.ETag)
+		byReason[DUPLICATE_IDENTICAL][id] = append(byReason[DUPLICATE_IDENTICAL][id], i)
+		if n := duplicateName(obj.Key); n != "" {
+			byReason[DUPLICATE_NAME][n] = append(byReason[DUPLICATE_NAME][n], i)
+		}
+		if e, ok := measured[obj.Key]; ok && !e.Failed && e.ETag == obj.ETag && durations[i] > 0 {
+			fp := fmt.Sprintf("%d\x00%.1f\x00%.1f", durations[i], e.Integrated, e.Peak)
+			byReason[DUPLICATE_AUDIO][fp] = append(byReason[DUPLICATE_AUDIO][fp], i)
+		}
+	}
+	loudness.mu.RUnlock()
+	byReason[DUPLICATE_ACOUSTIC] = fingerprints.duplicates(lib, objects)
+
+	groups := []duplicateGroup{}
+	reported := make(map[string]bool)
+	for _, reason := range []string{DUPLICATE_IDENTICAL, DUPLICATE_NAME, DUPLICATE_AUDIO, DUPLICATE_ACOUSTIC} {
+		var found []duplicateGroup
+		for _, members := range byReason[reason] {
+			if len(members) < 2 {
+				continue
+			}
+			g := duplicateGroup{Reason: reason}
+			for _, i := range members {
+				g.Copies = append(g.Copies, duplicateCopy{Key: objects[i].Key, Size: objects[i].Size, Duration: durations[i]})
+			}
+			sort.Slice(g.Copies, func(a, b int) bool { return g.Copies[a].Key < g.Copies[b].Key })
+			set := make([]string, len(g.Copies))
+			for j, cp := range g.Copies {
+				set[j] = cp.Key
+			}
+			if id := strings.Join(set, "\x00"); !reported[id] {
+				reported[id] = true
+				found = append(found, g)
+			}
+		}
+		sort.Slice(found, func(a, b int) bool { return found[a].Copies[0].Key < found[b].Copies[0].Key })
+		groups = append(groups, found...)
+	}
+	return groups, nil
+}
+
+// --- DUPLICATE HANDLERS ---
+
+// handleDuplicateReport lists likely duplicate tracks of a library (GET /admin/duplicates?library=)
+func handleDuplicateReport(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(withLibrary(c.Request.Context(), lib), DUPLICATES_TIMEOUT)
+	defer cancel()
+	groups, err := duplicateReport(ctx)
+	if budgetExceeded(c, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Duplicate report error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list library"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "groups": groups})
+}
+
+// handleDuplicateDelete deletes chosen copies (POST /admin/duplicates/delete?library=
+// with {"keys":[...]}). Only keys of a current duplicate group are deleted, and never
+// every copy of a group.
+func handleDuplicateDelete(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Keys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keys are required"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(withLibrary(c.Request.Context(), lib), DUPLICATES_TIMEOUT)
+	defer cancel()
+	groups, err := duplicateReport(ctx)
+	if budgetExceeded(c, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Duplicate report error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list library"})
+		return
+	}
+	wanted := make(map[string]bool, len(req.Keys))
+	for _, k := range req.Keys {
+		wanted[k] = true
+	}
+	// A key may be deleted when some group it belongs to keeps a copy that isn't deleted
+	allowed := make(map[string]bool)
+	for _, g := range groups {
+		kept := 0
+		for _, cp := range g.Copies {
+			if !wanted[cp.Key] {
+				kept++
+			}
+		}
+		if kept == 0 {
+			continue
+		}
+		for _, cp := range g.Copies {
+			allowed[cp.Key] = true
+		}
+	}
+	deleted := []string{}
+	var skipped, failed int
+	for _, key := range req.Keys {
+		if !allowed[key] || len(deleted) >= MAX_DUPLICATE_DELETES {
+			skipped++
+			continue
+		}
+		if err := s3TrashObject(ctx, key); err != nil {
+			log.Printf("Delete %s failed: %v", key, err)
+			failed++
+			continue
+		}
+		trims.set(ctx, lib, key, nil)
+		audit.record(c, "track.delete", lib.Name, key, "duplicate")
+		deleted = append(deleted, key)
+	}
+	if len(deleted) > 0 {
+		log.Printf("Deleted %d duplicate tracks in %s", len(deleted), lib.Name)
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "deleted": deleted, "skipped": skipped, "failed": failed})
+}
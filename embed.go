@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EMBED_WIDTH        = 480
+	EMBED_TRACK_HEIGHT = 90  // title and audio controls
+	EMBED_LIST_HEIGHT  = 360 // with a scrolling track list
+	EMBED_MIN_SIZE     = 60
+)
+
+// embedTitle is the display name of a share: the track name without extension, the
+// folder name or the collection name
+func embedTitle(sh share) string {
+	switch sh.Kind {
+	case SHARE_TRACK:
+		return strings.TrimSuffix(path.Base(sh.Target), path.Ext(sh.Target))
+	case SHARE_FOLDER:
+		if sh.Target == "" {
+			return sh.Library
+		}
+		return path.Base(strings.TrimSuffix(sh.Target, "/"))
+	}
+	return sh.Target
+}
+
+// embedShare resolves the token of an embed or oEmbed request to a usable share
+func embedShare(c *gin.Context, token string) (share, *library, bool) {
+	id, err := parseShareToken(token)
+	if err != nil {
+		shareError(c, err)
+		return share{}, nil, false
+	}
+	sh, err := shares.get(c.Request.Context(), id, false)
+	if err != nil {
+		shareError(c, err)
+		return share{}, nil, false
+	}
+	lib := findLibrary(sh.Library)
+	if lib == nil {
+		c.String(http.StatusNotFound, "Share not found")
+		return share{}, nil, false
+	}
+	return sh, lib, true
+}
+
+// handleEmbed serves a minimal player for a share, for iframes on other sites
+// (GET /embed/:token). Pages discover it through the oEmbed link in the head.
+func handleEmbed(c *gin.Context) {
+	token := c.Param("token")
+	sh, lib, ok := embedShare(c, token)
+	if !ok {
+		return
+	}
+	title := embedTitle(sh)
+	var items strings.Builder
+	src := externalURL(c, "/share/"+token)
+	if sh.Kind != SHARE_TRACK {
+		tracks, err := shareTracks(withLibrary(c.Request.Context(), lib), sh)
+		if err != nil {
+			log.Printf("Share listing error: %v", err)
+			c.String(http.StatusInternalServerError, "Failed to list shared tracks")
+			return
+		}
+		for i, t := range tracks {
+			rel := t
+			if sh.Kind == SHARE_FOLDER {
+				rel = strings.TrimPrefix(t, sh.Target)
+			}
+			segments := strings.Split(rel, "/")
+			for j, seg := range segments {
+				segments[j] = url.PathEscape(seg)
+			}
+			u := externalURL(c, "/share/"+token+"/"+strings.Join(segments, "/"))
+			if i == 0 {
+				src = u
+			}
+			name := strings.TrimSuffix(path.Base(t), path.Ext(t))
+			fmt.Fprintf(&items, "\t\t<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(u), html.EscapeString(name))
+		}
+	}
+	oembed := externalURL(c, "/oembed") + "?format=json&url=" + url.QueryEscape(externalURL(c, "/embed/"+token))
+	list := ""
+	if items.Len() > 0 {
+		list = "\n\t<ol id=\"tracks\">\n" + items.String() + "\t</ol>"
+	}
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Data(http.StatusOK, "text/html; charset="+CHARSET, []byte(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="UTF-8">
+	<title>`+html.EscapeString(title)+`</title>
+	<meta name="viewport" content="width=device-width,initial-scale=1">
+	<meta name="robots" content="noindex">
+	<link rel="alternate" type="application/json+oembed" href="`+html.EscapeString(oembed)+`" title="`+html.EscapeString(title)+`">
+	<style>
+		body { font-family: sans-serif; margin: 8px; background: #fff; color: #222; }
+		.title { font-weight: bold; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; margin-bottom: 6px; }
+		audio { width: 100%; }
+		ol { max-height: 250px; overflow-y: auto; margin: 6px 0 0; padding-left: 2em; }
+		a { color: inherit; text-decoration: none; }
+		li.playing a { font-weight: bold; }
+	</style>
+</head>
+<body>
+	<div class="title" id="title">`+html.EscapeString(title)+`</div>
+	<audio id="player" controls preload="none" src="`+html.EscapeString(src)+`"></audio>`+list+`
+	<script src="`+basePath+`/static/embed.js"></script>
+</body>
+</html>`))
+}
+
+// handleOEmbed describes an embed or share link for oEmbed consumers
+// (GET /oembed?url=&maxwidth=&maxheight=&format=json)
+func handleOEmbed(c *gin.Context) {
+	if f := c.DefaultQuery("format", "json"); f != "json" {
+		c.String(http.StatusNotImplemented, "Only json is supported")
+		return
+	}
+	u, err := url.Parse(c.Query("url"))
+	if err != nil {
+		c.String(http.StatusNotFound, "Share not found")
+		return
+	}
+	var token string
+	for _, marker := range []string{"/embed/", "/share/"} {
+		if i := strings.LastIndex(u.Path, marker); i >= 0 {
+			token, _, _ = strings.Cut(u.Path[i+len(marker):], "/")
+			break
+		}
+	}
+	sh, _, ok := embedShare(c, token)
+	if !ok {
+		return
+	}
+	width, height := EMBED_WIDTH, EMBED_LIST_HEIGHT
+	if sh.Kind == SHARE_TRACK {
+		height = EMBED_TRACK_HEIGHT
+	}
+	if v, err := strconv.Atoi(c.Query("maxwidth")); err == nil && v >= EMBED_MIN_SIZE {
+		width = min(width, v)
+	}
+	if v, err := strconv.Atoi(c.Query("maxheight")); err == nil && v >= EMBED_MIN_SIZE {
+		height = min(height, v)
+	}
+	title := embedTitle(sh)
+	src := externalURL(c, "/embed/"+token)
+	c.JSON(http.StatusOK, gin.H{
+		"version":       "1.0",
+		"type":          "rich",
+		"provider_name": "go-music",
+		"provider_url":  externalURL(c, "/"),
+		"title":         title,
+		"width":         width,
+		"height":        height,
+		"cache_age":     max(int(time.Until(sh.Expires).Seconds()), 0),
+		"html": fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" title="%s" frameborder="0" allow="autoplay"></iframe>`,
+			html.EscapeString(src), width, height, html.EscapeString(title)),
+	})
+}
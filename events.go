@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SSE_CLIENT_BUFFER = 16               // events queued per client before dropping
+	SSE_KEEPALIVE     = 30 * time.Second // comment sent to keep proxies from closing idle streams
+)
+
+// sseEvent is a named event pushed to /events subscribers
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+// sseSubscriber is the user an /events subscriber is signed in as and the folders it is
+// limited to, nil when it isn't
+type sseSubscriber struct {
+	user   string
+	access []string
+}
+
+// eventBroker holds the /events subscribers
+type eventBroker struct {
+	mu      sync.Mutex
+	clients map[chan sseEvent]sseSubscriber
+}
+
+var sseClients = &eventBroker{clients: make(map[chan sseEvent]sseSubscriber)}
+
+// sseEventTypes are the bus events forwarded to browsers; others (e.g. search queries) stay internal
+var sseEventTypes = []string{EVENT_SCAN_PROGRESS, EVENT_LIBRARY_CHANGED, EVENT_PLAY_STARTED, EVENT_COLLECTION_CHANGED, EVENT_SEARCH_JOB, EVENT_QUEUE_CHANGED}
+
+// attach forwards UI-relevant bus events to the /events subscribers
+func (b *eventBroker) attach(bus *EventBus) {
+	for _, eventType := range sseEventTypes {
+		bus.Subscribe("sse", eventType, func(ev Event) {
+			b.publish(ev.Type, ev.Data)
+		})
+	}
+}
+
+func (b *eventBroker) subscribe(user string, access []string) chan sseEvent {
+	ch := make(chan sseEvent, SSE_CLIENT_BUFFER)
+	b.mu.Lock()
+	b.clients[ch] = sseSubscriber{user: user, access: access}
+	b.mu.Unlock()
+	return ch
+}
+
+// count returns the number of connected /events subscribers
+func (b *eventBroker) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+func (b *eventBroker) unsubscribe(ch chan sseEvent) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+}
+
+// publish sends an event to every subscriber allowed to see it, which for plays means
+// the track's folder too; slow clients miss events rather than block
+func (b *eventBroker) publish(name string, data map[string]interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Event encode error: %v", err)
+		return
+	}
+	ev := sseEvent{Name: name, Data: string(payload)}
+	track, _ := data["track"].(string)
+	lib, _ := data["library"].(string)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, sub := range b.clients {
+		if !tenantVisible(sub.user, data) || !trackVisibleTo(sub.access, lib, track) {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// librarySnapshot describes the last full listing of one kind ("dirs", "files") in a library
+type librarySnapshot struct {
+	library string
+	kind    string
+	sig     uint64
+	count   int
+	scanned time.Time
+}
+
+var (
+	librarySigMu      sync.Mutex
+	librarySignatures = make(map[string]librarySnapshot)
+)
+
+// noteLibrarySnapshot publishes EVENT_LIBRARY_CHANGED when a full listing differs from the previous one
+func noteLibrarySnapshot(lib *library, kind string, items []string) {
+	sorted := append([]string(nil), items...)
+	sort.Strings(sorted)
+	h := fnv.New64a()
+	for _, item := range sorted {
+		h.Write([]byte(item))
+		h.Write([]byte{0})
+	}
+	sig := h.Sum64()
+	librarySigMu.Lock()
+	id := lib.Name + "/" + kind
+	prev, known := librarySignatures[id]
+	librarySignatures[id] = librarySnapshot{library: lib.Name, kind: kind, sig: sig, count: len(items), scanned: time.Now()}
+	librarySigMu.Unlock()
+	if known && prev.sig != sig {
+		eventBus.Publish(EVENT_LIBRARY_CHANGED, map[string]interface{}{"library": lib.Name, "kind": kind, "count": len(items)})
+	}
+}
+
+// handleEvents streams server events to the client (GET /events)
+func handleEvents(c *gin.Context) {
+	access, _ := requestAccess(c)
+	ch := sseClients.subscribe(requestUser(c), access)
+	defer sseClients.unsubscribe(ch)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	keepalive := time.NewTicker(SSE_KEEPALIVE)
+	defer keepalive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case ev := <-ch:
+			c.SSEvent(ev.Name, ev.Data)
+			return true
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			return true
+		}
+	})
+}
+
+// handleNowPlaying broadcasts the track a client started playing, or with finished, played to its end
+func handleNowPlaying(c *gin.Context, data string) {
+	var req struct {
+		Device   string `json:"device"`
+		Track    string `json:"track"`
+		Finished bool   `json:"finished"` // the track played to its end
+	}
+	if err := json.Unmarshal([]byte(data), &req); err != nil || req.Track == "" {
+		echoReqHtml(c, []interface{}{"error", "Invalid now playing data"}, "getNowPlaying")
+		return
+	}
+	eventType := EVENT_PLAY_STARTED
+	if req.Finished {
+		eventType = EVENT_PLAY_FINISHED
+	}
+	eventBus.Publish(eventType, map[string]interface{}{"user": requestUser(c), "device": req.Device, "track": req.Track, "library": libraryFrom(c.Request.Context()).Name, "time": time.Now().Unix()})
+	echoReqHtml(c, []interface{}{"ok", req.Track}, "getNowPlaying")
+}
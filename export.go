@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EXPORT_FILE        = "file"
+	EXPORT_S3          = "s3"
+	EXPORT_CSV         = "csv"
+	EXPORT_JSON        = "json"
+	EXPORT_TIME_FORMAT = "20060102T150405Z"
+)
+
+// Library snapshots: EXPORT=file writes one file per library to EXPORT_DIR, EXPORT=s3
+// one object under META_DIR/exports/<library>/, every EXPORT_INTERVAL (default 24h) in
+// EXPORT_FORMAT (csv or json)
+var (
+	exportMode     = os.Getenv("EXPORT")
+	exportDir      = os.Getenv("EXPORT_DIR")
+	exportFormat   = os.Getenv("EXPORT_FORMAT")
+	exportInterval = 24 * time.Hour
+)
+
+func initExport() error {
+	switch exportMode {
+	case "", "off":
+		exportMode = ""
+	case EXPORT_FILE:
+		if exportDir == "" {
+			exportDir = "exports"
+		}
+		if err := os.MkdirAll(exportDir, 0o700); err != nil {
+			return fmt.Errorf("EXPORT_DIR: %w", err)
+		}
+	case EXPORT_S3:
+	default:
+		return fmt.Errorf("invalid EXPORT: %q, expected file or s3", exportMode)
+	}
+	switch exportFormat {
+	case "":
+		exportFormat = EXPORT_CSV
+	case EXPORT_CSV, EXPORT_JSON:
+	default:
+		return fmt.Errorf("invalid EXPORT_FORMAT: %q, expected csv or json", exportFormat)
+	}
+	if v := os.Getenv("EXPORT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid EXPORT_INTERVAL: %q", v)
+		}
+		exportInterval = d
+	}
+	return nil
+}
+
+// exportRow is one track of a library snapshot
+type exportRow struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	ETag       string    `json:"etag"`
+	Duration   int       `json:"duration,omitempty"` // seconds, when the manifest knows it
+	Bitrate    int       `json:"bitrate,omitempty"`  // kbit/s
+	TrackGain  *float64  `json:"trackGain,omitempty"`
+	AlbumGain  *float64  `json:"albumGain,omitempty"`
+	AudioStart float64   `json:"audioStart,omitempty"`
+	AudioEnd   float64   `json:"audioEnd,omitempty"`
+}
+
+var exportColumns = []string{"key", "size", "modified", "etag", "duration", "bitrate", "trackGain", "albumGain", "audioStart", "audioEnd"}
+
+func (r exportRow) record() []string {
+	optional := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+	return []string{
+		r.Key, strconv.FormatInt(r.Size, 10), r.Modified.UTC().Format(time.RFC3339), r.ETag,
+		strconv.Itoa(r.Duration), strconv.Itoa(r.Bitrate), optional(r.TrackGain), optional(r.AlbumGain),
+		strconv.FormatFloat(r.AudioStart, 'f', -1, 64), strconv.FormatFloat(r.AudioEnd, 'f', -1, 64),
+	}
+}
+
+// writeExport writes every track of the context's library to w as CSV with a header
+// line or as a JSON array, page by page as the listing proceeds
+func writeExport(ctx context.Context, w io.Writer, format string) error {
+	lib := libraryFrom(ctx)
+	ctx, err := s3Meter.guardScan(ctx, "export")
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	first := true
+	if format == EXPORT_CSV {
+		cw.Write(exportColumns)
+	} else {
+		io.WriteString(w, "[")
+	}
+	err = s3WalkAudioObjects(ctx, "", func(page []audioObject) error {
+		keys := make([]string, len(page))
+		for i, obj := range page {
+			keys[i] = obj.Key
+		}
+		durations := manifest.durations(lib, keys)
+		for i, obj := range page {
+			if isMetaDir(obj.Key) {
+				continue
+			}
+			row := exportRow{Key: obj.Key, Size: obj.Size, Modified: obj.Modified, ETag: obj.ETag, Duration: durations[i]}
+			if m, ok := manifest.entry(lib, obj.Key); ok {
+				row.Bitrate = m.Bitrate
+			}
+			if track, album, ok := loudness.gains(lib, obj.Key); ok {
+				row.TrackGain, row.AlbumGain = &track, &album
+			}
+			row.AudioStart, row.AudioEnd = loudness.silence(lib, obj.Key)
+			if format == EXPORT_CSV {
+				cw.Write(row.record())
+				continue
+			}
+			if !first {
+				io.WriteString(w, ",")
+			}
+			first = false
+			if err := json.NewEncoder(w).Encode(row); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+	if err != nil {
+		return err
+	}
+	if format == EXPORT_JSON {
+		_, err = io.WriteString(w, "]\n")
+	}
+	return err
+}
+
+// exportAll writes a snapshot of every library to EXPORT_DIR or the bucket
+func exportAll(ctx context.Context) {
+	stamp := time.Now().UTC().Format(EXPORT_TIME_FORMAT)
+	for _, lib := range libraries {
+		start := time.Now()
+		var buf bytes.Buffer
+		if err := writeExport(withLibrary(ctx, lib), &buf, exportFormat); err != nil {
+			log.Printf("Export of %s failed: %v", lib.Name, err)
+			continue
+		}
+		var err error
+		if exportMode == EXPORT_FILE {
+			err = os.WriteFile(filepath.Join(exportDir, lib.Name+"-"+stamp+"."+exportFormat), buf.Bytes(), 0o600)
+		} else {
+			contentType := "text/csv"
+			if exportFormat == EXPORT_JSON {
+				contentType = "application/json"
+			}
+			_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:      aws.String(s3Bucket),
+				Key:         aws.String(metaKey("exports/" + lib.Name + "/" + stamp + "." + exportFormat)),
+				Body:        bytes.NewReader(buf.Bytes()),
+				ContentType: aws.String(contentType),
+			})
+		}
+		if err != nil {
+			log.Printf("Export of %s failed: %v", lib.Name, err)
+			continue
+		}
+		log.Printf("Exported %s (%d bytes) in %s", lib.Name, buf.Len(), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// runExports writes snapshots every EXPORT_INTERVAL, the first one an interval after startup
+func runExports(ctx context.Context) {
+	if exportMode == "" {
+		return
+	}
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			exportAll(ctx)
+		}
+	}
+}
+
+// handleExport downloads a snapshot of a library (GET /admin/export?library=&format=csv|json)
+func handleExport(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	format := c.DefaultQuery("format", EXPORT_CSV)
+	contentType := "text/csv; charset=utf-8"
+	switch format {
+	case EXPORT_CSV:
+	case EXPORT_JSON:
+		contentType = "application/json; charset=utf-8"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		return
+	}
+	// Checked before the headers go out; writeExport checks again for scheduled exports
+	if _, err := s3Meter.guardScan(c.Request.Context(), "export"); budgetExceeded(c, err) {
+		return
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, lib.Name, time.Now().UTC().Format(EXPORT_TIME_FORMAT), format))
+	c.Status(http.StatusOK)
+	if err := writeExport(withLibrary(c.Request.Context(), lib), c.Writer, format); err != nil {
+		log.Printf("Export of %s failed: %v", lib.Name, err)
+		// Headers are sent; dropping the connection keeps a truncated file from passing as complete
+		panic(http.ErrAbortHandler)
+	}
+}
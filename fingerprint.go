@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FINGERPRINT_OBJECT     = "fingerprints.json"
+	FINGERPRINT_WORKERS    = 2     // concurrent fpcalc runs; each downloads a whole track
+	FINGERPRINT_SAVE_EVERY = 100   // fingerprinted tracks between intermediate saves
+	FINGERPRINT_LENGTH     = "120" // seconds of audio fpcalc fingerprints
+	FINGERPRINT_COMPARE    = 120   // raw fingerprint items (about 15 s) kept to compare tracks
+	FINGERPRINT_MIN_ITEMS  = 40    // shorter fingerprints aren't compared
+	FINGERPRINT_MAX_BER    = 0.15  // share of differing bits below which two tracks are the same recording
+	FINGERPRINT_SLACK      = 2     // seconds the lengths of two copies may differ
+
+	ACOUSTID_URL       = "https://api.acoustid.org/v2/lookup"
+	ACOUSTID_MIN_SCORE = 0.8
+	ACOUSTID_INTERVAL  = 350 * time.Millisecond // AcoustID allows 3 requests per second
+	ACOUSTID_TIMEOUT   = 15 * time.Second
+)
+
+// Fingerprinting: FINGERPRINT_SCAN=true fingerprints new and changed tracks with
+// Chromaprint's fpcalc (FPCALC_PATH) at startup and every FINGERPRINT_SCAN_INTERVAL.
+// With ACOUSTID_API_KEY, tracks without an ID3 title and artist are identified on
+// AcoustID. The fingerprints also let the duplicate report match re-encoded copies.
+var (
+	fingerprintScan         = os.Getenv("FINGERPRINT_SCAN") == "true"
+	fingerprintScanInterval time.Duration
+	fpcalcPath              = os.Getenv("FPCALC_PATH")
+	trackLookup             trackIdentifier // nil when tracks aren't identified
+)
+
+func initFingerprints() error {
+	if v := os.Getenv("FINGERPRINT_SCAN_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid FINGERPRINT_SCAN_INTERVAL: %q", v)
+		}
+		fingerprintScanInterval = d
+	}
+	if key := os.Getenv("ACOUSTID_API_KEY"); key != "" {
+		trackLookup = &acoustID{key: key, client: &http.Client{Timeout: ACOUSTID_TIMEOUT}}
+	}
+	if fpcalcPath == "" {
+		fpcalcPath = "fpcalc"
+	}
+	p, err := exec.LookPath(fpcalcPath)
+	if err != nil {
+		if fingerprintScan {
+			return fmt.Errorf("FINGERPRINT_SCAN needs fpcalc: %w", err)
+		}
+		fpcalcPath = ""
+		return nil
+	}
+	fpcalcPath = p
+	return nil
+}
+
+// fingerprint is what fpcalc computed for one track
+type fingerprint struct {
+	Duration   float64  // seconds
+	Raw        []uint32 // the first FINGERPRINT_COMPARE items
+	Compressed string   // the form AcoustID takes, only computed for lookups
+}
+
+// trackMatch is the recording a fingerprint was identified as
+type trackMatch struct {
+	AcoustID    string  `json:"acoustid"`
+	Score       float64 `json:"score"`
+	RecordingID string  `json:"recordingId,omitempty"` // MusicBrainz recording
+	Title       string  `json:"title,omitempty"`
+	Artist      string  `json:"artist,omitempty"`
+	Album       string  `json:"album,omitempty"`
+	Year        int     `json:"year,omitempty"`
+	ReleaseID   string  `json:"releaseId,omitempty"` // MusicBrainz release
+	Cover       string  `json:"cover,omitempty"`     // Cover Art Archive URL
+	Manual      bool    `json:"manual,omitempty"`    // set by hand, kept across scans
+	Enriched    bool    `json:"enriched,omitempty"`
+}
+
+// trackIdentifier looks up the recording of a fingerprint; it returns nil when it
+// knows none. AcoustID is built in; other services implement the same method.
+type trackIdentifier interface {
+	identify(ctx context.Context, fp fingerprint) (*trackMatch, error)
+}
+
+// acoustID identifies fingerprints with the AcoustID web service
+type acoustID struct {
+	key    string
+	client *http.Client
+	mu     sync.Mutex
+	next   time.Time // earliest time of the next request
+}
+
+func (a *acoustID) identify(ctx context.Context, fp fingerprint) (*trackMatch, error) {
+	a.mu.Lock()
+	wait := time.Until(a.next)
+	a.next = time.Now().Add(max(wait, 0) + ACOUSTID_INTERVAL)
+	a.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(wait):
+	}
+	form := url.Values{
+		"client":      {a.key},
+		"format":      {"json"},
+		"meta":        {"recordings releasegroups compress"},
+		"duration":    {strconv.Itoa(int(fp.Duration))},
+		"fingerprint": {fp.Compressed},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ACOUSTID_URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "go-music/"+version)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Status string `json:"status"`
+		Error  struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Results []struct {
+			ID         string  `json:"id"`
+			Score      float64 `json:"score"`
+			Recordings []struct {
+				ID      string `json:"id"`
+				Title   string `json:"title"`
+				Artists []struct {
+					Name string `json:"name"`
+				} `json:"artists"`
+				ReleaseGroups []struct {
+					Title string `json:"title"`
+				} `json:"releasegroups"`
+			} `json:"recordings"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return nil, fmt.Errorf("acoustid: %s: %w", resp.Status, err)
+	}
+	if res.Status != "ok" {
+		return nil, fmt.Errorf("acoustid: %s", res.Error.Message)
+	}
+	var best *trackMatch
+	for _, r := range res.Results {
+		if r.Score < ACOUSTID_MIN_SCORE || (best != nil && r.Score <= best.Score) {
+			continue
+		}
+		best = &trackMatch{AcoustID: r.ID, Score: r.Score}
+		if len(r.Recordings) > 0 {
+			rec := r.Recordings[0]
+			best.RecordingID, best.Title = rec.ID, rec.Title
+			names := make([]string, len(rec.Artists))
+			for i, a := range rec.Artists {
+				names[i] = a.Name
+			}
+			best.Artist = strings.Join(names, ", ")
+			if len(rec.ReleaseGroups) > 0 {
+				best.Album = rec.ReleaseGroups[0].Title
+			}
+		}
+	}
+	return best, nil
+}
+
+// computeFingerprint downloads an object and runs fpcalc on it, a second time for the
+// compressed fingerprint when compressed is set
+func computeFingerprint(ctx context.Context, key string, compressed bool) (fingerprint, error) {
+	body, _, _, err := s3GetAudioFile(ctx, key)
+	if err != nil {
+		return fingerprint{}, err
+	}
+	defer body.Close()
+	// fpcalc needs a file it can probe; stdin only works for some formats
+	tmp, err := os.CreateTemp("", "go-music-fp-*"+path.Ext(key))
+	if err != nil {
+		return fingerprint{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fingerprint{}, err
+	}
+	var raw struct {
+		Duration    float64  `json:"duration"`
+		Fingerprint []uint32 `json:"fingerprint"`
+	}
+	out, err := exec.CommandContext(ctx, fpcalcPath, "-json", "-raw", "-length", FINGERPRINT_LENGTH, tmp.Name()).Output()
+	if err != nil {
+		return fingerprint{}, fmt.Errorf("fpcalc: %w", err)
+	}
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return fingerprint{}, fmt.Errorf("fpcalc: %w", err)
+	}
+	fp := fingerprint{Duration: raw.Duration, Raw: raw.Fingerprint[:min(len(raw.Fingerprint), FINGERPRINT_COMPARE)]}
+	if compressed {
+		var comp struct {
+			Fingerprint string `json:"fingerprint"`
+		}
+		out, err := exec.CommandContext(ctx, fpcalcPath, "-json", "-length", FINGERPRINT_LENGTH, tmp.Name()).Output()
+		if err != nil {
+			return fingerprint{}, fmt.Errorf("fpcalc: %w", err)
+		}
+		if err := json.Unmarshal(out, &comp); err != nil {
+			return fingerprint{}, fmt.Errorf("fpcalc: %w", err)
+		}
+		fp.Compressed = comp.Fingerprint
+	}
+	return fp, nil
+}
+
+// isTagged reports whether key has an ID3 title and artist; other formats count as untagged
+func isTagged(ctx context.Context, key string) bool {
+	tag, err := readID3Tag(ctx, key)
+	if err != nil || tag == nil {
+		return false
+	}
+	frames := id3Frames(tag, "TIT2", "TPE1")
+	for _, id := range []string{"TIT2", "TPE1"} {
+		f := frames[id]
+		if len(f) < 2 || strings.TrimSpace(strings.Trim(id3Text(f[0], f[1:]), "\x00")) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// fingerprintEntry is the fingerprint of one object version and what it was identified as
+type fingerprintEntry struct {
+	ETag     string      `json:"etag"`
+	Duration int         `json:"duration,omitempty"` // seconds
+	Prefix   string      `json:"prefix,omitempty"`   // base64 of the raw items, little-endian
+	Tagged   bool        `json:"tagged,omitempty"`
+	LookedUp bool        `json:"lookedUp,omitempty"`
+	Match    *trackMatch `json:"match,omitempty"`
+	Failed   bool        `json:"failed,omitempty"`
+}
+
+// raw decodes the kept part of the raw fingerprint
+func (e fingerprintEntry) raw() []uint32 {
+	b, err := base64.StdEncoding.DecodeString(e.Prefix)
+	if err != nil {
+		return nil
+	}
+	out := make([]uint32, len(b)/4)
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return out
+}
+
+func encodeRaw(items []uint32) string {
+	b := make([]byte, 4*len(items))
+	for i, v := range items {
+		binary.LittleEndian.PutUint32(b[i*4:], v)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// bitErrorRate is the share of differing bits of the common length of a and b
+func bitErrorRate(a, b []uint32) float64 {
+	n := min(len(a), len(b))
+	diff := 0
+	for i := 0; i < n; i++ {
+		diff += bits.OnesCount32(a[i] ^ b[i])
+	}
+	return float64(diff) / float64(32*n)
+}
+
+// fingerprintIndex holds fingerprints per library and key, persisted as one metadata object
+type fingerprintIndex struct {
+	mu        sync.RWMutex
+	libraries map[string]map[string]fingerprintEntry
+	saveMu    sync.Mutex
+	scanning  atomic.Bool
+}
+
+var fingerprints = &fingerprintIndex{libraries: make(map[string]map[string]fingerprintEntry)}
+
+// load reads the index from the bucket; a missing object means nothing was fingerprinted yet
+func (fi *fingerprintIndex) load(ctx context.Context) error {
+	libs := make(map[string]map[string]fingerprintEntry)
+	if err := s3GetJSON(ctx, FINGERPRINT_OBJECT, &libs); err != nil {
+		if isNoSuchKey(err) {
+			return nil
+		}
+		return err
+	}
+	fi.mu.Lock()
+	fi.libraries = libs
+	fi.mu.Unlock()
+	return nil
+}
+
+func (fi *fingerprintIndex) save(ctx context.Context) error {
+	fi.saveMu.Lock()
+	defer fi.saveMu.Unlock()
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	return s3PutJSON(ctx, FINGERPRINT_OBJECT, fi.libraries)
+}
+
+// rename moves the fingerprint of a renamed object along with it
+func (fi *fingerprintIndex) rename(lib *library, from, to string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if e, ok := fi.libraries[lib.Name][from]; ok {
+		fi.libraries[lib.Name][to] = e
+		delete(fi.libraries[lib.Name], from)
+	}
+}
+
+// needsLookup reports whether an unchanged entry is still to be identified
+func (e fingerprintEntry) needsLookup() bool {
+	return trackLookup != nil && !e.Failed && !e.Tagged && !e.LookedUp
+}
+
+// scan fingerprints every new or changed object of lib, identifies untagged ones and
+// drops entries of deleted ones
+func (fi *fingerprintIndex) scan(ctx context.Context, lib *library) (done, identified, failed int, err error) {
+	ctx, err = s3Meter.guardScan(withLibrary(ctx, lib), "fingerprints")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	objects, err := s3ListAudioObjects(ctx, "")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	fi.mu.Lock()
+	old := fi.libraries[lib.Name]
+	fresh := make(map[string]fingerprintEntry, len(objects))
+	var todo []audioObject
+	manual := make(map[string]*trackMatch) // corrections outlive changes of the file
+	for _, obj := range objects {
+		e, ok := old[obj.Key]
+		if ok && e.Match != nil && e.Match.Manual {
+			manual[obj.Key] = e.Match
+		}
+		// A correction made before the first scan has no fingerprint yet
+		if ok && e.ETag == obj.ETag && !e.needsLookup() && (e.Prefix != "" || e.Failed) {
+			fresh[obj.Key] = e
+		} else if streamPolicy(obj.Key) != STREAM_BLOCK {
+			todo = append(todo, obj)
+		}
+	}
+	fi.libraries[lib.Name] = fresh
+	fi.mu.Unlock()
+
+	var (
+		wg              sync.WaitGroup
+		doneCount       atomic.Int64
+		identifiedCount atomic.Int64
+		failCount       atomic.Int64
+	)
+	sem := make(chan struct{}, FINGERPRINT_WORKERS)
+	for _, obj := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(obj audioObject) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			entry := fingerprintEntry{ETag: obj.ETag, Tagged: isTagged(ctx, obj.Key)}
+			if m := manual[obj.Key]; m != nil {
+				entry.LookedUp, entry.Match = true, m
+			}
+			lookup := trackLookup != nil && !entry.Tagged && !entry.LookedUp
+			fp, err := computeFingerprint(ctx, obj.Key, lookup)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Fingerprint of %s failed: %v", obj.Key, err)
+				failCount.Add(1)
+				// Remember the failure so unchanged files aren't fingerprinted again
+				entry.Failed = true
+			} else {
+				entry.Duration, entry.Prefix = int(fp.Duration), encodeRaw(fp.Raw)
+				if lookup {
+					match, err := trackLookup.identify(ctx, fp)
+					if err != nil {
+						log.Printf("Identifying %s failed: %v", obj.Key, err)
+					} else {
+						entry.LookedUp, entry.Match = true, match
+						if match != nil {
+							identifiedCount.Add(1)
+						}
+					}
+				}
+			}
+			fi.mu.Lock()
+			fi.libraries[lib.Name][obj.Key] = entry
+			fi.mu.Unlock()
+			if n := doneCount.Add(1); n%FINGERPRINT_SAVE_EVERY == 0 {
+				log.Printf("Fingerprint scan of %s: %d/%d tracks fingerprinted", lib.Name, n, len(todo))
+				if err := fi.save(ctx); err != nil {
+					log.Printf("Fingerprint save error: %v", err)
+				}
+			}
+		}(obj)
+	}
+	wg.Wait()
+	if metadataEnricher != nil && ctx.Err() == nil {
+		if n := fi.enrich(ctx, lib); n > 0 {
+			log.Printf("Fingerprint scan of %s: %d tracks enriched from MusicBrainz", lib.Name, n)
+		}
+	}
+	if err := fi.save(context.WithoutCancel(ctx)); err != nil {
+		return int(doneCount.Load()), int(identifiedCount.Load()), int(failCount.Load()), err
+	}
+	return int(doneCount.Load()), int(identifiedCount.Load()), int(failCount.Load()), ctx.Err()
+}
+
+// scanAll scans every library unless a scan is already running
+func (fi *fingerprintIndex) scanAll(ctx context.Context) {
+	if !fi.scanning.CompareAndSwap(false, true) {
+		return
+	}
+	defer fi.scanning.Store(false)
+	for _, lib := range libraries {
+		start := time.Now()
+		done, identified, failed, err := fi.scan(ctx, lib)
+		if err != nil {
+			log.Printf("Fingerprint scan of %s failed: %v", lib.Name, err)
+			continue
+		}
+		log.Printf("Fingerprint scan of %s finished: %d tracks fingerprinted, %d identified (%d failed) in %s", lib.Name, done, identified, failed, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// run loads the index, scans once and then every FINGERPRINT_SCAN_INTERVAL
+func (fi *fingerprintIndex) run(ctx context.Context) {
+	if err := fi.load(ctx); err != nil {
+		log.Printf("Failed to load fingerprints: %v", err)
+	}
+	if !fingerprintScan {
+		return
+	}
+	fi.scanAll(ctx)
+	if fingerprintScanInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(fingerprintScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi.scanAll(ctx)
+		}
+	}
+}
+
+// duplicates groups the indexes of objects that are the same recording: identified as
+// the same AcoustID track, or with nearly the same fingerprint and length. Groups are
+// keyed by their first member.
+func (fi *fingerprintIndex) duplicates(lib *library, objects []audioObject) map[string][]int {
+	parent := make([]int, len(objects))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) {
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[max(ra, rb)] = min(ra, rb)
+		}
+	}
+	fi.mu.RLock()
+	entries := fi.libraries[lib.Name]
+	byTrack := make(map[string]int)
+	byLength := make(map[int][]int)
+	raws := make([][]uint32, len(objects))
+	for i, obj := range objects {
+		e, ok := entries[obj.Key]
+		if !ok || e.Failed || e.ETag != obj.ETag {
+			continue
+		}
+		if e.Match != nil && e.Match.AcoustID != "" {
+			if j, seen := byTrack[e.Match.AcoustID]; seen {
+				union(i, j)
+			} else {
+				byTrack[e.Match.AcoustID] = i
+			}
+		}
+		raws[i] = e.raw()
+		if len(raws[i]) < FINGERPRINT_MIN_ITEMS || e.Duration == 0 {
+			continue
+		}
+		for d := e.Duration - FINGERPRINT_SLACK; d <= e.Duration+FINGERPRINT_SLACK; d++ {
+			for _, j := range byLength[d] {
+				if find(i) != find(j) && bitErrorRate(raws[i], raws[j]) < FINGERPRINT_MAX_BER {
+					union(i, j)
+				}
+			}
+		}
+		byLength[e.Duration] = append(byLength[e.Duration], i)
+	}
+	fi.mu.RUnlock()
+	groups := make(map[string][]int)
+	for i := range objects {
+		r := strconv.Itoa(find(i))
+		groups[r] = append(groups[r], i)
+	}
+	return groups
+}
+
+// --- FINGERPRINT HANDLERS ---
+
+// handleFingerprintScan starts a background fingerprint scan (POST /admin/fingerprints/scan)
+func handleFingerprintScan(c *gin.Context) {
+	if fpcalcPath == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "fingerprinting needs fpcalc"})
+		return
+	}
+	if fingerprints.scanning.Load() {
+		c.JSON(http.StatusConflict, gin.H{"error": "scan already running"})
+		return
+	}
+	go fingerprints.scanAll(context.Background())
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
+
+// handleListIdentified lists the untagged tracks of a library and what they were
+// identified as (GET /admin/fingerprints?library=)
+func handleListIdentified(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	type identifiedTrack struct {
+		Key   string      `json:"key"`
+		Match *trackMatch `json:"match"`
+	}
+	identified, unknown := []identifiedTrack{}, []string{}
+	fingerprinted := 0
+	fingerprints.mu.RLock()
+	for key, e := range fingerprints.libraries[lib.Name] {
+		if !e.Failed {
+			fingerprinted++
+		}
+		switch {
+		case e.Match != nil:
+			identified = append(identified, identifiedTrack{Key: key, Match: e.Match})
+		case e.LookedUp:
+			unknown = append(unknown, key)
+		}
+	}
+	fingerprints.mu.RUnlock()
+	sort.Slice(identified, func(i, j int) bool { return identified[i].Key < identified[j].Key })
+	sort.Strings(unknown)
+	c.JSON(http.StatusOK, gin.H{
+		"library":       lib.Name,
+		"fingerprinted": fingerprinted,
+		"scanning":      fingerprints.scanning.Load(),
+		"identified":    identified,
+		"unidentified":  unknown,
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ACL_EVERYONE     = "*" // rule for users without one, and requests without an API key
+	ACL_GROUP_PREFIX = "@"
+)
+
+// FOLDER_ACL limits users to folders, e.g. "alice=Kids/|Audiobooks/,@family=Shared/,*=Public/".
+// A rule names the user of an API key, a group of FOLDER_GROUPS ("family=alice|bob") or *
+// for everyone else. Users and groups without a rule see everything unless there is a *
+// rule; in guest mode, requests without a key get PUBLIC_PREFIXES instead of the * rule.
+// Admin keys and ADMIN_TOKEN are never limited, and neither are the user homes.
+// Prefixes are relative to each library.
+var (
+	folderACL    map[string][]string // user, @group or * to allowed prefixes
+	folderGroups = map[string][]string{}
+)
+
+func initFolderACL() error {
+	for _, item := range splitList(os.Getenv("FOLDER_GROUPS")) {
+		group, members, ok := strings.Cut(item, "=")
+		if group = strings.TrimSpace(group); !ok || group == "" {
+			return fmt.Errorf("invalid FOLDER_GROUPS entry %q, expected group=user|user", item)
+		}
+		for _, user := range strings.Split(members, "|") {
+			if user = strings.TrimSpace(user); user != "" {
+				folderGroups[user] = append(folderGroups[user], group)
+			}
+		}
+	}
+	for _, item := range splitList(os.Getenv("FOLDER_ACL")) {
+		subject, prefixes, ok := strings.Cut(item, "=")
+		if subject = strings.TrimSpace(subject); !ok || subject == "" || subject == ACL_GROUP_PREFIX {
+			return fmt.Errorf("invalid FOLDER_ACL entry %q, expected user=prefix|prefix", item)
+		}
+		if folderACL == nil {
+			folderACL = make(map[string][]string)
+		}
+		if _, dup := folderACL[subject]; dup {
+			return fmt.Errorf("duplicate FOLDER_ACL subject %q", subject)
+		}
+		allowed := []string{} // a rule without prefixes hides everything
+		for _, p := range strings.Split(prefixes, "|") {
+			if p = strings.Trim(strings.TrimSpace(p), "/"); p != "" {
+				allowed = append(allowed, p+"/")
+			}
+		}
+		folderACL[subject] = allowed
+	}
+	return nil
+}
+
+type accessCtxKey struct{}
+
+// withAccess limits the listings and walks of ctx to the folders below prefixes
+func withAccess(ctx context.Context, prefixes []string) context.Context {
+	return context.WithValue(ctx, accessCtxKey{}, prefixes)
+}
+
+// accessFrom returns the folders ctx is limited to, nil when it isn't
+func accessFrom(ctx context.Context) []string {
+	prefixes, _ := ctx.Value(accessCtxKey{}).([]string)
+	return prefixes
+}
+
+// requestAccess returns the folders a request is limited to; ok is false when it isn't.
+// Only API keys name users here, ?user= and the user cookie are not trusted.
+func requestAccess(c *gin.Context) (prefixes []string, ok bool) {
+	if folderACL == nil && publicPrefixes == nil {
+		return nil, false
+	}
+	if isAdminToken(bearerToken(c)) {
+		return nil, false
+	}
+	user, known := homeUser(c)
+	if known {
+		k, _ := c.Get(API_KEY_CONTEXT)
+		if k.(*apiKey).Scope == SCOPE_ADMIN {
+			return nil, false
+		}
+		prefixes = []string{} // a rule without prefixes hides everything
+		subjects := []string{user}
+		for _, g := range folderGroups[user] {
+			subjects = append(subjects, ACL_GROUP_PREFIX+g)
+		}
+		for _, g := range k.(*apiKey).Groups {
+			subjects = append(subjects, ACL_GROUP_PREFIX+g)
+		}
+		for _, s := range subjects {
+			if allowed, ruled := folderACL[s]; ruled {
+				prefixes, ok = append(prefixes, allowed...), true
+			}
+		}
+		if ok {
+			sort.Strings(prefixes)
+			return prefixes, true
+		}
+	} else if publicPrefixes != nil {
+		return publicPrefixes, true // guests
+	}
+	if allowed, ruled := folderACL[ACL_EVERYONE]; ruled {
+		return allowed, true
+	}
+	return nil, false
+}
+
+// anonymousAccess returns the folders clients without an API key are limited to, like
+// requestAccess does: PUBLIC_PREFIXES in guest mode, else the FOLDER_ACL rule for everyone
+func anonymousAccess() ([]string, bool) {
+	if publicPrefixes != nil {
+		return publicPrefixes, true
+	}
+	allowed, ok := folderACL[ACL_EVERYONE]
+	return allowed, ok
+}
+
+// folderVisible reports whether ctx may list or play a library-relative path. Folders above
+// an allowed prefix stay visible so users can navigate down to it.
+func folderVisible(ctx context.Context, name string, isDir bool) bool {
+	prefixes := accessFrom(ctx)
+	if prefixes == nil || strings.HasPrefix(libraryFrom(ctx).Name, HOME_NAME_PREFIX) {
+		return true
+	}
+	if isDir {
+		if name = strings.Trim(name, "/"); name == "" {
+			return true // the root
+		}
+		name += "/"
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) || (isDir && strings.HasPrefix(p, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackVisibleTo reports whether a subscriber limited to prefixes, nil when it isn't, may
+// see a track of the named library in an event
+func trackVisibleTo(prefixes []string, libName, track string) bool {
+	if prefixes == nil || track == "" {
+		return true
+	}
+	ctx := withAccess(withLibrary(context.Background(), &library{Name: libName}), prefixes)
+	return folderVisible(ctx, track, false)
+}
+
+// filterVisible returns the names of dir that ctx may see, in a new slice so cached
+// listings stay whole
+func filterVisible(ctx context.Context, dir string, names []string, isDir bool) []string {
+	if accessFrom(ctx) == nil {
+		return names
+	}
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if folderVisible(ctx, dir+name, isDir) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestFolderVisible checks the FOLDER_ACL prefix rules for files, the folders above an
+// allowed prefix, the user homes and a rule without prefixes
+func TestFolderVisible(t *testing.T) {
+	music := &library{Name: "Music"}
+	home := &library{Name: HOME_NAME_PREFIX + "alice"}
+	tests := []struct {
+		name     string
+		lib      *library
+		prefixes []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"unrestricted", music, nil, "Secret/a.mp3", false, true},
+		{"allowed file", music, []string{"Kids/"}, "Kids/a.mp3", false, true},
+		{"nested allowed file", music, []string{"Kids/"}, "Kids/Sub/b.mp3", false, true},
+		{"hidden file", music, []string{"Kids/"}, "Secret/a.mp3", false, false},
+		{"same name start", music, []string{"Kids/"}, "Kids Party/a.mp3", false, false},
+		{"root", music, []string{"Kids/"}, "", true, true},
+		{"folder above prefix", music, []string{"Family/Kids/"}, "Family", true, true},
+		{"file above prefix", music, []string{"Family/Kids/"}, "Family/a.mp3", false, false},
+		{"sibling folder", music, []string{"Family/Kids/"}, "Family/Parents/", true, false},
+		{"allowed folder", music, []string{"Kids/"}, "Kids/Sub", true, true},
+		{"empty rule", music, []string{}, "Kids/a.mp3", false, false},
+		{"empty rule root", music, []string{}, "", true, true},
+		{"home", home, []string{}, "Secret/a.mp3", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := withLibrary(context.Background(), tt.lib)
+			if tt.prefixes != nil {
+				ctx = withAccess(ctx, tt.prefixes)
+			}
+			if got := folderVisible(ctx, tt.path, tt.isDir); got != tt.want {
+				t.Errorf("folderVisible(%q, %t) = %t, want %t", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+// searchAsyncTitles starts a searchAsync title search as the holder of token ("" for a
+// guest) and returns what the job found
+func searchAsyncTitles(t *testing.T, r *gin.Engine, token, query string) []string {
+	t.Helper()
+	form := url.Values{"dffunc": {"searchAsync"}, "dfdata": {`{"kind":"title","query":"` + query + `"}`}}
+	req := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := w.Body.String()
+	start := strings.Index(body, dataBlockStart)
+	end := strings.Index(body, "</script>")
+	var data []interface{}
+	if start < 0 || end < start || json.Unmarshal([]byte(body[start+len(dataBlockStart):end]), &data) != nil || len(data) < 2 || data[0] != "ok" {
+		t.Fatalf("searchAsync: status %d, body %q", w.Code, body)
+	}
+	id, _ := data[1].(string)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if job, ok := searchJobs.get(id); ok && job.status != SEARCH_JOB_RUNNING {
+			if job.status != SEARCH_JOB_DONE {
+				t.Fatalf("search job %s: %s", job.status, job.err)
+			}
+			return job.results
+		}
+	}
+	t.Fatalf("search job %s did not finish", id)
+	return nil
+}
+
+// TestSearchAsyncFolderACL checks that a background search only finds the tracks of the
+// folders FOLDER_ACL gives the user, like the synchronous one
+func TestSearchAsyncFolderACL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(acl map[string][]string, libs []*library) { folderACL, libraries = acl, libs }(folderACL, libraries)
+	folderACL = map[string][]string{"bob": {"Kids/"}}
+	libraries = []*library{{Name: "Music", Bucket: "acl-search"}}
+	useFakeS3(t, &fakeS3{objects: map[string]string{"acl-search/Kids/song.mp3": "a", "acl-search/Secret/song.mp3": "b"}})
+	bob := addTestAPIKey(t, "bob-search", "bob", "")
+	r := gin.New()
+	registerRoutes(r)
+
+	got := searchAsyncTitles(t, r, bob, "song")
+	if strings.Join(got, ",") != "Kids/song.mp3" {
+		t.Errorf("searchAsync as bob found %v, want [Kids/song.mp3]", got)
+	}
+}
+
+// TestEventsFolderACL checks that play events only reach the /events subscribers that
+// may see the track's folder
+func TestEventsFolderACL(t *testing.T) {
+	kids := sseClients.subscribe("bob", []string{"Kids/"})
+	defer sseClients.unsubscribe(kids)
+	all := sseClients.subscribe("alice", nil)
+	defer sseClients.unsubscribe(all)
+
+	sseClients.publish(EVENT_PLAY_STARTED, map[string]interface{}{"user": "alice", "track": "Secret/a.mp3", "library": "Music"})
+	sseClients.publish(EVENT_PLAY_STARTED, map[string]interface{}{"user": "alice", "track": "Kids/b.mp3", "library": "Music"})
+	for name, ch := range map[string]chan sseEvent{"limited": kids, "unrestricted": all} {
+		var got []string
+		for len(ch) > 0 {
+			ev := <-ch
+			got = append(got, ev.Data)
+		}
+		want := 2
+		if name == "limited" {
+			want = 1
+		}
+		if len(got) != want || strings.Contains(strings.Join(got, ""), "Secret") != (name == "unrestricted") {
+			t.Errorf("%s subscriber got %v", name, got)
+		}
+	}
+}
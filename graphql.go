@@ -0,0 +1,1308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /graphql serves the library graph to clients that want to pick their fields: libraries,
+// their directories and tracks with durations, ratings and tags, title search and the
+// user's playlists. Only queries are supported. The schema is small and fixed, so it is
+// resolved by hand from graphSchema rather than through a GraphQL library.
+const (
+	GRAPHQL_MAX_QUERY   = 16 << 10 // bytes of query text
+	GRAPHQL_MAX_DEPTH   = 12       // nested selection sets
+	GRAPHQL_MAX_LOOKUPS = 50       // directory listings, track lookups and searches of one query
+	GRAPHQL_MAX_FIELDS  = 50000    // fields resolved for one response
+)
+
+// gqlRequest is a GraphQL request, as a JSON body or the query parameters of a GET
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlError is an entry of the errors list of a response; path locates a field error
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// handleGraphQL executes a query (GET or POST /graphql)
+func handleGraphQL(c *gin.Context) {
+	var req gqlRequest
+	if c.Request.Method == http.MethodGet {
+		req.Query, req.OperationName = c.Query("query"), c.Query("operationName")
+		if v := c.Query("variables"); v != "" && json.Unmarshal([]byte(v), &req.Variables) != nil {
+			graphError(c, http.StatusBadRequest, "variables must be a JSON object")
+			return
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		graphError(c, http.StatusBadRequest, "request body must be a JSON object with a query")
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		graphError(c, http.StatusBadRequest, "query required")
+		return
+	}
+	if len(req.Query) > GRAPHQL_MAX_QUERY {
+		graphError(c, http.StatusBadRequest, fmt.Sprintf("query is longer than %d bytes", GRAPHQL_MAX_QUERY))
+		return
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		graphError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, err := s3Meter.guardScan(c.Request.Context(), "graphql")
+	if budgetExceeded(c, err) {
+		return
+	}
+	x := &gqlExec{c: c, ctx: ctx, fragments: doc.fragments, user: requestUser(c),
+		libraries: make(map[string]*gqlLibrary), listings: make(map[string]*gqlListing)}
+	op, err := doc.operation(req.OperationName)
+	if err == nil {
+		err = x.variables(op, req.Variables)
+	}
+	if err == nil {
+		err = x.validate("Query", op.selections, 1, map[string]bool{})
+	}
+	if err != nil {
+		graphError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	data, err := x.object("Query", nil, op.selections, nil)
+	if err != nil {
+		graphError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	out := gin.H{"data": data}
+	if len(x.errors) > 0 {
+		out["errors"] = x.errors
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// graphError answers a request that could not be executed at all
+func graphError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"errors": []gqlError{{Message: message}}})
+}
+
+// Query documents are lexed into names, numbers, strings and punctuators; commas are
+// insignificant like white space
+type gqlToken struct {
+	kind  byte // 'n'ame, 'i'nt, 'f'loat, 's'tring, 'p'unctuator, 0 at the end
+	value string
+	pos   int
+}
+
+var gqlNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?`)
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var toks []gqlToken
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',':
+			i++
+		case strings.HasPrefix(src[i:], "\ufeff"):
+			i += len("\ufeff")
+		case ch == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, gqlToken{'p', "...", i})
+			i += 3
+		case strings.IndexByte("!$&()[]{}:=@|", ch) >= 0:
+			toks = append(toks, gqlToken{'p', string(ch), i})
+			i++
+		case ch == '_' || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, gqlToken{'n', src[i:j], i})
+			i = j
+		case ch == '-' || ch >= '0' && ch <= '9':
+			m := gqlNumber.FindStringSubmatch(src[i:])
+			if m == nil {
+				return nil, fmt.Errorf("invalid number at offset %d", i)
+			}
+			kind := byte('i')
+			if m[2] != "" || m[3] != "" {
+				kind = 'f'
+			}
+			toks = append(toks, gqlToken{kind, m[0], i})
+			i += len(m[0])
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(strings.ReplaceAll(src[i+3:], `\"""`, "\x00\x00\x00\x00"), `"""`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, gqlToken{'s', strings.ReplaceAll(src[i+3:i+3+end], `\"""`, `"""`), i})
+			i += 3 + end + 3
+		case ch == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			var s string
+			// String escapes are those of JSON
+			if j >= len(src) || src[j] != '"' || json.Unmarshal([]byte(src[i:j+1]), &s) != nil {
+				return nil, fmt.Errorf("invalid string at offset %d", i)
+			}
+			toks = append(toks, gqlToken{'s', s, i})
+			i = j + 1
+		default:
+			return nil, fmt.Errorf("unexpected character %q at offset %d", ch, i)
+		}
+	}
+	return append(toks, gqlToken{pos: len(src)}), nil
+}
+
+// gqlDocument is a parsed query document
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind, name string
+	vars       []gqlVarDef
+	selections []*gqlSelection
+}
+
+type gqlVarDef struct {
+	name, typ string
+	def       interface{}
+	hasDef    bool
+}
+
+type gqlFragment struct {
+	name, on   string
+	selections []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (fragment set) or an inline fragment (inline set)
+type gqlSelection struct {
+	alias, name string
+	args        map[string]interface{}
+	directives  []gqlDirective
+	selections  []*gqlSelection
+	fragment    string
+	inline      bool
+	on          string
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// gqlVariable is a $variable in a value, replaced by its value when arguments are read
+type gqlVariable string
+
+// operation picks the operation to execute: the named one, or the only one
+func (d *gqlDocument) operation(name string) (*gqlOperation, error) {
+	var op *gqlOperation
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, errors.New("operationName required for a document with several operations")
+		}
+		op = d.operations[0]
+	}
+	for _, o := range d.operations {
+		if name != "" && o.name == name {
+			op = o
+		}
+	}
+	if op == nil {
+		return nil, fmt.Errorf("unknown operation %q", name)
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("%s operations are not supported, only queries", op.kind)
+	}
+	return op, nil
+}
+
+type gqlParser struct {
+	toks []gqlToken
+	i    int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	toks, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.peek().kind != 0 {
+		if p.peek().kind == 'n' && p.peek().value == "fragment" {
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if doc.fragments[f.name] != nil {
+				return nil, fmt.Errorf("fragment %q is defined twice", f.name)
+			}
+			doc.fragments[f.name] = f
+			continue
+		}
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		doc.operations = append(doc.operations, op)
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.toks[p.i]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.toks[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+// is reports whether the next token is the punctuator v
+func (p *gqlParser) is(v string) bool {
+	t := p.peek()
+	return t.kind == 'p' && t.value == v
+}
+
+func (p *gqlParser) expect(v string) error {
+	if !p.is(v) {
+		return p.unexpected("expected " + v)
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != 'n' {
+		return "", p.unexpected("expected a name")
+	}
+	return p.next().value, nil
+}
+
+func (p *gqlParser) unexpected(want string) error {
+	t := p.peek()
+	if t.kind == 0 {
+		return fmt.Errorf("syntax error: %s, found the end of the query", want)
+	}
+	return fmt.Errorf("syntax error at offset %d: %s, found %q", t.pos, want, t.value)
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query"}
+	if !p.is("{") {
+		kind, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if kind != "query" && kind != "mutation" && kind != "subscription" {
+			return nil, fmt.Errorf("syntax error: unknown definition %q", kind)
+		}
+		op.kind = kind
+		if p.peek().kind == 'n' {
+			op.name = p.next().value
+		}
+		if p.is("(") {
+			p.next()
+			for !p.is(")") {
+				v, err := p.varDef()
+				if err != nil {
+					return nil, err
+				}
+				op.vars = append(op.vars, v)
+			}
+			p.next()
+		}
+		if _, err := p.directives(true); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	op.selections, err = p.selectionSet(1)
+	return op, err
+}
+
+func (p *gqlParser) varDef() (gqlVarDef, error) {
+	var v gqlVarDef
+	if err := p.expect("$"); err != nil {
+		return v, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return v, err
+	}
+	v.name = name
+	if err := p.expect(":"); err != nil {
+		return v, err
+	}
+	if v.typ, err = p.typeRef(); err != nil {
+		return v, err
+	}
+	if p.is("=") {
+		p.next()
+		if v.def, err = p.value(true); err != nil {
+			return v, err
+		}
+		v.hasDef = true
+	}
+	_, err = p.directives(true)
+	return v, err
+}
+
+// typeRef reads a type such as String!, returning it as written
+func (p *gqlParser) typeRef() (string, error) {
+	var typ string
+	if p.is("[") {
+		p.next()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+	if p.is("!") {
+		p.next()
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	p.next() // fragment
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, p.unexpected("expected a fragment name")
+	}
+	if on, err := p.name(); err != nil || on != "on" {
+		return nil, fmt.Errorf("syntax error: fragment %q needs a type condition", name)
+	}
+	f := &gqlFragment{name: name}
+	if f.on, err = p.name(); err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(true); err != nil {
+		return nil, err
+	}
+	f.selections, err = p.selectionSet(1)
+	return f, err
+}
+
+func (p *gqlParser) selectionSet(depth int) ([]*gqlSelection, error) {
+	if depth > GRAPHQL_MAX_DEPTH {
+		return nil, fmt.Errorf("query is nested deeper than %d levels", GRAPHQL_MAX_DEPTH)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.is("}") {
+		s, err := p.selection(depth)
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, s)
+	}
+	p.next()
+	if len(sels) == 0 {
+		return nil, errors.New("syntax error: empty selection set")
+	}
+	return sels, nil
+}
+
+func (p *gqlParser) selection(depth int) (*gqlSelection, error) {
+	s := &gqlSelection{}
+	var err error
+	if p.is("...") {
+		p.next()
+		if t := p.peek(); t.kind == 'n' && t.value != "on" {
+			s.fragment = p.next().value
+			s.directives, err = p.directives(false)
+			return s, err
+		}
+		s.inline = true
+		if p.peek().kind == 'n' {
+			p.next() // on
+			if s.on, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(false); err != nil {
+			return nil, err
+		}
+		s.selections, err = p.selectionSet(depth)
+		return s, err
+	}
+	if s.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.is(":") {
+		p.next()
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is("(") {
+		if s.args, err = p.arguments(false); err != nil {
+			return nil, err
+		}
+	}
+	if s.directives, err = p.directives(false); err != nil {
+		return nil, err
+	}
+	if p.is("{") {
+		s.selections, err = p.selectionSet(depth + 1)
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments(constant bool) (map[string]interface{}, error) {
+	p.next() // (
+	args := make(map[string]interface{})
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if _, dup := args[name]; dup {
+			return nil, fmt.Errorf("argument %q is given twice", name)
+		}
+		if args[name], err = p.value(constant); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *gqlParser) directives(constant bool) ([]gqlDirective, error) {
+	var dirs []gqlDirective
+	for p.is("@") {
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		d := gqlDirective{name: name}
+		if p.is("(") {
+			if d.args, err = p.arguments(constant); err != nil {
+				return nil, err
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// value reads an argument value; enum values are read as strings
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.peek()
+	switch {
+	case t.kind == 'p' && t.value == "$" && !constant:
+		p.next()
+		name, err := p.name()
+		return gqlVariable(name), err
+	case t.kind == 'i':
+		p.next()
+		n, err := strconv.ParseInt(t.value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("integer %s out of range", t.value)
+		}
+		return int(n), nil
+	case t.kind == 'f':
+		p.next()
+		return strconv.ParseFloat(t.value, 64)
+	case t.kind == 's':
+		p.next()
+		return t.value, nil
+	case t.kind == 'n':
+		p.next()
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.value, nil
+	case t.kind == 'p' && t.value == "[":
+		p.next()
+		list := []interface{}{}
+		for !p.is("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+	case t.kind == 'p' && t.value == "{":
+		p.next()
+		obj := make(map[string]interface{})
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return obj, nil
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+// gqlField is a field of graphSchema. typ names the object type of the value, which is a
+// single parent or a []interface{} of them; scalar fields leave it empty.
+type gqlField struct {
+	typ     string
+	args    map[string]string // argument types, e.g. "String!"
+	resolve func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+// Parents handed to the resolvers of Library, Directory, Track and Playlist fields
+type gqlLibrary struct {
+	lib *library
+	ctx context.Context // scoped to the library and to the folders the request may see
+}
+
+type gqlDirectory struct {
+	lib  *gqlLibrary
+	path string // "" or ending in '/'
+}
+
+type gqlTrack struct {
+	lib *gqlLibrary
+	key string
+}
+
+var pageArgs = map[string]string{"first": "Int", "offset": "Int"}
+
+var graphSchema = map[string]map[string]gqlField{
+	"Query": {
+		"libraries": {typ: "Library", resolve: func(x *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			out := []interface{}{}
+			for _, name := range x.libraryNames() {
+				if l, err := x.library(name); err == nil {
+					out = append(out, l)
+				}
+			}
+			return out, nil
+		}},
+		"library": {typ: "Library", args: map[string]string{"name": "String"}, resolve: func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			name, _ := args["name"].(string)
+			return x.library(name)
+		}},
+		"playlists": {typ: "Playlist", resolve: func(x *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			if err := x.requireUser(); err != nil {
+				return nil, err
+			}
+			out := []interface{}{}
+			for _, p := range playlists.list(x.user) {
+				out = append(out, p)
+			}
+			return out, nil
+		}},
+		"playlist": {typ: "Playlist", args: map[string]string{"name": "String!"}, resolve: func(x *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			if err := x.requireUser(); err != nil {
+				return nil, err
+			}
+			if p, ok := playlists.get(x.user, args["name"].(string)); ok {
+				return p, nil
+			}
+			return nil, nil
+		}},
+	},
+	"Library": {
+		"name": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return parent.(*gqlLibrary).lib.Name, nil
+		}},
+		"directory": {typ: "Directory", args: map[string]string{"path": "String"}, resolve: func(_ *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			l := parent.(*gqlLibrary)
+			dir, _ := args["path"].(string)
+			if dir = strings.Trim(dir, "/"); dir == "" {
+				return &gqlDirectory{lib: l}, nil
+			}
+			if isMetaDir(dir) || !isListed(dir, true) || !folderVisible(l.ctx, dir, true) {
+				return nil, nil
+			}
+			return &gqlDirectory{lib: l, path: dir + "/"}, nil
+		}},
+		"track": {typ: "Track", args: map[string]string{"path": "String!"}, resolve: func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			return x.track(parent.(*gqlLibrary), args["path"].(string))
+		}},
+		"search": {typ: "Track", args: map[string]string{"query": "String!", "mode": "String", "first": "Int", "offset": "Int"}, resolve: func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			l := parent.(*gqlLibrary)
+			mode, _ := args["mode"].(string)
+			keys, err := x.search(l, args["query"].(string), mode)
+			if err != nil {
+				return nil, err
+			}
+			lo, hi, err := gqlPage(len(keys), args, maxSearchResult)
+			if err != nil {
+				return nil, err
+			}
+			return l.tracks(keys[lo:hi]), nil
+		}},
+	},
+	"Directory": {
+		"path": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return parent.(*gqlDirectory).path, nil
+		}},
+		"name": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return path.Base("/" + strings.TrimSuffix(parent.(*gqlDirectory).path, "/")), nil
+		}},
+		"directories": {typ: "Directory", args: pageArgs, resolve: func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			d := parent.(*gqlDirectory)
+			ls, err := x.listing(d)
+			if err != nil {
+				return nil, err
+			}
+			lo, hi, err := gqlPage(len(ls.dirs), args, maxListResult)
+			if err != nil {
+				return nil, err
+			}
+			out := []interface{}{}
+			for _, name := range ls.dirs[lo:hi] {
+				out = append(out, &gqlDirectory{lib: d.lib, path: d.path + name + "/"})
+			}
+			return out, nil
+		}},
+		"tracks": {typ: "Track", args: pageArgs, resolve: func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			d := parent.(*gqlDirectory)
+			ls, err := x.listing(d)
+			if err != nil {
+				return nil, err
+			}
+			lo, hi, err := gqlPage(len(ls.files), args, maxListResult)
+			if err != nil {
+				return nil, err
+			}
+			keys := make([]string, hi-lo)
+			for i, f := range ls.files[lo:hi] {
+				keys[i] = d.path + f
+			}
+			return d.lib.tracks(keys), nil
+		}},
+	},
+	"Track": {
+		"path": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return parent.(*gqlTrack).key, nil
+		}},
+		"name": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return path.Base(parent.(*gqlTrack).key), nil
+		}},
+		"url": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			t := parent.(*gqlTrack)
+			return audioURL(t.lib.lib, t.key, nil), nil
+		}},
+		"duration": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			t := parent.(*gqlTrack)
+			return gqlInt(manifest.durations(t.lib.lib, []string{t.key})[0]), nil
+		}},
+		"rating": {resolve: func(x *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			t := parent.(*gqlTrack)
+			return ratings.get(x.user, t.lib.lib, t.key), nil
+		}},
+		"tags": {typ: "Tags", resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			t := parent.(*gqlTrack)
+			if tags, ok := tagsIndex.get(t.lib.lib, t.key); ok && !tags.empty() {
+				return tags, nil
+			}
+			return nil, nil
+		}},
+	},
+	"Tags": {
+		"title":       tagField(func(t trackTags) interface{} { return gqlString(t.Title) }),
+		"artist":      tagField(func(t trackTags) interface{} { return gqlString(t.Artist) }),
+		"albumArtist": tagField(func(t trackTags) interface{} { return gqlString(t.AlbumArtist) }),
+		"album":       tagField(func(t trackTags) interface{} { return gqlString(t.Album) }),
+		"genre":       tagField(func(t trackTags) interface{} { return gqlString(t.Genre) }),
+		"year":        tagField(func(t trackTags) interface{} { return gqlInt(t.Year) }),
+		"track":       tagField(func(t trackTags) interface{} { return gqlInt(t.Track) }),
+		"disc":        tagField(func(t trackTags) interface{} { return gqlInt(t.Disc) }),
+		"compilation": tagField(func(t trackTags) interface{} { return t.Compilation }),
+	},
+	"Playlist": {
+		"name": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return parent.(playlist).Name, nil
+		}},
+		"library": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return parent.(playlist).Library, nil
+		}},
+		"created": {resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return parent.(playlist).Created.UTC().Format(time.RFC3339), nil
+		}},
+		"tracks": {typ: "Track", args: pageArgs, resolve: func(x *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			p := parent.(playlist)
+			l, err := x.library(p.Library)
+			if err != nil {
+				return nil, err
+			}
+			lo, hi, err := gqlPage(len(p.Tracks), args, maxListResult)
+			if err != nil {
+				return nil, err
+			}
+			return l.tracks(p.Tracks[lo:hi]), nil
+		}},
+	},
+}
+
+func tagField(get func(trackTags) interface{}) gqlField {
+	return gqlField{resolve: func(_ *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+		return get(parent.(trackTags)), nil
+	}}
+}
+
+// gqlString and gqlInt answer null for an empty tag or unknown duration
+func gqlString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func gqlInt(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// gqlPage returns the range the first and offset arguments select from n items; first
+// defaults to and is capped at max
+func gqlPage(n int, args map[string]interface{}, max int) (int, int, error) {
+	first, offset := max, 0
+	if v, ok := args["first"].(int); ok {
+		first = min(v, max)
+	}
+	if v, ok := args["offset"].(int); ok {
+		offset = v
+	}
+	if first < 0 || offset < 0 {
+		return 0, 0, errors.New("first and offset must not be negative")
+	}
+	lo := min(offset, n)
+	return lo, min(lo+first, n), nil
+}
+
+func (l *gqlLibrary) tracks(keys []string) []interface{} {
+	out := make([]interface{}, len(keys))
+	for i, key := range keys {
+		out[i] = &gqlTrack{lib: l, key: key}
+	}
+	return out
+}
+
+// gqlListing is a directory listed for a query, shared by its directories and tracks fields
+type gqlListing struct {
+	dirs, files []string
+}
+
+// gqlExec executes one operation
+type gqlExec struct {
+	c         *gin.Context
+	ctx       context.Context
+	fragments map[string]*gqlFragment
+	declared  map[string]bool // variables the operation declares
+	vars      map[string]interface{}
+	user      string
+	libraries map[string]*gqlLibrary
+	listings  map[string]*gqlListing
+	lookups   int
+	fields    int
+	errors    []gqlError
+}
+
+// variables reads the values of the operation's variables, applying their defaults
+func (x *gqlExec) variables(op *gqlOperation, given map[string]interface{}) error {
+	x.declared, x.vars = make(map[string]bool), make(map[string]interface{})
+	for _, v := range op.vars {
+		x.declared[v.name] = true
+		value, ok := given[v.name]
+		if !ok && v.hasDef {
+			value, ok = v.def, true
+		}
+		if strings.HasSuffix(v.typ, "!") && (!ok || value == nil) {
+			return fmt.Errorf("variable $%s of type %s is required", v.name, v.typ)
+		}
+		if ok {
+			x.vars[v.name] = value
+		}
+	}
+	return nil
+}
+
+// arguments checks the arguments of a field selection against its definition and
+// returns them with variables replaced and ints read from JSON numbers
+func (x *gqlExec) arguments(name string, def gqlField, sel *gqlSelection) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	for arg := range sel.args {
+		if _, ok := def.args[arg]; !ok {
+			return nil, fmt.Errorf("unknown argument %q on field %q", arg, name)
+		}
+	}
+	for arg, typ := range def.args {
+		v, err := x.value(sel.args[arg])
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			if strings.HasSuffix(typ, "!") {
+				return nil, fmt.Errorf("argument %q of field %q is required", arg, name)
+			}
+			continue
+		}
+		switch strings.TrimSuffix(typ, "!") {
+		case "String":
+			if _, ok := v.(string); !ok {
+				return nil, fmt.Errorf("argument %q of field %q must be a string", arg, name)
+			}
+		case "Int":
+			if f, ok := v.(float64); ok && f == float64(int32(f)) {
+				v = int(f)
+			}
+			if _, ok := v.(int); !ok {
+				return nil, fmt.Errorf("argument %q of field %q must be an integer", arg, name)
+			}
+		case "Boolean":
+			if _, ok := v.(bool); !ok {
+				return nil, fmt.Errorf("argument %q of field %q must be a boolean", arg, name)
+			}
+		}
+		args[arg] = v
+	}
+	return args, nil
+}
+
+func (x *gqlExec) value(v interface{}) (interface{}, error) {
+	name, ok := v.(gqlVariable)
+	if !ok {
+		return v, nil
+	}
+	if !x.declared[string(name)] {
+		return nil, fmt.Errorf("variable $%s is not defined", name)
+	}
+	return x.vars[string(name)], nil
+}
+
+// skipped applies @skip and @include
+func (x *gqlExec) skipped(dirs []gqlDirective) (bool, error) {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		v, err := x.value(d.args["if"])
+		if err != nil {
+			return false, err
+		}
+		cond, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a boolean if argument", d.name)
+		}
+		if cond == (d.name == "skip") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// gqlCollected is a response key with the field selections merged into it
+type gqlCollected struct {
+	key    string
+	fields []*gqlSelection
+}
+
+// collect flattens fragments into the fields selected on typ
+func (x *gqlExec) collect(typ string, sels []*gqlSelection, out []gqlCollected, visited map[string]bool) ([]gqlCollected, error) {
+	for _, s := range sels {
+		skip, err := x.skipped(s.directives)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			continue
+		}
+		switch {
+		case s.fragment != "":
+			f, ok := x.fragments[s.fragment]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %q", s.fragment)
+			}
+			if visited[s.fragment] {
+				continue
+			}
+			visited[s.fragment] = true
+			if graphSchema[f.on] == nil {
+				return nil, fmt.Errorf("unknown type %q", f.on)
+			}
+			if f.on == typ {
+				if out, err = x.collect(typ, f.selections, out, visited); err != nil {
+					return nil, err
+				}
+			}
+		case s.inline:
+			if s.on != "" && graphSchema[s.on] == nil {
+				return nil, fmt.Errorf("unknown type %q", s.on)
+			}
+			if s.on == "" || s.on == typ {
+				if out, err = x.collect(typ, s.selections, out, visited); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			key := s.name
+			if s.alias != "" {
+				key = s.alias
+			}
+			i := slices.IndexFunc(out, func(f gqlCollected) bool { return f.key == key })
+			if i < 0 {
+				out = append(out, gqlCollected{key: key})
+				i = len(out) - 1
+			}
+			if len(out[i].fields) > 0 && out[i].fields[0].name != s.name {
+				return nil, fmt.Errorf("fields %q and %q both answer as %q", out[i].fields[0].name, s.name, key)
+			}
+			out[i].fields = append(out[i].fields, s)
+		}
+	}
+	return out, nil
+}
+
+// subSelections merges the selection sets of the fields collected under one key
+func (f gqlCollected) subSelections() []*gqlSelection {
+	var subs []*gqlSelection
+	for _, s := range f.fields {
+		subs = append(subs, s.selections...)
+	}
+	return subs
+}
+
+// validate checks a selection set against the schema before anything is resolved, so an
+// invalid query fails whole, whatever the data; spreads tracks the fragments being
+// expanded to reject cycles
+func (x *gqlExec) validate(typ string, sels []*gqlSelection, depth int, spreads map[string]bool) error {
+	if depth > GRAPHQL_MAX_DEPTH {
+		return fmt.Errorf("query is nested deeper than %d levels", GRAPHQL_MAX_DEPTH)
+	}
+	for _, s := range sels {
+		if _, err := x.skipped(s.directives); err != nil {
+			return err
+		}
+		switch {
+		case s.fragment != "":
+			f, ok := x.fragments[s.fragment]
+			if !ok {
+				return fmt.Errorf("unknown fragment %q", s.fragment)
+			}
+			if spreads[s.fragment] {
+				return fmt.Errorf("fragment %q spreads itself", s.fragment)
+			}
+			if graphSchema[f.on] == nil {
+				return fmt.Errorf("unknown type %q", f.on)
+			}
+			if f.on != typ {
+				return fmt.Errorf("fragment %q on %s cannot be spread on %s", f.name, f.on, typ)
+			}
+			spreads[s.fragment] = true
+			err := x.validate(typ, f.selections, depth, spreads)
+			delete(spreads, s.fragment)
+			if err != nil {
+				return err
+			}
+		case s.inline:
+			if s.on != "" && s.on != typ {
+				return fmt.Errorf("fragment on %s cannot be spread on %s", s.on, typ)
+			}
+			if err := x.validate(typ, s.selections, depth, spreads); err != nil {
+				return err
+			}
+		case s.name == "__typename":
+			if len(s.selections) > 0 || len(s.args) > 0 {
+				return errors.New("__typename takes no arguments or selections")
+			}
+		default:
+			def, ok := graphSchema[typ][s.name]
+			if !ok {
+				return fmt.Errorf("cannot query field %q on type %s", s.name, typ)
+			}
+			if _, err := x.arguments(s.name, def, s); err != nil {
+				return err
+			}
+			if def.typ == "" && len(s.selections) > 0 {
+				return fmt.Errorf("field %q is a scalar and has no fields to select", s.name)
+			}
+			if def.typ != "" && len(s.selections) == 0 {
+				return fmt.Errorf("field %q of type %s needs a selection of its fields", s.name, def.typ)
+			}
+			if err := x.validate(def.typ, s.selections, depth+1, spreads); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gqlMap is a response object, which keeps its fields in the order they were selected
+type gqlMap struct {
+	keys   []string
+	values []interface{}
+}
+
+func (m *gqlMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		v, err := json.Marshal(m.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// object resolves the fields selected on a parent of type typ. Resolver errors null their
+// field and are listed with its path; an error returned ends the whole query.
+func (x *gqlExec) object(typ string, parent interface{}, sels []*gqlSelection, at []interface{}) (*gqlMap, error) {
+	fields, err := x.collect(typ, sels, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	out := &gqlMap{}
+	for _, f := range fields {
+		if x.fields++; x.fields > GRAPHQL_MAX_FIELDS {
+			return nil, fmt.Errorf("query resolves more than %d fields, select fewer or page with first", GRAPHQL_MAX_FIELDS)
+		}
+		fieldPath := append(slices.Clip(at), f.key)
+		out.keys = append(out.keys, f.key)
+		sel := f.fields[0]
+		if sel.name == "__typename" {
+			out.values = append(out.values, typ)
+			continue
+		}
+		def := graphSchema[typ][sel.name]
+		args, err := x.arguments(sel.name, def, sel)
+		if err != nil {
+			return nil, err
+		}
+		v, err := def.resolve(x, parent, args)
+		if err != nil {
+			x.errors = append(x.errors, gqlError{Message: err.Error(), Path: fieldPath})
+			v = nil
+		}
+		if def.typ != "" && v != nil {
+			if v, err = x.complete(def.typ, v, f.subSelections(), fieldPath); err != nil {
+				return nil, err
+			}
+		}
+		out.values = append(out.values, v)
+	}
+	return out, nil
+}
+
+// complete resolves the selection of an object field, item by item for lists
+func (x *gqlExec) complete(typ string, v interface{}, sels []*gqlSelection, at []interface{}) (interface{}, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return x.object(typ, v, sels, at)
+	}
+	out := make([]interface{}, len(list))
+	for i, item := range list {
+		obj, err := x.object(typ, item, sels, append(slices.Clip(at), i))
+		if err != nil {
+			return nil, err
+		}
+		out[i] = obj
+	}
+	return out, nil
+}
+
+// lookup counts an S3 lookup against GRAPHQL_MAX_LOOKUPS
+func (x *gqlExec) lookup() error {
+	if x.lookups++; x.lookups > GRAPHQL_MAX_LOOKUPS {
+		return fmt.Errorf("query needs more than %d directory listings, track lookups and searches", GRAPHQL_MAX_LOOKUPS)
+	}
+	return nil
+}
+
+// libraryNames lists the libraries of the request like getLibraries does
+func (x *gqlExec) libraryNames() []string {
+	if userHomes {
+		return tenantLibraryNames(x.c)
+	}
+	names := make([]string, len(libraries))
+	for i, lib := range libraries {
+		names[i] = lib.Name
+	}
+	return names
+}
+
+// library opens a library the request may see, "" being the default (the user's home
+// with USER_HOMES) like the Library middleware selects it
+func (x *gqlExec) library(name string) (*gqlLibrary, error) {
+	if l, ok := x.libraries[name]; ok {
+		return l, nil
+	}
+	var lib *library
+	if userHomes {
+		if _, ok := homeUser(x.c); !ok {
+			return nil, errors.New("API key required")
+		}
+		names := tenantLibraryNames(x.c)
+		if name == "" || name == HOME_LIBRARY {
+			name = names[0]
+		}
+		if slices.Contains(names, name) {
+			lib = findLibrary(name)
+		}
+	} else {
+		lib = findLibrary(name)
+	}
+	if lib == nil {
+		return nil, errors.New(msg(x.c, MSG_UNKNOWN_LIBRARY))
+	}
+	ctx := withLibrary(x.ctx, lib)
+	if prefixes, ok := requestAccess(x.c); ok {
+		ctx = withAccess(ctx, prefixes)
+	}
+	l := &gqlLibrary{lib: lib, ctx: ctx}
+	x.libraries[name] = l
+	return l, nil
+}
+
+// requireUser refuses playlists to guests and, with USER_HOMES, to requests without an
+// API key user, as RequireHomeUser does for the JSON API
+func (x *gqlExec) requireUser() error {
+	if _, signedIn := homeUser(x.c); (userHomes && !signedIn) || isGuest(x.c) {
+		return errors.New("API key required")
+	}
+	return nil
+}
+
+// listing lists a directory once per query, ordered like getBrowserData
+func (x *gqlExec) listing(d *gqlDirectory) (*gqlListing, error) {
+	id := d.lib.lib.Name + "\x00" + d.path
+	if ls, ok := x.listings[id]; ok {
+		return ls, nil
+	}
+	if err := x.lookup(); err != nil {
+		return nil, err
+	}
+	dirs, files, err := s3List(d.lib.ctx, d.path, "/")
+	if err != nil {
+		log.Printf("S3 list error: %v", err)
+		return nil, errors.New(msg(x.c, MSG_ACC_DIR))
+	}
+	files = expandCueFiles(d.lib.ctx, d.path, files)
+	order := requestOrder(x.c)
+	order.sortDirs(dirs)
+	order.sortTracks(d.lib.ctx, d.path, files)
+	ls := &gqlListing{dirs: dirs, files: files}
+	x.listings[id] = ls
+	return ls, nil
+}
+
+// track looks a track up by key, null when it doesn't exist or isn't visible
+func (x *gqlExec) track(l *gqlLibrary, key string) (interface{}, error) {
+	key = strings.TrimPrefix(key, "/")
+	if !isAudioFile(key) || !isListed(key, false) || !folderVisible(l.ctx, key, false) {
+		return nil, nil
+	}
+	if err := x.lookup(); err != nil {
+		return nil, err
+	}
+	object := key
+	if sheet, _, ok := parseCueTrackKey(key); ok {
+		object = sheet // tracks of a cue sheet exist as long as the sheet does
+	}
+	if _, _, _, err := s3HeadAudioFile(l.ctx, object); err != nil {
+		return nil, nil
+	}
+	return &gqlTrack{lib: l, key: key}, nil
+}
+
+// search runs a title search, with the filters and matching modes of searchTitle
+func (x *gqlExec) search(l *gqlLibrary, query, mode string) ([]string, error) {
+	match, _, text, err := titleMatcher(x.c, l.lib, x.user, query, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := x.lookup(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(l.ctx, searchTimeout)
+	defer cancel()
+	titles, err := s3SearchFilesIn(ctx, nil, match)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, errors.New(msg(x.c, MSG_SEARCH_TIMEOUT))
+	}
+	if err != nil {
+		log.Printf("S3 search error: %v", err)
+		return nil, errors.New("S3 search error")
+	}
+	eventBus.Publish(EVENT_SEARCH, map[string]interface{}{"kind": "title", "query": text, "count": len(titles)})
+	requestOrder(x.c).sortTracks(ctx, "", titles)
+	return titles, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+	}{
+		{"shorthand", `{ libraries { name } }`, true},
+		{"named with variables", `query Q($p: String = "Jazz", $n: Int!) { library { directory(path: $p) { tracks(first: $n) { path } } } }`, true},
+		{"fragments and directives", `{ ...F ... on Query @include(if: true) { libraries { name } } } fragment F on Query { libraries { name } }`, true},
+		{"comments and commas", "# all\n{ libraries, { name, } }", true},
+		{"block string", `{ library(name: """Lossless "HD" """) { name } }`, true},
+		{"unterminated", `{ libraries { name }`, false},
+		{"empty selection", `{ libraries { } }`, false},
+		{"bad string", `{ library(name: "a\qb") { name } }`, false},
+		{"variable in default", `query ($a: String = $b) { libraries { name } }`, false},
+		{"duplicate fragment", `{ ...F } fragment F on Query { libraries { name } } fragment F on Query { libraries { name } }`, false},
+		{"no operation", `fragment F on Query { libraries { name } }`, false},
+		{"too deep", "{" + strings.Repeat(" a {", GRAPHQL_MAX_DEPTH) + " b" + strings.Repeat(" }", GRAPHQL_MAX_DEPTH) + " }", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.query)
+			if (err == nil) != tt.ok {
+				t.Errorf("parseGraphQL(%q) error %v, want ok %v", tt.query, err, tt.ok)
+			}
+		})
+	}
+}
+
+// TestGraphQLQuery runs queries against a fake bucket: fields come back in the order they
+// were selected, unknown libraries null their field, and invalid queries fail whole
+func TestGraphQLQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(libs []*library) { libraries = libs }(libraries)
+	libraries = []*library{{Name: "Music", Bucket: "music"}}
+	useFakeS3(t, &fakeS3{objects: map[string]string{"music/Jazz/a.mp3": "a", "music/Jazz/Sub/b.mp3": "b", "music/c.mp3": "c"}})
+	r := gin.New()
+	registerRoutes(r)
+
+	tests := []struct {
+		name string
+		body string
+		code int
+		want string
+	}{
+		{
+			name: "browse",
+			body: `{"query":"query Browse($dir: String = \"Jazz\") { libraries { name } library { directory(path: $dir) { __typename path name directories { path } tracks { ...T } } } missing: library(name: \"Nope\") { name } } fragment T on Track { path url rating }"}`,
+			code: http.StatusOK,
+			want: `{"data":{"libraries":[{"name":"Music"}],"library":{"directory":{"__typename":"Directory","path":"Jazz/","name":"Jazz","directories":[{"path":"Jazz/Sub/"}],"tracks":[{"path":"Jazz/a.mp3","url":"/audio/Jazz/a.mp3","rating":0}]}},"missing":null},"errors":[{"message":"unknown library","path":["missing"]}]}`,
+		},
+		{
+			name: "paging and skip",
+			body: `{"query":"query ($all: Boolean!) { library { directory { tracks(offset: 0, first: 1) { name } directories @skip(if: $all) { name } } } }","variables":{"all":true}}`,
+			code: http.StatusOK,
+			want: `{"data":{"library":{"directory":{"tracks":[{"name":"c.mp3"}]}}}}`,
+		},
+		{
+			name: "track lookup",
+			body: `{"query":"{ library { a: track(path: \"Jazz/a.mp3\") { name } none: track(path: \"Jazz/x.mp3\") { name } } }"}`,
+			code: http.StatusOK,
+			want: `{"data":{"library":{"a":{"name":"a.mp3"},"none":null}}}`,
+		},
+		{
+			name: "unknown field",
+			body: `{"query":"{ libraries { size } }"}`,
+			code: http.StatusBadRequest,
+			want: `{"errors":[{"message":"cannot query field \"size\" on type Library"}]}`,
+		},
+		{
+			name: "missing variable",
+			body: `{"query":"query ($n: Int!) { library { directory { tracks(first: $n) { name } } } }"}`,
+			code: http.StatusBadRequest,
+			want: `{"errors":[{"message":"variable $n of type Int! is required"}]}`,
+		},
+		{
+			name: "mutation",
+			body: `{"query":"mutation { libraries { name } }"}`,
+			code: http.StatusBadRequest,
+			want: `{"errors":[{"message":"mutation operations are not supported, only queries"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.code || w.Body.String() != tt.want {
+				t.Errorf("status %d, body %s\nwant %d, %s", w.Code, w.Body.String(), tt.code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	GRPC_PACKAGE     = "gomusic.v1"
+	GRPC_SERVICE     = "Library"
+	GRPC_PROTO_FILE  = "gomusic/v1/library.proto"
+	GRPC_MAX_STREAMS = 100 // concurrent calls per connection
+)
+
+// GRPC_LISTEN (e.g. ":9090") serves the gomusic.v1.Library gRPC service for automation
+// tools and native apps, with TLS_CERT/TLS_KEY when those are set. Its calls are passed
+// to the HTTP routes in-process, /graphql for the unary ones and /events for
+// WatchLibrary, so API keys (sent as "authorization: Bearer gm_..." metadata), folder
+// ACLs, IP rules, quotas and rate limits apply as they do over HTTP. The definition is
+// served at /api/v1/library.proto and by server reflection.
+var grpcListen = os.Getenv("GRPC_LISTEN")
+
+// grpcFile is the descriptor of the service, built from grpcMessages and grpcMethods
+var grpcFile protoreflect.FileDescriptor
+
+func initGRPC() error {
+	if grpcListen == "" {
+		return nil
+	}
+	if autocertDomains != "" {
+		return fmt.Errorf("GRPC_LISTEN supports TLS_CERT/TLS_KEY, not TLS_AUTOCERT_DOMAINS")
+	}
+	fd, err := buildGRPCFile()
+	if err != nil {
+		return fmt.Errorf("gRPC service definition: %w", err)
+	}
+	grpcFile = fd
+	// Server reflection looks the file up in the global registry
+	return protoregistry.GlobalFiles.RegisterFile(fd)
+}
+
+// grpcField is a field of a message: a scalar (string, int32, int64, bool) or a message
+type grpcField struct {
+	name, typ string
+	repeated  bool
+	doc       string
+}
+
+type grpcMessage struct {
+	name, doc string
+	fields    []grpcField // numbered in order, from 1
+}
+
+type grpcMethod struct {
+	name, in, out, doc string
+	stream             bool // server stream
+}
+
+var grpcMessages = []grpcMessage{
+	{"Directory", "A folder of a library", []grpcField{
+		{"path", "string", false, "Library-relative, ending in /; empty for the root"},
+		{"name", "string", false, ""},
+	}},
+	{"Tags", "Tags the tag scan read (TAG_SCAN); empty values are left out", []grpcField{
+		{"title", "string", false, ""},
+		{"artist", "string", false, ""},
+		{"album_artist", "string", false, ""},
+		{"album", "string", false, ""},
+		{"genre", "string", false, ""},
+		{"year", "int32", false, ""},
+		{"track", "int32", false, ""},
+		{"disc", "int32", false, ""},
+		{"compilation", "bool", false, ""},
+	}},
+	{"Track", "An audio file, or a track of a cue sheet", []grpcField{
+		{"path", "string", false, "Library-relative key"},
+		{"name", "string", false, ""},
+		{"url", "string", false, "Stream path below the HTTP server's BASE_PATH; send the same authorization"},
+		{"duration", "int32", false, "Seconds, 0 when unknown"},
+		{"rating", "int32", false, "Stars the user gave, 0 when unrated"},
+		{"tags", "Tags", false, "Unset without tags"},
+	}},
+	{"BrowseRequest", "", []grpcField{
+		{"library", "string", false, "Empty for the default library"},
+		{"path", "string", false, "Folder to list, empty for the root"},
+		{"offset", "int32", false, "Tracks to skip"},
+		{"limit", "int32", false, "Tracks to return, 0 for the server's list limit"},
+	}},
+	{"BrowseResponse", "", []grpcField{
+		{"path", "string", false, ""},
+		{"directories", "Directory", true, ""},
+		{"tracks", "Track", true, ""},
+	}},
+	{"SearchRequest", "", []grpcField{
+		{"library", "string", false, ""},
+		{"query", "string", false, "Title search with the filters of the web UI, e.g. \"artist:miles rating:4 blue\""},
+		{"mode", "string", false, "substring (default), regex or glob"},
+		{"offset", "int32", false, ""},
+		{"limit", "int32", false, "0 for the server's search result limit"},
+	}},
+	{"SearchResponse", "", []grpcField{
+		{"tracks", "Track", true, ""},
+	}},
+	{"GetStreamURLRequest", "", []grpcField{
+		{"library", "string", false, ""},
+		{"path", "string", false, ""},
+	}},
+	{"GetStreamURLResponse", "", []grpcField{
+		{"url", "string", false, "Stream path below the HTTP server's BASE_PATH"},
+	}},
+	{"ListPlaylistsRequest", "", nil},
+	{"Playlist", "A playlist the user saved", []grpcField{
+		{"name", "string", false, ""},
+		{"library", "string", false, ""},
+		{"created", "string", false, "RFC 3339"},
+		{"tracks", "Track", true, ""},
+	}},
+	{"ListPlaylistsResponse", "", []grpcField{
+		{"playlists", "Playlist", true, ""},
+	}},
+	{"WatchLibraryRequest", "", []grpcField{
+		{"events", "string", true, "Event types to receive, as on /events; default scan, library and collection"},
+	}},
+	{"LibraryEvent", "", []grpcField{
+		{"type", "string", false, ""},
+		{"data", "string", false, "The event as JSON, as /events sends it"},
+	}},
+}
+
+var grpcMethods = []grpcMethod{
+	{"Browse", "BrowseRequest", "BrowseResponse", "Lists the folders and tracks of a folder", false},
+	{"Search", "SearchRequest", "SearchResponse", "Searches track titles, paths and tags", false},
+	{"GetStreamURL", "GetStreamURLRequest", "GetStreamURLResponse", "Returns the stream URL of a track; NOT_FOUND when it doesn't exist", false},
+	{"ListPlaylists", "ListPlaylistsRequest", "ListPlaylistsResponse", "Lists the user's saved playlists with their tracks", false},
+	{"WatchLibrary", "WatchLibraryRequest", "LibraryEvent", "Streams library events until the call is cancelled", true},
+}
+
+var grpcScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+}
+
+// buildGRPCFile builds the descriptor the server decodes and encodes messages with
+func buildGRPCFile() (protoreflect.FileDescriptor, error) {
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(GRPC_PROTO_FILE),
+		Package: proto.String(GRPC_PACKAGE),
+		Syntax:  proto.String("proto3"),
+	}
+	for _, m := range grpcMessages {
+		dp := &descriptorpb.DescriptorProto{Name: proto.String(m.name)}
+		for i, f := range m.fields {
+			fp := &descriptorpb.FieldDescriptorProto{
+				Name:   proto.String(f.name),
+				Number: proto.Int32(int32(i + 1)),
+				Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			if f.repeated {
+				fp.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			}
+			if t, ok := grpcScalarTypes[f.typ]; ok {
+				fp.Type = t.Enum()
+			} else {
+				fp.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fp.TypeName = proto.String("." + GRPC_PACKAGE + "." + f.typ)
+			}
+			dp.Field = append(dp.Field, fp)
+		}
+		fdp.MessageType = append(fdp.MessageType, dp)
+	}
+	sp := &descriptorpb.ServiceDescriptorProto{Name: proto.String(GRPC_SERVICE)}
+	for _, m := range grpcMethods {
+		sp.Method = append(sp.Method, &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(m.name),
+			InputType:       proto.String("." + GRPC_PACKAGE + "." + m.in),
+			OutputType:      proto.String("." + GRPC_PACKAGE + "." + m.out),
+			ServerStreaming: proto.Bool(m.stream),
+		})
+	}
+	fdp.Service = []*descriptorpb.ServiceDescriptorProto{sp}
+	return protodesc.NewFile(fdp, nil)
+}
+
+// grpcProto renders the service definition as a .proto file for client code generators
+func grpcProto() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// gRPC service of go-music, served on GRPC_LISTEN\nsyntax = \"proto3\";\n\npackage %s;\n\n", GRPC_PACKAGE)
+	fmt.Fprintf(&b, "service %s {\n", GRPC_SERVICE)
+	for _, m := range grpcMethods {
+		out := m.out
+		if m.stream {
+			out = "stream " + out
+		}
+		fmt.Fprintf(&b, "  // %s\n  rpc %s(%s) returns (%s);\n", m.doc, m.name, m.in, out)
+	}
+	b.WriteString("}\n")
+	for _, m := range grpcMessages {
+		b.WriteString("\n")
+		if m.doc != "" {
+			fmt.Fprintf(&b, "// %s\n", m.doc)
+		}
+		fmt.Fprintf(&b, "message %s {", m.name)
+		if len(m.fields) == 0 {
+			b.WriteString("}\n")
+			continue
+		}
+		b.WriteString("\n")
+		for i, f := range m.fields {
+			typ := f.typ
+			if f.repeated {
+				typ = "repeated " + typ
+			}
+			fmt.Fprintf(&b, "  %s %s = %d;", typ, f.name, i+1)
+			if f.doc != "" {
+				fmt.Fprintf(&b, " // %s", f.doc)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// handleGRPCProto serves the service definition (GET /api/v1/library.proto)
+func handleGRPCProto(c *gin.Context) {
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(grpcProto()))
+}
+
+// grpcTrackFields selects a Track message from /graphql
+const grpcTrackFields = ` fragment T on Track { path name url duration rating tags { title artist albumArtist album genre year track disc compilation } }`
+
+// grpcQuery answers a unary method with a /graphql query. The message is read from the
+// data at path, or nested under wrap; variables are the request fields by JSON name.
+type grpcQuery struct {
+	query   string
+	path    []string
+	wrap    string
+	missing string // NOT_FOUND message when the data at path is null
+}
+
+var grpcQueries = map[string]grpcQuery{
+	"Browse": {
+		query:   `query ($library: String, $path: String, $offset: Int, $limit: Int) { library(name: $library) { directory(path: $path) { path directories { path name } tracks(offset: $offset, first: $limit) { ...T } } } }` + grpcTrackFields,
+		path:    []string{"library", "directory"},
+		missing: "no such directory",
+	},
+	"Search": {
+		query: `query ($library: String, $query: String!, $mode: String, $offset: Int, $limit: Int) { library(name: $library) { search(query: $query, mode: $mode, offset: $offset, first: $limit) { ...T } } }` + grpcTrackFields,
+		path:  []string{"library", "search"},
+		wrap:  "tracks",
+	},
+	"GetStreamURL": {
+		query:   `query ($library: String, $path: String!) { library(name: $library) { track(path: $path) { url } } }`,
+		path:    []string{"library", "track"},
+		missing: "no such track",
+	},
+	"ListPlaylists": {
+		query: `{ playlists { name library created tracks { ...T } } }` + grpcTrackFields,
+		path:  []string{"playlists"},
+		wrap:  "playlists",
+	},
+}
+
+// grpcWatchEvents are the events WatchLibrary sends when the request names none
+var grpcWatchEvents = []string{EVENT_SCAN_PROGRESS, EVENT_LIBRARY_CHANGED, EVENT_COLLECTION_CHANGED}
+
+// grpcGateway serves the service by passing its calls to the HTTP routes of handler
+type grpcGateway struct {
+	handler http.Handler
+	file    protoreflect.FileDescriptor
+}
+
+// runGRPC serves the gRPC service on GRPC_LISTEN until ctx is done
+func runGRPC(ctx context.Context, handler http.Handler) {
+	opts := []grpc.ServerOption{grpc.MaxConcurrentStreams(GRPC_MAX_STREAMS)}
+	if tlsCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(tlsCert, tlsKey)
+		if err != nil {
+			log.Printf("gRPC TLS error: %v", err)
+			return
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	ln, err := net.Listen("tcp", grpcListen)
+	if err != nil {
+		log.Printf("gRPC listener failed: %v", err)
+		return
+	}
+	s := grpc.NewServer(opts...)
+	g := &grpcGateway{handler: handler, file: grpcFile}
+	s.RegisterService(g.serviceDesc(), g)
+	reflection.Register(s)
+	log.Printf("gRPC service %s.%s listening on %s", GRPC_PACKAGE, GRPC_SERVICE, ln.Addr())
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	if err := s.Serve(ln); err != nil {
+		log.Printf("gRPC server error: %v", err)
+	}
+}
+
+func (g *grpcGateway) message(name string) protoreflect.MessageDescriptor {
+	return g.file.Messages().ByName(protoreflect.Name(name))
+}
+
+// serviceDesc describes the methods to grpc-go the way generated code would
+func (g *grpcGateway) serviceDesc() *grpc.ServiceDesc {
+	sd := &grpc.ServiceDesc{
+		ServiceName: GRPC_PACKAGE + "." + GRPC_SERVICE,
+		HandlerType: (*interface{})(nil),
+		Metadata:    GRPC_PROTO_FILE,
+	}
+	for _, m := range grpcMethods {
+		if m.stream {
+			sd.Streams = append(sd.Streams, grpc.StreamDesc{StreamName: m.name, ServerStreams: true, Handler: g.watchLibrary})
+			continue
+		}
+		sd.Methods = append(sd.Methods, grpc.MethodDesc{MethodName: m.name, Handler: g.unary(m)})
+	}
+	return sd
+}
+
+func (g *grpcGateway) unary(m grpcMethod) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := g.message(m.in)
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := dynamicpb.NewMessage(in)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return g.query(ctx, m, req.(proto.Message))
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GRPC_PACKAGE + "." + GRPC_SERVICE + "/" + m.name}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// query answers a unary call with its grpcQuery
+func (g *grpcGateway) query(ctx context.Context, m grpcMethod, req proto.Message) (proto.Message, error) {
+	q := grpcQueries[m.name]
+	vars := make(map[string]interface{})
+	if b, err := (protojson.MarshalOptions{EmitUnpopulated: true}).Marshal(req); err == nil {
+		json.Unmarshal(b, &vars)
+	}
+	if vars["limit"] == float64(0) {
+		delete(vars, "limit") // the server's limit
+	}
+	body, _ := json.Marshal(gqlRequest{Query: q.query, Variables: vars})
+	res := &grpcResponse{header: make(http.Header)}
+	g.handler.ServeHTTP(res, g.request(ctx, http.MethodPost, "/graphql", body))
+	if res.status != http.StatusOK {
+		return nil, res.err()
+	}
+	var out struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []gqlError             `json:"errors"`
+	}
+	if err := json.Unmarshal(res.body.Bytes(), &out); err != nil {
+		return nil, status.Error(codes.Internal, "invalid response")
+	}
+	if len(out.Errors) > 0 {
+		return nil, status.Error(codes.Unknown, out.Errors[0].Message)
+	}
+	var v interface{} = out.Data
+	for _, key := range q.path {
+		obj, _ := v.(map[string]interface{})
+		v = obj[key]
+	}
+	if v == nil && q.missing != "" {
+		return nil, status.Error(codes.NotFound, q.missing)
+	}
+	if q.wrap != "" {
+		v = map[string]interface{}{q.wrap: v}
+	}
+	b, _ := json.Marshal(v)
+	msg := dynamicpb.NewMessage(g.message(m.out))
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, msg); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return msg, nil
+}
+
+// watchLibrary streams the events /events sends the caller
+func (g *grpcGateway) watchLibrary(_ interface{}, stream grpc.ServerStream) error {
+	req := dynamicpb.NewMessage(g.message("WatchLibraryRequest"))
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	wanted := grpcWatchEvents
+	if list := req.Get(req.Descriptor().Fields().ByName("events")).List(); list.Len() > 0 {
+		wanted = nil
+		for i := 0; i < list.Len(); i++ {
+			wanted = append(wanted, list.Get(i).String())
+		}
+	}
+	desc := g.message("LibraryEvent")
+	res := &grpcResponse{header: make(http.Header), event: func(name, data string) error {
+		if !slices.Contains(wanted, name) {
+			return nil
+		}
+		ev := dynamicpb.NewMessage(desc)
+		ev.Set(desc.Fields().ByName("type"), protoreflect.ValueOfString(name))
+		ev.Set(desc.Fields().ByName("data"), protoreflect.ValueOfString(data))
+		return stream.SendMsg(ev)
+	}}
+	g.handler.ServeHTTP(res, g.request(stream.Context(), http.MethodGet, "/events", nil))
+	if res.status != http.StatusOK {
+		return res.err()
+	}
+	return nil
+}
+
+// request builds the HTTP request a call is passed on as, with the caller's address and
+// authorization
+func (g *grpcGateway) request(ctx context.Context, method, target string, body []byte) *http.Request {
+	req, _ := http.NewRequestWithContext(ctx, method, basePath+target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			req.Header.Set("Authorization", v[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+	return req
+}
+
+// grpcResponse records the response to a call passed on to the HTTP routes. An event
+// stream is parsed as it is written, each event handed to event.
+type grpcResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	event  func(name, data string) error
+}
+
+func (r *grpcResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *grpcResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *grpcResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	r.body.Write(p)
+	if r.event == nil || r.status != http.StatusOK {
+		return len(p), nil
+	}
+	for {
+		i := bytes.Index(r.body.Bytes(), []byte("\n\n"))
+		if i < 0 {
+			return len(p), nil
+		}
+		var name, data string
+		for _, line := range strings.Split(string(r.body.Next(i+2)), "\n") {
+			if v, ok := strings.CutPrefix(line, "event:"); ok {
+				name = strings.TrimSpace(v)
+			} else if v, ok := strings.CutPrefix(line, "data:"); ok {
+				data += strings.TrimSpace(v)
+			}
+		}
+		if name == "" {
+			continue // keepalive comment
+		}
+		if err := r.event(name, data); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *grpcResponse) Flush() {}
+
+// CloseNotify never fires: the call's context ends the request instead
+func (r *grpcResponse) CloseNotify() <-chan bool {
+	return nil
+}
+
+// err turns an HTTP error response into a gRPC status
+func (r *grpcResponse) err() error {
+	code := codes.Internal
+	switch r.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	var body struct {
+		Error  string     `json:"error"`
+		Errors []gqlError `json:"errors"`
+	}
+	msg := strings.TrimSpace(r.body.String())
+	if json.Unmarshal(r.body.Bytes(), &body) == nil {
+		if body.Error != "" {
+			msg = body.Error
+		} else if len(body.Errors) > 0 {
+			msg = body.Errors[0].Message
+		}
+	}
+	return status.Error(code, msg)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// TestGRPCGateway calls the service over an in-memory connection against a fake bucket
+func TestGRPCGateway(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(libs []*library) { libraries = libs }(libraries)
+	libraries = []*library{{Name: "Music", Bucket: "music"}}
+	useFakeS3(t, &fakeS3{objects: map[string]string{"music/Jazz/a.mp3": "a", "music/Jazz/Sub/b.mp3": "b"}})
+	r := gin.New()
+	registerRoutes(r)
+	fd, err := buildGRPCFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &grpcGateway{handler: r, file: fd}
+	ln := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	s.RegisterService(g.serviceDesc(), g)
+	go s.Serve(ln)
+	defer s.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		method, in, out, req string
+		want                 string
+		code                 codes.Code
+	}{
+		{"Browse", "BrowseRequest", "BrowseResponse", `{"path":"Jazz"}`,
+			`{"path":"Jazz/","directories":[{"path":"Jazz/Sub/","name":"Sub"}],"tracks":[{"path":"Jazz/a.mp3","name":"a.mp3","url":"/audio/Jazz/a.mp3"}]}`, codes.OK},
+		{"Browse", "BrowseRequest", "BrowseResponse", `{"library":"Nope"}`, "", codes.Unknown},
+		{"GetStreamURL", "GetStreamURLRequest", "GetStreamURLResponse", `{"path":"Jazz/Sub/b.mp3"}`, `{"url":"/audio/Jazz/Sub/b.mp3"}`, codes.OK},
+		{"GetStreamURL", "GetStreamURLRequest", "GetStreamURLResponse", `{"path":"Jazz/c.mp3"}`, "", codes.NotFound},
+		{"ListPlaylists", "ListPlaylistsRequest", "ListPlaylistsResponse", `{}`, `{}`, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.req, func(t *testing.T) {
+			req := dynamicpb.NewMessage(g.message(tt.in))
+			if err := protojson.Unmarshal([]byte(tt.req), req); err != nil {
+				t.Fatal(err)
+			}
+			res := dynamicpb.NewMessage(g.message(tt.out))
+			err := conn.Invoke(context.Background(), "/gomusic.v1.Library/"+tt.method, req, res)
+			if status.Code(err) != tt.code {
+				t.Fatalf("code %v (%v), want %v", status.Code(err), err, tt.code)
+			}
+			if err != nil {
+				return
+			}
+			got, _ := protojson.Marshal(res)
+			if strings.ReplaceAll(string(got), " ", "") != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("WatchLibrary", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/gomusic.v1.Library/WatchLibrary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.SendMsg(dynamicpb.NewMessage(g.message("WatchLibraryRequest"))); err != nil {
+			t.Fatal(err)
+		}
+		stream.CloseSend()
+		for sseClients.count() == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		sseClients.publish(EVENT_PLAY_STARTED, map[string]interface{}{"track": "Jazz/a.mp3"}) // not a library event
+		sseClients.publish(EVENT_LIBRARY_CHANGED, map[string]interface{}{"library": "Music"})
+		ev := dynamicpb.NewMessage(g.message("LibraryEvent"))
+		if err := stream.RecvMsg(ev); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := protojson.Marshal(ev); strings.ReplaceAll(string(got), " ", "") != `{"type":"library","data":"{\"library\":\"Music\"}"}` {
+			t.Errorf("got %s", got)
+		}
+	})
+}
+
+// TestGRPCProto checks the published definition names every message and method
+func TestGRPCProto(t *testing.T) {
+	fd, err := buildGRPCFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := grpcProto()
+	for i := 0; i < fd.Messages().Len(); i++ {
+		if name := string(fd.Messages().Get(i).Name()); !strings.Contains(text, "message "+name+" {") {
+			t.Errorf("message %s missing from the .proto", name)
+		}
+	}
+	methods := fd.Services().Get(0).Methods()
+	for i := 0; i < methods.Len(); i++ {
+		if name := string(methods.Get(i).Name()); !strings.Contains(text, "rpc "+name+"(") {
+			t.Errorf("rpc %s missing from the .proto", name)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Guest mode opens PUBLIC_PREFIXES, e.g. "Mixtapes/,Shared/", to visitors without an API
+// key or sign-in: they browse and stream those folders read-only, and sign in at /login
+// for the rest. Signed-in users keep their FOLDER_ACL access.
+var publicPrefixes []string
+
+func initPublicPrefixes() error {
+	for _, p := range splitList(os.Getenv("PUBLIC_PREFIXES")) {
+		if p = strings.Trim(p, "/"); p != "" {
+			publicPrefixes = append(publicPrefixes, p+"/")
+		}
+	}
+	if publicPrefixes != nil && userHomes {
+		return fmt.Errorf("PUBLIC_PREFIXES cannot be combined with USER_HOMES, which requires sign-in")
+	}
+	return nil
+}
+
+// isGuest reports whether a request is a guest's in guest mode: it has no API key user
+// and not the admin token
+func isGuest(c *gin.Context) bool {
+	if publicPrefixes == nil || isAdminToken(bearerToken(c)) {
+		return false
+	}
+	_, signedIn := homeUser(c)
+	return !signedIn
+}
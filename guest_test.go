@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestGuestMode checks that guests only read and only reach PUBLIC_PREFIXES, while a
+// signed-in user gets past both limits
+func TestGuestMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prefixes []string, libs []*library) { publicPrefixes, libraries = prefixes, libs }(publicPrefixes, libraries)
+	publicPrefixes = []string{"Mixtapes/"}
+	music := &library{Name: "Music", Bucket: "music"}
+	libraries = []*library{music}
+	useFakeS3(t, &fakeS3{objects: map[string]string{"music/Mixtapes/a.mp3": "public", "music/Private/b.mp3": "private"}})
+	alice := addTestAPIKey(t, "alice", "alice", "")
+	r := gin.New()
+	registerRoutes(r)
+
+	form := func(name string) string { return url.Values{"dffunc": {name}, "dfdata": {"{}"}}.Encode() }
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		token  string
+		want   int
+	}{
+		{"guest public track", http.MethodGet, "/audio/Mixtapes/a.mp3", "", "", http.StatusOK},
+		{"guest private track", http.MethodGet, "/audio/Private/b.mp3", "", "", http.StatusNotFound},
+		{"signed-in private track", http.MethodGet, "/audio/Private/b.mp3", "", alice, http.StatusOK},
+		{"guest browsing", http.MethodPost, "/api", form("dir"), "", http.StatusOK},
+		{"guest publishing playback", http.MethodPost, "/api", form("nowPlaying"), "", http.StatusUnauthorized},
+		{"guest registering a device", http.MethodPost, "/api", form("registerDevice"), "", http.StatusUnauthorized},
+		{"guest rating", http.MethodPut, "/api/v1/rating/Mixtapes/a.mp3", `{"rating":5}`, "", http.StatusUnauthorized},
+		{"guest events", http.MethodGet, "/events", "", "", http.StatusUnauthorized},
+		{"guest sync", http.MethodGet, "/ws", "", "", http.StatusUnauthorized},
+		{"guest queue", http.MethodGet, "/api/v1/queue", "", "", http.StatusUnauthorized},
+		{"signed-in queue", http.MethodGet, "/api/v1/queue", "", alice, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// TestGuestSearchAsync checks that a guest's background search stays in PUBLIC_PREFIXES
+func TestGuestSearchAsync(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prefixes []string, libs []*library) { publicPrefixes, libraries = prefixes, libs }(publicPrefixes, libraries)
+	publicPrefixes = []string{"Mixtapes/"}
+	libraries = []*library{{Name: "Music", Bucket: "guest-search"}}
+	useFakeS3(t, &fakeS3{objects: map[string]string{"guest-search/Mixtapes/song.mp3": "public", "guest-search/Private/song.mp3": "private"}})
+	r := gin.New()
+	registerRoutes(r)
+
+	got := searchAsyncTitles(t, r, "", "song")
+	if strings.Join(got, ",") != "Mixtapes/song.mp3" {
+		t.Errorf("guest searchAsync found %v, want [Mixtapes/song.mp3]", got)
+	}
+}
+
+// TestGuestAccess checks the folders requestAccess gives guests and signed-in users, and
+// that guest mode takes precedence over the FOLDER_ACL rule for everyone
+func TestGuestAccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prefixes []string, acl map[string][]string) { publicPrefixes, folderACL = prefixes, acl }(publicPrefixes, folderACL)
+	publicPrefixes = []string{"Mixtapes/"}
+	folderACL = map[string][]string{ACL_EVERYONE: {"Shared/"}, "bob": {"Kids/"}}
+	alice := addTestAPIKey(t, "alice", "alice", "")
+	bob := addTestAPIKey(t, "bob", "bob", "")
+
+	tests := []struct {
+		name  string
+		token string
+		want  []string
+	}{
+		{"guest", "", []string{"Mixtapes/"}},
+		{"user without a rule", alice, []string{"Shared/"}},
+		{"user with a rule", bob, []string{"Kids/"}},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		got, ok := requestAccess(c)
+		if !ok || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: access %v, %v; want %v", tt.name, got, ok, tt.want)
+		}
+	}
+}
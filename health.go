@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	HEALTH_TIMEOUT      = 2 * time.Minute
+	HEALTH_MAX_EXAMPLES = 20 // paths listed per checklist item
+)
+
+var artworkExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true}
+
+// healthCheck is one item of the cleanup checklist
+type healthCheck struct {
+	Check    string   `json:"check"`
+	Count    int      `json:"count"`
+	Action   string   `json:"action"`
+	Job      string   `json:"job,omitempty"` // endpoint that fixes or rechecks the issue
+	Examples []string `json:"examples,omitempty"`
+}
+
+func (h *healthCheck) add(key string) {
+	h.Count++
+	if len(h.Examples) < HEALTH_MAX_EXAMPLES {
+		h.Examples = append(h.Examples, key)
+	}
+}
+
+// libraryHealth walks a library once and scores it by the share of tracks without any issue.
+// Tag and play-count checks need data the server doesn't keep yet and are reported as unavailable.
+func libraryHealth(ctx context.Context, lib *library) (gin.H, error) {
+	var (
+		tracks    []audioObject
+		artDirs   = make(map[string]bool)
+		trackDirs = make(map[string]bool)
+	)
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(lib.Bucket),
+		Prefix: aws.String(lib.Prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(*obj.Key, lib.Prefix)
+			if isMetaDir(key) || isIgnored(key) {
+				continue
+			}
+			dir := path.Dir(key)
+			if artworkExts[strings.ToLower(path.Ext(key))] {
+				artDirs[dir] = true
+			} else if isAudioFile(key) {
+				trackDirs[dir] = true
+				tracks = append(tracks, audioObject{Key: key, Size: aws.ToInt64(obj.Size), ETag: normalizeETag(aws.ToString(obj.ETag))})
+			}
+		}
+	}
+
+	duplicates := &healthCheck{Check: "duplicates", Action: "Remove copies of identical files (same content hash and size)"}
+	names := &healthCheck{Check: "non-normalized names", Action: "Rename paths to Unicode NFC without leading or trailing spaces"}
+	corrupt := &healthCheck{Check: "unreadable files", Action: "Replace or re-encode files whose header could not be read, then rescan", Job: "POST /admin/manifest/scan"}
+	artwork := &healthCheck{Check: "missing artwork", Action: "Add a cover image (jpg, png or webp) to these folders"}
+	unscanned := 0
+
+	bad := make(map[string]bool)
+	seen := make(map[string]string)
+	for _, t := range tracks {
+		if t.ETag != "" {
+			id := t.ETag + "/" + strconv.FormatInt(t.Size, 10)
+			if _, dup := seen[id]; dup {
+				duplicates.add(t.Key)
+				bad[t.Key] = true
+			} else {
+				seen[id] = t.Key
+			}
+		}
+		if !isNormalizedName(t.Key) {
+			names.add(t.Key)
+			bad[t.Key] = true
+		}
+		if e, ok := manifest.entry(lib, t.Key); !ok || e.ETag != t.ETag {
+			unscanned++
+		} else if e.DurationMs == 0 {
+			corrupt.add(t.Key)
+			bad[t.Key] = true
+		}
+	}
+	var bare []string
+	for dir := range trackDirs {
+		if !artDirs[dir] {
+			if dir == "." {
+				dir = ""
+			}
+			bare = append(bare, dir+"/")
+		}
+	}
+	sortNames(bare)
+	for _, dir := range bare {
+		artwork.add(dir)
+	}
+	for _, t := range tracks {
+		if !artDirs[path.Dir(t.Key)] {
+			bad[t.Key] = true
+		}
+	}
+
+	score := 100
+	if len(tracks) > 0 {
+		score = int(math.Round(100 * float64(len(tracks)-len(bad)) / float64(len(tracks))))
+	}
+	var checklist []*healthCheck
+	for _, h := range []*healthCheck{duplicates, names, corrupt, artwork} {
+		if h.Count > 0 {
+			checklist = append(checklist, h)
+		}
+	}
+	return gin.H{
+		"library":     lib.Name,
+		"score":       score,
+		"tracks":      len(tracks),
+		"cleanTracks": len(tracks) - len(bad),
+		"unscanned":   unscanned,
+		"checklist":   checklist,
+		"unavailable": []string{"missing tags", "zero plays"},
+	}, nil
+}
+
+// isNormalizedName reports whether every component of a path is NFC and free of surrounding spaces
+func isNormalizedName(key string) bool {
+	if !norm.NFC.IsNormalString(key) {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part != strings.TrimSpace(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleLibraryHealth reports the health score and cleanup checklist of a library (GET /admin/health?library=)
+func handleLibraryHealth(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	ctx, err := s3Meter.guardScan(c.Request.Context(), "health")
+	if budgetExceeded(c, err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_TIMEOUT)
+	defer cancel()
+	report, err := libraryHealth(ctx, lib)
+	if err != nil {
+		log.Printf("Library health error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list library"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HLS_PLAYLIST        = "index.m3u8"
+	HLS_SEGMENT_SECONDS = 10
+	HLS_READY_TIMEOUT   = 20 * time.Second // wait for the first segment before giving up
+	HLS_MAX_DURATION    = 4 * time.Hour    // bound for one segmenting run
+	HLS_TTL             = time.Hour        // segment sets unused this long are removed
+)
+
+// HLS configuration: HLS_DIR holds segment sets (default <tmp>/go-music-hls),
+// HLS_TRANSCODE=false copies MP3/AAC audio into segments instead of encoding AAC
+var (
+	hlsDir       = os.Getenv("HLS_DIR")
+	hlsTranscode = os.Getenv("HLS_TRANSCODE") != "false"
+)
+
+// hlsJobs tracks segmenting runs in progress by output directory
+var hlsJobs = struct {
+	sync.Mutex
+	running map[string]chan struct{}
+}{running: make(map[string]chan struct{})}
+
+func initHLS() error {
+	if hlsDir == "" {
+		hlsDir = filepath.Join(os.TempDir(), "go-music-hls")
+	}
+	if err := os.MkdirAll(hlsDir, 0o755); err != nil {
+		return fmt.Errorf("invalid HLS_DIR: %w", err)
+	}
+	return nil
+}
+
+// hlsOutputDir names the segment set of one object version
+func hlsOutputDir(lib *library, key, etag string, trim *trimPoint) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%t", lib.Name, key, etag, hlsTranscode)
+	if trim != nil {
+		fmt.Fprintf(h, "\x00%g-%g", trim.Start, trim.End)
+	}
+	return filepath.Join(hlsDir, hex.EncodeToString(h.Sum(nil)))
+}
+
+// ensureHLS starts segmenting key into dir unless that is done or running, and
+// waits until the playlist lists a first segment
+func ensureHLS(ctx context.Context, dir, key string, trim *trimPoint) error {
+	playlist := filepath.Join(dir, HLS_PLAYLIST)
+	hlsJobs.Lock()
+	done, running := hlsJobs.running[dir]
+	if !running {
+		if _, err := os.Stat(playlist); err == nil {
+			hlsJobs.Unlock()
+			now := time.Now()
+			os.Chtimes(dir, now, now)
+			return nil
+		}
+		done = make(chan struct{})
+		hlsJobs.running[dir] = done
+		go segmentHLS(withLibrary(context.Background(), libraryFrom(ctx)), dir, key, trim, done)
+	}
+	hlsJobs.Unlock()
+
+	deadline := time.NewTimer(HLS_READY_TIMEOUT)
+	defer deadline.Stop()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if data, err := os.ReadFile(playlist); err == nil && strings.Contains(string(data), "#EXTINF") {
+			return nil
+		}
+		select {
+		case <-done:
+			if _, err := os.Stat(playlist); err != nil {
+				return fmt.Errorf("segmenting %s failed", key)
+			}
+			return nil
+		case <-deadline.C:
+			return fmt.Errorf("segmenting %s timed out", key)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// segmentHLS runs ffmpeg over the object and writes an event playlist that grows while
+// segments are produced, so playback can start before the whole file is processed
+func segmentHLS(ctx context.Context, dir, key string, trim *trimPoint, done chan struct{}) {
+	defer func() {
+		hlsJobs.Lock()
+		delete(hlsJobs.running, dir)
+		hlsJobs.Unlock()
+		close(done)
+	}()
+	ctx, cancel := context.WithTimeout(ctx, HLS_MAX_DURATION)
+	defer cancel()
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("HLS dir error: %v", err)
+		return
+	}
+	body, _, _, err := s3GetAudioFile(ctx, key)
+	if err != nil {
+		log.Printf("HLS source error for %s: %v", key, err)
+		os.RemoveAll(dir)
+		return
+	}
+	defer body.Close()
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn"}
+	if trim != nil {
+		args = append(args, "-ss", strconv.FormatFloat(trim.Start, 'f', 3, 64))
+		if trim.End > 0 {
+			args = append(args, "-t", strconv.FormatFloat(trim.End-trim.Start, 'f', 3, 64))
+		}
+	}
+	ext := strings.ToLower(path.Ext(key))
+	if hlsTranscode || (ext != ".mp3" && ext != ".aac" && ext != ".m4a") {
+		args = append(args, "-c:a", "aac", "-b:a", transcodeBitrate)
+	} else {
+		args = append(args, "-c:a", "copy")
+	}
+	args = append(args, "-f", "hls",
+		"-hls_time", strconv.Itoa(HLS_SEGMENT_SECONDS),
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"),
+		filepath.Join(dir, HLS_PLAYLIST))
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	cmd.Stdin = body
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		log.Printf("HLS segmenting of %s failed: %v %s", key, err, strings.TrimSpace(stderr.String()))
+		os.RemoveAll(dir)
+		return
+	}
+	log.Printf("HLS segmenting of %s finished in %s", key, time.Since(start).Round(time.Millisecond))
+}
+
+// sweepHLS removes segment sets nobody requested within HLS_TTL
+func sweepHLS(ctx context.Context) {
+	ticker := time.NewTicker(HLS_TTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			entries, err := os.ReadDir(hlsDir)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				dir := filepath.Join(hlsDir, e.Name())
+				info, err := e.Info()
+				hlsJobs.Lock()
+				_, running := hlsJobs.running[dir]
+				if err == nil && !running && time.Since(info.ModTime()) > HLS_TTL {
+					os.RemoveAll(dir)
+				}
+				hlsJobs.Unlock()
+			}
+		}
+	}
+}
+
+// handleHLS serves /hls/<track>/index.m3u8 and the segments it lists
+func handleHLS(c *gin.Context) {
+	p := strings.TrimPrefix(c.Param("path"), "/")
+	key, file := path.Split(p)
+	key = strings.TrimSuffix(key, "/")
+	if key == "" || (file != HLS_PLAYLIST && !(strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".ts"))) {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	if !isAudioFile(key) || !isListed(key, false) {
+		// Kiosk guests, trashed and ignored tracks get no playlist and no segments
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	if ffmpegPath == "" {
+		c.String(http.StatusNotImplemented, "HLS needs ffmpeg")
+		return
+	}
+	if streamPolicy(key) == STREAM_BLOCK {
+		c.String(http.StatusForbidden, "Format not allowed")
+		return
+	}
+	ctx := c.Request.Context()
+	if !folderVisible(ctx, key, false) {
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	lib := libraryFrom(ctx)
+	etag, _, _, err := s3HeadAudioFile(ctx, key)
+	if err != nil {
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	var trim *trimPoint
+	if t, ok := trims.get(lib, key); ok {
+		trim = &t
+	}
+	dir := hlsOutputDir(lib, key, etag, trim)
+	if file == HLS_PLAYLIST {
+		if err := ensureHLS(ctx, dir, key, trim); err != nil {
+			log.Printf("HLS error: %v", err)
+			c.String(http.StatusServiceUnavailable, "Stream not ready")
+			return
+		}
+		data, err := os.ReadFile(filepath.Join(dir, HLS_PLAYLIST))
+		if err != nil {
+			c.String(http.StatusServiceUnavailable, "Stream not ready")
+			return
+		}
+		if lib != defaultLibrary() {
+			// Segment URIs are relative and would lose the library otherwise
+			lines := strings.Split(string(data), "\n")
+			for i, line := range lines {
+				if line != "" && !strings.HasPrefix(line, "#") {
+					lines[i] = line + "?lib=" + url.QueryEscape(lib.Name)
+				}
+			}
+			data = []byte(strings.Join(lines, "\n"))
+		}
+		// The playlist grows while segmenting runs
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+		return
+	}
+	c.Header("Content-Type", "video/mp2t")
+	c.File(filepath.Join(dir, file))
+}
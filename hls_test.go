@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestHLSKioskPrefixes checks that kiosk guests get no playlist or segments for tracks
+// outside KIOSK_PREFIXES, or for trashed tracks
+func TestHLSKioskPrefixes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(mode bool, prefixes []string, trash, ffmpeg string) {
+		kioskMode, kioskPrefixes, trashPrefix, ffmpegPath = mode, prefixes, trash, ffmpeg
+	}(kioskMode, kioskPrefixes, trashPrefix, ffmpegPath)
+	kioskMode, kioskPrefixes, trashPrefix = true, []string{"Party/"}, ".trash"
+	ffmpegPath = "" // listed tracks stop at the ffmpeg check, before any S3 call
+
+	r := gin.New()
+	r.GET("/hls/*path", handleHLS)
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{"kiosk playlist", "/hls/Party/a.mp3/index.m3u8", http.StatusNotImplemented},
+		{"other playlist", "/hls/Private/a.mp3/index.m3u8", http.StatusNotFound},
+		{"other segment", "/hls/Private/a.mp3/seg00001.ts", http.StatusNotFound},
+		{"trashed playlist", "/hls/.trash/Party/a.mp3/index.m3u8", http.StatusNotFound},
+		{"not audio", "/hls/Party/cover.jpg/index.m3u8", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != tt.want {
+				t.Errorf("GET %s: status %d, want %d", tt.url, w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	USER_HOMES_DIR   = "users/" // under S3_PREFIX, one folder per user
+	HOME_LIBRARY     = "home"   // lib= name of the requesting user's home
+	HOME_NAME_PREFIX = "~"      // home libraries are named ~<user>
+	HOME_COOKIE      = "gm_key" // API key of a signed-in browser, HttpOnly
+	HOME_COOKIE_AGE  = 30 * 24 * time.Hour
+)
+
+// USER_HOMES=on roots every user at S3_PREFIX/users/<name>/: browse, search and streaming
+// only see that folder, plus the libraries named in USER_HOMES_SHARED. Users are
+// authenticated by API key, sent as a bearer token or, for the browser UI, signed in at
+// /login into an HttpOnly cookie; requests without one are refused.
+var (
+	userHomes       = os.Getenv("USER_HOMES") == "on"
+	userHomesShared = map[string]bool{}
+	homeLibraries   = struct {
+		sync.Mutex
+		byUser map[string]*library
+	}{byUser: make(map[string]*library)}
+)
+
+func initUserHomes() error {
+	switch v := os.Getenv("USER_HOMES"); v {
+	case "", "off", "on":
+	default:
+		return fmt.Errorf("invalid USER_HOMES: %q, expected on or off", v)
+	}
+	for _, name := range splitList(os.Getenv("USER_HOMES_SHARED")) {
+		lib := findLibrary(name)
+		if lib == nil {
+			return fmt.Errorf("USER_HOMES_SHARED: unknown library %q", name)
+		}
+		// A library above the homes would list every user's files
+		if lib.Bucket == s3Bucket && strings.HasPrefix(s3Prefix+USER_HOMES_DIR, lib.Prefix) {
+			return fmt.Errorf("USER_HOMES_SHARED: library %q contains the user homes", name)
+		}
+		userHomesShared[name] = true
+	}
+	return nil
+}
+
+// homeLibrary returns the library rooted at the home folder of user
+func homeLibrary(user string) *library {
+	homeLibraries.Lock()
+	defer homeLibraries.Unlock()
+	lib, ok := homeLibraries.byUser[user]
+	if !ok {
+		lib = &library{Name: HOME_NAME_PREFIX + user, Bucket: s3Bucket, Prefix: s3Prefix + USER_HOMES_DIR + user + "/"}
+		homeLibraries.byUser[user] = lib
+	}
+	return lib
+}
+
+// validHomeUser reports whether user can name a home folder; the name becomes a path
+// segment, so it must not climb out of the homes
+func validHomeUser(user string) bool {
+	return user != "" && user != "." && user != ".." && !strings.ContainsAny(user, "/\\")
+}
+
+// homeUser returns the user of the request's API key, from the Authorization header or
+// the sign-in cookie. Routes without the APIKey middleware authenticate the key here.
+func homeUser(c *gin.Context) (string, bool) {
+	if k, ok := c.Get(API_KEY_CONTEXT); ok {
+		return k.(*apiKey).User, true
+	}
+	token := bearerToken(c)
+	if !strings.HasPrefix(token, API_KEY_PREFIX) {
+		token, _ = c.Cookie(HOME_COOKIE)
+	}
+	k := apiKeys.authenticate(token)
+	if k == nil {
+		return "", false
+	}
+	c.Set(API_KEY_CONTEXT, k)
+	return k.User, true
+}
+
+// RequireHomeUser middleware refuses requests without an API key user in USER_HOMES
+// mode, where per-user routes must not trust ?user= or the user cookie, and guests
+func RequireHomeUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, signedIn := homeUser(c)
+		if (userHomes && !signedIn) || isGuest(c) {
+			challengeBasic(c)
+			c.String(http.StatusUnauthorized, "API key required")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// tenantVisible reports whether an event may be shown to user: in USER_HOMES mode,
+// events naming another user or another user's home are left out
+func tenantVisible(user string, data map[string]interface{}) bool {
+	if !userHomes {
+		return true
+	}
+	if u, ok := data["user"].(string); ok && u != user {
+		return false
+	}
+	if lib, ok := data["library"].(string); ok && strings.HasPrefix(lib, HOME_NAME_PREFIX) && lib != HOME_NAME_PREFIX+user {
+		return false
+	}
+	return true
+}
+
+// homeLibraryList returns the home library of every user folder under USER_HOMES_DIR
+func homeLibraryList(ctx context.Context) ([]*library, error) {
+	root := &library{Name: HOME_NAME_PREFIX, Bucket: s3Bucket, Prefix: s3Prefix + USER_HOMES_DIR}
+	users, _, err := s3List(withLibrary(ctx, root), "", "/")
+	if err != nil {
+		return nil, err
+	}
+	out := []*library{}
+	for _, user := range users {
+		if validHomeUser(user) {
+			out = append(out, homeLibrary(user))
+		}
+	}
+	return out, nil
+}
+
+// handleLogin signs a browser in with an API key of full user or admin scope, posted as
+// the form field key (POST /login). The key is kept in an HttpOnly cookie, so the player
+// page, its data frame and audio elements carry it without script access.
+func handleLogin(c *gin.Context) {
+	token := strings.TrimSpace(c.PostForm("key"))
+	k := apiKeys.authenticate(token)
+	if k == nil || (k.Scope != "" && k.Scope != SCOPE_ADMIN) {
+		audit.record(c, "login.failed", "", "", "")
+		c.Redirect(http.StatusSeeOther, basePath+"/login?failed=1")
+		return
+	}
+	signIn(c, token, HOME_COOKIE_AGE)
+	audit.record(c, "login", "", k.User, "")
+	c.Redirect(http.StatusSeeOther, basePath+"/")
+}
+
+// signIn keeps an API key or single sign-on token in the sign-in cookie for age
+func signIn(c *gin.Context, token string, age time.Duration) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name: HOME_COOKIE, Value: token, Path: basePath + "/", MaxAge: int(age.Seconds()),
+		HttpOnly: true, Secure: secureRequest(c), SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// secureRequest reports whether the browser reached the server over https
+func secureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// handleLogout removes the sign-in cookie (POST /logout)
+func handleLogout(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{Name: HOME_COOKIE, Path: basePath + "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	c.Redirect(http.StatusSeeOther, basePath+"/login")
+}
+
+// tenantLibrary resolves a library name for a user in USER_HOMES mode: their home by
+// default, or a shared library. It answers the error itself.
+func tenantLibrary(c *gin.Context, name string) (*library, bool) {
+	user, ok := homeUser(c)
+	if !ok {
+		challengeBasic(c)
+		c.String(http.StatusUnauthorized, "API key required")
+		return nil, false
+	}
+	if !validHomeUser(user) {
+		c.String(http.StatusForbidden, "User has no home folder")
+		return nil, false
+	}
+	home := homeLibrary(user)
+	switch {
+	case name == "" || name == HOME_LIBRARY || name == home.Name:
+		return home, true
+	case userHomesShared[name]:
+		return findLibrary(name), true
+	}
+	c.String(http.StatusNotFound, "Unknown library")
+	return nil, false
+}
+
+// tenantLibraryNames lists what a user can open: their home first, then shared libraries
+func tenantLibraryNames(c *gin.Context) []string {
+	names := []string{}
+	if user, ok := homeUser(c); ok {
+		names = append(names, homeLibrary(user).Name)
+	}
+	for _, lib := range libraries {
+		if userHomesShared[lib.Name] {
+			names = append(names, lib.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strconv"
+	"unicode/utf16"
+)
+
+const MAX_ID3_TAG = 1 << 20 // frames beyond this (e.g. after large cover art) are not read
+
+// id3Text decodes an ID3v2 text field in the given encoding
+func id3Text(enc byte, b []byte) string {
+	switch enc {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		order := binary.ByteOrder(binary.BigEndian)
+		if len(b) >= 2 && enc == 1 {
+			if b[0] == 0xFF && b[1] == 0xFE {
+				order = binary.LittleEndian
+			}
+			if (b[0] == 0xFF && b[1] == 0xFE) || (b[0] == 0xFE && b[1] == 0xFF) {
+				b = b[2:]
+			}
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	case 3:
+		return string(b)
+	}
+	r := make([]rune, len(b)) // ISO-8859-1
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// id3Cut splits b at the first string terminator of the encoding
+func id3Cut(enc byte, b []byte) ([]byte, []byte) {
+	if enc == 1 || enc == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+// id3Frames returns the body of the first frame with each of the given IDs from an
+// ID3v2.3/2.4 tag
+func id3Frames(tag []byte, ids ...string) map[string][]byte {
+	out := make(map[string][]byte)
+	for id, frames := range id3AllFrames(tag, ids...) {
+		out[id] = frames[0]
+	}
+	return out
+}
+
+// id3AllFrames returns the bodies of all frames with the given IDs, in tag order
+func id3AllFrames(tag []byte, ids ...string) map[string][][]byte {
+	out := make(map[string][][]byte)
+	if len(tag) < 10 || string(tag[:3]) != "ID3" || tag[3] < 3 || tag[3] > 4 {
+		return out
+	}
+	version, flags := tag[3], tag[5]
+	size := int(tag[6]&0x7f)<<21 | int(tag[7]&0x7f)<<14 | int(tag[8]&0x7f)<<7 | int(tag[9]&0x7f)
+	body := tag[10:min(len(tag), 10+size)]
+	if flags&0x80 != 0 && version == 3 {
+		body = bytes.ReplaceAll(body, []byte{0xFF, 0x00}, []byte{0xFF})
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		ext := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			ext = int(body[0]&0x7f)<<21 | int(body[1]&0x7f)<<14 | int(body[2]&0x7f)<<7 | int(body[3]&0x7f)
+		} else {
+			ext += 4
+		}
+		if ext > len(body) {
+			return out
+		}
+		body = body[ext:]
+	}
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		n := int(binary.BigEndian.Uint32(body[4:]))
+		if version == 4 {
+			n = int(body[4]&0x7f)<<21 | int(body[5]&0x7f)<<14 | int(body[6]&0x7f)<<7 | int(body[7]&0x7f)
+		}
+		if n < 0 || 10+n > len(body) {
+			break
+		}
+		for _, want := range ids {
+			if id == want {
+				out[id] = append(out[id], body[10:10+n])
+			}
+		}
+		body = body[10+n:]
+	}
+	return out
+}
+
+// readID3Tag fetches the ID3v2 tag at the start of an object, up to MAX_ID3_TAG bytes
+func readID3Tag(ctx context.Context, key string) ([]byte, error) {
+	hdr, err := s3GetRange(ctx, key, "bytes=0-9")
+	if err != nil || len(hdr) < 10 || string(hdr[:3]) != "ID3" {
+		return nil, err
+	}
+	size := int(hdr[6]&0x7f)<<21 | int(hdr[7]&0x7f)<<14 | int(hdr[8]&0x7f)<<7 | int(hdr[9]&0x7f)
+	return s3GetRange(ctx, key, "bytes=0-"+strconv.Itoa(min(10+size, MAX_ID3_TAG)-1))
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MUSICBRAINZ_URL      = "https://musicbrainz.org/ws/2/recording/"
+	COVER_ART_URL        = "https://coverartarchive.org/release/"
+	COVER_ART_SIZE       = "front-500"
+	MUSICBRAINZ_INTERVAL = 1100 * time.Millisecond // MusicBrainz allows one request per second
+	MUSICBRAINZ_TIMEOUT  = 15 * time.Second
+)
+
+// MUSICBRAINZ_ENRICH=true completes identified recordings with the year of their first
+// release, that release and its front cover on the Cover Art Archive. It needs a
+// MusicBrainz recording ID, from AcoustID or from a manual correction.
+var metadataEnricher *musicBrainz
+
+func initEnrichment() error {
+	switch v := os.Getenv("MUSICBRAINZ_ENRICH"); v {
+	case "", "false":
+	case "true":
+		metadataEnricher = &musicBrainz{client: &http.Client{Timeout: MUSICBRAINZ_TIMEOUT}}
+	default:
+		return fmt.Errorf("invalid MUSICBRAINZ_ENRICH: %q", v)
+	}
+	return nil
+}
+
+// musicBrainz looks recordings up on the MusicBrainz web service
+type musicBrainz struct {
+	client *http.Client
+	mu     sync.Mutex
+	next   time.Time // earliest time of the next request
+}
+
+// wait spaces requests MUSICBRAINZ_INTERVAL apart
+func (mb *musicBrainz) wait(ctx context.Context) error {
+	mb.mu.Lock()
+	wait := time.Until(mb.next)
+	mb.next = time.Now().Add(max(wait, 0) + MUSICBRAINZ_INTERVAL)
+	mb.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// enrich fills the year, release and cover of m from its recording, and the title and
+// album where m has none. A recording MusicBrainz doesn't know counts as enriched.
+func (mb *musicBrainz) enrich(ctx context.Context, m *trackMatch) error {
+	if err := mb.wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, MUSICBRAINZ_URL+url.PathEscape(m.RecordingID)+"?inc=releases&fmt=json", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "go-music/"+version)
+	req.Header.Set("Accept", "application/json")
+	resp, err := mb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+		m.Enriched = true
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("musicbrainz: %s", resp.Status)
+	}
+	var rec struct {
+		Title            string `json:"title"`
+		FirstReleaseDate string `json:"first-release-date"`
+		Releases         []struct {
+			ID     string `json:"id"`
+			Title  string `json:"title"`
+			Date   string `json:"date"`
+			Status string `json:"status"`
+		} `json:"releases"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&rec); err != nil {
+		return fmt.Errorf("musicbrainz: %w", err)
+	}
+	if m.Title == "" {
+		m.Title = rec.Title
+	}
+	if y := releaseYear(rec.FirstReleaseDate); m.Year == 0 && y > 0 {
+		m.Year = y
+	}
+	// The earliest official release, the one the first release date most likely refers to
+	best := -1
+	for i, r := range rec.Releases {
+		if best < 0 || (r.Status == "Official" && rec.Releases[best].Status != "Official") ||
+			(r.Status == rec.Releases[best].Status && r.Date != "" && (rec.Releases[best].Date == "" || r.Date < rec.Releases[best].Date)) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		r := rec.Releases[best]
+		m.ReleaseID = r.ID
+		if m.Album == "" {
+			m.Album = r.Title
+		}
+		if cover := COVER_ART_URL + url.PathEscape(r.ID) + "/" + COVER_ART_SIZE; mb.hasCover(ctx, cover) {
+			m.Cover = cover
+		}
+	}
+	m.Enriched = true
+	return nil
+}
+
+// hasCover reports whether the Cover Art Archive serves an image at u
+func (mb *musicBrainz) hasCover(ctx context.Context, u string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", "go-music/"+version)
+	resp, err := mb.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// releaseYear returns the year of a MusicBrainz date (YYYY, YYYY-MM or YYYY-MM-DD)
+func releaseYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	y, _ := strconv.Atoi(date[:4])
+	return y
+}
+
+// needsEnrich reports whether an identified entry is still to be completed
+func (e fingerprintEntry) needsEnrich() bool {
+	return metadataEnricher != nil && e.Match != nil && e.Match.RecordingID != "" && !e.Match.Enriched
+}
+
+// enrich completes the identified tracks of lib that weren't enriched yet
+func (fi *fingerprintIndex) enrich(ctx context.Context, lib *library) (enriched int) {
+	fi.mu.RLock()
+	var keys []string
+	for key, e := range fi.libraries[lib.Name] {
+		if e.needsEnrich() {
+			keys = append(keys, key)
+		}
+	}
+	fi.mu.RUnlock()
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		fi.mu.RLock()
+		e, ok := fi.libraries[lib.Name][key]
+		fi.mu.RUnlock()
+		if !ok || !e.needsEnrich() {
+			continue
+		}
+		m := *e.Match
+		if err := metadataEnricher.enrich(ctx, &m); err != nil {
+			log.Printf("Enriching %s failed: %v", key, err)
+			continue
+		}
+		fi.mu.Lock()
+		if cur, ok := fi.libraries[lib.Name][key]; ok && cur.ETag == e.ETag {
+			cur.Match = &m
+			fi.libraries[lib.Name][key] = cur
+			enriched++
+		}
+		fi.mu.Unlock()
+	}
+	return enriched
+}
+
+// match returns what key was identified or corrected as, nil when nothing is known
+func (fi *fingerprintIndex) match(lib *library, key string) *trackMatch {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	if e, ok := fi.libraries[lib.Name][key]; ok && e.Match != nil {
+		m := *e.Match
+		return &m
+	}
+	return nil
+}
+
+// setEntry stores the entry of one track and saves the index
+func (fi *fingerprintIndex) setEntry(ctx context.Context, lib *library, key string, e fingerprintEntry) error {
+	fi.mu.Lock()
+	if fi.libraries[lib.Name] == nil {
+		fi.libraries[lib.Name] = make(map[string]fingerprintEntry)
+	}
+	fi.libraries[lib.Name][key] = e
+	fi.mu.Unlock()
+	return fi.save(ctx)
+}
+
+// --- IDENTIFY HANDLERS ---
+
+// identifyRequest resolves the library and track of an identify request and returns the
+// current ETag of the track; it answers failures itself
+func identifyRequest(c *gin.Context) (*library, string, string, bool) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return nil, "", "", false
+	}
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	if !isAudioFile(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown track"})
+		return nil, "", "", false
+	}
+	etag, _, _, err := s3HeadAudioFile(withLibrary(c.Request.Context(), lib), key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown track"})
+		return nil, "", "", false
+	}
+	return lib, key, normalizeETag(etag), true
+}
+
+// handleIdentifyTrack fingerprints one track now and looks it up on AcoustID, replacing
+// a manual correction (POST /admin/identify/*path?library=)
+func handleIdentifyTrack(c *gin.Context) {
+	if fpcalcPath == "" || trackLookup == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "identifying needs fpcalc and ACOUSTID_API_KEY"})
+		return
+	}
+	lib, key, etag, ok := identifyRequest(c)
+	if !ok {
+		return
+	}
+	ctx := withLibrary(c.Request.Context(), lib)
+	fp, err := computeFingerprint(ctx, key, true)
+	if err != nil {
+		log.Printf("Fingerprint of %s failed: %v", key, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "fingerprinting failed"})
+		return
+	}
+	match, err := trackLookup.identify(ctx, fp)
+	if err != nil {
+		log.Printf("Identifying %s failed: %v", key, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "lookup failed"})
+		return
+	}
+	if match != nil && metadataEnricher != nil && match.RecordingID != "" {
+		if err := metadataEnricher.enrich(ctx, match); err != nil {
+			log.Printf("Enriching %s failed: %v", key, err)
+		}
+	}
+	e := fingerprintEntry{ETag: etag, Duration: int(fp.Duration), Prefix: encodeRaw(fp.Raw), Tagged: isTagged(ctx, key), LookedUp: true, Match: match}
+	if err := fingerprints.setEntry(ctx, lib, key, e); err != nil {
+		log.Printf("Fingerprint save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save fingerprints"})
+		return
+	}
+	audit.record(c, "track.identify", lib.Name, key, "")
+	c.JSON(http.StatusOK, gin.H{"key": key, "match": match})
+}
+
+// handleCorrectTrack sets what a track is by hand (PUT /admin/identify/*path?library=).
+// The body is {"title","artist","album","year","recordingId"}; with a recording ID and
+// MUSICBRAINZ_ENRICH the fields left empty are filled from MusicBrainz. Scans keep a
+// correction even when the file changes.
+func handleCorrectTrack(c *gin.Context) {
+	var req struct {
+		Title       string `json:"title"`
+		Artist      string `json:"artist"`
+		Album       string `json:"album"`
+		Year        int    `json:"year"`
+		RecordingID string `json:"recordingId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (strings.TrimSpace(req.Title) == "" && req.RecordingID == "") || req.Year < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title or recordingId required"})
+		return
+	}
+	lib, key, etag, ok := identifyRequest(c)
+	if !ok {
+		return
+	}
+	ctx := withLibrary(c.Request.Context(), lib)
+	m := &trackMatch{Title: strings.TrimSpace(req.Title), Artist: strings.TrimSpace(req.Artist), Album: strings.TrimSpace(req.Album),
+		Year: req.Year, RecordingID: req.RecordingID, Manual: true}
+	if metadataEnricher != nil && m.RecordingID != "" {
+		if err := metadataEnricher.enrich(ctx, m); err != nil {
+			log.Printf("Enriching %s failed: %v", key, err)
+		}
+	}
+	fingerprints.mu.RLock()
+	e, found := fingerprints.libraries[lib.Name][key]
+	fingerprints.mu.RUnlock()
+	if !found || e.ETag != etag {
+		e = fingerprintEntry{ETag: etag}
+	}
+	e.LookedUp, e.Match = true, m
+	if err := fingerprints.setEntry(ctx, lib, key, e); err != nil {
+		log.Printf("Fingerprint save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save fingerprints"})
+		return
+	}
+	audit.record(c, "track.correct", lib.Name, key, m.Artist+" - "+m.Title)
+	c.JSON(http.StatusOK, gin.H{"key": key, "match": m})
+}
+
+// handleDeleteCorrection drops the manual correction of a track, so the next scan looks
+// it up again (DELETE /admin/identify/*path?library=)
+func handleDeleteCorrection(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	fingerprints.mu.Lock()
+	e, ok := fingerprints.libraries[lib.Name][key]
+	if ok && e.Match != nil && e.Match.Manual {
+		e.Match, e.LookedUp = nil, false
+		fingerprints.libraries[lib.Name][key] = e
+	} else {
+		ok = false
+	}
+	fingerprints.mu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no correction for track"})
+		return
+	}
+	if err := fingerprints.save(c.Request.Context()); err != nil {
+		log.Printf("Fingerprint save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save fingerprints"})
+		return
+	}
+	audit.record(c, "track.uncorrect", lib.Name, key, "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
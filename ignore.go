@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// DEFAULT_IGNORE_PATTERNS covers junk commonly synced along with music:
+// dotfiles (.DS_Store, ._ resource forks), NAS thumbnail and recycle folders
+// and Windows shell files
+const DEFAULT_IGNORE_PATTERNS = ".*,@eaDir,#recycle,#snapshot,__MACOSX,$RECYCLE.BIN,System Volume Information,Thumbs.db,desktop.ini"
+
+// IGNORE_PATTERNS is a comma separated list of globs matched against each
+// path component; set it empty to list everything
+var ignorePatterns []string
+
+func initIgnorePatterns() error {
+	v, ok := os.LookupEnv("IGNORE_PATTERNS")
+	if !ok {
+		v = DEFAULT_IGNORE_PATTERNS
+	}
+	ignorePatterns = nil
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid IGNORE_PATTERNS entry %q: %w", p, err)
+		}
+		ignorePatterns = append(ignorePatterns, p)
+	}
+	return nil
+}
+
+// isIgnored reports whether any component of a library-relative path matches an ignore pattern
+func isIgnored(name string) bool {
+	if len(ignorePatterns) == 0 {
+		return false
+	}
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		for _, p := range ignorePatterns {
+			if ok, _ := path.Match(p, part); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
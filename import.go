@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IMPORT_SUBSONIC         = "subsonic"
+	IMPORT_GO_MUSIC         = "go-music"
+	IMPORT_TIMEOUT          = 10 * time.Minute
+	IMPORT_REQUEST_TIMEOUT  = time.Minute
+	IMPORT_MAX_RESPONSE     = 64 << 20
+	IMPORT_SONG_PAGE        = 500    // songs per Subsonic search3 call
+	IMPORT_MAX_SONGS        = 500000 // songs read for ratings at most
+	IMPORT_STARRED_PLAYLIST = "Starred"
+	SUBSONIC_API_VERSION    = "1.16.1"
+)
+
+// importTrack is a track as the other server describes it
+type importTrack struct {
+	Path   string `json:"path"`
+	Artist string `json:"artist,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Rating int    `json:"rating,omitempty"`
+}
+
+// entry describes the track the way playlist lines do, for the track matcher
+func (t importTrack) entry() playlistEntry {
+	e := playlistEntry{Entry: t.Path, Title: t.Title}
+	if t.Artist != "" && t.Title != "" {
+		e.Title = t.Artist + PLAYLIST_ARTIST_SEP + t.Title
+	}
+	return e
+}
+
+type importPlaylist struct {
+	Name   string
+	Tracks []importTrack
+}
+
+// importSource reads the user data of another server. Subsonic-compatible servers and
+// go-music are built in.
+type importSource interface {
+	playlists(ctx context.Context) ([]importPlaylist, error)
+	starred(ctx context.Context) ([]importTrack, error) // nil when the server has no favorites
+	ratings(ctx context.Context) ([]importTrack, error)
+}
+
+// subsonic reads from the REST API of a Subsonic-compatible server (Navidrome, Airsonic,
+// Gonic, ...) with token authentication
+type subsonic struct {
+	base     string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// call runs a REST method and decodes its "subsonic-response" into v
+func (s *subsonic) call(ctx context.Context, method string, params url.Values, v interface{}) error {
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	token := md5.Sum([]byte(s.password + hex.EncodeToString(salt)))
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("u", s.user)
+	params.Set("t", hex.EncodeToString(token[:]))
+	params.Set("s", hex.EncodeToString(salt))
+	params.Set("v", SUBSONIC_API_VERSION)
+	params.Set("c", "go-music")
+	params.Set("f", "json")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/rest/"+method+".view?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "go-music/"+version)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("subsonic %s: %w", method, requestError(err))
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Response json.RawMessage `json:"subsonic-response"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, IMPORT_MAX_RESPONSE)).Decode(&res); err != nil || res.Response == nil {
+		return fmt.Errorf("subsonic %s: %s: not a Subsonic response", method, resp.Status)
+	}
+	var status struct {
+		Status string `json:"status"`
+		Error  struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(res.Response, &status); err != nil {
+		return err
+	}
+	if status.Status != "ok" {
+		return fmt.Errorf("subsonic %s: %s (code %d)", method, status.Error.Message, status.Error.Code)
+	}
+	return json.Unmarshal(res.Response, v)
+}
+
+// requestError drops the URL from a client error; Subsonic URLs carry the password token
+func requestError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Err
+	}
+	return err
+}
+
+// subsonicSong is the part of a Subsonic child element the import uses
+type subsonicSong struct {
+	Path       string `json:"path"`
+	Artist     string `json:"artist"`
+	Title      string `json:"title"`
+	UserRating int    `json:"userRating"`
+}
+
+func (song subsonicSong) track() importTrack {
+	return importTrack{Path: song.Path, Artist: song.Artist, Title: song.Title, Rating: song.UserRating}
+}
+
+func subsonicTracks(songs []subsonicSong) []importTrack {
+	tracks := make([]importTrack, len(songs))
+	for i, song := range songs {
+		tracks[i] = song.track()
+	}
+	return tracks
+}
+
+func (s *subsonic) playlists(ctx context.Context) ([]importPlaylist, error) {
+	var list struct {
+		Playlists struct {
+			Playlist []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"playlist"`
+		} `json:"playlists"`
+	}
+	if err := s.call(ctx, "getPlaylists", nil, &list); err != nil {
+		return nil, err
+	}
+	var out []importPlaylist
+	for _, p := range list.Playlists.Playlist {
+		var res struct {
+			Playlist struct {
+				Entry []subsonicSong `json:"entry"`
+			} `json:"playlist"`
+		}
+		if err := s.call(ctx, "getPlaylist", url.Values{"id": {p.ID}}, &res); err != nil {
+			return nil, err
+		}
+		out = append(out, importPlaylist{Name: p.Name, Tracks: subsonicTracks(res.Playlist.Entry)})
+	}
+	return out, nil
+}
+
+func (s *subsonic) starred(ctx context.Context) ([]importTrack, error) {
+	var res struct {
+		Starred struct {
+			Song []subsonicSong `json:"song"`
+		} `json:"starred2"`
+	}
+	if err := s.call(ctx, "getStarred2", nil, &res); err != nil {
+		return nil, err
+	}
+	return subsonicTracks(res.Starred.Song), nil
+}
+
+// ratings pages through every song with an empty search3 query, which Subsonic
+// servers answer with the whole library, and keeps the rated ones
+func (s *subsonic) ratings(ctx context.Context) ([]importTrack, error) {
+	var rated []importTrack
+	for offset := 0; offset < IMPORT_MAX_SONGS; offset += IMPORT_SONG_PAGE {
+		var res struct {
+			Result struct {
+				Song []subsonicSong `json:"song"`
+			} `json:"searchResult3"`
+		}
+		params := url.Values{"query": {""}, "artistCount": {"0"}, "albumCount": {"0"},
+			"songCount": {strconv.Itoa(IMPORT_SONG_PAGE)}, "songOffset": {strconv.Itoa(offset)}}
+		if err := s.call(ctx, "search3", params, &res); err != nil {
+			return nil, err
+		}
+		for _, song := range res.Result.Song {
+			if song.UserRating > 0 {
+				rated = append(rated, song.track())
+			}
+		}
+		if len(res.Result.Song) < IMPORT_SONG_PAGE {
+			break
+		}
+	}
+	return rated, nil
+}
+
+// goMusicSource reads the playlists and ratings of an API key's user on another
+// go-music server
+type goMusicSource struct {
+	base    string
+	key     string
+	library string
+	client  *http.Client
+}
+
+func (g *goMusicSource) get(ctx context.Context, p string, v interface{}) error {
+	u := g.base + p
+	if g.library != "" {
+		u += "?lib=" + url.QueryEscape(g.library)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.key)
+	req.Header.Set("User-Agent", "go-music/"+version)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("go-music %s: %w", p, requestError(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("go-music %s: %s", p, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, IMPORT_MAX_RESPONSE)).Decode(v)
+}
+
+func (g *goMusicSource) playlists(ctx context.Context) ([]importPlaylist, error) {
+	var list struct {
+		Playlists []struct {
+			Name string `json:"name"`
+		} `json:"playlists"`
+	}
+	if err := g.get(ctx, "/api/v1/playlists", &list); err != nil {
+		return nil, err
+	}
+	var out []importPlaylist
+	for _, p := range list.Playlists {
+		var res struct {
+			Tracks []struct {
+				Key string `json:"key"`
+			} `json:"tracks"`
+		}
+		if err := g.get(ctx, "/api/v1/playlists/"+url.PathEscape(p.Name), &res); err != nil {
+			return nil, err
+		}
+		pl := importPlaylist{Name: p.Name}
+		for _, t := range res.Tracks {
+			pl.Tracks = append(pl.Tracks, importTrack{Path: t.Key})
+		}
+		out = append(out, pl)
+	}
+	return out, nil
+}
+
+func (g *goMusicSource) starred(ctx context.Context) ([]importTrack, error) {
+	return nil, nil
+}
+
+func (g *goMusicSource) ratings(ctx context.Context) ([]importTrack, error) {
+	var res struct {
+		Ratings map[string]int `json:"ratings"`
+	}
+	if err := g.get(ctx, "/api/v1/ratings", &res); err != nil {
+		return nil, err
+	}
+	var rated []importTrack
+	for key, stars := range res.Ratings {
+		rated = append(rated, importTrack{Path: key, Rating: stars})
+	}
+	return rated, nil
+}
+
+// importRequest is the body of POST /admin/import
+type importRequest struct {
+	Source   string `json:"source"` // subsonic or go-music
+	URL      string `json:"url"`
+	Username string `json:"username"` // Subsonic
+	Password string `json:"password"` // Subsonic
+	APIKey   string `json:"apiKey"`   // go-music
+	Library  string `json:"library"`  // go-music: library on the other server
+	User     string `json:"user"`     // local user; the Subsonic username by default
+	DryRun   bool   `json:"dryRun"`
+}
+
+func (r importRequest) source() (importSource, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("url must be an http or https URL")
+	}
+	base := strings.TrimRight(r.URL, "/")
+	client := &http.Client{Timeout: IMPORT_REQUEST_TIMEOUT}
+	switch r.Source {
+	case IMPORT_SUBSONIC:
+		if r.Username == "" {
+			return nil, errors.New("username required")
+		}
+		return &subsonic{base: base, user: r.Username, password: r.Password, client: client}, nil
+	case IMPORT_GO_MUSIC:
+		if r.APIKey == "" {
+			return nil, errors.New("apiKey required")
+		}
+		return &goMusicSource{base: base, key: r.APIKey, library: r.Library, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown source %q, expected %s or %s", r.Source, IMPORT_SUBSONIC, IMPORT_GO_MUSIC)
+}
+
+// importResult reports what an import matched, per playlist and for the ratings
+type importResult struct {
+	Playlists []importedList `json:"playlists"`
+	Ratings   importedList   `json:"ratings"`
+}
+
+type importedList struct {
+	Name      string        `json:"name,omitempty"`
+	Entries   int           `json:"entries"`
+	Matched   int           `json:"matched"`
+	Unmatched []importTrack `json:"unmatched"`
+}
+
+// mapTracks finds the local key of every track, leaving out the ones that match nothing
+func mapTracks(m *trackMatcher, tracks []importTrack) (keys []string, matched []importTrack, report importedList) {
+	report = importedList{Entries: len(tracks), Unmatched: []importTrack{}}
+	for _, t := range tracks {
+		if key, _ := m.match(t.entry()); key != "" {
+			keys = append(keys, key)
+			matched = append(matched, t)
+		} else {
+			report.Unmatched = append(report.Unmatched, t)
+		}
+	}
+	report.Matched = len(keys)
+	return keys, matched, report
+}
+
+// runImport reads the playlists, favorites and ratings of src and stores the ones that
+// match tracks of lib for user. Favorites become the playlist IMPORT_STARRED_PLAYLIST.
+func runImport(ctx context.Context, src importSource, lib *library, user string, dryRun bool) (importResult, error) {
+	res := importResult{Playlists: []importedList{}}
+	lists, err := src.playlists(ctx)
+	if err != nil {
+		return res, err
+	}
+	starred, err := src.starred(ctx)
+	if err != nil {
+		return res, err
+	}
+	if len(starred) > 0 {
+		lists = append(lists, importPlaylist{Name: IMPORT_STARRED_PLAYLIST, Tracks: starred})
+	}
+	rated, err := src.ratings(ctx)
+	if err != nil {
+		return res, err
+	}
+	keys, err := s3ListAllTracks(ctx, "")
+	if err != nil {
+		return res, err
+	}
+	var listed []string
+	for _, k := range keys {
+		if !isMetaDir(k) && streamPolicy(k) != STREAM_BLOCK {
+			listed = append(listed, k)
+		}
+	}
+	matcher := newTrackMatcher(listed)
+	for _, pl := range lists {
+		tracks, _, report := mapTracks(matcher, pl.Tracks)
+		name := strings.TrimSpace(pl.Name)
+		if len(name) > MAX_PLAYLIST_NAME {
+			name = name[:MAX_PLAYLIST_NAME]
+		}
+		if len(tracks) > MAX_PLAYLIST_TRACKS {
+			tracks = tracks[:MAX_PLAYLIST_TRACKS]
+		}
+		report.Name = name
+		res.Playlists = append(res.Playlists, report)
+		if dryRun || name == "" || len(tracks) == 0 {
+			continue
+		}
+		if err := playlists.put(ctx, user, playlist{Name: name, Library: lib.Name, Tracks: tracks, Created: time.Now().UTC()}); err != nil {
+			return res, err
+		}
+	}
+	ratedKeys, matched, report := mapTracks(matcher, rated)
+	res.Ratings = report
+	if !dryRun && len(ratedKeys) > 0 {
+		stars := make(map[string]int, len(ratedKeys))
+		for i, key := range ratedKeys {
+			stars[key] = min(max(matched[i].Rating, 1), 5)
+		}
+		if err := ratings.setMany(ctx, user, lib, stars); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// handleImport copies the playlists, favorites and ratings of a user of a Subsonic
+// server or another go-music server onto the matching tracks of a library (POST
+// /admin/import?library=). With "dryRun" it only reports what would match.
+func handleImport(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	var req importRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	src, err := req.source()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := strings.TrimSpace(req.User)
+	if user == "" {
+		user = req.Username
+	}
+	if user == "" {
+		user = DEFAULT_RATING_USER
+	}
+	if len(user) > MAX_RATING_USER {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user name too long"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(withLibrary(c.Request.Context(), lib), IMPORT_TIMEOUT)
+	defer cancel()
+	ctx, err = s3Meter.guardScan(ctx, "import")
+	if budgetExceeded(c, err) {
+		return
+	}
+	res, err := runImport(ctx, src, lib, user, req.DryRun)
+	if err != nil {
+		log.Printf("Import from %s failed: %v", req.URL, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.DryRun {
+		audit.record(c, "import", lib.Name, req.URL, user)
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "user": user, "dryRun": req.DryRun, "playlists": res.Playlists, "ratings": res.Ratings})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestSubsonicSource reads playlists, starred songs and ratings from a fake Subsonic
+// server and maps them onto local keys
+func TestSubsonicSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		sum := md5.Sum([]byte("secret" + q.Get("s")))
+		if q.Get("u") != "ann" || q.Get("t") != hex.EncodeToString(sum[:]) {
+			fmt.Fprint(w, `{"subsonic-response":{"status":"failed","error":{"code":40,"message":"Wrong username or password"}}}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/rest/getPlaylists.view":
+			fmt.Fprint(w, `{"subsonic-response":{"status":"ok","playlists":{"playlist":[{"id":"7","name":"Jazz"}]}}}`)
+		case "/rest/getPlaylist.view":
+			fmt.Fprint(w, `{"subsonic-response":{"status":"ok","playlist":{"entry":[
+				{"path":"Miles Davis/Kind of Blue/01 So What.flac","artist":"Miles Davis","title":"So What"},
+				{"path":"Unknown/track.mp3","artist":"Nobody","title":"Nothing"}]}}}`)
+		case "/rest/getStarred2.view":
+			fmt.Fprint(w, `{"subsonic-response":{"status":"ok","starred2":{"song":[{"path":"elsewhere/Blue in Green.mp3","title":"Blue in Green"}]}}}`)
+		case "/rest/search3.view":
+			if q.Get("songOffset") != "0" {
+				fmt.Fprint(w, `{"subsonic-response":{"status":"ok","searchResult3":{}}}`)
+				return
+			}
+			fmt.Fprint(w, `{"subsonic-response":{"status":"ok","searchResult3":{"song":[
+				{"path":"Miles Davis/Kind of Blue/01 So What.flac","title":"So What","userRating":5},
+				{"path":"Miles Davis/Kind of Blue/02 Freddie Freeloader.flac","title":"Freddie Freeloader"}]}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	src, err := importRequest{Source: IMPORT_SUBSONIC, URL: srv.URL + "/", Username: "ann", Password: "secret"}.source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	lists, err := src.playlists(ctx)
+	if err != nil || len(lists) != 1 || lists[0].Name != "Jazz" || len(lists[0].Tracks) != 2 {
+		t.Fatalf("playlists = %+v, %v", lists, err)
+	}
+	starred, err := src.starred(ctx)
+	if err != nil || len(starred) != 1 {
+		t.Fatalf("starred = %+v, %v", starred, err)
+	}
+	rated, err := src.ratings(ctx)
+	if err != nil || len(rated) != 1 || rated[0].Rating != 5 {
+		t.Fatalf("ratings = %+v, %v", rated, err)
+	}
+
+	m := newTrackMatcher([]string{"Jazz/Miles Davis/Kind of Blue/01 So What.flac", "Jazz/Miles Davis/Kind of Blue/03 Blue in Green.mp3"})
+	keys, _, report := mapTracks(m, append(lists[0].Tracks, starred...))
+	if len(keys) != 2 || keys[0] != "Jazz/Miles Davis/Kind of Blue/01 So What.flac" || report.Matched != 2 || len(report.Unmatched) != 1 {
+		t.Errorf("mapTracks = %q, %+v", keys, report)
+	}
+
+	bad, _ := importRequest{Source: IMPORT_SUBSONIC, URL: srv.URL, Username: "ann", Password: "wrong"}.source()
+	if _, err := bad.playlists(ctx); err == nil {
+		t.Error("wrong password accepted")
+	}
+	for _, r := range []importRequest{
+		{Source: IMPORT_SUBSONIC, URL: "ftp://host", Username: "ann"},
+		{Source: IMPORT_GO_MUSIC, URL: srv.URL},
+		{Source: "plex", URL: srv.URL},
+	} {
+		if _, err := r.source(); err == nil {
+			t.Errorf("%+v accepted", r)
+		}
+	}
+}
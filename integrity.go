@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CHECK_TIMEOUT        = 10 * time.Minute
+	DEFAULT_CHECK_SAMPLE = 50 // files whose headers are read per check
+)
+
+// contentTypesByExt are the stored content types that match each audio extension
+var contentTypesByExt = map[string][]string{
+	".mp3": {"audio/mpeg", "audio/mp3"},
+	".wav": {"audio/wav", "audio/x-wav", "audio/wave", "audio/vnd.wave"},
+	".ogg": {"audio/ogg", "application/ogg", "audio/vorbis", "audio/opus"},
+	".mp4": {"audio/mp4", "video/mp4", "audio/x-m4a", "audio/m4a"},
+	".m4a": {"audio/mp4", "audio/x-m4a", "audio/m4a"},
+}
+
+// contentTypeMatches reports whether ctype fits the extension of key; unknown extensions always match
+func contentTypeMatches(key, ctype string) bool {
+	want, ok := contentTypesByExt[strings.ToLower(path.Ext(key))]
+	if !ok {
+		return true
+	}
+	ctype, _, _ = strings.Cut(strings.ToLower(ctype), ";")
+	for _, t := range want {
+		if strings.TrimSpace(ctype) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// truncatedAudio reports whether the header of a file declares more data than the object holds
+func truncatedAudio(key string, head, tail []byte, size int64) bool {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".wav":
+		if len(head) >= 12 && string(head[:4]) == "RIFF" {
+			return int64(binary.LittleEndian.Uint32(head[4:]))+8 > size
+		}
+	case ".mp3":
+		// The Xing/Info frame right after the tag optionally holds the stream length
+		// in bytes, VBRI always does
+		start := 0
+		if len(head) >= 10 && string(head[:3]) == "ID3" {
+			start = 10 + (int(head[6]&0x7f)<<21 | int(head[7]&0x7f)<<14 | int(head[8]&0x7f)<<7 | int(head[9]&0x7f))
+		}
+		if start >= len(head) {
+			return false
+		}
+		frame := head[start:min(len(head), start+256)]
+		for _, tag := range []string{"Xing", "Info"} {
+			if i := strings.Index(string(frame), tag); i >= 0 && i+16 <= len(frame) {
+				return binary.BigEndian.Uint32(frame[i+4:])&3 == 3 && int64(start+int(binary.BigEndian.Uint32(frame[i+12:]))) > size
+			}
+		}
+		if i := strings.Index(string(frame), "VBRI"); i >= 0 && i+14 <= len(frame) {
+			return int64(start+int(binary.BigEndian.Uint32(frame[i+10:]))) > size
+		}
+	case ".ogg":
+		// The last page must be complete, and be flagged as the end of the stream
+		last := strings.LastIndex(string(tail), "OggS")
+		if last < 0 || last+27 > len(tail) {
+			return true
+		}
+		segments := int(tail[last+26])
+		if last+27+segments > len(tail) {
+			return true
+		}
+		n := 27 + segments
+		for _, s := range tail[last+27 : last+27+segments] {
+			n += int(s)
+		}
+		return last+n > len(tail) || tail[last+5]&4 == 0
+	}
+	return false
+}
+
+// libraryIntegrity checks the objects of a library against the manifest and their own
+// headers. Header checks read sample randomly chosen files; sample < 0 reads all of them.
+func libraryIntegrity(ctx context.Context, lib *library, sample int) (gin.H, error) {
+	ctx, err := s3Meter.guardScan(withLibrary(ctx, lib), "check")
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s3ListAudioObjects(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	missing := &healthCheck{Check: "missing", Action: "Objects in the duration manifest are gone; restore them or rescan to drop them", Job: "POST /admin/manifest/scan"}
+	empty := &healthCheck{Check: "zero-byte files", Action: "Re-upload or delete these files"}
+	truncated := &healthCheck{Check: "truncated files", Action: "The header declares more data than the object holds; re-upload these files"}
+	invalid := &healthCheck{Check: "invalid headers", Action: "Replace or re-encode files whose audio header could not be read"}
+	ctypes := &healthCheck{Check: "content type mismatch", Action: "Set the stored Content-Type to match the extension (shown in parentheses)"}
+
+	present := make(map[string]bool, len(objects))
+	var readable []audioObject
+	for _, obj := range objects {
+		present[obj.Key] = true
+		if obj.Size == 0 {
+			empty.add(obj.Key)
+		} else {
+			readable = append(readable, obj)
+		}
+	}
+	manifest.mu.RLock()
+	var gone []string
+	for key := range manifest.libraries[lib.Name] {
+		if !present[key] {
+			gone = append(gone, key)
+		}
+	}
+	manifest.mu.RUnlock()
+	sortNames(gone)
+	for _, key := range gone {
+		missing.add(key)
+	}
+
+	rand.Shuffle(len(readable), func(i, j int) { readable[i], readable[j] = readable[j], readable[i] })
+	if sample >= 0 && sample < len(readable) {
+		readable = readable[:sample]
+	}
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, walkConcurrency)
+	)
+	record := func(h *healthCheck, entry string) {
+		mu.Lock()
+		h.add(entry)
+		mu.Unlock()
+	}
+	for _, obj := range objects {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(obj audioObject) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Stored types are read uncached, as the metadata cache may predate a re-upload
+			resp, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(lib.Bucket),
+				Key:    aws.String(lib.Prefix + obj.Key),
+			})
+			if err != nil {
+				if isNoSuchKey(err) {
+					record(missing, obj.Key)
+				}
+				return
+			}
+			if ctype := aws.ToString(resp.ContentType); !contentTypeMatches(obj.Key, ctype) {
+				record(ctypes, obj.Key+" ("+ctype+")")
+			}
+		}(obj)
+	}
+	for _, obj := range readable {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(obj audioObject) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			head, err := s3GetRange(ctx, obj.Key, fmt.Sprintf("bytes=0-%d", PROBE_HEAD_BYTES-1))
+			if err != nil {
+				return
+			}
+			tail := head
+			if obj.Size > PROBE_HEAD_BYTES {
+				if tail, err = s3GetRange(ctx, obj.Key, fmt.Sprintf("bytes=-%d", PROBE_TAIL_BYTES)); err != nil {
+					return
+				}
+			}
+			if _, err := probeAudio(obj.Key, head, tail, obj.Size); err != nil {
+				record(invalid, obj.Key)
+			} else if truncatedAudio(obj.Key, head, tail, obj.Size) {
+				record(truncated, obj.Key)
+			}
+		}(obj)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var checklist []*healthCheck
+	for _, h := range []*healthCheck{missing, empty, truncated, invalid, ctypes} {
+		if h.Count > 0 {
+			sortNames(h.Examples)
+			checklist = append(checklist, h)
+		}
+	}
+	return gin.H{
+		"library":   lib.Name,
+		"tracks":    len(objects),
+		"sampled":   len(readable),
+		"ok":        len(checklist) == 0,
+		"checklist": checklist,
+	}, nil
+}
+
+// handleLibraryCheck runs the integrity checker (GET /admin/check?library=&sample=)
+func handleLibraryCheck(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	sample := DEFAULT_CHECK_SAMPLE
+	if v := c.Query("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sample must be a number, -1 for all files"})
+			return
+		}
+		sample = n
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), CHECK_TIMEOUT)
+	defer cancel()
+	report, err := libraryIntegrity(ctx, lib, sample)
+	if budgetExceeded(c, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Integrity check error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to check library"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	INVENTORY_CHECK_INTERVAL = time.Hour // how often a newer inventory is looked for
+	INVENTORY_PAGE_SIZE      = 1000      // objects per page handed to walkers, as S3 pages them
+)
+
+// S3 Inventory: INVENTORY_LOCATION=s3://bucket/prefix names the folder an inventory
+// configuration writes its dated manifests to (destination prefix, source bucket and
+// configuration ID). While the newest CSV inventory is younger than INVENTORY_MAX_AGE,
+// full library walks read it instead of listing the bucket. Folders the server changed
+// since the inventory date, and INVENTORY_LIVE_PREFIXES (comma-separated folders where
+// uploads land), are always listed live.
+var (
+	inventoryBucket       string
+	inventoryPrefix       string
+	inventoryMaxAge       = 48 * time.Hour
+	inventoryLivePrefixes []string
+)
+
+// inventoryDateFolder matches the folders inventory manifests are written to
+var inventoryDateFolder = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}-\d{2}Z$`)
+
+func initInventory() error {
+	if v := os.Getenv("INVENTORY_LOCATION"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme != "s3" || u.Host == "" {
+			return fmt.Errorf("invalid INVENTORY_LOCATION: %q, expected s3://bucket/prefix", v)
+		}
+		inventoryBucket = u.Host
+		inventoryPrefix = strings.Trim(u.Path, "/")
+		if inventoryPrefix != "" {
+			inventoryPrefix += "/"
+		}
+	}
+	if v := os.Getenv("INVENTORY_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid INVENTORY_MAX_AGE: %q", v)
+		}
+		inventoryMaxAge = d
+	}
+	for _, p := range strings.Split(os.Getenv("INVENTORY_LIVE_PREFIXES"), ",") {
+		if p = strings.Trim(strings.TrimSpace(p), "/"); p != "" {
+			inventoryLivePrefixes = append(inventoryLivePrefixes, p+"/")
+		}
+	}
+	return nil
+}
+
+// inventoryManifest is the manifest.json of one inventory report
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	CreationTimestamp string `json:"creationTimestamp"` // milliseconds since the epoch
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// inventoryIndex holds the objects of the latest inventory per library, sorted by key
+type inventoryIndex struct {
+	mu       sync.RWMutex
+	manifest string // key of the loaded manifest.json
+	created  time.Time
+	objects  map[string][]audioObject
+	changed  map[string]map[string]time.Time // folders the server changed, per library
+}
+
+var inventory = &inventoryIndex{objects: make(map[string][]audioObject), changed: make(map[string]map[string]time.Time)}
+
+// latestManifest returns the key of the newest manifest.json under INVENTORY_LOCATION
+func (inv *inventoryIndex) latestManifest(ctx context.Context) (string, error) {
+	latest := ""
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(inventoryBucket),
+		Prefix:    aws.String(inventoryPrefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, cp := range page.CommonPrefixes {
+			folder := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(cp.Prefix), inventoryPrefix), "/")
+			if inventoryDateFolder.MatchString(folder) && folder > latest {
+				latest = folder
+			}
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no inventory found at s3://%s/%s", inventoryBucket, inventoryPrefix)
+	}
+	return inventoryPrefix + latest + "/manifest.json", nil
+}
+
+// load reads the newest inventory unless it is already loaded
+func (inv *inventoryIndex) load(ctx context.Context) error {
+	ctx = withS3Feature(ctx, "inventory")
+	key, err := inv.latestManifest(ctx)
+	if err != nil {
+		return err
+	}
+	inv.mu.RLock()
+	loaded := inv.manifest
+	inv.mu.RUnlock()
+	if key == loaded {
+		return nil
+	}
+	start := time.Now()
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(inventoryBucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	var m inventoryManifest
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if m.FileFormat != "CSV" {
+		return fmt.Errorf("%s: %s inventories are not supported, configure the inventory as CSV", key, m.FileFormat)
+	}
+	ms, err := strconv.ParseInt(m.CreationTimestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid creationTimestamp %q", key, m.CreationTimestamp)
+	}
+	created := time.UnixMilli(ms)
+	columns := make(map[string]int)
+	for i, name := range strings.Split(m.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["Key"]; !ok {
+		return fmt.Errorf("%s: the schema has no Key column", key)
+	}
+	objects := make(map[string][]audioObject)
+	for _, f := range m.Files {
+		if err := readInventoryFile(ctx, f.Key, m.SourceBucket, columns, objects); err != nil {
+			return fmt.Errorf("%s: %w", f.Key, err)
+		}
+	}
+	count := 0
+	for _, objs := range objects {
+		sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+		count += len(objs)
+	}
+	inv.mu.Lock()
+	inv.manifest, inv.created, inv.objects = key, created, objects
+	// Changes the inventory already includes needn't be listed live anymore
+	for _, folders := range inv.changed {
+		for folder, t := range folders {
+			if t.Before(created) {
+				delete(folders, folder)
+			}
+		}
+	}
+	inv.mu.Unlock()
+	log.Printf("Inventory of %s from %s: %d objects read in %s", m.SourceBucket, created.UTC().Format(time.RFC3339), count, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// readInventoryFile adds the objects of one gzipped CSV file to the libraries of source
+func readInventoryFile(ctx context.Context, key, source string, columns map[string]int, objects map[string][]audioObject) error {
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(inventoryBucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	field := func(rec []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Versioned inventories list old versions and delete markers too
+		if field(rec, "IsLatest") == "false" || field(rec, "IsDeleteMarker") == "true" {
+			continue
+		}
+		bucket := field(rec, "Bucket")
+		if bucket == "" {
+			bucket = source
+		}
+		name, err := url.QueryUnescape(field(rec, "Key")) // inventory keys are URL-encoded
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(field(rec, "Size"), 10, 64)
+		modified, _ := time.Parse(time.RFC3339, field(rec, "LastModifiedDate"))
+		for _, lib := range libraries {
+			if lib.Bucket != bucket || !strings.HasPrefix(name, lib.Prefix) || name == lib.Prefix {
+				continue
+			}
+			objects[lib.Name] = append(objects[lib.Name], audioObject{
+				Key:      strings.TrimPrefix(name, lib.Prefix),
+				Size:     size,
+				ETag:     normalizeETag(field(rec, "ETag")),
+				Modified: modified,
+			})
+		}
+	}
+}
+
+// run looks for a newer inventory every INVENTORY_CHECK_INTERVAL
+func (inv *inventoryIndex) run(ctx context.Context) {
+	ticker := time.NewTicker(INVENTORY_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := inv.load(ctx); err != nil {
+				log.Printf("Inventory refresh failed: %v", err)
+			}
+		}
+	}
+}
+
+// touch notes that the server changed key, so its folder is listed live until an
+// inventory from after the change is loaded
+func (inv *inventoryIndex) touch(lib *library, key string) {
+	folder := ""
+	if dir := path.Dir(key); dir != "." {
+		folder = dir + "/"
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.changed[lib.Name] == nil {
+		inv.changed[lib.Name] = make(map[string]time.Time)
+	}
+	inv.changed[lib.Name][folder] = time.Now()
+}
+
+// lookup returns the inventory objects under prefix and the folders under it that must be
+// listed live. ok is false when the walk must be live altogether: no fresh inventory covers
+// the library, or prefix lies in a live folder.
+func (inv *inventoryIndex) lookup(lib *library, prefix string) (objects []audioObject, live []string, ok bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	all, found := inv.objects[lib.Name]
+	if !found || time.Since(inv.created) > inventoryMaxAge {
+		return nil, nil, false
+	}
+	folders := append([]string{}, inventoryLivePrefixes...)
+	for folder := range inv.changed[lib.Name] {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders) // parents before their subfolders
+	for _, folder := range folders {
+		if strings.HasPrefix(prefix, folder) {
+			return nil, nil, false
+		}
+		if strings.HasPrefix(folder, prefix) && (len(live) == 0 || !strings.HasPrefix(folder, live[len(live)-1])) {
+			live = append(live, folder)
+		}
+	}
+	for i := sort.Search(len(all), func(i int) bool { return all[i].Key >= prefix }); i < len(all) && strings.HasPrefix(all[i].Key, prefix); i++ {
+		if !underAny(all[i].Key, live) {
+			objects = append(objects, all[i])
+		}
+	}
+	return objects, live, true
+}
+
+func underAny(key string, folders []string) bool {
+	for _, f := range folders {
+		if strings.HasPrefix(key, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk is s3WalkObjects served from the inventory, with live listings of the live folders
+func (inv *inventoryIndex) walk(ctx context.Context, objects []audioObject, live []string, keep func(key string) bool, fn func([]audioObject) error) error {
+	var kept []audioObject
+	for _, obj := range objects {
+		if keep(obj.Key) && isListed(obj.Key, false) {
+			kept = append(kept, obj)
+		}
+	}
+	for _, folder := range live {
+		err := s3WalkObjectsLive(ctx, folder, keep, func(page []audioObject) error {
+			kept = append(kept, page...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Key < kept[j].Key })
+	for len(kept) > 0 {
+		n := min(len(kept), INVENTORY_PAGE_SIZE)
+		if err := fn(kept[:n]); err != nil {
+			return err
+		}
+		kept = kept[n:]
+	}
+	return nil
+}
+
+// dirs returns every listed directory of the request's library as s3ListAllDirs does, or
+// false when the library isn't covered by a fresh inventory
+func (inv *inventoryIndex) dirs(ctx context.Context) ([]string, bool, error) {
+	objects, live, ok := inv.lookup(libraryFrom(ctx), "")
+	if !ok {
+		return nil, false, nil
+	}
+	seen := make(map[string]bool)
+	err := inv.walk(ctx, objects, live, func(string) bool { return true }, func(page []audioObject) error {
+		for _, obj := range page {
+			parts := strings.Split(obj.Key, "/")
+			for i := 1; i < len(parts); i++ {
+				dir := strings.Join(parts[:i], "/")
+				if isMetaDir(dir) || !isListed(dir, true) {
+					break
+				}
+				seen[dir] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	dirs := make([]string, 0, len(seen)+1)
+	for dir := range seen {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return append([]string{""}, dirs...), true, nil
+}
+
+// status reports the loaded inventory for the dashboard
+func (inv *inventoryIndex) status() gin.H {
+	if inventoryBucket == "" {
+		return gin.H{"enabled": false}
+	}
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	libs := gin.H{}
+	for name, objs := range inv.objects {
+		changed := make([]string, 0, len(inv.changed[name]))
+		for folder := range inv.changed[name] {
+			changed = append(changed, folder)
+		}
+		sort.Strings(changed)
+		libs[name] = gin.H{"objects": len(objs), "changedFolders": changed}
+	}
+	st := gin.H{"enabled": true, "manifest": inv.manifest, "libraries": libs, "livePrefixes": inventoryLivePrefixes}
+	if !inv.created.IsZero() {
+		st["created"] = inv.created.UTC().Format(time.RFC3339)
+		st["fresh"] = time.Since(inv.created) <= inventoryMaxAge
+	}
+	return st
+}
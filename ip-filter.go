@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Access by client address: IP_DENY wins over IP_ALLOW, and when IP_ALLOW is set every
+// other address is refused. Both take IPs, CIDRs and the aliases "private" and "loopback",
+// e.g. IP_ALLOW=private,loopback for LAN and VPN only.
+var (
+	ipAllow = splitList(os.Getenv("IP_ALLOW"))
+	ipDeny  = splitList(os.Getenv("IP_DENY"))
+
+	// CLIENT_IP_HEADERS are the headers trusted proxies put the client address in
+	clientIPHeaders = splitList(os.Getenv("CLIENT_IP_HEADERS"))
+)
+
+var ipAllowNets, ipDenyNets []*net.IPNet
+
+func initIPFilter() error {
+	var err error
+	if ipAllowNets, err = parseIPNets("IP_ALLOW", ipAllow); err != nil {
+		return err
+	}
+	if ipDenyNets, err = parseIPNets("IP_DENY", ipDeny); err != nil {
+		return err
+	}
+	if len(clientIPHeaders) == 0 {
+		clientIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	}
+	return nil
+}
+
+// configureClientIP makes gin take client addresses from forwarding headers only when
+// they come from TRUSTED_PROXIES; gin trusts every peer by default
+func configureClientIP(r *gin.Engine) error {
+	proxies := make([]string, len(trustedProxyNets))
+	for i, n := range trustedProxyNets {
+		proxies[i] = n.String()
+	}
+	r.RemoteIPHeaders = clientIPHeaders
+	return r.SetTrustedProxies(proxies)
+}
+
+// ipAllowed applies IP_DENY and IP_ALLOW to a client address
+func ipAllowed(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return len(ipAllowNets) == 0 && len(ipDenyNets) == 0
+	}
+	if containsIP(ipDenyNets, ip) {
+		return false
+	}
+	return len(ipAllowNets) == 0 || containsIP(ipAllowNets, ip)
+}
+
+// IPFilter middleware refuses clients outside IP_ALLOW or inside IP_DENY
+func IPFilter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ipAllowed(c.ClientIP()) {
+			c.Next()
+			return
+		}
+		c.String(http.StatusForbidden, "Forbidden")
+		c.Abort()
+	}
+}
+
+// ipFilterDescription summarizes the access rules for printConfig
+func ipFilterDescription() string {
+	var rules []string
+	if len(ipAllow) > 0 {
+		rules = append(rules, "allow "+strings.Join(ipAllow, ","))
+	}
+	if len(ipDeny) > 0 {
+		rules = append(rules, "deny "+strings.Join(ipDeny, ","))
+	}
+	if len(rules) == 0 {
+		return "any"
+	}
+	return strings.Join(rules, ", ")
+}
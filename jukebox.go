@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	JUKEBOX_START_TIMEOUT = 10 * time.Second // for the player's control socket to appear
+	JUKEBOX_RESTART_DELAY = 5 * time.Second
+)
+
+// JUKEBOX=true plays the kiosk queue through the host's sound card, for a server such
+// as a Raspberry Pi plugged into speakers. An mpv process (MPV_PATH, default "mpv")
+// does the decoding and output, driven over its JSON IPC socket; it streams the tracks
+// from this server through a loopback listener, so transcoding, trims and cue sheets
+// apply as for any player, and IP_ALLOW must not exclude 127.0.0.1. It advances the
+// queue when a track ends, like the big screen at /kiosk does, so don't start both.
+// Play, pause, next and volume are the admin endpoints under /kiosk and the MPD commands.
+var (
+	jukeboxEnabled = os.Getenv("JUKEBOX") == "true"
+	mpvPath        = os.Getenv("MPV_PATH")
+)
+
+func initJukebox() error {
+	if !jukeboxEnabled {
+		return nil
+	}
+	if !kioskMode {
+		return fmt.Errorf("JUKEBOX needs KIOSK_MODE=true")
+	}
+	if mpvPath == "" {
+		mpvPath = "mpv"
+	}
+	p, err := exec.LookPath(mpvPath)
+	if err != nil {
+		return fmt.Errorf("JUKEBOX needs mpv: %w", err)
+	}
+	mpvPath = p
+	return nil
+}
+
+// jukeboxState is what the player was last told to do
+type jukeboxState struct {
+	id     int // of the loaded kiosk item, 0 for none
+	paused bool
+	volume int
+}
+
+// runJukebox serves handler on a loopback port for the player and keeps an mpv process
+// running until ctx is done
+func runJukebox(ctx context.Context, handler http.Handler) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("Jukebox listener failed: %v", err)
+		return
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	defer srv.Close()
+	base := "http://" + ln.Addr().String()
+	dir, err := os.MkdirTemp("", "go-music-jukebox")
+	if err != nil {
+		log.Printf("Jukebox failed: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	for {
+		if err := playJukebox(ctx, base, filepath.Join(dir, "mpv.sock")); err != nil {
+			log.Printf("Jukebox player stopped: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(JUKEBOX_RESTART_DELAY):
+		}
+	}
+}
+
+// playJukebox runs one mpv process and follows the kiosk queue with it until it exits
+func playJukebox(ctx context.Context, base, socket string) error {
+	os.Remove(socket)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, mpvPath, "--idle=yes", "--no-video", "--no-terminal",
+		"--input-ipc-server="+socket)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	var conn net.Conn
+	for deadline := time.Now().Add(JUKEBOX_START_TIMEOUT); ; {
+		var err error
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no control socket: %w", err)
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("exited: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer conn.Close()
+	log.Printf("Jukebox playing the kiosk queue with %s", mpvPath)
+
+	ended := make(chan string, 1)
+	go func() {
+		defer cancel()
+		jukeboxEvents(ctx, conn, ended)
+	}()
+	enc := json.NewEncoder(conn)
+	send := func(args ...interface{}) error {
+		return enc.Encode(map[string]interface{}{"command": args})
+	}
+	state := jukeboxState{volume: -1}
+	for {
+		changed := kiosk.watch()
+		if err := jukeboxSync(&state, base, send); err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case reason := <-ended:
+			if reason == "eof" || reason == "error" {
+				state.id = 0 // nothing loaded; an error skips an unplayable track
+				kioskStarted(kiosk.next())
+			}
+		case err := <-exited:
+			return fmt.Errorf("exited: %v", err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// jukeboxEvents passes on why each track ended until the connection closes
+func jukeboxEvents(ctx context.Context, conn net.Conn, ended chan<- string) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var ev struct {
+			Event  string `json:"event"`
+			Reason string `json:"reason"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &ev) != nil || ev.Event != "end-file" {
+			continue
+		}
+		select {
+		case ended <- ev.Reason:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// jukeboxSync brings the player in line with the kiosk queue, starting the next track
+// when it is idle as the big screen does
+func jukeboxSync(state *jukeboxState, base string, send func(...interface{}) error) error {
+	kiosk.mu.Lock()
+	playing, paused, stopped, queued, volume := kiosk.playing, kiosk.paused, kiosk.stopped, len(kiosk.queue), kiosk.volume
+	kiosk.mu.Unlock()
+	if playing == nil && !stopped && queued > 0 {
+		if playing = kiosk.next(); playing != nil {
+			kioskStarted(playing)
+			paused = false
+		}
+	}
+	switch {
+	case playing == nil && state.id != 0:
+		if err := send("stop"); err != nil {
+			return err
+		}
+		state.id = 0
+	case playing != nil && playing.ID != state.id:
+		if err := send("loadfile", base+playing.URL, "replace"); err != nil {
+			return err
+		}
+		state.id = playing.ID // mpv keeps its pause property across files
+	}
+	if playing != nil && paused != state.paused {
+		if err := send("set_property", "pause", paused); err != nil {
+			return err
+		}
+		state.paused = paused
+	}
+	if volume != state.volume {
+		if err := send("set_property", "volume", volume); err != nil {
+			return err
+		}
+		state.volume = volume
+	}
+	return nil
+}
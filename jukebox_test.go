@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestJukeboxSync follows the kiosk queue through the commands sent to the player
+func TestJukeboxSync(t *testing.T) {
+	defer func(k *kioskQueue) { kiosk = k }(kiosk)
+	kiosk = &kioskQueue{volume: 100, changed: make(chan struct{})}
+	var sent []string
+	send := func(args ...interface{}) error {
+		sent = append(sent, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+		return nil
+	}
+	state := jukeboxState{volume: -1}
+	step := func(name string, change func(), want ...string) {
+		t.Helper()
+		change()
+		sent = nil
+		if err := jukeboxSync(&state, "http://127.0.0.1:1", send); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sent, want) {
+			t.Errorf("%s: sent %q, want %q", name, sent, want)
+		}
+	}
+
+	step("idle", func() {}, "set_property volume 100")
+	step("queued track starts", func() {
+		kiosk.add(kioskItem{Track: "a.mp3", URL: "/audio/a.mp3", client: "x"})
+		kiosk.add(kioskItem{Track: "b.mp3", URL: "/audio/b.mp3", client: "x"})
+	}, "loadfile http://127.0.0.1:1/audio/a.mp3 replace")
+	step("pause", func() { kiosk.setPaused(true) }, "set_property pause true")
+	step("next keeps the player paused until told", func() { kiosk.next() },
+		"loadfile http://127.0.0.1:1/audio/b.mp3 replace", "set_property pause false")
+	step("volume", func() { kiosk.setVolume(40) }, "set_property volume 40")
+	step("stop", func() { kiosk.stop() }, "stop")
+	step("stopped queue stays idle", func() { kiosk.add(kioskItem{Track: "c.mp3", URL: "/audio/c.mp3", client: "y"}) })
+	step("play", func() { kiosk.play() }, "loadfile http://127.0.0.1:1/audio/c.mp3 replace")
+}
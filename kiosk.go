@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_KIOSK_MAX_QUEUE      = 100
+	DEFAULT_KIOSK_MAX_PER_CLIENT = 3
+	KIOSK_UPCOMING               = 10 // queue entries shown on the big screen
+)
+
+// Kiosk mode turns the server into a public jukebox: guests browse only
+// KIOSK_PREFIXES and add tracks to one shared queue played by the screen at /kiosk
+var (
+	kioskMode         = os.Getenv("KIOSK_MODE") == "true"
+	kioskPrefixes     []string
+	kioskMaxQueue     = DEFAULT_KIOSK_MAX_QUEUE
+	kioskMaxPerClient = DEFAULT_KIOSK_MAX_PER_CLIENT
+)
+
+func initKiosk() error {
+	if !kioskMode {
+		return nil
+	}
+	for _, p := range splitList(os.Getenv("KIOSK_PREFIXES")) {
+		if p = strings.Trim(p, "/"); p != "" {
+			kioskPrefixes = append(kioskPrefixes, p+"/")
+		}
+	}
+	for _, opt := range []struct {
+		name string
+		dst  *int
+	}{{"KIOSK_MAX_QUEUE", &kioskMaxQueue}, {"KIOSK_MAX_PER_CLIENT", &kioskMaxPerClient}} {
+		if v := os.Getenv(opt.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid %s: %q", opt.name, v)
+			}
+			*opt.dst = n
+		}
+	}
+	return nil
+}
+
+// kioskVisible reports whether a library-relative path may be listed or played in kiosk mode.
+// Directories above an allowed prefix stay visible so guests can navigate down to it.
+func kioskVisible(name string, isDir bool) bool {
+	if !kioskMode || len(kioskPrefixes) == 0 {
+		return true
+	}
+	if isDir {
+		name = strings.TrimSuffix(name, "/") + "/"
+	}
+	for _, p := range kioskPrefixes {
+		if strings.HasPrefix(name, p) || (isDir && strings.HasPrefix(p, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isListed reports whether a library-relative path shows up in listings
+func isListed(name string, isDir bool) bool {
+	return !isMetaDir(name) && !isTrashed(name) && !isIgnored(name) && kioskVisible(name, isDir)
+}
+
+// kioskItem is a queued or playing track
+type kioskItem struct {
+	ID      int       `json:"id"`
+	Track   string    `json:"track"`
+	Library string    `json:"library"`
+	URL     string    `json:"url"`
+	Added   time.Time `json:"added"`
+	client  string
+}
+
+type kioskQueue struct {
+	mu       sync.Mutex
+	queue    []kioskItem
+	playing  *kioskItem
+	started  time.Time
+	paused   bool
+	pausedAt time.Time
+	stopped  bool // by an MPD client; the screen doesn't advance until play
+	volume   int  // percent, applied by the screen and the jukebox player
+	lastID   int
+	version  int           // counts changes, the playlist version of MPD clients
+	changed  chan struct{} // closed on the next change
+}
+
+var kiosk = &kioskQueue{volume: 100, changed: make(chan struct{})}
+
+// changedLocked counts a change and wakes everyone watching
+func (k *kioskQueue) changedLocked() {
+	k.version++
+	close(k.changed)
+	k.changed = make(chan struct{})
+}
+
+// watch returns a channel that is closed on the next change
+func (k *kioskQueue) watch() <-chan struct{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.changed
+}
+
+// add appends a track unless it is already queued or the client has too many waiting
+func (k *kioskQueue) add(item kioskItem) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.queue) >= kioskMaxQueue {
+		return 0, newUserError(MSG_QUEUE_FULL, kioskMaxQueue)
+	}
+	mine := 0
+	for _, q := range k.queue {
+		if q.Track == item.Track && q.Library == item.Library {
+			return 0, newUserError(MSG_ALREADY_QUEUED)
+		}
+		if q.client == item.client {
+			mine++
+		}
+	}
+	if mine >= kioskMaxPerClient {
+		return 0, newUserError(MSG_GUEST_LIMIT, mine)
+	}
+	k.lastID++
+	item.ID = k.lastID
+	k.queue = append(k.queue, item)
+	k.changedLocked()
+	return len(k.queue), nil
+}
+
+// next moves the head of the queue to now playing
+func (k *kioskQueue) next() *kioskItem {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	defer k.changedLocked()
+	k.paused, k.stopped = false, false
+	if len(k.queue) == 0 {
+		k.playing = nil
+		return nil
+	}
+	item := k.queue[0]
+	k.queue = k.queue[1:]
+	k.playing = &item
+	k.started = time.Now()
+	return &item
+}
+
+// remove drops a queued track by ID; the playing one is skipped instead
+func (k *kioskQueue) remove(id int) bool {
+	k.mu.Lock()
+	if k.playing != nil && k.playing.ID == id {
+		k.mu.Unlock()
+		k.next()
+		return true
+	}
+	defer k.mu.Unlock()
+	for i, q := range k.queue {
+		if q.ID == id {
+			k.queue = append(k.queue[:i:i], k.queue[i+1:]...)
+			k.changedLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// promote moves a queued track to the head of the queue
+func (k *kioskQueue) promote(id int) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, q := range k.queue {
+		if q.ID == id {
+			copy(k.queue[1:i+1], k.queue[:i])
+			k.queue[0] = q
+			k.changedLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// clear empties the queue, leaving the playing track
+func (k *kioskQueue) clear() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.queue = nil
+	k.changedLocked()
+}
+
+// setPaused pauses or resumes the playing track
+func (k *kioskQueue) setPaused(paused bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.playing == nil || k.paused == paused {
+		return
+	}
+	if paused {
+		k.pausedAt = time.Now()
+	} else {
+		k.started = k.started.Add(time.Since(k.pausedAt))
+	}
+	k.paused = paused
+	k.changedLocked()
+}
+
+// stop ends the playing track and keeps the screen from advancing until play
+func (k *kioskQueue) stop() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.playing, k.paused, k.stopped = nil, false, true
+	k.changedLocked()
+}
+
+// play resumes a paused track or starts the next one
+func (k *kioskQueue) play() *kioskItem {
+	k.mu.Lock()
+	playing := k.playing
+	k.mu.Unlock()
+	if playing == nil {
+		return k.next()
+	}
+	k.setPaused(false)
+	return playing
+}
+
+// setVolume sets the playback volume, 0 to 100
+func (k *kioskQueue) setVolume(volume int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.volume != volume {
+		k.volume = volume
+		k.changedLocked()
+	}
+}
+
+// elapsed returns how far into the playing track the screen should be
+func (k *kioskQueue) elapsed() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case k.playing == nil:
+		return 0
+	case k.paused:
+		return k.pausedAt.Sub(k.started)
+	}
+	return time.Since(k.started)
+}
+
+func (k *kioskQueue) snapshot() gin.H {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	upcoming := k.queue
+	if len(upcoming) > KIOSK_UPCOMING {
+		upcoming = upcoming[:KIOSK_UPCOMING]
+	}
+	resp := gin.H{"queue": append([]kioskItem{}, upcoming...), "queued": len(k.queue), "paused": k.paused, "stopped": k.stopped, "volume": k.volume}
+	if k.playing != nil {
+		resp["nowPlaying"] = k.playing
+		resp["started"] = k.started.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+// RequireKiosk middleware hides the kiosk endpoints unless KIOSK_MODE is on
+func RequireKiosk() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !kioskMode {
+			c.String(http.StatusNotFound, "Not found")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleKioskQueue shows now playing and the next tracks (GET /kiosk/queue)
+func handleKioskQueue(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, kiosk.snapshot())
+}
+
+// handleKioskEnqueue adds a guest's track to the shared queue (POST /kiosk/queue, {"track":"..."})
+func handleKioskEnqueue(c *gin.Context) {
+	var req struct {
+		Track string `json:"track"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Track == "" {
+		apiError(c, http.StatusBadRequest, MSG_TRACK_REQUIRED)
+		return
+	}
+	key := strings.TrimPrefix(req.Track, "/")
+	if !isAudioFile(key) || !isListed(key, false) || !folderVisible(c.Request.Context(), key, false) || streamPolicy(key) == STREAM_BLOCK {
+		apiError(c, http.StatusForbidden, MSG_TRACK_NOT_ALLOWED)
+		return
+	}
+	lib := libraryFrom(c.Request.Context())
+	if _, _, _, err := s3HeadAudioFile(c.Request.Context(), key); err != nil {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_TRACK)
+		return
+	}
+	pos, err := kiosk.add(kioskItem{Track: key, Library: lib.Name, URL: audioURL(lib, key, nil), Added: time.Now().UTC(), client: c.ClientIP()})
+	if ue, ok := err.(userError); ok {
+		apiError(c, http.StatusConflict, ue.code, ue.args...)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"position": pos})
+}
+
+// kioskStarted announces a track the shared queue started
+func kioskStarted(item *kioskItem) {
+	if item != nil {
+		eventBus.Publish(EVENT_PLAY_STARTED, map[string]interface{}{"device": "kiosk", "track": item.Track, "library": item.Library, "time": time.Now().Unix()})
+	}
+}
+
+// handleKioskNext is called by the kiosk screen when a track ends (POST /kiosk/next, admin)
+func handleKioskNext(c *gin.Context) {
+	item := kiosk.next()
+	kioskStarted(item)
+	c.JSON(http.StatusOK, gin.H{"nowPlaying": item})
+}
+
+// handleKioskPlay resumes the playing track or starts the next one (POST /kiosk/play, admin)
+func handleKioskPlay(c *gin.Context) {
+	kioskStarted(kiosk.play())
+	c.JSON(http.StatusOK, kiosk.snapshot())
+}
+
+// handleKioskPause pauses or resumes the playing track (POST /kiosk/pause, admin,
+// {"paused":true})
+func handleKioskPause(c *gin.Context) {
+	var req struct {
+		Paused *bool `json:"paused"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Paused == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "paused required"})
+		return
+	}
+	kiosk.setPaused(*req.Paused)
+	c.JSON(http.StatusOK, kiosk.snapshot())
+}
+
+// handleKioskVolume sets the playback volume (POST /kiosk/volume, admin, {"volume":80})
+func handleKioskVolume(c *gin.Context) {
+	var req struct {
+		Volume *int `json:"volume"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Volume == nil || *req.Volume < 0 || *req.Volume > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "volume must be 0 to 100"})
+		return
+	}
+	kiosk.setVolume(*req.Volume)
+	c.JSON(http.StatusOK, kiosk.snapshot())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+// INDEX_OTHER buckets folders that don't start with a letter
+const INDEX_OTHER = "#"
+
+// INDEX_IGNORED_ARTICLES are leading words skipped when picking a folder's letter, so
+// "The Beatles" is found under B
+var indexIgnoredArticles = splitList(os.Getenv("INDEX_IGNORED_ARTICLES"))
+
+func initLetterIndex() error {
+	if len(indexIgnoredArticles) == 0 {
+		indexIgnoredArticles = []string{"The", "El", "La", "Los", "Las", "Le", "Les"}
+	}
+	return nil
+}
+
+// indexLetter returns the bucket of a folder name: its first letter without accents,
+// upper-cased, or INDEX_OTHER for digits and symbols
+func indexLetter(name string) string {
+	for _, article := range indexIgnoredArticles {
+		if len(name) > len(article)+1 && strings.EqualFold(name[:len(article)], article) && name[len(article)] == ' ' {
+			name = strings.TrimLeft(name[len(article):], " ")
+			break
+		}
+	}
+	r, _ := utf8.DecodeRuneInString(norm.NFD.String(name))
+	if !unicode.IsLetter(r) {
+		return INDEX_OTHER
+	}
+	return string(unicode.ToUpper(r))
+}
+
+type letterBucket struct {
+	Letter  string   `json:"letter"`
+	Count   int      `json:"count"`
+	Folders []string `json:"folders,omitempty"`
+}
+
+// handleLetterIndex buckets the folders under ?prefix= by initial letter
+// (GET /api/v1/index). Letters come in listing order with "#" last; only counts are
+// returned unless ?letter= asks for the folders of one bucket.
+func handleLetterIndex(c *gin.Context) {
+	prefix := strings.Trim(c.Query("prefix"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	dirs, _, err := s3List(c.Request.Context(), prefix, "/")
+	if err != nil {
+		log.Printf("S3 list error: %v", err)
+		apiError(c, http.StatusBadGateway, MSG_ACC_DIR)
+		return
+	}
+	sortNames(dirs)
+	want := strings.ToUpper(c.Query("letter"))
+	byLetter := make(map[string]*letterBucket)
+	var letters []string
+	for _, d := range dirs {
+		letter := indexLetter(d)
+		b, ok := byLetter[letter]
+		if !ok {
+			b = &letterBucket{Letter: letter}
+			byLetter[letter] = b
+			if letter != INDEX_OTHER {
+				letters = append(letters, letter)
+			}
+		}
+		b.Count++
+		if letter == want {
+			b.Folders = append(b.Folders, prefix+d)
+		}
+	}
+	sortNames(letters)
+	if _, ok := byLetter[INDEX_OTHER]; ok {
+		letters = append(letters, INDEX_OTHER)
+	}
+	index := make([]letterBucket, len(letters))
+	for i, letter := range letters {
+		index[i] = *byLetter[letter]
+	}
+	c.JSON(http.StatusOK, gin.H{"prefix": prefix, "total": len(dirs), "index": index})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// library is a named bucket/prefix that browse, search and streaming are scoped to
+type library struct {
+	Name   string
+	Bucket string
+	Prefix string // ends with '/' unless empty
+}
+
+// libraries holds the configured libraries; the first one is the default, built from BUCKET and S3_PREFIX.
+// LIBRARY_NAME names the default library, LIBRARIES adds more, e.g. "Lossless=music/flac,Podcasts=pods-bucket".
+var libraries []*library
+
+func initLibraries() error {
+	name := os.Getenv("LIBRARY_NAME")
+	if name == "" {
+		name = "Music"
+	}
+	libraries = []*library{{Name: name, Bucket: s3Bucket, Prefix: s3Prefix}}
+	for _, item := range splitList(os.Getenv("LIBRARIES")) {
+		name, location, ok := strings.Cut(item, "=")
+		name, location = strings.TrimSpace(name), strings.TrimSpace(location)
+		if !ok || name == "" || location == "" {
+			return fmt.Errorf("invalid LIBRARIES entry %q, expected name=bucket[/prefix]", item)
+		}
+		if findLibrary(name) != nil {
+			return fmt.Errorf("duplicate library name %q", name)
+		}
+		bucket, prefix, _ := strings.Cut(location, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		libraries = append(libraries, &library{Name: name, Bucket: bucket, Prefix: prefix})
+	}
+	return nil
+}
+
+// defaultLibrary is the library served when a request doesn't select one
+func defaultLibrary() *library {
+	return libraries[0]
+}
+
+// findLibrary looks a library up by name, "" meaning the default. With USER_HOMES, ~<user>
+// names a user's home; requests are limited to their own by the Library middleware.
+func findLibrary(name string) *library {
+	if name == "" && len(libraries) > 0 {
+		return defaultLibrary()
+	}
+	if user, ok := strings.CutPrefix(name, HOME_NAME_PREFIX); ok && userHomes && validHomeUser(user) {
+		return homeLibrary(user)
+	}
+	for _, lib := range libraries {
+		if lib.Name == name {
+			return lib
+		}
+	}
+	return nil
+}
+
+// cacheKey identifies an object in the disk cache; default library keys are kept as-is
+func (l *library) cacheKey(key string) string {
+	if l == defaultLibrary() {
+		return key
+	}
+	return l.Bucket + "/" + l.Prefix + key
+}
+
+type libraryCtxKey struct{}
+
+// withLibrary scopes the S3 helpers called with ctx to lib
+func withLibrary(ctx context.Context, lib *library) context.Context {
+	return context.WithValue(ctx, libraryCtxKey{}, lib)
+}
+
+// libraryFrom returns the library selected for ctx, or the default library
+func libraryFrom(ctx context.Context) *library {
+	if lib, ok := ctx.Value(libraryCtxKey{}).(*library); ok {
+		return lib
+	}
+	return defaultLibrary()
+}
+
+// Library middleware selects the library from the "dflib" form field or the "lib" query
+// parameter; with USER_HOMES only the user's home and shared libraries can be selected.
+// It also limits the request to the folders FOLDER_ACL allows its user.
+func Library() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Query("lib")
+		if c.Request.Method == http.MethodPost {
+			if v := c.PostForm("dflib"); v != "" {
+				name = v
+			}
+		}
+		var lib *library
+		if userHomes {
+			var ok bool
+			if lib, ok = tenantLibrary(c, name); !ok {
+				c.Abort()
+				return
+			}
+		} else if lib = findLibrary(name); lib == nil {
+			c.String(http.StatusNotFound, "Unknown library")
+			c.Abort()
+			return
+		}
+		ctx := withLibrary(c.Request.Context(), lib)
+		if prefixes, ok := requestAccess(c); ok {
+			ctx = withAccess(ctx, prefixes)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// handleGetLibraries lists the library names, default first, whether kiosk mode is on and
+// whether the request is a guest's
+func handleGetLibraries(c *gin.Context) {
+	names := make([]string, len(libraries))
+	for i, lib := range libraries {
+		names[i] = lib.Name
+	}
+	if userHomes {
+		names = tenantLibraryNames(c)
+	}
+	kiosk, guest := "", ""
+	if kioskMode {
+		kiosk = "1"
+	}
+	if isGuest(c) {
+		guest = "1"
+	}
+	echoReqHtml(c, []interface{}{"ok", names, kiosk, guest}, "getLibrariesData")
+}
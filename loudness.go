@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LOUDNESS_OBJECT         = "loudness.json"
+	LOUDNESS_WORKERS        = 2   // concurrent ffmpeg analyses; each decodes a whole track
+	LOUDNESS_SAVE_EVERY     = 100 // analyzed tracks between intermediate saves
+	DEFAULT_LOUDNESS_TARGET = -18.0
+	LOUDNESS_MAX_PEAK       = -1.0 // dBTP a positive gain may raise the true peak to
+	LOUDNESS_VERSION        = 2    // entries of older analyses are redone; 2 added silence detection
+
+	// Leading and trailing silence: quieter than SILENCE_NOISE for at least SILENCE_MIN_DURATION
+	SILENCE_NOISE        = "-50dB"
+	SILENCE_MIN_DURATION = "0.5"
+	SILENCE_TOLERANCE    = 0.05 // seconds from either end a silence may start or stop
+)
+
+// Loudness analysis: LOUDNESS_SCAN=true analyzes new and changed tracks with ffmpeg
+// at startup and every LOUDNESS_SCAN_INTERVAL; LOUDNESS_TARGET is the reference
+// level in LUFS gains are computed for (ReplayGain 2.0 uses -18)
+var (
+	loudnessScan         = os.Getenv("LOUDNESS_SCAN") == "true"
+	loudnessScanInterval time.Duration
+	loudnessTarget       = DEFAULT_LOUDNESS_TARGET
+)
+
+func initLoudness() error {
+	if v := os.Getenv("LOUDNESS_SCAN_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid LOUDNESS_SCAN_INTERVAL: %q", v)
+		}
+		loudnessScanInterval = d
+	}
+	if v := os.Getenv("LOUDNESS_TARGET"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f > 0 || f < -40 {
+			return fmt.Errorf("invalid LOUDNESS_TARGET: %q, expected LUFS between -40 and 0", v)
+		}
+		loudnessTarget = f
+	}
+	if loudnessScan && ffmpegPath == "" {
+		return fmt.Errorf("LOUDNESS_SCAN needs ffmpeg")
+	}
+	return nil
+}
+
+// loudnessEntry is the EBU R128 measurement of one object version
+type loudnessEntry struct {
+	ETag       string  `json:"etag"`
+	Version    int     `json:"v,omitempty"`
+	Integrated float64 `json:"lufs"` // integrated loudness
+	Peak       float64 `json:"peak"` // true peak in dBTP
+	Failed     bool    `json:"failed,omitempty"`
+	AudioStart float64 `json:"audioStart,omitempty"` // seconds of leading silence
+	AudioEnd   float64 `json:"audioEnd,omitempty"`   // position trailing silence starts at, 0 when there is none
+}
+
+// gain returns the adjustment in dB that brings e to the target without raising
+// the true peak above LOUDNESS_MAX_PEAK
+func (e loudnessEntry) gain() float64 {
+	g := loudnessTarget - e.Integrated
+	if g > 0 {
+		g = min(g, LOUDNESS_MAX_PEAK-e.Peak)
+	}
+	return math.Round(g*100) / 100
+}
+
+// loudnessIndex holds measurements per library and key, persisted as one metadata
+// object, and the album values derived from them per folder
+type loudnessIndex struct {
+	mu        sync.RWMutex
+	libraries map[string]map[string]loudnessEntry
+	albums    map[string]map[string]loudnessEntry
+	saveMu    sync.Mutex
+	scanning  atomic.Bool
+}
+
+var loudness = &loudnessIndex{
+	libraries: make(map[string]map[string]loudnessEntry),
+	albums:    make(map[string]map[string]loudnessEntry),
+}
+
+// load reads the index from the bucket; a missing object means nothing was analyzed yet
+func (li *loudnessIndex) load(ctx context.Context) error {
+	libs := make(map[string]map[string]loudnessEntry)
+	if err := s3GetJSON(ctx, LOUDNESS_OBJECT, &libs); err != nil {
+		if isNoSuchKey(err) {
+			return nil
+		}
+		return err
+	}
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.libraries = libs
+	for _, lib := range libraries {
+		li.computeAlbums(lib)
+	}
+	return nil
+}
+
+func (li *loudnessIndex) save(ctx context.Context) error {
+	li.saveMu.Lock()
+	defer li.saveMu.Unlock()
+	li.mu.RLock()
+	defer li.mu.RUnlock()
+	return s3PutJSON(ctx, LOUDNESS_OBJECT, li.libraries)
+}
+
+// computeAlbums derives the loudness of every folder of lib from its tracks: the
+// duration-weighted energy mean of their integrated loudness and the highest peak.
+// Called with mu held.
+func (li *loudnessIndex) computeAlbums(lib *library) {
+	type sum struct{ energy, weight, peak float64 }
+	sums := make(map[string]*sum)
+	for key, e := range li.libraries[lib.Name] {
+		if e.Failed {
+			continue
+		}
+		w := 1.0
+		if m, ok := manifest.entry(lib, key); ok && m.DurationMs > 0 {
+			w = float64(m.DurationMs) / 1000
+		}
+		dir := path.Dir(key)
+		s := sums[dir]
+		if s == nil {
+			s = &sum{peak: math.Inf(-1)}
+			sums[dir] = s
+		}
+		s.energy += w * math.Pow(10, e.Integrated/10)
+		s.weight += w
+		s.peak = max(s.peak, e.Peak)
+	}
+	albums := make(map[string]loudnessEntry, len(sums))
+	for dir, s := range sums {
+		albums[dir] = loudnessEntry{Integrated: math.Round(10*math.Log10(s.energy/s.weight)*10) / 10, Peak: s.peak}
+	}
+	li.albums[lib.Name] = albums
+}
+
+// gains returns the track and album gain of key in lib
+func (li *loudnessIndex) gains(lib *library, key string) (track, album float64, ok bool) {
+	li.mu.RLock()
+	defer li.mu.RUnlock()
+	e, ok := li.libraries[lib.Name][key]
+	if !ok || e.Failed {
+		return 0, 0, false
+	}
+	return e.gain(), li.albums[lib.Name][path.Dir(key)].gain(), true
+}
+
+// rename moves the measurement of a renamed object along with it
+func (li *loudnessIndex) rename(lib *library, from, to string) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if e, ok := li.libraries[lib.Name][from]; ok {
+		li.libraries[lib.Name][to] = e
+		delete(li.libraries[lib.Name], from)
+		li.computeAlbums(lib)
+	}
+}
+
+// scan analyzes every new or changed object of lib and drops entries of deleted ones
+func (li *loudnessIndex) scan(ctx context.Context, lib *library) (analyzed, failed int, err error) {
+	ctx, err = s3Meter.guardScan(withLibrary(ctx, lib), "loudness")
+	if err != nil {
+		return 0, 0, err
+	}
+	objects, err := s3ListAudioObjects(ctx, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	li.mu.Lock()
+	old := li.libraries[lib.Name]
+	fresh := make(map[string]loudnessEntry, len(objects))
+	var todo []audioObject
+	for _, obj := range objects {
+		if e, ok := old[obj.Key]; ok && e.ETag == obj.ETag && e.Version >= LOUDNESS_VERSION {
+			fresh[obj.Key] = e
+		} else if streamPolicy(obj.Key) != STREAM_BLOCK {
+			todo = append(todo, obj)
+		}
+	}
+	li.libraries[lib.Name] = fresh
+	li.mu.Unlock()
+
+	var (
+		wg        sync.WaitGroup
+		done      atomic.Int64
+		failCount atomic.Int64
+	)
+	sem := make(chan struct{}, LOUDNESS_WORKERS)
+	for _, obj := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(obj audioObject) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			entry, err := analyzeLoudness(ctx, obj.Key)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Loudness analysis of %s failed: %v", obj.Key, err)
+				failCount.Add(1)
+				// Remember the failure so unchanged files aren't analyzed again
+				entry = loudnessEntry{Failed: true}
+			}
+			entry.ETag, entry.Version = obj.ETag, LOUDNESS_VERSION
+			li.mu.Lock()
+			li.libraries[lib.Name][obj.Key] = entry
+			li.mu.Unlock()
+			if n := done.Add(1); n%LOUDNESS_SAVE_EVERY == 0 {
+				log.Printf("Loudness scan of %s: %d/%d tracks analyzed", lib.Name, n, len(todo))
+				if err := li.save(ctx); err != nil {
+					log.Printf("Loudness save error: %v", err)
+				}
+			}
+		}(obj)
+	}
+	wg.Wait()
+	li.mu.Lock()
+	li.computeAlbums(lib)
+	li.mu.Unlock()
+	if err := li.save(context.WithoutCancel(ctx)); err != nil {
+		return int(done.Load()), int(failCount.Load()), err
+	}
+	return int(done.Load()), int(failCount.Load()), ctx.Err()
+}
+
+// scanAll scans every library unless a scan is already running
+func (li *loudnessIndex) scanAll(ctx context.Context) {
+	if !li.scanning.CompareAndSwap(false, true) {
+		return
+	}
+	defer li.scanning.Store(false)
+	for _, lib := range libraries {
+		start := time.Now()
+		analyzed, failed, err := li.scan(ctx, lib)
+		if err != nil {
+			log.Printf("Loudness scan of %s failed: %v", lib.Name, err)
+			continue
+		}
+		log.Printf("Loudness scan of %s finished: %d tracks analyzed (%d failed) in %s", lib.Name, analyzed, failed, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// run loads the index, scans once and then every LOUDNESS_SCAN_INTERVAL
+func (li *loudnessIndex) run(ctx context.Context) {
+	if err := li.load(ctx); err != nil {
+		log.Printf("Failed to load loudness index: %v", err)
+	}
+	if !loudnessScan {
+		return
+	}
+	li.scanAll(ctx)
+	if loudnessScanInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(loudnessScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			li.scanAll(ctx)
+		}
+	}
+}
+
+// The ebur128 filter prints a line per frame and a summary after the last one; the
+// silencedetect filter prints where each silence starts and ends
+var (
+	ebur128Integrated = regexp.MustCompile(`I:\s+(-?[\d.]+) LUFS`)
+	ebur128Peak       = regexp.MustCompile(`Peak:\s+(-?[\d.]+|-inf) dBFS`)
+	ebur128Time       = regexp.MustCompile(`\bt:\s+([\d.]+)`)
+	silenceEvent      = regexp.MustCompile(`silence_(start|end): (-?[\d.]+)`)
+)
+
+// analyzeLoudness decodes an object with ffmpeg and measures it
+func analyzeLoudness(ctx context.Context, key string) (loudnessEntry, error) {
+	body, _, _, err := s3GetAudioFile(ctx, key)
+	if err != nil {
+		return loudnessEntry{}, err
+	}
+	defer body.Close()
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-nostats", "-i", "pipe:0", "-vn",
+		"-af", "ebur128=peak=true,silencedetect=noise="+SILENCE_NOISE+":d="+SILENCE_MIN_DURATION, "-f", "null", "-")
+	cmd.Stdin = body
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return loudnessEntry{}, fmt.Errorf("ffmpeg: %w", err)
+	}
+	text := string(out)
+	frames := text
+	if i := strings.LastIndex(text, "Summary:"); i >= 0 {
+		frames, text = text[:i], text[i:]
+	}
+	im := ebur128Integrated.FindStringSubmatch(text)
+	pm := ebur128Peak.FindStringSubmatch(text)
+	if im == nil || pm == nil {
+		return loudnessEntry{}, fmt.Errorf("no ebur128 summary")
+	}
+	integrated, _ := strconv.ParseFloat(im[1], 64)
+	if integrated <= -70 {
+		return loudnessEntry{}, fmt.Errorf("track is silent")
+	}
+	peak, err := strconv.ParseFloat(pm[1], 64)
+	if err != nil {
+		peak = -70 // -inf, which JSON can't hold
+	}
+	e := loudnessEntry{Integrated: integrated, Peak: peak}
+	var duration float64
+	if tm := ebur128Time.FindAllStringSubmatch(frames, -1); tm != nil {
+		duration, _ = strconv.ParseFloat(tm[len(tm)-1][1], 64)
+	}
+	e.AudioStart, e.AudioEnd = parseSilence(frames, duration)
+	return e, nil
+}
+
+// parseSilence finds the end of a silence at the start of a track and the start of one
+// running to its end in silencedetect output. A silence still open at the end of the
+// output runs to the end.
+func parseSilence(text string, duration float64) (audioStart, audioEnd float64) {
+	type span struct{ start, end float64 }
+	var spans []span
+	for _, m := range silenceEvent.FindAllStringSubmatch(text, -1) {
+		v, _ := strconv.ParseFloat(m[2], 64)
+		if m[1] == "start" {
+			spans = append(spans, span{start: max(v, 0), end: -1})
+		} else if len(spans) > 0 && spans[len(spans)-1].end < 0 {
+			spans[len(spans)-1].end = v
+		}
+	}
+	if len(spans) == 0 {
+		return 0, 0
+	}
+	if first := spans[0]; first.start <= SILENCE_TOLERANCE && first.end > 0 {
+		audioStart = math.Round(first.end*1000) / 1000
+	}
+	if last := spans[len(spans)-1]; last.start > audioStart && (last.end < 0 || (duration > 0 && last.end >= duration-SILENCE_TOLERANCE)) {
+		audioEnd = math.Round(last.start*1000) / 1000
+	}
+	return audioStart, audioEnd
+}
+
+// silence returns where the audible part of key in lib starts and ends, as played:
+// relative to its trim points and 0 where there is no silence
+func (li *loudnessIndex) silence(lib *library, key string) (audioStart, audioEnd float64) {
+	li.mu.RLock()
+	e, ok := li.libraries[lib.Name][key]
+	li.mu.RUnlock()
+	if !ok || e.Failed {
+		return 0, 0
+	}
+	audioStart, audioEnd = e.AudioStart, e.AudioEnd
+	if t, ok := trims.get(lib, key); ok && ffmpegPath != "" {
+		audioStart = max(0, audioStart-t.Start)
+		if audioEnd > 0 && (t.End == 0 || audioEnd < t.End) {
+			audioEnd = max(0, audioEnd-t.Start)
+		} else {
+			audioEnd = 0
+		}
+	}
+	return audioStart, audioEnd
+}
+
+// trimSilence narrows trim (nil for the whole object) to the audible part of key
+func (li *loudnessIndex) trimSilence(lib *library, key string, trim *trimPoint) *trimPoint {
+	li.mu.RLock()
+	e, ok := li.libraries[lib.Name][key]
+	li.mu.RUnlock()
+	if !ok || e.Failed || (e.AudioStart == 0 && e.AudioEnd == 0) {
+		return trim
+	}
+	t := trimPoint{}
+	if trim != nil {
+		t = *trim
+	}
+	t.Start = max(t.Start, e.AudioStart)
+	if e.AudioEnd > 0 && (t.End == 0 || e.AudioEnd < t.End) {
+		t.End = e.AudioEnd
+	}
+	return &t
+}
+
+// normalizeGain returns the gain ?normalize= asks for on an audio request:
+// 1 (or track) for the track gain, album for the album gain
+func normalizeGain(c *gin.Context, key string) float64 {
+	mode := c.Query("normalize")
+	if mode == "" || mode == "0" || ffmpegPath == "" {
+		return 0
+	}
+	track, album, ok := loudness.gains(libraryFrom(c.Request.Context()), key)
+	if !ok {
+		return 0
+	}
+	if mode == "album" {
+		return album
+	}
+	return track
+}
+
+// handleLoudnessScan starts a background loudness scan (POST /admin/loudness/scan)
+func handleLoudnessScan(c *gin.Context) {
+	if ffmpegPath == "" {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "loudness analysis needs ffmpeg"})
+		return
+	}
+	if loudness.scanning.Load() {
+		c.JSON(http.StatusConflict, gin.H{"error": "scan already running"})
+		return
+	}
+	go loudness.scanAll(context.Background())
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const MAX_LRC_BYTES = 256 << 10
+
+// lyricsLine is one line of lyrics; Time is in seconds and only meaningful when synced
+type lyricsLine struct {
+	Time float64 `json:"time"`
+	Text string  `json:"text"`
+}
+
+type trackLyrics struct {
+	Source string       `json:"source"` // lrc, sylt or uslt
+	Synced bool         `json:"synced"`
+	Lines  []lyricsLine `json:"lines"`
+}
+
+var lrcTimestamp = regexp.MustCompile(`^\[(\d+):(\d{1,2}(?:[.:]\d{1,3})?)\]`)
+
+// parseLRC reads LRC text. Lines without timestamps make the result unsynced.
+func parseLRC(text string) ([]lyricsLine, bool) {
+	var lines []lyricsLine
+	var plain []lyricsLine
+	offset := 0.0
+	for _, raw := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		line := strings.TrimSpace(raw)
+		if v, ok := strings.CutPrefix(line, "[offset:"); ok {
+			// Positive offsets make lyrics appear sooner
+			if ms, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(v, "]"))); err == nil {
+				offset = float64(ms) / 1000
+			}
+			continue
+		}
+		var times []float64
+		for {
+			m := lrcTimestamp.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			mins, _ := strconv.Atoi(m[1])
+			secs, _ := strconv.ParseFloat(strings.Replace(m[2], ":", ".", 1), 64)
+			times = append(times, float64(mins)*60+secs)
+			line = strings.TrimSpace(line[len(m[0]):])
+		}
+		if len(times) == 0 {
+			// [ar:...] style tags carry no lyrics
+			if line != "" && !(strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]")) {
+				plain = append(plain, lyricsLine{Text: line})
+			}
+			continue
+		}
+		for _, t := range times {
+			lines = append(lines, lyricsLine{Time: max(t-offset, 0), Text: line})
+		}
+	}
+	if len(lines) == 0 {
+		return plain, false
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time < lines[j].Time })
+	return lines, true
+}
+
+// embeddedLyrics reads SYLT (synced, millisecond timestamps) or USLT lyrics from an ID3v2 tag
+func embeddedLyrics(tag []byte) (trackLyrics, bool) {
+	frames := id3Frames(tag, "SYLT", "USLT")
+	if f := frames["SYLT"]; len(f) > 6 && f[4] == 2 {
+		enc := f[0]
+		_, rest := id3Cut(enc, f[6:]) // content descriptor
+		var lines []lyricsLine
+		for len(rest) > 0 {
+			var text []byte
+			text, rest = id3Cut(enc, rest)
+			if len(rest) < 4 {
+				break
+			}
+			ms := binary.BigEndian.Uint32(rest)
+			rest = rest[4:]
+			lines = append(lines, lyricsLine{Time: float64(ms) / 1000, Text: strings.TrimSpace(id3Text(enc, text))})
+		}
+		if len(lines) > 0 {
+			return trackLyrics{Source: "sylt", Synced: true, Lines: lines}, true
+		}
+	}
+	if f := frames["USLT"]; len(f) > 4 {
+		enc := f[0]
+		_, text := id3Cut(enc, f[4:]) // content descriptor
+		// Lyrics in LRC format are often pasted into USLT
+		lines, synced := parseLRC(id3Text(enc, text))
+		if len(lines) > 0 {
+			return trackLyrics{Source: "uslt", Synced: synced, Lines: lines}, true
+		}
+	}
+	return trackLyrics{}, false
+}
+
+// loadLyrics finds the lyrics of key: a .lrc object next to it wins over embedded tags.
+// A missing result is cached as well, so tags aren't read again on every request.
+func loadLyrics(ctx context.Context, key string) (trackLyrics, bool, error) {
+	lib := libraryFrom(ctx)
+	cacheKey := "lyrics\x00" + lib.Name + "\x00" + key
+	var lyr trackLyrics
+	if data, ok := metadataCache.Get(cacheKey); ok && json.Unmarshal(data, &lyr) == nil {
+		return lyr, lyr.Source != "", nil
+	}
+	found := false
+	lrcKey := strings.TrimSuffix(key, path.Ext(key)) + ".lrc"
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + lrcKey),
+	})
+	if err == nil {
+		data, rerr := io.ReadAll(io.LimitReader(resp.Body, MAX_LRC_BYTES))
+		resp.Body.Close()
+		if rerr != nil {
+			return lyr, false, rerr
+		}
+		if lines, synced := parseLRC(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))); len(lines) > 0 {
+			lyr, found = trackLyrics{Source: "lrc", Synced: synced, Lines: lines}, true
+		}
+	} else if !isNoSuchKey(err) {
+		return lyr, false, err
+	}
+	if !found && strings.EqualFold(path.Ext(key), ".mp3") {
+		tag, err := readID3Tag(ctx, key)
+		if err != nil {
+			return lyr, false, err
+		}
+		lyr, found = embeddedLyrics(tag)
+	}
+	if data, err := json.Marshal(lyr); err == nil {
+		metadataCache.Set(cacheKey, data)
+	}
+	return lyr, found, nil
+}
+
+// handleLyrics returns the lyrics of a track as JSON (GET /lyrics/*path). Synced
+// times follow the track's trim points, as played.
+func handleLyrics(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	if !isAudioFile(key) || !isListed(key, false) || !folderVisible(c.Request.Context(), key, false) {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_TRACK)
+		return
+	}
+	ctx := c.Request.Context()
+	lyr, found, err := loadLyrics(ctx, key)
+	if err != nil {
+		if isNoSuchKey(err) {
+			apiError(c, http.StatusNotFound, MSG_UNKNOWN_TRACK)
+			return
+		}
+		apiError(c, http.StatusBadGateway, MSG_LYRICS_FAILED)
+		return
+	}
+	if !found {
+		apiError(c, http.StatusNotFound, MSG_NO_LYRICS)
+		return
+	}
+	if t, ok := trims.get(libraryFrom(ctx), key); ok && ffmpegPath != "" && lyr.Synced && t.Start > 0 {
+		shifted := make([]lyricsLine, 0, len(lyr.Lines))
+		for _, l := range lyr.Lines {
+			if l.Time >= t.Start {
+				shifted = append(shifted, lyricsLine{Time: l.Time - t.Start, Text: l.Text})
+			}
+		}
+		lyr.Lines = shifted
+	}
+	c.JSON(http.StatusOK, gin.H{"track": key, "source": lyr.Source, "synced": lyr.Synced, "lines": lyr.Lines})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MANIFEST_OBJECT     = "manifest.json"
+	MANIFEST_SAVE_EVERY = 500 // probed tracks between intermediate saves
+
+	MAX_ADDED_EVENT_TRACKS = 100 // keys named by an EVENT_TRACKS_ADDED event, which counts all
+)
+
+// Duration scanning: DURATION_SCAN=false disables the startup scan,
+// DURATION_SCAN_INTERVAL (e.g. "6h") rescans periodically
+var (
+	durationScan         = os.Getenv("DURATION_SCAN") != "false"
+	durationScanInterval time.Duration
+)
+
+func initDurationScan() error {
+	if v := os.Getenv("DURATION_SCAN_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid DURATION_SCAN_INTERVAL: %q", v)
+		}
+		durationScanInterval = d
+	}
+	return nil
+}
+
+// manifestEntry caches the probed length of one object; ETag tells when it must be probed again
+type manifestEntry struct {
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+	DurationMs int64  `json:"durationMs"`
+	Bitrate    int    `json:"bitrate,omitempty"` // kbit/s
+}
+
+// trackManifest holds durations per library and key, persisted as one metadata object
+type trackManifest struct {
+	mu        sync.RWMutex
+	libraries map[string]map[string]manifestEntry
+	scanned   map[string]time.Time // last completed scan per library, since startup
+	saveMu    sync.Mutex
+	scanning  atomic.Bool
+}
+
+var manifest = &trackManifest{libraries: make(map[string]map[string]manifestEntry), scanned: make(map[string]time.Time)}
+
+// load reads the manifest from the bucket; a missing object means nothing was scanned yet
+func (m *trackManifest) load(ctx context.Context) error {
+	libs := make(map[string]map[string]manifestEntry)
+	if err := s3GetJSON(ctx, MANIFEST_OBJECT, &libs); err != nil {
+		if isNoSuchKey(err) {
+			return nil
+		}
+		return err
+	}
+	m.mu.Lock()
+	m.libraries = libs
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *trackManifest) save(ctx context.Context) error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return s3PutJSON(ctx, MANIFEST_OBJECT, m.libraries)
+}
+
+// durations returns the played length in whole seconds of each key in lib, 0 when unknown.
+// Trim points shorten the length the same way they shorten the stream.
+func (m *trackManifest) durations(lib *library, keys []string) []int {
+	out := make([]int, len(keys))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := m.libraries[lib.Name]
+	for i, key := range keys {
+		e, ok := entries[key]
+		if !ok || e.DurationMs == 0 {
+			if d, ok := cueDurations.Load(lib.Name + "\x00" + key); ok {
+				out[i] = d.(int)
+			}
+			continue
+		}
+		secs := float64(e.DurationMs) / 1000
+		if t, ok := trims.get(lib, key); ok && ffmpegPath != "" {
+			secs = t.length(secs)
+		}
+		out[i] = int(secs + 0.5)
+	}
+	return out
+}
+
+// entry returns the manifest entry of key in lib
+func (m *trackManifest) entry(lib *library, key string) (manifestEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.libraries[lib.Name][key]
+	return e, ok
+}
+
+// status reports the tracks known per library and when each was last scanned
+func (m *trackManifest) status() gin.H {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	libs := gin.H{}
+	for name, entries := range m.libraries {
+		st := gin.H{"tracks": len(entries)}
+		if t, ok := m.scanned[name]; ok {
+			st["scanned"] = t.UTC().Format(time.RFC3339)
+		}
+		libs[name] = st
+	}
+	return gin.H{"scanning": m.scanning.Load(), "libraries": libs}
+}
+
+// rename moves the entry of a renamed object; the copy keeps the content, so it needn't be probed again
+func (m *trackManifest) rename(lib *library, from, to string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.libraries[lib.Name][from]; ok {
+		m.libraries[lib.Name][to] = e
+		delete(m.libraries[lib.Name], from)
+	}
+}
+
+// scan probes every new or changed object of lib and drops entries of deleted ones
+func (m *trackManifest) scan(ctx context.Context, lib *library) (probed, failed int, err error) {
+	ctx, err = s3Meter.guardScan(withLibrary(ctx, lib), "manifest")
+	if err != nil {
+		return 0, 0, err
+	}
+	objects, err := s3ListAudioObjects(ctx, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	m.mu.Lock()
+	old := m.libraries[lib.Name]
+	fresh := make(map[string]manifestEntry, len(objects))
+	var todo []audioObject
+	var added []string
+	for _, obj := range objects {
+		if e, ok := old[obj.Key]; ok && e.ETag == obj.ETag {
+			fresh[obj.Key] = e
+		} else {
+			todo = append(todo, obj)
+			if _, known := old[obj.Key]; !known && old != nil && !isTrashed(obj.Key) {
+				added = append(added, obj.Key)
+			}
+		}
+	}
+	m.libraries[lib.Name] = fresh
+	m.mu.Unlock()
+
+	var (
+		wg        sync.WaitGroup
+		done      atomic.Int64
+		failCount atomic.Int64
+	)
+	sem := make(chan struct{}, walkConcurrency)
+	for _, obj := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(obj audioObject) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			entry, err := probeObject(ctx, obj)
+			if err != nil {
+				failCount.Add(1)
+				// Remember the failure so unchanged files aren't probed again
+				entry = manifestEntry{ETag: obj.ETag, Size: obj.Size}
+			}
+			m.mu.Lock()
+			m.libraries[lib.Name][obj.Key] = entry
+			m.mu.Unlock()
+			if n := done.Add(1); n%MANIFEST_SAVE_EVERY == 0 {
+				log.Printf("Duration scan of %s: %d/%d tracks probed", lib.Name, n, len(todo))
+				if err := m.save(ctx); err != nil {
+					log.Printf("Manifest save error: %v", err)
+				}
+			}
+		}(obj)
+	}
+	wg.Wait()
+	if len(added) > 0 {
+		sortNames(added)
+		eventBus.Publish(EVENT_TRACKS_ADDED, map[string]interface{}{"library": lib.Name, "count": len(added), "tracks": added[:min(len(added), MAX_ADDED_EVENT_TRACKS)]})
+	}
+	if err := m.save(ctx); err != nil {
+		return int(done.Load()), int(failCount.Load()), err
+	}
+	return int(done.Load()), int(failCount.Load()), ctx.Err()
+}
+
+// scanAll scans every library unless a scan is already running
+func (m *trackManifest) scanAll(ctx context.Context) {
+	if !m.scanning.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.scanning.Store(false)
+	for _, lib := range libraries {
+		start := time.Now()
+		probed, failed, err := m.scan(ctx, lib)
+		if err != nil {
+			log.Printf("Duration scan of %s failed: %v", lib.Name, err)
+			eventBus.Publish(EVENT_ERROR, map[string]interface{}{"source": "scan", "library": lib.Name, "message": err.Error()})
+			continue
+		}
+		log.Printf("Duration scan of %s finished: %d tracks probed (%d unreadable) in %s", lib.Name, probed, failed, time.Since(start).Round(time.Millisecond))
+		m.mu.Lock()
+		m.scanned[lib.Name] = time.Now()
+		m.mu.Unlock()
+		eventBus.Publish(EVENT_LIBRARY_SCANNED, map[string]interface{}{"library": lib.Name, "probed": probed, "failed": failed, "seconds": int(time.Since(start).Seconds())})
+	}
+}
+
+// run loads the manifest, scans once and then every DURATION_SCAN_INTERVAL
+func (m *trackManifest) run(ctx context.Context) {
+	if err := m.load(ctx); err != nil {
+		log.Printf("Failed to load manifest: %v", err)
+	}
+	if !durationScan {
+		return
+	}
+	m.scanAll(ctx)
+	if durationScanInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(durationScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.scanAll(ctx)
+		}
+	}
+}
+
+// probeObject reads the header (and for some formats the tail) of an object and measures it
+func probeObject(ctx context.Context, obj audioObject) (manifestEntry, error) {
+	head, err := s3GetRange(ctx, obj.Key, fmt.Sprintf("bytes=0-%d", PROBE_HEAD_BYTES-1))
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	var tail []byte
+	if probeNeedsTail(obj.Key) && obj.Size > PROBE_HEAD_BYTES {
+		if tail, err = s3GetRange(ctx, obj.Key, fmt.Sprintf("bytes=-%d", PROBE_TAIL_BYTES)); err != nil {
+			return manifestEntry{}, err
+		}
+	} else {
+		tail = head
+	}
+	info, err := probeAudio(obj.Key, head, tail, obj.Size)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	return manifestEntry{ETag: obj.ETag, Size: obj.Size, DurationMs: info.Duration.Milliseconds(), Bitrate: info.Bitrate}, nil
+}
+
+// handleManifestScan starts a background duration scan (POST /admin/manifest/scan)
+func handleManifestScan(c *gin.Context) {
+	if manifest.scanning.Load() {
+		c.JSON(http.StatusConflict, gin.H{"error": "scan already running"})
+		return
+	}
+	go manifest.scanAll(context.Background())
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+const DEFAULT_LOCALE = "en"
+
+// Message codes of user-facing messages. JSON API errors carry the code next to the
+// localized text, so clients can use their own translations.
+const (
+	MSG_ACC_DIR            = "acc_dir"
+	MSG_MIN_SEARCH         = "min_search"
+	MSG_SEARCH_TIMEOUT     = "search_timeout"
+	MSG_INVALID_REQUEST    = "invalid_request"
+	MSG_TRACK_REQUIRED     = "track_required"
+	MSG_TRACK_NOT_ALLOWED  = "track_not_allowed"
+	MSG_UNKNOWN_TRACK      = "unknown_track"
+	MSG_TRACK_NOT_RATED    = "track_not_rated"
+	MSG_RATING_RANGE       = "rating_range"
+	MSG_KIOSK_UNAVAILABLE  = "kiosk_unavailable"
+	MSG_SAVE_FAILED        = "save_failed"
+	MSG_INDEX_NOT_NUMBER   = "index_not_number"
+	MSG_INDEX_OUT_OF_RANGE = "index_out_of_range"
+	MSG_FROM_TO_REQUIRED   = "from_to_required"
+	MSG_QUEUE_FULL         = "queue_full"
+	MSG_ALREADY_QUEUED     = "already_queued"
+	MSG_GUEST_LIMIT        = "guest_limit"
+	MSG_KEYS_REQUIRED      = "keys_required"
+	MSG_FORMAT_INVALID     = "format_invalid"
+	MSG_LISTING_FAILED     = "listing_failed"
+	MSG_FOLDERS_FAILED     = "folders_failed"
+	MSG_INVALID_PATH       = "invalid_path"
+	MSG_INVALID_ENCODING   = "invalid_encoding"
+	MSG_INPUT_TOO_LONG     = "input_too_long"
+	MSG_TOO_MANY_FOLDERS   = "too_many_folders"
+	MSG_PARTY_NOT_FOUND    = "party_not_found"
+	MSG_PARTY_NOT_MEMBER   = "party_not_member"
+	MSG_PARTY_HOST_ONLY    = "party_host_only"
+	MSG_PARTY_FULL         = "party_full"
+	MSG_PARTY_LIMIT        = "party_limit"
+	MSG_PROTOCOL_INVALID   = "protocol_invalid"
+	MSG_CLIENT_OUTDATED    = "client_outdated"
+	MSG_SERVER_OUTDATED    = "server_outdated"
+	MSG_S3_QUOTA           = "s3_quota"
+	MSG_PLAYLIST_TOO_LARGE = "playlist_too_large"
+	MSG_PLAYLIST_NAME      = "playlist_name"
+	MSG_PLAYLIST_SIZE      = "playlist_size"
+	MSG_UNKNOWN_PLAYLIST   = "unknown_playlist"
+	MSG_UNKNOWN_LIBRARY    = "unknown_library"
+	MSG_LYRICS_FAILED      = "lyrics_failed"
+	MSG_NO_LYRICS          = "no_lyrics"
+	MSG_WAVEFORM_FFMPEG    = "waveform_ffmpeg"
+	MSG_WAVEFORM_FORMAT    = "waveform_format"
+	MSG_WAVEFORM_FAILED    = "waveform_failed"
+	MSG_UNKNOWN_ARTIST     = "unknown_artist"
+	MSG_TAG_SEARCH_OFF     = "tag_search_off"
+	MSG_CAST_UNKNOWN       = "cast_unknown"
+	MSG_CAST_FAILED        = "cast_failed"
+	MSG_CAST_IDLE          = "cast_idle"
+	MSG_CAST_ACTION        = "cast_action"
+	MSG_CAST_POSITION      = "cast_position"
+	MSG_CAST_VOLUME        = "cast_volume"
+)
+
+// messageCatalog holds a bundle per locale; missing entries fall back to English
+var messageCatalog = map[string]map[string]string{
+	"en": {
+		MSG_ACC_DIR:            "Server is unable to access the directory.",
+		MSG_MIN_SEARCH:         "Minimum search characters: %d",
+		MSG_SEARCH_TIMEOUT:     "Search took too long, try a more specific query.",
+		MSG_INVALID_REQUEST:    "invalid request",
+		MSG_TRACK_REQUIRED:     "track required",
+		MSG_TRACK_NOT_ALLOWED:  "track not allowed",
+		MSG_UNKNOWN_TRACK:      "unknown track",
+		MSG_TRACK_NOT_RATED:    "track not rated",
+		MSG_RATING_RANGE:       "rating must be 1 to 5 stars, or 0 to clear",
+		MSG_KIOSK_UNAVAILABLE:  "not available in kiosk mode",
+		MSG_SAVE_FAILED:        "saving failed, try again later",
+		MSG_INDEX_NOT_NUMBER:   "index must be a number",
+		MSG_INDEX_OUT_OF_RANGE: "index out of range",
+		MSG_FROM_TO_REQUIRED:   "from and to required",
+		MSG_QUEUE_FULL:         "the queue holds at most %d tracks",
+		MSG_ALREADY_QUEUED:     "already queued",
+		MSG_GUEST_LIMIT:        "you already have %d tracks queued",
+		MSG_KEYS_REQUIRED:      "keys required, at most %d",
+		MSG_FORMAT_INVALID:     "format must be ndjson or json",
+		MSG_LISTING_FAILED:     "listing failed",
+		MSG_FOLDERS_FAILED:     "%d of %d folders could not be listed",
+		MSG_INVALID_PATH:       "%s must be a relative path without . or .. segments",
+		MSG_INVALID_ENCODING:   "%s is not valid UTF-8",
+		MSG_INPUT_TOO_LONG:     "%s is longer than %d bytes",
+		MSG_TOO_MANY_FOLDERS:   "at most %d folders can be selected",
+		MSG_PARTY_NOT_FOUND:    "no party session with this code",
+		MSG_PARTY_NOT_MEMBER:   "join the party session first",
+		MSG_PARTY_HOST_ONLY:    "only the host can do this",
+		MSG_PARTY_FULL:         "the party session has %d members already",
+		MSG_PARTY_LIMIT:        "at most %d party sessions can be open",
+		MSG_PROTOCOL_INVALID:   "invalid protocol version %q",
+		MSG_CLIENT_OUTDATED:    "this page speaks protocol version %s, the server %d: reload the page to update the player",
+		MSG_SERVER_OUTDATED:    "this page speaks protocol version %s, but the server only %d: the server needs an update",
+		MSG_S3_QUOTA:           "The daily S3 call quota is used up; library-wide scans resume at midnight UTC.",
+		MSG_PLAYLIST_TOO_LARGE: "playlist files are limited to %d bytes",
+		MSG_PLAYLIST_NAME:      "a playlist name of at most %d bytes is required",
+		MSG_PLAYLIST_SIZE:      "a playlist needs 1 to %d entries",
+		MSG_UNKNOWN_PLAYLIST:   "unknown playlist",
+		MSG_UNKNOWN_LIBRARY:    "unknown library",
+		MSG_LYRICS_FAILED:      "reading lyrics failed",
+		MSG_NO_LYRICS:          "no lyrics",
+		MSG_WAVEFORM_FFMPEG:    "waveforms need ffmpeg on the server",
+		MSG_WAVEFORM_FORMAT:    "format must be json or binary",
+		MSG_WAVEFORM_FAILED:    "waveform generation failed",
+		MSG_UNKNOWN_ARTIST:     "no tracks by this artist",
+		MSG_TAG_SEARCH_OFF:     "Searching by artist, album, genre, title or year needs the tag scan (TAG_SCAN).",
+		MSG_CAST_UNKNOWN:       "no cast device with this id on the network",
+		MSG_CAST_FAILED:        "the cast device did not accept the request",
+		MSG_CAST_IDLE:          "nothing is loaded on the cast device",
+		MSG_CAST_ACTION:        "action must be play, pause, stop, next, previous, seek or volume",
+		MSG_CAST_POSITION:      "seek needs a position in seconds",
+		MSG_CAST_VOLUME:        "volume must be 0 to 100",
+	},
+	"de": {
+		MSG_ACC_DIR:            "Der Server kann nicht auf das Verzeichnis zugreifen.",
+		MSG_MIN_SEARCH:         "Mindestanzahl Suchzeichen: %d",
+		MSG_SEARCH_TIMEOUT:     "Die Suche hat zu lange gedauert, bitte genauer suchen.",
+		MSG_INVALID_REQUEST:    "ungültige Anfrage",
+		MSG_TRACK_REQUIRED:     "Titel erforderlich",
+		MSG_TRACK_NOT_ALLOWED:  "Titel nicht erlaubt",
+		MSG_UNKNOWN_TRACK:      "unbekannter Titel",
+		MSG_TRACK_NOT_RATED:    "Titel nicht bewertet",
+		MSG_RATING_RANGE:       "Bewertung muss 1 bis 5 Sterne sein, 0 löscht sie",
+		MSG_KIOSK_UNAVAILABLE:  "im Kiosk-Modus nicht verfügbar",
+		MSG_SAVE_FAILED:        "Speichern fehlgeschlagen, bitte später erneut versuchen",
+		MSG_INDEX_NOT_NUMBER:   "Index muss eine Zahl sein",
+		MSG_INDEX_OUT_OF_RANGE: "Index außerhalb des Bereichs",
+		MSG_FROM_TO_REQUIRED:   "from und to erforderlich",
+		MSG_QUEUE_FULL:         "Die Warteschlange fasst höchstens %d Titel",
+		MSG_ALREADY_QUEUED:     "bereits in der Warteschlange",
+		MSG_GUEST_LIMIT:        "Du hast bereits %d Titel in der Warteschlange",
+		MSG_KEYS_REQUIRED:      "keys erforderlich, höchstens %d",
+		MSG_FORMAT_INVALID:     "format muss ndjson oder json sein",
+		MSG_LISTING_FAILED:     "Auflistung fehlgeschlagen",
+		MSG_FOLDERS_FAILED:     "%d von %d Ordnern konnten nicht aufgelistet werden",
+		MSG_INVALID_PATH:       "%s muss ein relativer Pfad ohne . oder .. sein",
+		MSG_INVALID_ENCODING:   "%s ist kein gültiges UTF-8",
+		MSG_INPUT_TOO_LONG:     "%s ist länger als %d Bytes",
+		MSG_TOO_MANY_FOLDERS:   "höchstens %d Ordner können ausgewählt werden",
+		MSG_PARTY_NOT_FOUND:    "keine Party-Sitzung mit diesem Code",
+		MSG_PARTY_NOT_MEMBER:   "bitte zuerst der Party-Sitzung beitreten",
+		MSG_PARTY_HOST_ONLY:    "nur der Gastgeber kann das",
+		MSG_PARTY_FULL:         "die Party-Sitzung hat bereits %d Mitglieder",
+		MSG_PARTY_LIMIT:        "höchstens %d Party-Sitzungen können offen sein",
+		MSG_PROTOCOL_INVALID:   "ungültige Protokollversion %q",
+		MSG_CLIENT_OUTDATED:    "diese Seite spricht Protokollversion %s, der Server %d: bitte die Seite neu laden, um den Player zu aktualisieren",
+		MSG_SERVER_OUTDATED:    "diese Seite spricht Protokollversion %s, der Server nur %d: der Server muss aktualisiert werden",
+		MSG_S3_QUOTA:           "Das tägliche S3-Kontingent ist aufgebraucht; Durchläufe über die ganze Bibliothek sind ab Mitternacht UTC wieder möglich.",
+		MSG_PLAYLIST_TOO_LARGE: "Playlist-Dateien dürfen höchstens %d Bytes groß sein",
+		MSG_PLAYLIST_NAME:      "ein Playlist-Name mit höchstens %d Bytes ist erforderlich",
+		MSG_PLAYLIST_SIZE:      "eine Playlist braucht 1 bis %d Einträge",
+		MSG_UNKNOWN_PLAYLIST:   "unbekannte Playlist",
+		MSG_UNKNOWN_LIBRARY:    "unbekannte Bibliothek",
+		MSG_LYRICS_FAILED:      "Liedtext konnte nicht gelesen werden",
+		MSG_NO_LYRICS:          "kein Liedtext",
+		MSG_WAVEFORM_FFMPEG:    "Wellenformen brauchen ffmpeg auf dem Server",
+		MSG_WAVEFORM_FORMAT:    "format muss json oder binary sein",
+		MSG_WAVEFORM_FAILED:    "Wellenform konnte nicht erzeugt werden",
+		MSG_UNKNOWN_ARTIST:     "keine Titel von diesem Künstler",
+		MSG_TAG_SEARCH_OFF:     "Die Suche nach Künstler, Album, Genre, Titel oder Jahr braucht den Tag-Scan (TAG_SCAN).",
+		MSG_CAST_UNKNOWN:       "kein Cast-Gerät mit dieser ID im Netzwerk",
+		MSG_CAST_FAILED:        "das Cast-Gerät hat die Anfrage nicht angenommen",
+		MSG_CAST_IDLE:          "auf dem Cast-Gerät ist nichts geladen",
+		MSG_CAST_ACTION:        "action muss play, pause, stop, next, previous, seek oder volume sein",
+		MSG_CAST_POSITION:      "seek braucht eine Position in Sekunden",
+		MSG_CAST_VOLUME:        "volume muss 0 bis 100 sein",
+	},
+}
+
+// localeMatcher picks the best catalog for an Accept-Language header; English comes
+// first so it is the fallback
+var localeMatcher = language.NewMatcher([]language.Tag{language.English, language.German})
+
+// requestLocale selects the catalog from ?lang=, the lang cookie or Accept-Language
+func requestLocale(c *gin.Context) string {
+	lang := c.Query("lang")
+	if lang == "" {
+		lang, _ = c.Cookie("lang")
+	}
+	if lang == "" {
+		lang = c.GetHeader("Accept-Language")
+	}
+	tags, _, _ := language.ParseAcceptLanguage(lang)
+	tag, _, _ := localeMatcher.Match(tags...)
+	base, _ := tag.Base()
+	if _, ok := messageCatalog[base.String()]; ok {
+		return base.String()
+	}
+	return DEFAULT_LOCALE
+}
+
+// message formats the message of code in locale
+func message(locale, code string, args ...interface{}) string {
+	format, ok := messageCatalog[locale][code]
+	if !ok {
+		format = messageCatalog[DEFAULT_LOCALE][code]
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// msg returns the message of code in the request's locale
+func msg(c *gin.Context, code string, args ...interface{}) string {
+	return message(requestLocale(c), code, args...)
+}
+
+// apiError answers a JSON API request with the localized message and its code
+func apiError(c *gin.Context, status int, code string, args ...interface{}) {
+	c.JSON(status, gin.H{"error": msg(c, code, args...), "code": code})
+}
+
+// userError is a request error that is reported to the client in its language
+type userError struct {
+	code string
+	args []interface{}
+}
+
+func newUserError(code string, args ...interface{}) userError {
+	return userError{code: code, args: args}
+}
+
+func (e userError) Error() string {
+	return message(DEFAULT_LOCALE, e.code, e.args...)
+}
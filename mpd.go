@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MPD_VERSION         = "0.19.0" // clients then send the find/search syntax implemented here
+	MPD_MAX_CONNECTIONS = 50
+	MPD_MAX_LINE        = 64 << 10
+	MPD_MAX_LIST        = 1000 // commands in one command list
+	MPD_TIMEOUT         = 5 * time.Minute
+
+	// ACK error codes of the protocol
+	ACK_ERROR_ARG          = 2
+	ACK_ERROR_PASSWORD     = 3
+	ACK_ERROR_PERMISSION   = 4
+	ACK_ERROR_UNKNOWN      = 5
+	ACK_ERROR_NO_EXIST     = 50
+	ACK_ERROR_PLAYLIST_MAX = 51
+	ACK_ERROR_SYSTEM       = 52
+)
+
+// MPD_LISTEN (e.g. ":6600") serves a subset of the Music Player Daemon protocol for
+// clients such as ncmpcpp and MALP. They browse and search the default library and
+// control the kiosk jukebox: its shared queue is the MPD playlist and the big screen at
+// /kiosk plays it. Like kiosk guests, anyone may browse and add tracks; skipping, pausing,
+// removing and clearing need the password command with ADMIN_TOKEN. IP_ALLOW and IP_DENY
+// apply to connections.
+var mpdListen = os.Getenv("MPD_LISTEN")
+
+func initMPD() error {
+	if mpdListen != "" && !kioskMode {
+		return fmt.Errorf("MPD_LISTEN needs KIOSK_MODE=true")
+	}
+	return nil
+}
+
+// mpdError is answered as "ACK [code@index] {command} message"
+type mpdError struct {
+	code int
+	msg  string
+}
+
+func (e mpdError) Error() string { return e.msg }
+
+var errMPDClose = errors.New("close")
+
+// mpdConn is one client connection
+type mpdConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	admin  bool
+	client string
+}
+
+// runMPD accepts MPD clients until ctx is done
+func runMPD(ctx context.Context) {
+	ln, err := net.Listen("tcp", mpdListen)
+	if err != nil {
+		log.Printf("MPD listener failed: %v", err)
+		return
+	}
+	log.Printf("MPD protocol listening on %s", ln.Addr())
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	sem := make(chan struct{}, MPD_MAX_CONNECTIONS)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("MPD accept error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !ipAllowed(host) {
+			conn.Close()
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			conn.Close() // too many clients
+			continue
+		}
+		go func() {
+			defer func() { <-sem }()
+			mc := &mpdConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), client: "mpd:" + host}
+			mc.serve(withLibrary(ctx, defaultLibrary()))
+		}()
+	}
+}
+
+// serve answers the commands of one connection until it closes
+func (mc *mpdConn) serve(ctx context.Context) {
+	defer mc.conn.Close()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := mc.readLine()
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	fmt.Fprintf(mc.w, "OK MPD %s\n", MPD_VERSION)
+	var list []string
+	inList, listOK := false, false
+	for mc.w.Flush() == nil {
+		mc.conn.SetReadDeadline(time.Now().Add(MPD_TIMEOUT))
+		line, ok := <-lines
+		switch {
+		case !ok:
+			return
+		case line == "noidle":
+			continue // idle already ended
+		case line == "command_list_begin" || line == "command_list_ok_begin":
+			inList, listOK, list = true, line == "command_list_ok_begin", nil
+			continue
+		case inList && line == "command_list_end":
+			inList = false
+		case inList:
+			if len(list) < MPD_MAX_LIST {
+				list = append(list, line)
+			}
+			continue
+		default:
+			list, listOK = []string{line}, false
+		}
+		for i, l := range list {
+			cmd, args, err := parseMPDLine(l)
+			if err == nil {
+				if cmd == "idle" && len(list) == 1 {
+					err = mc.idle(args, lines)
+				} else {
+					err = mc.exec(ctx, cmd, args)
+				}
+			}
+			if err == errMPDClose {
+				mc.w.Flush()
+				return
+			}
+			if err != nil {
+				var me mpdError
+				if !errors.As(err, &me) {
+					me = mpdError{ACK_ERROR_SYSTEM, err.Error()}
+				}
+				fmt.Fprintf(mc.w, "ACK [%d@%d] {%s} %s\n", me.code, i, cmd, me.msg)
+				break
+			}
+			if listOK {
+				mc.w.WriteString("list_OK\n")
+			}
+			if i == len(list)-1 {
+				mc.w.WriteString("OK\n")
+			}
+		}
+	}
+}
+
+// readLine reads one command line without its line ending
+func (mc *mpdConn) readLine() (string, error) {
+	var b []byte
+	for {
+		part, isPrefix, err := mc.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if b = append(b, part...); len(b) > MPD_MAX_LINE {
+			return "", errors.New("line too long")
+		}
+		if !isPrefix {
+			return string(b), nil
+		}
+	}
+}
+
+// parseMPDLine splits a command line into the command and its arguments, which may be
+// double-quoted with backslash escapes
+func parseMPDLine(line string) (string, []string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		switch line[i] {
+		case ' ', '\t':
+			i++
+		case '"':
+			var b strings.Builder
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				b.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return "", nil, mpdError{ACK_ERROR_ARG, "Missing closing '\"'"}
+			}
+			i++
+			args = append(args, b.String())
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' {
+				j++
+			}
+			args = append(args, line[i:j])
+			i = j
+		}
+	}
+	if len(args) == 0 {
+		return "", nil, mpdError{ACK_ERROR_UNKNOWN, "No command given"}
+	}
+	return args[0], args[1:], nil
+}
+
+// idle waits for a change of the queue or player, or for noidle from the client
+func (mc *mpdConn) idle(subsystems []string, lines <-chan string) error {
+	var reported []string
+	for _, s := range []string{"playlist", "player", "mixer"} {
+		if len(subsystems) == 0 || contains(subsystems, s) {
+			reported = append(reported, s)
+		}
+	}
+	var changed <-chan struct{} // nil when nothing this server changes was asked for
+	if len(reported) > 0 {
+		changed = kiosk.watch()
+	}
+	mc.conn.SetReadDeadline(time.Time{})
+	select {
+	case <-changed:
+		for _, s := range reported {
+			mc.pair("changed", s)
+		}
+		return nil
+	case line, ok := <-lines:
+		if !ok {
+			return errMPDClose
+		}
+		if line != "noidle" {
+			return mpdError{ACK_ERROR_ARG, "Only noidle is allowed while idle"}
+		}
+		return nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mpdAdminCommands change the jukebox beyond adding tracks
+var mpdAdminCommands = map[string]bool{
+	"next": true, "pause": true, "play": true, "playid": true, "stop": true, "setvol": true,
+	"delete": true, "deleteid": true, "clear": true,
+}
+
+// mpdCommandNames are the commands exec knows, for the commands command
+var mpdCommandNames = []string{
+	"add", "addid", "clear", "close", "commands", "currentsong", "delete", "deleteid",
+	"find", "idle", "list", "listall", "listallinfo", "listplaylists", "lsinfo", "next",
+	"noidle", "notcommands", "outputs", "password", "pause", "ping", "play", "playid",
+	"playlistid", "playlistinfo", "plchanges", "plchangesposid", "search", "setvol", "stats",
+	"status", "stop", "tagtypes",
+}
+
+// exec runs one command, writing its answer lines but not the final OK. Clients without
+// the password browse like requests without an API key.
+func (mc *mpdConn) exec(ctx context.Context, cmd string, args []string) error {
+	if mpdAdminCommands[cmd] && !mc.admin {
+		return mpdError{ACK_ERROR_PERMISSION, "you don't have permission for \"" + cmd + "\""}
+	}
+	if allowed, ok := anonymousAccess(); ok && !mc.admin {
+		ctx = withAccess(ctx, allowed)
+	}
+	switch cmd {
+	case "ping", "noidle", "binarylimit":
+		return nil
+	case "close":
+		return errMPDClose
+	case "password":
+		if len(args) != 1 {
+			return mpdError{ACK_ERROR_ARG, "wrong number of arguments"}
+		}
+		if !isAdminToken(args[0]) {
+			return mpdError{ACK_ERROR_PASSWORD, "incorrect password"}
+		}
+		mc.admin = true
+		return nil
+	case "commands":
+		for _, name := range mpdCommandNames {
+			if !mpdAdminCommands[name] || mc.admin {
+				mc.pair("command", name)
+			}
+		}
+		return nil
+	case "notcommands":
+		if !mc.admin {
+			for _, name := range mpdCommandNames {
+				if mpdAdminCommands[name] {
+					mc.pair("command", name)
+				}
+			}
+		}
+		return nil
+	case "tagtypes":
+		if len(args) == 0 {
+			mc.pair("tagtype", "Title")
+		}
+		return nil
+	case "outputs":
+		mc.pair("outputid", "0")
+		mc.pair("outputname", "kiosk screen")
+		mc.pair("outputenabled", "1")
+		return nil
+	case "listplaylists":
+		return nil
+	case "stats":
+		mc.pair("uptime", strconv.Itoa(int(time.Since(startTime).Seconds())))
+		mc.pair("playtime", "0")
+		mc.pair("db_update", strconv.FormatInt(startTime.Unix(), 10))
+		return nil
+	case "status":
+		return mc.status()
+	case "currentsong":
+		items, playing, _, _ := kioskPlaylist()
+		if playing {
+			mc.queued(ctx, items[:1], 0)
+		}
+		return nil
+	case "playlistinfo", "playlistid", "plchanges", "plchangesposid":
+		return mc.playlist(ctx, cmd, args)
+	case "lsinfo":
+		return mc.lsinfo(ctx, firstArg(args))
+	case "listall", "listallinfo":
+		return mc.listall(ctx, firstArg(args), cmd == "listallinfo")
+	case "find", "search":
+		return mc.find(ctx, args, cmd == "search")
+	case "list":
+		if len(args) == 0 {
+			return mpdError{ACK_ERROR_ARG, "too few arguments for \"list\""}
+		}
+		if strings.EqualFold(args[0], "file") {
+			return mc.listall(ctx, "", false)
+		}
+		return nil // no tag index: artists, albums and genres are unknown
+	case "add", "addid":
+		if len(args) == 0 {
+			return mpdError{ACK_ERROR_ARG, "wrong number of arguments"}
+		}
+		return mc.add(ctx, args[0], cmd == "addid")
+	case "delete":
+		items, _, _, _ := kioskPlaylist()
+		start, end, err := mpdRange(firstArg(args), len(items))
+		if err != nil {
+			return err
+		}
+		for _, item := range items[start:end] {
+			kiosk.remove(item.ID)
+		}
+		return nil
+	case "deleteid":
+		id, err := strconv.Atoi(firstArg(args))
+		if err != nil || !kiosk.remove(id) {
+			return mpdError{ACK_ERROR_NO_EXIST, "No such song"}
+		}
+		return nil
+	case "clear":
+		kiosk.clear()
+		kiosk.stop()
+		return nil
+	case "play", "playid":
+		return mc.play(cmd, args)
+	case "pause":
+		if len(args) == 0 {
+			items, playing, paused, _ := kioskPlaylist()
+			kiosk.setPaused(playing && len(items) > 0 && !paused)
+			return nil
+		}
+		kiosk.setPaused(args[0] == "1")
+		return nil
+	case "stop":
+		kiosk.stop()
+		return nil
+	case "setvol":
+		v, err := strconv.Atoi(firstArg(args))
+		if err != nil || v < 0 || v > 100 {
+			return mpdError{ACK_ERROR_ARG, "Invalid volume value"}
+		}
+		kiosk.setVolume(v)
+		return nil
+	case "next":
+		kioskStarted(kiosk.next())
+		return nil
+	}
+	return mpdError{ACK_ERROR_UNKNOWN, "unknown command \"" + cmd + "\""}
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// pair writes one "key: value" answer line
+func (mc *mpdConn) pair(key, value string) {
+	mc.w.WriteString(key + ": " + strings.NewReplacer("\n", " ", "\r", " ").Replace(value) + "\n")
+}
+
+// song writes the lines describing one track
+func (mc *mpdConn) song(key string, duration int) {
+	mc.pair("file", key)
+	mc.pair("Title", strings.TrimSuffix(path.Base(key), path.Ext(key)))
+	if duration > 0 {
+		mc.pair("Time", strconv.Itoa(duration))
+		mc.pair("duration", strconv.Itoa(duration))
+	}
+}
+
+// songs writes the lines of tracks of the context's library
+func (mc *mpdConn) songs(ctx context.Context, keys []string) {
+	durations := manifest.durations(libraryFrom(ctx), keys)
+	for i, key := range keys {
+		mc.song(key, durations[i])
+	}
+}
+
+// kioskPlaylist returns the playing track followed by the queue, as MPD clients see it
+func kioskPlaylist() (items []kioskItem, playing, paused bool, version int) {
+	kiosk.mu.Lock()
+	defer kiosk.mu.Unlock()
+	if kiosk.playing != nil {
+		items = append(items, *kiosk.playing)
+	}
+	items = append(items, kiosk.queue...)
+	return items, kiosk.playing != nil, kiosk.paused, kiosk.version
+}
+
+// queued writes the playlist entries items, the first at position pos
+func (mc *mpdConn) queued(ctx context.Context, items []kioskItem, pos int) {
+	for i, item := range items {
+		d := 0
+		if lib := findLibrary(item.Library); lib != nil {
+			d = manifest.durations(lib, []string{item.Track})[0]
+		}
+		mc.song(item.Track, d)
+		mc.pair("Pos", strconv.Itoa(pos+i))
+		mc.pair("Id", strconv.Itoa(item.ID))
+	}
+}
+
+func (mc *mpdConn) status() error {
+	items, playing, paused, version := kioskPlaylist()
+	kiosk.mu.Lock()
+	volume := kiosk.volume
+	kiosk.mu.Unlock()
+	for _, kv := range [][2]string{{"volume", strconv.Itoa(volume)}, {"repeat", "0"}, {"random", "0"}, {"single", "0"}, {"consume", "1"}} {
+		mc.pair(kv[0], kv[1])
+	}
+	mc.pair("playlist", strconv.Itoa(version))
+	mc.pair("playlistlength", strconv.Itoa(len(items)))
+	state := "stop"
+	if playing {
+		state = "play"
+		if paused {
+			state = "pause"
+		}
+	}
+	mc.pair("state", state)
+	if playing {
+		elapsed := kiosk.elapsed().Seconds()
+		mc.pair("song", "0")
+		mc.pair("songid", strconv.Itoa(items[0].ID))
+		d := 0
+		if lib := findLibrary(items[0].Library); lib != nil {
+			d = manifest.durations(lib, []string{items[0].Track})[0]
+		}
+		mc.pair("time", fmt.Sprintf("%d:%d", int(elapsed), d))
+		mc.pair("elapsed", strconv.FormatFloat(elapsed, 'f', 3, 64))
+		if d > 0 {
+			mc.pair("duration", strconv.Itoa(d))
+		}
+	}
+	if next := 0; playing && len(items) > 1 || !playing && len(items) > 0 {
+		if playing {
+			next = 1
+		}
+		mc.pair("nextsong", strconv.Itoa(next))
+		mc.pair("nextsongid", strconv.Itoa(items[next].ID))
+	}
+	return nil
+}
+
+// mpdRange parses a position or START:END range of a list of n entries
+func mpdRange(arg string, n int) (int, int, error) {
+	if arg == "" {
+		return 0, n, nil
+	}
+	s, e, isRange := strings.Cut(arg, ":")
+	start, err := strconv.Atoi(s)
+	end := start + 1
+	if err == nil && isRange {
+		if e == "" {
+			end = n
+		} else {
+			end, err = strconv.Atoi(e)
+		}
+	}
+	if err != nil || start < 0 || end < start {
+		return 0, 0, mpdError{ACK_ERROR_ARG, "Bad song index"}
+	}
+	if start >= n && n > 0 || (n == 0 && start > 0) {
+		return 0, 0, mpdError{ACK_ERROR_ARG, "Bad song index"}
+	}
+	return start, min(end, n), nil
+}
+
+func (mc *mpdConn) playlist(ctx context.Context, cmd string, args []string) error {
+	items, _, _, version := kioskPlaylist()
+	switch cmd {
+	case "playlistid":
+		if len(args) == 0 {
+			mc.queued(ctx, items, 0)
+			return nil
+		}
+		id, _ := strconv.Atoi(args[0])
+		for i, item := range items {
+			if item.ID == id {
+				mc.queued(ctx, items[i:i+1], i)
+				return nil
+			}
+		}
+		return mpdError{ACK_ERROR_NO_EXIST, "No such song"}
+	case "plchanges", "plchangesposid":
+		if v, err := strconv.Atoi(firstArg(args)); err == nil && v == version {
+			return nil
+		}
+		if cmd == "plchangesposid" {
+			for i, item := range items {
+				mc.pair("cpos", strconv.Itoa(i))
+				mc.pair("Id", strconv.Itoa(item.ID))
+			}
+			return nil
+		}
+		mc.queued(ctx, items, 0)
+		return nil
+	}
+	start, end, err := mpdRange(firstArg(args), len(items))
+	if err != nil {
+		return err
+	}
+	mc.queued(ctx, items[start:end], start)
+	return nil
+}
+
+// lsinfo lists the folders and tracks of a folder, or describes one track
+func (mc *mpdConn) lsinfo(ctx context.Context, uri string) error {
+	uri = strings.Trim(uri, "/")
+	if isAudioFile(uri) {
+		if !isListed(uri, false) || !folderVisible(ctx, uri, false) {
+			return mpdError{ACK_ERROR_NO_EXIST, "No such file"}
+		}
+		if _, _, _, err := s3HeadAudioFile(ctx, uri); err != nil {
+			return mpdError{ACK_ERROR_NO_EXIST, "No such file"}
+		}
+		mc.songs(ctx, []string{uri})
+		return nil
+	}
+	dir := uri
+	if dir != "" {
+		dir += "/"
+	}
+	if isMetaDir(uri) || !kioskVisible(dir, true) || !folderVisible(ctx, dir, true) {
+		return mpdError{ACK_ERROR_NO_EXIST, "No such directory"}
+	}
+	dirs, files, err := s3List(ctx, dir, "/")
+	if err != nil {
+		log.Printf("MPD list error: %v", err)
+		return mpdError{ACK_ERROR_SYSTEM, "listing failed"}
+	}
+	for _, d := range dirs {
+		mc.pair("directory", dir+d)
+	}
+	var keys []string
+	for _, f := range files {
+		if isAudioFile(f) && streamPolicy(dir+f) != STREAM_BLOCK {
+			keys = append(keys, dir+f)
+		}
+	}
+	mc.songs(ctx, keys)
+	return nil
+}
+
+// walkTracks lists every track under prefix, within the daily S3 quota
+func walkTracks(ctx context.Context, prefix string) ([]string, error) {
+	ctx, err := s3Meter.guardScan(ctx, "mpd")
+	if err != nil {
+		return nil, mpdError{ACK_ERROR_SYSTEM, message(DEFAULT_LOCALE, MSG_S3_QUOTA)}
+	}
+	keys, err := s3ListAllTracks(ctx, prefix)
+	if err != nil {
+		log.Printf("MPD walk error: %v", err)
+		return nil, mpdError{ACK_ERROR_SYSTEM, "listing failed"}
+	}
+	out := keys[:0:0]
+	for _, k := range keys {
+		if kioskVisible(k, false) && streamPolicy(k) != STREAM_BLOCK {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+// listall lists the folders and tracks below uri, with track details for listallinfo
+func (mc *mpdConn) listall(ctx context.Context, uri string, info bool) error {
+	prefix := strings.Trim(uri, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	keys, err := walkTracks(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		// Folders before their tracks, as MPD lists them
+		for dir := path.Dir(key); dir != "." && len(dir) >= len(prefix) && !seen[dir]; dir = path.Dir(dir) {
+			seen[dir] = true
+		}
+	}
+	dirs := make([]string, 0, len(seen))
+	for d := range seen {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	for _, d := range dirs {
+		mc.pair("directory", d)
+	}
+	if info {
+		mc.songs(ctx, keys)
+		return nil
+	}
+	for _, key := range keys {
+		mc.pair("file", key)
+	}
+	return nil
+}
+
+// find answers find (exact) and search (case-insensitive substring) with TYPE VALUE
+// pairs. Without a tag index only file, title, any and base can match.
+func (mc *mpdConn) find(ctx context.Context, args []string, substring bool) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		if len(args) > 0 && strings.HasPrefix(args[0], "(") {
+			return mpdError{ACK_ERROR_ARG, "filter expressions are not supported"}
+		}
+		return mpdError{ACK_ERROR_ARG, "incorrect arguments"}
+	}
+	prefix := ""
+	type filter struct{ tag, value string }
+	var filters []filter
+	for i := 0; i < len(args); i += 2 {
+		tag := strings.ToLower(args[i])
+		switch tag {
+		case "base":
+			if prefix = strings.Trim(args[i+1], "/"); prefix != "" {
+				prefix += "/"
+			}
+		case "file", "filename", "title", "any":
+			filters = append(filters, filter{tag, args[i+1]})
+		default:
+			return nil // tags this server doesn't know never match
+		}
+	}
+	keys, err := walkTracks(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	match := func(have, want string) bool {
+		if substring {
+			return strings.Contains(strings.ToLower(have), strings.ToLower(want))
+		}
+		return have == want
+	}
+	var found []string
+	for _, key := range keys {
+		title := strings.TrimSuffix(path.Base(key), path.Ext(key))
+		ok := true
+		for _, f := range filters {
+			switch f.tag {
+			case "file", "filename":
+				ok = match(key, f.value)
+			case "title":
+				ok = match(title, f.value)
+			default:
+				ok = match(key, f.value) || match(title, f.value)
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			if found = append(found, key); len(found) >= maxSearchResult {
+				break
+			}
+		}
+	}
+	mc.songs(ctx, found)
+	return nil
+}
+
+// add queues a track, or every track of a folder, as a kiosk guest would
+func (mc *mpdConn) add(ctx context.Context, uri string, withID bool) error {
+	uri = strings.Trim(uri, "/")
+	keys := []string{uri}
+	if !isAudioFile(uri) {
+		if withID {
+			return mpdError{ACK_ERROR_ARG, "addid takes a track"}
+		}
+		prefix := uri
+		if prefix != "" {
+			prefix += "/"
+		}
+		var err error
+		if keys, err = walkTracks(ctx, prefix); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return mpdError{ACK_ERROR_NO_EXIST, "No such directory"}
+		}
+		sortNames(keys)
+	} else if !isListed(uri, false) || !folderVisible(ctx, uri, false) || streamPolicy(uri) == STREAM_BLOCK {
+		return mpdError{ACK_ERROR_NO_EXIST, "No such file"}
+	} else if _, _, _, err := s3HeadAudioFile(ctx, uri); err != nil {
+		return mpdError{ACK_ERROR_NO_EXIST, "No such file"}
+	}
+	lib := libraryFrom(ctx)
+	for _, key := range keys {
+		_, err := kiosk.add(kioskItem{Track: key, Library: lib.Name, URL: audioURL(lib, key, nil), Added: time.Now().UTC(), client: mc.client})
+		if ue, ok := err.(userError); ok {
+			if ue.code == MSG_ALREADY_QUEUED && len(keys) > 1 {
+				continue
+			}
+			return mpdError{ACK_ERROR_PLAYLIST_MAX, message(DEFAULT_LOCALE, ue.code, ue.args...)}
+		}
+		if withID {
+			items, _, _, _ := kioskPlaylist()
+			mc.pair("Id", strconv.Itoa(items[len(items)-1].ID))
+		}
+	}
+	return nil
+}
+
+// play resumes or starts the jukebox; a position or ID other than the playing track is
+// moved to the head of the queue and started
+func (mc *mpdConn) play(cmd string, args []string) error {
+	items, playing, _, _ := kioskPlaylist()
+	if len(args) == 0 || (cmd == "playid" && args[0] == "-1") {
+		kioskStarted(kiosk.play())
+		return nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return mpdError{ACK_ERROR_ARG, "need an integer"}
+	}
+	index := -1
+	for i, item := range items {
+		if (cmd == "play" && i == n) || (cmd == "playid" && item.ID == n) {
+			index = i
+		}
+	}
+	switch {
+	case index < 0:
+		return mpdError{ACK_ERROR_NO_EXIST, "No such song"}
+	case index == 0 && playing:
+		kiosk.play()
+	default:
+		kiosk.promote(items[index].ID)
+		kioskStarted(kiosk.next())
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	NORMALIZE_TIMEOUT     = 5 * time.Minute
+	MAX_NORMALIZE_RENAMES = 500 // renames applied per request
+)
+
+// Naming rules, applied to every path component; bitrate tags only to file names
+var (
+	featRe       = regexp.MustCompile(`(?i)\b(?:ft|feat|featuring)\b\.?\s+`)
+	bitrateTagRe = regexp.MustCompile(`(?i)\s*(?:[\[(]\s*\d{2,3}\s*(?:kbps|kbit/s|k)\s*[\])]|-\s*\d{2,3}\s*kbps)$`)
+	spacesRe     = regexp.MustCompile(`\s{2,}`)
+)
+
+// normalizeComponent returns the normalized form of one path component and the rules that changed it
+func normalizeComponent(name string, isFile bool) (string, []string) {
+	var rules []string
+	apply := func(rule, next string) {
+		if next != name {
+			name = next
+			rules = append(rules, rule)
+		}
+	}
+	ext := ""
+	if isFile {
+		ext = path.Ext(name)
+		name = strings.TrimSuffix(name, ext)
+	}
+	apply("unicode", norm.NFC.String(name))
+	if !strings.Contains(name, " ") {
+		apply("underscores", strings.ReplaceAll(name, "_", " "))
+	}
+	apply("feat", featRe.ReplaceAllString(name, "feat. "))
+	if isFile {
+		apply("bitrate tag", bitrateTagRe.ReplaceAllString(name, ""))
+	}
+	apply("spacing", strings.TrimSpace(spacesRe.ReplaceAllString(name, " ")))
+	if name == "" {
+		return "", nil // a rule would empty the name, leave it alone
+	}
+	return name + ext, rules
+}
+
+// normalizeKey normalizes every component of a library-relative key
+func normalizeKey(key string) (string, []string) {
+	parts := strings.Split(key, "/")
+	var rules []string
+	seen := make(map[string]bool)
+	for i, part := range parts {
+		norm, changed := normalizeComponent(part, i == len(parts)-1)
+		if norm == "" {
+			continue
+		}
+		parts[i] = norm
+		for _, r := range changed {
+			if !seen[r] {
+				seen[r] = true
+				rules = append(rules, r)
+			}
+		}
+	}
+	return strings.Join(parts, "/"), rules
+}
+
+// renameProposal is a key whose normalized form differs
+type renameProposal struct {
+	Key      string   `json:"key"`
+	Proposed string   `json:"proposed"`
+	Rules    []string `json:"rules"`
+	Conflict bool     `json:"conflict,omitempty"` // the target exists or several keys normalize to it
+}
+
+// normalizationReport lists the tracks of the request's library whose names don't follow the conventions
+func normalizationReport(ctx context.Context) ([]renameProposal, error) {
+	files, err := s3ListAllAudioFiles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(files))
+	targets := make(map[string]int)
+	for _, f := range files {
+		existing[f] = true
+	}
+	var proposals []renameProposal
+	for _, f := range files {
+		proposed, rules := normalizeKey(f)
+		if proposed == f {
+			continue
+		}
+		targets[proposed]++
+		proposals = append(proposals, renameProposal{Key: f, Proposed: proposed, Rules: rules})
+	}
+	for i := range proposals {
+		p := &proposals[i]
+		p.Conflict = existing[p.Proposed] || targets[p.Proposed] > 1
+	}
+	return proposals, nil
+}
+
+// --- NORMALIZE HANDLERS ---
+
+// handleNormalizeReport proposes normalized names for a library (GET /admin/normalize?library=)
+func handleNormalizeReport(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	ctx, err := s3Meter.guardScan(withLibrary(c.Request.Context(), lib), "normalize")
+	if budgetExceeded(c, err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, NORMALIZE_TIMEOUT)
+	defer cancel()
+	proposals, err := normalizationReport(ctx)
+	if err != nil {
+		log.Printf("Normalization report error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list library"})
+		return
+	}
+	if proposals == nil {
+		proposals = []renameProposal{}
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "proposals": proposals})
+}
+
+// handleNormalizeApply renames tracks to their proposed names (POST /admin/normalize?library=).
+// The body {"keys":[...]} limits the renames to those keys; conflicting proposals are never applied.
+// Sidecars move along, and saved playlists, play queues, party queues and track shares are
+// pointed at the new keys; folder shares whose folder was renamed are reported in brokenShares.
+func handleNormalizeApply(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+	}
+	ctx, err := s3Meter.guardScan(withLibrary(c.Request.Context(), lib), "normalize")
+	if budgetExceeded(c, err) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, NORMALIZE_TIMEOUT)
+	defer cancel()
+	proposals, err := normalizationReport(ctx)
+	if err != nil {
+		log.Printf("Normalization report error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list library"})
+		return
+	}
+	wanted := make(map[string]bool, len(req.Keys))
+	for _, k := range req.Keys {
+		wanted[k] = true
+	}
+	renamed := []renameProposal{}
+	moved := make(map[string]string)
+	var skipped, failed int
+	for _, p := range proposals {
+		if len(wanted) > 0 && !wanted[p.Key] {
+			continue
+		}
+		if p.Conflict || len(renamed) >= MAX_NORMALIZE_RENAMES {
+			skipped++
+			continue
+		}
+		if err := s3MoveTrack(ctx, p.Key, p.Proposed); err != nil {
+			log.Printf("Rename %s -> %s failed: %v", p.Key, p.Proposed, err)
+			failed++
+			continue
+		}
+		manifest.rename(lib, p.Key, p.Proposed)
+		loudness.rename(lib, p.Key, p.Proposed)
+		tagsIndex.rename(lib, p.Key, p.Proposed)
+		fingerprints.rename(lib, p.Key, p.Proposed)
+		ratings.rename(ctx, lib, p.Key, p.Proposed)
+		if t, ok := trims.get(lib, p.Key); ok {
+			trims.set(ctx, lib, p.Proposed, &t)
+			trims.set(ctx, lib, p.Key, nil)
+		}
+		audit.record(c, "track.rename", lib.Name, p.Key, p.Proposed)
+		renamed = append(renamed, p)
+		moved[p.Key] = p.Proposed
+	}
+	refs := gin.H{}
+	brokenShares := []string{}
+	if len(renamed) > 0 {
+		if err := manifest.save(ctx); err != nil {
+			log.Printf("Manifest save error: %v", err)
+		}
+		refs["playlists"] = playlists.renameTracks(ctx, lib.Name, moved)
+		refs["queues"] = playQueues.renameTracks(ctx, lib.Name, moved)
+		refs["parties"] = parties.renameTracks(ctx, lib.Name, moved)
+		refs["shares"], brokenShares = shares.renameTracks(ctx, lib.Name, moved)
+		log.Printf("Normalized %d track names in %s", len(renamed), lib.Name)
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "renamed": renamed, "skipped": skipped, "failed": failed,
+		"references": refs, "brokenShares": brokenShares})
+}
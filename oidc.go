@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	OIDC_COOKIE         = "gm_oidc"                // state, nonce and PKCE verifier of a sign-in in progress
+	OIDC_SESSION_PREFIX = API_KEY_PREFIX + "oidc_" // sign-in cookie of a single sign-on: gm_oidc_<claims>.<mac>
+	OIDC_LOGIN_AGE      = 10 * time.Minute         // to come back from the provider
+	OIDC_TIMEOUT        = 10 * time.Second
+	OIDC_CLOCK_SKEW     = time.Minute
+	OIDC_KEYS_REFRESH   = 5 * time.Minute // at most this often for an unknown signing key
+	OIDC_MAX_RESPONSE   = 1 << 20
+
+	ROLE_ADMIN = "admin"
+	ROLE_USER  = "user"
+)
+
+// OIDC_ISSUER turns on single sign-on with an OpenID Connect provider such as Authentik,
+// Keycloak or Google, for the client OIDC_CLIENT_ID and OIDC_CLIENT_SECRET. /login then
+// offers it next to the API key form: the browser goes through the provider's
+// authorization code flow and comes back signed in as the user the OIDC_USER_CLAIM
+// (default preferred_username) names. The client's redirect URI is
+// <external URL>/login/oidc/callback, or OIDC_REDIRECT_URL behind a proxy that doesn't
+// forward the host. OIDC_SCOPES adds scopes to "openid profile email", such as groups.
+//
+// OIDC_ROLES maps users, @groups of the OIDC_GROUPS_CLAIM (default groups) and * to a
+// role, "@music-admins=admin,@family=user": admin signs in with the access of an admin
+// API key, user with that of a full user key. The strongest role wins and anyone
+// without one is refused, so a provider like Google lets in only who is named. The
+// groups also count as FOLDER_GROUPS in FOLDER_ACL rules. Roles and groups are read at
+// sign-in and kept for OIDC_SESSION_AGE (default 24h) in a cookie signed with a key
+// derived from the client secret, which every instance shares.
+var (
+	oidcIssuer       = strings.TrimSpace(os.Getenv("OIDC_ISSUER"))
+	oidcClientID     = os.Getenv("OIDC_CLIENT_ID")
+	oidcClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	oidcRedirectURL  = os.Getenv("OIDC_REDIRECT_URL")
+	oidcUserClaim    = os.Getenv("OIDC_USER_CLAIM")
+	oidcGroupsClaim  = os.Getenv("OIDC_GROUPS_CLAIM")
+	oidcScopes       = "openid profile email"
+	oidcSessionAge   = 24 * time.Hour
+	oidcRoles        map[string]string // user, @group or * to role
+	oidcSessionKey   []byte
+
+	oidcClient   = &http.Client{Timeout: OIDC_TIMEOUT}
+	oidcProvider = &oidcDiscovery{}
+)
+
+func initOIDC() error {
+	if oidcIssuer == "" {
+		return nil
+	}
+	u, err := url.Parse(oidcIssuer)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname()))) {
+		return fmt.Errorf("invalid OIDC_ISSUER %q, expected an https URL", oidcIssuer)
+	}
+	if oidcClientID == "" || oidcClientSecret == "" {
+		return fmt.Errorf("OIDC_ISSUER needs OIDC_CLIENT_ID and OIDC_CLIENT_SECRET")
+	}
+	if oidcRedirectURL != "" {
+		if u, err := url.Parse(oidcRedirectURL); err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid OIDC_REDIRECT_URL %q", oidcRedirectURL)
+		}
+	}
+	if oidcUserClaim == "" {
+		oidcUserClaim = "preferred_username"
+	}
+	if oidcGroupsClaim == "" {
+		oidcGroupsClaim = "groups"
+	}
+	for _, s := range strings.Fields(os.Getenv("OIDC_SCOPES")) {
+		if !strings.Contains(" "+oidcScopes+" ", " "+s+" ") {
+			oidcScopes += " " + s
+		}
+	}
+	if v := os.Getenv("OIDC_SESSION_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid OIDC_SESSION_AGE: %q", v)
+		}
+		oidcSessionAge = d
+	}
+	oidcRoles = make(map[string]string)
+	for _, item := range splitList(os.Getenv("OIDC_ROLES")) {
+		subject, role, _ := strings.Cut(item, "=")
+		subject, role = strings.TrimSpace(subject), strings.TrimSpace(role)
+		if subject == "" || subject == ACL_GROUP_PREFIX || (role != ROLE_ADMIN && role != ROLE_USER) {
+			return fmt.Errorf("invalid OIDC_ROLES entry %q, expected user, @group or * = admin or user", item)
+		}
+		oidcRoles[subject] = role
+	}
+	if len(oidcRoles) == 0 {
+		return fmt.Errorf("OIDC_ISSUER needs OIDC_ROLES, for example *=user")
+	}
+	mac := hmac.New(sha256.New, []byte(oidcClientSecret))
+	mac.Write([]byte("go-music sign-in"))
+	oidcSessionKey = mac.Sum(nil)
+	return nil
+}
+
+// isLoopbackHost reports whether a URL host is this machine, where plain http is fine
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// oidcRole returns the strongest role OIDC_ROLES gives a user with groups, or ""
+func oidcRole(user string, groups []string) string {
+	subjects := []string{user, ACL_EVERYONE}
+	for _, g := range groups {
+		subjects = append(subjects, ACL_GROUP_PREFIX+g)
+	}
+	role := ""
+	for _, s := range subjects {
+		switch oidcRoles[s] {
+		case ROLE_ADMIN:
+			return ROLE_ADMIN
+		case ROLE_USER:
+			role = ROLE_USER
+		}
+	}
+	return role
+}
+
+// oidcSession is what a single sign-on cookie carries
+type oidcSession struct {
+	User    string   `json:"u"`
+	Scope   string   `json:"s,omitempty"`
+	Groups  []string `json:"g,omitempty"`
+	Expires int64    `json:"e"` // unix seconds
+}
+
+func oidcMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, oidcSessionKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// token encodes and signs the session
+func (s oidcSession) token() string {
+	data, _ := json.Marshal(s)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return OIDC_SESSION_PREFIX + payload + "." + base64.RawURLEncoding.EncodeToString(oidcMAC(payload))
+}
+
+// oidcSessionKeyFor returns the key a valid, unexpired session token acts as, or nil;
+// apiKeys.authenticate hands session tokens here
+func oidcSessionKeyFor(token string) *apiKey {
+	rest, ok := strings.CutPrefix(token, OIDC_SESSION_PREFIX)
+	if !ok || oidcSessionKey == nil {
+		return nil
+	}
+	payload, sig, _ := strings.Cut(rest, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, oidcMAC(payload)) {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var s oidcSession
+	if err != nil || json.Unmarshal(data, &s) != nil || time.Now().Unix() >= s.Expires {
+		return nil
+	}
+	return &apiKey{ID: "oidc", User: s.User, Scope: s.Scope, Groups: s.Groups}
+}
+
+// oidcConfig is the part of the provider's discovery document the flow uses
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcDiscovery caches the discovery document and the provider's signing keys
+type oidcDiscovery struct {
+	mu      sync.Mutex
+	config  *oidcConfig
+	keys    map[string]crypto.PublicKey // by key ID
+	fetched time.Time                   // of keys
+}
+
+func oidcGetJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE)).Decode(v)
+}
+
+// configuration returns the discovery document, fetching it the first time
+func (p *oidcDiscovery) configuration(ctx context.Context) (*oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+	var cfg oidcConfig
+	if err := oidcGetJSON(ctx, strings.TrimSuffix(oidcIssuer, "/")+"/.well-known/openid-configuration", &cfg); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(cfg.Issuer, "/") != strings.TrimSuffix(oidcIssuer, "/") {
+		return nil, fmt.Errorf("discovery document is for issuer %q", cfg.Issuer)
+	}
+	if cfg.AuthorizationEndpoint == "" || cfg.TokenEndpoint == "" || cfg.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document lacks endpoints")
+	}
+	p.config = &cfg
+	return p.config, nil
+}
+
+// key returns the signing key with the ID kid, or the only key for an empty kid,
+// refetching the key set when the provider may have rotated it
+func (p *oidcDiscovery) key(ctx context.Context, cfg *oidcConfig, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	find := func() crypto.PublicKey {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k
+			}
+		}
+		return p.keys[kid]
+	}
+	if k := find(); k != nil || time.Since(p.fetched) < OIDC_KEYS_REFRESH {
+		if k == nil {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return k, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, cfg.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	p.fetched = time.Now()
+	num := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	for _, k := range set.Keys {
+		switch {
+		case k.Use != "" && k.Use != "sig":
+		case k.Kty == "RSA" && k.N != "" && num(k.E).IsInt64():
+			p.keys[k.Kid] = &rsa.PublicKey{N: num(k.N), E: int(num(k.E).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: num(k.X), Y: num(k.Y)}
+		}
+	}
+	if k := find(); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+// and returns its claims
+func verifyIDToken(ctx context.Context, cfg *oidcConfig, raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := oidcProvider.key(ctx, cfg, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("bad ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad ID token signature")
+		}
+	}
+	var claims map[string]interface{}
+	if data, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == oidcClientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == oidcClientID
+		}
+	}
+	exp, _ := claims["exp"].(float64)
+	switch {
+	case claims["iss"] != cfg.Issuer:
+		return nil, fmt.Errorf("ID token from issuer %v", claims["iss"])
+	case !audience:
+		return nil, errors.New("ID token for another client")
+	case claims["azp"] != nil && claims["azp"] != oidcClientID:
+		return nil, errors.New("ID token authorized for another client")
+	case time.Unix(int64(exp), 0).Add(OIDC_CLOCK_SKEW).Before(time.Now()):
+		return nil, errors.New("ID token expired")
+	case claims["nonce"] != nonce:
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// oidcRedirect is the redirect URI registered with the provider
+func oidcRedirect(c *gin.Context) string {
+	if oidcRedirectURL != "" {
+		return oidcRedirectURL
+	}
+	return externalURL(c, "/login/oidc/callback")
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// oidcFailed ends a sign-in attempt on the login page
+func oidcFailed(c *gin.Context, err error) {
+	log.Printf("Single sign-on failed: %v", err)
+	audit.record(c, "login.failed", "", "", "oidc")
+	c.Redirect(http.StatusSeeOther, basePath+"/login?failed=1")
+}
+
+// handleOIDCLogin sends the browser to the provider (GET /login/oidc)
+func handleOIDCLogin(c *gin.Context) {
+	cfg, err := oidcProvider.configuration(c.Request.Context())
+	if err != nil {
+		oidcFailed(c, err)
+		return
+	}
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name: OIDC_COOKIE, Value: state + "." + nonce + "." + verifier, Path: basePath + "/login/oidc",
+		MaxAge: int(OIDC_LOGIN_AGE.Seconds()), HttpOnly: true, Secure: secureRequest(c),
+		SameSite: http.SameSiteLaxMode, // sent along when the provider redirects back
+	})
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcClientID},
+		"redirect_uri":          {oidcRedirect(c)},
+		"scope":                 {oidcScopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(cfg.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	c.Redirect(http.StatusFound, cfg.AuthorizationEndpoint+sep+query.Encode())
+}
+
+// handleOIDCCallback redeems the provider's code and signs the browser in
+// (GET /login/oidc/callback)
+func handleOIDCCallback(c *gin.Context) {
+	ctx := c.Request.Context()
+	cookie, _ := c.Cookie(OIDC_COOKIE)
+	http.SetCookie(c.Writer, &http.Cookie{Name: OIDC_COOKIE, Path: basePath + "/login/oidc", MaxAge: -1, HttpOnly: true})
+	if e := c.Query("error"); e != "" {
+		oidcFailed(c, fmt.Errorf("provider answered %s: %s", e, c.Query("error_description")))
+		return
+	}
+	parts := strings.Split(cookie, ".")
+	if len(parts) != 3 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(c.Query("state"))) != 1 {
+		oidcFailed(c, errors.New("state mismatch or sign-in expired"))
+		return
+	}
+	cfg, err := oidcProvider.configuration(ctx)
+	if err != nil {
+		oidcFailed(c, err)
+		return
+	}
+	idToken, err := oidcExchange(ctx, cfg, c.Query("code"), oidcRedirect(c), parts[2])
+	if err != nil {
+		oidcFailed(c, err)
+		return
+	}
+	claims, err := verifyIDToken(ctx, cfg, idToken, parts[1])
+	if err != nil {
+		oidcFailed(c, err)
+		return
+	}
+	user, _ := claims[oidcUserClaim].(string)
+	if user = strings.TrimSpace(user); user == "" || len(user) > MAX_RATING_USER || (userHomes && !validHomeUser(user)) {
+		oidcFailed(c, fmt.Errorf("unusable %s claim %q", oidcUserClaim, user))
+		return
+	}
+	var groups []string
+	switch g := claims[oidcGroupsClaim].(type) {
+	case string:
+		groups = []string{g}
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	role := oidcRole(user, groups)
+	if role == "" {
+		oidcFailed(c, fmt.Errorf("no OIDC_ROLES entry for %s", user))
+		return
+	}
+	s := oidcSession{User: user, Groups: groups, Expires: time.Now().Add(oidcSessionAge).Unix()}
+	if role == ROLE_ADMIN {
+		s.Scope = SCOPE_ADMIN
+	}
+	signIn(c, s.token(), oidcSessionAge)
+	audit.record(c, "login", "", user, "oidc "+role)
+	c.Redirect(http.StatusSeeOther, basePath+"/")
+}
+
+// oidcExchange redeems an authorization code for an ID token at the token endpoint
+func oidcExchange(ctx context.Context, cfg *oidcConfig, code, redirect, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirect},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, tok.Error, tok.Description)
+	}
+	return tok.IDToken, nil
+}
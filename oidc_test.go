@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeProvider is an OpenID provider that signs in whoever the test names next
+type fakeProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	claims   map[string]interface{} // of the next ID token, besides iss, aud, exp and nonce
+	nonce    string                 // seen at the authorization endpoint
+	verifier string                 // sent to the token endpoint
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{key: key}
+	b64 := base64.RawURLEncoding.EncodeToString
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": p.URL, "authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint": p.URL + "/token", "jwks_uri": p.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "k1", "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "music" || secret != "s3cret" || r.PostFormValue("code") != "c0de" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		p.verifier = r.PostFormValue("code_verifier")
+		claims := map[string]interface{}{"iss": p.URL, "aud": "music", "exp": time.Now().Add(time.Minute).Unix(), "nonce": p.nonce}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + b64(sig), "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// TestOIDCSignIn signs browsers in through a fake provider and checks who they become
+func TestOIDCSignIn(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(issuer, id, secret, scopes string, roles map[string]string, key []byte, provider *oidcDiscovery, libs []*library) {
+		oidcIssuer, oidcClientID, oidcClientSecret, oidcScopes, oidcRoles, oidcSessionKey, oidcProvider, libraries = issuer, id, secret, scopes, roles, key, provider, libs
+	}(oidcIssuer, oidcClientID, oidcClientSecret, oidcScopes, oidcRoles, oidcSessionKey, oidcProvider, libraries)
+	p := newFakeProvider(t)
+	oidcIssuer, oidcClientID, oidcClientSecret, oidcProvider = p.URL, "music", "s3cret", &oidcDiscovery{}
+	t.Setenv("OIDC_ROLES", "@family=user, bob=admin")
+	t.Setenv("OIDC_SCOPES", "groups")
+	if err := initOIDC(); err != nil {
+		t.Fatal(err)
+	}
+	libraries = []*library{{Name: "Music", Bucket: "music"}}
+	useFakeS3(t, &fakeS3{objects: map[string]string{}})
+	r := gin.New()
+	registerRoutes(r)
+
+	serve := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://music.example"+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	var challenge string // of the last sign-in
+	// signIn runs the flow for the claims and returns the final redirect and the sign-in cookie
+	signIn := func(claims map[string]interface{}, tamper func(q url.Values)) (string, *http.Cookie) {
+		w := serve("/login/oidc")
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		q := loc.Query()
+		if w.Code != http.StatusFound || !strings.HasPrefix(loc.String(), p.URL+"/authorize?") ||
+			q.Get("redirect_uri") != "http://music.example/login/oidc/callback" || q.Get("scope") != "openid profile email groups" ||
+			q.Get("code_challenge_method") != "S256" {
+			t.Fatalf("login redirect %d to %s", w.Code, loc)
+		}
+		p.nonce, p.claims, challenge = q.Get("nonce"), claims, q.Get("code_challenge")
+		back := url.Values{"code": {"c0de"}, "state": {q.Get("state")}}
+		if tamper != nil {
+			tamper(back)
+		}
+		w = serve("/login/oidc/callback?"+back.Encode(), cookie(w, OIDC_COOKIE))
+		return w.Header().Get("Location"), cookie(w, HOME_COOKIE)
+	}
+	whoAmI := func(c *http.Cookie) string {
+		var res struct{ User string }
+		json.Unmarshal(serve("/api/v1/rating/Jazz/a.mp3", c).Body.Bytes(), &res)
+		return res.User
+	}
+
+	loc, c := signIn(map[string]interface{}{"preferred_username": "ann", "groups": []string{"family"}}, nil)
+	if loc != "/" || c == nil || !c.HttpOnly {
+		t.Fatalf("ann: redirected to %q with cookie %v", loc, c)
+	}
+	if got := whoAmI(c); got != "ann" {
+		t.Errorf("signed in as %q, want ann", got)
+	}
+	if k := apiKeys.authenticate(c.Value); k == nil || k.Scope != "" || len(k.Groups) != 1 || k.Groups[0] != "family" {
+		t.Errorf("ann's session: %+v", k)
+	}
+	if sum := sha256.Sum256([]byte(p.verifier)); base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		t.Errorf("PKCE verifier %q doesn't match the challenge %q", p.verifier, challenge)
+	}
+
+	if _, c := signIn(map[string]interface{}{"preferred_username": "bob"}, nil); c == nil {
+		t.Error("bob was not signed in")
+	} else if k := apiKeys.authenticate(c.Value); k == nil || k.Scope != SCOPE_ADMIN {
+		t.Errorf("bob's session: %+v, want admin scope", k)
+	}
+
+	refused := []struct {
+		name   string
+		claims map[string]interface{}
+		tamper func(q url.Values)
+	}{
+		{"no role", map[string]interface{}{"preferred_username": "eve", "groups": []string{"neighbours"}}, nil},
+		{"no user claim", map[string]interface{}{"email": "ann@example.com", "groups": []string{"family"}}, nil},
+		{"wrong state", map[string]interface{}{"preferred_username": "ann", "groups": []string{"family"}}, func(q url.Values) { q.Set("state", "x") }},
+		{"bad code", map[string]interface{}{"preferred_username": "ann", "groups": []string{"family"}}, func(q url.Values) { q.Set("code", "x") }},
+		{"wrong nonce", map[string]interface{}{"preferred_username": "ann", "groups": []string{"family"}, "nonce": "x"}, nil},
+		{"other client", map[string]interface{}{"preferred_username": "ann", "groups": []string{"family"}, "aud": "other"}, nil},
+		{"expired", map[string]interface{}{"preferred_username": "ann", "groups": []string{"family"}, "exp": time.Now().Add(-time.Hour).Unix()}, nil},
+		{"provider error", nil, func(q url.Values) { q.Set("error", "access_denied") }},
+	}
+	for _, tt := range refused {
+		if loc, c := signIn(tt.claims, tt.tamper); loc != "/login?failed=1" || c != nil {
+			t.Errorf("%s: redirected to %q with cookie %v", tt.name, loc, c)
+		}
+	}
+
+	// A session signed with another key, or expired, is no key
+	forged := oidcSession{User: "ann", Scope: SCOPE_ADMIN, Expires: time.Now().Add(time.Hour).Unix()}.token()
+	oidcSessionKey = []byte("other")
+	if apiKeys.authenticate(forged) != nil {
+		t.Error("accepted a session signed with another key")
+	}
+	expired := oidcSession{User: "ann", Expires: time.Now().Add(-time.Second).Unix()}.token()
+	if apiKeys.authenticate(expired) != nil {
+		t.Error("accepted an expired session")
+	}
+}
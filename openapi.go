@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SWAGGER_UI_VERSION pins the swagger-ui-dist release of the docs page. go generate
+// vendors it into static/swagger-ui, which is embedded like the rest of the frontend.
+//
+//go:generate sh -c "mkdir -p static/swagger-ui && for f in swagger-ui.css swagger-ui-bundle.js LICENSE; do curl -fsSL -o static/swagger-ui/$f https://unpkg.com/swagger-ui-dist@5.17.14/$f || exit 1; done"
+const (
+	SWAGGER_UI_VERSION = "5.17.14"
+	SWAGGER_UI_DIR     = "swagger-ui"
+	SWAGGER_UI_CDN     = "https://unpkg.com/swagger-ui-dist@" + SWAGGER_UI_VERSION + "/"
+)
+
+// The OpenAPI document is assembled from the route table below, which is
+// compiled into the binary, so it always matches the build that serves it
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// apiOp describes one operation of the JSON API
+type apiOp struct {
+	method, path, summary, tag string
+	admin                      bool
+	params                     []string // path parameters
+	query                      []string // optional query parameters
+	body                       string   // request schema name
+	response                   string   // 200 response schema name, "" for a plain status object
+	contentType                string   // non-JSON 200 response, e.g. audio
+}
+
+var apiOps = []apiOp{
+	{method: "get", path: "/api/v1/capabilities", summary: "Protocol version of the dffunc API, the functions, enabled features and limits such as the search result cap and audio extensions", tag: "status", response: "Object"},
+	{method: "get", path: "/api/v1/connectivity", summary: "S3 connectivity as last seen by the server", tag: "status", response: "Connectivity"},
+	{method: "get", path: "/api/v1/diagnostics", summary: "Bucket reachability, configuration, index and build info", tag: "status", admin: true, response: "Object"},
+	{method: "post", path: "/api/v1/tracks/resolve", summary: "Resolve up to 500 keys {\"keys\":[...]} to encoded stream URLs, durations, sizes, content types and what fingerprinting identified them as", tag: "library", query: []string{"lib"}, response: "Object"},
+	{method: "get", path: "/api/v1/tracks", summary: "Stream every track under prefix as NDJSON (default) or a JSON array, flushed per S3 page in bucket order", tag: "library", query: []string{"prefix", "format", "lib"}, contentType: "application/x-ndjson"},
+	{method: "get", path: "/api/v1/index", summary: "Folders under prefix bucketed by initial letter with counts, for a jump bar; letter lists the folders of one bucket", tag: "library", query: []string{"prefix", "letter", "lib"}, response: "Object"},
+	{method: "get", path: "/api/v1/artists", summary: "Artists of the tagged tracks with their track counts (needs TAG_SCAN)", tag: "library", query: []string{"lib"}, response: "Object"},
+	{method: "get", path: "/api/v1/artists/{name}", summary: "Albums of an artist with their tracks, sectioned into studio albums, live albums, compilations and appearances on albums of others; a recording on several albums is listed once, on the studio album", tag: "library", params: []string{"name"}, query: []string{"lib"}, response: "Object"},
+	{method: "get", path: "/api/v1/artists/{name}/tracks", summary: "Every track crediting an artist as artist, album artist or featured artist, across albums and folders", tag: "library", params: []string{"name"}, query: []string{"lib"}, response: "Object"},
+	{method: "get", path: "/api/v1/ratings", summary: "Star ratings of the user (user query parameter or cookie) in a library", tag: "library", query: []string{"user", "lib"}, response: "Object"},
+	{method: "get", path: "/api/v1/rating/{path}", summary: "Rating of a track, 0 when unrated", tag: "library", params: []string{"path"}, query: []string{"user", "lib"}, response: "Rating"},
+	{method: "put", path: "/api/v1/rating/{path}", summary: "Rate a track 1-5 stars, 0 clears", tag: "library", params: []string{"path"}, query: []string{"user", "lib"}, body: "Rating", response: "Rating"},
+	{method: "delete", path: "/api/v1/rating/{path}", summary: "Clear the rating of a track", tag: "library", params: []string{"path"}, query: []string{"user", "lib"}},
+	{method: "get", path: "/api/v1/playlists", summary: "Saved playlists of the user (user query parameter or cookie)", tag: "library", query: []string{"user"}, response: "Object"},
+	{method: "post", path: "/api/v1/playlists/import", summary: "Create a playlist from an M3U/M3U8/PLS file (form field file, or the body); entries are matched by path, file name and #EXTINF title, unmatched lines are reported", tag: "library", query: []string{"name", "user", "lib"}, response: "Object"},
+	{method: "get", path: "/api/v1/playlists/{name}", summary: "Tracks of a saved playlist with stream URLs", tag: "library", params: []string{"name"}, query: []string{"user"}, response: "Object"},
+	{method: "delete", path: "/api/v1/playlists/{name}", summary: "Delete a saved playlist", tag: "library", params: []string{"name"}, query: []string{"user"}},
+	{method: "get", path: "/api/v1/queue", summary: "Play queue of the user (user query parameter or cookie) with now playing and next", tag: "queue", query: []string{"user"}, response: "Object"},
+	{method: "post", path: "/api/v1/queue", summary: "Append tracks {\"tracks\":[...]}, or insert them before \"position\"", tag: "queue", query: []string{"user", "lib"}, response: "Object"},
+	{method: "delete", path: "/api/v1/queue", summary: "Clear the play queue", tag: "queue", query: []string{"user"}, response: "Object"},
+	{method: "delete", path: "/api/v1/queue/{index}", summary: "Remove a queue entry", tag: "queue", params: []string{"index"}, query: []string{"user"}, response: "Object"},
+	{method: "post", path: "/api/v1/queue/move", summary: "Move a queue entry {\"from\":i,\"to\":j}", tag: "queue", query: []string{"user"}, response: "Object"},
+	{method: "post", path: "/api/v1/queue/next", summary: "Advance playback; {\"index\":n} jumps, {\"step\":-1} goes back", tag: "queue", query: []string{"user"}, response: "Object"},
+	{method: "post", path: "/api/v1/party", summary: "Start a party session hosted by the user; others join with its code", tag: "party", query: []string{"user"}, response: "Party"},
+	{method: "get", path: "/api/v1/party/{code}", summary: "Party session with its shared queue and the host's position", tag: "party", params: []string{"code"}, query: []string{"user"}, response: "Party"},
+	{method: "post", path: "/api/v1/party/{code}/join", summary: "Join a party session by its code", tag: "party", params: []string{"code"}, query: []string{"user"}, response: "Party"},
+	{method: "post", path: "/api/v1/party/{code}/leave", summary: "Leave a party session; the host leaving ends it", tag: "party", params: []string{"code"}, query: []string{"user"}, response: "Status"},
+	{method: "post", path: "/api/v1/party/{code}/queue", summary: "Append tracks {\"tracks\":[...]} to the shared queue", tag: "party", params: []string{"code"}, query: []string{"user", "lib"}, response: "Party"},
+	{method: "delete", path: "/api/v1/party/{code}/queue/{index}", summary: "Remove a shared queue entry; members may remove the entries they added", tag: "party", params: []string{"code", "index"}, query: []string{"user"}, response: "Party"},
+	{method: "post", path: "/api/v1/party/{code}/playback", summary: "Host only: {\"index\":n} jumps, {\"step\":1} skips, {\"position\":s} seeks, {\"paused\":true} pauses", tag: "party", params: []string{"code"}, query: []string{"user"}, response: "Party"},
+	{method: "get", path: "/api/v1/cast", summary: "Google Cast devices found on the LAN (needs CAST)", tag: "queue", response: "Object"},
+	{method: "get", path: "/api/v1/cast/{device}", summary: "What a cast device plays: player state, position, track and volume", tag: "queue", params: []string{"device"}, response: "Object"},
+	{method: "post", path: "/api/v1/cast/{device}/load", summary: "Cast tracks {\"tracks\":[...]} or a playlist {\"playlist\":\"...\"} of the user to a device, starting at \"start\"; the server drives playback", tag: "queue", params: []string{"device"}, query: []string{"user", "lib"}, response: "Object"},
+	{method: "post", path: "/api/v1/cast/{device}/control", summary: "{\"action\":\"play\"}, pause, stop, next or previous; seek takes \"position\" in seconds, volume \"volume\" 0 to 100", tag: "queue", params: []string{"device"}, response: "Object"},
+	{method: "get", path: "/api/v1/openapi.json", summary: "This document", tag: "status", response: "Object"},
+	{method: "get", path: "/api/v1/library.proto", summary: "Protobuf definition of the gRPC service served on GRPC_LISTEN", tag: "status", contentType: "text/plain"},
+	{method: "get", path: "/graphql", summary: "Run a GraphQL query (query, variables and operationName parameters) over libraries, directories, tracks with durations, ratings and tags, title search and the user's playlists", tag: "library", query: []string{"query", "variables", "operationName"}, response: "Object"},
+	{method: "post", path: "/graphql", summary: "Run a GraphQL query {\"query\",\"variables\",\"operationName\"}; only queries are supported", tag: "library", body: "Object", response: "Object"},
+	{method: "get", path: "/audio/{path}", summary: "Stream an audio file; supports Range. normalize=1 or album applies the analyzed track or album gain, trim=1 cuts leading and trailing silence (transcoded, needs ffmpeg)", tag: "audio", params: []string{"path"}, query: []string{"lib", "normalize", "trim"}, contentType: "audio/*"},
+	{method: "get", path: "/hls/{path}/index.m3u8", summary: "HLS playlist of a track, segmented on first request (needs ffmpeg)", tag: "audio", params: []string{"path"}, query: []string{"lib"}, contentType: "application/vnd.apple.mpegurl"},
+	{method: "get", path: "/artwork/{path}", summary: "Cover image of a folder (cover, folder or front image, else the first one); size=64, 256 or 1024 resizes it for srcset candidates", tag: "audio", params: []string{"path"}, query: []string{"lib", "size"}, contentType: "image/*"},
+	{method: "get", path: "/podcast/{path}.xml", summary: "Podcast RSS feed of a folder, one episode per audio file in natural order", tag: "audio", params: []string{"path"}, query: []string{"lib"}, contentType: "application/rss+xml"},
+	{method: "get", path: "/zip/{path}", summary: "Download a folder (<folder>.zip) as an uncompressed archive of its tracks with a SHA-256 manifest; ranged requests resume an interrupted download (needs ZIP_DOWNLOADS)", tag: "audio", params: []string{"path"}, query: []string{"lib"}, contentType: "application/zip"},
+	{method: "get", path: "/lyrics/{path}", summary: "Lyrics of a track from a .lrc sidecar or embedded SYLT/USLT tags; synced lines carry times in seconds", tag: "audio", params: []string{"path"}, query: []string{"lib"}, response: "Object"},
+	{method: "get", path: "/waveform/{path}", summary: "Peaks of a track (0-255, evenly spread over its trimmed duration) for a seekable waveform; computed with ffmpeg on first request and stored", tag: "audio", params: []string{"path"}, query: []string{"format", "lib"}, response: "Object"},
+	{method: "get", path: "/radio/{station}", summary: "Endless MP3 stream of a station; send Icy-MetaData: 1 for track titles", tag: "audio", params: []string{"station"}, contentType: "audio/mpeg"},
+	{method: "get", path: "/ws", summary: "WebSocket syncing now playing, playback position, queue and remote commands between a user's devices", tag: "queue", query: []string{"user", "device"}},
+	{method: "get", path: "/remote", summary: "Remote control page for the user's other devices", tag: "queue", contentType: "text/html"},
+	{method: "get", path: "/events", summary: "Server-Sent Events: scan progress, library changes, plays, search jobs", tag: "audio", contentType: "text/event-stream"},
+	{method: "get", path: "/share/{token}", summary: "Open a share link: a track streams, a folder or collection lists its tracks", tag: "shares", params: []string{"token"}, response: "ShareListing"},
+	{method: "get", path: "/share/{token}/{path}", summary: "Stream a track of a shared folder or collection", tag: "shares", params: []string{"token", "path"}, contentType: "audio/*"},
+	{method: "get", path: "/embed/{token}", summary: "Minimal player page of a share for iframes on other sites, with an oEmbed discovery link", tag: "shares", params: []string{"token"}, contentType: "text/html"},
+	{method: "get", path: "/oembed", summary: "oEmbed description (rich iframe) of an /embed or /share link", tag: "shares", query: []string{"url", "maxwidth", "maxheight", "format"}, response: "Object"},
+	{method: "get", path: "/kiosk/queue", summary: "Kiosk mode: now playing and the next tracks of the shared queue", tag: "kiosk", response: "Object"},
+	{method: "post", path: "/kiosk/queue", summary: "Kiosk mode: add a track to the shared queue ({\"track\":\"...\"})", tag: "kiosk", query: []string{"lib"}, response: "Object"},
+	{method: "post", path: "/kiosk/next", summary: "Kiosk mode: advance the shared queue (the big screen calls this)", tag: "kiosk", admin: true, response: "Object"},
+	{method: "post", path: "/kiosk/play", summary: "Kiosk mode: resume the playing track or start the next one", tag: "kiosk", admin: true, response: "Object"},
+	{method: "post", path: "/kiosk/pause", summary: "Kiosk mode: pause or resume the playing track ({\"paused\":true})", tag: "kiosk", admin: true, response: "Object"},
+	{method: "post", path: "/kiosk/volume", summary: "Kiosk mode: set the volume of the screen or the jukebox player, 0 to 100 ({\"volume\":80})", tag: "kiosk", admin: true, response: "Object"},
+	{method: "get", path: "/admin/shares", summary: "List share links", tag: "shares", admin: true, response: "ShareList"},
+	{method: "post", path: "/admin/shares", summary: "Create a share link", tag: "shares", admin: true, body: "ShareRequest", response: "CreatedShare"},
+	{method: "delete", path: "/admin/shares/{id}", summary: "Revoke a share link", tag: "shares", admin: true, params: []string{"id"}},
+	{method: "put", path: "/admin/collections/{name}", summary: "Create or replace a collection", tag: "library", admin: true, params: []string{"name"}, body: "Collection", response: "Collection"},
+	{method: "delete", path: "/admin/collections/{name}", summary: "Delete a collection", tag: "library", admin: true, params: []string{"name"}},
+	{method: "get", path: "/admin/smart-playlists", summary: "List smart playlists", tag: "library", admin: true, response: "SmartPlaylistList"},
+	{method: "put", path: "/admin/smart-playlists/{name}", summary: "Create or replace a rule-based playlist; resolve it with the getAllMp3InSmartPlaylist call", tag: "library", admin: true, params: []string{"name"}, body: "SmartPlaylist", response: "SmartPlaylist"},
+	{method: "delete", path: "/admin/smart-playlists/{name}", summary: "Delete a smart playlist", tag: "library", admin: true, params: []string{"name"}},
+	{method: "post", path: "/admin/manifest/scan", summary: "Start a background duration scan of all libraries", tag: "library", admin: true},
+	{method: "post", path: "/admin/tags/scan", summary: "Start a background scan of the title, artist, album, genre and year tags of all libraries", tag: "library", admin: true},
+	{method: "post", path: "/admin/loudness/scan", summary: "Start a background EBU R128 loudness and silence scan of all libraries (needs ffmpeg)", tag: "library", admin: true},
+	{method: "post", path: "/admin/fingerprints/scan", summary: "Start a background Chromaprint fingerprint scan of all libraries, identifying untagged tracks on AcoustID (needs fpcalc)", tag: "library", admin: true},
+	{method: "get", path: "/admin/fingerprints", summary: "Untagged tracks of a library and the recordings AcoustID identified them as", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "post", path: "/admin/identify/{path}", summary: "Fingerprint one track now and identify it on AcoustID, enriched from MusicBrainz with MUSICBRAINZ_ENRICH (needs fpcalc and ACOUSTID_API_KEY)", tag: "library", admin: true, params: []string{"path"}, query: []string{"library"}, response: "Object"},
+	{method: "put", path: "/admin/identify/{path}", summary: "Correct what a track is by hand: {title, artist, album, year, recordingId}; scans keep the correction", tag: "library", admin: true, params: []string{"path"}, query: []string{"library"}, body: "Object", response: "Object"},
+	{method: "delete", path: "/admin/identify/{path}", summary: "Drop the manual correction of a track so the next scan identifies it again", tag: "library", admin: true, params: []string{"path"}, query: []string{"library"}},
+	{method: "get", path: "/admin/health", summary: "Library health score and cleanup checklist", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "get", path: "/admin/check", summary: "Integrity check: missing, zero-byte and truncated files, invalid headers of a sample (sample=-1 for all), content type mismatches", tag: "library", admin: true, query: []string{"library", "sample"}, response: "Object"},
+	{method: "get", path: "/admin/normalize", summary: "Propose normalized track names (feat., underscores, bitrate tags, spacing, Unicode)", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "post", path: "/admin/normalize", summary: "Rename tracks to their proposed names; {\"keys\":[...]} limits the renames; sidecars move along and playlist, queue and share references follow", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "post", path: "/admin/import", summary: "Copy the playlists, starred songs and ratings of a user of a Subsonic-compatible server or another go-music server onto the matching tracks of a library; starred songs become the playlist Starred, dryRun only reports the matches", tag: "library", admin: true, query: []string{"library"}, body: "Object", response: "Object"},
+	{method: "get", path: "/admin/duplicates", summary: "Group likely duplicate tracks (same size+ETag, same normalized name, same length and loudness, same recording by fingerprint)", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "post", path: "/admin/duplicates/delete", summary: "Move chosen copies {\"keys\":[...]} to the trash; at least one copy of every group is kept", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "get", path: "/admin/trash", summary: "Deleted tracks of a library with when they were deleted and will be purged", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "post", path: "/admin/trash/restore", summary: "Move tracks {\"keys\":[...]} back from the trash; keys taken again meanwhile are reported as conflicts", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "post", path: "/admin/trash/purge", summary: "Delete tracks {\"keys\":[...]} from the trash for good; all=1 empties it", tag: "library", admin: true, query: []string{"library", "all"}, response: "Object"},
+	{method: "get", path: "/admin/trims", summary: "Trim points of a library by track", tag: "library", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "put", path: "/admin/trims/{path}", summary: "Set the trim points of a track", tag: "library", admin: true, params: []string{"path"}, query: []string{"library"}, body: "TrimPoint", response: "TrimPoint"},
+	{method: "delete", path: "/admin/trims/{path}", summary: "Remove the trim points of a track", tag: "library", admin: true, params: []string{"path"}, query: []string{"library"}},
+	{method: "get", path: "/admin/uploads", summary: "Uploads of a library that were started and neither completed nor aborted", tag: "uploads", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "post", path: "/admin/uploads", summary: "Start a resumable upload {\"key\",\"contentType\",\"overwrite\"}; the returned token names it in the other upload calls", tag: "uploads", admin: true, query: []string{"library"}, response: "Object"},
+	{method: "get", path: "/admin/uploads/{token}", summary: "Parts an upload has received so far, to resume it after an interruption", tag: "uploads", admin: true, params: []string{"token"}, response: "Object"},
+	{method: "put", path: "/admin/uploads/{token}/parts/{number}", summary: "Upload part 1-10000 as the raw body; every part but the last must be at least 5 MiB, sending a part again replaces it", tag: "uploads", admin: true, params: []string{"token", "number"}, response: "Object"},
+	{method: "post", path: "/admin/uploads/{token}/complete", summary: "Join the received parts into the track", tag: "uploads", admin: true, params: []string{"token"}, response: "Object"},
+	{method: "delete", path: "/admin/uploads/{token}", summary: "Abort an upload and discard its parts", tag: "uploads", admin: true, params: []string{"token"}},
+	{method: "get", path: "/admin/api-keys", summary: "List API keys without their secrets, optionally of one user", tag: "admin", admin: true, query: []string{"user"}, response: "Object"},
+	{method: "post", path: "/admin/api-keys", summary: "Create an API key {\"user\",\"name\",\"scope\"}; scope is read, stream, admin or empty for full user access. The token is only returned once", tag: "admin", admin: true, response: "Object"},
+	{method: "delete", path: "/admin/api-keys/{id}", summary: "Revoke an API key", tag: "admin", admin: true, params: []string{"id"}},
+	{method: "get", path: "/admin/export", summary: "Download a snapshot of a library: key, size, date, ETag, duration, bitrate, gains and silence offsets per track", tag: "library", admin: true, query: []string{"library", "format"}, contentType: "text/csv"},
+	{method: "get", path: "/admin/audit", summary: "Audit log entries of one day, filtered by action prefix and actor", tag: "admin", admin: true, query: []string{"day", "action", "actor", "limit"}, response: "Object"},
+	{method: "get", path: "/admin/schedules", summary: "List playback schedules", tag: "schedules", admin: true, response: "ScheduleList"},
+	{method: "put", path: "/admin/schedules/{name}", summary: "Create or replace a playback schedule", tag: "schedules", admin: true, params: []string{"name"}, body: "Schedule", response: "Schedule"},
+	{method: "delete", path: "/admin/schedules/{name}", summary: "Delete a playback schedule", tag: "schedules", admin: true, params: []string{"name"}},
+	{method: "get", path: "/admin/parties", summary: "Open party sessions with their members, queue length and followers", tag: "party", admin: true, response: "Object"},
+	{method: "get", path: "/admin/dashboard", summary: "Active streams, sessions, index freshness, caches and recent errors", tag: "dashboard", admin: true, response: "Dashboard"},
+	{method: "get", path: "/admin/streams", summary: "List audio streams in progress", tag: "dashboard", admin: true, response: "StreamList"},
+	{method: "delete", path: "/admin/streams/{id}", summary: "Disconnect a stream in progress", tag: "dashboard", admin: true, params: []string{"id"}, response: "Stream"},
+	{method: "get", path: "/admin/report", summary: "Listening report of the last complete day or week: plays and listening time per user, top tracks, new tracks (needs REPORT)", tag: "admin", admin: true, query: []string{"period", "format"}, response: "Report"},
+	{method: "post", path: "/admin/report/send", summary: "Send the report of the last complete period now, by mail and as a report event", tag: "admin", admin: true, query: []string{"period"}, response: "Status"},
+	{method: "get", path: "/admin/webhooks", summary: "List webhooks and the events they can subscribe to", tag: "webhooks", admin: true, response: "WebhookList"},
+	{method: "put", path: "/admin/webhooks/{name}", summary: "Create or replace a webhook", tag: "webhooks", admin: true, params: []string{"name"}, body: "Webhook", response: "Webhook"},
+	{method: "delete", path: "/admin/webhooks/{name}", summary: "Delete a webhook", tag: "webhooks", admin: true, params: []string{"name"}},
+	{method: "post", path: "/admin/webhooks/{name}/test", summary: "Send a ping event to a webhook", tag: "webhooks", admin: true, params: []string{"name"}, response: "Status"},
+	{method: "post", path: "/admin/cache/purge", summary: "Empty the audio disk cache, or one cache layer", tag: "admin", admin: true, query: []string{"layer"}},
+	{method: "get", path: "/admin/cache/layers", summary: "Size, limits, hits, misses and evictions of each cache layer", tag: "admin", admin: true, response: "Object"},
+	{method: "put", path: "/admin/cache/layers/{name}", summary: "Change a cache layer's size limit or TTL until restart ({\"maxMB\":64,\"ttl\":\"5m\"})", tag: "admin", admin: true, params: []string{"name"}, response: "Object"},
+	{method: "get", path: "/admin/search/zero-results", summary: "Searches that found nothing", tag: "admin", admin: true, response: "Object"},
+	{method: "delete", path: "/admin/search/zero-results", summary: "Reset the zero-result search statistics", tag: "admin", admin: true},
+}
+
+func schemaRef(name string) gin.H {
+	return gin.H{"$ref": "#/components/schemas/" + name}
+}
+
+func str() gin.H     { return gin.H{"type": "string"} }
+func integer() gin.H { return gin.H{"type": "integer"} }
+func boolean() gin.H { return gin.H{"type": "boolean"} }
+func strList() gin.H { return gin.H{"type": "array", "items": str()} }
+
+func object(props gin.H) gin.H {
+	return gin.H{"type": "object", "properties": props}
+}
+
+var apiSchemas = gin.H{
+	"Object": gin.H{"type": "object", "additionalProperties": true},
+	"Status": object(gin.H{"status": str()}),
+	"Error":  object(gin.H{"error": str(), "code": str()}),
+	"Connectivity": object(gin.H{
+		"status": gin.H{"type": "string", "enum": []string{S3_STATUS_UNKNOWN, S3_STATUS_OK, S3_STATUS_DNS, S3_STATUS_AUTH, S3_STATUS_NETWORK}}, "reachable": boolean(),
+		"message": str(), "lastSuccess": gin.H{"type": "string", "format": "date-time"}, "lastFailure": gin.H{"type": "string", "format": "date-time"},
+	}),
+	"Collection": object(gin.H{"name": str(), "folders": strList()}),
+	"SmartPlaylist": object(gin.H{
+		"name": str(), "match": gin.H{"type": "string", "enum": []string{"all", "any"}},
+		"rules": gin.H{"type": "array", "items": object(gin.H{
+			"field": gin.H{"type": "string", "enum": []string{SMART_PATH, SMART_FOLDER, SMART_NAME, SMART_EXT, SMART_DURATION, SMART_SIZE, SMART_ADDED, SMART_RATING}},
+			"op":    str(), "value": str(),
+		})},
+		"sort": gin.H{"type": "string", "enum": smartSorts}, "limit": integer(),
+		"maxBytes": integer(), "maxSeconds": integer(),
+	}),
+	"SmartPlaylistList": gin.H{"type": "array", "items": schemaRef("SmartPlaylist")},
+	"ShareRequest": object(gin.H{
+		"kind": gin.H{"type": "string", "enum": []string{SHARE_TRACK, SHARE_FOLDER, SHARE_COLLECTION}}, "target": str(), "library": str(),
+		"ttlHours": gin.H{"type": "number"}, "maxDownloads": integer(),
+	}),
+	"Share": object(gin.H{
+		"id": str(), "kind": str(), "target": str(), "library": str(), "created": gin.H{"type": "string", "format": "date-time"},
+		"expires": gin.H{"type": "string", "format": "date-time"}, "maxDownloads": integer(), "downloads": integer(),
+	}),
+	"ShareList":    gin.H{"type": "array", "items": schemaRef("Share")},
+	"CreatedShare": object(gin.H{"share": schemaRef("Share"), "token": str(), "url": str()}),
+	"ShareListing": gin.H{"type": "object", "additionalProperties": true},
+	"Schedule": object(gin.H{
+		"name": str(), "at": gin.H{"type": "string", "pattern": "^([01][0-9]|2[0-3]):[0-5][0-9]$"}, "days": strList(), "device": str(),
+		"action": gin.H{"type": "string", "enum": []string{SCHEDULE_PLAY, SCHEDULE_FADEOUT, SCHEDULE_STOP}}, "library": str(),
+		"folder": str(), "collection": str(), "fadeSeconds": integer(),
+	}),
+	"Rating":       object(gin.H{"user": str(), "track": str(), "rating": gin.H{"type": "integer", "minimum": 0, "maximum": 5}}),
+	"TrimPoint":    object(gin.H{"start": gin.H{"type": "number"}, "end": gin.H{"type": "number"}}),
+	"ScheduleList": gin.H{"type": "array", "items": schemaRef("Schedule")},
+	"Stream": object(gin.H{
+		"id": str(), "user": str(), "ip": str(), "library": str(), "track": str(), "started": gin.H{"type": "string", "format": "date-time"},
+		"sent": integer(), "size": integer(), "progress": gin.H{"type": "number"},
+	}),
+	"StreamList": gin.H{"type": "array", "items": schemaRef("Stream")},
+	"Dashboard": object(gin.H{
+		"streams": schemaRef("StreamList"), "sessions": schemaRef("Object"), "index": schemaRef("Object"), "caches": schemaRef("Object"),
+		"errors": gin.H{"type": "array", "items": schemaRef("Object")}, "uptimeSec": integer(), "goroutines": integer(),
+	}),
+	"Webhook": object(gin.H{
+		"name": str(), "url": str(), "secret": str(), "events": gin.H{"type": "array", "items": gin.H{"type": "string", "enum": webhookEventTypes}},
+		"format": gin.H{"type": "string", "enum": []string{WEBHOOK_FORMAT_JSON, WEBHOOK_FORMAT_DISCORD}}, "hasSecret": boolean(),
+		"created": gin.H{"type": "string", "format": "date-time"},
+	}),
+	"Party": object(gin.H{
+		"code": str(), "host": str(), "members": strList(), "queue": schemaRef("Object"),
+		"position": gin.H{"type": "number"}, "paused": boolean(), "time": integer(),
+	}),
+	"Report": object(gin.H{
+		"period": str(), "from": gin.H{"type": "string", "format": "date-time"}, "to": gin.H{"type": "string", "format": "date-time"},
+		"plays": integer(), "seconds": integer(), "users": gin.H{"type": "array", "items": schemaRef("Object")},
+		"topTracks": gin.H{"type": "array", "items": schemaRef("Object")}, "added": gin.H{"type": "array", "items": schemaRef("Object")},
+	}),
+	"WebhookList": object(gin.H{"events": strList(), "webhooks": gin.H{"type": "array", "items": schemaRef("Webhook")}}),
+}
+
+// buildOpenAPI turns apiOps into an OpenAPI 3 document
+func buildOpenAPI() gin.H {
+	paths := gin.H{}
+	for _, op := range apiOps {
+		ok := gin.H{"description": "OK"}
+		switch {
+		case op.contentType != "":
+			ok["content"] = gin.H{op.contentType: gin.H{"schema": gin.H{"type": "string", "format": "binary"}}}
+		case op.response != "":
+			ok["content"] = gin.H{"application/json": gin.H{"schema": schemaRef(op.response)}}
+		default:
+			ok["content"] = gin.H{"application/json": gin.H{"schema": schemaRef("Status")}}
+		}
+		errResp := gin.H{"description": "Error", "content": gin.H{"application/json": gin.H{"schema": schemaRef("Error")}}}
+		o := gin.H{
+			"summary":   op.summary,
+			"tags":      []string{op.tag},
+			"responses": gin.H{"200": ok, "default": errResp},
+		}
+		var params []gin.H
+		for _, p := range op.params {
+			params = append(params, gin.H{"name": p, "in": "path", "required": true, "schema": str()})
+		}
+		for _, q := range op.query {
+			params = append(params, gin.H{"name": q, "in": "query", "schema": str()})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.body != "" {
+			o["requestBody"] = gin.H{"required": true, "content": gin.H{"application/json": gin.H{"schema": schemaRef(op.body)}}}
+		}
+		if op.admin {
+			o["security"] = []gin.H{{"adminToken": []string{}}}
+		}
+		item, _ := paths[op.path].(gin.H)
+		if item == nil {
+			item = gin.H{}
+			paths[op.path] = item
+		}
+		item[op.method] = o
+	}
+	apiVersion := version
+	if apiVersion == "" {
+		apiVersion = "dev" // built without -ldflags version info
+	}
+	serverURL := basePath
+	if serverURL == "" {
+		serverURL = "/"
+	}
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "go-music",
+			"version":     apiVersion,
+			"description": "JSON API of go-music. The browser UI uses the form-encoded POST /api (dffunc) protocol, which is not described here.",
+		},
+		"servers": []gin.H{{"url": serverURL}},
+		"paths":   paths,
+		"components": gin.H{
+			"schemas":         apiSchemas,
+			"securitySchemes": gin.H{"adminToken": gin.H{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN, or an API key with the admin scope. Other API keys are accepted the same way on /api, /api/v1, /events, /ws and the media routes; read keys may only read, stream keys only stream"}},
+		},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document (GET /api/v1/openapi.json)
+func handleOpenAPI(c *gin.Context) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPIJSON)
+}
+
+// swaggerUIAssets returns where the docs page loads Swagger UI from: the copy vendored
+// into static/swagger-ui by go generate, or the pinned release on unpkg without it
+func swaggerUIAssets() (base string, vendored bool) {
+	if staticFileExists(SWAGGER_UI_DIR + "/swagger-ui-bundle.js") {
+		return basePath + "/static/" + SWAGGER_UI_DIR + "/", true
+	}
+	return SWAGGER_UI_CDN, false
+}
+
+// handleAPIDocs serves the Swagger UI page for the OpenAPI document (GET /api/v1/docs)
+func handleAPIDocs(c *gin.Context) {
+	assets, _ := swaggerUIAssets()
+	c.Data(http.StatusOK, "text/html; charset="+CHARSET, []byte(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>go-music API</title>
+    <link rel="stylesheet" href="`+assets+`swagger-ui.css">
+</head>
+<body>
+    <div id="swagger-ui"></div>
+    <script src="`+assets+`swagger-ui-bundle.js"></script>
+    <script src="`+basePath+`/static/swagger-init.js"></script>
+</body>
+</html>`))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// documentedPrefixes are the route groups every route of which needs an apiOps entry
+var documentedPrefixes = []string{"/api/v1/", "/admin/", "/audio/", "/hls/", "/artwork/", "/podcast/", "/lyrics/", "/waveform/", "/share/", "/embed/", "/oembed", "/radio/", "/graphql"}
+
+var ginParam = regexp.MustCompile(`[:*]([A-Za-z]+)`)
+
+// TestAPIOpsCoverRoutes checks that the OpenAPI document describes every JSON API,
+// admin and stream route, and nothing that isn't routed
+func TestAPIOpsCoverRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prev bool) { userHomes = prev }(userHomes)
+	userHomes = true // registers the sign-in routes as well
+	r := gin.New()
+	registerRoutes(r)
+
+	documented := make(map[string]bool, len(apiOps))
+	for _, op := range apiOps {
+		p := op.path
+		if i := strings.Index(p, "{path}"); i >= 0 {
+			p = p[:i+len("{path}")] // e.g. /hls/{path}/index.m3u8 is served by /hls/*path
+		}
+		documented[strings.ToUpper(op.method)+" "+p] = true
+	}
+	routed := make(map[string]bool)
+	for _, rt := range r.Routes() {
+		p := strings.TrimPrefix(rt.Path, basePath)
+		op := rt.Method + " " + ginParam.ReplaceAllString(p, "{$1}")
+		routed[op] = true
+		if rt.Method == "OPTIONS" || !hasAnyPrefix(p, documentedPrefixes) || p == "/api/v1/docs" {
+			continue
+		}
+		if !documented[op] {
+			t.Errorf("%s has no apiOps entry", op)
+		}
+	}
+	for op := range documented {
+		if !routed[op] {
+			t.Errorf("apiOps entry %s matches no route", op)
+		}
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const DEFAULT_MAX_LIST_RESULT = 10000
+
+// Response size limits (MAX_SEARCH_RESULT for searches, MAX_LIST_RESULT for other listings)
+var (
+	maxSearchResult = MAX_SEARCH_RESULT
+	maxListResult   = DEFAULT_MAX_LIST_RESULT
+)
+
+func initResponseLimits() error {
+	for _, opt := range []struct {
+		name string
+		dst  *int
+	}{{"MAX_SEARCH_RESULT", &maxSearchResult}, {"MAX_LIST_RESULT", &maxListResult}} {
+		v := os.Getenv(opt.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s: %q", opt.name, v)
+		}
+		*opt.dst = n
+	}
+	return nil
+}
+
+// pageInfo is appended to every list response so clients can detect and fetch further pages
+type pageInfo struct {
+	Total      int  `json:"total"`
+	Offset     int  `json:"offset"`
+	Limit      int  `json:"limit"`
+	Truncated  bool `json:"truncated"`
+	NextOffset int  `json:"nextOffset,omitempty"`
+}
+
+// requestPage reads the optional dfoffset/dflimit form fields, capping the limit at max
+func requestPage(c *gin.Context, max int) (offset, limit int) {
+	offset, _ = strconv.Atoi(c.PostForm("dfoffset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ = strconv.Atoi(c.PostForm("dflimit"))
+	if limit <= 0 || limit > max {
+		limit = max
+	}
+	return offset, limit
+}
+
+// paginate slices items for the requested page of a listing limited to max entries
+func paginate(c *gin.Context, items []string, max int) ([]string, pageInfo) {
+	offset, limit := requestPage(c, max)
+	info := pageInfo{Total: len(items), Offset: offset, Limit: limit}
+	if offset >= len(items) {
+		return []string{}, info
+	}
+	end := offset + limit
+	if end < len(items) {
+		info.Truncated = true
+		info.NextOffset = end
+	} else {
+		end = len(items)
+	}
+	return items[offset:end], info
+}
+
+// paginatePair pages through two lists as if concatenated (e.g. directories then files)
+func paginatePair(c *gin.Context, first, second []string, max int) ([]string, []string, pageInfo) {
+	combined := make([]string, 0, len(first)+len(second))
+	combined = append(combined, first...)
+	combined = append(combined, second...)
+	page, info := paginate(c, combined, max)
+	split := len(first) - info.Offset
+	if split < 0 {
+		split = 0
+	}
+	if split > len(page) {
+		split = len(page)
+	}
+	return page[:split], page[split:], info
+}
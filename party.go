@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PARTIES_OBJECT      = "parties.json"
+	PARTY_CODE_LEN      = 6
+	PARTY_CODE_ALPHABET = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O or 1/I to misread
+	PARTY_IDLE_TTL      = 12 * time.Hour                     // sessions nobody changed for this long end
+	MAX_PARTIES         = 100
+	MAX_PARTY_MEMBERS   = 50
+)
+
+// partyPlayback is where the host's player is: Position seconds into the current
+// entry at Updated, running on from there unless Paused
+type partyPlayback struct {
+	Position float64   `json:"position"`
+	Paused   bool      `json:"paused"`
+	Updated  time.Time `json:"updated"`
+}
+
+// at returns the position at t
+func (p partyPlayback) at(t time.Time) float64 {
+	if p.Paused || p.Updated.IsZero() {
+		return p.Position
+	}
+	return p.Position + t.Sub(p.Updated).Seconds()
+}
+
+// partySession is a shared listening session: its host plays the queue, every member
+// may append to it. Sessions are saved, so members can reconnect after a restart.
+type partySession struct {
+	Code     string               `json:"code"`
+	Host     string               `json:"host"`
+	Members  map[string]time.Time `json:"members"` // user → joined
+	Queue    playQueue            `json:"queue"`
+	Playback partyPlayback        `json:"playback"`
+	Created  time.Time            `json:"created"`
+	Active   time.Time            `json:"active"` // last change
+}
+
+func (s *partySession) expired() bool {
+	return time.Since(s.Active) > PARTY_IDLE_TTL
+}
+
+// response renders a session with stream URLs and the current position
+func (s *partySession) response() gin.H {
+	q := queueResponse(s.Host, s.Queue)
+	for i, item := range s.Queue.Items {
+		q["items"].([]gin.H)[i]["addedBy"] = item.AddedBy
+	}
+	members := make([]string, 0, len(s.Members))
+	for user := range s.Members {
+		members = append(members, user)
+	}
+	sortNames(members)
+	now := time.Now()
+	return gin.H{
+		"code":     s.Code,
+		"host":     s.Host,
+		"members":  members,
+		"queue":    q,
+		"position": s.Playback.at(now),
+		"paused":   s.Playback.Paused,
+		"time":     now.Unix(),
+	}
+}
+
+type partyStore struct {
+	mu       sync.Mutex
+	sessions map[string]*partySession
+	subs     map[string]map[*syncClient]struct{} // /ws connections following each session
+	doc      stateDoc
+}
+
+var parties = &partyStore{sessions: make(map[string]*partySession), subs: make(map[string]map[*syncClient]struct{}), doc: stateDoc{name: PARTIES_OBJECT}}
+
+// load reads the sessions object from the state store; a missing object means no sessions
+func (ps *partyStore) load(ctx context.Context) error {
+	return ps.doc.load(ctx, &ps.mu, ps)
+}
+
+// decode replaces the sessions, leaving out expired ones. Positions the host reported
+// to this instance since are kept, as they aren't saved.
+func (ps *partyStore) decode(data []byte) error {
+	sessions := make(map[string]*partySession)
+	if data != nil {
+		if err := json.Unmarshal(data, &sessions); err != nil {
+			return err
+		}
+	}
+	for code, s := range sessions {
+		if s.expired() {
+			delete(sessions, code)
+		} else if prev, ok := ps.sessions[code]; ok && prev.Playback.Updated.After(s.Playback.Updated) {
+			s.Playback = prev.Playback
+		}
+	}
+	ps.sessions = sessions
+	return nil
+}
+
+// encode returns the sessions, leaving out expired ones
+func (ps *partyStore) encode() (interface{}, error) {
+	for code, s := range ps.sessions {
+		if s.expired() {
+			delete(ps.sessions, code)
+		}
+	}
+	return ps.sessions, nil
+}
+
+// renameTracks points the session queues at the new keys of renamed tracks of library
+// lib (old key → new key) and returns how many items changed
+func (ps *partyStore) renameTracks(ctx context.Context, lib string, moved map[string]string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	n := 0
+	err := ps.doc.update(ctx, ps, func() bool {
+		n = 0
+		for _, s := range ps.sessions {
+			if k := renameQueueItems(s.Queue.Items, lib, moved); k > 0 {
+				s.Queue.Version++
+				s.Queue.Updated = time.Now().UTC()
+				n += k
+			}
+		}
+		return n > 0
+	})
+	if err != nil {
+		log.Printf("Party sessions save error: %v", err)
+		return 0
+	}
+	return n
+}
+
+// newPartyCode returns a code no session uses; the caller holds ps.mu
+func (ps *partyStore) newPartyCode() string {
+	b := make([]byte, PARTY_CODE_LEN)
+	for {
+		rand.Read(b)
+		for i := range b {
+			b[i] = PARTY_CODE_ALPHABET[int(b[i])%len(PARTY_CODE_ALPHABET)]
+		}
+		if _, taken := ps.sessions[string(b)]; !taken {
+			return string(b)
+		}
+	}
+}
+
+// create starts a session hosted by user
+func (ps *partyStore) create(ctx context.Context, host string) (partySession, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var s *partySession
+	var limitErr error
+	err := ps.doc.update(ctx, ps, func() bool {
+		live := 0
+		for _, s := range ps.sessions {
+			if !s.expired() {
+				live++
+			}
+		}
+		if live >= MAX_PARTIES {
+			limitErr = newUserError(MSG_PARTY_LIMIT, MAX_PARTIES)
+			return false
+		}
+		now := time.Now().UTC()
+		s = &partySession{
+			Code:    ps.newPartyCode(),
+			Host:    host,
+			Members: map[string]time.Time{host: now},
+			Queue:   playQueue{Items: []queueItem{}, Current: -1},
+			Created: now,
+			Active:  now,
+		}
+		ps.sessions[s.Code] = s
+		return true
+	})
+	if limitErr != nil {
+		return partySession{}, limitErr
+	}
+	if err != nil {
+		return partySession{}, err
+	}
+	return s.copy(), nil
+}
+
+// get returns a copy of a session that user is a member of
+func (ps *partyStore) get(code, user string) (partySession, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	s, ok := ps.sessions[strings.ToUpper(code)]
+	if !ok || s.expired() {
+		return partySession{}, newUserError(MSG_PARTY_NOT_FOUND)
+	}
+	if _, member := s.Members[user]; !member {
+		return partySession{}, newUserError(MSG_PARTY_NOT_MEMBER)
+	}
+	return s.copy(), nil
+}
+
+func (s *partySession) copy() partySession {
+	cp := *s
+	cp.Members = make(map[string]time.Time, len(s.Members))
+	for u, t := range s.Members {
+		cp.Members[u] = t
+	}
+	cp.Queue.Items = append([]queueItem{}, s.Queue.Items...)
+	return cp
+}
+
+// update applies fn to a session of which user is a member and saves it when fn
+// succeeds; fn may set end to end the session
+func (ps *partyStore) update(ctx context.Context, code, user string, fn func(s *partySession) (end bool, err error)) (partySession, error) {
+	return ps.change(ctx, code, func(s *partySession) (bool, error) {
+		if _, member := s.Members[user]; !member {
+			return false, newUserError(MSG_PARTY_NOT_MEMBER)
+		}
+		return fn(s)
+	})
+}
+
+// change applies fn to a session and saves it when fn succeeds; a failed save rolls
+// the change back. Connections following the session over /ws get the new state.
+func (ps *partyStore) change(ctx context.Context, code string, fn func(s *partySession) (end bool, err error)) (partySession, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	code = strings.ToUpper(code)
+	var s *partySession
+	var end bool
+	var fnErr error
+	err := ps.doc.update(ctx, ps, func() bool {
+		prev, ok := ps.sessions[code]
+		if !ok || prev.expired() {
+			fnErr = newUserError(MSG_PARTY_NOT_FOUND)
+			return false
+		}
+		cp := prev.copy()
+		s = &cp
+		if end, fnErr = fn(s); fnErr != nil {
+			return false
+		}
+		s.Active = time.Now().UTC()
+		if end {
+			delete(ps.sessions, code)
+		} else {
+			ps.sessions[code] = s
+		}
+		return true
+	})
+	if fnErr != nil {
+		return partySession{}, fnErr
+	}
+	if err != nil {
+		return partySession{}, err
+	}
+	// Followers that aren't members anymore get a last message without state
+	state := s.response()
+	for cl := range ps.subs[code] {
+		if _, member := s.Members[cl.user]; end || !member {
+			cl.deliver(syncMessage{Type: "party", Code: code})
+			delete(ps.subs[code], cl)
+			cl.party = ""
+			continue
+		}
+		cl.deliver(syncMessage{Type: "party", Code: code, Party: state})
+	}
+	if len(ps.subs[code]) == 0 {
+		delete(ps.subs, code)
+	}
+	return *s, nil
+}
+
+// follow subscribes a /ws connection to a session of its user and sends it the state;
+// an empty code stops following
+func (ps *partyStore) follow(cl *syncClient, code string) error {
+	ps.unfollow(cl)
+	if code == "" {
+		return nil
+	}
+	s, err := ps.get(code, cl.user)
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.subs[s.Code] == nil {
+		ps.subs[s.Code] = make(map[*syncClient]struct{})
+	}
+	ps.subs[s.Code][cl] = struct{}{}
+	cl.party = s.Code
+	cl.deliver(syncMessage{Type: "party", Code: s.Code, Party: s.response()})
+	return nil
+}
+
+func (ps *partyStore) unfollow(cl *syncClient) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if cl.party == "" {
+		return
+	}
+	delete(ps.subs[cl.party], cl)
+	if len(ps.subs[cl.party]) == 0 {
+		delete(ps.subs, cl.party)
+	}
+	cl.party = ""
+}
+
+// position takes a position report of the host's player and relays it to the other
+// followers. Positions aren't saved: a resumed session runs on from the last change.
+func (ps *partyStore) position(cl *syncClient, msg syncMessage) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	s, ok := ps.sessions[cl.party]
+	if !ok || s.Host != cl.user || msg.Position == nil {
+		return
+	}
+	s.Playback = partyPlayback{Position: *msg.Position, Paused: msg.Paused != nil && *msg.Paused, Updated: time.Now().UTC()}
+	out := syncMessage{Type: "position", Code: s.Code, Device: cl.device, Track: msg.Track, Library: msg.Library, Position: msg.Position, Paused: msg.Paused, Time: time.Now().Unix()}
+	for sub := range ps.subs[s.Code] {
+		if sub != cl {
+			sub.deliver(out)
+		}
+	}
+}
+
+// advanceParty moves a session's playback to entry next, -1 to stop; the caller checks the host
+func advanceParty(s *partySession, next int) {
+	if next < 0 || next >= len(s.Queue.Items) {
+		next = -1
+	}
+	s.Queue.Current = next
+	s.Queue.Version++
+	s.Queue.Updated = time.Now().UTC()
+	s.Playback = partyPlayback{Updated: time.Now().UTC()}
+}
+
+// finished moves a session on when the host's player finished its current entry
+func (ps *partyStore) finished(cl *syncClient, msg syncMessage) {
+	ps.mu.Lock()
+	code := cl.party
+	ps.mu.Unlock()
+	if code == "" {
+		return
+	}
+	_, err := ps.update(context.Background(), code, cl.user, func(s *partySession) (bool, error) {
+		if s.Host != cl.user || s.Queue.Current < 0 || s.Queue.Items[s.Queue.Current].Track != msg.Track {
+			return false, errPartyUnchanged
+		}
+		advanceParty(s, s.Queue.Current+1)
+		return false, nil
+	})
+	if err != nil && err != errPartyUnchanged {
+		log.Printf("Party %s save error: %v", code, err)
+	}
+}
+
+// errPartyUnchanged tells update there is nothing to save
+var errPartyUnchanged = errors.New("party session unchanged")
+
+// --- PARTY HANDLERS ---
+
+// writePartyResult answers a session change, mapping request errors to 400, 403 and 404
+func writePartyResult(c *gin.Context, s partySession, err error) {
+	if err != nil {
+		if ue, ok := err.(userError); ok {
+			status := http.StatusBadRequest
+			switch ue.code {
+			case MSG_PARTY_NOT_FOUND:
+				status = http.StatusNotFound
+			case MSG_PARTY_NOT_MEMBER, MSG_PARTY_HOST_ONLY:
+				status = http.StatusForbidden
+			case MSG_PARTY_LIMIT:
+				status = http.StatusTooManyRequests
+			}
+			apiError(c, status, ue.code, ue.args...)
+			return
+		}
+		log.Printf("Party save error: %v", err)
+		apiError(c, http.StatusInternalServerError, MSG_SAVE_FAILED)
+		return
+	}
+	c.JSON(http.StatusOK, s.response())
+}
+
+// handleCreateParty starts a session hosted by the user (POST /api/v1/party)
+func handleCreateParty(c *gin.Context) {
+	s, err := parties.create(c.Request.Context(), requestUser(c))
+	writePartyResult(c, s, err)
+}
+
+// handleGetParty returns a session with its queue and position (GET /api/v1/party/:code)
+func handleGetParty(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	s, err := parties.get(c.Param("code"), requestUser(c))
+	writePartyResult(c, s, err)
+}
+
+// handleJoinParty adds the user to a session by its code (POST /api/v1/party/:code/join)
+func handleJoinParty(c *gin.Context) {
+	user := requestUser(c)
+	s, err := parties.change(c.Request.Context(), c.Param("code"), func(s *partySession) (bool, error) {
+		if _, member := s.Members[user]; member {
+			return false, nil
+		}
+		if len(s.Members) >= MAX_PARTY_MEMBERS {
+			return false, newUserError(MSG_PARTY_FULL, MAX_PARTY_MEMBERS)
+		}
+		s.Members[user] = time.Now().UTC()
+		return false, nil
+	})
+	writePartyResult(c, s, err)
+}
+
+// handleLeaveParty removes the user from a session; the host leaving ends it
+// (POST /api/v1/party/:code/leave)
+func handleLeaveParty(c *gin.Context) {
+	user := requestUser(c)
+	_, err := parties.update(c.Request.Context(), c.Param("code"), user, func(s *partySession) (bool, error) {
+		delete(s.Members, user)
+		return user == s.Host, nil
+	})
+	if err != nil {
+		writePartyResult(c, partySession{}, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handlePartyAdd appends tracks of the request's library to a session's queue
+// (POST /api/v1/party/:code/queue, {"tracks":[...]})
+func handlePartyAdd(c *gin.Context) {
+	var req struct {
+		Tracks []string `json:"tracks"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Tracks) == 0 {
+		apiError(c, http.StatusBadRequest, MSG_TRACK_REQUIRED)
+		return
+	}
+	lib := libraryFrom(c.Request.Context())
+	user := requestUser(c)
+	var items []queueItem
+	for _, t := range req.Tracks {
+		key := strings.TrimPrefix(t, "/")
+		if code := checkKey(key); code != "" {
+			rejectInput(c, newInputError(c, "tracks", code))
+			return
+		}
+		if !isAudioFile(key) || !isListed(key, false) || !folderVisible(c.Request.Context(), key, false) || streamPolicy(key) == STREAM_BLOCK {
+			apiError(c, http.StatusBadRequest, MSG_TRACK_NOT_ALLOWED)
+			return
+		}
+		items = append(items, queueItem{Track: key, Library: lib.Name, AddedBy: user})
+	}
+	s, err := parties.update(c.Request.Context(), c.Param("code"), user, func(s *partySession) (bool, error) {
+		if len(s.Queue.Items)+len(items) > MAX_QUEUE_ITEMS {
+			return false, newUserError(MSG_QUEUE_FULL, MAX_QUEUE_ITEMS)
+		}
+		s.Queue.Items = append(s.Queue.Items, items...)
+		s.Queue.Version++
+		s.Queue.Updated = time.Now().UTC()
+		return false, nil
+	})
+	writePartyResult(c, s, err)
+}
+
+// handlePartyRemove removes a queue entry; members may remove the entries they added,
+// the host any (DELETE /api/v1/party/:code/queue/:index)
+func handlePartyRemove(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, MSG_INDEX_NOT_NUMBER)
+		return
+	}
+	user := requestUser(c)
+	s, err := parties.update(c.Request.Context(), c.Param("code"), user, func(s *partySession) (bool, error) {
+		if index < 0 || index >= len(s.Queue.Items) {
+			return false, newUserError(MSG_INDEX_OUT_OF_RANGE)
+		}
+		if user != s.Host && s.Queue.Items[index].AddedBy != user {
+			return false, newUserError(MSG_PARTY_HOST_ONLY)
+		}
+		s.Queue.Items = append(s.Queue.Items[:index], s.Queue.Items[index+1:]...)
+		switch {
+		case index < s.Queue.Current:
+			s.Queue.Current--
+		case index == s.Queue.Current:
+			advanceParty(s, index) // the following entry plays from its start
+		}
+		s.Queue.Version++
+		s.Queue.Updated = time.Now().UTC()
+		return false, nil
+	})
+	writePartyResult(c, s, err)
+}
+
+// handlePartyPlayback lets the host control playback (POST /api/v1/party/:code/playback);
+// {"index":n} jumps, {"step":1} or {"step":-1} skips, {"position":s} seeks and
+// {"paused":true} pauses. Followers on /ws get the new state.
+func handlePartyPlayback(c *gin.Context) {
+	var req struct {
+		Index    *int     `json:"index"`
+		Step     *int     `json:"step"`
+		Position *float64 `json:"position"`
+		Paused   *bool    `json:"paused"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, MSG_INVALID_REQUEST)
+		return
+	}
+	user := requestUser(c)
+	started := false
+	s, err := parties.update(c.Request.Context(), c.Param("code"), user, func(s *partySession) (bool, error) {
+		if user != s.Host {
+			return false, newUserError(MSG_PARTY_HOST_ONLY)
+		}
+		if req.Index != nil && (*req.Index < 0 || *req.Index >= len(s.Queue.Items)) {
+			return false, newUserError(MSG_INDEX_OUT_OF_RANGE)
+		}
+		now := time.Now().UTC()
+		switch {
+		case req.Index != nil:
+			advanceParty(s, *req.Index)
+			started = true
+		case req.Step != nil:
+			advanceParty(s, s.Queue.Current+*req.Step)
+			started = s.Queue.Current >= 0
+		}
+		pos := s.Playback.at(now)
+		if req.Position != nil && *req.Position >= 0 {
+			pos = *req.Position
+		}
+		paused := s.Playback.Paused
+		if req.Paused != nil {
+			paused = *req.Paused
+		}
+		s.Playback = partyPlayback{Position: pos, Paused: paused, Updated: now}
+		return false, nil
+	})
+	if err == nil && started {
+		item := s.Queue.Items[s.Queue.Current]
+		eventBus.Publish(EVENT_PLAY_STARTED, map[string]interface{}{"user": user, "device": "party:" + s.Code, "track": item.Track, "library": item.Library, "time": time.Now().Unix()})
+	}
+	writePartyResult(c, s, err)
+}
+
+// handleListParties lists the open sessions for admins (GET /admin/parties)
+func handleListParties(c *gin.Context) {
+	parties.mu.Lock()
+	out := []gin.H{}
+	for _, s := range parties.sessions {
+		if !s.expired() {
+			out = append(out, gin.H{"code": s.Code, "host": s.Host, "members": len(s.Members), "queued": len(s.Queue.Items), "following": len(parties.subs[s.Code]), "active": s.Active})
+		}
+	}
+	parties.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i]["code"].(string) < out[j]["code"].(string) })
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestPartyCodesNotServed checks that neither a guest nor a stream key can read the
+// party join codes of parties.json through the routes that serve objects
+func TestPartyCodesNotServed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prefixes []string, libs []*library, bucket, prefix string) {
+		publicPrefixes, libraries, s3Bucket, s3Prefix = prefixes, libs, bucket, prefix
+	}(publicPrefixes, libraries, s3Bucket, s3Prefix)
+	publicPrefixes = []string{""}
+	libraries = []*library{{Name: "Music", Bucket: "music"}}
+	s3Bucket, s3Prefix = "music", ""
+	useFakeS3(t, &fakeS3{objects: map[string]string{"music/" + META_DIR + "/" + PARTIES_OBJECT: `[{"code":"ABC234"}]`}})
+	stream := addTestAPIKey(t, "stream3", "alice", SCOPE_STREAM)
+	r := gin.New()
+	r.Use(ValidatePath())
+	registerRoutes(r)
+
+	for _, path := range []string{
+		"/audio/" + META_DIR + "/" + PARTIES_OBJECT,
+		"/audio/./" + META_DIR + "/" + PARTIES_OBJECT,
+		"/hls/" + META_DIR + "/" + PARTIES_OBJECT + "/" + HLS_PLAYLIST,
+		"/zip/" + META_DIR + ".zip",
+	} {
+		for _, token := range []string{"", stream} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code < 400 || strings.Contains(w.Body.String(), "ABC234") {
+				t.Errorf("GET %s (key %t): status %d, body %q", path, token != "", w.Code, w.Body.String())
+			}
+		}
+	}
+}
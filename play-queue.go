@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	QUEUES_OBJECT   = "queues.json"
+	MAX_QUEUE_ITEMS = 1000
+)
+
+// queueItem is one entry of a play queue; tracks may come from different libraries
+type queueItem struct {
+	Track   string `json:"track"`
+	Library string `json:"library"`
+	AddedBy string `json:"addedBy,omitempty"` // the member who queued it, in party sessions
+}
+
+// playQueue is the server-side queue shared by every device of a user. Current is the
+// index of the playing entry, -1 before playback starts. Version grows with every
+// change, so devices can tell whether their copy is stale.
+type playQueue struct {
+	Items   []queueItem `json:"items"`
+	Current int         `json:"current"`
+	Version int         `json:"version"`
+	Updated time.Time   `json:"updated"`
+}
+
+type queueStore struct {
+	mu     sync.Mutex
+	queues map[string]*playQueue
+	doc    stateDoc
+}
+
+var playQueues = &queueStore{queues: make(map[string]*playQueue), doc: stateDoc{name: QUEUES_OBJECT}}
+
+// load reads the queues object from the state store; a missing object means empty queues
+func (qs *queueStore) load(ctx context.Context) error {
+	return qs.doc.load(ctx, &qs.mu, qs)
+}
+
+func (qs *queueStore) decode(data []byte) error {
+	queues := make(map[string]*playQueue)
+	if data != nil {
+		if err := json.Unmarshal(data, &queues); err != nil {
+			return err
+		}
+	}
+	qs.queues = queues
+	return nil
+}
+
+func (qs *queueStore) encode() (interface{}, error) {
+	return qs.queues, nil
+}
+
+// update applies fn to the queue of user and saves it when fn succeeds. A failed
+// save rolls the change back.
+func (qs *queueStore) update(ctx context.Context, user string, fn func(q *playQueue) error) (playQueue, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	var q *playQueue
+	var fnErr error
+	err := qs.doc.update(ctx, qs, func() bool {
+		q = &playQueue{Current: -1}
+		if prev := qs.queues[user]; prev != nil {
+			cp := *prev
+			cp.Items = append([]queueItem{}, prev.Items...)
+			q = &cp
+		}
+		if fnErr = fn(q); fnErr != nil {
+			return false
+		}
+		q.Version++
+		q.Updated = time.Now().UTC()
+		qs.queues[user] = q
+		return true
+	})
+	if err == nil {
+		err = fnErr
+	}
+	if err != nil {
+		return playQueue{}, err
+	}
+	eventBus.Publish(EVENT_QUEUE_CHANGED, map[string]interface{}{"user": user, "version": q.Version, "current": q.Current})
+	return *q, nil
+}
+
+// renameTracks points queue items of library lib at the new keys of renamed tracks
+// (old key → new key) and returns how many items changed
+func (qs *queueStore) renameTracks(ctx context.Context, lib string, moved map[string]string) int {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	n := 0
+	var changed []string
+	err := qs.doc.update(ctx, qs, func() bool {
+		n, changed = 0, nil
+		for user, q := range qs.queues {
+			k := renameQueueItems(q.Items, lib, moved)
+			if k == 0 {
+				continue
+			}
+			n += k
+			q.Version++
+			q.Updated = time.Now().UTC()
+			changed = append(changed, user)
+		}
+		return n > 0
+	})
+	if err != nil {
+		log.Printf("Queues save error: %v", err)
+		return 0
+	}
+	for _, user := range changed {
+		q := qs.queues[user]
+		eventBus.Publish(EVENT_QUEUE_CHANGED, map[string]interface{}{"user": user, "version": q.Version, "current": q.Current})
+	}
+	return n
+}
+
+// renameQueueItems rewrites the items of lib found in moved and returns their number
+func renameQueueItems(items []queueItem, lib string, moved map[string]string) int {
+	n := 0
+	for i := range items {
+		if items[i].Library != lib {
+			continue
+		}
+		if to, ok := moved[items[i].Track]; ok {
+			items[i].Track = to
+			n++
+		}
+	}
+	return n
+}
+
+func (qs *queueStore) get(user string) playQueue {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q, ok := qs.queues[user]
+	if !ok {
+		return playQueue{Items: []queueItem{}, Current: -1}
+	}
+	cp := *q
+	cp.Items = append([]queueItem{}, q.Items...)
+	return cp
+}
+
+// queueEntry renders an item with its stream URL
+func queueEntry(item queueItem) gin.H {
+	entry := gin.H{"track": item.Track, "library": item.Library}
+	if lib := findLibrary(item.Library); lib != nil {
+		entry["url"] = audioURL(lib, item.Track, nil)
+	}
+	return entry
+}
+
+// queueResponse renders a queue together with its current and next entries
+func queueResponse(user string, q playQueue) gin.H {
+	items := make([]gin.H, len(q.Items))
+	for i, item := range q.Items {
+		items[i] = queueEntry(item)
+	}
+	resp := gin.H{"user": user, "items": items, "current": q.Current, "version": q.Version}
+	if q.Current >= 0 && q.Current < len(q.Items) {
+		resp["nowPlaying"] = items[q.Current]
+	}
+	if q.Current+1 < len(q.Items) {
+		resp["next"] = items[q.Current+1]
+	}
+	return resp
+}
+
+// writeQueueResult answers a queue change, mapping request errors to 400
+func writeQueueResult(c *gin.Context, user string, q playQueue, err error) {
+	if err != nil {
+		if ue, ok := err.(userError); ok {
+			apiError(c, http.StatusBadRequest, ue.code, ue.args...)
+			return
+		}
+		log.Printf("Queue save error: %v", err)
+		apiError(c, http.StatusInternalServerError, MSG_SAVE_FAILED)
+		return
+	}
+	c.JSON(http.StatusOK, queueResponse(user, q))
+}
+
+// --- QUEUE HANDLERS ---
+
+// handleGetQueue returns the user's queue (GET /api/v1/queue)
+func handleGetQueue(c *gin.Context) {
+	user := requestUser(c)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, queueResponse(user, playQueues.get(user)))
+}
+
+// handleQueueAdd appends tracks of the request's library, or inserts them before
+// position (POST /api/v1/queue, {"tracks":[...],"position":n})
+func handleQueueAdd(c *gin.Context) {
+	var req struct {
+		Tracks   []string `json:"tracks"`
+		Position *int     `json:"position"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Tracks) == 0 {
+		apiError(c, http.StatusBadRequest, MSG_TRACK_REQUIRED)
+		return
+	}
+	lib := libraryFrom(c.Request.Context())
+	var items []queueItem
+	for _, t := range req.Tracks {
+		key := strings.TrimPrefix(t, "/")
+		if code := checkKey(key); code != "" {
+			rejectInput(c, newInputError(c, "tracks", code))
+			return
+		}
+		if !isAudioFile(key) || !isListed(key, false) || !folderVisible(c.Request.Context(), key, false) || streamPolicy(key) == STREAM_BLOCK {
+			apiError(c, http.StatusBadRequest, MSG_TRACK_NOT_ALLOWED)
+			return
+		}
+		items = append(items, queueItem{Track: key, Library: lib.Name})
+	}
+	user := requestUser(c)
+	q, err := playQueues.update(c.Request.Context(), user, func(q *playQueue) error {
+		if len(q.Items)+len(items) > MAX_QUEUE_ITEMS {
+			return newUserError(MSG_QUEUE_FULL, MAX_QUEUE_ITEMS)
+		}
+		pos := len(q.Items)
+		if req.Position != nil {
+			if *req.Position < 0 || *req.Position > len(q.Items) {
+				return newUserError(MSG_INDEX_OUT_OF_RANGE)
+			}
+			pos = *req.Position
+		}
+		q.Items = append(q.Items[:pos], append(items, q.Items[pos:]...)...)
+		if q.Current >= pos {
+			q.Current += len(items) // the playing entry moved down
+		}
+		return nil
+	})
+	writeQueueResult(c, user, q, err)
+}
+
+// handleQueueRemove removes the entry at an index (DELETE /api/v1/queue/:index)
+func handleQueueRemove(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, MSG_INDEX_NOT_NUMBER)
+		return
+	}
+	user := requestUser(c)
+	q, err := playQueues.update(c.Request.Context(), user, func(q *playQueue) error {
+		if index < 0 || index >= len(q.Items) {
+			return newUserError(MSG_INDEX_OUT_OF_RANGE)
+		}
+		q.Items = append(q.Items[:index], q.Items[index+1:]...)
+		switch {
+		case index < q.Current:
+			q.Current--
+		case index == q.Current && q.Current == len(q.Items):
+			q.Current = -1 // the last entry was playing
+		}
+		// Removing another playing entry makes the following one current
+		return nil
+	})
+	writeQueueResult(c, user, q, err)
+}
+
+// handleQueueMove moves an entry (POST /api/v1/queue/move, {"from":i,"to":j})
+func handleQueueMove(c *gin.Context) {
+	var req struct {
+		From *int `json:"from"`
+		To   *int `json:"to"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.From == nil || req.To == nil {
+		apiError(c, http.StatusBadRequest, MSG_FROM_TO_REQUIRED)
+		return
+	}
+	from, to := *req.From, *req.To
+	user := requestUser(c)
+	q, err := playQueues.update(c.Request.Context(), user, func(q *playQueue) error {
+		if from < 0 || from >= len(q.Items) || to < 0 || to >= len(q.Items) {
+			return newUserError(MSG_INDEX_OUT_OF_RANGE)
+		}
+		item := q.Items[from]
+		q.Items = append(q.Items[:from], q.Items[from+1:]...)
+		q.Items = append(q.Items[:to], append([]queueItem{item}, q.Items[to:]...)...)
+		// Keep pointing at the same playing entry
+		switch {
+		case q.Current == from:
+			q.Current = to
+		case from < q.Current && to >= q.Current:
+			q.Current--
+		case from > q.Current && to <= q.Current && q.Current >= 0:
+			q.Current++
+		}
+		return nil
+	})
+	writeQueueResult(c, user, q, err)
+}
+
+// handleQueueClear empties the queue (DELETE /api/v1/queue)
+func handleQueueClear(c *gin.Context) {
+	user := requestUser(c)
+	q, err := playQueues.update(c.Request.Context(), user, func(q *playQueue) error {
+		q.Items = nil
+		q.Current = -1
+		return nil
+	})
+	writeQueueResult(c, user, q, err)
+}
+
+// handleQueueNext advances playback (POST /api/v1/queue/next); {"index":n} jumps to
+// an entry and {"step":-1} goes back. Moving past the end stops playback.
+func handleQueueNext(c *gin.Context) {
+	var req struct {
+		Index *int `json:"index"`
+		Step  *int `json:"step"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apiError(c, http.StatusBadRequest, MSG_INVALID_REQUEST)
+			return
+		}
+	}
+	user := requestUser(c)
+	q, err := playQueues.update(c.Request.Context(), user, func(q *playQueue) error {
+		next := q.Current + 1
+		if req.Step != nil {
+			next = q.Current + *req.Step
+		}
+		if req.Index != nil {
+			next = *req.Index
+		}
+		if next < 0 || next >= len(q.Items) {
+			if req.Index != nil {
+				return newUserError(MSG_INDEX_OUT_OF_RANGE)
+			}
+			next = -1
+		}
+		q.Current = next
+		return nil
+	})
+	if err == nil && q.Current >= 0 {
+		item := q.Items[q.Current]
+		eventBus.Publish(EVENT_PLAY_STARTED, map[string]interface{}{"user": user, "device": "queue:" + user, "track": item.Track, "library": item.Library, "time": time.Now().Unix()})
+	}
+	writeQueueResult(c, user, q, err)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PLAYLISTS_OBJECT    = "playlists.json"
+	MAX_PLAYLIST_UPLOAD = 1 << 20
+	MAX_PLAYLIST_TRACKS = 10000
+	MAX_PLAYLIST_NAME   = 100
+	PLAYLIST_UNMATCHED  = "not found"
+	PLAYLIST_AMBIGUOUS  = "ambiguous"
+	PLAYLIST_FORM_FIELD = "file"
+	PLAYLIST_PLS_HEADER = "[playlist]"
+	PLAYLIST_EXTINF     = "#EXTINF:"
+	PLAYLIST_MIN_SUFFIX = 2 // path segments that must agree when several files share a name
+	PLAYLIST_ARTIST_SEP = " - "
+)
+
+// playlist is a saved list of tracks of one library, owned by a user
+type playlist struct {
+	Name    string    `json:"name"`
+	Library string    `json:"library"`
+	Tracks  []string  `json:"tracks"`
+	Created time.Time `json:"created"`
+}
+
+// playlistStore holds playlists per user and name
+type playlistStore struct {
+	mu    sync.Mutex
+	users map[string]map[string]*playlist
+	doc   stateDoc
+}
+
+var playlists = &playlistStore{users: make(map[string]map[string]*playlist), doc: stateDoc{name: PLAYLISTS_OBJECT}}
+
+// load reads the playlists object from the state store; a missing object means no playlists
+func (ps *playlistStore) load(ctx context.Context) error {
+	return ps.doc.load(ctx, &ps.mu, ps)
+}
+
+func (ps *playlistStore) decode(data []byte) error {
+	users := make(map[string]map[string]*playlist)
+	if data != nil {
+		if err := json.Unmarshal(data, &users); err != nil {
+			return err
+		}
+	}
+	ps.users = users
+	return nil
+}
+
+func (ps *playlistStore) encode() (interface{}, error) {
+	return ps.users, nil
+}
+
+func (ps *playlistStore) list(user string) []playlist {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	out := []playlist{}
+	for _, p := range ps.users[user] {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (ps *playlistStore) get(user, name string) (playlist, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.users[user][name]
+	if !ok {
+		return playlist{}, false
+	}
+	return *p, true
+}
+
+// put stores p, replacing a playlist of the same name
+func (ps *playlistStore) put(ctx context.Context, user string, p playlist) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.doc.update(ctx, ps, func() bool {
+		if ps.users[user] == nil {
+			ps.users[user] = make(map[string]*playlist)
+		}
+		stored := p
+		ps.users[user][p.Name] = &stored
+		return true
+	})
+}
+
+func (ps *playlistStore) delete(ctx context.Context, user, name string) (bool, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	found := false
+	err := ps.doc.update(ctx, ps, func() bool {
+		_, found = ps.users[user][name]
+		delete(ps.users[user], name)
+		return found
+	})
+	if err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+// renameTracks points the playlists of library lib at the new keys of renamed tracks
+// (old key → new key) and returns how many entries changed
+func (ps *playlistStore) renameTracks(ctx context.Context, lib string, moved map[string]string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	n := 0
+	err := ps.doc.update(ctx, ps, func() bool {
+		n = 0
+		for _, lists := range ps.users {
+			for _, p := range lists {
+				if p.Library != lib {
+					continue
+				}
+				for i, t := range p.Tracks {
+					if to, ok := moved[t]; ok {
+						p.Tracks[i] = to
+						n++
+					}
+				}
+			}
+		}
+		return n > 0
+	})
+	if err != nil {
+		log.Printf("Playlists save error: %v", err)
+		return 0
+	}
+	return n
+}
+
+// playlistEntry is a track reference read from an uploaded playlist
+type playlistEntry struct {
+	Line  int    `json:"line"`
+	Entry string `json:"entry"`
+	Title string `json:"title,omitempty"` // from #EXTINF or TitleN, usually "Artist - Title"
+}
+
+var plsLine = regexp.MustCompile(`(?i)^(File|Title)(\d+)=(.*)$`)
+
+// parsePlaylist reads M3U/M3U8 (one path or URL per line, #EXTINF titles) or PLS
+// (FileN= and TitleN= keys). Playlists that aren't UTF-8 are read as Latin-1, like
+// classic .m3u files.
+func parsePlaylist(data string) []playlistEntry {
+	data = strings.TrimPrefix(data, "\xef\xbb\xbf")
+	if !utf8.ValidString(data) {
+		r := make([]rune, len(data))
+		for i := 0; i < len(data); i++ {
+			r[i] = rune(data[i])
+		}
+		data = string(r)
+	}
+	var entries []playlistEntry
+	pls := make(map[string]*playlistEntry)
+	var order []string
+	title := ""
+	isPLS := false
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 64<<10), MAX_PLAYLIST_UPLOAD)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.EqualFold(line, PLAYLIST_PLS_HEADER):
+			isPLS = true
+		case isPLS:
+			m := plsLine.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			e := pls[m[2]]
+			if e == nil {
+				e = &playlistEntry{}
+				pls[m[2]] = e
+				order = append(order, m[2])
+			}
+			if strings.EqualFold(m[1], "File") {
+				e.Line, e.Entry = n, strings.TrimSpace(m[3])
+			} else {
+				e.Title = strings.TrimSpace(m[3])
+			}
+		case strings.HasPrefix(line, PLAYLIST_EXTINF):
+			if _, t, ok := strings.Cut(line[len(PLAYLIST_EXTINF):], ","); ok {
+				title = strings.TrimSpace(t)
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			entries = append(entries, playlistEntry{Line: n, Entry: line, Title: title})
+			title = ""
+		}
+	}
+	for _, id := range order {
+		if e := pls[id]; e.Entry != "" {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+// matchName reduces a file name or title to lower-case words, without extension and
+// leading track number, for fuzzy comparison
+func matchName(s string) string {
+	s = strings.TrimSuffix(s, path.Ext(s))
+	s = strings.TrimLeft(s, "0123456789")
+	var b strings.Builder
+	space := true
+	for _, r := range foldPathSegment(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			space = false
+		} else if !space {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// trackMatcher finds library keys for playlist entries written on other machines
+type trackMatcher struct {
+	exact  map[string]string   // folded key
+	byName map[string][]string // folded file name
+	fuzzy  map[string][]string // matchName of the file name
+}
+
+func newTrackMatcher(keys []string) *trackMatcher {
+	m := &trackMatcher{exact: make(map[string]string), byName: make(map[string][]string), fuzzy: make(map[string][]string)}
+	for _, key := range keys {
+		m.exact[foldPathSegment(key)] = key
+		name := path.Base(key)
+		m.byName[foldPathSegment(name)] = append(m.byName[foldPathSegment(name)], key)
+		if f := matchName(name); f != "" {
+			m.fuzzy[f] = append(m.fuzzy[f], key)
+		}
+	}
+	return m
+}
+
+// entryPath turns a playlist entry (relative or absolute path, Windows path, file:// or
+// http URL) into slash-separated path segments
+func entryPath(entry string) string {
+	if u, err := url.Parse(entry); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		entry = u.Path
+	}
+	entry = strings.ReplaceAll(entry, "\\", "/")
+	if len(entry) > 1 && entry[1] == ':' {
+		entry = entry[2:] // drive letter
+	}
+	return strings.Trim(path.Clean("/"+entry), "/")
+}
+
+// pick chooses among keys sharing a name the one whose folders agree most with the entry
+func pick(keys []string, entry, artist string) (string, bool) {
+	if len(keys) == 1 {
+		return keys[0], true
+	}
+	want := strings.Split(foldPathSegment(entry), "/")
+	best, bestScore, tie := "", 0, false
+	for _, key := range keys {
+		have := strings.Split(foldPathSegment(key), "/")
+		score := 0
+		for score < len(want) && score < len(have) && want[len(want)-1-score] == have[len(have)-1-score] {
+			score++
+		}
+		if artist != "" && strings.Contains(foldPathSegment(key), artist) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore, tie = key, score, false
+		} else if score == bestScore {
+			tie = true
+		}
+	}
+	if tie || bestScore < PLAYLIST_MIN_SUFFIX {
+		return "", false
+	}
+	return best, true
+}
+
+// match returns the key of an entry: its path relative to the library, then its file
+// name (ambiguous names decided by their folders), then file name or title with
+// punctuation and track numbers ignored. reason says why nothing matched.
+func (m *trackMatcher) match(e playlistEntry) (key, reason string) {
+	p := entryPath(e.Entry)
+	segments := strings.Split(p, "/")
+	for i := range segments {
+		if k, ok := m.exact[foldPathSegment(strings.Join(segments[i:], "/"))]; ok {
+			return k, ""
+		}
+	}
+	artist, title, _ := strings.Cut(e.Title, PLAYLIST_ARTIST_SEP)
+	if title == "" {
+		artist, title = "", e.Title
+	}
+	artist = foldPathSegment(strings.TrimSpace(artist))
+	reason = PLAYLIST_UNMATCHED
+	for _, candidates := range [][]string{
+		m.byName[foldPathSegment(path.Base(p))],
+		m.fuzzy[matchName(path.Base(p))],
+		m.fuzzy[matchName(title)],
+		m.fuzzy[matchName(e.Title)],
+	} {
+		if len(candidates) == 0 {
+			continue
+		}
+		if k, ok := pick(candidates, p, artist); ok {
+			return k, ""
+		}
+		reason = PLAYLIST_AMBIGUOUS
+	}
+	return "", reason
+}
+
+// --- PLAYLIST HANDLERS ---
+
+// handleImportPlaylist creates a playlist from an uploaded M3U/M3U8/PLS file (POST
+// /api/v1/playlists/import?name=), sent as the "file" form field or as the body. It
+// answers the matched tracks and the lines that matched nothing or several tracks.
+func handleImportPlaylist(c *gin.Context) {
+	if kioskMode {
+		apiError(c, http.StatusForbidden, MSG_KIOSK_UNAVAILABLE)
+		return
+	}
+	var body io.Reader = c.Request.Body
+	name := strings.TrimSpace(c.Query("name"))
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		fh, err := c.FormFile(PLAYLIST_FORM_FIELD)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, MSG_INVALID_REQUEST)
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			apiError(c, http.StatusBadRequest, MSG_INVALID_REQUEST)
+			return
+		}
+		defer f.Close()
+		body = f
+		if name == "" {
+			name = strings.TrimSuffix(fh.Filename, path.Ext(fh.Filename))
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(body, MAX_PLAYLIST_UPLOAD+1))
+	if err != nil || len(data) > MAX_PLAYLIST_UPLOAD {
+		apiError(c, http.StatusRequestEntityTooLarge, MSG_PLAYLIST_TOO_LARGE, MAX_PLAYLIST_UPLOAD)
+		return
+	}
+	if name == "" || len(name) > MAX_PLAYLIST_NAME {
+		apiError(c, http.StatusBadRequest, MSG_PLAYLIST_NAME, MAX_PLAYLIST_NAME)
+		return
+	}
+	entries := parsePlaylist(string(data))
+	if len(entries) == 0 || len(entries) > MAX_PLAYLIST_TRACKS {
+		apiError(c, http.StatusBadRequest, MSG_PLAYLIST_SIZE, MAX_PLAYLIST_TRACKS)
+		return
+	}
+	ctx := c.Request.Context()
+	keys, err := s3ListAllTracks(ctx, "")
+	if err != nil {
+		log.Printf("S3 list error: %v", err)
+		apiError(c, http.StatusBadGateway, MSG_LISTING_FAILED)
+		return
+	}
+	var listed []string
+	for _, k := range keys {
+		if !isMetaDir(k) && kioskVisible(k, false) && streamPolicy(k) != STREAM_BLOCK {
+			listed = append(listed, k)
+		}
+	}
+	matcher := newTrackMatcher(listed)
+	lib := libraryFrom(ctx)
+	p := playlist{Name: name, Library: lib.Name, Tracks: []string{}, Created: time.Now().UTC()}
+	type unmatched struct {
+		playlistEntry
+		Reason string `json:"reason"`
+	}
+	missing := []unmatched{}
+	for _, e := range entries {
+		if key, reason := matcher.match(e); key != "" {
+			p.Tracks = append(p.Tracks, key)
+		} else {
+			missing = append(missing, unmatched{e, reason})
+		}
+	}
+	user := requestUser(c)
+	if err := playlists.put(ctx, user, p); err != nil {
+		log.Printf("Playlists save error: %v", err)
+		apiError(c, http.StatusInternalServerError, MSG_SAVE_FAILED)
+		return
+	}
+	audit.record(c, "playlist.import", lib.Name, name, "")
+	c.JSON(http.StatusOK, gin.H{"playlist": name, "library": lib.Name, "entries": len(entries), "matched": len(p.Tracks), "unmatched": missing})
+}
+
+// handleListPlaylists lists the user's playlists without their tracks (GET /api/v1/playlists)
+func handleListPlaylists(c *gin.Context) {
+	user := requestUser(c)
+	out := []gin.H{}
+	for _, p := range playlists.list(user) {
+		out = append(out, gin.H{"name": p.Name, "library": p.Library, "tracks": len(p.Tracks), "created": p.Created})
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user, "playlists": out})
+}
+
+// handleGetPlaylist returns a playlist with stream URLs (GET /api/v1/playlists/:name)
+func handleGetPlaylist(c *gin.Context) {
+	p, ok := playlists.get(requestUser(c), c.Param("name"))
+	if !ok {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_PLAYLIST)
+		return
+	}
+	lib := findLibrary(p.Library)
+	if lib == nil {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_LIBRARY)
+		return
+	}
+	durations := manifest.durations(lib, p.Tracks)
+	tracks := make([]gin.H, len(p.Tracks))
+	for i, key := range p.Tracks {
+		tracks[i] = gin.H{"key": key, "url": audioURL(lib, key, nil), "duration": durations[i]}
+	}
+	c.JSON(http.StatusOK, gin.H{"name": p.Name, "library": p.Library, "created": p.Created, "tracks": tracks})
+}
+
+// handleDeletePlaylist removes a playlist (DELETE /api/v1/playlists/:name)
+func handleDeletePlaylist(c *gin.Context) {
+	if kioskMode {
+		apiError(c, http.StatusForbidden, MSG_KIOSK_UNAVAILABLE)
+		return
+	}
+	found, err := playlists.delete(c.Request.Context(), requestUser(c), c.Param("name"))
+	if err != nil {
+		log.Printf("Playlists save error: %v", err)
+		apiError(c, http.StatusInternalServerError, MSG_SAVE_FAILED)
+		return
+	}
+	if !found {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_PLAYLIST)
+		return
+	}
+	audit.record(c, "playlist.delete", "", c.Param("name"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
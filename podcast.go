@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Episodes get synthetic publication dates one hour apart from this date, so that
+// podcast apps keep the folder's natural file order
+var podcastEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type podcastRSS struct {
+	XMLName xml.Name       `xml:"rss"`
+	Version string         `xml:"version,attr"`
+	Itunes  string         `xml:"xmlns:itunes,attr"`
+	Channel podcastChannel `xml:"channel"`
+}
+
+type podcastChannel struct {
+	Title       string           `xml:"title"`
+	Link        string           `xml:"link"`
+	Description string           `xml:"description"`
+	Type        string           `xml:"itunes:type"`
+	Image       *podcastImage    `xml:"itunes:image,omitempty"`
+	Items       []podcastEpisode `xml:"item"`
+}
+
+type podcastImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type podcastEpisode struct {
+	Title     string           `xml:"title"`
+	GUID      podcastGUID      `xml:"guid"`
+	PubDate   string           `xml:"pubDate"`
+	Enclosure podcastEnclosure `xml:"enclosure"`
+	Duration  int              `xml:"itunes:duration,omitempty"`
+	Episode   int              `xml:"itunes:episode"`
+}
+
+type podcastGUID struct {
+	PermaLink bool   `xml:"isPermaLink,attr"`
+	Value     string `xml:",chardata"`
+}
+
+type podcastEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// handlePodcast renders a folder as a serial podcast feed (GET /podcast/<folder>.xml),
+// one episode per audio file below it in natural order
+func handlePodcast(c *gin.Context) {
+	p := strings.TrimPrefix(c.Param("path"), "/")
+	if !strings.HasSuffix(p, ".xml") {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	dir := strings.Trim(strings.TrimSuffix(p, ".xml"), "/")
+	if dir == "" || !isListed(dir, true) || !folderVisible(c.Request.Context(), dir, true) {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	ctx := c.Request.Context()
+	lib := libraryFrom(ctx)
+	objects, err := s3ListAudioObjects(ctx, dir+"/")
+	if err != nil {
+		log.Printf("Podcast listing error: %v", err)
+		c.String(http.StatusInternalServerError, "Listing failed")
+		return
+	}
+	sizes := make(map[string]int64, len(objects))
+	var keys []string
+	for _, obj := range objects {
+		if streamPolicy(obj.Key) != STREAM_BLOCK {
+			sizes[obj.Key] = obj.Size
+			keys = append(keys, obj.Key)
+		}
+	}
+	if len(keys) == 0 {
+		c.String(http.StatusNotFound, "No tracks")
+		return
+	}
+	sortNames(keys)
+	durations := manifest.durations(lib, keys)
+
+	var query url.Values
+	if lib != defaultLibrary() {
+		query = url.Values{"lib": {lib.Name}}
+	}
+	withLib := func(u string) string {
+		if query != nil {
+			return u + "?" + query.Encode()
+		}
+		return u
+	}
+	feed := podcastRSS{Version: "2.0", Itunes: "http://www.itunes.com/dtds/podcast-1.0.dtd", Channel: podcastChannel{
+		Title:       path.Base(dir),
+		Link:        externalURL(c, "/"),
+		Description: dir,
+		Type:        "serial",
+	}}
+	if _, files, err := s3List(ctx, dir+"/", "/"); err == nil && pickArtwork(files) != "" {
+		segments := strings.Split(dir, "/")
+		for i, seg := range segments {
+			segments[i] = url.PathEscape(seg)
+		}
+		feed.Channel.Image = &podcastImage{Href: externalURL(c, withLib("/artwork/"+strings.Join(segments, "/")))}
+	}
+	for i, key := range keys {
+		ctype, _ := servedContentType(lib, key)
+		name := path.Base(key)
+		feed.Channel.Items = append(feed.Channel.Items, podcastEpisode{
+			Title:     strings.TrimSuffix(name, path.Ext(name)),
+			GUID:      podcastGUID{Value: lib.Name + ":" + key},
+			PubDate:   podcastEpoch.Add(time.Duration(i) * time.Hour).Format(time.RFC1123Z),
+			Enclosure: podcastEnclosure{URL: externalURL(c, strings.TrimPrefix(audioURL(lib, key, nil), basePath)), Length: sizes[key], Type: ctype},
+			Duration:  durations[i],
+			Episode:   i + 1,
+		})
+	}
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Feed failed")
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), data...))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PREFETCH_WORKERS = 2 // concurrent prefetches; more are skipped rather than queued
+	PREFETCH_TIMEOUT = 5 * time.Minute
+)
+
+// PREFETCH=on copies the next track of a user's play queue into the audio disk cache
+// (CACHE_DIR) while the current one streams, so the next track starts from local disk
+var (
+	prefetchNext  = os.Getenv("PREFETCH") == "on"
+	prefetching   sync.Map // cache keys being fetched
+	prefetchSlots = make(chan struct{}, PREFETCH_WORKERS)
+)
+
+func initPrefetch() error {
+	switch v := os.Getenv("PREFETCH"); v {
+	case "", "off":
+	case "on":
+		if cacheDir == "" {
+			return fmt.Errorf("PREFETCH=on needs the audio disk cache (CACHE_DIR)")
+		}
+	default:
+		return fmt.Errorf("invalid PREFETCH: %q, expected on or off", v)
+	}
+	return nil
+}
+
+// prefetchQueued starts fetching the track after key when key is the current entry of
+// the user's play queue. Cue sheet tracks are skipped, as they usually share the file
+// that is streaming already.
+func prefetchQueued(c *gin.Context, key string) {
+	if !prefetchNext || audioCache == nil || cdnMode {
+		return
+	}
+	q := playQueues.get(requestUser(c))
+	if q.Current < 0 || q.Current+1 >= len(q.Items) {
+		return
+	}
+	current, next := q.Items[q.Current], q.Items[q.Current+1]
+	if current.Track != key || current.Library != libraryFrom(c.Request.Context()).Name {
+		return
+	}
+	lib := findLibrary(next.Library)
+	if lib == nil || streamPolicy(next.Track) == STREAM_BLOCK {
+		return
+	}
+	if _, _, ok := parseCueTrackKey(next.Track); ok {
+		return
+	}
+	go prefetch(lib, next.Track)
+}
+
+// prefetch reads an object into the audio disk cache unless it is cached or on its way
+func prefetch(lib *library, key string) {
+	cacheKey := lib.cacheKey(key)
+	if _, busy := prefetching.LoadOrStore(cacheKey, struct{}{}); busy {
+		return
+	}
+	defer prefetching.Delete(cacheKey)
+	select {
+	case prefetchSlots <- struct{}{}:
+	default:
+		return
+	}
+	defer func() { <-prefetchSlots }()
+	ctx, cancel := context.WithTimeout(withS3Feature(withLibrary(context.Background(), lib), "prefetch"), PREFETCH_TIMEOUT)
+	defer cancel()
+	etag, _, _, err := s3HeadAudioFile(ctx, key)
+	if err != nil || audioCache.Has(cacheKey, etag) {
+		return
+	}
+	body, size, _, err := s3GetAudioFile(ctx, key)
+	if err != nil {
+		log.Printf("Prefetch of %s failed: %v", key, err)
+		return
+	}
+	body = audioCache.Fill(cacheKey, etag, body, size)
+	defer body.Close()
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		log.Printf("Prefetch of %s failed: %v", key, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// PROTOCOL_VERSION is the version of the dffunc contract: the function names, their
+	// dfdata and the arrays handed to the callbacks. Raise it on incompatible changes and
+	// keep MIN_PROTOCOL_VERSION at the oldest client version still served.
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1
+
+	PROTOCOL_HEADER = "X-Go-Music-Protocol"
+)
+
+// dffuncNames are the functions handleRequest dispatches, as announced by getCapabilities
+var dffuncNames = []string{
+	"dir", "searchTitle", "searchTitleIn", "searchDir", "getAllMp3", "getAllMp3InDir", "getAllMp3InDirs",
+	"getAllDirs", "getDirStats", "getChapters", "resolveTracks", "registerDevice", "listDevices",
+	"sendDeviceCommand", "pollDeviceCommands", "nowPlaying", "getCollections", "getCollection",
+	"getAllMp3InCollection", "getSmartPlaylists", "getAllMp3InSmartPlaylist", "shuffle", "getLibraries",
+	"searchAsync", "searchJob", "getCapabilities",
+}
+
+// checkProtocol refuses dffunc requests whose dfversion this server doesn't speak; it
+// answers the error itself. Requests without dfversion come from clients older than
+// versioning and are served as version 1.
+func checkProtocol(c *gin.Context) bool {
+	c.Header(PROTOCOL_HEADER, strconv.Itoa(PROTOCOL_VERSION))
+	v := strings.TrimSpace(c.PostForm("dfversion"))
+	if v == "" {
+		return true
+	}
+	n, err := strconv.Atoi(v)
+	code := ""
+	switch {
+	case err != nil || n < 1:
+		code = MSG_PROTOCOL_INVALID
+	case n < MIN_PROTOCOL_VERSION:
+		code = MSG_CLIENT_OUTDATED // a cached page of an older release
+	case n > PROTOCOL_VERSION:
+		code = MSG_SERVER_OUTDATED // a newer page against an older server, e.g. behind a CDN
+	}
+	if code == "" {
+		return true
+	}
+	text := msg(c, code, v, PROTOCOL_VERSION)
+	if code == MSG_PROTOCOL_INVALID {
+		text = msg(c, code, v)
+	}
+	rejectInput(c, inputError{Field: "dfversion", Code: code, Message: text})
+	return false
+}
+
+// capabilities describes the protocol, the enabled features and the limits of this server
+func capabilities(c *gin.Context) gin.H {
+	libs := len(libraries)
+	if userHomes {
+		libs = len(tenantLibraryNames(c))
+	}
+	return gin.H{
+		"protocol":    PROTOCOL_VERSION,
+		"minProtocol": MIN_PROTOCOL_VERSION,
+		"version":     version,
+		"functions":   dffuncNames,
+		"features": gin.H{
+			"kiosk":        kioskMode,
+			"userHomes":    userHomes,
+			"guest":        isGuest(c),
+			"libraries":    libs > 1,
+			"transcoding":  ffmpegPath != "",
+			"hls":          ffmpegPath != "",
+			"zip":          zipDownloads,
+			"prefetch":     prefetchNext,
+			"durations":    durationScan,
+			"loudness":     loudnessScan,
+			"tags":         tagScan,
+			"fingerprints": fingerprintScan,
+			"reports":      reportPeriod != "",
+			"sso":          oidcIssuer != "",
+		},
+		"limits": gin.H{
+			"maxSearchResult":    MAX_SEARCH_RESULT,
+			"maxKeyLength":       MAX_KEY_LEN,
+			"maxDataLength":      MAX_DFDATA_LEN,
+			"maxSelectedFolders": MAX_SELECTED_FOLDERS,
+		},
+		"extensions": audioExtensions,
+	}
+}
+
+// handleGetCapabilities answers the getCapabilities dffunc
+func handleGetCapabilities(c *gin.Context) {
+	echoReqHtml(c, []interface{}{"ok", capabilities(c)}, "getCapabilities")
+}
+
+// handleCapabilities returns the capabilities as JSON (GET /api/v1/capabilities)
+func handleCapabilities(c *gin.Context) {
+	c.Header(PROTOCOL_HEADER, strconv.Itoa(PROTOCOL_VERSION))
+	c.JSON(http.StatusOK, capabilities(c))
+}
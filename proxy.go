@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reverse-proxy configuration from environment variables
+var (
+	basePath       = os.Getenv("BASE_PATH")                  // e.g. "/music" when mounted behind nginx at /music/
+	trustedProxies = splitList(os.Getenv("TRUSTED_PROXIES")) // IPs/CIDRs whose X-Forwarded-* headers are honored
+)
+
+var trustedProxyNets []*net.IPNet
+
+// initProxyConfig normalizes BASE_PATH and parses TRUSTED_PROXIES
+func initProxyConfig() error {
+	basePath = strings.TrimRight(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	var err error
+	trustedProxyNets, err = parseIPNets("TRUSTED_PROXIES", trustedProxies)
+	return err
+}
+
+// ipNetAliases are names accepted in IP lists for common address ranges
+var ipNetAliases = map[string][]string{
+	"loopback": {"127.0.0.0/8", "::1/128"},
+	"private":  {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", "100.64.0.0/10"}, // LAN, ULA and CGNAT (Tailscale)
+}
+
+// parseIPNets parses a list of IPs, CIDRs and aliases, env naming it in errors
+func parseIPNets(env string, list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range list {
+		if alias, ok := ipNetAliases[strings.ToLower(p)]; ok {
+			more, _ := parseIPNets(env, alias)
+			nets = append(nets, more...)
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", env, p, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is in one of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether the direct peer of the request is a configured proxy
+func fromTrustedProxy(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	return ip != nil && containsIP(trustedProxyNets, ip)
+}
+
+// forwardedValue returns the first value of a comma separated X-Forwarded-* header
+func forwardedValue(c *gin.Context, header string) string {
+	v, _, _ := strings.Cut(c.GetHeader(header), ",")
+	return strings.TrimSpace(v)
+}
+
+// externalURL builds the absolute URL clients must use for path (relative to BASE_PATH),
+// honoring X-Forwarded-Proto/Host/Prefix from trusted proxies
+func externalURL(c *gin.Context, path string) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	host := c.Request.Host
+	prefix := basePath
+	if fromTrustedProxy(c) {
+		if v := forwardedValue(c, "X-Forwarded-Proto"); v != "" {
+			scheme = v
+		}
+		if v := forwardedValue(c, "X-Forwarded-Host"); v != "" {
+			host = v
+		}
+		if v := forwardedValue(c, "X-Forwarded-Prefix"); v != "" {
+			prefix = strings.TrimRight(v, "/")
+		}
+	}
+	return scheme + "://" + host + prefix + path
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RADIO_METAINT       = 16000            // audio bytes between ICY metadata blocks
+	RADIO_BURST_SECONDS = 2                // audio sent ahead on connect and kept as slack
+	RADIO_REFRESH       = 10 * time.Minute // station playlists are rebuilt this often
+)
+
+// RADIO_STATIONS defines stations as name=folder or name=@collection, e.g.
+// "rock=Rock/,chill=@Chill Out". Stations play MP3 tracks of the default library
+// whose length is in the duration manifest, and to each listener only those of the
+// folders FOLDER_ACL or PUBLIC_PREFIXES allow them.
+var radioStations = map[string]string{}
+
+func initRadio() error {
+	for _, item := range splitList(os.Getenv("RADIO_STATIONS")) {
+		name, source, ok := strings.Cut(item, "=")
+		name, source = strings.TrimSpace(name), strings.TrimSpace(source)
+		if !ok || name == "" || source == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid RADIO_STATIONS entry %q, expected name=folder or name=@collection", item)
+		}
+		radioStations[name] = source
+	}
+	return nil
+}
+
+// radioTrack is one entry of a station's day playlist
+type radioTrack struct {
+	key      string
+	duration time.Duration
+	bitrate  int // kbit/s
+}
+
+type radioPlaylist struct {
+	tracks []radioTrack
+	total  time.Duration
+	day    int64
+	built  time.Time
+}
+
+var radioPlaylists = struct {
+	sync.Mutex
+	stations map[string]*radioPlaylist
+}{stations: make(map[string]*radioPlaylist)}
+
+// errStationHidden means the folder ACL leaves a listener no track of a station
+var errStationHidden = errors.New("no track of the station is visible")
+
+// stationPlaylist returns the shuffled playlist of a station, holding only the tracks the
+// folders ctx is limited to allow. The order is seeded by the station name and the day,
+// so every listener with the same access hears the same program.
+func stationPlaylist(ctx context.Context, name string) (*radioPlaylist, error) {
+	day := time.Now().Unix() / 86400
+	cacheKey := name
+	if prefixes := accessFrom(ctx); prefixes != nil {
+		cacheKey += "\x00" + strings.Join(prefixes, "\x00")
+	}
+	radioPlaylists.Lock()
+	pl := radioPlaylists.stations[cacheKey]
+	radioPlaylists.Unlock()
+	if pl != nil && pl.day == day && time.Since(pl.built) < RADIO_REFRESH {
+		return pl, nil
+	}
+
+	lib := defaultLibrary()
+	ctx = withLibrary(ctx, lib)
+	source := radioStations[name]
+	var keys []string
+	var err error
+	if col, ok := strings.CutPrefix(source, "@"); ok {
+		c, found := collections.get(col)
+		if !found {
+			return nil, fmt.Errorf("unknown collection %q", col)
+		}
+		keys, err = collectionTracks(ctx, c)
+	} else {
+		keys, err = s3ListAllAudioFiles(ctx, strings.Trim(source, "/")+"/")
+		sortNames(keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pl = &radioPlaylist{day: day, built: time.Now()}
+	hidden := 0
+	for _, key := range keys {
+		if isServerOwned(lib, key) || !kioskVisible(key, false) || !folderVisible(ctx, key, false) {
+			hidden++
+			continue
+		}
+		e, ok := manifest.entry(lib, key)
+		if strings.ToLower(path.Ext(key)) != ".mp3" || !ok || e.DurationMs == 0 || e.Bitrate == 0 {
+			continue
+		}
+		pl.tracks = append(pl.tracks, radioTrack{key: key, duration: time.Duration(e.DurationMs) * time.Millisecond, bitrate: e.Bitrate})
+		pl.total += time.Duration(e.DurationMs) * time.Millisecond
+	}
+	if len(pl.tracks) == 0 && hidden > 0 {
+		return nil, errStationHidden
+	}
+	if len(pl.tracks) == 0 {
+		return nil, fmt.Errorf("station %s has no scanned MP3 tracks", name)
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", name, day)
+	order := shuffleOrder(len(pl.tracks), h.Sum64())
+	shuffled := make([]radioTrack, len(order))
+	for i, idx := range order {
+		shuffled[i] = pl.tracks[idx]
+	}
+	pl.tracks = shuffled
+
+	radioPlaylists.Lock()
+	radioPlaylists.stations[cacheKey] = pl
+	radioPlaylists.Unlock()
+	return pl, nil
+}
+
+// onAir returns the index of the track playing at t and how far into it the station is
+func (pl *radioPlaylist) onAir(t time.Time) (int, time.Duration) {
+	pos := time.Duration(t.UnixNano()) % pl.total
+	for i, tr := range pl.tracks {
+		if pos < tr.duration {
+			return i, pos
+		}
+		pos -= tr.duration
+	}
+	return 0, 0
+}
+
+// icyWriter interleaves ICY metadata blocks with the audio every RADIO_METAINT bytes
+type icyWriter struct {
+	w     io.Writer
+	left  int
+	title string
+	sent  string
+}
+
+func (iw *icyWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), iw.left)
+		if _, err := iw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		if iw.left -= n; iw.left == 0 {
+			if err := iw.writeMeta(); err != nil {
+				return written, err
+			}
+			iw.left = RADIO_METAINT
+		}
+	}
+	return written, nil
+}
+
+// writeMeta sends the title when it changed, an empty block otherwise
+func (iw *icyWriter) writeMeta() error {
+	if iw.title == iw.sent {
+		_, err := iw.w.Write([]byte{0})
+		return err
+	}
+	meta := "StreamTitle='" + strings.ReplaceAll(iw.title, "'", "’") + "';"
+	if len(meta) > 255*16 {
+		meta = meta[:255*16]
+	}
+	blocks := (len(meta) + 15) / 16
+	buf := make([]byte, 1+blocks*16)
+	buf[0] = byte(blocks)
+	copy(buf[1:], meta)
+	iw.sent = iw.title
+	_, err := iw.w.Write(buf)
+	return err
+}
+
+// radioTitle shows a track as "Folder - Title"
+func radioTitle(key string) string {
+	dir, file := path.Split(key)
+	title := strings.TrimSuffix(file, path.Ext(file))
+	if dir = path.Base(strings.TrimSuffix(dir, "/")); dir != "." && dir != "" {
+		return dir + " - " + title
+	}
+	return title
+}
+
+// handleRadio streams a station as one endless MP3 stream (GET /radio/:station).
+// Listeners join the program where it currently is, Icy-MetaData: 1 adds titles.
+func handleRadio(c *gin.Context) {
+	name := c.Param("station")
+	if _, ok := radioStations[name]; !ok {
+		c.String(http.StatusNotFound, "Unknown station")
+		return
+	}
+	ctx := withLibrary(c.Request.Context(), defaultLibrary())
+	if prefixes, ok := requestAccess(c); ok {
+		ctx = withAccess(ctx, prefixes)
+	}
+	pl, err := stationPlaylist(ctx, name)
+	if errors.Is(err, errStationHidden) {
+		c.String(http.StatusNotFound, "Unknown station")
+		return
+	}
+	if err != nil {
+		log.Printf("Radio %s: %v", name, err)
+		c.String(http.StatusServiceUnavailable, "Station not available")
+		return
+	}
+
+	c.Header("Content-Type", "audio/mpeg")
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("icy-name", name)
+	c.Header("icy-pub", "0")
+	var out io.Writer = c.Writer
+	var icy *icyWriter
+	if c.GetHeader("Icy-MetaData") == "1" {
+		c.Header("icy-metaint", strconv.Itoa(RADIO_METAINT))
+		icy = &icyWriter{w: c.Writer, left: RADIO_METAINT}
+		out = icy
+	}
+	c.Status(http.StatusOK)
+
+	idx, offset := pl.onAir(time.Now())
+	for ctx.Err() == nil {
+		tr := pl.tracks[idx]
+		if icy != nil {
+			icy.title = radioTitle(tr.key)
+		}
+		from := int64(offset.Seconds() * float64(tr.bitrate) * 125)
+		if err := streamRadioTrack(ctx, tr, from, out, c.Writer); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Radio %s: %s: %v", name, tr.key, err)
+			}
+			if isClientGone(err) {
+				return
+			}
+			time.Sleep(time.Second) // don't spin through the playlist while S3 fails
+		}
+		if next, err := stationPlaylist(ctx, name); err == nil && next != pl {
+			// A new day or rebuilt playlist: continue with whatever is on air now
+			pl = next
+			idx, offset = pl.onAir(time.Now())
+			continue
+		}
+		idx, offset = (idx+1)%len(pl.tracks), 0
+	}
+}
+
+// streamRadioTrack copies one track from byte offset from at its own bitrate
+func streamRadioTrack(ctx context.Context, tr radioTrack, from int64, out io.Writer, flusher http.Flusher) error {
+	if from == 0 {
+		from = id3Length(ctx, tr.key)
+	}
+	lib := libraryFrom(ctx)
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + tr.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", from)),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	limiter := newByteRateLimiter(int64(tr.bitrate))
+	limiter.burst = limiter.rate * RADIO_BURST_SECONDS
+	limiter.tokens = limiter.burst
+	src := &throttledReader{r: resp.Body, limiter: limiter}
+	buf := make([]byte, THROTTLE_CHUNK)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := out.Write(buf[:n]); werr != nil {
+				return clientGone{werr}
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// id3Length returns the size of a leading ID3v2 tag, which players only expect at the start of a stream
+func id3Length(ctx context.Context, key string) int64 {
+	hdr, err := s3GetRange(ctx, key, "bytes=0-9")
+	if err != nil || len(hdr) < 10 || string(hdr[:3]) != "ID3" {
+		return 0
+	}
+	size := int64(hdr[6]&0x7f)<<21 | int64(hdr[7]&0x7f)<<14 | int64(hdr[8]&0x7f)<<7 | int64(hdr[9]&0x7f)
+	if hdr[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	return 10 + size
+}
+
+// clientGone marks write errors: the listener disconnected
+type clientGone struct{ error }
+
+func isClientGone(err error) bool {
+	_, ok := err.(clientGone)
+	return ok
+}
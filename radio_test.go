@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestRadioFolderACL checks that a station only plays a limited listener the tracks of
+// its allowed folders, and that a wrong API key is refused
+func TestRadioFolderACL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(libs []*library, stations map[string]string) { libraries, radioStations = libs, stations }(libraries, radioStations)
+	radio := &library{Name: "Radio", Bucket: "radio"}
+	libraries = []*library{radio}
+	radioStations = map[string]string{"mixed": "Mixed/"}
+	useFakeS3(t, &fakeS3{objects: map[string]string{
+		"radio/Mixed/Public/a.mp3":  "a",
+		"radio/Mixed/Private/b.mp3": "b",
+	}})
+	manifest.mu.Lock()
+	manifest.libraries[radio.Name] = map[string]manifestEntry{
+		"Mixed/Public/a.mp3":  {DurationMs: 1000, Bitrate: 128},
+		"Mixed/Private/b.mp3": {DurationMs: 1000, Bitrate: 128},
+	}
+	manifest.mu.Unlock()
+	t.Cleanup(func() {
+		manifest.mu.Lock()
+		delete(manifest.libraries, radio.Name)
+		manifest.mu.Unlock()
+	})
+
+	ctx := withLibrary(context.Background(), radio)
+	for _, tt := range []struct {
+		name   string
+		access []string
+		want   int
+	}{
+		{"unlimited", nil, 2},
+		{"public", []string{"Mixed/Public/"}, 1},
+	} {
+		c := ctx
+		if tt.access != nil {
+			c = withAccess(ctx, tt.access)
+		}
+		pl, err := stationPlaylist(c, "mixed")
+		if err != nil || len(pl.tracks) != tt.want {
+			t.Fatalf("%s: playlist %v, %v; want %d tracks", tt.name, pl, err, tt.want)
+		}
+		for _, tr := range pl.tracks {
+			if tt.access != nil && !folderVisible(c, tr.key, false) {
+				t.Errorf("%s: station plays hidden %s", tt.name, tr.key)
+			}
+		}
+	}
+	if _, err := stationPlaylist(withAccess(ctx, []string{"Other/"}), "mixed"); !errors.Is(err, errStationHidden) {
+		t.Errorf("no visible track: %v, want errStationHidden", err)
+	}
+
+	r := gin.New()
+	registerRoutes(r)
+	req := httptest.NewRequest(http.MethodGet, "/radio/mixed", nil)
+	req.Header.Set("Authorization", "Bearer "+API_KEY_PREFIX+"wrong")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RATE_LIMIT_IDLE_TTL = 10 * time.Minute // per-IP buckets unused this long are dropped
+
+// Rate limit configuration from environment variables (0 disables a limit)
+var (
+	apiRateLimit    float64 // API_RATE_LIMIT: sustained /api requests per second per IP
+	apiRateBurst    float64 // API_RATE_BURST: bucket size, default max(1, 2*rate)
+	maxStreamsPerIP int     // MAX_STREAMS_PER_IP: simultaneous /audio streams per API key user, else per IP
+)
+
+func initRateLimits() error {
+	if v := os.Getenv("API_RATE_LIMIT"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid API_RATE_LIMIT: %q", v)
+		}
+		apiRateLimit = n
+	}
+	apiRateBurst = math.Max(1, 2*apiRateLimit)
+	if v := os.Getenv("API_RATE_BURST"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid API_RATE_BURST: %q", v)
+		}
+		apiRateBurst = n
+	}
+	if v := os.Getenv("MAX_STREAMS_PER_IP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid MAX_STREAMS_PER_IP: %q", v)
+		}
+		maxStreamsPerIP = n
+	}
+	return nil
+}
+
+// tokenBucket is a classic refilling token bucket
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	sweep   time.Time
+}
+
+// allow takes a token for ip, or returns how long until one is available
+func (l *ipRateLimiter) allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.sweep) > RATE_LIMIT_IDLE_TTL {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastUsed) > RATE_LIMIT_IDLE_TTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.sweep = now
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	b.lastUsed = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// tooManyRequests aborts with 429 and a Retry-After header rounded up to whole seconds
+func tooManyRequests(c *gin.Context, retryAfter time.Duration, msg string) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(secs))
+	c.String(http.StatusTooManyRequests, msg)
+	c.Abort()
+}
+
+// RateLimit middleware limits the request rate per client IP
+func RateLimit() gin.HandlerFunc {
+	if apiRateLimit <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	limiter := &ipRateLimiter{rate: apiRateLimit, burst: apiRateBurst, buckets: make(map[string]*tokenBucket)}
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		if ok, wait := limiter.allow(c.ClientIP()); !ok {
+			tooManyRequests(c, wait, "Too many requests")
+			return
+		}
+		c.Next()
+	}
+}
+
+// streamCounter tracks active /audio streams per client, and each stream for the
+// admin dashboard
+type streamCounter struct {
+	mu      sync.Mutex
+	active  map[string]int
+	streams map[string]*liveStream
+}
+
+var activeStreams = &streamCounter{active: make(map[string]int), streams: make(map[string]*liveStream)}
+
+func (s *streamCounter) acquire(client string, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max > 0 && s.active[client] >= max {
+		return false
+	}
+	s.active[client]++
+	return true
+}
+
+func (s *streamCounter) release(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[client]--; s.active[client] <= 0 {
+		delete(s.active, client)
+	}
+}
+
+// total returns the number of active streams across all clients
+func (s *streamCounter) total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, v := range s.active {
+		n += v
+	}
+	return n
+}
+
+// streamClient names the client a stream counts against: the API key user when the
+// request has one, so users behind one NAT don't share a limit and a user can't dodge
+// it by switching networks, else the client IP
+func streamClient(c *gin.Context) string {
+	if user, ok := homeUser(c); ok {
+		return "user:" + user
+	}
+	return c.ClientIP()
+}
+
+// StreamLimit middleware caps simultaneous audio streams per client
+func StreamLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		client := streamClient(c)
+		if !activeStreams.acquire(client, maxStreamsPerIP) {
+			tooManyRequests(c, 5*time.Second, "Too many concurrent streams")
+			return
+		}
+		defer activeStreams.release(client)
+		s := activeStreams.open(c)
+		defer activeStreams.close(s)
+		c.Next()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestStreamLimitPerUser checks that streams count against the API key user when there
+// is one, and against the client IP otherwise
+func TestStreamLimitPerUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(n int) { maxStreamsPerIP = n }(maxStreamsPerIP)
+	maxStreamsPerIP = 1
+	alice := addTestAPIKey(t, "alice", "alice", SCOPE_STREAM)
+	bob := addTestAPIKey(t, "bob", "bob", SCOPE_STREAM)
+
+	// Hold a stream of alice and one anonymous stream from the shared IP open
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	r := gin.New()
+	r.GET("/hold", StreamLimit(), func(c *gin.Context) { started <- struct{}{}; <-release })
+	r.GET("/audio", StreamLimit(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	for _, token := range []string{alice, ""} {
+		req := httptest.NewRequest(http.MethodGet, "/hold", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		go r.ServeHTTP(httptest.NewRecorder(), req)
+		<-started
+	}
+	defer close(release)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"same user", alice, http.StatusTooManyRequests},
+		{"other user on the same IP", bob, http.StatusOK},
+		{"anonymous on the same IP", "", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/audio", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RATINGS_OBJECT      = "ratings.json"
+	DEFAULT_RATING_USER = "default"
+	MAX_RATING_USER     = 64
+)
+
+// ratingStore holds 1-5 star ratings per user, library and key, kept in STATE_STORE.
+// The user is the one of the request's API key or OIDC session; only without
+// USER_HOMES may a request without either name itself with ?user= (see requestUser).
+type ratingStore struct {
+	mu    sync.Mutex
+	users map[string]map[string]map[string]int
+	doc   stateDoc
+}
+
+var ratings = &ratingStore{users: make(map[string]map[string]map[string]int), doc: stateDoc{name: RATINGS_OBJECT}}
+
+// load reads the ratings object from the state store; a missing object means no ratings
+func (rs *ratingStore) load(ctx context.Context) error {
+	return rs.doc.load(ctx, &rs.mu, rs)
+}
+
+func (rs *ratingStore) decode(data []byte) error {
+	users := make(map[string]map[string]map[string]int)
+	if data != nil {
+		if err := json.Unmarshal(data, &users); err != nil {
+			return err
+		}
+	}
+	rs.users = users
+	return nil
+}
+
+func (rs *ratingStore) encode() (interface{}, error) {
+	return rs.users, nil
+}
+
+func (rs *ratingStore) get(user string, lib *library, key string) int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.users[user][lib.Name][key]
+}
+
+func (rs *ratingStore) list(user string, lib *library) map[string]int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	out := make(map[string]int, len(rs.users[user][lib.Name]))
+	for k, v := range rs.users[user][lib.Name] {
+		out[k] = v
+	}
+	return out
+}
+
+// set stores the rating of key, or removes it when stars is 0
+func (rs *ratingStore) set(ctx context.Context, user string, lib *library, key string, stars int) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	existed := false
+	err := rs.doc.update(ctx, rs, func() bool {
+		entries := rs.users[user][lib.Name]
+		_, existed = entries[key]
+		if stars == 0 && !existed {
+			return false
+		}
+		if entries == nil {
+			if rs.users[user] == nil {
+				rs.users[user] = make(map[string]map[string]int)
+			}
+			entries = make(map[string]int)
+			rs.users[user][lib.Name] = entries
+		}
+		if stars > 0 {
+			entries[key] = stars
+		} else {
+			delete(entries, key)
+		}
+		return true
+	})
+	return existed, err
+}
+
+// setMany stores several ratings of user in lib with one write
+func (rs *ratingStore) setMany(ctx context.Context, user string, lib *library, stars map[string]int) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.doc.update(ctx, rs, func() bool {
+		if rs.users[user] == nil {
+			rs.users[user] = make(map[string]map[string]int)
+		}
+		entries := rs.users[user][lib.Name]
+		if entries == nil {
+			entries = make(map[string]int)
+			rs.users[user][lib.Name] = entries
+		}
+		for key, n := range stars {
+			entries[key] = n
+		}
+		return true
+	})
+}
+
+// rename moves the ratings of a renamed object for every user
+func (rs *ratingStore) rename(ctx context.Context, lib *library, from, to string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	err := rs.doc.update(ctx, rs, func() bool {
+		moved := false
+		for _, libs := range rs.users {
+			if v, ok := libs[lib.Name][from]; ok {
+				libs[lib.Name][to] = v
+				delete(libs[lib.Name], from)
+				moved = true
+			}
+		}
+		return moved
+	})
+	if err != nil {
+		log.Printf("Ratings save error: %v", err)
+	}
+}
+
+// requestUser returns the user ratings of a request belong to
+func requestUser(c *gin.Context) string {
+	if k, ok := c.Get(API_KEY_CONTEXT); ok {
+		return k.(*apiKey).User // a key acts as its user only
+	}
+	if user, signedIn := homeUser(c); signedIn || userHomes {
+		// Only keys name users with homes; RequireHomeUser refuses requests without one
+		return user
+	}
+	user := c.Query("user")
+	if user == "" {
+		user, _ = c.Cookie("user")
+	}
+	user = strings.TrimSpace(user)
+	if user == "" || len(user) > MAX_RATING_USER {
+		return DEFAULT_RATING_USER
+	}
+	return user
+}
+
+var ratingFilterRe = regexp.MustCompile(`(?i)(?:^|\s)rating:([1-5])(?:\s|$)`)
+
+// cutRatingFilter removes a "rating:N" token from a search string and returns N
+func cutRatingFilter(s string) (string, int) {
+	m := ratingFilterRe.FindStringSubmatchIndex(s)
+	if m == nil {
+		return s, 0
+	}
+	stars, _ := strconv.Atoi(s[m[2]:m[3]])
+	return strings.TrimSpace(s[:m[0]] + " " + s[m[1]:]), stars
+}
+
+// --- RATING HANDLERS ---
+
+// handleListRatings lists the rated tracks of the user in the request's library (GET /api/v1/ratings)
+func handleListRatings(c *gin.Context) {
+	user := requestUser(c)
+	c.JSON(http.StatusOK, gin.H{"user": user, "ratings": ratings.list(user, libraryFrom(c.Request.Context()))})
+}
+
+// handleGetRating returns the rating of a track, 0 when unrated (GET /api/v1/rating/*path)
+func handleGetRating(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	user := requestUser(c)
+	c.JSON(http.StatusOK, gin.H{"user": user, "track": key, "rating": ratings.get(user, libraryFrom(c.Request.Context()), key)})
+}
+
+// handlePutRating rates a track 1-5 stars (PUT /api/v1/rating/*path), 0 clears the rating
+func handlePutRating(c *gin.Context) {
+	if kioskMode {
+		apiError(c, http.StatusForbidden, MSG_KIOSK_UNAVAILABLE)
+		return
+	}
+	var req struct {
+		Rating *int `json:"rating"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Rating == nil || *req.Rating < 0 || *req.Rating > 5 {
+		apiError(c, http.StatusBadRequest, MSG_RATING_RANGE)
+		return
+	}
+	ctx := c.Request.Context()
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	if !isAudioFile(key) || !isListed(key, false) || !folderVisible(ctx, key, false) {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_TRACK)
+		return
+	}
+	object := key
+	if sheet, _, ok := parseCueTrackKey(key); ok {
+		object = sheet // tracks of a cue sheet exist as long as the sheet does
+	}
+	if _, _, _, err := s3HeadAudioFile(ctx, object); err != nil {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_TRACK)
+		return
+	}
+	user := requestUser(c)
+	if _, err := ratings.set(ctx, user, libraryFrom(ctx), key, *req.Rating); err != nil {
+		log.Printf("Ratings save error: %v", err)
+		apiError(c, http.StatusInternalServerError, MSG_SAVE_FAILED)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user, "track": key, "rating": *req.Rating})
+}
+
+// handleDeleteRating clears the rating of a track (DELETE /api/v1/rating/*path)
+func handleDeleteRating(c *gin.Context) {
+	if kioskMode {
+		apiError(c, http.StatusForbidden, MSG_KIOSK_UNAVAILABLE)
+		return
+	}
+	ctx := c.Request.Context()
+	found, err := ratings.set(ctx, requestUser(c), libraryFrom(ctx), strings.TrimPrefix(c.Param("path"), "/"), 0)
+	if err != nil {
+		log.Printf("Ratings save error: %v", err)
+		apiError(c, http.StatusInternalServerError, MSG_SAVE_FAILED)
+		return
+	}
+	if !found {
+		apiError(c, http.StatusNotFound, MSG_TRACK_NOT_RATED)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
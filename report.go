@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PLAY_HISTORY_OBJECT = "play-history.json"
+	PLAY_HISTORY_DAYS   = 35     // plays and additions kept, enough for a weekly report and then some
+	MAX_PLAY_HISTORY    = 100000 // plays kept at most; the oldest go first
+	PLAY_HISTORY_SAVE   = 5 * time.Minute
+
+	REPORT_DAILY        = "daily"
+	REPORT_WEEKLY       = "weekly"
+	REPORT_ADDED_TRACKS = 20 // new tracks named per library; the count covers all
+	REPORT_SMTP_TIMEOUT = 30 * time.Second
+)
+
+// Listening reports: REPORT=daily or weekly sends a summary of the previous day or week
+// at REPORT_AT ("HH:MM" in SCHEDULE_TZ, default 08:00), weekly ones on REPORT_DAY (default
+// mon). It is mailed through REPORT_SMTP (host:port, with REPORT_SMTP_USER and
+// REPORT_SMTP_PASSWORD if the server wants them) from REPORT_FROM to REPORT_TO, and
+// published as a "report" event for webhooks subscribed to it. REPORT_TOP tracks are listed.
+var (
+	reportPeriod   = os.Getenv("REPORT")
+	reportAt       = "08:00"
+	reportDay      = "mon"
+	reportTop      = 10
+	reportSMTP     = os.Getenv("REPORT_SMTP")
+	reportSMTPUser = os.Getenv("REPORT_SMTP_USER")
+	reportSMTPPass = os.Getenv("REPORT_SMTP_PASSWORD")
+	reportFrom     = os.Getenv("REPORT_FROM")
+	reportTo       []string
+)
+
+func initReports() error {
+	switch reportPeriod {
+	case "", "off":
+		reportPeriod = ""
+	case REPORT_DAILY, REPORT_WEEKLY:
+	default:
+		return fmt.Errorf("invalid REPORT: %q, expected daily or weekly", reportPeriod)
+	}
+	if v := os.Getenv("REPORT_AT"); v != "" {
+		if !scheduleTimeRe.MatchString(v) {
+			return fmt.Errorf("invalid REPORT_AT: %q, expected HH:MM", v)
+		}
+		reportAt = v
+	}
+	if v := strings.ToLower(os.Getenv("REPORT_DAY")); v != "" {
+		if !scheduleDays[v] {
+			return fmt.Errorf("invalid REPORT_DAY: %q, expected mon..sun", v)
+		}
+		reportDay = v
+	}
+	if v := os.Getenv("REPORT_TOP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid REPORT_TOP: %q", v)
+		}
+		reportTop = n
+	}
+	reportTo = splitList(os.Getenv("REPORT_TO"))
+	if reportSMTP != "" {
+		if _, _, err := net.SplitHostPort(reportSMTP); err != nil {
+			return fmt.Errorf("invalid REPORT_SMTP: %q, expected host:port", reportSMTP)
+		}
+		if reportFrom == "" || len(reportTo) == 0 {
+			return fmt.Errorf("REPORT_SMTP needs REPORT_FROM and REPORT_TO")
+		}
+	}
+	return nil
+}
+
+// playRecord is one track played to its end
+type playRecord struct {
+	User    string    `json:"user"`
+	Library string    `json:"library"`
+	Track   string    `json:"track"`
+	Seconds int       `json:"seconds,omitempty"` // from the manifest, 0 when unknown
+	Time    time.Time `json:"time"`
+}
+
+// additionRecord is one EVENT_TRACKS_ADDED of a duration scan
+type additionRecord struct {
+	Library string    `json:"library"`
+	Count   int       `json:"count"`
+	Tracks  []string  `json:"tracks,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// playHistory records plays and additions for the reports, persisted as one metadata object
+type playHistory struct {
+	mu       sync.Mutex
+	Plays    []playRecord     `json:"plays"`
+	Added    []additionRecord `json:"added"`
+	LastSent string           `json:"lastSent,omitempty"` // period key of the last scheduled report
+	doc      stateDoc
+
+	// Recorded since the last save, kept when the history is read again
+	pendingPlays []playRecord
+	pendingAdded []additionRecord
+}
+
+var history = &playHistory{doc: stateDoc{name: PLAY_HISTORY_OBJECT}}
+
+// load reads the history from the state store; a missing object means nothing was recorded yet
+func (h *playHistory) load(ctx context.Context) error {
+	return h.doc.load(ctx, &h.mu, h)
+}
+
+// decode replaces the history with the stored one plus the records not saved yet
+func (h *playHistory) decode(data []byte) error {
+	var stored struct {
+		Plays    []playRecord     `json:"plays"`
+		Added    []additionRecord `json:"added"`
+		LastSent string           `json:"lastSent"`
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+	}
+	plays := append(stored.Plays, h.pendingPlays...)
+	sort.SliceStable(plays, func(i, j int) bool { return plays[i].Time.Before(plays[j].Time) })
+	if len(plays) > MAX_PLAY_HISTORY {
+		plays = plays[len(plays)-MAX_PLAY_HISTORY:]
+	}
+	added := append(stored.Added, h.pendingAdded...)
+	sort.SliceStable(added, func(i, j int) bool { return added[i].Time.Before(added[j].Time) })
+	h.Plays, h.Added, h.LastSent = plays, added, stored.LastSent
+	return nil
+}
+
+func (h *playHistory) encode() (interface{}, error) {
+	return h, nil
+}
+
+// save writes the history if it has new records, dropping records older than PLAY_HISTORY_DAYS
+func (h *playHistory) save(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.saveLocked(ctx, func() bool { return false })
+}
+
+// saveLocked writes the history if it has new records or change changed it; the caller holds h.mu
+func (h *playHistory) saveLocked(ctx context.Context, change func() bool) error {
+	err := h.doc.update(ctx, h, func() bool {
+		if !change() && len(h.pendingPlays) == 0 && len(h.pendingAdded) == 0 {
+			return false
+		}
+		cutoff := time.Now().AddDate(0, 0, -PLAY_HISTORY_DAYS)
+		i := sort.Search(len(h.Plays), func(i int) bool { return h.Plays[i].Time.After(cutoff) })
+		h.Plays = append([]playRecord(nil), h.Plays[i:]...)
+		i = sort.Search(len(h.Added), func(i int) bool { return h.Added[i].Time.After(cutoff) })
+		h.Added = append([]additionRecord(nil), h.Added[i:]...)
+		return true
+	})
+	if err == nil {
+		h.pendingPlays, h.pendingAdded = nil, nil
+	}
+	return err
+}
+
+// attach records finished plays and scan additions from the bus
+func (h *playHistory) attach(bus *EventBus) {
+	bus.Subscribe("history", EVENT_PLAY_FINISHED, func(ev Event) {
+		rec := playRecord{Time: ev.Time.UTC()}
+		rec.User, _ = ev.Data["user"].(string)
+		rec.Library, _ = ev.Data["library"].(string)
+		rec.Track, _ = ev.Data["track"].(string)
+		if rec.Track == "" {
+			return
+		}
+		if lib := findLibrary(rec.Library); lib != nil {
+			rec.Seconds = manifest.durations(lib, []string{rec.Track})[0]
+		}
+		h.mu.Lock()
+		h.Plays = append(h.Plays, rec)
+		if len(h.Plays) > MAX_PLAY_HISTORY {
+			h.Plays = h.Plays[len(h.Plays)-MAX_PLAY_HISTORY:]
+		}
+		h.pendingPlays = append(h.pendingPlays, rec)
+		if len(h.pendingPlays) > MAX_PLAY_HISTORY {
+			h.pendingPlays = h.pendingPlays[len(h.pendingPlays)-MAX_PLAY_HISTORY:]
+		}
+		h.mu.Unlock()
+	})
+	bus.Subscribe("history", EVENT_TRACKS_ADDED, func(ev Event) {
+		rec := additionRecord{Time: ev.Time.UTC()}
+		rec.Library, _ = ev.Data["library"].(string)
+		rec.Count, _ = ev.Data["count"].(int)
+		rec.Tracks, _ = ev.Data["tracks"].([]string)
+		if len(rec.Tracks) > REPORT_ADDED_TRACKS {
+			rec.Tracks = rec.Tracks[:REPORT_ADDED_TRACKS]
+		}
+		h.mu.Lock()
+		h.Added = append(h.Added, rec)
+		h.pendingAdded = append(h.pendingAdded, rec)
+		h.mu.Unlock()
+	})
+}
+
+// userListening is the listening of one user in a report
+type userListening struct {
+	User    string `json:"user"`
+	Plays   int    `json:"plays"`
+	Seconds int    `json:"seconds"`
+}
+
+// trackPlays counts the plays of one track in a report
+type trackPlays struct {
+	Library string `json:"library"`
+	Track   string `json:"track"`
+	Plays   int    `json:"plays"`
+}
+
+// libraryAdditions are the tracks a library gained in a report's period
+type libraryAdditions struct {
+	Library string   `json:"library"`
+	Count   int      `json:"count"`
+	Tracks  []string `json:"tracks,omitempty"`
+}
+
+// listeningReport summarizes the plays and additions of [From, To)
+type listeningReport struct {
+	Period    string             `json:"period"`
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	Plays     int                `json:"plays"`
+	Seconds   int                `json:"seconds"`
+	Users     []userListening    `json:"users"`
+	TopTracks []trackPlays       `json:"topTracks"`
+	Added     []libraryAdditions `json:"added"`
+}
+
+// reportBounds returns the last complete day or week before now, in SCHEDULE_TZ.
+// Weeks end at midnight before REPORT_DAY.
+func reportBounds(period string, now time.Time) (from, to time.Time) {
+	now = now.In(scheduleLocation)
+	to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, scheduleLocation)
+	if period != REPORT_WEEKLY {
+		return to.AddDate(0, 0, -1), to
+	}
+	for strings.ToLower(to.Weekday().String()[:3]) != reportDay {
+		to = to.AddDate(0, 0, -1)
+	}
+	return to.AddDate(0, 0, -7), to
+}
+
+// report aggregates the history of a period ending before now
+func (h *playHistory) report(period string, now time.Time) listeningReport {
+	from, to := reportBounds(period, now)
+	r := listeningReport{Period: period, From: from, To: to, Users: []userListening{}, TopTracks: []trackPlays{}, Added: []libraryAdditions{}}
+	users := make(map[string]*userListening)
+	tracks := make(map[string]*trackPlays)
+	added := make(map[string]*libraryAdditions)
+	h.mu.Lock()
+	for _, p := range h.Plays {
+		if p.Time.Before(from) || !p.Time.Before(to) {
+			continue
+		}
+		r.Plays++
+		r.Seconds += p.Seconds
+		u := users[p.User]
+		if u == nil {
+			u = &userListening{User: p.User}
+			users[p.User] = u
+		}
+		u.Plays++
+		u.Seconds += p.Seconds
+		id := p.Library + "\x00" + p.Track
+		t := tracks[id]
+		if t == nil {
+			t = &trackPlays{Library: p.Library, Track: p.Track}
+			tracks[id] = t
+		}
+		t.Plays++
+	}
+	for _, a := range h.Added {
+		if a.Time.Before(from) || !a.Time.Before(to) {
+			continue
+		}
+		la := added[a.Library]
+		if la == nil {
+			la = &libraryAdditions{Library: a.Library}
+			added[a.Library] = la
+		}
+		la.Count += a.Count
+		for _, t := range a.Tracks {
+			if len(la.Tracks) < REPORT_ADDED_TRACKS {
+				la.Tracks = append(la.Tracks, t)
+			}
+		}
+	}
+	h.mu.Unlock()
+	for _, u := range users {
+		r.Users = append(r.Users, *u)
+	}
+	sort.Slice(r.Users, func(i, j int) bool {
+		if r.Users[i].Seconds != r.Users[j].Seconds {
+			return r.Users[i].Seconds > r.Users[j].Seconds
+		}
+		return r.Users[i].User < r.Users[j].User
+	})
+	for _, t := range tracks {
+		r.TopTracks = append(r.TopTracks, *t)
+	}
+	sort.Slice(r.TopTracks, func(i, j int) bool {
+		a, b := r.TopTracks[i], r.TopTracks[j]
+		if a.Plays != b.Plays {
+			return a.Plays > b.Plays
+		}
+		if a.Library != b.Library {
+			return a.Library < b.Library
+		}
+		return a.Track < b.Track
+	})
+	r.TopTracks = r.TopTracks[:min(len(r.TopTracks), reportTop)]
+	for _, la := range added {
+		r.Added = append(r.Added, *la)
+	}
+	sort.Slice(r.Added, func(i, j int) bool { return r.Added[i].Library < r.Added[j].Library })
+	return r
+}
+
+// key identifies the report's period, so a scheduled report is sent once
+func (r listeningReport) key() string {
+	return r.Period + " " + r.From.Format("2006-01-02")
+}
+
+// subject is the mail subject of the report
+func (r listeningReport) subject() string {
+	if r.Period == REPORT_WEEKLY {
+		return fmt.Sprintf("go-music weekly report %s to %s", r.From.Format("2006-01-02"), r.To.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	return "go-music daily report " + r.From.Format("2006-01-02")
+}
+
+// listeningTime formats seconds as "3h 05m" or "12m"
+func listeningTime(secs int) string {
+	if secs >= 3600 {
+		return fmt.Sprintf("%dh %02dm", secs/3600, secs%3600/60)
+	}
+	return fmt.Sprintf("%dm", (secs+30)/60)
+}
+
+// text renders the report as the plain text of the mail
+func (r listeningReport) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", r.subject())
+	fmt.Fprintf(&b, "%d plays, %s of listening\n", r.Plays, listeningTime(r.Seconds))
+	if len(r.Users) > 0 {
+		b.WriteString("\nListening per user\n")
+		for _, u := range r.Users {
+			fmt.Fprintf(&b, "  %-20s %8s  %d plays\n", u.User, listeningTime(u.Seconds), u.Plays)
+		}
+	}
+	if len(r.TopTracks) > 0 {
+		b.WriteString("\nTop tracks\n")
+		for i, t := range r.TopTracks {
+			fmt.Fprintf(&b, "  %2d. %s (%s) - %d plays\n", i+1, t.Track, t.Library, t.Plays)
+		}
+	}
+	if len(r.Added) > 0 {
+		b.WriteString("\nNew in the libraries\n")
+		for _, a := range r.Added {
+			fmt.Fprintf(&b, "  %s: %d tracks\n", a.Library, a.Count)
+			for _, t := range a.Tracks {
+				fmt.Fprintf(&b, "    %s\n", t)
+			}
+			if a.Count > len(a.Tracks) {
+				fmt.Fprintf(&b, "    and %d more\n", a.Count-len(a.Tracks))
+			}
+		}
+	}
+	return b.String()
+}
+
+// mail sends the report through REPORT_SMTP
+func (r listeningReport) mail() error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", reportFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(reportTo, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", r.subject())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(r.text(), "\n", "\r\n"))
+	var auth smtp.Auth
+	if reportSMTPUser != "" {
+		host, _, _ := net.SplitHostPort(reportSMTP)
+		auth = smtp.PlainAuth("", reportSMTPUser, reportSMTPPass, host)
+	}
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(reportSMTP, auth, reportFrom, reportTo, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(REPORT_SMTP_TIMEOUT):
+		return fmt.Errorf("%s timed out", reportSMTP)
+	}
+}
+
+// send publishes the report for webhooks and mails it when REPORT_SMTP is set
+func (r listeningReport) send() error {
+	eventBus.Publish(EVENT_REPORT, map[string]interface{}{
+		"period": r.Period, "from": r.From.Unix(), "to": r.To.Unix(), "plays": r.Plays, "seconds": r.Seconds,
+		"users": r.Users, "topTracks": r.TopTracks, "added": r.Added, "text": r.text(),
+	})
+	if reportSMTP == "" {
+		return nil
+	}
+	return r.mail()
+}
+
+// run saves the history now and then and sends the scheduled report once its period is over
+func (h *playHistory) run(ctx context.Context) {
+	if reportPeriod == "" {
+		return
+	}
+	ticker := time.NewTicker(SCHEDULE_TICK)
+	defer ticker.Stop()
+	lastSave := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			local := now.In(scheduleLocation)
+			weekday := strings.ToLower(local.Weekday().String()[:3])
+			if local.Format("15:04") >= reportAt && (reportPeriod == REPORT_DAILY || weekday == reportDay) {
+				r := h.report(reportPeriod, now)
+				h.mu.Lock()
+				due := h.LastSent != r.key()
+				h.mu.Unlock()
+				if due {
+					// Claimed in the store first, so one of the instances sharing it sends the
+					// report. A failed mail isn't retried every tick; it can be sent again from /admin.
+					claimed := false
+					h.mu.Lock()
+					err := h.saveLocked(ctx, func() bool {
+						claimed = h.LastSent != r.key()
+						h.LastSent = r.key()
+						return claimed
+					})
+					h.mu.Unlock()
+					if err != nil {
+						log.Printf("Play history save error: %v", err)
+					} else if claimed {
+						if err := r.send(); err != nil {
+							log.Printf("Listening report: %v", err)
+						} else {
+							log.Printf("Listening report: sent %s", r.key())
+						}
+					}
+					lastSave = now
+				}
+			}
+			if now.Sub(lastSave) >= PLAY_HISTORY_SAVE {
+				if err := h.save(ctx); err != nil {
+					log.Printf("Play history save error: %v", err)
+				}
+				lastSave = now
+			}
+		}
+	}
+}
+
+// requestReport reads ?period=, the configured period by default
+func requestReport(c *gin.Context) (listeningReport, bool) {
+	period := c.Query("period")
+	if period == "" {
+		period = reportPeriod
+	}
+	switch period {
+	case REPORT_DAILY, REPORT_WEEKLY:
+	case "":
+		period = REPORT_DAILY
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be daily or weekly"})
+		return listeningReport{}, false
+	}
+	return history.report(period, time.Now()), true
+}
+
+// handleReport previews the report of the last complete period
+// (GET /admin/report?period=daily|weekly&format=json|text)
+func handleReport(c *gin.Context) {
+	r, ok := requestReport(c)
+	if !ok {
+		return
+	}
+	if c.Query("format") == "text" {
+		c.String(http.StatusOK, r.text())
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// handleSendReport sends the report of the last complete period now (POST /admin/report/send?period=)
+func handleSendReport(c *gin.Context) {
+	r, ok := requestReport(c)
+	if !ok {
+		return
+	}
+	if err := r.send(); err != nil {
+		log.Printf("Listening report: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "period": r.key(), "mailed": reportSMTP != ""})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MAX_RESOLVE_TRACKS = 500
+	RESOLVE_TIMEOUT    = 30 * time.Second
+)
+
+// resolvedTrack is what a client needs to play a key. Error is set instead of the
+// other fields for keys that don't exist or may not be streamed.
+type resolvedTrack struct {
+	Key         string `json:"key"`
+	URL         string `json:"url,omitempty"`
+	Duration    int    `json:"duration,omitempty"`
+	Size        int64  `json:"size,omitempty"` // unknown for cue sheet tracks
+	ContentType string `json:"contentType,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Where the audible part starts and ends in seconds, for gapless playback and crossfades
+	AudioStart float64 `json:"audioStart,omitempty"`
+	AudioEnd   float64 `json:"audioEnd,omitempty"`
+	// What fingerprinting or a manual correction says the track is
+	Identified *trackMatch `json:"identified,omitempty"`
+}
+
+// resolveTracks looks up keys of the context's library in parallel, keeping their order
+func resolveTracks(ctx context.Context, keys []string) []resolvedTrack {
+	lib := libraryFrom(ctx)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, "/")
+	}
+	durations := manifest.durations(lib, keys)
+	out := make([]resolvedTrack, len(keys))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, walkConcurrency)
+	for i, key := range keys {
+		out[i] = resolvedTrack{Key: key}
+		if !isAudioFile(key) || !isListed(key, false) || !kioskVisible(key, false) || !folderVisible(ctx, key, false) {
+			out[i].Error = "not found"
+			continue
+		}
+		if streamPolicy(key) == STREAM_BLOCK {
+			out[i].Error = "format not allowed"
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t *resolvedTrack, duration int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			object := t.Key
+			sheet, _, isCue := parseCueTrackKey(t.Key)
+			if isCue {
+				object = sheet
+			}
+			_, size, ctype, err := s3HeadAudioFile(ctx, object)
+			if err != nil {
+				t.Error = "not found"
+				return
+			}
+			t.URL = audioURL(lib, t.Key, nil)
+			t.Duration = duration
+			if isCue {
+				t.ContentType = mime.TypeByExtension(path.Ext(t.Key))
+			} else {
+				t.Size, t.ContentType = size, ctype
+				t.AudioStart, t.AudioEnd = loudness.silence(lib, t.Key)
+			}
+			t.Identified = fingerprints.match(lib, object)
+		}(&out[i], durations[i])
+	}
+	wg.Wait()
+	return out
+}
+
+// handleResolveTracks answers the resolveTracks dffunc, dfdata is a JSON array of keys
+func handleResolveTracks(c *gin.Context, data string) {
+	var keys []string
+	if err := json.Unmarshal([]byte(data), &keys); err != nil || len(keys) == 0 || len(keys) > MAX_RESOLVE_TRACKS {
+		echoReqHtml(c, []interface{}{"error", "Invalid track list", []resolvedTrack{}}, "getResolvedTracks")
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), RESOLVE_TIMEOUT)
+	defer cancel()
+	echoReqHtml(c, []interface{}{"ok", resolveTracks(ctx, keys)}, "getResolvedTracks")
+}
+
+// handleResolveTracksJSON is the JSON variant (POST /api/v1/tracks/resolve, {"keys":[...]})
+func handleResolveTracksJSON(c *gin.Context) {
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Keys) == 0 || len(req.Keys) > MAX_RESOLVE_TRACKS {
+		apiError(c, http.StatusBadRequest, MSG_KEYS_REQUIRED, MAX_RESOLVE_TRACKS)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), RESOLVE_TIMEOUT)
+	defer cancel()
+	c.JSON(http.StatusOK, gin.H{"tracks": resolveTracks(ctx, req.Keys)})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NO_RESPONSE_CACHE is set on the context by responses that must not be cached, errors
+// and timeouts, which should be retried rather than repeated
+const NO_RESPONSE_CACHE = "noResponseCache"
+
+// responseCacheCost scales the responses layer TTL by what a miss costs in S3 requests:
+// a directory is one LIST, searches and full listings walk every directory
+var responseCacheCost = map[string]int{
+	"dir":             1,
+	"getAllMp3InDir":  2,
+	"getAllMp3InDirs": 2,
+	"searchTitle":     4,
+	"searchTitleIn":   4,
+	"searchDir":       4,
+	"getAllMp3":       10,
+	"getAllDirs":      10,
+	"getDirStats":     10,
+}
+
+// responseCacheKey returns the cache key and TTL of a dffunc request, or false when the
+// response isn't cacheable. Rating searches depend on the user and are never cached;
+// users limited by FOLDER_ACL share entries with those allowed the same folders.
+func responseCacheKey(c *gin.Context, funcType, data string) (string, time.Duration, bool) {
+	cost, ok := responseCacheCost[funcType]
+	if !ok || responseCache == nil || strings.Contains(data, "rating:") {
+		return "", 0, false
+	}
+	access := "all"
+	if prefixes := accessFrom(c.Request.Context()); prefixes != nil {
+		access = "only|" + strings.Join(prefixes, "|")
+	}
+	key := strings.Join([]string{FRAME_PAGE_VERSION, libraryFrom(c.Request.Context()).Name, access, funcType, data,
+		c.PostForm("dfoffset"), c.PostForm("dflimit"), c.PostForm("dfmode"),
+		c.PostForm("dfsort"), c.PostForm("dforder")}, "\x00")
+	return key, responseCache.TTL() * time.Duration(cost), true
+}
+
+// captureWriter keeps a copy of the response body for the response cache
+type captureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// cachedResponse answers a dffunc request from the response cache, or runs handler and
+// caches what it wrote. Repeated searches answered from the cache don't publish search
+// events again, so search statistics count them once per TTL.
+func cachedResponse(c *gin.Context, funcType, data string, handler func()) {
+	key, ttl, ok := responseCacheKey(c, funcType, data)
+	if !ok {
+		handler()
+		return
+	}
+	if body, hit := responseCache.Get(key); hit {
+		c.Header("X-Cache", "HIT")
+		c.Data(http.StatusOK, "text/html; charset="+CHARSET, body)
+		return
+	}
+	c.Header("X-Cache", "MISS")
+	w := &captureWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	handler()
+	c.Writer = w.ResponseWriter
+	if w.Status() == http.StatusOK && !c.GetBool(NO_RESPONSE_CACHE) {
+		responseCache.SetTTL(key, w.body.Bytes(), ttl)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// S3-compatible stores (MinIO, Ceph RGW, Backblaze B2) and cross-account buckets.
+// AWS_ENDPOINT_URL(_S3) and IRSA (AWS_ROLE_ARN with AWS_WEB_IDENTITY_TOKEN_FILE) are
+// read by the SDK itself; these settings take precedence over them.
+var (
+	s3Endpoint        = os.Getenv("S3_ENDPOINT")                   // e.g. https://minio.example.com:9000
+	s3ForcePathStyle  = os.Getenv("S3_FORCE_PATH_STYLE") == "true" // bucket in the path, not the host name
+	s3AssumeRoleARN   = os.Getenv("S3_ASSUME_ROLE_ARN")
+	s3AssumeRoleExtID = os.Getenv("S3_ASSUME_ROLE_EXTERNAL_ID")
+)
+
+const S3_ASSUME_ROLE_SESSION = "go-music"
+
+func initS3Endpoint() error {
+	if s3Endpoint != "" {
+		u, err := url.Parse(s3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid S3_ENDPOINT: %q, expected an http(s) URL", s3Endpoint)
+		}
+	}
+	if s3AssumeRoleExtID != "" && s3AssumeRoleARN == "" {
+		return fmt.Errorf("S3_ASSUME_ROLE_EXTERNAL_ID needs S3_ASSUME_ROLE_ARN")
+	}
+	return nil
+}
+
+// assumeRole replaces the credentials of cfg with those of S3_ASSUME_ROLE_ARN, assumed
+// with the credentials cfg resolved (which may themselves come from a web identity)
+func assumeRole(cfg *aws.Config) {
+	if s3AssumeRoleARN == "" {
+		return
+	}
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), s3AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = S3_ASSUME_ROLE_SESSION
+		if s3AssumeRoleExtID != "" {
+			o.ExternalID = aws.String(s3AssumeRoleExtID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+}
+
+// s3EndpointOptions applies the endpoint settings to the S3 client
+func s3EndpointOptions(o *s3.Options) {
+	if s3Endpoint != "" {
+		o.BaseEndpoint = aws.String(s3Endpoint)
+	}
+	if s3ForcePathStyle {
+		o.UsePathStyle = true
+	}
+}
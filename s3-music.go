@@ -4,28 +4,42 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	CHARSET           = "UTF-8"
+	META_DIR          = ".go-music" // server-owned objects under S3_PREFIX, hidden from listings
 	MIN_SEARCH_STR    = 1
 	MAX_SEARCH_RESULT = 100
-	TXT_ACC_DIR       = "Server is unable to access the directory."
-	TXT_NO_RES        = "Server not responding."
-	TXT_MIN_SEARCH    = "Minimum search characters: "
+
+	DEFAULT_WALK_CONCURRENCY = 8
+	WALK_PROGRESS_INTERVAL   = 5 * time.Second
 )
 
 var audioExtensions = []string{"mp3", "wav", "ogg", "mp4"}
@@ -38,17 +52,32 @@ var (
 	s3Prefix = os.Getenv("S3_PREFIX") // optional, e.g. "music/"
 )
 
+// Number of concurrent ListObjectsV2 calls used when walking directories (WALK_CONCURRENCY)
+var walkConcurrency = DEFAULT_WALK_CONCURRENCY
+
+// Local disk cache configuration (disabled when CACHE_DIR is empty)
+var (
+	cacheDir   = os.Getenv("CACHE_DIR")
+	cacheMaxMB = os.Getenv("CACHE_MAX_MB") // default 1024
+)
+
 var s3Client *s3.Client
 
+// MAX_LOGGED_RESPONSE caps how much of a response body is kept for logging,
+// so long streamed listings aren't held in memory
+const MAX_LOGGED_RESPONSE = 4 << 10
+
 // responseWriter to capture the response for logging
 type responseWriter struct {
 	gin.ResponseWriter
 	buffer *bytes.Buffer
 }
 
-// Write captures the response data
+// Write captures the start of the response data
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.buffer.Write(b)                // Store the response
+	if room := MAX_LOGGED_RESPONSE - rw.buffer.Len(); room > 0 {
+		rw.buffer.Write(b[:min(room, len(b))]) // Store the response
+	}
 	return rw.ResponseWriter.Write(b) // Write the response to the original ResponseWriter
 }
 
@@ -65,6 +94,9 @@ func ResponseLogger() gin.HandlerFunc {
 		c.Writer = writer
 		c.Next()
 		statusCode := c.Writer.Status()
+		if statusCode >= 500 {
+			eventBus.Publish(EVENT_ERROR, map[string]interface{}{"source": "http", "status": statusCode, "method": c.Request.Method, "path": c.Request.URL.Path})
+		}
 		if statusCode >= 400 {
 			logResponse(c, responseBuffer.String())
 			return
@@ -83,38 +115,38 @@ func isAudioFile(filename string) bool {
 	return false
 }
 
-// ea escapes and formats data for embedding in HTML/JS
+// ea encodes the data of a dffunc response as a JSON array. json.Marshal escapes <, >, &
+// and U+2028/9, so no value can end the script element it is embedded in.
 func ea(varData []interface{}) string {
-	res := ""
-	for i, v := range varData {
-		if i > 0 {
-			res += ","
-		}
-		if arr, ok := v.([]string); ok {
-			quotedArr := make([]string, len(arr))
-			for j, item := range arr {
-				quotedArr[j] = `"` + strings.ReplaceAll(item, `"`, `\\"`) + `"`
-			}
-			res += "[" + strings.Join(quotedArr, ",") + "]"
-		} else {
-			res += `"` + strings.ReplaceAll(v.(string), `"`, `\\"`) + `"`
-		}
+	encoded, err := json.Marshal(varData)
+	if err != nil {
+		log.Printf("Response encoding error: %v", err)
+		encoded, _ = json.Marshal([]interface{}{"error", err.Error()})
 	}
-	return "[" + res + "]"
+	return string(encoded)
 }
 
 // echoReqHtml sends an HTML response back to the client's iframe
 func echoReqHtml(c *gin.Context, data []interface{}, funcName string) {
+	if status, _ := data[0].(string); status != "ok" && status != "" {
+		c.Set(NO_RESPONSE_CACHE, true) // errors and timeouts are retried, not cached
+	}
+	writeFramePage(c, http.StatusOK, data, funcName)
+}
+
+// writeFramePage sends the iframe page of a dffunc response. The data sits in a JSON
+// data block that static/frame.js hands to parent[funcName], so the page has no inline
+// script and runs under frameCSP.
+func writeFramePage(c *gin.Context, status int, data []interface{}, funcName string) {
 	c.Header("Content-Type", "text/html; charset="+CHARSET)
-	c.String(http.StatusOK, `<!DOCTYPE html>
+	c.String(status, `<!DOCTYPE html>
 <html>
 <head>
     <meta charset="`+CHARSET+`">
-    <script>
-        var dataContainer = `+ea(data)+`;
-    </script>
+    <script type="application/json" id="dataContainer">`+ea(data)+`</script>
 </head>
-<body onload="parent.`+funcName+`(dataContainer)">
+<body data-callback="`+html.EscapeString(funcName)+`">
+    <script src="static/frame.js"></script>
 </body>
 </html>`)
 }
@@ -123,135 +155,475 @@ func initS3() error {
 	if s3Bucket == "" || s3Region == "" {
 		return fmt.Errorf("BUCKET and AWS_REGION environment variables must be set")
 	}
+	if v := os.Getenv("WALK_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid WALK_CONCURRENCY: %q", v)
+		}
+		walkConcurrency = n
+	}
 	// Ensure s3Prefix ends with '/' if not empty
 	if s3Prefix != "" && !strings.HasSuffix(s3Prefix, "/") {
 		s3Prefix += "/"
 	}
-	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	if err := initLibraries(); err != nil {
+		return err
+	}
+	if err := initS3Endpoint(); err != nil {
+		return err
+	}
+	if err := initS3DNSCache(); err != nil {
+		return err
+	}
+	if err := initBucketAccess(); err != nil {
+		return err
+	}
+	if err := initS3Resilience(); err != nil {
+		return err
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region), config.WithHTTPClient(s3HTTPClient()))
 	if err != nil {
 		return fmt.Errorf("failed to load AWS config: %w", err)
 	}
-	s3Client = s3.NewFromConfig(cfg)
+	assumeRole(&cfg)
+	s3Retryer(&cfg)
+	cfg.APIOptions = append(cfg.APIOptions, addS3UsageMiddleware, addConnectivityMiddleware, addBucketAccessMiddleware, addCircuitBreakerMiddleware)
+	if tracingEnabled {
+		otelaws.AppendMiddlewares(&cfg.APIOptions)
+	}
+	s3Client = s3.NewFromConfig(cfg, s3EndpointOptions)
+	return nil
+}
+
+func initCache() error {
+	if cacheDir == "" {
+		return nil
+	}
+	maxMB := int64(1024)
+	if cacheMaxMB != "" {
+		n, err := strconv.ParseInt(cacheMaxMB, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid CACHE_MAX_MB: %q", cacheMaxMB)
+		}
+		maxMB = n
+	}
+	dc, err := newDiskCache(cacheDir, maxMB<<20)
+	if err != nil {
+		return fmt.Errorf("failed to open cache dir: %w", err)
+	}
+	audioCache = dc
 	return nil
 }
 
-func s3List(prefix string, delimiter string) ([]string, []string, error) {
+// metaKey returns the full S3 key of a server-owned metadata object
+func metaKey(name string) string {
+	return s3Prefix + META_DIR + "/" + name
+}
+
+// isMetaDir reports whether a path relative to S3_PREFIX is the metadata directory
+func isMetaDir(name string) bool {
+	return name == META_DIR || strings.HasPrefix(name, META_DIR+"/")
+}
+
+// isServerOwned reports whether key of lib names the metadata directory or an object in
+// it, which no route serves, also through a library whose prefix lies above S3_PREFIX
+func isServerOwned(lib *library, key string) bool {
+	if isMetaDir(key) {
+		return true
+	}
+	rel, ok := strings.CutPrefix(lib.Prefix+key, s3Prefix)
+	return ok && lib.Bucket == s3Bucket && isMetaDir(rel)
+}
+
+// s3GetJSON decodes a metadata document from the state store, by default an object
+// under META_DIR
+func s3GetJSON(ctx context.Context, name string, v interface{}) error {
+	data, err := state.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// s3PutJSON stores v as a metadata document in the state store
+func s3PutJSON(ctx context.Context, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return state.put(ctx, name, data)
+}
+
+func s3List(ctx context.Context, prefix string, delimiter string) ([]string, []string, error) {
 	// List S3 objects and common prefixes (directories)
+	lib := libraryFrom(ctx)
 	var dirs, files []string
+	cacheKey := lib.Name + "\x00" + prefix + "\x00" + delimiter
+	if data, ok := listingCache.Get(cacheKey); ok {
+		var cached [2][]string
+		if json.Unmarshal(data, &cached) == nil {
+			return filterVisible(ctx, prefix, cached[0], true), filterVisible(ctx, prefix, cached[1], false), nil
+		}
+	}
 	input := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s3Bucket),
-		Prefix:    aws.String(s3Prefix + prefix),
+		Bucket:    aws.String(lib.Bucket),
+		Prefix:    aws.String(lib.Prefix + prefix),
 		Delimiter: aws.String(delimiter),
 	}
-	resp, err := s3Client.ListObjectsV2(context.Background(), input)
-	if err != nil {
-		return nil, nil, err
-	}
-	for _, cp := range resp.CommonPrefixes {
-		name := strings.TrimPrefix(*cp.Prefix, s3Prefix+prefix)
-		name = strings.TrimSuffix(name, "/")
-		if name != "" {
-			dirs = append(dirs, name)
+	// Folders with more than 1000 entries span several pages
+	paginator := s3.NewListObjectsV2Paginator(s3Client, input)
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			var cached [2][]string
+			if lastGoodIndex.recall(cacheKey, err, &cached) {
+				return filterVisible(ctx, prefix, cached[0], true), filterVisible(ctx, prefix, cached[1], false), nil
+			}
+			return nil, nil, err
 		}
-	}
-	for _, obj := range resp.Contents {
-		name := strings.TrimPrefix(*obj.Key, s3Prefix+prefix)
-		if name != "" && !strings.Contains(name, "/") {
-			files = append(files, name)
+		for _, cp := range resp.CommonPrefixes {
+			name := strings.TrimPrefix(*cp.Prefix, lib.Prefix+prefix)
+			name = strings.TrimSuffix(name, "/")
+			if name != "" && !isMetaDir(prefix+name) && isListed(prefix+name, true) {
+				dirs = append(dirs, name)
+			}
+		}
+		for _, obj := range resp.Contents {
+			name := strings.TrimPrefix(*obj.Key, lib.Prefix+prefix)
+			if name != "" && !strings.Contains(name, "/") && isListed(prefix+name, false) {
+				files = append(files, name)
+			}
 		}
 	}
-	return dirs, files, nil
+	if data, err := json.Marshal([2][]string{dirs, files}); err == nil {
+		listingCache.Set(cacheKey, data)
+	}
+	lastGoodIndex.remember(cacheKey, [2][]string{dirs, files})
+	return filterVisible(ctx, prefix, dirs, true), filterVisible(ctx, prefix, files, false), nil
+}
+
+// s3ListAllDirs lists every directory of the library that ctx may see, the root first
+func s3ListAllDirs(ctx context.Context) ([]string, error) {
+	dirs, err := s3WalkAllDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return filterVisible(ctx, "", dirs, true), nil
 }
 
-func s3ListAllDirs() ([]string, error) {
-	// Recursively list all directories in S3 bucket
-	var allDirs []string
-	var walk func(prefix string) error
-	walk = func(prefix string) error {
+func s3WalkAllDirs(ctx context.Context) ([]string, error) {
+	// Walk all directories in S3 bucket with a bounded pool of concurrent ListObjectsV2 calls
+	ctx, span := tracer.Start(ctx, "s3ListAllDirs")
+	defer span.End()
+	lib := libraryFrom(ctx)
+	if dirs, ok, err := inventory.dirs(ctx); ok {
+		if err != nil {
+			return nil, err
+		}
+		noteLibrarySnapshot(lib, "dirs", dirs)
+		return dirs, nil
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		listed   atomic.Int64
+	)
+	allDirs := []string{""} // root
+	sem := make(chan struct{}, walkConcurrency)
+	var walk func(prefix string)
+	walk = func(prefix string) {
+		defer wg.Done()
+		sem <- struct{}{}
+		defer func() { <-sem }()
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			return
+		}
 		input := &s3.ListObjectsV2Input{
-			Bucket:    aws.String(s3Bucket),
-			Prefix:    aws.String(s3Prefix + prefix),
+			Bucket:    aws.String(lib.Bucket),
+			Prefix:    aws.String(lib.Prefix + prefix),
 			Delimiter: aws.String("/"),
 		}
-		resp, err := s3Client.ListObjectsV2(context.Background(), input)
-		if err != nil {
-			return err
+		paginator := s3.NewListObjectsV2Paginator(s3Client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			for _, cp := range page.CommonPrefixes {
+				name := strings.TrimPrefix(*cp.Prefix, lib.Prefix)
+				name = strings.TrimSuffix(name, "/")
+				if isMetaDir(name) || !isListed(name, true) {
+					continue
+				}
+				mu.Lock()
+				allDirs = append(allDirs, name)
+				mu.Unlock()
+				wg.Add(1)
+				go walk(name + "/")
+			}
 		}
-		for _, cp := range resp.CommonPrefixes {
-			name := strings.TrimPrefix(*cp.Prefix, s3Prefix)
-			name = strings.TrimSuffix(name, "/")
-			allDirs = append(allDirs, name)
-			if err := walk(name + "/"); err != nil {
-				return err
+		listed.Add(1)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(WALK_PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				found := len(allDirs)
+				mu.Unlock()
+				log.Printf("Directory scan in progress: %d prefixes listed, %d directories found", listed.Load(), found)
+				eventBus.Publish(EVENT_SCAN_PROGRESS, map[string]interface{}{"listed": listed.Load(), "found": found, "done": false})
 			}
 		}
-		return nil
+	}()
+	start := time.Now()
+	wg.Add(1)
+	walk("")
+	wg.Wait()
+	close(done)
+	if firstErr != nil {
+		var cached []string
+		if lastGoodIndex.recall(lib.Name+"\x00alldirs", firstErr, &cached) {
+			return cached, nil
+		}
+		return nil, firstErr
 	}
-	allDirs = append(allDirs, "") // root
-	if err := walk(""); err != nil {
+	lastGoodIndex.remember(lib.Name+"\x00alldirs", allDirs)
+	log.Printf("Directory scan finished: %d directories in %s", len(allDirs), time.Since(start).Round(time.Millisecond))
+	eventBus.Publish(EVENT_SCAN_PROGRESS, map[string]interface{}{"listed": listed.Load(), "found": len(allDirs), "done": true})
+	noteLibrarySnapshot(lib, "dirs", allDirs)
+	return allDirs, nil
+}
+
+// audioObject is an audio file found by a listing, keyed relative to the library prefix
+type audioObject struct {
+	Key      string
+	Size     int64
+	ETag     string
+	Modified time.Time
+}
+
+func s3ListAudioObjects(ctx context.Context, prefix string) ([]audioObject, error) {
+	// Recursively list all audio objects under prefix
+	var objects []audioObject
+	err := s3WalkAudioObjects(ctx, prefix, func(page []audioObject) error {
+		objects = append(objects, page...)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	return allDirs, nil
+	return objects, nil
 }
 
-func s3ListAllAudioFiles(prefix string) ([]string, error) {
-	// Recursively list all audio files under prefix
-	var allFiles []string
+// s3WalkAudioObjects lists audio objects under prefix, calling fn with each page as S3 returns it
+func s3WalkAudioObjects(ctx context.Context, prefix string, fn func([]audioObject) error) error {
+	return s3WalkObjects(ctx, prefix, isAudioFile, fn)
+}
+
+// s3WalkObjects lists the listed objects under prefix that keep accepts, page by page.
+// A fresh S3 Inventory stands in for the listing where it covers the prefix.
+func s3WalkObjects(ctx context.Context, prefix string, keep func(key string) bool, fn func([]audioObject) error) error {
+	if objects, live, ok := inventory.lookup(libraryFrom(ctx), prefix); ok {
+		return inventory.walk(ctx, objects, live, keep, fn)
+	}
+	return s3WalkObjectsLive(ctx, prefix, keep, fn)
+}
+
+// s3WalkObjectsLive is s3WalkObjects listing the bucket
+func s3WalkObjectsLive(ctx context.Context, prefix string, keep func(key string) bool, fn func([]audioObject) error) error {
+	lib := libraryFrom(ctx)
 	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(s3Bucket),
-		Prefix: aws.String(s3Prefix + prefix),
+		Bucket: aws.String(lib.Bucket),
+		Prefix: aws.String(lib.Prefix + prefix),
 	}
 	paginator := s3.NewListObjectsV2Paginator(s3Client, input)
 	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(context.Background())
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		var objects []audioObject
 		for _, obj := range page.Contents {
-			if isAudioFile(*obj.Key) {
-				name := strings.TrimPrefix(*obj.Key, s3Prefix)
-				allFiles = append(allFiles, name)
+			key := strings.TrimPrefix(*obj.Key, lib.Prefix)
+			if keep(key) && isListed(key, false) {
+				objects = append(objects, audioObject{
+					Key:      key,
+					Size:     aws.ToInt64(obj.Size),
+					ETag:     normalizeETag(aws.ToString(obj.ETag)),
+					Modified: aws.ToTime(obj.LastModified),
+				})
 			}
 		}
+		if err := fn(objects); err != nil {
+			return err
+		}
 	}
-	return allFiles, nil
+	return nil
 }
 
-func s3SearchFiles(searchStr string) ([]string, error) {
-	// List all audio files and filter by searchStr
-	allFiles, err := s3ListAllAudioFiles("")
+func s3ListAllAudioFiles(ctx context.Context, prefix string) ([]string, error) {
+	// Recursively list all audio files under prefix
+	ctx, span := tracer.Start(ctx, "s3ListAllAudioFiles", trace.WithAttributes(attribute.String("s3.prefix", prefix)))
+	defer span.End()
+	objects, err := s3ListAudioObjects(ctx, prefix)
 	if err != nil {
 		return nil, err
 	}
+	allFiles := make([]string, len(objects))
+	for i, obj := range objects {
+		allFiles[i] = obj.Key
+	}
+	if prefix == "" {
+		noteLibrarySnapshot(libraryFrom(ctx), "files", allFiles)
+	}
+	return allFiles, nil
+}
+
+// Search modes, chosen with the dfmode form field
+const (
+	SEARCH_MODE_SUBSTRING = "substring" // the default
+	SEARCH_MODE_GLOB      = "glob"      // * ? and [...] against the whole path
+	SEARCH_MODE_REGEX     = "regex"
+)
+
+// searchMatcher returns a case-insensitive matcher for searchStr in the given mode
+func searchMatcher(searchStr string, mode string) (func(string) bool, error) {
+	switch mode {
+	case SEARCH_MODE_REGEX:
+		re, err := regexp.Compile("(?i)" + searchStr)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case SEARCH_MODE_GLOB:
+		re, err := regexp.Compile("(?is)^" + globToRegexp(searchStr) + "$")
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case "", SEARCH_MODE_SUBSTRING:
+		lower := strings.ToLower(searchStr)
+		return func(s string) bool { return strings.Contains(strings.ToLower(s), lower) }, nil
+	}
+	return nil, fmt.Errorf("unknown search mode %q", mode)
+}
+
+// globToRegexp translates a glob pattern; unlike path.Match, * also crosses "/" so
+// *Live*1994*.flac finds files in any folder
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch ch := glob[i]; ch {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			if end := strings.IndexByte(glob[i+1:], ']'); end > 0 {
+				class := glob[i+1 : i+1+end]
+				if class[0] == '!' {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+				i += end + 1
+			} else {
+				b.WriteString(`\[`)
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return b.String()
+}
+
+// requestSearchMatcher builds the matcher for a dffunc search, answering invalid patterns itself
+func requestSearchMatcher(c *gin.Context, searchStr, callback string) (func(string) bool, bool) {
+	match, err := searchMatcher(searchStr, c.PostForm("dfmode"))
+	if err != nil {
+		echoReqHtml(c, []interface{}{"error", "Invalid search pattern: " + err.Error(), []string{}}, callback)
+		return nil, false
+	}
+	return match, true
+}
+
+func s3SearchFiles(ctx context.Context, match func(string) bool) ([]string, error) {
+	return s3SearchFilesIn(ctx, nil, match)
+}
+
+// s3SearchFilesIn lists the tracks below each folder, or the whole library when there
+// are none, and filters them. A track in nested selected folders is returned once.
+func s3SearchFilesIn(ctx context.Context, folders []string, match func(string) bool) ([]string, error) {
+	prefixes := []string{""}
+	if len(folders) > 0 {
+		prefixes = prefixes[:0]
+		for _, f := range folders {
+			if f = strings.Trim(f, "/"); f == "" {
+				prefixes = []string{""}
+				break
+			}
+			prefixes = append(prefixes, f+"/") // "Classical" must not match "Classical Crossover"
+		}
+	}
+	seen := make(map[string]bool)
 	var matches []string
-	for _, f := range allFiles {
-		if strings.Contains(strings.ToLower(f), strings.ToLower(searchStr)) {
-			matches = append(matches, f)
+	for _, prefix := range prefixes {
+		files, err := s3ListAllTracks(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !seen[f] && match(f) {
+				seen[f] = true
+				matches = append(matches, f)
+			}
 		}
 	}
 	return matches, nil
 }
 
-func s3SearchDirs(searchStr string) ([]string, error) {
-	allDirs, err := s3ListAllDirs()
+func s3SearchDirs(ctx context.Context, match func(string) bool) ([]string, error) {
+	allDirs, err := s3ListAllDirs(ctx)
 	if err != nil {
 		return nil, err
 	}
 	var matches []string
 	for _, d := range allDirs {
-		if strings.Contains(strings.ToLower(d), strings.ToLower(searchStr)) {
+		if match(d) {
 			matches = append(matches, d+"/")
 		}
 	}
 	return matches, nil
 }
 
-func s3GetAudioFile(key string) (io.ReadCloser, int64, string, error) {
+func s3GetAudioFile(ctx context.Context, key string) (io.ReadCloser, int64, string, error) {
+	lib := libraryFrom(ctx)
+	if checkKey(key) != "" {
+		return nil, 0, "", errInvalidKey
+	}
+	if isServerOwned(lib, key) {
+		return nil, 0, "", errServerOwned
+	}
 	input := &s3.GetObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(s3Prefix + key),
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + key),
 	}
-	resp, err := s3Client.GetObject(context.Background(), input)
+	resp, err := s3Client.GetObject(ctx, input)
 	if err != nil {
 		return nil, 0, "", err
 	}
@@ -259,93 +631,371 @@ func s3GetAudioFile(key string) (io.ReadCloser, int64, string, error) {
 	if resp.ContentLength != nil {
 		size = *resp.ContentLength
 	}
-	return resp.Body, size, aws.ToString(resp.ContentType), nil
+	body := newResumableBody(ctx, lib.Bucket, lib.Prefix+key, aws.ToString(resp.ETag), resp.Body, size)
+	return body, size, aws.ToString(resp.ContentType), nil
+}
+
+// objectMeta is a cached HEAD result
+type objectMeta struct {
+	ETag        string `json:"etag"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+func s3HeadAudioFile(ctx context.Context, key string) (string, int64, string, error) {
+	lib := libraryFrom(ctx)
+	if checkKey(key) != "" {
+		return "", 0, "", errInvalidKey
+	}
+	if isServerOwned(lib, key) {
+		return "", 0, "", errServerOwned
+	}
+	cacheKey := lib.Name + "\x00" + key
+	var meta objectMeta
+	if data, ok := metadataCache.Get(cacheKey); ok && json.Unmarshal(data, &meta) == nil {
+		return meta.ETag, meta.Size, meta.ContentType, nil
+	}
+	resp, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + key),
+	})
+	if err != nil {
+		return "", 0, "", err
+	}
+	meta = objectMeta{ETag: aws.ToString(resp.ETag), Size: aws.ToInt64(resp.ContentLength), ContentType: aws.ToString(resp.ContentType)}
+	if data, err := json.Marshal(meta); err == nil {
+		metadataCache.Set(cacheKey, data)
+	}
+	return meta.ETag, meta.Size, meta.ContentType, nil
+}
+
+// s3RenameObject moves an object within the request's library by copying and deleting it
+func s3RenameObject(ctx context.Context, from, to string) error {
+	lib := libraryFrom(ctx)
+	_, err := s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(lib.Bucket),
+		CopySource: aws.String(url.PathEscape(lib.Bucket + "/" + lib.Prefix + from)),
+		Key:        aws.String(lib.Prefix + to),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + from),
+	})
+	forgetObject(lib, from)
+	forgetObject(lib, to)
+	return err
+}
+
+// s3DeleteObject removes an object of the request's library
+func s3DeleteObject(ctx context.Context, key string) error {
+	lib := libraryFrom(ctx)
+	_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + key),
+	})
+	forgetObject(lib, key)
+	return err
+}
+
+// forgetObject drops what the caches know about a key of lib after it was written,
+// moved or deleted
+func forgetObject(lib *library, key string) {
+	metadataCache.Delete(lib.Name + "\x00" + key)
+	if audioCache != nil {
+		audioCache.Delete(lib.cacheKey(key))
+	}
+	inventory.touch(lib, key)
+	listingCache.Purge()
+	responseCache.Purge()
+}
+
+// trackSidecars returns the keys of the objects that belong to track key: its .lrc
+// lyrics, .chapters.txt chapter list and .cue sheet, named after the track
+func trackSidecars(key string) []string {
+	base := strings.TrimSuffix(key, path.Ext(key))
+	return []string{base + ".lrc", base + CHAPTERS_SUFFIX, base + CUE_EXT}
+}
+
+// s3MoveTrack renames a track together with its sidecars. A cue sheet's FILE lines are
+// pointed at the new file name. Sidecar failures are logged; the track's error is returned.
+func s3MoveTrack(ctx context.Context, from, to string) error {
+	if err := s3RenameObject(ctx, from, to); err != nil {
+		return err
+	}
+	oldName, newName := path.Base(from), path.Base(to)
+	toSidecars := trackSidecars(to)
+	for i, sc := range trackSidecars(from) {
+		var err error
+		if isCueSheet(sc) && oldName != newName {
+			err = s3RewriteCueSheet(ctx, sc, toSidecars[i], oldName, newName)
+		} else {
+			err = s3RenameObject(ctx, sc, toSidecars[i])
+		}
+		if err != nil && !isNoSuchKey(err) {
+			log.Printf("Moving %s along with %s failed: %v", sc, from, err)
+		}
+	}
+	return nil
+}
+
+// s3DeleteTrack deletes a track and its sidecars
+func s3DeleteTrack(ctx context.Context, key string) error {
+	if err := s3DeleteObject(ctx, key); err != nil {
+		return err
+	}
+	for _, sc := range trackSidecars(key) {
+		// DeleteObject succeeds for missing keys
+		if err := s3DeleteObject(ctx, sc); err != nil {
+			log.Printf("Deleting %s along with %s failed: %v", sc, key, err)
+		}
+	}
+	return nil
+}
+
+// s3RewriteCueSheet moves a cue sheet to "to", replacing the file name oldName by
+// newName in its FILE lines
+func s3RewriteCueSheet(ctx context.Context, from, to, oldName, newName string) error {
+	lib := libraryFrom(ctx)
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + from),
+	})
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_CUE_SHEET))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		cmd, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if strings.EqualFold(cmd, "FILE") {
+			lines[i] = strings.Replace(line, oldName, newName, 1)
+		}
+	}
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(lib.Bucket),
+		Key:         aws.String(lib.Prefix + to),
+		Body:        strings.NewReader(strings.Join(lines, "\n")),
+		ContentType: resp.ContentType,
+	})
+	if err != nil {
+		return err
+	}
+	return s3DeleteObject(ctx, from)
+}
+
+// s3GetRange reads part of an audio object, rng being an HTTP range such as "bytes=0-1023" or "bytes=-1024"
+func s3GetRange(ctx context.Context, key, rng string) ([]byte, error) {
+	lib := libraryFrom(ctx)
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(lib.Bucket),
+		Key:    aws.String(lib.Prefix + key),
+		Range:  aws.String(rng),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
 }
 
 // --- HANDLERS ---
 func handleDirRequest(c *gin.Context, dir string) {
-	dirs, files, err := s3List(dir, "/")
+	dirs, files, err := s3List(c.Request.Context(), dir, "/")
 	if err != nil {
 		log.Printf("S3 list error: %v", err)
-		echoReqHtml(c, []interface{}{"error", TXT_ACC_DIR, dir, []string{}}, "getBrowserData")
+		echoReqHtml(c, []interface{}{"error", msg(c, MSG_ACC_DIR), dir, []string{}}, "getBrowserData")
 		return
 	}
-	sort.Strings(dirs)
-	sort.Strings(files)
-	echoReqHtml(c, []interface{}{"ok", dir, dirs, files}, "getBrowserData")
+	files = expandCueFiles(c.Request.Context(), dir, files)
+	order := requestOrder(c)
+	order.sortDirs(dirs)
+	order.sortTracks(c.Request.Context(), dir, files)
+	dirs, files, page := paginatePair(c, dirs, files, maxListResult)
+	keys := make([]string, len(files))
+	for i, f := range files {
+		keys[i] = dir + f
+	}
+	durations := manifest.durations(libraryFrom(c.Request.Context()), keys)
+	echoReqHtml(c, []interface{}{"ok", dir, dirs, files, page, durations}, "getBrowserData")
 }
 
 func handleSearchTitle(c *gin.Context, searchStr string) {
-	searchStr = strings.TrimSpace(searchStr)
-	if len(searchStr) < MIN_SEARCH_STR {
-		echoReqHtml(c, []interface{}{"error", TXT_MIN_SEARCH + fmt.Sprintf("%d", MIN_SEARCH_STR), []string{}}, "getSearchTitle")
+	searchTitles(c, searchStr, nil)
+}
+
+// handleSearchTitleIn searches titles inside the given folders only, dfdata is
+// {"query":"...","folders":["Classical/", ...]}
+func handleSearchTitleIn(c *gin.Context, data string) {
+	var req struct {
+		Query   string   `json:"query"`
+		Folders []string `json:"folders"`
+	}
+	if err := json.Unmarshal([]byte(data), &req); err != nil || len(req.Folders) == 0 {
+		echoReqHtml(c, []interface{}{"error", "Invalid search scope", []string{}}, "getSearchTitle")
+		return
+	}
+	if !validateFolders(c, req.Folders) {
+		return
+	}
+	searchTitles(c, req.Query, req.Folders)
+}
+
+// titleMatcher parses a title search of user in lib: the text pattern in mode, narrowed by
+// the rating and tag filters. It also returns the text left once the filters are cut and,
+// when tags are filtered on, the tag search that marks what each hit matched. Its errors
+// are meant to be shown as they are.
+func titleMatcher(c *gin.Context, lib *library, user, searchStr, mode string) (func(string) bool, *tagSearch, string, error) {
+	// "rating:N" limits the results to tracks the user rated N stars or more
+	searchStr, minRating := cutRatingFilter(strings.TrimSpace(searchStr))
+	// artist:, album:, genre:, title: and year: match the tags the tag scan read
+	searchStr, filters, err := cutTagFilters(searchStr)
+	if err != nil {
+		return nil, nil, "", errors.New("Invalid search pattern: " + err.Error())
+	}
+	if len(filters) > 0 && !tagScan {
+		return nil, nil, "", errors.New(msg(c, MSG_TAG_SEARCH_OFF))
+	}
+	if len(searchStr) < MIN_SEARCH_STR && ((minRating == 0 && len(filters) == 0) || searchStr != "") {
+		return nil, nil, "", errors.New(msg(c, MSG_MIN_SEARCH, MIN_SEARCH_STR))
+	}
+	match, err := searchMatcher(searchStr, mode)
+	if err != nil {
+		return nil, nil, "", errors.New("Invalid search pattern: " + err.Error())
+	}
+	if minRating > 0 {
+		rated := ratings.list(user, lib)
+		text := match
+		match = func(s string) bool { return rated[s] >= minRating && text(s) }
+	}
+	var tagged *tagSearch
+	if len(filters) > 0 {
+		tagged = newTagSearch(lib, filters, searchStr, mode)
+		text := match
+		match = func(s string) bool { return tagged.match(s) && text(s) }
+	}
+	return match, tagged, searchStr, nil
+}
+
+// searchTitles answers a title search over the whole library, or over folders when given
+func searchTitles(c *gin.Context, searchStr string, folders []string) {
+	match, tagged, searchStr, err := titleMatcher(c, libraryFrom(c.Request.Context()), requestUser(c), searchStr, c.PostForm("dfmode"))
+	if err != nil {
+		echoReqHtml(c, []interface{}{"error", err.Error(), []string{}}, "getSearchTitle")
+		return
+	}
+	if !guardWalk(c, "getSearchTitle", []string{}) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), searchTimeout)
+	defer cancel()
+	titles, err := s3SearchFilesIn(ctx, folders, match)
+	if errors.Is(err, context.DeadlineExceeded) {
+		echoReqHtml(c, []interface{}{msg(c, MSG_SEARCH_TIMEOUT), []string{}}, "getSearchTitle")
 		return
 	}
-	titles, err := s3SearchFiles(searchStr)
 	if err != nil {
 		log.Printf("S3 search error: %v", err)
 		echoReqHtml(c, []interface{}{"error", "S3 search error", []string{}}, "getSearchTitle")
 		return
 	}
-	if len(titles) > MAX_SEARCH_RESULT {
-		titles = titles[:MAX_SEARCH_RESULT]
+	eventBus.Publish(EVENT_SEARCH, map[string]interface{}{"kind": "title", "query": searchStr, "count": len(titles)})
+	requestOrder(c).sortTracks(c.Request.Context(), "", titles)
+	titles, page := paginate(c, titles, maxSearchResult)
+	durations := manifest.durations(libraryFrom(c.Request.Context()), titles)
+	reply := []interface{}{"", titles, page, durations}
+	if tagged != nil {
+		reply = append(reply, tagged.hits(titles))
 	}
-	sort.Strings(titles)
-	echoReqHtml(c, []interface{}{"", titles}, "getSearchTitle")
+	echoReqHtml(c, reply, "getSearchTitle")
 }
 
 func handleSearchDir(c *gin.Context, searchStr string) {
 	searchStr = strings.TrimSpace(searchStr)
 	if len(searchStr) < MIN_SEARCH_STR {
-		echoReqHtml(c, []interface{}{"error", TXT_MIN_SEARCH + fmt.Sprintf("%d", MIN_SEARCH_STR), []string{}}, "getSearchDir")
+		echoReqHtml(c, []interface{}{"error", msg(c, MSG_MIN_SEARCH, MIN_SEARCH_STR), []string{}}, "getSearchDir")
+		return
+	}
+	match, ok := requestSearchMatcher(c, searchStr, "getSearchDir")
+	if !ok || !guardWalk(c, "getSearchDir", []string{}) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), searchTimeout)
+	defer cancel()
+	dirs, err := s3SearchDirs(ctx, match)
+	if errors.Is(err, context.DeadlineExceeded) {
+		echoReqHtml(c, []interface{}{msg(c, MSG_SEARCH_TIMEOUT), []string{}}, "getSearchDir")
 		return
 	}
-	dirs, err := s3SearchDirs(searchStr)
 	if err != nil {
 		log.Printf("S3 search dir error: %v", err)
 		echoReqHtml(c, []interface{}{"error", "S3 search dir error", []string{}}, "getSearchDir")
 		return
 	}
-	if len(dirs) > MAX_SEARCH_RESULT {
-		dirs = dirs[:MAX_SEARCH_RESULT]
-	}
-	sort.Strings(dirs)
-	echoReqHtml(c, []interface{}{"", dirs}, "getSearchDir")
+	eventBus.Publish(EVENT_SEARCH, map[string]interface{}{"kind": "dir", "query": searchStr, "count": len(dirs)})
+	requestOrder(c).sortDirs(dirs)
+	dirs, page := paginate(c, dirs, maxSearchResult)
+	echoReqHtml(c, []interface{}{"", dirs, page}, "getSearchDir")
 }
 
 func handleGetAllMp3(c *gin.Context) {
-	files, err := s3ListAllAudioFiles("")
+	if !guardWalk(c, "getAllMp3Data") {
+		return
+	}
+	files, err := s3ListAllTracks(c.Request.Context(), "")
 	if err != nil {
 		log.Printf("S3 get all mp3 error: %v", err)
 		echoReqHtml(c, []interface{}{"error", "Failed to scan S3 bucket"}, "getAllMp3Data")
 		return
 	}
-	sort.Strings(files)
-	echoReqHtml(c, []interface{}{"ok", files}, "getAllMp3Data")
+	requestOrder(c).sortTracks(c.Request.Context(), "", files)
+	files, page := paginate(c, files, maxListResult)
+	echoReqHtml(c, []interface{}{"ok", files, page, manifest.durations(libraryFrom(c.Request.Context()), files)}, "getAllMp3Data")
 }
 
 func handleGetAllDirs(c *gin.Context) {
-	dirs, err := s3ListAllDirs()
+	if !guardWalk(c, "getAllDirsData") {
+		return
+	}
+	dirs, err := s3ListAllDirs(c.Request.Context())
 	if err != nil {
 		log.Printf("S3 get all dirs error: %v", err)
 		echoReqHtml(c, []interface{}{"error", "Failed to scan S3 directories"}, "getAllDirsData")
 		return
 	}
-	sort.Strings(dirs[1:]) // keep root at top
-	echoReqHtml(c, []interface{}{"ok", dirs}, "getAllDirsData")
+	requestOrder(c).sortDirs(dirs[1:]) // keep root at top
+	dirs, page := paginate(c, dirs, maxListResult)
+	echoReqHtml(c, []interface{}{"ok", dirs, page}, "getAllDirsData")
 }
 
 func handleGetAllMp3InDir(c *gin.Context, dir string) {
-	files, err := s3ListAllAudioFiles(dir)
+	files, err := s3ListAllTracks(c.Request.Context(), dir)
 	if err != nil {
 		log.Printf("S3 get all mp3 in dir error: %v", err)
 		echoReqHtml(c, []interface{}{"error", "Failed to scan S3 directory"}, "getAllMp3Data")
 		return
 	}
-	sort.Strings(files)
-	echoReqHtml(c, []interface{}{"ok", files}, "getAllMp3Data")
+	requestOrder(c).sortTracks(c.Request.Context(), "", files)
+	files, page := paginate(c, files, maxListResult)
+	echoReqHtml(c, []interface{}{"ok", files, page, manifest.durations(libraryFrom(c.Request.Context()), files)}, "getAllMp3Data")
+}
+
+// folderResult reports how listing one of several selected folders went
+type folderResult struct {
+	Folder string `json:"folder"`
+	Tracks int    `json:"tracks"`
+	Error  string `json:"error,omitempty"`
 }
 
+// handleGetAllMp3InDirs lists the tracks of several folders with the outcome of each.
+// When some folders fail the status is "partial"; with dfstrict=1 the whole request
+// fails instead.
 func handleGetAllMp3InDirs(c *gin.Context, data string) {
 	var selectedFolders []string
 	err := json.Unmarshal([]byte(data), &selectedFolders)
@@ -353,15 +1003,28 @@ func handleGetAllMp3InDirs(c *gin.Context, data string) {
 		echoReqHtml(c, []interface{}{"error", "Invalid folder data"}, "getAllMp3Data")
 		return
 	}
+	if !validateFolders(c, selectedFolders) {
+		return
+	}
 	var allFiles []string
-	for _, folder := range selectedFolders {
-		files, err := s3ListAllAudioFiles(folder)
+	results := make([]folderResult, len(selectedFolders))
+	failed := 0
+	for i, folder := range selectedFolders {
+		results[i].Folder = folder
+		files, err := s3ListAllTracks(c.Request.Context(), folder)
 		if err != nil {
-			log.Printf("S3 get all mp3 in dirs error: %v", err)
+			log.Printf("S3 get all mp3 in dirs error for %q: %v", folder, err)
+			results[i].Error = msg(c, MSG_LISTING_FAILED)
+			failed++
 			continue
 		}
+		results[i].Tracks = len(files)
 		allFiles = append(allFiles, files...)
 	}
+	if failed > 0 && c.PostForm("dfstrict") == "1" {
+		echoReqHtml(c, []interface{}{"error", msg(c, MSG_FOLDERS_FAILED, failed, len(selectedFolders)), results}, "getAllMp3Data")
+		return
+	}
 	// Remove duplicates and sort
 	uniqueFiles := make(map[string]bool)
 	var finalFiles []string
@@ -371,87 +1034,715 @@ func handleGetAllMp3InDirs(c *gin.Context, data string) {
 			finalFiles = append(finalFiles, file)
 		}
 	}
-	sort.Strings(finalFiles)
-	echoReqHtml(c, []interface{}{"ok", finalFiles}, "getAllMp3Data")
+	requestOrder(c).sortTracks(c.Request.Context(), "", finalFiles)
+	finalFiles, page := paginate(c, finalFiles, maxListResult)
+	status := "ok"
+	if failed > 0 {
+		status = "partial" // not cached, so the failed folders are tried again
+	}
+	echoReqHtml(c, []interface{}{status, finalFiles, page, manifest.durations(libraryFrom(c.Request.Context()), finalFiles), results}, "getAllMp3Data")
+}
+
+// handleAudio streams the audio object named by the request path
+func handleAudio(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	if isServerOwned(libraryFrom(c.Request.Context()), key) {
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	if !kioskVisible(key, false) {
+		c.String(http.StatusForbidden, "Not available in kiosk mode")
+		return
+	}
+	if !folderVisible(c.Request.Context(), key, false) {
+		if _, signedIn := homeUser(c); basicAuth && !signedIn {
+			challengeBasic(c) // a client without a key may be allowed more with one
+			c.String(http.StatusUnauthorized, "API key required")
+			return
+		}
+		c.String(http.StatusNotFound, "Audio not found") // hidden folders don't exist for the user
+		return
+	}
+	noteStreamTrack(c, libraryFrom(c.Request.Context()), key)
+	prefetchQueued(c, key)
+	serveAudio(c, key)
+}
+
+// serveAudio streams an audio object or cue sheet track of the request's library
+func serveAudio(c *gin.Context, key string) {
+	if sheet, number, ok := parseCueTrackKey(key); ok {
+		serveCueTrack(c, sheet, number)
+		return
+	}
+	serveObject(c, key, nil)
+}
+
+// serveObject streams an audio object, cut to trim (or its stored trim points when nil),
+// serving it from the disk cache when possible
+func serveObject(c *gin.Context, key string, trim *trimPoint) {
+	lib := libraryFrom(c.Request.Context())
+	if isServerOwned(lib, key) {
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	policy := streamPolicy(key)
+	if policy == STREAM_BLOCK {
+		c.String(http.StatusForbidden, "Format not allowed")
+		return
+	}
+	if trim == nil {
+		if t, ok := trims.get(lib, key); ok {
+			trim = &t
+		}
+	}
+	if c.Query("trim") == "1" {
+		trim = loudness.trimSilence(lib, key, trim)
+	}
+	if trim != nil && ffmpegPath == "" {
+		trim = nil
+	}
+	gain := normalizeGain(c, key)
+	if gain != 0 && policy == STREAM_REMUX {
+		// Applying gain means re-encoding, which remuxing avoids
+		gain = 0
+	}
+	if (trim != nil || gain != 0) && policy == STREAM_DIRECT {
+		policy = STREAM_TRANSCODE
+	}
+	if cdnMode && policy == STREAM_DIRECT && handleCDNAudio(c, key) {
+		return
+	}
+	var convKey string
+	if policy != STREAM_DIRECT {
+		if convKey = transcodeCacheKey(c.Request.Context(), key, policy, trim, gain); convKey != "" {
+			if data, ok := transcodeCache.Get(convKey); ok {
+				serveCachedTranscode(c, key, policy, data)
+				return
+			}
+		}
+	}
+	// The cached HEAD tells which version a disk-cached copy must be
+	var etag string
+	if audioCache != nil {
+		etag, _, _, _ = s3HeadAudioFile(c.Request.Context(), key)
+	}
+	if etag != "" {
+		if f, ok := audioCache.Get(lib.cacheKey(key), etag); ok {
+			if policy != STREAM_DIRECT {
+				streamConverted(c, f, policy, trim, gain, convKey)
+				return
+			}
+			defer f.Close()
+			if info, err := f.Stat(); err == nil {
+				if ct := mime.TypeByExtension(filepath.Ext(key)); ct != "" {
+					c.Header("Content-Type", ct)
+				}
+				http.ServeContent(c.Writer, c.Request, key, info.ModTime(), throttleReadSeeker(f))
+				return
+			}
+		}
+	}
+	body, size, contentType, err := s3GetAudioFile(c.Request.Context(), key)
+	if err != nil {
+		if audioPathMode == AUDIO_PATH_LENIENT && isNoSuchKey(err) {
+			if canonical, ok := resolveLenientKey(c.Request.Context(), key); ok && canonical != key {
+				// The query already names the library and carries the stream options
+				target := audioPath(canonical)
+				if c.Request.URL.RawQuery != "" {
+					target += "?" + c.Request.URL.RawQuery
+				}
+				c.Redirect(http.StatusMovedPermanently, target)
+				return
+			}
+		}
+		log.Printf("S3 audio error: %v", err)
+		c.String(http.StatusNotFound, "Audio not found")
+		return
+	}
+	if etag != "" {
+		body = audioCache.Fill(lib.cacheKey(key), etag, body, size)
+	}
+	if policy != STREAM_DIRECT {
+		streamConverted(c, body, policy, trim, gain, convKey)
+		return
+	}
+	body = throttleReadCloser(body)
+	defer body.Close()
+	c.DataFromReader(http.StatusOK, size, contentType, body, nil)
 }
 
 func handleRequest(c *gin.Context) {
 	funcType := c.PostForm("dffunc")
 	data := c.PostForm("dfdata")
+	c.Request = c.Request.WithContext(withS3Feature(c.Request.Context(), "dffunc:"+funcType))
+	if !checkProtocol(c) || !validateDffunc(c, funcType, data) {
+		return
+	}
 
 	switch funcType {
 	case "dir":
-		handleDirRequest(c, data)
+		cachedResponse(c, funcType, data, func() { handleDirRequest(c, data) })
 	case "searchTitle":
-		handleSearchTitle(c, data)
+		cachedResponse(c, funcType, data, func() { handleSearchTitle(c, data) })
+	case "searchTitleIn":
+		cachedResponse(c, funcType, data, func() { handleSearchTitleIn(c, data) })
 	case "searchDir":
-		handleSearchDir(c, data)
+		cachedResponse(c, funcType, data, func() { handleSearchDir(c, data) })
 	case "getAllMp3":
-		handleGetAllMp3(c)
+		cachedResponse(c, funcType, data, func() { handleGetAllMp3(c) })
 	case "getAllMp3InDir":
-		handleGetAllMp3InDir(c, data)
+		cachedResponse(c, funcType, data, func() { handleGetAllMp3InDir(c, data) })
 	case "getAllMp3InDirs":
-		handleGetAllMp3InDirs(c, data)
+		cachedResponse(c, funcType, data, func() { handleGetAllMp3InDirs(c, data) })
 	case "getAllDirs":
-		handleGetAllDirs(c)
+		cachedResponse(c, funcType, data, func() { handleGetAllDirs(c) })
+	case "getDirStats":
+		cachedResponse(c, funcType, data, func() { handleGetDirStats(c, data) })
+	case "getChapters":
+		handleGetChapters(c, data)
+	case "resolveTracks":
+		handleResolveTracks(c, data)
+	case "registerDevice":
+		handleRegisterDevice(c, data)
+	case "listDevices":
+		handleListDevices(c, data)
+	case "sendDeviceCommand":
+		if kioskMode {
+			// Guests must not control other players
+			echoReqHtml(c, []interface{}{"error", "Not available in kiosk mode"}, "getDeviceCommandResult")
+			return
+		}
+		handleSendDeviceCommand(c, data)
+	case "pollDeviceCommands":
+		handlePollDeviceCommands(c, data)
+	case "nowPlaying":
+		handleNowPlaying(c, data)
+	case "getCollections":
+		handleGetCollections(c)
+	case "getCollection":
+		handleGetCollection(c, data)
+	case "getAllMp3InCollection":
+		handleGetAllMp3InCollection(c, data)
+	case "getSmartPlaylists":
+		handleGetSmartPlaylists(c)
+	case "getAllMp3InSmartPlaylist":
+		handleGetAllMp3InSmartPlaylist(c, data)
+	case "shuffle":
+		handleShuffle(c, data)
+	case "getLibraries":
+		handleGetLibraries(c)
+	case "searchAsync":
+		handleSearchAsync(c, data)
+	case "searchJob":
+		handleSearchJob(c, data)
+	case "getCapabilities":
+		handleGetCapabilities(c)
 	default:
 		echoReqHtml(c, []interface{}{"error", "Unknown function"}, "default")
 	}
 }
 
+// initConfig validates the environment configuration and creates the S3 client
+func initConfig() error {
+	if err := initS3(); err != nil {
+		return fmt.Errorf("S3 init error: %w", err)
+	}
+	for _, initFn := range []func() error{
+		initAudioPathMode,
+		initProxyConfig,
+		initIPFilter,
+		initLetterIndex,
+		initRateLimits,
+		initCompression,
+		initThrottle,
+		initStreamPolicies,
+		initSearchTimeout,
+		initSortOrder,
+		initIgnorePatterns,
+		initShutdownDrain,
+		initHLS,
+		initZip,
+		initKiosk,
+		initRadio,
+		initScheduleLocation,
+		initDurationScan,
+		initLoudness,
+		initTagScan,
+		initResponseLimits,
+		validateServerConfig,
+		initHTTPServer,
+		initCDN,
+		initCacheLayers,
+		initStateStore,
+		initStateRefresh,
+		initAuditLog,
+		initExport,
+		initUserHomes,
+		initFolderACL,
+		initOIDC,
+		initPublicPrefixes,
+		initMPD,
+		initGRPC,
+		initDLNA,
+		initJukebox,
+		initCast,
+		initPrefetch,
+		initTrash,
+		initS3Costs,
+		initSecurityHeaders,
+		initCORS,
+		initInventory,
+		initFingerprints,
+		initEnrichment,
+		initReports,
+		initWebhookKey,
+	} {
+		if err := initFn(); err != nil {
+			return fmt.Errorf("Config error: %w", err)
+		}
+	}
+	return nil
+}
+
+// printConfig writes the effective configuration. It must never include credential material.
+func printConfig(w io.Writer) {
+	fmt.Fprintln(w, "AWS credentials:", credentialSource())
+	fmt.Fprintln(w, "BUCKET:", s3Bucket)
+	fmt.Fprintln(w, "AWS_REGION:", s3Region)
+	fmt.Fprintln(w, "S3_PREFIX:", s3Prefix)
+	fmt.Fprintln(w, "Bucket access:", bucketAccessDescription())
+	fmt.Fprintf(w, "S3_ENDPOINT: %s (path style %t)\n", s3Endpoint, s3ForcePathStyle)
+	for _, lib := range libraries {
+		fmt.Fprintf(w, "Library %q: s3://%s/%s\n", lib.Name, lib.Bucket, lib.Prefix)
+	}
+	fmt.Fprintf(w, "S3 prices: $%g/1k writes, $%g/1k reads, $%g/GB out (daily call quota %d)\n", s3PriceWrites, s3PriceReads, s3PriceGBOut, s3DailyCallQuota)
+	if inventoryBucket != "" {
+		fmt.Fprintf(w, "INVENTORY_LOCATION: s3://%s/%s (max age %s, live %s)\n", inventoryBucket, inventoryPrefix, inventoryMaxAge, strings.Join(inventoryLivePrefixes, ","))
+	}
+	fmt.Fprintln(w, "CACHE_DIR:", cacheDir)
+	fmt.Fprintln(w, "STATE_STORE:", state)
+	fmt.Fprintln(w, "PREFETCH:", prefetchNext)
+	fmt.Fprintln(w, "HLS_DIR:", hlsDir)
+	if zipDownloads {
+		fmt.Fprintf(w, "ZIP_DOWNLOADS: on (%s, max %d MB)\n", zipDir, zipMaxBytes>>20)
+	}
+	for _, cfg := range cacheLayerConfig {
+		if l := *cfg.dst; l != nil {
+			st := l.Stats()
+			fmt.Fprintf(w, "Cache layer %s: %s, %d MB, ttl %q\n", cfg.name, st.Backend, st.MaxBytes>>20, st.TTL)
+		} else {
+			fmt.Fprintf(w, "Cache layer %s: off\n", cfg.name)
+		}
+	}
+	fmt.Fprintln(w, "AUDIO_PATH_MODE:", audioPathMode)
+	fmt.Fprintln(w, "STREAM_POLICY:", os.Getenv("STREAM_POLICY"))
+	fmt.Fprintf(w, "LOUDNESS_SCAN: %t (target %g LUFS)\n", loudnessScan, loudnessTarget)
+	fmt.Fprintln(w, "TAG_SCAN:", tagScan)
+	if reportPeriod != "" {
+		fmt.Fprintf(w, "REPORT: %s at %s (SMTP %q to %s)\n", reportPeriod, reportAt, reportSMTP, strings.Join(reportTo, ","))
+	}
+	fmt.Fprintf(w, "FINGERPRINT_SCAN: %t (fpcalc %q, AcoustID lookups %t)\n", fingerprintScan, fpcalcPath, trackLookup != nil)
+	fmt.Fprintf(w, "MUSICBRAINZ_ENRICH: %t\n", metadataEnricher != nil)
+	fmt.Fprintln(w, "SORT_ORDER:", sortOrder)
+	fmt.Fprintln(w, "IGNORE_PATTERNS:", strings.Join(ignorePatterns, ","))
+	fmt.Fprintln(w, "SORT_LOCALE:", os.Getenv("SORT_LOCALE"))
+	fmt.Fprintln(w, "LISTEN_ADDR:", listenAddr)
+	fmt.Fprintf(w, "HTTP2: %s (ping %s)\n", http2Mode, http2Ping)
+	fmt.Fprintf(w, "Timeouts: read header %s, read %s, write %s, idle %s\n", readHeaderTimeout, readTimeout, writeTimeout, idleTimeout)
+	fmt.Fprintln(w, "SHUTDOWN_DRAIN:", shutdownDrain)
+	fmt.Fprintln(w, "COMPRESSION_LEVEL:", compressionLevel)
+	fmt.Fprintln(w, "AUDIT_LOG:", auditMode, auditDir)
+	fmt.Fprintln(w, "EXPORT:", exportMode, exportDir, exportFormat, exportInterval)
+	fmt.Fprintf(w, "TRASH_PREFIX: %q (purged after %d days)\n", trashPrefix, trashDays)
+	if userHomes {
+		fmt.Fprintf(w, "USER_HOMES: on (%s%s<user>/, shared %s)\n", s3Prefix, USER_HOMES_DIR, os.Getenv("USER_HOMES_SHARED"))
+	}
+	fmt.Fprintln(w, "BASIC_AUTH:", basicAuth)
+	if mpdListen != "" {
+		fmt.Fprintln(w, "MPD_LISTEN:", mpdListen, "(kiosk queue)")
+	}
+	if grpcListen != "" {
+		fmt.Fprintln(w, "GRPC_LISTEN:", grpcListen)
+	}
+	if jukeboxEnabled {
+		fmt.Fprintln(w, "JUKEBOX:", mpvPath, "(kiosk queue)")
+	}
+	if castEnabled {
+		if castURL != "" {
+			fmt.Fprintln(w, "CAST: streams from", castURL)
+		} else {
+			fmt.Fprintln(w, "CAST: streams from the requesting client's URL")
+		}
+	}
+	if dlnaEnabled {
+		if dlnaURL != "" {
+			fmt.Fprintf(w, "DLNA: %q at %s\n", dlnaName, dlnaURL)
+		} else {
+			fmt.Fprintf(w, "DLNA: %q on port %s\n", dlnaName, dlnaPort)
+		}
+	}
+	if folderACL != nil {
+		fmt.Fprintf(w, "FOLDER_ACL: %d rules (groups %s)\n", len(folderACL), os.Getenv("FOLDER_GROUPS"))
+	}
+	if oidcIssuer != "" {
+		fmt.Fprintf(w, "OIDC_ISSUER: %s (client %s, roles %s, sessions %s)\n", oidcIssuer, oidcClientID, os.Getenv("OIDC_ROLES"), oidcSessionAge)
+	}
+	if publicPrefixes != nil {
+		fmt.Fprintln(w, "PUBLIC_PREFIXES:", strings.Join(publicPrefixes, ","), "(guest mode)")
+	}
+	fmt.Fprintln(w, "BASE_PATH:", basePath)
+	fmt.Fprintln(w, "TRUSTED_PROXIES:", strings.Join(trustedProxies, ","))
+	fmt.Fprintln(w, "IP access:", ipFilterDescription())
+	fmt.Fprintln(w, "INDEX_IGNORED_ARTICLES:", strings.Join(indexIgnoredArticles, ","))
+	fmt.Fprintln(w, "STATIC_DIR:", staticDir)
+	fmt.Fprintln(w, "CONTENT_SECURITY_POLICY:", contentSecurityPolicy)
+	fmt.Fprintln(w, "CORS_ALLOWED_ORIGINS:", strings.Join(corsAllowedOrigins, ","), "credentials:", corsAllowCredentials)
+}
+
 // --- MAIN ---
 func main() {
-	if err := initS3(); err != nil {
-		log.Fatalf("S3 init error: %v", err)
-	}
-	fmt.Println("go-music build date: ", buildDate)
-	fmt.Println("go-music commit: ", commitHash)
-	fmt.Println("go-music version: ", version)
-	awsKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	awsSecret := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	awsKeyPrefix := ""
-	awsSecretPrefix := ""
-	if len(awsKey) >= 4 {
-		awsKeyPrefix = awsKey[:4]
-	}
-	if len(awsSecret) >= 4 {
-		awsSecretPrefix = awsSecret[:4]
-	}
-	fmt.Println("AWS_ACCESS_KEY_ID (first 4):", awsKeyPrefix)
-	fmt.Println("AWS_SECRET_ACCESS_KEY (first 4):", awsSecretPrefix)
-	fmt.Println("BUCKET:", s3Bucket)
-	fmt.Println("AWS_REGION:", s3Region)
-	fmt.Println("S3_PREFIX:", s3Prefix)
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "scan":
+		runScan(args)
+	case "check":
+		runCheck(args)
+	case "validate-config":
+		runValidateConfig(args)
+	case "migrate-state":
+		runMigrateState(args)
+	case "version":
+		runVersion(args)
+	case "help":
+		usage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", cmd)
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+}
+
+// runServe starts the HTTP server
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(&listenAddr, "listen", listenAddr, "listen address (LISTEN_ADDR)")
+	fs.StringVar(&staticDir, "static-dir", staticDir, "serve frontend files from this directory instead of the embedded copy (STATIC_DIR)")
+	fs.Parse(args)
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Tracing init error: %v", err)
+	}
+	if err := initConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initCache(); err != nil {
+		log.Fatalf("Cache init error: %v", err)
+	}
+	sseClients.attach(eventBus)
+	syncClients.attach(eventBus)
+	searchTelemetry.attach(eventBus)
+	webhooks.attach(eventBus)
+	recentErrors.attach(eventBus)
+	if err := collections.load(context.Background()); err != nil {
+		log.Printf("Failed to load collections: %v", err)
+	}
+	if err := playQueues.load(context.Background()); err != nil {
+		log.Printf("Failed to load play queues: %v", err)
+	}
+	if err := ratings.load(context.Background()); err != nil {
+		log.Printf("Failed to load ratings: %v", err)
+	}
+	if err := playlists.load(context.Background()); err != nil {
+		log.Printf("Failed to load playlists: %v", err)
+	}
+	if err := smartPlaylists.load(context.Background()); err != nil {
+		log.Printf("Failed to load smart playlists: %v", err)
+	}
+	if err := apiKeys.load(context.Background()); err != nil {
+		log.Printf("Failed to load API keys: %v", err)
+	}
+	if err := shares.load(context.Background()); err != nil {
+		log.Printf("Failed to load shares: %v", err)
+	}
+	if err := trims.load(context.Background()); err != nil {
+		log.Printf("Failed to load trims: %v", err)
+	}
+	if err := schedules.load(context.Background()); err != nil {
+		log.Printf("Failed to load schedules: %v", err)
+	}
+	if err := webhooks.load(context.Background()); err != nil {
+		log.Printf("Failed to load webhooks: %v", err)
+	}
+	if err := parties.load(context.Background()); err != nil {
+		log.Printf("Failed to load party sessions: %v", err)
+	}
+	if err := lastGoodIndex.load(context.Background()); err != nil {
+		log.Printf("Failed to load listings: %v", err)
+	}
+	if inventoryBucket != "" {
+		// Read before the first scans, which it saves walking the bucket
+		if err := inventory.load(context.Background()); err != nil {
+			log.Printf("Failed to load inventory, listing the bucket: %v", err)
+		}
+		go inventory.run(context.Background())
+	}
+	if reportPeriod != "" {
+		if err := history.load(context.Background()); err != nil {
+			log.Printf("Failed to load play history: %v", err)
+		}
+		history.attach(eventBus)
+		go history.run(context.Background())
+	}
+	go refreshState(context.Background())
+	go lastGoodIndex.run(context.Background())
+	go schedules.run(context.Background())
+	go manifest.run(context.Background())
+	go loudness.run(context.Background())
+	go tagsIndex.run(context.Background())
+	go fingerprints.run(context.Background())
+	go audit.run(context.Background())
+	go runExports(context.Background())
+	go runTrashPurge(context.Background())
+	go sweepHLS(context.Background())
+	if zipDownloads {
+		go sweepZips(context.Background())
+	}
+	if mpdListen != "" {
+		go runMPD(context.Background())
+	}
+	if dlnaEnabled {
+		go runDLNA(context.Background())
+	}
+	if castEnabled {
+		go runCastDiscovery(context.Background())
+	}
+	log.Printf("go-music %s (commit %s, built %s)", version, commitHash, buildDate)
+	printConfig(os.Stdout)
 
 	r := gin.Default()
+	if err := configureClientIP(r); err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	r.Use(IPFilter(), SecurityHeaders(), Tracing(), Drain(), S3Feature(), ValidatePath())
+	registerRoutes(r)
 
-	// --- Serve static files from the "static" directory ---
-	r.Static("/static", "./static")
-	r.GET("/", func(c *gin.Context) {
-		c.File("./static/index.html")
+	r.NoRoute(func(c *gin.Context) {
+		c.String(http.StatusNotFound, "Not found")
 	})
+	if grpcListen != "" {
+		go runGRPC(context.Background(), r)
+	}
+	if jukeboxEnabled {
+		go runJukebox(context.Background(), r)
+	}
 
-	r.Use(ResponseLogger())
+	err = runServer(r)
+	if auditMode == AUDIT_S3 {
+		audit.flush(context.Background())
+	}
+	shutdownTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+}
 
-	// API route
-	r.POST("/api", handleRequest)
+// registerRoutes adds every route of the server below BASE_PATH to r
+func registerRoutes(r *gin.Engine) {
+	base := r.Group(basePath)
 
-	// Serve audio files from S3
-	r.GET("/audio/*path", func(c *gin.Context) {
-		key := strings.TrimPrefix(c.Param("path"), "/")
-		body, size, contentType, err := s3GetAudioFile(key)
-		if err != nil {
-			log.Printf("S3 audio error: %v", err)
-			c.String(http.StatusNotFound, "Audio not found")
+	// --- Serve static files, embedded unless STATIC_DIR is set ---
+	staticFS := staticFileSystem()
+	base.StaticFS("/static", staticFS)
+	base.GET("/", func(c *gin.Context) {
+		if _, ok := homeUser(c); userHomes && !ok {
+			c.Redirect(http.StatusSeeOther, basePath+"/login")
 			return
 		}
-		defer body.Close()
-		c.DataFromReader(http.StatusOK, size, contentType, body, nil)
+		setCDNSignedCookies(c)
+		c.FileFromFS("/", staticFS) // directory request serves index.html
 	})
 
-	r.NoRoute(func(c *gin.Context) {
-		c.String(http.StatusNotFound, "Not found")
+	// Server-Sent Events, registered before the response logger so streams aren't buffered
+	base.GET("/events", LongLived(), APIKey(false), RequireHomeUser(), handleEvents)
+	base.GET("/ws", LongLived(), APIKey(false), RequireHomeUser(), handleSync)
+	base.GET("/remote", func(c *gin.Context) {
+		c.FileFromFS("remote.html", staticFS) // controls the user's other devices over /ws
 	})
 
-	r.Run(":8080")
+	base.Use(Compress(), ResponseLogger())
+
+	// API route
+	cors := CORS()
+	rateLimit := RateLimit()
+	base.POST("/api", cors, rateLimit, APIKey(false), Library(), handleRequest)
+	base.OPTIONS("/api", cors)
+
+	// Browser sign-in for USER_HOMES, FOLDER_ACL, guest mode and single sign-on
+	if userHomes || folderACL != nil || publicPrefixes != nil || oidcIssuer != "" {
+		base.GET("/login", func(c *gin.Context) {
+			c.FileFromFS("login.html", staticFS)
+		})
+		base.POST("/login", rateLimit, handleLogin)
+		base.POST("/logout", handleLogout)
+	}
+	if oidcIssuer != "" {
+		base.GET("/login/oidc", rateLimit, handleOIDCLogin)
+		base.GET("/login/oidc/callback", rateLimit, handleOIDCCallback)
+	}
+
+	// JSON API
+	apiV1 := base.Group("/api/v1", cors, rateLimit, APIKey(false))
+	apiV1.OPTIONS("/*path")
+	apiV1.GET("/capabilities", handleCapabilities)
+	apiV1.GET("/connectivity", handleConnectivity)
+	apiV1.GET("/diagnostics", RequireAdmin(), handleDiagnostics)
+	apiV1.GET("/tracks", LongLived(), Library(), handleStreamTracks)
+	apiV1.POST("/tracks/resolve", Library(), handleResolveTracksJSON)
+	apiV1.GET("/index", Library(), handleLetterIndex)
+	apiV1.GET("/ratings", Library(), handleListRatings)
+	apiV1.GET("/artists", Library(), handleListArtists)
+	apiV1.GET("/artists/:name", Library(), handleArtist)
+	apiV1.GET("/artists/:name/tracks", Library(), handleArtistTracks)
+	apiV1.GET("/rating/*path", Library(), handleGetRating)
+	apiV1.PUT("/rating/*path", Library(), handlePutRating)
+	apiV1.DELETE("/rating/*path", Library(), handleDeleteRating)
+	apiV1.GET("/playlists", RequireHomeUser(), handleListPlaylists)
+	apiV1.POST("/playlists/import", Library(), handleImportPlaylist)
+	apiV1.GET("/playlists/:name", RequireHomeUser(), handleGetPlaylist)
+	apiV1.DELETE("/playlists/:name", RequireHomeUser(), handleDeletePlaylist)
+	apiV1.GET("/queue", RequireHomeUser(), handleGetQueue)
+	apiV1.POST("/queue", Library(), handleQueueAdd)
+	apiV1.DELETE("/queue", RequireHomeUser(), handleQueueClear)
+	apiV1.DELETE("/queue/:index", RequireHomeUser(), handleQueueRemove)
+	apiV1.POST("/queue/move", RequireHomeUser(), handleQueueMove)
+	apiV1.POST("/queue/next", RequireHomeUser(), handleQueueNext)
+	apiV1.POST("/party", RequireHomeUser(), handleCreateParty)
+	apiV1.GET("/party/:code", RequireHomeUser(), handleGetParty)
+	apiV1.POST("/party/:code/join", RequireHomeUser(), handleJoinParty)
+	apiV1.POST("/party/:code/leave", RequireHomeUser(), handleLeaveParty)
+	apiV1.POST("/party/:code/queue", Library(), handlePartyAdd)
+	apiV1.DELETE("/party/:code/queue/:index", RequireHomeUser(), handlePartyRemove)
+	apiV1.POST("/party/:code/playback", RequireHomeUser(), handlePartyPlayback)
+	apiV1.GET("/cast", RequireCast(), handleListCastDevices)
+	apiV1.GET("/cast/:device", RequireCast(), handleCastStatus)
+	apiV1.POST("/cast/:device/load", RequireCast(), Library(), handleCastLoad)
+	apiV1.POST("/cast/:device/control", RequireCast(), handleCastControl)
+	apiV1.GET("/openapi.json", handleOpenAPI)
+	apiV1.GET("/library.proto", handleGRPCProto)
+	apiV1.GET("/docs", handleAPIDocs)
+
+	// GraphQL queries over libraries, folders, tracks, search and playlists
+	base.GET("/graphql", cors, rateLimit, APIKey(false), handleGraphQL)
+	base.POST("/graphql", cors, rateLimit, APIKey(false), handleGraphQL)
+	base.OPTIONS("/graphql", cors)
+
+	// Serve audio files from S3
+	base.GET("/audio/*path", cors, APIKey(true), LongLived(), StreamLimit(), Library(), handleAudio)
+	base.OPTIONS("/audio/*path", cors)
+	base.GET("/hls/*path", cors, APIKey(true), Library(), handleHLS)
+	base.GET("/artwork/*path", cors, APIKey(false), Library(), handleArtwork)
+	base.GET("/podcast/*path", cors, APIKey(false), Library(), handlePodcast)
+	base.GET("/zip/*path", cors, APIKey(true), LongLived(), StreamLimit(), Library(), handleZip)
+	base.GET("/lyrics/*path", cors, APIKey(false), Library(), handleLyrics)
+	base.GET("/waveform/*path", cors, APIKey(false), Library(), handleWaveform)
+	base.OPTIONS("/hls/*path", cors)
+
+	// UPnP MediaServer for renderers on the LAN, enabled by DLNA
+	dlnaGroup := base.Group("/dlna", RequireDLNA())
+	dlnaGroup.GET("/device.xml", handleDLNADevice)
+	dlnaGroup.GET("/ContentDirectory.xml", handleDLNAService(contentDirectoryActions, contentDirectoryVars))
+	dlnaGroup.GET("/ConnectionManager.xml", handleDLNAService(connectionManagerActions, connectionManagerVars))
+	dlnaGroup.POST("/control/:service", handleDLNAControl)
+	dlnaGroup.Handle("SUBSCRIBE", "/event/:service", handleDLNASubscribe)
+	dlnaGroup.Handle("UNSUBSCRIBE", "/event/:service", handleDLNASubscribe)
+
+	// Share links, enabled by SHARE_SECRET
+	shareGroup := base.Group("/share", RequireShares(), cors)
+	shareGroup.GET("/:token", LongLived(), StreamLimit(), handleShare)
+	shareGroup.GET("/:token/*path", LongLived(), StreamLimit(), handleShareTrack)
+	base.GET("/embed/:token", RequireShares(), handleEmbed)
+	base.GET("/oembed", RequireShares(), cors, handleOEmbed)
+
+	// Public jukebox, enabled by KIOSK_MODE
+	kioskGroup := base.Group("/kiosk", RequireKiosk())
+	kioskGroup.GET("/", func(c *gin.Context) {
+		c.FileFromFS("kiosk.html", staticFS) // big-screen player, relative to /kiosk/
+	})
+	kioskGroup.GET("/queue", handleKioskQueue)
+	kioskGroup.POST("/queue", rateLimit, Library(), handleKioskEnqueue)
+	kioskGroup.POST("/next", RequireAdmin(), handleKioskNext)
+	kioskGroup.POST("/play", RequireAdmin(), handleKioskPlay)
+	kioskGroup.POST("/pause", RequireAdmin(), handleKioskPause)
+	kioskGroup.POST("/volume", RequireAdmin(), handleKioskVolume)
+
+	// Continuous stations, configured by RADIO_STATIONS
+	base.GET("/radio/:station", cors, APIKey(true), LongLived(), StreamLimit(), handleRadio)
+
+	// Metrics and admin routes
+	base.GET("/metrics", RequireMetrics(), handleMetrics)
+	admin := base.Group("/admin", RequireAdmin())
+	admin.POST("/cache/purge", handleCachePurge)
+	admin.GET("/cache/layers", handleCacheLayers)
+	admin.PUT("/cache/layers/:name", handleSetCacheLayer)
+	admin.GET("/search/zero-results", handleZeroResultQueries)
+	admin.DELETE("/search/zero-results", handleZeroResultQueriesReset)
+	admin.PUT("/collections/:name", handlePutCollection)
+	admin.DELETE("/collections/:name", handleDeleteCollection)
+	admin.GET("/smart-playlists", handleListSmartPlaylists)
+	admin.PUT("/smart-playlists/:name", handlePutSmartPlaylist)
+	admin.DELETE("/smart-playlists/:name", handleDeleteSmartPlaylist)
+	admin.GET("/shares", RequireShares(), handleListShares)
+	admin.POST("/shares", RequireShares(), handleCreateShare)
+	admin.DELETE("/shares/:id", RequireShares(), handleRevokeShare)
+	admin.POST("/manifest/scan", handleManifestScan)
+	admin.POST("/loudness/scan", handleLoudnessScan)
+	admin.POST("/tags/scan", handleTagScan)
+	admin.POST("/fingerprints/scan", handleFingerprintScan)
+	admin.GET("/parties", handleListParties)
+	admin.GET("/report", handleReport)
+	admin.POST("/report/send", handleSendReport)
+	admin.GET("/fingerprints", handleListIdentified)
+	admin.POST("/identify/*path", handleIdentifyTrack)
+	admin.PUT("/identify/*path", handleCorrectTrack)
+	admin.DELETE("/identify/*path", handleDeleteCorrection)
+	admin.GET("/health", handleLibraryHealth)
+	admin.GET("/check", handleLibraryCheck)
+	admin.GET("/normalize", handleNormalizeReport)
+	admin.POST("/normalize", handleNormalizeApply)
+	admin.POST("/import", handleImport)
+	admin.GET("/duplicates", handleDuplicateReport)
+	admin.POST("/duplicates/delete", handleDuplicateDelete)
+	admin.GET("/uploads", handleListUploads)
+	admin.POST("/uploads", handleCreateUpload)
+	admin.GET("/uploads/:token", handleGetUpload)
+	admin.PUT("/uploads/:token/parts/:number", LongLived(), handleUploadPart)
+	admin.POST("/uploads/:token/complete", handleCompleteUpload)
+	admin.DELETE("/uploads/:token", handleAbortUpload)
+	admin.GET("/trash", handleListTrash)
+	admin.POST("/trash/restore", handleRestoreTrash)
+	admin.POST("/trash/purge", handlePurgeTrash)
+	admin.GET("/trims", handleListTrims)
+	admin.PUT("/trims/*path", handlePutTrim)
+	admin.DELETE("/trims/*path", handleDeleteTrim)
+	admin.GET("/audit", handleAuditLog)
+	admin.GET("/export", LongLived(), handleExport)
+	admin.GET("/api-keys", handleListAPIKeys)
+	admin.POST("/api-keys", handleCreateAPIKey)
+	admin.DELETE("/api-keys/:id", handleRevokeAPIKey)
+	admin.GET("/schedules", handleListSchedules)
+	admin.PUT("/schedules/:name", handlePutSchedule)
+	admin.DELETE("/schedules/:name", handleDeleteSchedule)
+	admin.GET("/dashboard", handleDashboard)
+	admin.GET("/streams", handleListStreams)
+	admin.DELETE("/streams/:id", handleDisconnectStream)
+	admin.GET("/webhooks", handleListWebhooks)
+	admin.PUT("/webhooks/:name", handlePutWebhook)
+	admin.DELETE("/webhooks/:name", handleDeleteWebhook)
+	admin.POST("/webhooks/:name/test", handleTestWebhook)
 }
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const (
+	DEFAULT_S3_MAX_ATTEMPTS   = 5
+	DEFAULT_S3_MAX_BACKOFF    = 20 * time.Second
+	DEFAULT_BREAKER_THRESHOLD = 5 // consecutive failed operations that open the breaker
+	DEFAULT_BREAKER_COOLDOWN  = 30 * time.Second
+	MAX_STALE_INDEX_ENTRIES   = 2000
+	STALE_INDEX_LOG_INTERVAL  = time.Minute
+	STALE_INDEX_OBJECT        = "listings.json"
+	STALE_INDEX_SAVE_INTERVAL = 5 * time.Minute
+)
+
+var (
+	s3MaxAttempts    = DEFAULT_S3_MAX_ATTEMPTS
+	s3MaxBackoff     = DEFAULT_S3_MAX_BACKOFF
+	breakerThreshold = DEFAULT_BREAKER_THRESHOLD
+	breakerCooldown  = DEFAULT_BREAKER_COOLDOWN
+)
+
+// errS3Unavailable is returned without calling S3 while the circuit breaker is open
+var errS3Unavailable = errors.New("S3 is unavailable, circuit breaker open")
+
+// s3ThrottleCodes are the error codes of a throttled or overloaded S3
+var s3ThrottleCodes = map[string]bool{"SlowDown": true, "ServiceUnavailable": true, "Throttling": true, "ThrottlingException": true, "RequestTimeout": true, "InternalError": true}
+
+func initS3Resilience() error {
+	if v := os.Getenv("S3_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid S3_MAX_ATTEMPTS: %q", v)
+		}
+		s3MaxAttempts = n
+	}
+	if v := os.Getenv("S3_MAX_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid S3_MAX_BACKOFF: %q", v)
+		}
+		s3MaxBackoff = d
+	}
+	if v := os.Getenv("S3_BREAKER_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid S3_BREAKER_THRESHOLD: %q, 0 disables the breaker", v)
+		}
+		breakerThreshold = n
+	}
+	if v := os.Getenv("S3_BREAKER_COOLDOWN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid S3_BREAKER_COOLDOWN: %q", v)
+		}
+		breakerCooldown = d
+	}
+	return nil
+}
+
+// s3Retryer retries throttling, 5xx and network errors with jittered exponential
+// backoff. AWS_MAX_ATTEMPTS, when set, wins over S3_MAX_ATTEMPTS.
+func s3Retryer(cfg *aws.Config) {
+	attempts := s3MaxAttempts
+	if cfg.RetryMaxAttempts > 0 {
+		attempts = cfg.RetryMaxAttempts
+	}
+	cfg.Retryer = func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = attempts
+			o.MaxBackoff = s3MaxBackoff
+		})
+	}
+}
+
+// s3Degraded reports whether err says S3 is unreachable or overloaded, rather than
+// answering about the request itself
+func s3Degraded(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, errS3Unavailable) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && s3ThrottleCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() != 0 {
+		return respErr.HTTPStatusCode() >= http.StatusInternalServerError
+	}
+	return classifyS3Error(err) == S3_STATUS_NETWORK || classifyS3Error(err) == S3_STATUS_DNS
+}
+
+// circuitBreaker stops calling S3 after repeated degraded failures, and lets a single
+// probe through once the cooldown has passed
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero when closed
+	probing  bool
+	rejected int64
+}
+
+var s3Breaker = &circuitBreaker{}
+
+// allow reports whether an operation may call S3, and whether it is the half-open probe
+func (b *circuitBreaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true, false
+	}
+	if !b.probing && time.Since(b.openedAt) >= breakerCooldown {
+		b.probing = true
+		return true, true
+	}
+	b.rejected++
+	return false, false
+}
+
+func (b *circuitBreaker) record(err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if errors.Is(err, context.Canceled) {
+		return // says nothing about S3
+	}
+	if !s3Degraded(err) {
+		if !b.openedAt.IsZero() {
+			log.Printf("S3 circuit breaker closed after rejecting %d operations", b.rejected)
+		}
+		b.failures, b.openedAt, b.rejected = 0, time.Time{}, 0
+		return
+	}
+	b.failures++
+	if probe {
+		b.openedAt = time.Now() // still failing, wait another cooldown
+		return
+	}
+	if b.openedAt.IsZero() && b.failures >= breakerThreshold {
+		b.openedAt = time.Now()
+		log.Printf("S3 circuit breaker open for %s after %d failed operations: %v", breakerCooldown, b.failures, err)
+	}
+}
+
+// state describes the breaker for diagnostics
+func (b *circuitBreaker) state() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case breakerThreshold == 0:
+		return "disabled"
+	case b.openedAt.IsZero():
+		return "closed"
+	case b.probing:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// addCircuitBreakerMiddleware wraps every S3 operation, including its retries, in the breaker
+func addCircuitBreakerMiddleware(stack *middleware.Stack) error {
+	if breakerThreshold == 0 {
+		return nil
+	}
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("GoMusicCircuitBreaker",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			ok, probe := s3Breaker.allow()
+			if !ok {
+				return middleware.InitializeOutput{}, middleware.Metadata{}, errS3Unavailable
+			}
+			out, md, err := next.HandleInitialize(ctx, in)
+			s3Breaker.record(err, probe)
+			return out, md, err
+		}), middleware.Before)
+}
+
+// staleIndex keeps the last successful listings, served while S3 is degraded. Unlike
+// the listing cache it has no TTL; entries are only replaced by newer listings. With a
+// STATE_STORE other than the bucket, which a degraded S3 takes down with it, they are
+// saved there and read at startup, so a restart during an outage still has them.
+type staleIndex struct {
+	mu      sync.Mutex
+	entries map[string]json.RawMessage
+	dirty   bool // changed since the last save
+	lastLog time.Time
+}
+
+var lastGoodIndex = &staleIndex{entries: make(map[string]json.RawMessage)}
+
+func (s *staleIndex) remember(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytes.Equal(s.entries[key], data) {
+		return
+	}
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= MAX_STALE_INDEX_ENTRIES {
+		for k := range s.entries { // drop an arbitrary entry
+			delete(s.entries, k)
+			break
+		}
+	}
+	s.entries[key] = data
+	s.dirty = true
+}
+
+// recall decodes the last good listing for key into v when err says S3 is degraded
+func (s *staleIndex) recall(key string, err error, v interface{}) bool {
+	if !s3Degraded(err) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.entries[key]
+	if !ok || json.Unmarshal(data, v) != nil {
+		return false
+	}
+	if time.Since(s.lastLog) > STALE_INDEX_LOG_INTERVAL {
+		s.lastLog = time.Now()
+		log.Printf("S3 degraded, serving stale listings: %v", err)
+	}
+	return true
+}
+
+// persisted reports whether the listings are saved, which needs a store besides the bucket
+func (s *staleIndex) persisted() bool {
+	_, inBucket := state.(bucketState)
+	return !inBucket
+}
+
+// load reads the saved listings; a missing object means none were saved yet. Listings
+// made since startup are newer and stay.
+func (s *staleIndex) load(ctx context.Context) error {
+	if !s.persisted() {
+		return nil
+	}
+	entries := make(map[string]json.RawMessage)
+	if err := s3GetJSON(ctx, STALE_INDEX_OBJECT, &entries); err != nil {
+		if isNoSuchKey(err) {
+			return nil
+		}
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range entries {
+		if _, ok := s.entries[k]; !ok && len(s.entries) < MAX_STALE_INDEX_ENTRIES {
+			s.entries[k] = v
+		}
+	}
+	return nil
+}
+
+// save writes the listings if they changed
+func (s *staleIndex) save(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	entries := make(map[string]json.RawMessage, len(s.entries))
+	for k, v := range s.entries {
+		entries[k] = v
+	}
+	s.dirty = false
+	s.mu.Unlock()
+	if err := s3PutJSON(ctx, STALE_INDEX_OBJECT, entries); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// run saves the listings every STALE_INDEX_SAVE_INTERVAL until ctx is cancelled
+func (s *staleIndex) run(ctx context.Context) {
+	if !s.persisted() {
+		return
+	}
+	ticker := time.NewTicker(STALE_INDEX_SAVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.save(ctx); err != nil {
+				log.Printf("Listings save error: %v", err)
+			}
+		}
+	}
+}
+
+const (
+	MAX_STREAM_RESUMES  = 3 // ranged re-requests per object body
+	STREAM_RESUME_DELAY = 500 * time.Millisecond
+)
+
+// resumableBody reads an object body and, when the connection breaks, continues with a
+// ranged GetObject from the last delivered byte. If-Match pins the resumed request to the
+// same object version, so a re-upload mid-stream fails cleanly instead of splicing files.
+type resumableBody struct {
+	ctx     context.Context
+	bucket  string
+	key     string
+	etag    string
+	body    io.ReadCloser
+	offset  int64 // bytes delivered so far
+	size    int64
+	resumes int
+}
+
+func newResumableBody(ctx context.Context, bucket, key, etag string, body io.ReadCloser, size int64) io.ReadCloser {
+	if etag == "" || size <= 0 {
+		return body
+	}
+	return &resumableBody{ctx: ctx, bucket: bucket, key: key, etag: etag, body: body, size: size}
+}
+
+func (r *resumableBody) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == nil || r.offset >= r.size {
+		return n, err
+	}
+	if r.ctx.Err() != nil || r.resumes >= MAX_STREAM_RESUMES {
+		return n, err
+	}
+	// The body ended early or broke; the bytes read so far are still delivered
+	if rerr := r.resume(err); rerr != nil {
+		return n, err
+	}
+	if n == 0 {
+		return r.Read(p)
+	}
+	return n, nil
+}
+
+func (r *resumableBody) resume(cause error) error {
+	r.body.Close()
+	for r.resumes < MAX_STREAM_RESUMES {
+		r.resumes++
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-time.After(STREAM_RESUME_DELAY * time.Duration(r.resumes)):
+		}
+		resp, err := s3Client.GetObject(r.ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(r.bucket),
+			Key:     aws.String(r.key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+			IfMatch: aws.String(r.etag),
+		})
+		if err != nil {
+			log.Printf("Resuming %s at byte %d failed: %v", r.key, r.offset, err)
+			if !s3Degraded(err) {
+				break // changed or deleted object, retrying won't help
+			}
+			continue
+		}
+		log.Printf("Resumed %s at byte %d after: %v", r.key, r.offset, cause)
+		r.body = resp.Body
+		return nil
+	}
+	r.resumes = MAX_STREAM_RESUMES
+	r.body = io.NopCloser(strings.NewReader(""))
+	return cause
+}
+
+func (r *resumableBody) Close() error {
+	return r.body.Close()
+}
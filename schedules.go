@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SCHEDULES_OBJECT = "schedules.json"
+	SCHEDULE_TICK    = 20 * time.Second
+
+	SCHEDULE_PLAY    = "play"    // queue the tracks of Folder or Collection, sent as a JSON list
+	SCHEDULE_FADEOUT = "fadeout" // fade to silence over FadeSeconds, then stop
+	SCHEDULE_STOP    = "stop"
+)
+
+var scheduleTimeRe = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+var scheduleDays = map[string]bool{"sun": true, "mon": true, "tue": true, "wed": true, "thu": true, "fri": true, "sat": true}
+
+// SCHEDULE_TZ is the time zone schedule times are given in, the server's local zone by default
+var scheduleLocation = time.Local
+
+func initScheduleLocation() error {
+	if v := os.Getenv("SCHEDULE_TZ"); v != "" {
+		loc, err := time.LoadLocation(v)
+		if err != nil {
+			return fmt.Errorf("invalid SCHEDULE_TZ: %w", err)
+		}
+		scheduleLocation = loc
+	}
+	return nil
+}
+
+// schedule triggers a playback action on the devices with a given name at a time of day
+type schedule struct {
+	Name        string   `json:"name"`
+	At          string   `json:"at"`             // "HH:MM" in SCHEDULE_TZ
+	Days        []string `json:"days,omitempty"` // "mon".."sun", every day when empty
+	Device      string   `json:"device"`         // registered device name
+	Action      string   `json:"action"`
+	Library     string   `json:"library,omitempty"`
+	Folder      string   `json:"folder,omitempty"`
+	Collection  string   `json:"collection,omitempty"`
+	FadeSeconds int      `json:"fadeSeconds,omitempty"`
+}
+
+// validate normalizes a schedule and reports what is wrong with it
+func (s *schedule) validate() error {
+	if !scheduleTimeRe.MatchString(s.At) {
+		return fmt.Errorf("at must be HH:MM")
+	}
+	for i, d := range s.Days {
+		d = strings.ToLower(d)
+		if len(d) > 3 {
+			d = d[:3]
+		}
+		if !scheduleDays[d] {
+			return fmt.Errorf("unknown day %q", s.Days[i])
+		}
+		s.Days[i] = d
+	}
+	if strings.TrimSpace(s.Device) == "" {
+		return fmt.Errorf("device required")
+	}
+	if findLibrary(s.Library) == nil {
+		return fmt.Errorf("unknown library")
+	}
+	switch s.Action {
+	case SCHEDULE_PLAY:
+		if (s.Folder == "") == (s.Collection == "") {
+			return fmt.Errorf("play needs either folder or collection")
+		}
+		if s.Folder != "" {
+			s.Folder = strings.Trim(s.Folder, "/") + "/"
+		}
+	case SCHEDULE_FADEOUT:
+		if s.FadeSeconds <= 0 {
+			s.FadeSeconds = 30
+		}
+	case SCHEDULE_STOP:
+	default:
+		return fmt.Errorf("action must be play, fadeout or stop")
+	}
+	return nil
+}
+
+// due reports whether the schedule fires in the minute containing now
+func (s *schedule) due(now time.Time) bool {
+	if now.Format("15:04") != s.At {
+		return false
+	}
+	if len(s.Days) == 0 {
+		return true
+	}
+	today := strings.ToLower(now.Weekday().String()[:3])
+	for _, d := range s.Days {
+		if d == today {
+			return true
+		}
+	}
+	return false
+}
+
+type scheduleStore struct {
+	mu        sync.Mutex
+	schedules map[string]*schedule
+	fired     map[string]string // schedule name -> minute it last fired
+	doc       stateDoc
+}
+
+var schedules = &scheduleStore{schedules: make(map[string]*schedule), fired: make(map[string]string), doc: stateDoc{name: SCHEDULES_OBJECT}}
+
+// load reads the schedules object from the state store; a missing object means no schedules.
+// Every instance fires the schedules, each to the devices connected to it.
+func (ss *scheduleStore) load(ctx context.Context) error {
+	return ss.doc.load(ctx, &ss.mu, ss)
+}
+
+func (ss *scheduleStore) decode(data []byte) error {
+	var list []schedule
+	if data != nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	ss.schedules = make(map[string]*schedule, len(list))
+	for i := range list {
+		ss.schedules[list[i].Name] = &list[i]
+	}
+	return nil
+}
+
+func (ss *scheduleStore) encode() (interface{}, error) {
+	return ss.listLocked(), nil
+}
+
+func (ss *scheduleStore) listLocked() []schedule {
+	out := make([]schedule, 0, len(ss.schedules))
+	for _, s := range ss.schedules {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (ss *scheduleStore) list() []schedule {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.listLocked()
+}
+
+func (ss *scheduleStore) put(ctx context.Context, s schedule) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.doc.update(ctx, ss, func() bool {
+		s := s
+		ss.schedules[s.Name] = &s
+		return true
+	})
+}
+
+func (ss *scheduleStore) remove(ctx context.Context, name string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	found := false
+	err := ss.doc.update(ctx, ss, func() bool {
+		_, found = ss.schedules[name]
+		delete(ss.schedules, name)
+		return found
+	})
+	return found, err
+}
+
+// run fires due schedules until ctx is cancelled
+func (ss *scheduleStore) run(ctx context.Context) {
+	ticker := time.NewTicker(SCHEDULE_TICK)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			now = now.In(scheduleLocation)
+			minute := now.Format("2006-01-02 15:04")
+			var due []schedule
+			ss.mu.Lock()
+			for _, s := range ss.schedules {
+				if s.due(now) && ss.fired[s.Name] != minute {
+					ss.fired[s.Name] = minute
+					due = append(due, *s)
+				}
+			}
+			ss.mu.Unlock()
+			for _, s := range due {
+				s.fire(ctx)
+			}
+		}
+	}
+}
+
+// fire sends the schedule's command to every registered device with the target name
+func (s schedule) fire(ctx context.Context) {
+	cmd := deviceCommand{From: "schedule:" + s.Name, Command: s.Action}
+	switch s.Action {
+	case SCHEDULE_PLAY:
+		tracks, err := s.tracks(withLibrary(ctx, findLibrary(s.Library)))
+		if err != nil {
+			log.Printf("Schedule %s: failed to list tracks: %v", s.Name, err)
+			return
+		}
+		data, _ := json.Marshal(tracks)
+		cmd.Arg = string(data)
+	case SCHEDULE_FADEOUT:
+		cmd.Arg = strconv.Itoa(s.FadeSeconds)
+	}
+	sent := devices.broadcast(s.Device, cmd)
+	log.Printf("Schedule %s: %s sent to %d device(s) named %q", s.Name, s.Action, sent, s.Device)
+}
+
+// tracks resolves the folder or collection of a play schedule
+func (s schedule) tracks(ctx context.Context) ([]string, error) {
+	if s.Folder != "" {
+		files, err := s3ListAllAudioFiles(ctx, s.Folder)
+		sortNames(files)
+		return files, err
+	}
+	col, ok := collections.get(s.Collection)
+	if !ok {
+		return nil, fmt.Errorf("unknown collection %q", s.Collection)
+	}
+	return collectionTracks(ctx, col)
+}
+
+// --- SCHEDULE HANDLERS ---
+
+// handleListSchedules lists the schedules (GET /admin/schedules)
+func handleListSchedules(c *gin.Context) {
+	c.JSON(http.StatusOK, schedules.list())
+}
+
+// handlePutSchedule creates or replaces a schedule (PUT /admin/schedules/:name)
+func handlePutSchedule(c *gin.Context) {
+	var s schedule
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid schedule"})
+		return
+	}
+	s.Name = c.Param("name")
+	if err := s.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := schedules.put(c.Request.Context(), s); err != nil {
+		log.Printf("Schedule save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save schedules"})
+		return
+	}
+	audit.record(c, "schedule.put", "", s.Name, "")
+	c.JSON(http.StatusOK, s)
+}
+
+// handleDeleteSchedule removes a schedule (DELETE /admin/schedules/:name)
+func handleDeleteSchedule(c *gin.Context) {
+	found, err := schedules.remove(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		log.Printf("Schedule save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save schedules"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown schedule"})
+		return
+	}
+	audit.record(c, "schedule.delete", "", c.Param("name"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
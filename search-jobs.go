@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_SEARCH_TIMEOUT = 10 * time.Second // bound for synchronous searches
+	SEARCH_JOB_TIMEOUT     = 5 * time.Minute  // bound for background searches
+	SEARCH_JOB_TTL         = 10 * time.Minute // finished jobs are kept this long for polling
+	MAX_RUNNING_SEARCHES   = 4                // concurrent background searches
+
+	SEARCH_JOB_RUNNING = "running"
+	SEARCH_JOB_DONE    = "done"
+	SEARCH_JOB_FAILED  = "failed"
+)
+
+// SEARCH_TIMEOUT bounds synchronous searchTitle/searchDir calls
+var searchTimeout = DEFAULT_SEARCH_TIMEOUT
+
+func initSearchTimeout() error {
+	if v := os.Getenv("SEARCH_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid SEARCH_TIMEOUT: %q", v)
+		}
+		searchTimeout = d
+	}
+	return nil
+}
+
+// searchJob is a background search whose results are fetched by ID
+type searchJob struct {
+	id       string
+	status   string
+	err      string
+	results  []string
+	finished time.Time
+}
+
+type searchJobStore struct {
+	mu      sync.Mutex
+	jobs    map[string]*searchJob
+	running int
+}
+
+var searchJobs = &searchJobStore{jobs: make(map[string]*searchJob)}
+
+func newSearchJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// expireLocked drops finished jobs nobody fetched within SEARCH_JOB_TTL
+func (s *searchJobStore) expireLocked() {
+	for id, job := range s.jobs {
+		if job.status != SEARCH_JOB_RUNNING && time.Since(job.finished) > SEARCH_JOB_TTL {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// start runs a search of kind "title" or "dir" in the background and returns its job ID.
+// The job outlives the request but keeps its library, folder access and S3 feature.
+func (s *searchJobStore) start(ctx context.Context, kind, query string, match func(string) bool, order listingOrder) (string, error) {
+	s.mu.Lock()
+	s.expireLocked()
+	if s.running >= MAX_RUNNING_SEARCHES {
+		s.mu.Unlock()
+		return "", fmt.Errorf("too many searches running, try again later")
+	}
+	job := &searchJob{id: newSearchJobID(), status: SEARCH_JOB_RUNNING}
+	s.jobs[job.id] = job
+	s.running++
+	s.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), SEARCH_JOB_TIMEOUT)
+		defer cancel()
+		var results []string
+		var err error
+		if kind == "dir" {
+			results, err = s3SearchDirs(ctx, match)
+			order.sortDirs(results)
+		} else {
+			results, err = s3SearchFiles(ctx, match)
+			order.sortTracks(ctx, "", results)
+		}
+
+		s.mu.Lock()
+		s.running--
+		job.finished = time.Now()
+		if err != nil {
+			log.Printf("Search job %s failed: %v", job.id, err)
+			job.status, job.err = SEARCH_JOB_FAILED, "Search failed"
+		} else {
+			job.status, job.results = SEARCH_JOB_DONE, results
+		}
+		status := job.status
+		s.mu.Unlock()
+
+		if err == nil {
+			eventBus.Publish(EVENT_SEARCH, map[string]interface{}{"kind": kind, "query": query, "count": len(results)})
+		}
+		// Only the random job ID is broadcast, never the query
+		eventBus.Publish(EVENT_SEARCH_JOB, map[string]interface{}{"id": job.id, "status": status, "count": len(results)})
+	}()
+	return job.id, nil
+}
+
+// get returns a snapshot of a job
+func (s *searchJobStore) get(id string) (searchJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	job, ok := s.jobs[id]
+	if !ok {
+		return searchJob{}, false
+	}
+	return *job, true
+}
+
+// handleSearchAsync starts a background search; data is {"kind":"title"|"dir","query":"...","regex":bool}
+func handleSearchAsync(c *gin.Context, data string) {
+	var req struct {
+		Kind  string `json:"kind"`
+		Query string `json:"query"`
+		Mode  string `json:"mode"`
+		Regex bool   `json:"regex"` // same as "mode":"regex"
+	}
+	if err := json.Unmarshal([]byte(data), &req); err != nil || (req.Kind != "title" && req.Kind != "dir") {
+		echoReqHtml(c, []interface{}{"error", "Invalid search request"}, "getSearchJob")
+		return
+	}
+	req.Query = strings.TrimSpace(req.Query)
+	if len(req.Query) < MIN_SEARCH_STR {
+		echoReqHtml(c, []interface{}{"error", msg(c, MSG_MIN_SEARCH, MIN_SEARCH_STR)}, "getSearchJob")
+		return
+	}
+	if req.Regex && req.Mode == "" {
+		req.Mode = SEARCH_MODE_REGEX
+	}
+	match, err := searchMatcher(req.Query, req.Mode)
+	if err != nil {
+		echoReqHtml(c, []interface{}{"error", "Invalid search pattern: " + err.Error()}, "getSearchJob")
+		return
+	}
+	if !guardWalk(c, "getSearchJob") {
+		return
+	}
+	id, err := searchJobs.start(c.Request.Context(), req.Kind, req.Query, match, requestOrder(c))
+	if err != nil {
+		echoReqHtml(c, []interface{}{"error", err.Error()}, "getSearchJob")
+		return
+	}
+	echoReqHtml(c, []interface{}{"ok", id}, "getSearchJob")
+}
+
+// handleSearchJob reports a background search: status, a page of results and the page info
+func handleSearchJob(c *gin.Context, id string) {
+	job, ok := searchJobs.get(id)
+	if !ok {
+		echoReqHtml(c, []interface{}{"error", "Unknown search job"}, "getSearchJobData")
+		return
+	}
+	switch job.status {
+	case SEARCH_JOB_RUNNING:
+		echoReqHtml(c, []interface{}{"ok", job.status, []string{}}, "getSearchJobData")
+	case SEARCH_JOB_FAILED:
+		echoReqHtml(c, []interface{}{"error", job.err, []string{}}, "getSearchJobData")
+	default:
+		results, page := paginate(c, job.results, maxSearchResult)
+		echoReqHtml(c, []interface{}{"ok", job.status, results, page}, "getSearchJobData")
+	}
+}
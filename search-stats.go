@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MAX_ZERO_RESULT_QUERIES = 1000 // distinct queries kept before the oldest are dropped
+
+// zeroResultQuery aggregates repeated searches that found nothing
+type zeroResultQuery struct {
+	Query     string    `json:"query"`
+	Kind      string    `json:"kind"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type searchStats struct {
+	mu          sync.Mutex
+	zeroResults map[string]*zeroResultQuery
+}
+
+var searchTelemetry = &searchStats{zeroResults: make(map[string]*zeroResultQuery)}
+
+// attach records searches without matches published on the bus
+func (s *searchStats) attach(bus *EventBus) {
+	bus.Subscribe("search-stats", EVENT_SEARCH, func(ev Event) {
+		count, _ := ev.Data["count"].(int)
+		kind, _ := ev.Data["kind"].(string)
+		query, _ := ev.Data["query"].(string)
+		if count == 0 {
+			s.recordZeroResult(kind, query)
+		}
+	})
+}
+
+// recordZeroResult counts a search of the given kind ("title" or "dir") without matches
+func (s *searchStats) recordZeroResult(kind, query string) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	key := kind + "\x00" + query
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.zeroResults[key]; ok {
+		q.Count++
+		q.LastSeen = now
+		return
+	}
+	if len(s.zeroResults) >= MAX_ZERO_RESULT_QUERIES {
+		var oldestKey string
+		var oldest time.Time
+		for k, q := range s.zeroResults {
+			if oldestKey == "" || q.LastSeen.Before(oldest) {
+				oldestKey, oldest = k, q.LastSeen
+			}
+		}
+		delete(s.zeroResults, oldestKey)
+	}
+	s.zeroResults[key] = &zeroResultQuery{Query: query, Kind: kind, Count: 1, FirstSeen: now, LastSeen: now}
+}
+
+// zeroResultQueries returns the recorded queries, most frequent first
+func (s *searchStats) zeroResultQueries() []zeroResultQuery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]zeroResultQuery, 0, len(s.zeroResults))
+	for _, q := range s.zeroResults {
+		out = append(out, *q)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].LastSeen.After(out[j].LastSeen)
+	})
+	return out
+}
+
+// handleZeroResultQueries lists searches that returned no results
+func handleZeroResultQueries(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"queries": searchTelemetry.zeroResultQueries()})
+}
+
+// handleZeroResultQueriesReset clears the recorded queries
+func handleZeroResultQueriesReset(c *gin.Context) {
+	searchTelemetry.mu.Lock()
+	searchTelemetry.zeroResults = make(map[string]*zeroResultQuery)
+	searchTelemetry.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// FRAME_PAGE_VERSION is part of response cache keys, so bodies cached by an older
+	// page layout aren't replayed under the current policy
+	FRAME_PAGE_VERSION = "2"
+
+	// frameCSP is the policy of dffunc responses: they carry data and load frame.js only
+	frameCSP = "default-src 'none'; script-src 'self'; frame-ancestors 'self'; base-uri 'none'; form-action 'none'"
+
+	// defaultAppCSP is the policy of the pages and everything else. The player pages
+	// still use inline event handlers and inline kiosk/remote scripts.
+	defaultAppCSP = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data: blob:; media-src 'self' blob:; connect-src 'self'; frame-src 'self'; " +
+		"frame-ancestors 'self'; object-src 'none'; base-uri 'self'; form-action 'self'"
+
+	// embedCSP is the policy of the embedded share player, which any site may frame
+	embedCSP = "default-src 'none'; script-src 'self'; style-src 'unsafe-inline'; media-src 'self'; " +
+		"frame-ancestors *; base-uri 'none'; form-action 'none'"
+
+	// docsCSP is the policy of the Swagger UI page; swagger-ui styles its elements inline
+	docsCSP = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; " +
+		"frame-ancestors 'self'; object-src 'none'; base-uri 'self'"
+
+	// docsCDNCSP also allows the pinned release on unpkg, for builds without the vendored copy
+	docsCDNCSP = "default-src 'self'; script-src 'self' " + SWAGGER_UI_CDN + "swagger-ui-bundle.js; " +
+		"style-src 'self' 'unsafe-inline' " + SWAGGER_UI_CDN + "swagger-ui.css; img-src 'self' data:; " +
+		"frame-ancestors 'self'; object-src 'none'; base-uri 'self'"
+)
+
+// CONTENT_SECURITY_POLICY replaces the app policy, for example to allow a CDN origin in
+// media-src; "off" sends no Content-Security-Policy at all. dffunc responses keep their
+// own strict policy unless it is off.
+var contentSecurityPolicy = defaultAppCSP
+
+func initSecurityHeaders() error {
+	if v := strings.TrimSpace(os.Getenv("CONTENT_SECURITY_POLICY")); v != "" {
+		contentSecurityPolicy = v
+	}
+	return nil
+}
+
+// SecurityHeaders middleware sets Content-Security-Policy and X-Content-Type-Options
+func SecurityHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("X-Content-Type-Options", "nosniff")
+		if contentSecurityPolicy != "off" {
+			switch c.FullPath() {
+			case basePath + "/api":
+				c.Header("Content-Security-Policy", frameCSP)
+			case basePath + "/embed/:token":
+				c.Header("Content-Security-Policy", embedCSP)
+			case basePath + "/api/v1/docs":
+				if _, vendored := swaggerUIAssets(); vendored {
+					c.Header("Content-Security-Policy", docsCSP)
+				} else {
+					c.Header("Content-Security-Policy", docsCDNCSP)
+				}
+			default:
+				c.Header("Content-Security-Policy", contentSecurityPolicy)
+			}
+		}
+		c.Next()
+	}
+}
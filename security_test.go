@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const dataBlockStart = `<script type="application/json" id="dataContainer">`
+
+// TestFramePageDataBlock checks that no value in a dffunc response can end or comment
+// out the JSON data block, and that the block decodes to the values sent
+func TestFramePageDataBlock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"script end", `</script><script>alert(1)</script>`},
+		{"script end upper case", `</SCRIPT ><img src=x onerror=alert(1)>`},
+		{"html comment", `<!-- <script>`},
+		{"backslash", `C:\Music\"quoted"\`},
+		{"line separators", "a\u2028b\u2029c"},
+		{"ampersand entity", `&lt;/script&gt;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []interface{}{"ok", []interface{}{tt.value, map[string]interface{}{"title": tt.value}}}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			writeFramePage(c, http.StatusOK, data, `x"><script>`)
+			body := w.Body.String()
+
+			start := strings.Index(body, dataBlockStart)
+			if start < 0 {
+				t.Fatalf("no data block in %q", body)
+			}
+			block := body[start+len(dataBlockStart):]
+			end := strings.Index(strings.ToLower(block), "</script")
+			if end < 0 {
+				t.Fatalf("data block not closed in %q", body)
+			}
+			block = block[:end]
+			for _, bad := range []string{"<", ">", "\u2028", "\u2029"} {
+				if strings.Contains(block, bad) {
+					t.Errorf("data block contains %q: %s", bad, block)
+				}
+			}
+			var got []interface{}
+			if err := json.Unmarshal([]byte(block), &got); err != nil {
+				t.Fatalf("data block is not the whole JSON value: %v\n%s", err, block)
+			}
+			want := []interface{}{"ok", []interface{}{tt.value, map[string]interface{}{"title": tt.value}}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %#v, want %#v", got, want)
+			}
+			if strings.Contains(body, `x"><script>`) {
+				t.Errorf("callback name not escaped in %q", body)
+			}
+		})
+	}
+}
+
+// TestSecurityHeaders checks the policies of dffunc responses, the embed player and other pages
+func TestSecurityHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(prev string) { contentSecurityPolicy = prev }(contentSecurityPolicy)
+
+	r := gin.New()
+	r.Use(SecurityHeaders())
+	r.POST(basePath+"/api", func(c *gin.Context) { writeFramePage(c, http.StatusOK, []interface{}{"ok"}, "dir") })
+	r.GET(basePath+"/", func(c *gin.Context) { c.String(http.StatusOK, "page") })
+	r.GET(basePath+"/embed/:token", func(c *gin.Context) { c.String(http.StatusOK, "player") })
+
+	tests := []struct {
+		name   string
+		policy string
+		method string
+		path   string
+		want   string
+	}{
+		{"dffunc response", defaultAppCSP, http.MethodPost, "/api", frameCSP},
+		{"page", defaultAppCSP, http.MethodGet, "/", defaultAppCSP},
+		{"custom page policy", "default-src 'self'", http.MethodGet, "/", "default-src 'self'"},
+		{"custom policy keeps dffunc policy", "default-src 'self'", http.MethodPost, "/api", frameCSP},
+		{"embed player", defaultAppCSP, http.MethodGet, "/embed/x", embedCSP},
+		{"custom policy keeps embed policy", "default-src 'self'", http.MethodGet, "/embed/x", embedCSP},
+		{"off", "off", http.MethodPost, "/api", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentSecurityPolicy = tt.policy
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, basePath+tt.path, nil))
+			if got := w.Header().Get("Content-Security-Policy"); got != tt.want {
+				t.Errorf("Content-Security-Policy = %q, want %q", got, tt.want)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	LISTEN_UNIX         = "unix:"   // LISTEN_ADDR=unix:/run/go-music.sock
+	LISTEN_SYSTEMD      = "systemd" // LISTEN_ADDR=systemd takes the socket of a systemd .socket unit
+	SD_LISTEN_FDS_START = 3         // first file descriptor passed by socket activation
+)
+
+const (
+	HTTP2_ON  = "on"  // HTTP/2 over TLS
+	HTTP2_H2C = "h2c" // also unencrypted HTTP/2, for proxies that speak it to the backend
+	HTTP2_OFF = "off"
+)
+
+// Listener configuration from environment variables
+var (
+	listenAddr       = os.Getenv("LISTEN_ADDR")          // default ":8080", or ":443" with TLS; also unix:<path> or systemd
+	unixSocketMode   = os.Getenv("UNIX_SOCKET_MODE")     // permissions of a unix: socket, default 0660
+	tlsCert          = os.Getenv("TLS_CERT")             // certificate file, used together with TLS_KEY
+	tlsKey           = os.Getenv("TLS_KEY")              // private key file
+	autocertDomains  = os.Getenv("TLS_AUTOCERT_DOMAINS") // comma separated hosts for Let's Encrypt
+	autocertCacheDir = os.Getenv("TLS_AUTOCERT_CACHE")   // default "autocert-cache"
+	autocertEmail    = os.Getenv("TLS_AUTOCERT_EMAIL")
+	httpRedirectAddr = os.Getenv("HTTP_REDIRECT_ADDR") // e.g. ":80"; serves ACME challenges and redirects to HTTPS
+	http2Mode        = os.Getenv("HTTP2")              // on (default), h2c or off
+)
+
+// Server timeouts, configurable as Go durations. Streams are exempt from the read and
+// write timeouts (see LongLived), so these only bound ordinary requests; HTTP2_PING
+// checks idle HTTP/2 connections so streams of clients that went to sleep are released.
+var (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       = 2 * time.Minute
+	http2Ping         = time.Minute
+)
+
+func initHTTPServer() error {
+	switch http2Mode {
+	case "":
+		http2Mode = HTTP2_ON
+	case HTTP2_ON, HTTP2_H2C, HTTP2_OFF:
+	default:
+		return fmt.Errorf("invalid HTTP2: %q, expected on, h2c or off", http2Mode)
+	}
+	for _, t := range []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", &readHeaderTimeout},
+		{"READ_TIMEOUT", &readTimeout},
+		{"WRITE_TIMEOUT", &writeTimeout},
+		{"IDLE_TIMEOUT", &idleTimeout},
+		{"HTTP2_PING", &http2Ping},
+	} {
+		if v := os.Getenv(t.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid %s: %q", t.env, v)
+			}
+			*t.dst = d
+		}
+	}
+	return nil
+}
+
+// configureHTTPServer applies the timeouts and protocols to srv
+func configureHTTPServer(srv *http.Server) {
+	srv.ReadHeaderTimeout = readHeaderTimeout
+	srv.ReadTimeout = readTimeout
+	srv.WriteTimeout = writeTimeout
+	srv.IdleTimeout = idleTimeout
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(http2Mode != HTTP2_OFF)
+	srv.Protocols.SetUnencryptedHTTP2(http2Mode == HTTP2_H2C)
+	srv.HTTP2 = &http.HTTP2Config{SendPingTimeout: http2Ping}
+}
+
+// LongLived lifts the read and write timeouts for responses that last as long as the
+// client listens: audio, radio and event streams. The read deadline matters as well, as
+// the server cancels the request when it passes.
+func LongLived() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rc := http.NewResponseController(c.Writer)
+		if readTimeout > 0 {
+			rc.SetReadDeadline(time.Time{})
+		}
+		if writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Time{})
+		}
+		c.Next()
+	}
+}
+
+func validateServerConfig() error {
+	if (tlsCert == "") != (tlsKey == "") {
+		return fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if tlsCert != "" && autocertDomains != "" {
+		return fmt.Errorf("TLS_CERT/TLS_KEY and TLS_AUTOCERT_DOMAINS are mutually exclusive")
+	}
+	if httpRedirectAddr != "" && tlsCert == "" && autocertDomains == "" {
+		return fmt.Errorf("HTTP_REDIRECT_ADDR requires TLS to be enabled")
+	}
+	if listenAddr == LISTEN_UNIX {
+		return fmt.Errorf("LISTEN_ADDR: unix: needs a socket path")
+	}
+	if unixSocketMode != "" {
+		if _, err := strconv.ParseUint(unixSocketMode, 8, 32); err != nil {
+			return fmt.Errorf("invalid UNIX_SOCKET_MODE: %q, expected octal permissions", unixSocketMode)
+		}
+	}
+	return nil
+}
+
+// listen opens the listener of addr: a TCP address, a unix socket or the socket systemd
+// passed on
+func listen(addr string) (net.Listener, error) {
+	if addr == LISTEN_SYSTEMD {
+		return systemdListener()
+	}
+	path, ok := strings.CutPrefix(addr, LISTEN_UNIX)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// A socket left by a previous run would make the listen fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode := uint64(0o660)
+	if unixSocketMode != "" {
+		mode, _ = strconv.ParseUint(unixSocketMode, 8, 32)
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// systemdListener takes the first socket of systemd socket activation (LISTEN_FDS) and
+// clears its variables, so ffmpeg and other children don't think it was meant for them
+func systemdListener() (net.Listener, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("LISTEN_PID %s is not this process", pid)
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_ADDR=systemd, but systemd passed no socket (LISTEN_FDS)")
+	}
+	if n > 1 {
+		log.Printf("systemd passed %d sockets, using the first", n)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	f := os.NewFile(SD_LISTEN_FDS_START, "systemd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// localPeer gives requests over a unix socket the loopback address, which they come from
+// in effect. Otherwise the client IP would be empty, and forwarding headers of the proxy
+// in front could never be trusted.
+func localPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
+			r.RemoteAddr = "127.0.0.1:0"
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP clients to the same URL over HTTPS
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(listenAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// runServer serves handler over plain HTTP, static TLS certificates, or autocert
+func runServer(handler http.Handler) error {
+	if err := validateServerConfig(); err != nil {
+		return err
+	}
+	addr := listenAddr
+	useTLS := tlsCert != "" || autocertDomains != ""
+	if addr == "" {
+		addr = ":8080"
+		if useTLS {
+			addr = ":443"
+		}
+		listenAddr = addr
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	if ln.Addr().Network() == "unix" {
+		handler = localPeer(handler)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	configureHTTPServer(srv)
+	if !useTLS {
+		log.Printf("Listening on %s", ln.Addr())
+		return serveUntilSignal(srv, func() error { return srv.Serve(ln) })
+	}
+
+	redirect := http.Handler(http.HandlerFunc(redirectToHTTPS))
+	if autocertDomains != "" {
+		cacheDir := autocertCacheDir
+		if cacheDir == "" {
+			cacheDir = "autocert-cache"
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(splitList(autocertDomains)...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      autocertEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+	} else {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if httpRedirectAddr != "" {
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", httpRedirectAddr)
+			if err := http.ListenAndServe(httpRedirectAddr, redirect); err != nil {
+				log.Printf("HTTP redirect listener error: %v", err)
+			}
+		}()
+	}
+	log.Printf("Listening with TLS on %s", ln.Addr())
+	return serveUntilSignal(srv, func() error { return srv.ServeTLS(ln, tlsCert, tlsKey) })
+}
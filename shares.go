@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SHARES_OBJECT     = "shares.json"
+	DEFAULT_SHARE_TTL = 7 * 24 * time.Hour
+	MAX_SHARE_TTL     = 365 * 24 * time.Hour
+
+	SHARE_TRACK      = "track"
+	SHARE_FOLDER     = "folder"
+	SHARE_COLLECTION = "collection"
+)
+
+// Share links are enabled when SHARE_SECRET is set; tokens are signed with it
+var shareSecret = os.Getenv("SHARE_SECRET")
+
+var (
+	errShareUnknown   = errors.New("unknown share")
+	errShareExpired   = errors.New("share expired")
+	errShareExhausted = errors.New("share download limit reached")
+)
+
+// share grants unauthenticated streaming of one track, folder or collection until it expires or is revoked
+type share struct {
+	ID           string    `json:"id"`
+	Kind         string    `json:"kind"`
+	Target       string    `json:"target"` // track key, folder ("dir/") or collection name
+	Library      string    `json:"library"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+}
+
+type shareStore struct {
+	mu     sync.Mutex
+	shares map[string]*share
+	doc    stateDoc
+}
+
+var shares = &shareStore{shares: make(map[string]*share), doc: stateDoc{name: SHARES_OBJECT}}
+
+// load reads the shares object from the state store; a missing object means no shares
+func (ss *shareStore) load(ctx context.Context) error {
+	if shareSecret == "" {
+		return nil
+	}
+	return ss.doc.load(ctx, &ss.mu, ss)
+}
+
+func (ss *shareStore) decode(data []byte) error {
+	var list []share
+	if data != nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	m := make(map[string]*share, len(list))
+	for i := range list {
+		m[list[i].ID] = &list[i]
+	}
+	ss.shares = m
+	return nil
+}
+
+// encode drops expired shares before they are written
+func (ss *shareStore) encode() (interface{}, error) {
+	for id, sh := range ss.shares {
+		if time.Now().After(sh.Expires) {
+			delete(ss.shares, id)
+		}
+	}
+	return ss.listLocked(), nil
+}
+
+func (ss *shareStore) listLocked() []share {
+	out := make([]share, 0, len(ss.shares))
+	for _, sh := range ss.shares {
+		out = append(out, *sh)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+func (ss *shareStore) list() []share {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.listLocked()
+}
+
+func (ss *shareStore) create(ctx context.Context, sh share) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.doc.update(ctx, ss, func() bool {
+		stored := sh
+		ss.shares[sh.ID] = &stored
+		return true
+	})
+}
+
+func (ss *shareStore) revoke(ctx context.Context, id string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	found := false
+	err := ss.doc.update(ctx, ss, func() bool {
+		_, found = ss.shares[id]
+		delete(ss.shares, id)
+		return found
+	})
+	return found, err
+}
+
+// renameTracks points track shares of library lib at the new keys of renamed tracks
+// (old key → new key) and returns how many changed. Folder shares can't follow a
+// folder whose tracks were renamed one by one; their ids are returned as broken.
+func (ss *shareStore) renameTracks(ctx context.Context, lib string, moved map[string]string) (int, []string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	n := 0
+	var broken []string
+	err := ss.doc.update(ctx, ss, func() bool {
+		n, broken = 0, []string{}
+		for _, sh := range ss.shares {
+			if sh.Library != lib {
+				continue
+			}
+			switch sh.Kind {
+			case SHARE_TRACK:
+				if to, ok := moved[sh.Target]; ok {
+					sh.Target = to
+					n++
+				}
+			case SHARE_FOLDER:
+				for from, to := range moved {
+					if strings.HasPrefix(from, sh.Target) && !strings.HasPrefix(to, sh.Target) {
+						broken = append(broken, sh.ID)
+						break
+					}
+				}
+			}
+		}
+		return n > 0
+	})
+	if err != nil {
+		log.Printf("Shares save error: %v", err)
+		n = 0
+	}
+	sort.Strings(broken)
+	return n, broken
+}
+
+// get returns a usable share, optionally counting a download against its limit
+func (ss *shareStore) get(ctx context.Context, id string, download bool) (share, error) {
+	ss.mu.Lock()
+	_, known := ss.shares[id]
+	ss.mu.Unlock()
+	if !known {
+		ss.doc.refreshOnMiss() // another instance may just have created it
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var got share
+	var gotErr error
+	check := func() bool {
+		sh, ok := ss.shares[id]
+		switch {
+		case !ok:
+			got, gotErr = share{}, errShareUnknown
+		case time.Now().After(sh.Expires):
+			got, gotErr = share{}, errShareExpired
+		case sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads:
+			got, gotErr = share{}, errShareExhausted
+		default:
+			got, gotErr = *sh, nil
+		}
+		return gotErr == nil
+	}
+	if !check() || !download || got.MaxDownloads == 0 {
+		return got, gotErr
+	}
+	// Counted against the store's count, so instances can't hand out more downloads together
+	err := ss.doc.update(ctx, ss, func() bool {
+		if !check() {
+			return false
+		}
+		ss.shares[id].Downloads++
+		got.Downloads++
+		return true
+	})
+	if err != nil {
+		log.Printf("Share save error: %v", err)
+	}
+	return got, gotErr
+}
+
+// shareSignature authenticates a share ID and its expiry
+func shareSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(shareSecret))
+	mac.Write([]byte(id + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareToken returns the "<id>.<expires>.<signature>" token for a share
+func shareToken(sh share) string {
+	exp := sh.Expires.Unix()
+	return sh.ID + "." + strconv.FormatInt(exp, 10) + "." + shareSignature(sh.ID, exp)
+}
+
+// parseShareToken checks the signature and expiry of a token and returns the share ID
+func parseShareToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errShareUnknown
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !hmac.Equal([]byte(parts[2]), []byte(shareSignature(parts[0], exp))) {
+		return "", errShareUnknown
+	}
+	if time.Now().Unix() > exp {
+		return "", errShareExpired
+	}
+	return parts[0], nil
+}
+
+// shareError answers a request for an unusable share
+func shareError(c *gin.Context, err error) {
+	if errors.Is(err, errShareUnknown) {
+		c.String(http.StatusNotFound, "Share not found")
+		return
+	}
+	c.String(http.StatusGone, "Share no longer available")
+}
+
+// --- SHARE HANDLERS ---
+
+// RequireShares middleware hides the share routes unless SHARE_SECRET is set
+func RequireShares() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if shareSecret == "" {
+			c.String(http.StatusNotFound, "Not found")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleCreateShare creates a share link (POST /admin/shares)
+func handleCreateShare(c *gin.Context) {
+	var req struct {
+		Kind         string  `json:"kind"`
+		Target       string  `json:"target"`
+		Library      string  `json:"library"`
+		TTLHours     float64 `json:"ttlHours"`
+		MaxDownloads int     `json:"maxDownloads"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Target == "" || req.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind and target required"})
+		return
+	}
+	lib := findLibrary(req.Library)
+	if lib == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown library"})
+		return
+	}
+	ctx := withLibrary(c.Request.Context(), lib)
+	switch req.Kind {
+	case SHARE_TRACK:
+		req.Target = strings.TrimPrefix(req.Target, "/")
+		if _, _, _, err := s3HeadAudioFile(ctx, req.Target); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown track"})
+			return
+		}
+	case SHARE_FOLDER:
+		if req.Target = strings.Trim(req.Target, "/"); req.Target != "" {
+			req.Target += "/"
+		}
+	case SHARE_COLLECTION:
+		if _, ok := collections.get(req.Target); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown collection"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be track, folder or collection"})
+		return
+	}
+	ttl := DEFAULT_SHARE_TTL
+	if req.TTLHours > 0 {
+		ttl = time.Duration(req.TTLHours * float64(time.Hour))
+	}
+	if ttl > MAX_SHARE_TTL {
+		ttl = MAX_SHARE_TTL
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	now := time.Now()
+	sh := share{
+		ID:           hex.EncodeToString(id),
+		Kind:         req.Kind,
+		Target:       req.Target,
+		Library:      lib.Name,
+		Created:      now.UTC(),
+		Expires:      now.Add(ttl).UTC().Truncate(time.Second),
+		MaxDownloads: req.MaxDownloads,
+	}
+	if err := shares.create(c.Request.Context(), sh); err != nil {
+		log.Printf("Share save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save shares"})
+		return
+	}
+	audit.record(c, "share.create", lib.Name, sh.Kind+" "+sh.Target, sh.ID)
+	token := shareToken(sh)
+	c.JSON(http.StatusOK, gin.H{"share": sh, "token": token, "url": externalURL(c, "/share/"+token)})
+}
+
+// handleListShares lists active shares (GET /admin/shares)
+func handleListShares(c *gin.Context) {
+	c.JSON(http.StatusOK, shares.list())
+}
+
+// handleRevokeShare deletes a share (DELETE /admin/shares/:id)
+func handleRevokeShare(c *gin.Context) {
+	found, err := shares.revoke(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		log.Printf("Share save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save shares"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown share"})
+		return
+	}
+	audit.record(c, "share.revoke", "", c.Param("id"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// isShareDownload reports whether a request starts a new playback rather than continuing one
+func isShareDownload(c *gin.Context) bool {
+	r := c.GetHeader("Range")
+	return r == "" || strings.HasPrefix(r, "bytes=0-")
+}
+
+// handleShare streams a shared track, or lists the tracks of a shared folder or collection (GET /share/:token)
+func handleShare(c *gin.Context) {
+	token := c.Param("token")
+	id, err := parseShareToken(token)
+	if err != nil {
+		shareError(c, err)
+		return
+	}
+	sh, err := shares.get(c.Request.Context(), id, false)
+	if err != nil {
+		shareError(c, err)
+		return
+	}
+	lib := findLibrary(sh.Library)
+	if lib == nil {
+		c.String(http.StatusNotFound, "Share not found")
+		return
+	}
+	c.Request = c.Request.WithContext(withLibrary(c.Request.Context(), lib))
+	if sh.Kind == SHARE_TRACK {
+		if _, err := shares.get(c.Request.Context(), id, isShareDownload(c)); err != nil {
+			shareError(c, err)
+			return
+		}
+		serveAudio(c, sh.Target)
+		return
+	}
+	tracks, err := shareTracks(c.Request.Context(), sh)
+	if err != nil {
+		log.Printf("Share listing error: %v", err)
+		c.String(http.StatusInternalServerError, "Failed to list shared tracks")
+		return
+	}
+	urls := make([]string, len(tracks))
+	for i, t := range tracks {
+		rel := t
+		if sh.Kind == SHARE_FOLDER {
+			rel = strings.TrimPrefix(t, sh.Target)
+		}
+		segments := strings.Split(rel, "/")
+		for j, seg := range segments {
+			segments[j] = url.PathEscape(seg)
+		}
+		urls[i] = externalURL(c, "/share/"+token+"/"+strings.Join(segments, "/"))
+	}
+	c.JSON(http.StatusOK, gin.H{"kind": sh.Kind, "name": sh.Target, "expires": sh.Expires, "tracks": tracks, "urls": urls})
+}
+
+// handleShareTrack streams one track of a shared folder or collection (GET /share/:token/*path)
+func handleShareTrack(c *gin.Context) {
+	id, err := parseShareToken(c.Param("token"))
+	if err != nil {
+		shareError(c, err)
+		return
+	}
+	sh, err := shares.get(c.Request.Context(), id, false)
+	if err != nil {
+		shareError(c, err)
+		return
+	}
+	lib := findLibrary(sh.Library)
+	if lib == nil || sh.Kind == SHARE_TRACK {
+		c.String(http.StatusNotFound, "Share not found")
+		return
+	}
+	rel := strings.TrimPrefix(c.Param("path"), "/")
+	key := sh.Target + rel
+	if sh.Kind == SHARE_COLLECTION {
+		key = rel
+		col, ok := collections.get(sh.Target)
+		allowed := false
+		for _, folder := range col.Folders {
+			if ok && strings.HasPrefix(key, folder) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			c.String(http.StatusNotFound, "Audio not found")
+			return
+		}
+	}
+	if _, err := shares.get(c.Request.Context(), id, isShareDownload(c)); err != nil {
+		shareError(c, err)
+		return
+	}
+	c.Request = c.Request.WithContext(withLibrary(c.Request.Context(), lib))
+	serveAudio(c, key)
+}
+
+// shareTracks lists the audio files a folder or collection share grants access to
+func shareTracks(ctx context.Context, sh share) ([]string, error) {
+	if sh.Kind == SHARE_FOLDER {
+		files, err := s3ListAllAudioFiles(ctx, sh.Target)
+		sortNames(files)
+		return files, err
+	}
+	col, ok := collections.get(sh.Target)
+	if !ok {
+		return nil, errShareUnknown
+	}
+	return collectionTracks(ctx, col)
+}
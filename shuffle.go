@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	mathrand "math/rand/v2"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MAX_SHUFFLE_ITEMS = 100000
+
+// newShuffleSeed returns a random seed for callers that don't supply one
+func newShuffleSeed() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// shuffleOrder returns a permutation of 0..n-1 that depends only on seed.
+// PCG and Fisher-Yates are fixed algorithms, so every server version and
+// device reconstructs the same order from the same seed.
+func shuffleOrder(n int, seed uint64) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	rng := mathrand.New(mathrand.NewPCG(seed, seed^0x9e3779b97f4a7c15))
+	for i := n - 1; i > 0; i-- {
+		j := int(rng.Uint64N(uint64(i + 1)))
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
+
+// playlistBudget caps the total size and length of a generated playlist; zero means no cap
+type playlistBudget struct {
+	MaxBytes   int64 `json:"maxBytes"`
+	MaxSeconds int   `json:"maxSeconds"`
+}
+
+// budgetTotals reports what a budgeted playlist adds up to
+type budgetTotals struct {
+	Bytes   int64 `json:"bytes"`
+	Seconds int   `json:"seconds"`
+	Skipped int   `json:"skipped"` // tracks left out because they didn't fit or had no known size/length
+}
+
+// fill walks tracks in order and keeps each one that still fits the budget.
+// Sizes and lengths come from the duration manifest; a track missing there
+// can't be accounted for and is skipped whenever the matching cap is set.
+func (b playlistBudget) fill(lib *library, tracks []string) ([]string, budgetTotals) {
+	var out []string
+	var t budgetTotals
+	for _, track := range tracks {
+		e, ok := manifest.entry(lib, track)
+		secs := manifest.durations(lib, []string{track})[0]
+		if (b.MaxBytes > 0 && (!ok || t.Bytes+e.Size > b.MaxBytes)) ||
+			(b.MaxSeconds > 0 && (secs == 0 || t.Seconds+secs > b.MaxSeconds)) {
+			t.Skipped++
+			continue
+		}
+		out = append(out, track)
+		t.Bytes += e.Size
+		t.Seconds += secs
+	}
+	return out, t
+}
+
+// handleShuffle shuffles either a track list or n indexes with an optional seed.
+// The seed is passed as a decimal string since it doesn't fit a JS number.
+// With a budget ("make an 80-minute CD", "max 700MB") the shuffled tracks are
+// trimmed to what fits and the totals are returned as the fourth element.
+func handleShuffle(c *gin.Context, data string) {
+	var req struct {
+		Count  int      `json:"count"`
+		Seed   string   `json:"seed"`
+		Tracks []string `json:"tracks"`
+		playlistBudget
+	}
+	if err := json.Unmarshal([]byte(data), &req); err != nil || req.MaxBytes < 0 || req.MaxSeconds < 0 {
+		echoReqHtml(c, []interface{}{"error", "Invalid shuffle data"}, "getShuffleData")
+		return
+	}
+	budgeted := req.MaxBytes > 0 || req.MaxSeconds > 0
+	if budgeted && req.Tracks == nil {
+		echoReqHtml(c, []interface{}{"error", "A budget needs a track list"}, "getShuffleData")
+		return
+	}
+	n := req.Count
+	if req.Tracks != nil {
+		n = len(req.Tracks)
+	}
+	if n < 0 || n > MAX_SHUFFLE_ITEMS {
+		echoReqHtml(c, []interface{}{"error", "Invalid shuffle size"}, "getShuffleData")
+		return
+	}
+	seed := newShuffleSeed()
+	if req.Seed != "" {
+		s, err := strconv.ParseUint(req.Seed, 10, 64)
+		if err != nil {
+			echoReqHtml(c, []interface{}{"error", "Invalid shuffle seed"}, "getShuffleData")
+			return
+		}
+		seed = s
+	}
+	order := shuffleOrder(n, seed)
+	out := make([]string, n)
+	for i, idx := range order {
+		if req.Tracks != nil {
+			out[i] = req.Tracks[idx]
+		} else {
+			out[i] = strconv.Itoa(idx)
+		}
+	}
+	if budgeted {
+		out, totals := req.playlistBudget.fill(libraryFrom(c.Request.Context()), out)
+		echoReqHtml(c, []interface{}{"ok", strconv.FormatUint(seed, 10), out, totals}, "getShuffleData")
+		return
+	}
+	echoReqHtml(c, []interface{}{"ok", strconv.FormatUint(seed, 10), out}, "getShuffleData")
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SMART_PLAYLISTS_OBJECT = "smart-playlists.json"
+	MAX_SMART_RULES        = 20
+)
+
+// Rule fields; text fields compare case-insensitively
+const (
+	SMART_PATH     = "path"     // library-relative key
+	SMART_FOLDER   = "folder"   // folder of the track
+	SMART_NAME     = "name"     // file name without extension
+	SMART_EXT      = "ext"      // extension without the dot
+	SMART_DURATION = "duration" // seconds per the manifest; unknown lengths match no rule
+	SMART_SIZE     = "size"     // bytes
+	SMART_ADDED    = "added"    // last modification of the object
+	SMART_RATING   = "rating"   // stars given by the requesting user, 0 when unrated
+)
+
+var (
+	smartTextOps   = []string{"is", "isNot", "contains", "notContains", "startsWith", "endsWith"}
+	smartNumberOps = []string{"eq", "ne", "lt", "le", "gt", "ge"}
+	smartAddedOps  = []string{"inLast", "notInLast"} // value in days
+	smartSorts     = []string{"name", "added", "duration", "rating", "random"}
+)
+
+// smartRule is one condition of a smart playlist, e.g. {"field":"added","op":"inLast","value":"30"}
+type smartRule struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// smartPlaylist selects the tracks of a library matching all (or any) of its rules
+type smartPlaylist struct {
+	Name  string      `json:"name"`
+	Match string      `json:"match,omitempty"` // all (default) or any
+	Rules []smartRule `json:"rules"`
+	Sort  string      `json:"sort,omitempty"` // name (default), added (newest first), duration, rating (highest first), random (reshuffled daily)
+	Limit int         `json:"limit,omitempty"`
+	// A budget keeps the tracks that fit in sort order, before Limit, e.g. the newest 80 minutes
+	playlistBudget
+}
+
+// smartTrack is what rules are evaluated against
+type smartTrack struct {
+	audioObject
+	Duration int
+	Rating   int
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// compile checks the rule and returns its predicate
+func (r smartRule) compile() (func(t smartTrack, now time.Time) bool, error) {
+	switch r.Field {
+	case SMART_PATH, SMART_FOLDER, SMART_NAME, SMART_EXT:
+		if !containsString(smartTextOps, r.Op) {
+			return nil, fmt.Errorf("%s needs one of %s", r.Field, strings.Join(smartTextOps, ", "))
+		}
+		want := strings.ToLower(r.Value)
+		field := r.Field
+		return func(t smartTrack, _ time.Time) bool {
+			v := t.Key
+			switch field {
+			case SMART_FOLDER:
+				v = path.Dir(t.Key)
+			case SMART_NAME:
+				v = strings.TrimSuffix(path.Base(t.Key), path.Ext(t.Key))
+			case SMART_EXT:
+				v = strings.TrimPrefix(path.Ext(t.Key), ".")
+			}
+			v = strings.ToLower(v)
+			switch r.Op {
+			case "is":
+				return v == want
+			case "isNot":
+				return v != want
+			case "contains":
+				return strings.Contains(v, want)
+			case "notContains":
+				return !strings.Contains(v, want)
+			case "startsWith":
+				return strings.HasPrefix(v, want)
+			}
+			return strings.HasSuffix(v, want)
+		}, nil
+	case SMART_DURATION, SMART_SIZE, SMART_RATING:
+		if !containsString(smartNumberOps, r.Op) {
+			return nil, fmt.Errorf("%s needs one of %s", r.Field, strings.Join(smartNumberOps, ", "))
+		}
+		want, err := strconv.ParseFloat(r.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number, got %q", r.Field, r.Value)
+		}
+		field := r.Field
+		return func(t smartTrack, _ time.Time) bool {
+			v := float64(t.Size)
+			switch field {
+			case SMART_DURATION:
+				if t.Duration == 0 {
+					return false
+				}
+				v = float64(t.Duration)
+			case SMART_RATING:
+				v = float64(t.Rating)
+			}
+			switch r.Op {
+			case "eq":
+				return v == want
+			case "ne":
+				return v != want
+			case "lt":
+				return v < want
+			case "le":
+				return v <= want
+			case "gt":
+				return v > want
+			}
+			return v >= want
+		}, nil
+	case SMART_ADDED:
+		if !containsString(smartAddedOps, r.Op) {
+			return nil, fmt.Errorf("%s needs one of %s", r.Field, strings.Join(smartAddedOps, ", "))
+		}
+		days, err := strconv.Atoi(r.Value)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("%s needs a number of days, got %q", r.Field, r.Value)
+		}
+		window := time.Duration(days) * 24 * time.Hour
+		return func(t smartTrack, now time.Time) bool {
+			recent := now.Sub(t.Modified) <= window
+			return recent == (r.Op == "inLast")
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown field %q", r.Field)
+}
+
+// matcher validates the playlist and returns a predicate over tracks
+func (sp smartPlaylist) matcher() (func(t smartTrack, now time.Time) bool, error) {
+	if sp.Match != "" && sp.Match != "all" && sp.Match != "any" {
+		return nil, fmt.Errorf("match must be all or any")
+	}
+	if sp.Sort != "" && !containsString(smartSorts, sp.Sort) {
+		return nil, fmt.Errorf("sort must be one of %s", strings.Join(smartSorts, ", "))
+	}
+	if len(sp.Rules) == 0 || len(sp.Rules) > MAX_SMART_RULES || sp.Limit < 0 {
+		return nil, fmt.Errorf("between 1 and %d rules and a non-negative limit are required", MAX_SMART_RULES)
+	}
+	if sp.MaxBytes < 0 || sp.MaxSeconds < 0 {
+		return nil, fmt.Errorf("maxBytes and maxSeconds must not be negative")
+	}
+	preds := make([]func(smartTrack, time.Time) bool, len(sp.Rules))
+	for i, r := range sp.Rules {
+		p, err := r.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		preds[i] = p
+	}
+	matchAny := sp.Match == "any"
+	return func(t smartTrack, now time.Time) bool {
+		for _, p := range preds {
+			if p(t, now) == matchAny {
+				return matchAny
+			}
+		}
+		return !matchAny
+	}, nil
+}
+
+// describe renders the rules for the playlist list of the web player
+func (sp smartPlaylist) describe() string {
+	parts := make([]string, len(sp.Rules))
+	for i, r := range sp.Rules {
+		parts[i] = r.Field + " " + r.Op + " " + r.Value
+	}
+	join := " and "
+	if sp.Match == "any" {
+		join = " or "
+	}
+	return strings.Join(parts, join)
+}
+
+// resolve evaluates the playlist against the request's library, with the ratings of user
+func (sp smartPlaylist) resolve(ctx context.Context, user string) ([]string, error) {
+	match, err := sp.matcher()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s3ListAudioObjects(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+	lib := libraryFrom(ctx)
+	durations := manifest.durations(lib, keys)
+	rated := ratings.list(user, lib)
+	now := time.Now()
+	var tracks []smartTrack
+	for i, obj := range objects {
+		if t := (smartTrack{audioObject: obj, Duration: durations[i], Rating: rated[obj.Key]}); match(t, now) {
+			tracks = append(tracks, t)
+		}
+	}
+	switch sp.Sort {
+	case "added":
+		sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].Modified.After(tracks[j].Modified) })
+	case "duration":
+		sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].Duration < tracks[j].Duration })
+	case "rating":
+		sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].Rating > tracks[j].Rating })
+	case "random":
+		sort.Slice(tracks, func(i, j int) bool { return tracks[i].Key < tracks[j].Key })
+		h := fnv.New64a()
+		h.Write([]byte(sp.Name + now.Format("2006-01-02")))
+		shuffled := make([]smartTrack, len(tracks))
+		for i, j := range shuffleOrder(len(tracks), h.Sum64()) {
+			shuffled[i] = tracks[j]
+		}
+		tracks = shuffled
+	}
+	out := make([]string, len(tracks))
+	for i, t := range tracks {
+		out[i] = t.Key
+	}
+	if sp.Sort == "" || sp.Sort == "name" {
+		sortNames(out)
+	}
+	if sp.MaxBytes > 0 || sp.MaxSeconds > 0 {
+		out, _ = sp.playlistBudget.fill(lib, out)
+	}
+	if sp.Limit > 0 && len(out) > sp.Limit {
+		out = out[:sp.Limit]
+	}
+	return out, nil
+}
+
+type smartPlaylistStore struct {
+	mu        sync.Mutex
+	playlists map[string]*smartPlaylist
+	doc       stateDoc
+}
+
+var smartPlaylists = &smartPlaylistStore{playlists: make(map[string]*smartPlaylist), doc: stateDoc{name: SMART_PLAYLISTS_OBJECT}}
+
+// load reads the smart playlists object from the state store; a missing object means none
+func (ss *smartPlaylistStore) load(ctx context.Context) error {
+	return ss.doc.load(ctx, &ss.mu, ss)
+}
+
+func (ss *smartPlaylistStore) decode(data []byte) error {
+	var list []smartPlaylist
+	if data != nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	playlists := make(map[string]*smartPlaylist, len(list))
+	for i := range list {
+		playlists[list[i].Name] = &list[i]
+	}
+	ss.playlists = playlists
+	return nil
+}
+
+func (ss *smartPlaylistStore) encode() (interface{}, error) {
+	return ss.listLocked(), nil
+}
+
+func (ss *smartPlaylistStore) listLocked() []smartPlaylist {
+	out := make([]smartPlaylist, 0, len(ss.playlists))
+	for _, sp := range ss.playlists {
+		out = append(out, *sp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (ss *smartPlaylistStore) list() []smartPlaylist {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.listLocked()
+}
+
+func (ss *smartPlaylistStore) get(name string) (smartPlaylist, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sp, ok := ss.playlists[name]
+	if !ok {
+		return smartPlaylist{}, false
+	}
+	return *sp, true
+}
+
+func (ss *smartPlaylistStore) put(ctx context.Context, sp smartPlaylist) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.doc.update(ctx, ss, func() bool {
+		stored := sp
+		ss.playlists[sp.Name] = &stored
+		return true
+	})
+}
+
+func (ss *smartPlaylistStore) remove(ctx context.Context, name string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	found := false
+	err := ss.doc.update(ctx, ss, func() bool {
+		_, found = ss.playlists[name]
+		delete(ss.playlists, name)
+		return found
+	})
+	return found, err
+}
+
+// --- SMART PLAYLIST HANDLERS ---
+func handleGetSmartPlaylists(c *gin.Context) {
+	list := smartPlaylists.list()
+	names := make([]string, len(list))
+	rules := make([]string, len(list))
+	for i, sp := range list {
+		names[i] = sp.Name
+		rules[i] = sp.describe()
+	}
+	echoReqHtml(c, []interface{}{"ok", names, rules}, "getSmartPlaylistsData")
+}
+
+// handleGetAllMp3InSmartPlaylist returns the tracks a smart playlist currently selects
+func handleGetAllMp3InSmartPlaylist(c *gin.Context, name string) {
+	sp, ok := smartPlaylists.get(name)
+	if !ok {
+		echoReqHtml(c, []interface{}{"error", "Unknown smart playlist"}, "getAllMp3Data")
+		return
+	}
+	tracks, err := sp.resolve(c.Request.Context(), requestUser(c))
+	if err != nil {
+		log.Printf("Smart playlist %s error: %v", name, err)
+		echoReqHtml(c, []interface{}{"error", "Failed to evaluate smart playlist"}, "getAllMp3Data")
+		return
+	}
+	tracks, page := paginate(c, tracks, maxListResult)
+	echoReqHtml(c, []interface{}{"ok", tracks, page, manifest.durations(libraryFrom(c.Request.Context()), tracks)}, "getAllMp3Data")
+}
+
+// handleListSmartPlaylists lists the stored rules (GET /admin/smart-playlists)
+func handleListSmartPlaylists(c *gin.Context) {
+	c.JSON(http.StatusOK, smartPlaylists.list())
+}
+
+// handlePutSmartPlaylist creates or replaces a smart playlist (PUT /admin/smart-playlists/:name)
+func handlePutSmartPlaylist(c *gin.Context) {
+	var sp smartPlaylist
+	if err := c.ShouldBindJSON(&sp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	sp.Name = c.Param("name")
+	if _, err := sp.matcher(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := smartPlaylists.put(c.Request.Context(), sp); err != nil {
+		log.Printf("Smart playlist save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save smart playlists"})
+		return
+	}
+	audit.record(c, "smartplaylist.put", "", sp.Name, "")
+	c.JSON(http.StatusOK, sp)
+}
+
+// handleDeleteSmartPlaylist removes a smart playlist (DELETE /admin/smart-playlists/:name)
+func handleDeleteSmartPlaylist(c *gin.Context) {
+	found, err := smartPlaylists.remove(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		log.Printf("Smart playlist save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save smart playlists"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown smart playlist"})
+		return
+	}
+	audit.record(c, "smartplaylist.delete", "", c.Param("name"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+const (
+	SORT_NATURAL = "natural" // numeric-aware: "Track 2" before "Track 10"
+	SORT_LEXICAL = "lexical" // plain byte order, as sort.Strings
+
+	// Listing sort keys, chosen with the dfsort form field; dforder=desc reverses them
+	SORT_BY_NAME     = "name"
+	SORT_BY_MODIFIED = "modified"
+	SORT_BY_SIZE     = "size"
+	SORT_BY_DURATION = "duration"
+)
+
+// Listing order: SORT_ORDER picks natural (default) or lexical; SORT_LOCALE
+// (e.g. "de", "sv") switches to locale-aware collation, still numeric-aware
+var (
+	sortOrder  = SORT_NATURAL
+	sortLocale language.Tag
+)
+
+func initSortOrder() error {
+	if v := os.Getenv("SORT_ORDER"); v != "" {
+		if v != SORT_NATURAL && v != SORT_LEXICAL {
+			return fmt.Errorf("invalid SORT_ORDER: %q", v)
+		}
+		sortOrder = v
+	}
+	if v := os.Getenv("SORT_LOCALE"); v != "" {
+		tag, err := language.Parse(v)
+		if err != nil {
+			return fmt.Errorf("invalid SORT_LOCALE: %w", err)
+		}
+		sortLocale = tag
+	}
+	return nil
+}
+
+// sortNames sorts directory, file and search listings in the configured order
+func sortNames(names []string) {
+	switch {
+	case sortLocale != language.Und:
+		// A collator keeps internal buffers, so each sort gets its own
+		opts := []collate.Option{collate.IgnoreCase}
+		if sortOrder == SORT_NATURAL {
+			opts = append(opts, collate.Numeric)
+		}
+		collate.New(sortLocale, opts...).SortStrings(names)
+	case sortOrder == SORT_LEXICAL:
+		sort.Strings(names)
+	default:
+		sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	}
+}
+
+// naturalLess compares runs of digits by numeric value and everything else byte by byte
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if da > 0 && db > 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			if da != db { // same value, fewer leading zeros first
+				return da < db
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digitPrefix returns the length of the run of ASCII digits s starts with
+func digitPrefix(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// listingOrder is the order a client asked a listing in
+type listingOrder struct {
+	by   string
+	desc bool
+}
+
+// requestOrder reads the dfsort and dforder form fields; unknown values mean name order
+func requestOrder(c *gin.Context) listingOrder {
+	o := listingOrder{by: c.PostForm("dfsort"), desc: c.PostForm("dforder") == "desc"}
+	switch o.by {
+	case SORT_BY_MODIFIED, SORT_BY_SIZE, SORT_BY_DURATION:
+	default:
+		o.by = SORT_BY_NAME
+	}
+	return o
+}
+
+// sortDirs sorts folder names; folders have no size or date, so only the direction applies
+func (o listingOrder) sortDirs(names []string) {
+	sortNames(names)
+	if o.desc {
+		reverseNames(names)
+	}
+}
+
+// sortTracks sorts track names relative to dir (dir+name is the key). Tracks with equal
+// or unknown values stay in name order.
+func (o listingOrder) sortTracks(ctx context.Context, dir string, names []string) {
+	sortNames(names)
+	if o.by == SORT_BY_NAME {
+		if o.desc {
+			reverseNames(names)
+		}
+		return
+	}
+	keys := make([]string, len(names))
+	for i, n := range names {
+		keys[i] = dir + n
+	}
+	values := make(map[string]int64, len(names))
+	switch o.by {
+	case SORT_BY_DURATION:
+		for i, d := range manifest.durations(libraryFrom(ctx), keys) {
+			values[names[i]] = int64(d)
+		}
+	default:
+		objects, err := listingObjects(ctx, keys)
+		if err != nil {
+			log.Printf("S3 list error, keeping name order: %v", err)
+			return
+		}
+		for i, key := range keys {
+			obj := objects[key]
+			if o.by == SORT_BY_SIZE {
+				values[names[i]] = obj.Size
+			} else if !obj.Modified.IsZero() {
+				values[names[i]] = obj.Modified.UnixNano()
+			}
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if o.desc {
+			return values[names[i]] > values[names[j]]
+		}
+		return values[names[i]] < values[names[j]]
+	})
+}
+
+// listingObjects looks up size and date of keys with one walk below their common folder
+func listingObjects(ctx context.Context, keys []string) (map[string]audioObject, error) {
+	out := make(map[string]audioObject, len(keys))
+	if len(keys) == 0 {
+		return out, nil
+	}
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	prefix := keys[0][:strings.LastIndex(keys[0], "/")+1]
+	for _, key := range keys[1:] {
+		for !strings.HasPrefix(key, prefix) {
+			prefix = prefix[:strings.LastIndex(strings.TrimSuffix(prefix, "/"), "/")+1]
+		}
+	}
+	err := s3WalkObjects(ctx, prefix, func(key string) bool { return wanted[key] }, func(page []audioObject) error {
+		for _, obj := range page {
+			out[obj.Key] = obj
+		}
+		return nil
+	})
+	return out, err
+}
+
+func reverseNames(names []string) {
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQLITE_BUSY_TIMEOUT  = 5000       // milliseconds a writer waits for the database lock
+	POSTGRES_MIGRATE_KEY = 0x676d7573 // advisory lock held by the instance migrating the schema
+)
+
+const (
+	SQL_SQLITE   = "sqlite"
+	SQL_POSTGRES = "postgres"
+)
+
+// sqlMigration is one version of the SQL STATE_STORE schema, in each dialect. Released
+// migrations never change; a new schema is a new migration appended to sqlMigrations.
+type sqlMigration struct {
+	version  int
+	sqlite   string
+	postgres string
+}
+
+var sqlMigrations = []sqlMigration{
+	{1, `CREATE TABLE documents (
+		name    TEXT PRIMARY KEY,
+		data    BLOB NOT NULL,
+		updated TIMESTAMP NOT NULL
+	)`, `CREATE TABLE documents (
+		name    TEXT PRIMARY KEY,
+		data    BYTEA NOT NULL,
+		updated TIMESTAMPTZ NOT NULL
+	)`},
+	// Versions for conditional writes; existing rows start at 1
+	{2, `ALTER TABLE documents ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+		`ALTER TABLE documents ADD COLUMN version BIGINT NOT NULL DEFAULT 1`},
+}
+
+// sqlState keeps documents as rows of a SQL database, one per name, with a version
+// counted up by every write. The documents stay JSON as in the other stores: tracks,
+// ratings or playlists aren't tables of their own.
+type sqlState struct {
+	db      *sql.DB
+	dialect string
+	name    string // what String returns
+}
+
+// newSQLiteState opens an embedded SQLite database file, creating it if needed. WAL
+// lets the request path read while a document is written.
+func newSQLiteState(path string) (*sqlState, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)", path, SQLITE_BUSY_TIMEOUT)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // one writer at a time; SQLite would answer SQLITE_BUSY otherwise
+	return &sqlState{db: db, dialect: SQL_SQLITE, name: "sqlite:" + path}, nil
+}
+
+// newPostgresState connects to a Postgres database shared by instances behind a load
+// balancer; dsn is a postgres:// URL
+func newPostgresState(dsn string) (*sqlState, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Postgres URL")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlState{db: db, dialect: SQL_POSTGRES, name: u.Redacted()}, nil
+}
+
+// query writes the ? placeholders of q the way the dialect expects them
+func (s *sqlState) query(q string) string {
+	if s.dialect != SQL_POSTGRES {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// migrate brings the schema up to the last of sqlMigrations in one transaction,
+// recording each applied version in schema_migrations. On Postgres the instances
+// starting together take turns.
+func (s *sqlState) migrate(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.dialect == SQL_POSTGRES {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, POSTGRES_MIGRATE_KEY); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied TIMESTAMP NOT NULL
+	)`); err != nil {
+		return err
+	}
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if last := sqlMigrations[len(sqlMigrations)-1].version; current > last {
+		return fmt.Errorf("schema version %d is newer than this server's %d", current, last)
+	}
+	for _, m := range sqlMigrations {
+		if m.version <= current {
+			continue
+		}
+		stmt := m.sqlite
+		if s.dialect == SQL_POSTGRES {
+			stmt = m.postgres
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.query(`INSERT INTO schema_migrations (version, applied) VALUES (?, ?)`), m.version, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlState) get(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := s.read(ctx, name)
+	return data, err
+}
+
+func (s *sqlState) read(ctx context.Context, name string) ([]byte, string, error) {
+	var data []byte
+	var version int64
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT data, version FROM documents WHERE name = ?`), name).Scan(&data, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, strconv.FormatInt(version, 10), nil
+}
+
+func (s *sqlState) version(ctx context.Context, name string) (string, error) {
+	var version int64
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT version FROM documents WHERE name = ?`), name).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return strconv.FormatInt(version, 10), err
+}
+
+func (s *sqlState) put(ctx context.Context, name string, data []byte) error {
+	_, err := s.db.ExecContext(ctx, s.query(`INSERT INTO documents (name, data, updated) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data, updated = excluded.updated, version = documents.version + 1`),
+		name, data, time.Now().UTC())
+	return err
+}
+
+// write inserts a new document unless one exists, or updates the row still at version
+func (s *sqlState) write(ctx context.Context, name string, data []byte, version string) (string, error) {
+	var res sql.Result
+	var err error
+	next := int64(1)
+	if version == "" {
+		res, err = s.db.ExecContext(ctx, s.query(`INSERT INTO documents (name, data, updated, version) VALUES (?, ?, ?, ?)
+			ON CONFLICT (name) DO NOTHING`), name, data, time.Now().UTC(), next)
+	} else {
+		current, perr := strconv.ParseInt(version, 10, 64)
+		if perr != nil {
+			return "", fmt.Errorf("%s: invalid version %q", name, version)
+		}
+		next = current + 1
+		res, err = s.db.ExecContext(ctx, s.query(`UPDATE documents SET data = ?, updated = ?, version = ? WHERE name = ? AND version = ?`),
+			data, time.Now().UTC(), next, name, current)
+	}
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", errStateConflict
+	}
+	return strconv.FormatInt(next, 10), nil
+}
+
+func (s *sqlState) list(ctx context.Context, prefix string) ([]string, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+	rows, err := s.db.QueryContext(ctx, s.query(`SELECT name FROM documents WHERE name LIKE ? ESCAPE '\'`), pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		// LIKE ignores case for ASCII in SQLite
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // the database's collation may order differently
+	return names, rows.Err()
+}
+
+func (s *sqlState) String() string {
+	return s.name
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_STATE_REFRESH = 30 * time.Second
+	STATE_MISS_REFRESH    = 5 * time.Second // least time between refreshes for lookups that found nothing
+)
+
+// STATE_REFRESH is how often the user data documents are checked for changes other
+// instances made, on the stores instances can share; 0 turns the checks off
+var stateRefresh = DEFAULT_STATE_REFRESH
+
+func initStateRefresh() error {
+	if v := os.Getenv("STATE_REFRESH"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid STATE_REFRESH: %q", v)
+		}
+		stateRefresh = d
+	}
+	return nil
+}
+
+// stateCopy is a store's in-memory copy of one document
+type stateCopy interface {
+	decode(data []byte) error     // replaces the copy; data is nil when there is no document
+	encode() (interface{}, error) // returns what to write
+}
+
+// stateDoc keeps a store's copy of a document in step with STATE_STORE, which other
+// instances may write as well. update reads the document again when its version moved,
+// makes the change and writes it only if nobody wrote in between, starting over if
+// somebody did; refreshState picks up the changes of other instances in between.
+type stateDoc struct {
+	name    string
+	version string // of the document the copy was read from or written as
+	data    []byte // that document, to put the copy back after a failed write
+	mu      sync.Locker
+	copy    stateCopy
+	missed  time.Time // of the last refreshOnMiss
+}
+
+var stateDocs = struct {
+	sync.Mutex
+	loaded []*stateDoc
+}{}
+
+// load reads the document into c, the copy mu guards, and has refreshState keep it fresh
+func (d *stateDoc) load(ctx context.Context, mu sync.Locker, c stateCopy) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if d.copy == nil {
+		stateDocs.Lock()
+		stateDocs.loaded = append(stateDocs.loaded, d)
+		stateDocs.Unlock()
+	}
+	d.mu, d.copy = mu, c
+	return d.syncLocked(ctx, c)
+}
+
+// syncLocked reads the document into c if it changed since c was; the caller holds the lock
+func (d *stateDoc) syncLocked(ctx context.Context, c stateCopy) error {
+	version, err := state.version(ctx, d.name)
+	if isNoSuchKey(err) {
+		version, err = "", nil
+	}
+	if err != nil || version == d.version {
+		return err
+	}
+	data, version, err := state.read(ctx, d.name)
+	if isNoSuchKey(err) {
+		data, version, err = nil, "", nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.decode(data); err != nil {
+		return err
+	}
+	d.version, d.data = version, data
+	return nil
+}
+
+// update applies change to c and writes it; change reports whether it changed anything.
+// When another instance wrote the document first, change runs again on its version, so
+// it must only depend on the copy and its own arguments. A failed write leaves c as the
+// store has it. The caller holds the lock of c.
+func (d *stateDoc) update(ctx context.Context, c stateCopy, change func() bool) error {
+	for attempt := 1; ; attempt++ {
+		if err := d.syncLocked(ctx, c); err != nil {
+			return err
+		}
+		if !change() {
+			return nil
+		}
+		v, err := c.encode()
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(v)
+		}
+		var version string
+		if err == nil {
+			version, err = state.write(ctx, d.name, data, d.version)
+		}
+		if err == nil {
+			d.version, d.data = version, data
+			return nil
+		}
+		if derr := c.decode(d.data); derr != nil {
+			log.Printf("State %s rollback error: %v", d.name, derr)
+		}
+		if !errors.Is(err, errStateConflict) || attempt == STATE_WRITE_ATTEMPTS {
+			return err
+		}
+	}
+}
+
+// refresh reads the document again if another instance changed it. The version is
+// checked without the lock, which readers of the copy would otherwise wait for.
+func (d *stateDoc) refresh(ctx context.Context) error {
+	version, err := state.version(ctx, d.name)
+	if isNoSuchKey(err) {
+		version, err = "", nil
+	}
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if version == d.version {
+		return nil
+	}
+	return d.syncLocked(ctx, d.copy)
+}
+
+// refreshOnMiss refreshes a loaded document after a lookup in the copy found nothing,
+// since another instance may just have added it. Refreshes are STATE_MISS_REFRESH apart
+// at least, so lookups of made-up names can't keep the store busy. The caller must not
+// hold the lock.
+func (d *stateDoc) refreshOnMiss() {
+	if d.mu == nil || !sharedState(state) {
+		return
+	}
+	d.mu.Lock()
+	if time.Since(d.missed) < STATE_MISS_REFRESH {
+		d.mu.Unlock()
+		return
+	}
+	d.missed = time.Now()
+	d.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), STATE_CHECK_TIMEOUT)
+	defer cancel()
+	if err := d.refresh(ctx); err != nil {
+		log.Printf("State refresh error: %s: %v", d.name, err)
+	}
+}
+
+// sharedState reports whether other instances may write the store
+func sharedState(s stateStore) bool {
+	switch s := s.(type) {
+	case dirState:
+		return false
+	case *sqlState:
+		return s.dialect == SQL_POSTGRES
+	}
+	return true
+}
+
+// refreshState checks the loaded documents every STATE_REFRESH until ctx is cancelled
+func refreshState(ctx context.Context) {
+	if stateRefresh == 0 || !sharedState(state) {
+		return
+	}
+	ticker := time.NewTicker(stateRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stateDocs.Lock()
+			docs := append([]*stateDoc(nil), stateDocs.loaded...)
+			stateDocs.Unlock()
+			for _, d := range docs {
+				if err := d.refresh(ctx); err != nil {
+					log.Printf("State refresh error: %s: %v", d.name, err)
+					break // the store is likely down; the next tick tries again
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+)
+
+const (
+	STATE_CHECK_TIMEOUT  = 10 * time.Second
+	STATE_CREATE_TIMEOUT = 2 * time.Minute
+	STATE_DYNAMO_CHUNK   = 300 << 10 // bytes per item; DynamoDB items are at most 400KB
+	STATE_DYNAMO_HEAD    = "head"
+	STATE_READ_ATTEMPTS  = 3 // a document rewritten while it is read is read again
+	STATE_WRITE_ATTEMPTS = 5 // a change that lost a race with another writer is made again
+	STATE_VERSION_BYTES  = 8
+
+	STATE_DYNAMO_NO_VER = "-" // the version of a head written before there were versions
+)
+
+// STATE_STORE says where the server keeps its own state: playlists, ratings, queues,
+// play history, shares, the duration manifest, tag and loudness indexes and the rest
+// of what s3GetJSON and s3PutJSON read and write.
+//
+//	s3                objects under META_DIR in the bucket, shared by every instance (default)
+//	dir:<path>        one JSON file per object in a local directory, for a single instance
+//	                  with a read-only bucket or a bucket it shouldn't write to
+//	sqlite:<path>     rows of an embedded SQLite database, for a single instance
+//	postgres://...    rows of a Postgres database, shared by instances behind a load balancer
+//	dynamodb:<table>  items in a DynamoDB table, shared by instances behind a load balancer
+//	                  without writing state to the bucket
+//
+// Every store holds the same JSON documents, each read whole at startup and written
+// whole; the SQL stores keep them as rows of one table rather than a relational
+// catalog. Whichever the store, the indexes are read at startup, so the server doesn't
+// probe every track again. Directory listings come from S3; with a store other than
+// s3 the last good ones are kept there too, for a restart while S3 is degraded (see
+// staleIndex). Instances sharing a store don't overwrite each other's changes to user
+// data (see stateDoc) and pick them up within STATE_REFRESH. SQL stores bring their
+// schema up to date at startup. "go-music migrate-state -to <store>" copies everything
+// from the current store into another, creating the DynamoDB table or the SQL schema
+// if needed.
+var stateStoreConfig = os.Getenv("STATE_STORE")
+
+// stateStore holds named JSON documents. get, read and version fail with an error
+// isNoSuchKey accepts when a document doesn't exist. Every write gives a document a new
+// version; write only replaces a document that is still at the version it is given, ""
+// for one that doesn't exist yet, and fails with errStateConflict otherwise.
+type stateStore interface {
+	get(ctx context.Context, name string) ([]byte, error)
+	read(ctx context.Context, name string) (data []byte, version string, err error)
+	version(ctx context.Context, name string) (string, error)
+	put(ctx context.Context, name string, data []byte) error
+	write(ctx context.Context, name string, data []byte, version string) (string, error)
+	list(ctx context.Context, prefix string) ([]string, error) // names starting with prefix, sorted
+	String() string
+}
+
+var state stateStore = bucketState{}
+
+// errStateConflict means another writer changed a document since it was read
+var errStateConflict = errors.New("document changed by another writer")
+
+// newStateVersion returns a version for stores that don't make their own
+func newStateVersion() string {
+	b := make([]byte, STATE_VERSION_BYTES)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contentVersion is the version of a document a store keeps no version of: a hash of it
+func contentVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:STATE_VERSION_BYTES])
+}
+
+func initStateStore() error {
+	s, err := parseStateStore(stateStoreConfig)
+	if err != nil {
+		return fmt.Errorf("STATE_STORE: %w", err)
+	}
+	switch s := s.(type) {
+	case *dynamoState:
+		ctx, cancel := context.WithTimeout(context.Background(), STATE_CHECK_TIMEOUT)
+		defer cancel()
+		if err := s.check(ctx); err != nil {
+			return fmt.Errorf("STATE_STORE: %w", err)
+		}
+	case *sqlState:
+		ctx, cancel := context.WithTimeout(context.Background(), STATE_CREATE_TIMEOUT)
+		defer cancel()
+		if err := s.migrate(ctx); err != nil {
+			return fmt.Errorf("STATE_STORE: %w", err)
+		}
+	}
+	state = s
+	return nil
+}
+
+// parseStateStore opens the store a STATE_STORE value names
+func parseStateStore(value string) (stateStore, error) {
+	switch {
+	case value == "" || value == "s3":
+		return bucketState{}, nil
+	case strings.HasPrefix(value, "dir:"):
+		dir := strings.TrimPrefix(value, "dir:")
+		if dir == "" {
+			return nil, fmt.Errorf("dir: needs a path")
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		return dirState{dir: dir}, nil
+	case strings.HasPrefix(value, "sqlite:"):
+		path := strings.TrimPrefix(value, "sqlite:")
+		if path == "" {
+			return nil, fmt.Errorf("sqlite: needs a path")
+		}
+		return newSQLiteState(path)
+	case strings.HasPrefix(value, "postgres://") || strings.HasPrefix(value, "postgresql://"):
+		return newPostgresState(value)
+	case strings.HasPrefix(value, "dynamodb:"):
+		table := strings.TrimPrefix(value, "dynamodb:")
+		if table == "" {
+			return nil, fmt.Errorf("dynamodb: needs a table name")
+		}
+		return newDynamoState(table)
+	}
+	return nil, fmt.Errorf("invalid store %q, want s3, dir:<path>, sqlite:<path>, postgres://... or dynamodb:<table>", value)
+}
+
+// bucketState keeps documents as objects under META_DIR; their ETags are the versions
+type bucketState struct{}
+
+func (b bucketState) get(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := b.read(ctx, name)
+	return data, err
+}
+
+func (bucketState) read(ctx context.Context, name string) ([]byte, string, error) {
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(metaKey(name)),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return data, aws.ToString(resp.ETag), err
+}
+
+func (bucketState) version(ctx context.Context, name string) (string, error) {
+	resp, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(metaKey(name)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(resp.ETag), nil
+}
+
+func (bucketState) put(ctx context.Context, name string, data []byte) error {
+	_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s3Bucket),
+		Key:         aws.String(metaKey(name)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// write is a conditional put: If-Match the version, or If-None-Match for a new document
+func (bucketState) write(ctx context.Context, name string, data []byte, version string) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s3Bucket),
+		Key:         aws.String(metaKey(name)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	if version == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(version)
+	}
+	out, err := s3Client.PutObject(ctx, input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict") {
+		return "", errStateConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (bucketState) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(metaKey(prefix)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			// S3 cache layers and exports share META_DIR but aren't documents
+			name := strings.TrimPrefix(aws.ToString(obj.Key), metaKey(""))
+			if !strings.HasPrefix(name, "cache/") && !strings.HasPrefix(name, "exports/") {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+func (bucketState) String() string {
+	return "s3://" + s3Bucket + "/" + metaKey("")
+}
+
+// dirState keeps one file per document; names with slashes are subdirectories. Versions
+// are hashes of the files.
+type dirState struct {
+	dir string
+}
+
+// dirWrites makes a conditional write of a dirState one step
+var dirWrites sync.Mutex
+
+func (d dirState) get(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+func (d dirState) read(ctx context.Context, name string) ([]byte, string, error) {
+	data, err := d.get(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, contentVersion(data), nil
+}
+
+func (d dirState) version(ctx context.Context, name string) (string, error) {
+	_, version, err := d.read(ctx, name)
+	return version, err
+}
+
+func (d dirState) put(ctx context.Context, name string, data []byte) error {
+	dirWrites.Lock()
+	defer dirWrites.Unlock()
+	return d.replace(name, data)
+}
+
+func (d dirState) write(ctx context.Context, name string, data []byte, version string) (string, error) {
+	dirWrites.Lock()
+	defer dirWrites.Unlock()
+	current, err := d.version(ctx, name)
+	if err != nil && !isNoSuchKey(err) {
+		return "", err
+	}
+	if current != version {
+		return "", errStateConflict
+	}
+	if err := d.replace(name, data); err != nil {
+		return "", err
+	}
+	return contentVersion(data), nil
+}
+
+// replace renames a synced temporary file over the document's, so a crash leaves the
+// old or the new document and never a torn one
+func (d dirState) replace(name string, data []byte) error {
+	file := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (d dirState) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(d.dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || filepath.Ext(p) == ".tmp" {
+			return err
+		}
+		rel, err := filepath.Rel(d.dir, p)
+		if name := filepath.ToSlash(rel); err == nil && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return err
+	})
+	return names, err
+}
+
+func (d dirState) String() string {
+	return "dir:" + d.dir
+}
+
+// dynamoState keeps documents in a DynamoDB table with the string partition key "name"
+// and the string sort key "part". A document's "head" item holds it whole when it is
+// small; a larger one is split into chunk items of one generation, which the head
+// names. Writers put the chunks before the head, so readers never see a half-written
+// document, and then delete the chunks the head pointed to before. The head's "ver"
+// attribute is the version; heads written before there were versions have none and
+// are at STATE_DYNAMO_NO_VER.
+type dynamoState struct {
+	client *dynamodb.Client
+	table  string
+	chunk  int
+}
+
+// newDynamoState creates a client from the default AWS configuration; the S3 settings
+// and middlewares don't apply to it
+func newDynamoState(table string) (*dynamoState, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if tracingEnabled {
+		otelaws.AppendMiddlewares(&cfg.APIOptions)
+	}
+	return &dynamoState{client: dynamodb.NewFromConfig(cfg), table: table, chunk: STATE_DYNAMO_CHUNK}, nil
+}
+
+func (d *dynamoState) key(name, part string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"name": &types.AttributeValueMemberS{Value: name},
+		"part": &types.AttributeValueMemberS{Value: part},
+	}
+}
+
+// chunkPart is the sort key of a chunk; the index is padded so chunks sort in order
+func chunkPart(gen string, i int) string {
+	return fmt.Sprintf("%s.%05d", gen, i)
+}
+
+func (d *dynamoState) get(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := d.read(ctx, name)
+	return data, err
+}
+
+func (d *dynamoState) read(ctx context.Context, name string) ([]byte, string, error) {
+	for attempt := 1; ; attempt++ {
+		out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(d.table),
+			Key:            d.key(name, STATE_DYNAMO_HEAD),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if out.Item == nil {
+			return nil, "", fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		version := STATE_DYNAMO_NO_VER
+		if v, ok := out.Item["ver"].(*types.AttributeValueMemberS); ok {
+			version = v.Value
+		}
+		if data, ok := out.Item["data"].(*types.AttributeValueMemberB); ok {
+			return data.Value, version, nil
+		}
+		gen, _ := out.Item["gen"].(*types.AttributeValueMemberS)
+		parts, _ := out.Item["parts"].(*types.AttributeValueMemberN)
+		if gen == nil || parts == nil {
+			return nil, "", fmt.Errorf("%s: malformed head item", name)
+		}
+		n, _ := strconv.Atoi(parts.Value)
+		data, err := d.chunks(ctx, name, gen.Value, n)
+		if err == nil || attempt == STATE_READ_ATTEMPTS {
+			return data, version, err
+		}
+	}
+}
+
+func (d *dynamoState) version(ctx context.Context, name string) (string, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                aws.String(d.table),
+		Key:                      d.key(name, STATE_DYNAMO_HEAD),
+		ProjectionExpression:     aws.String("#n, #v"),
+		ExpressionAttributeNames: map[string]string{"#n": "name", "#v": "ver"},
+		ConsistentRead:           aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.Item == nil {
+		return "", fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	v, _ := out.Item["ver"].(*types.AttributeValueMemberS)
+	if v == nil {
+		return STATE_DYNAMO_NO_VER, nil
+	}
+	return v.Value, nil
+}
+
+// chunks reads and joins the n chunks of one generation of a document
+func (d *dynamoState) chunks(ctx context.Context, name, gen string, n int) ([]byte, error) {
+	var data []byte
+	found := 0
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:                aws.String(d.table),
+		KeyConditionExpression:   aws.String("#n = :n AND begins_with(#p, :g)"),
+		ExpressionAttributeNames: map[string]string{"#n": "name", "#p": "part"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n": &types.AttributeValueMemberS{Value: name},
+			":g": &types.AttributeValueMemberS{Value: gen + "."},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if b, ok := item["data"].(*types.AttributeValueMemberB); ok {
+				data = append(data, b.Value...)
+				found++
+			}
+		}
+	}
+	if found != n {
+		return nil, fmt.Errorf("%s: %d of %d chunks, rewritten while reading", name, found, n)
+	}
+	return data, nil
+}
+
+func (d *dynamoState) put(ctx context.Context, name string, data []byte) error {
+	_, err := d.store(ctx, name, data, nil)
+	return err
+}
+
+// write puts the head on the condition that its "ver" is the version
+func (d *dynamoState) write(ctx context.Context, name string, data []byte, version string) (string, error) {
+	return d.store(ctx, name, data, &version)
+}
+
+// store writes a document, conditionally when version isn't nil, and returns its new
+// version. The chunks of a write that lost are deleted again.
+func (d *dynamoState) store(ctx context.Context, name string, data []byte, version *string) (string, error) {
+	head := d.key(name, STATE_DYNAMO_HEAD)
+	next := newStateVersion()
+	head["ver"] = &types.AttributeValueMemberS{Value: next}
+	gen, n := "", 0
+	if len(data) <= d.chunk {
+		head["data"] = &types.AttributeValueMemberB{Value: data}
+	} else {
+		gen = strconv.FormatInt(time.Now().UnixNano(), 36)
+		for off := 0; off < len(data); off += d.chunk {
+			item := d.key(name, chunkPart(gen, n))
+			item["data"] = &types.AttributeValueMemberB{Value: data[off:min(off+d.chunk, len(data))]}
+			if _, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(d.table), Item: item}); err != nil {
+				return "", err
+			}
+			n++
+		}
+		head["gen"] = &types.AttributeValueMemberS{Value: gen}
+		head["parts"] = &types.AttributeValueMemberN{Value: strconv.Itoa(n)}
+	}
+	input := &dynamodb.PutItemInput{
+		TableName:    aws.String(d.table),
+		Item:         head,
+		ReturnValues: types.ReturnValueAllOld,
+	}
+	if version != nil {
+		switch *version {
+		case "":
+			input.ConditionExpression = aws.String("attribute_not_exists(#n)")
+			input.ExpressionAttributeNames = map[string]string{"#n": "name"}
+		case STATE_DYNAMO_NO_VER:
+			input.ConditionExpression = aws.String("attribute_exists(#n) AND attribute_not_exists(#v)")
+			input.ExpressionAttributeNames = map[string]string{"#n": "name", "#v": "ver"}
+		default:
+			input.ConditionExpression = aws.String("#v = :v")
+			input.ExpressionAttributeNames = map[string]string{"#v": "ver"}
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{":v": &types.AttributeValueMemberS{Value: *version}}
+		}
+	}
+	out, err := d.client.PutItem(ctx, input)
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		d.deleteChunks(ctx, name, gen, n) // none for a document the head holds
+		return "", errStateConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	old, _ := out.Attributes["gen"].(*types.AttributeValueMemberS)
+	parts, _ := out.Attributes["parts"].(*types.AttributeValueMemberN)
+	if old != nil && parts != nil && old.Value != gen {
+		oldParts, _ := strconv.Atoi(parts.Value)
+		d.deleteChunks(ctx, name, old.Value, oldParts)
+	}
+	return next, nil
+}
+
+// deleteChunks deletes the n chunks of one generation of a document
+func (d *dynamoState) deleteChunks(ctx context.Context, name, gen string, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.table),
+			Key:       d.key(name, chunkPart(gen, i)),
+		}); err != nil {
+			log.Printf("State chunk delete error: %v", err)
+		}
+	}
+}
+
+// list scans the table for head items; it is for the audit log and migrations, not
+// the request path
+func (d *dynamoState) list(ctx context.Context, prefix string) ([]string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(d.table),
+		FilterExpression:         aws.String("#p = :h"),
+		ProjectionExpression:     aws.String("#n"),
+		ExpressionAttributeNames: map[string]string{"#n": "name", "#p": "part"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":h": &types.AttributeValueMemberS{Value: STATE_DYNAMO_HEAD},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	if prefix != "" {
+		input.FilterExpression = aws.String("#p = :h AND begins_with(#n, :prefix)")
+		input.ExpressionAttributeValues[":prefix"] = &types.AttributeValueMemberS{Value: prefix}
+	}
+	var names []string
+	paginator := dynamodb.NewScanPaginator(d.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if n, ok := item["name"].(*types.AttributeValueMemberS); ok {
+				names = append(names, n.Value)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// check verifies that the table exists
+func (d *dynamoState) check(ctx context.Context) error {
+	_, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)})
+	var nf *types.ResourceNotFoundException
+	if errors.As(err, &nf) {
+		return fmt.Errorf("no DynamoDB table %q, create it with go-music migrate-state -to dynamodb:%s", d.table, d.table)
+	}
+	return err
+}
+
+// create makes the table with on-demand capacity unless it exists, and waits for it
+func (d *dynamoState) create(ctx context.Context) error {
+	if d.check(ctx) == nil {
+		return nil
+	}
+	_, err := d.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(d.table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("name"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("part"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("name"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("part"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return err
+	}
+	return dynamodb.NewTableExistsWaiter(d.client).Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)}, STATE_CREATE_TIMEOUT)
+}
+
+func (d *dynamoState) String() string {
+	return "dynamodb:" + d.table
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Frontend assets compiled into the binary
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// STATIC_DIR serves the frontend from disk instead, e.g. "./static" during development
+var staticDir = os.Getenv("STATIC_DIR")
+
+// staticFileSystem returns the frontend file system, rooted at the static directory
+func staticFileSystem() http.FileSystem {
+	if staticDir != "" {
+		log.Printf("Serving static files from %s", staticDir)
+		return http.Dir(staticDir)
+	}
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		log.Fatalf("Embedded static files missing: %v", err)
+	}
+	return http.FS(sub)
+}
+
+// staticFileExists reports whether the frontend has the file name, relative to static
+func staticFileExists(name string) bool {
+	if staticDir != "" {
+		_, err := os.Stat(filepath.Join(staticDir, filepath.FromSlash(name)))
+		return err == nil
+	}
+	_, err := fs.Stat(embeddedStatic, "static/"+name)
+	return err == nil
+}
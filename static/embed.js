@@ -0,0 +1,42 @@
+// Embedded share player: plays the clicked track of a folder or collection share and
+// moves on to the next one when a track ends
+(function () {
+	var player = document.getElementById('player');
+	var list = document.getElementById('tracks');
+	if (!list) {
+		return;
+	}
+	var links = list.getElementsByTagName('a');
+	var current = 0;
+
+	function play(i, start) {
+		if (i < 0 || i >= links.length) {
+			return;
+		}
+		if (links[current]) {
+			links[current].parentNode.className = '';
+		}
+		current = i;
+		links[i].parentNode.className = 'playing';
+		document.getElementById('title').textContent = links[i].textContent;
+		player.src = links[i].href;
+		if (start) {
+			player.play();
+		}
+	}
+
+	for (var i = 0; i < links.length; i++) {
+		links[i].addEventListener('click', (function (i) {
+			return function (e) {
+				e.preventDefault();
+				play(i, true);
+			};
+		})(i));
+	}
+	player.addEventListener('ended', function () {
+		play(current + 1, true);
+	});
+	if (links.length > 0) {
+		links[0].parentNode.className = 'playing';
+	}
+})();
@@ -0,0 +1,8 @@
+// Hands the data of a dffunc response page to the callback it names in the parent
+(function() {
+    var cb = document.body.getAttribute('data-callback');
+    var data = JSON.parse(document.getElementById('dataContainer').textContent);
+    if (cb && typeof parent[cb] === 'function') {
+        parent[cb](data);
+    }
+})();
@@ -9,6 +9,7 @@ var browserDirs = [];
 var browserTitles = [];
 var searchDirs = [];
 var searchDirTracks = [];
+var searchTags = {};
 var searchplaylistTracks = [];
 var playing = 0;
 var playingTrack = '';
@@ -18,8 +19,24 @@ var loading = false;
 var dataframeTime = 0;
 var searchString = '';
 var searchAction = '';
+var searchScope = '';
 var shuffledList = [];
 var shuffle = false;
+var searchTotal = 0;
+var lastRequestFunc = '';
+var lastRequestData = '';
+var libraries = [];
+var library = '';
+var trackDurations = {};
+var kioskMode = false;
+var guest = false;
+var PROTOCOL_VERSION = 1; // dffunc protocol this page speaks, sent as dfversion
+var capabilities = null;
+var lyricsLines = [];
+var lyricsSynced = false;
+var lyricsShown = -1;
+var syncSocket = null;
+var syncReported = 0;
 
 
 function getBrowserData(data) {
@@ -34,11 +51,23 @@ function getBrowserData(data) {
                 browserCurDirs[browserCurDirs.length] = tmpArr[i];
             }
         }
-        browserDirs = data[2];
-        browserTitles = data[3];
+        var page = data[4];
+        if (page && page.offset) {
+            // A further page of the folder opened by the first one
+            browserDirs = browserDirs.concat(data[2]);
+            browserTitles = browserTitles.concat(data[3]);
+        } else {
+            browserDirs = data[2];
+            browserTitles = data[3];
+        }
+        noteDurations(data[3], data[5], browserCurDir);
         updateBrowser();
+        if (page && page.truncated) {
+            markLoading('browser');
+            loadFromServer(lastRequestFunc, lastRequestData, page.nextOffset);
+        }
     } else {
-        alert(data[0]);
+        alert(data[0] == 'error' ? data[1] : data[0]);
     }
 }
 
@@ -46,8 +75,18 @@ function getBrowserData(data) {
 function getSearchTitle(data) {
     loading = false;
     markLoading(false);
+    if (data[0] == 'error') {
+        alert(data[1]);
+        return;
+    }
     searchDirs = [];
     searchDirTracks = data[1];
+    searchTotal = data[2] ? data[2].total : searchDirTracks.length;
+    noteDurations(searchDirTracks, data[3], '');
+    searchTags = {};
+    for (var i = 0; data[4] && i < data[4].length; i++) {
+        searchTags[searchDirTracks[i]] = data[4][i];
+    }
     updateSearch('title');
     if (data[0] != '') {
         alert(data[0]);
@@ -58,8 +97,13 @@ function getSearchTitle(data) {
 function getSearchDir(data) {
     loading = false;
     markLoading(false);
+    if (data[0] == 'error') {
+        alert(data[1]);
+        return;
+    }
     searchDirTracks = [];
     searchDirs = data[1];
+    searchTotal = data[2] ? data[2].total : searchDirs.length;
     updateSearch('dir');
     if (data[0] != '') {
         alert(data[0]);
@@ -75,25 +119,183 @@ function init() {
     showTab(1);
     markPlayingTab('');
     player = gebi('player');
+    library = decodeURIComponent(getCookie('library'));
+    gebi('dflib').value = library;
     loadPlaylist();
     updateProgressBar();
-    browseDir();
+    loadFromServer('getLibraries', '');
     updateAllLists();
     player.onended = function() {
+        reportNowPlaying(playingTrack, true);
         changeTrack(1);
     }
     player.onpause = function() {
         gebi('buttonPlay').innerHTML = '<alignPlay>&#9658;</alignPlay>';
+        reportPosition(true);
     }
     player.onplaying = function() {
         gebi('buttonPlay').innerHTML = '<alignJumpPause>&#10074;&#10074;</alignJumpPause>';
+        reportPosition(true);
     }
     player.ontimeupdate = function() {
         updateProgressBar();
+        updateLyrics();
+        reportPosition(false);
     }
     player.onloadedmetadata = function() {
         updateProgressBar();
     }
+    subscribeEvents();
+    connectSync();
+    checkConnectivity();
+}
+
+
+function getLibrariesData(data) {
+    loading = false;
+    libraries = data[1];
+    kioskMode = (data[2] == '1');
+    guest = (data[3] == '1');
+    gebi('signIn').style.display = (guest ? 'block' : 'none');
+    selectLibrary(libraries.indexOf(library) < 0 ? libraries[0] : library);
+}
+
+
+function getCapabilities(data) {
+    loading = false;
+    capabilities = data[1];
+}
+
+
+function selectLibrary(name) {
+    if (library != '' && name != library) {
+        playerStop();
+        searchDirs = [];
+        searchDirTracks = [];
+        searchTotal = 0;
+        searchScope = '';
+    }
+    library = name;
+    gebi('dflib').value = name;
+    setCookie('library', encodeURIComponent(name), 365);
+    loadPlaylist();
+    updateAllLists();
+    browseDir();
+}
+
+
+function libraryQuery() {
+    return (library == libraries[0] ? '' : '?lib=' + encodeURIComponent(library));
+}
+
+
+function subscribeEvents() {
+    if (!window.EventSource) {
+        return;
+    }
+    var source = new EventSource('events');
+    source.addEventListener('library', function(e) {
+        var ev = JSON.parse(e.data);
+        if (ev.library && ev.library != library) {
+            return;
+        }
+        if (!loading && browserCurDir !== undefined) {
+            loadFromServer('dir', browserCurDir);
+        }
+    });
+}
+
+
+// connectSync joins the user's devices on /ws, so /remote can show and control this player
+function connectSync() {
+    if (!window.WebSocket) {
+        return;
+    }
+    var device = getCookie('device');
+    if (device == '') {
+        device = 'player-' + Math.floor(Math.random() * 10000);
+        setCookie('device', device, 365);
+    }
+    var url = location.href.replace(/^http/, 'ws').replace(/[?#].*$/, '').replace(/[^\/]*$/, '');
+    syncSocket = new WebSocket(url + 'ws?device=' + encodeURIComponent(device));
+    syncSocket.onmessage = function(e) {
+        var msg = JSON.parse(e.data);
+        if (msg.type != 'command' || playingTrack == '') {
+            return;
+        }
+        if (msg.command == 'play') {
+            player.play();
+        } else if (msg.command == 'pause') {
+            player.pause();
+        } else if (msg.command == 'next') {
+            changeTrack(1);
+        } else if (msg.command == 'previous') {
+            changeTrack(-1);
+        } else if (msg.command == 'seek' && msg.position !== undefined) {
+            player.currentTime = msg.position;
+        }
+    };
+    syncSocket.onclose = function() {
+        syncSocket = null;
+        if (!guest) {
+            setTimeout(connectSync, 5000); // guests must sign in first
+        }
+    };
+}
+
+
+// reportPosition tells the other devices where playback is, at most every 5 seconds unless forced
+function reportPosition(force) {
+    var now = Date.now();
+    if (!syncSocket || syncSocket.readyState != 1 || playingTrack == '' || (!force && now - syncReported < 5000)) {
+        return;
+    }
+    syncReported = now;
+    syncSocket.send(JSON.stringify({
+        type: 'position',
+        track: playingTrack,
+        library: library,
+        position: player.currentTime,
+        duration: isNaN(player.duration) ? 0 : player.duration,
+        paused: player.paused
+    }));
+}
+
+
+function checkConnectivity() {
+    if (!window.fetch) {
+        return;
+    }
+    fetch('api/v1/connectivity').then(function(resp) {
+        return resp.json();
+    }).then(function(st) {
+        var box = gebi('s3Status');
+        if (st.status == 'dns') {
+            box.innerHTML = 'S3 unreachable: DNS lookup failed';
+        } else if (st.status == 'network') {
+            box.innerHTML = 'S3 unreachable: network error';
+        } else if (st.status == 'auth') {
+            box.innerHTML = 'S3 refused the server credentials';
+        } else {
+            box.innerHTML = '';
+        }
+        box.style.display = (box.innerHTML == '' ? 'none' : 'block');
+    }).catch(function() {});
+    setTimeout(function() {
+        checkConnectivity();
+    }, 30000);
+}
+
+
+function reportNowPlaying(track, finished) {
+    if (!window.fetch || !track || guest) {
+        return;
+    }
+    var form = new FormData();
+    form.append('dffunc', 'nowPlaying');
+    form.append('dfversion', PROTOCOL_VERSION);
+    form.append('dfdata', JSON.stringify({track: track, device: getCookie('device'), finished: !!finished}));
+    fetch('api', {method: 'POST', body: form}).catch(function() {});
 }
 
 
@@ -187,16 +389,23 @@ function getCookie(cname) {
 }
 
 
-function loadPlaylist() {
-    var playlistCookie = getCookie('playlist');
-    if (playlistCookie != '') {
-        playlistTracks = playlistCookie.split('|');
+function playlistCookieName() {
+    // The playlist is kept per library, the default library keeps the original cookie
+    if (libraries.length == 0 || library == libraries[0]) {
+        return 'playlist';
     }
+    return 'playlist_' + encodeURIComponent(library).replace(/[^A-Za-z0-9]/g, '_');
+}
+
+
+function loadPlaylist() {
+    var playlistCookie = getCookie(playlistCookieName());
+    playlistTracks = (playlistCookie != '' ? playlistCookie.split('|') : []);
 }
 
 
 function savePlaylist() {
-    setCookie('playlist', playlistTracks.join('|'), 365);
+    setCookie(playlistCookieName(), playlistTracks.join('|'), 365);
 }
 
 
@@ -353,22 +562,102 @@ function updateAllLists() {
 function setAndPlayTrack(track) {
     gebi('trackName').innerHTML = '&nbsp;' + getTrackTitle(track) + '<br>&nbsp;<smallPath>' + getTrackDir(track) + '</smallPath>';
     playingTrack = track;
-    player.src = "/audio/" + track;
+    player.src = "audio/" + encodeKey(track) + libraryQuery();
     player.play();
+    reportNowPlaying(track);
+    loadLyrics(track);
     updateAllLists();
 }
 
 
+function loadLyrics(track) {
+    lyricsLines = [];
+    lyricsShown = -1;
+    gebi('lyrics').style.display = 'none';
+    if (!window.fetch) {
+        return;
+    }
+    fetch('lyrics/' + encodeKey(track) + libraryQuery()).then(function(resp) {
+        return (resp.ok ? resp.json() : null);
+    }).then(function(lyr) {
+        if (!lyr || track != playingTrack) {
+            return;
+        }
+        lyricsLines = lyr.lines;
+        lyricsSynced = lyr.synced;
+        updateLyrics();
+    }).catch(function() {});
+}
+
+
+function updateLyrics() {
+    var box = gebi('lyrics');
+    if (lyricsLines.length == 0) {
+        return;
+    }
+    var cur = 0;
+    if (lyricsSynced) {
+        cur = -1;
+        while ((cur + 1 < lyricsLines.length) && (lyricsLines[cur + 1].time <= player.currentTime)) {
+            cur++;
+        }
+    }
+    if (cur == lyricsShown) {
+        return;
+    }
+    lyricsShown = cur;
+    var text = '';
+    if (!lyricsSynced) {
+        text = lyricsLines.map(function(l) { return escapeHtml(l.text); }).join('<br>');
+    } else if (cur >= 0) {
+        text = '<span class="lyricsCurrent">' + escapeHtml(lyricsLines[cur].text) + '</span>';
+        if (cur + 1 < lyricsLines.length) {
+            text += '<br>' + escapeHtml(lyricsLines[cur + 1].text);
+        }
+    }
+    box.innerHTML = text;
+    box.style.display = (text == '' ? 'none' : 'block');
+}
+
+
+function escapeHtml(text) {
+    return text.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+}
+
+
+function noteDurations(tracks, durations, prefix) {
+    if (!durations) {
+        return;
+    }
+    for (var i = 0; i < tracks.length; i++) {
+        if (durations[i] > 0) {
+            trackDurations[prefix + tracks[i]] = durations[i];
+        }
+    }
+}
+
+
+function trackLength(track) {
+    var secs = trackDurations[track];
+    return (secs ? ' <smallPath>' + secondsToTime(secs) + '</smallPath>' : '');
+}
+
+
+// encodeKey percent-encodes each segment of a key for use in a URL path, so names
+// with #, ?, % or + reach the server intact
+function encodeKey(track) {
+    return track.split('/').map(encodeURIComponent).join('/');
+}
 function getTrackTitle(track) {
     var name = track.split('/').pop();
     name = name.replace(new RegExp('_', 'g'), ' ');
     name = name.substr(0, name.lastIndexOf('.'));
-    return name;
+    return escapeHtml(name);
 }
 
 
 function getTrackDir(track) {
-    track = 'Home/' + track.replace(new RegExp('_', 'g'), ' ');
+    track = 'Home/' + escapeHtml(track.replace(new RegExp('_', 'g'), ' '));
     var dirStr = track.split('/');
     var tmp = dirStr.pop();
     return dirStr.join(' &#10137; ');
@@ -377,18 +666,26 @@ function getTrackDir(track) {
 
 function updateBrowser() {
     var list = '';
-    list += '<div class="pathContainer"><div class="browserPath" onClick="browseDir()">&nbsp;Home&nbsp;</div>';
+    list += '<div class="pathContainer">';
+    if (libraries.length > 1) {
+        list += '<select class="librarySelect" onChange="selectLibrary(this.value)">';
+        for (var i = 0; i < libraries.length; i++) {
+            list += '<option value="' + libraries[i] + '"' + (libraries[i] == library ? ' selected' : '') + '>' + libraries[i] + '</option>';
+        }
+        list += '</select>';
+    }
+    list += '<div class="browserPath" onClick="browseDir()">&nbsp;Home&nbsp;</div>';
     for (var i = 0; i < browserCurDirs.length; i++) {
-        list += '<div class="browserPath" onClick="browseDirFromBreadCrumbBar(' + i + ')">&nbsp;' + browserCurDirs[i] + '&nbsp;</div>';
+        list += '<div class="browserPath" onClick="browseDirFromBreadCrumbBar(' + i + ')">&nbsp;' + escapeHtml(browserCurDirs[i]) + '&nbsp;</div>';
     }
     list += '</div>';
     for (var i = 0; i < browserDirs.length; i++) {
-        list += '<div class="listContainer"><div class="browserDir" onClick="browseDir(' + i + ')">&nbsp;' + browserDirs[i] + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(browserCurDir) + '</smallPath></div></div>';
+        list += '<div class="listContainer"><div class="browserDir" onClick="browseDir(' + i + ')">&nbsp;' + escapeHtml(browserDirs[i]) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(browserCurDir) + '</smallPath></div></div>';
     }
     var playlistCount;
     for (var i = 0; i < browserTitles.length; i++) {
         playlistCount = inPlaylist(browserCurDir + browserTitles[i]);
-        list += '<div class="listContainer"><div class="' + (playingTrack == browserCurDir + browserTitles[i] ? 'browserTitleHL' : 'browserTitle') + '" onClick="setTrackFromBrowser(' + i + ')">&nbsp;' + getTrackTitle(browserTitles[i]) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(browserCurDir) + '</smallPath></div><div class="browserAction" onClick="' + (playlistCount > 0 ? 'removeBrowserTrackFromPlaylist' : 'addTrackFromBrowser') + '(' + i + ')">' + (playlistCount > 0 ? '<div class="mark">&#9733;</div>' : '&nbsp;') + '</div></div>';
+        list += '<div class="listContainer"><div class="' + (playingTrack == browserCurDir + browserTitles[i] ? 'browserTitleHL' : 'browserTitle') + '" onClick="setTrackFromBrowser(' + i + ')">&nbsp;' + getTrackTitle(browserTitles[i]) + trackLength(browserCurDir + browserTitles[i]) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(browserCurDir) + '</smallPath></div><div class="browserAction" onClick="' + (playlistCount > 0 ? 'removeBrowserTrackFromPlaylist' : 'addTrackFromBrowser') + '(' + i + ')">' + (playlistCount > 0 ? '<div class="mark">&#9733;</div>' : '&nbsp;') + '</div></div>';
     }
     gebi('frameBrowser').innerHTML = list;
 }
@@ -405,7 +702,7 @@ function updatePlaylist() {
     list += '</div></div>';
     list += '<div class="listContainer"><div class="browserDir" onClick="showFolderSelectDialog()">&nbsp;Add All MP3 Files to Playlist</div></div>';
     for (var i = 0; i < playlistTracks.length; i++) {
-        list += '<div class="listContainer"><div class="' + (playingTrack == playlistTracks[i] ? 'browserTitleHL' : 'browserTitle') + '" onClick="setTrackFromPlaylist(' + i + ');player.play()">&nbsp;' + getTrackTitle(playlistTracks[i]) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(playlistTracks[i]) + '</smallPath></div><div class="browserAction" onClick="removeTrack(' + i + ')"><div class="mark">&#9733;</div></div></div>';
+        list += '<div class="listContainer"><div class="' + (playingTrack == playlistTracks[i] ? 'browserTitleHL' : 'browserTitle') + '" onClick="setTrackFromPlaylist(' + i + ');player.play()">&nbsp;' + getTrackTitle(playlistTracks[i]) + trackLength(playlistTracks[i]) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(playlistTracks[i]) + '</smallPath></div><div class="browserAction" onClick="removeTrack(' + i + ')"><div class="mark">&#9733;</div></div></div>';
     }
     gebi('framePlaylist').innerHTML = list;
 }
@@ -415,12 +712,15 @@ function updateSearch(action) {
     if (action != undefined) {
         searchAction = action;
     }
-    var list = '<div class="pathContainer"><div class="browserPath">&nbsp;<input class="inp" value="' + (searchAction == 'clear' ? '' : searchString) + '" id="searchStr" name="searchStr" type="text"></div><div class="browserPath" onClick="searchString=gebi(\'searchStr\').value; searchForTitle(searchString); updateSearch(\'search\')"><div class="third">Title</div></div><div class="browserPath" onClick="searchString=gebi(\'searchStr\').value; searchForDir(searchString); updateSearch(\'search\')"><div class="third">Directory</div></div></div>';
+    var list = '<div class="pathContainer"><div class="browserPath">&nbsp;<input class="inp" value="' + (searchAction == 'clear' ? '' : escapeHtml(searchString).replace(/"/g, '&quot;')) + '" id="searchStr" name="searchStr" type="text"></div><div class="browserPath" onClick="searchString=gebi(\'searchStr\').value; searchForTitle(searchString); updateSearch(\'search\')"><div class="third">Title</div></div><div class="browserPath" onClick="searchString=gebi(\'searchStr\').value; searchForDir(searchString); updateSearch(\'search\')"><div class="third">Directory</div></div></div>';
+    if (searchScope != '' || (browserCurDir !== undefined && browserCurDir != '')) {
+        list += '<div class="listContainer"><div class="browserDir" onClick="toggleSearchScope()">&nbsp;' + (searchScope != '' ? '&#9745; Titles only in ' + escapeHtml(searchScope) : '&#9744; Titles only in ' + escapeHtml(browserCurDir)) + '</div></div>';
+    }
     list += '<div class="listContainer"><div class="browserDir" onClick="updateSearch(\'clear\')">';
     if (searchAction == 'dir') {
-        list += '&nbsp;Directory search result: ' + String(searchDirs.length);
+        list += '&nbsp;Directory search result: ' + resultCount(searchDirs.length, searchTotal);
     } else if (searchAction == 'title') {
-        list += '&nbsp;Title search result: ' + String(searchDirTracks.length);
+        list += '&nbsp;Title search result: ' + resultCount(searchDirTracks.length, searchTotal);
     } else if (searchAction == 'search') {
         list += '&nbsp;Searching...';
         searchDirs = [];
@@ -434,17 +734,62 @@ function updateSearch(action) {
     }
     list += '</div></div>';
     for (var i = 0; i < searchDirs.length; i++) {
-        list += '<div class="listContainer"><div class="browserDir" onClick="browseDirByStr(searchDirs[' + i + '])">&nbsp;' + searchDirs[i].split('/').pop() + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(searchDirs[i]) + '</smallPath></div></div>';
+        list += '<div class="listContainer"><div class="browserDir" onClick="browseDirByStr(searchDirs[' + i + '])">&nbsp;' + escapeHtml(searchDirs[i].split('/').pop()) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(searchDirs[i]) + '</smallPath></div></div>';
     }
     var playlistCount;
     for (var i = 0; i < searchDirTracks.length; i++) {
         playlistCount = inPlaylist(searchDirTracks[i]);
-        list += '<div class="listContainer"><div class="' + (playingTrack == searchDirTracks[i] ? 'browserTitleHL' : 'browserTitle') + '" onClick="setTrackFromSearch(' + i + ',true)">&nbsp;' + getTrackTitle(searchDirTracks[i]) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(searchDirTracks[i]) + '</smallPath></div><div class="browserAction" onClick="' + (playlistCount > 0 ? 'removeSearchTrackFromPlaylist' : 'addTrackFromSearch') + '(' + i + ')">' + (playlistCount > 0 ? '<div class="mark">&#9733;</div>' : '&nbsp;') + '</div></div>';
+        list += '<div class="listContainer"><div class="' + (playingTrack == searchDirTracks[i] ? 'browserTitleHL' : 'browserTitle') + '" onClick="setTrackFromSearch(' + i + ',true)">&nbsp;' + getTrackTitle(searchDirTracks[i]) + trackLength(searchDirTracks[i]) + '&nbsp;<br>&nbsp;<smallPath>' + getTrackDir(searchDirTracks[i]) + searchTagLine(searchDirTracks[i]) + '</smallPath></div><div class="browserAction" onClick="' + (playlistCount > 0 ? 'removeSearchTrackFromPlaylist' : 'addTrackFromSearch') + '(' + i + ')">' + (playlistCount > 0 ? '<div class="mark">&#9733;</div>' : '&nbsp;') + '</div></div>';
     }
     gebi('frameSearch').innerHTML = list;
 }
 
 
+// searchTagLine shows the tags of a result of a search with tag filters, with the
+// parts the filters matched marked
+function searchTagLine(track) {
+    var hit = searchTags[track];
+    if (!hit) {
+        return '';
+    }
+    var parts = [];
+    var fields = ['title', 'artist', 'albumArtist', 'album', 'year', 'genre'];
+    for (var i = 0; i < fields.length; i++) {
+        var value = hit[fields[i]] ? String(hit[fields[i]]) : '';
+        var spans = hit.matches[fields[i]] || [];
+        if (value == '' || (fields[i] == 'title' || fields[i] == 'albumArtist') && spans.length == 0) {
+            continue;
+        }
+        parts.push(markSpans(value, spans));
+    }
+    return parts.length > 0 ? ' &middot; ' + parts.join(' &middot; ') : '';
+}
+
+
+// markSpans escapes text and marks the [start, end) spans, which must not overlap
+function markSpans(text, spans) {
+    spans = spans.slice().sort(function(a, b) { return a[0] - b[0]; });
+    var out = '';
+    var at = 0;
+    for (var i = 0; i < spans.length; i++) {
+        if (spans[i][0] < at) {
+            continue;
+        }
+        out += escapeHtml(text.substring(at, spans[i][0])) + '<mark>' + escapeHtml(text.substring(spans[i][0], spans[i][1])) + '</mark>';
+        at = spans[i][1];
+    }
+    return out + escapeHtml(text.substring(at));
+}
+
+
+function resultCount(shown, total) {
+    if (total > shown) {
+        return String(shown) + ' of ' + String(total);
+    }
+    return String(shown);
+}
+
+
 function inPlaylist(track) {
     var number = 0;
     for (var i = 0; i < playlistTracks.length; i++) {
@@ -457,17 +802,36 @@ function inPlaylist(track) {
 
 
 function addTrackFromBrowser(id) {
+    if (kioskMode) {
+        kioskEnqueue(browserCurDir + browserTitles[id]);
+        return;
+    }
     playlistTracks[playlistTracks.length] = browserCurDir + browserTitles[id];
     updateAllLists();
 }
 
 
 function addTrackFromSearch(id) {
+    if (kioskMode) {
+        kioskEnqueue(searchDirTracks[id]);
+        return;
+    }
     playlistTracks[playlistTracks.length] = searchDirTracks[id];
     updateAllLists();
 }
 
 
+function kioskEnqueue(track) {
+    fetch('kiosk/queue' + libraryQuery(), {method: 'POST', headers: {'Content-Type': 'application/json'}, body: JSON.stringify({track: track})}).then(function(resp) {
+        return resp.json();
+    }).then(function(res) {
+        alert(res.error ? 'Not queued: ' + res.error : track.split('/').pop() + ' is number ' + res.position + ' in the queue');
+    }).catch(function() {
+        alert('Server not responding');
+    });
+}
+
+
 function clearPlaylist() {
     if (confirm('Clear Playlist?') == true) {
         playlistTracks = [];
@@ -484,6 +848,8 @@ function playerStop() {
         updateProgressBar();
         markPlayingTab('');
         playingTrack = '';
+        lyricsLines = [];
+        gebi('lyrics').style.display = 'none';
     } else {
         player.pause();
         player.currentTime = 0;
@@ -524,10 +890,21 @@ function removeTrack(id) {
 
 function searchForTitle(search) {
     markLoading('search');
+    if (searchScope != '') {
+        loadFromServer('searchTitleIn', JSON.stringify({query: search, folders: [searchScope]}));
+        return;
+    }
     loadFromServer('searchTitle', search);
 }
 
 
+// toggleSearchScope limits title searches to the folder open in the browser
+function toggleSearchScope() {
+    searchScope = (searchScope == '' ? browserCurDir : '');
+    updateSearch();
+}
+
+
 function searchForDir(search) {
     markLoading('search');
     loadFromServer('searchDir', search);
@@ -573,15 +950,26 @@ function getPlayingDir() {
 }
 
 
-function loadFromServer(param, varia) {
+function loadFromServer(param, varia, offset) {
     dataframeTime = 15;
     loading = true;
+    lastRequestFunc = param;
+    lastRequestData = varia;
+    gebi('dfversion').value = PROTOCOL_VERSION;
     gebi('dffunc').value = param;
     gebi('dfdata').value = varia;
+    gebi('dfoffset').value = (offset === undefined ? '' : offset);
     gebi('dfform').submit();
 }
 
 
+function requestError(data) {
+    loading = false;
+    markLoading(false);
+    alert(data[1]);
+}
+
+
 function checkDataframe() {
     if (loading) {
         if (dataframeTime > 0) {
@@ -720,14 +1108,33 @@ function getAllDirsData(data) {
 function getAllMp3Data(data) {
     loading = false;
     markLoading(false);
-    if (data[0] == 'ok') {
+    if (data[0] == 'ok' || data[0] == 'partial') {
+        if (data[0] == 'partial' && (!data[2] || !data[2].offset)) {
+            alert('Some folders could not be loaded:\n' + failedFolders(data[4]));
+        }
+        noteDurations(data[1], data[3], '');
         for (var i = 0; i < data[1].length; i++) {
             if (inPlaylist(data[1][i]) === 0) {
                 playlistTracks.push(data[1][i]);
             }
         }
         updateAllLists();
+        if (data[2] && data[2].truncated) {
+            // Fetch the next page of a large result
+            markLoading('browser');
+            loadFromServer(lastRequestFunc, lastRequestData, data[2].nextOffset);
+        }
     } else {
-        alert('Failed to add files: ' + data[1]);
+        alert('Failed to add files: ' + data[1] + (data[2] ? '\n' + failedFolders(data[2]) : ''));
+    }
+}
+
+function failedFolders(results) {
+    var lines = [];
+    for (var i = 0; i < results.length; i++) {
+        if (results[i].error) {
+            lines.push((results[i].folder || '/') + ': ' + results[i].error);
+        }
     }
+    return lines.join('\n');
 }
@@ -0,0 +1,4 @@
+// Starts Swagger UI on the OpenAPI document next to the docs page
+(function() {
+    SwaggerUIBundle({url: 'openapi.json', dom_id: '#swagger-ui'});
+})();
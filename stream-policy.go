@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Streaming strategies selectable per file extension
+const (
+	STREAM_DIRECT    = "direct"    // serve the object as stored (default)
+	STREAM_TRANSCODE = "transcode" // re-encode to MP3 with ffmpeg
+	STREAM_REMUX     = "remux"     // drop video and copy the audio into fragmented MP4
+	STREAM_BLOCK     = "block"     // refuse to stream
+)
+
+const DEFAULT_TRANSCODE_BITRATE = "192k"
+
+// STREAM_POLICY maps extensions to strategies, e.g. "wav=transcode,mp4=block"
+var (
+	streamPolicies   = map[string]string{}
+	ffmpegPath       = os.Getenv("FFMPEG_PATH")
+	transcodeBitrate = os.Getenv("TRANSCODE_BITRATE")
+)
+
+func initStreamPolicies() error {
+	needsFFmpeg := false
+	for _, item := range splitList(os.Getenv("STREAM_POLICY")) {
+		ext, strategy, ok := strings.Cut(item, "=")
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		strategy = strings.TrimSpace(strategy)
+		if !ok || ext == "" {
+			return fmt.Errorf("invalid STREAM_POLICY entry %q, expected ext=strategy", item)
+		}
+		switch strategy {
+		case STREAM_DIRECT, STREAM_BLOCK:
+		case STREAM_TRANSCODE, STREAM_REMUX:
+			needsFFmpeg = true
+		default:
+			return fmt.Errorf("invalid STREAM_POLICY strategy %q for .%s", strategy, ext)
+		}
+		streamPolicies["."+ext] = strategy
+	}
+	if transcodeBitrate == "" {
+		transcodeBitrate = DEFAULT_TRANSCODE_BITRATE
+	}
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	path, err := exec.LookPath(ffmpegPath)
+	if err != nil {
+		if needsFFmpeg {
+			return fmt.Errorf("STREAM_POLICY needs ffmpeg: %w", err)
+		}
+		// Without ffmpeg, trim points are ignored and tracks stream as stored
+		ffmpegPath = ""
+		return nil
+	}
+	ffmpegPath = path
+	return nil
+}
+
+// streamPolicy returns the strategy configured for the extension of key
+func streamPolicy(key string) string {
+	if strategy, ok := streamPolicies[strings.ToLower(filepath.Ext(key))]; ok {
+		return strategy
+	}
+	return STREAM_DIRECT
+}
+
+// convertedContentType is the type streamConverted produces for a strategy
+func convertedContentType(strategy string) string {
+	if strategy == STREAM_REMUX {
+		return "audio/mp4"
+	}
+	return "audio/mpeg"
+}
+
+// servedContentType is the type handleAudio serves key with, and whether it streams
+// the stored object (so byte ranges work) rather than a conversion
+func servedContentType(lib *library, key string) (string, bool) {
+	policy := streamPolicy(key)
+	if _, trimmed := trims.get(lib, key); trimmed && ffmpegPath != "" && policy == STREAM_DIRECT {
+		policy = STREAM_TRANSCODE // as served by handleAudio
+	}
+	if policy != STREAM_DIRECT {
+		return convertedContentType(policy), false
+	}
+	if ctype := mime.TypeByExtension(filepath.Ext(key)); ctype != "" {
+		return ctype, true
+	}
+	return "audio/mpeg", true
+}
+
+// transcodeCacheKey identifies the converted output of one object version, or is
+// empty when the transcode cache is off
+func transcodeCacheKey(ctx context.Context, key, strategy string, trim *trimPoint, gain float64) string {
+	if transcodeCache == nil {
+		return ""
+	}
+	etag, _, _, err := s3HeadAudioFile(ctx, key)
+	if err != nil {
+		return ""
+	}
+	k := fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s", libraryFrom(ctx).Name, key, etag, strategy, transcodeBitrate)
+	if trim != nil {
+		k += fmt.Sprintf("\x00%g-%g", trim.Start, trim.End)
+	}
+	if gain != 0 {
+		k += fmt.Sprintf("\x00%gdB", gain)
+	}
+	return k
+}
+
+// serveCachedTranscode serves converted output from the transcode cache; unlike a
+// live conversion it supports range requests
+func serveCachedTranscode(c *gin.Context, key, strategy string, data []byte) {
+	c.Header("Content-Type", convertedContentType(strategy))
+	http.ServeContent(c.Writer, c.Request, key, time.Time{}, throttleReadSeeker(bytes.NewReader(data)))
+}
+
+// streamConverted pipes src through ffmpeg and streams the output, cut to trim
+// when set and amplified by gain dB. The result length isn't known up front, so range
+// requests aren't supported. A complete conversion is stored in the transcode cache
+// under cacheKey when that is set.
+func streamConverted(c *gin.Context, src io.ReadCloser, strategy string, trim *trimPoint, gain float64, cacheKey string) {
+	defer src.Close()
+	args := []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn"}
+	if trim != nil {
+		args = append(args, "-ss", strconv.FormatFloat(trim.Start, 'f', 3, 64))
+		if trim.End > 0 {
+			args = append(args, "-t", strconv.FormatFloat(trim.End-trim.Start, 'f', 3, 64))
+		}
+	}
+	if gain != 0 && strategy == STREAM_TRANSCODE {
+		args = append(args, "-af", fmt.Sprintf("volume=%.2fdB", gain))
+	}
+	if strategy == STREAM_REMUX {
+		args = append(args, "-c:a", "copy", "-f", "mp4", "-movflags", "frag_keyframe+empty_moov")
+	} else {
+		args = append(args, "-c:a", "libmp3lame", "-b:a", transcodeBitrate, "-f", "mp3")
+	}
+	args = append(args, "pipe:1")
+
+	cmd := exec.CommandContext(c.Request.Context(), ffmpegPath, args...)
+	cmd.Stdin = src
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Conversion failed")
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("ffmpeg start error: %v", err)
+		c.String(http.StatusInternalServerError, "Conversion failed")
+		return
+	}
+	var captured *captureReader
+	var body io.Reader = out
+	if cacheKey != "" {
+		captured = &captureReader{r: out, limit: transcodeCache.Stats().MaxBytes}
+		body = captured
+	}
+	c.Header("Accept-Ranges", "none")
+	c.DataFromReader(http.StatusOK, -1, convertedContentType(strategy), throttleReadCloser(io.NopCloser(body)), nil)
+	err = cmd.Wait()
+	if err != nil && c.Request.Context().Err() == nil {
+		log.Printf("ffmpeg %s error: %v %s", strategy, err, strings.TrimSpace(stderr.String()))
+	}
+	if captured != nil && err == nil && captured.complete() {
+		transcodeCache.Set(cacheKey, captured.buf.Bytes())
+	}
+}
+
+// captureReader keeps a copy of what passes through, up to limit bytes
+type captureReader struct {
+	r        io.Reader
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	eof      bool
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 && !cr.overflow {
+		if int64(cr.buf.Len()+n) > cr.limit {
+			cr.overflow = true
+			cr.buf = bytes.Buffer{}
+		} else {
+			cr.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		cr.eof = true
+	}
+	return n, err
+}
+
+// complete reports whether the whole output was read and fits the cache
+func (cr *captureReader) complete() bool {
+	return cr.eof && !cr.overflow
+}
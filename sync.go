@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	SYNC_CLIENT_BUFFER  = 16               // messages queued per connection before dropping
+	SYNC_PING_INTERVAL  = 30 * time.Second // keeps proxies from closing idle connections
+	SYNC_WRITE_TIMEOUT  = 10 * time.Second
+	MAX_SYNC_MESSAGE    = 4096
+	MAX_SYNC_DEVICE_LEN = 64
+)
+
+// syncCommands are the commands a remote control may send to a player
+var syncCommands = map[string]bool{"play": true, "pause": true, "next": true, "previous": true, "seek": true}
+
+// syncMessage is exchanged over /ws. Players send "nowplaying", "position" and "finished", remote
+// controls send "command"; the server adds "queue", "devices" and "ping". Members of a
+// party session send "party" with its code to follow it, and get "party" with its state
+// on every change and the host's "position" reports.
+type syncMessage struct {
+	Type     string   `json:"type"`
+	Device   string   `json:"device,omitempty"`
+	Track    string   `json:"track,omitempty"`
+	Library  string   `json:"library,omitempty"`
+	Position *float64 `json:"position,omitempty"`
+	Duration *float64 `json:"duration,omitempty"`
+	Paused   *bool    `json:"paused,omitempty"`
+	Command  string   `json:"command,omitempty"`
+	Target   string   `json:"target,omitempty"` // device a command is for, empty for every other device
+	Queue    gin.H    `json:"queue,omitempty"`
+	Devices  []string `json:"devices,omitempty"`
+	Code     string   `json:"code,omitempty"`  // party session
+	Party    gin.H    `json:"party,omitempty"` // party session state, none when it ended
+	Time     int64    `json:"time,omitempty"`
+}
+
+type syncClient struct {
+	user   string
+	access []string // folders the connection is limited to, nil when it isn't
+	device string
+	addr   string
+	since  time.Time
+	send   chan syncMessage
+	party  string // code of the followed party session, guarded by parties.mu
+}
+
+// deliver queues a message; a slow connection misses messages rather than block, and
+// one limited to some folders misses the tracks outside them
+func (cl *syncClient) deliver(msg syncMessage) {
+	if !trackVisibleTo(cl.access, msg.Library, msg.Track) {
+		return
+	}
+	select {
+	case cl.send <- msg:
+	default:
+	}
+}
+
+// syncHub relays playback state between the connected devices of each user
+type syncHub struct {
+	mu      sync.Mutex
+	clients map[string]map[*syncClient]struct{}
+	state   map[string]map[string]syncMessage // last playback state per user and device
+	seq     int
+}
+
+var syncClients = &syncHub{
+	clients: make(map[string]map[*syncClient]struct{}),
+	state:   make(map[string]map[string]syncMessage),
+}
+
+// attach forwards plays and queue changes that name a user to that user's devices
+func (h *syncHub) attach(bus *EventBus) {
+	bus.Subscribe("sync", EVENT_PLAY_STARTED, func(ev Event) {
+		user, _ := ev.Data["user"].(string)
+		if user == "" {
+			return
+		}
+		msg := syncMessage{Type: "nowplaying", Time: ev.Time.Unix()}
+		msg.Device, _ = ev.Data["device"].(string)
+		msg.Track, _ = ev.Data["track"].(string)
+		msg.Library, _ = ev.Data["library"].(string)
+		h.record(user, msg)
+		h.broadcast(user, msg, nil)
+	})
+	bus.Subscribe("sync", EVENT_QUEUE_CHANGED, func(ev Event) {
+		if user, _ := ev.Data["user"].(string); user != "" {
+			h.broadcast(user, syncMessage{Type: "queue", Queue: queueResponse(user, playQueues.get(user))}, nil)
+		}
+	})
+}
+
+// record keeps the latest state of a device, merging position updates into its last play
+func (h *syncHub) record(user string, msg syncMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state[user] == nil {
+		h.state[user] = make(map[string]syncMessage)
+	}
+	prev, ok := h.state[user][msg.Device]
+	if msg.Type == "position" && ok && msg.Track == "" {
+		msg.Track, msg.Library = prev.Track, prev.Library
+	}
+	msg.Type = "nowplaying"
+	if msg.Time == 0 {
+		msg.Time = time.Now().Unix()
+	}
+	h.state[user][msg.Device] = msg
+}
+
+// broadcast sends msg to the user's connections except skip
+func (h *syncHub) broadcast(user string, msg syncMessage, skip *syncClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for cl := range h.clients[user] {
+		if cl != skip && (msg.Target == "" || msg.Target == cl.device) {
+			cl.deliver(msg)
+		}
+	}
+}
+
+// devices lists the connected device names of a user; the caller holds h.mu
+func (h *syncHub) devices(user string) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for cl := range h.clients[user] {
+		if !seen[cl.device] {
+			seen[cl.device] = true
+			names = append(names, cl.device)
+		}
+	}
+	sortNames(names)
+	return names
+}
+
+// sessions lists the open connections of every user
+func (h *syncHub) sessions() []gin.H {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []gin.H{}
+	for user, clients := range h.clients {
+		for cl := range clients {
+			out = append(out, gin.H{"user": user, "device": cl.device, "ip": cl.addr, "since": cl.since.UTC().Format(time.RFC3339)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["since"].(string) < out[j]["since"].(string) })
+	return out
+}
+
+// join registers a connection and sends it the queue and what the other devices play
+func (h *syncHub) join(cl *syncClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[cl.user] == nil {
+		h.clients[cl.user] = make(map[*syncClient]struct{})
+	}
+	h.clients[cl.user][cl] = struct{}{}
+	cl.deliver(syncMessage{Type: "queue", Queue: queueResponse(cl.user, playQueues.get(cl.user))})
+	for device, st := range h.state[cl.user] {
+		if device != cl.device {
+			cl.deliver(st)
+		}
+	}
+	h.announceDevices(cl.user)
+}
+
+func (h *syncHub) leave(cl *syncClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients[cl.user], cl)
+	if len(h.clients[cl.user]) == 0 {
+		delete(h.clients, cl.user)
+	}
+	// A device that is gone no longer plays anything
+	if !h.connected(cl.user, cl.device) {
+		delete(h.state[cl.user], cl.device)
+		if len(h.state[cl.user]) == 0 {
+			delete(h.state, cl.user)
+		}
+	}
+	h.announceDevices(cl.user)
+}
+
+// connected reports whether a device still has a connection; the caller holds h.mu
+func (h *syncHub) connected(user, device string) bool {
+	for cl := range h.clients[user] {
+		if cl.device == device {
+			return true
+		}
+	}
+	return false
+}
+
+// announceDevices tells a user's connections which devices are online; the caller holds h.mu
+func (h *syncHub) announceDevices(user string) {
+	msg := syncMessage{Type: "devices", Devices: h.devices(user)}
+	for cl := range h.clients[user] {
+		cl.deliver(msg)
+	}
+}
+
+// handle processes a message received from a device
+func (h *syncHub) handle(cl *syncClient, msg syncMessage) {
+	msg.Device = cl.device
+	msg.Queue, msg.Devices, msg.Party = nil, nil, nil
+	switch msg.Type {
+	case "nowplaying":
+		// Published on the bus like dffunc plays, which delivers it back to every device
+		if msg.Track == "" {
+			return
+		}
+		eventBus.Publish(EVENT_PLAY_STARTED, map[string]interface{}{"user": cl.user, "device": cl.device, "track": msg.Track, "library": msg.Library, "time": time.Now().Unix()})
+	case "finished":
+		if msg.Track != "" {
+			eventBus.Publish(EVENT_PLAY_FINISHED, map[string]interface{}{"user": cl.user, "device": cl.device, "track": msg.Track, "library": msg.Library, "time": time.Now().Unix()})
+			parties.finished(cl, msg)
+		}
+	case "party":
+		if err := parties.follow(cl, strings.ToUpper(strings.TrimSpace(msg.Code))); err != nil {
+			cl.deliver(syncMessage{Type: "error", Code: msg.Code})
+		}
+	case "position":
+		if msg.Position == nil {
+			return
+		}
+		parties.position(cl, msg)
+		msg.Time = time.Now().Unix()
+		h.record(cl.user, msg)
+		msg.Target = ""
+		h.broadcast(cl.user, msg, cl)
+	case "command":
+		if !syncCommands[msg.Command] {
+			cl.deliver(syncMessage{Type: "error", Command: msg.Command})
+			return
+		}
+		h.broadcast(cl.user, msg, cl)
+	}
+}
+
+// serve runs one connection until the device disconnects
+func (h *syncHub) serve(ws *websocket.Conn, user string, access []string, device, addr string) {
+	defer ws.Close()
+	ws.MaxPayloadBytes = MAX_SYNC_MESSAGE
+	h.mu.Lock()
+	h.seq++
+	if device == "" {
+		device = "device " + strconv.Itoa(h.seq)
+	}
+	h.mu.Unlock()
+	cl := &syncClient{user: user, access: access, device: device, addr: addr, since: time.Now(), send: make(chan syncMessage, SYNC_CLIENT_BUFFER)}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(SYNC_PING_INTERVAL)
+		defer ping.Stop()
+		for {
+			var msg syncMessage
+			select {
+			case <-done:
+				return
+			case msg = <-cl.send:
+			case <-ping.C:
+				msg = syncMessage{Type: "ping"}
+			}
+			ws.SetWriteDeadline(time.Now().Add(SYNC_WRITE_TIMEOUT))
+			if err := websocket.JSON.Send(ws, msg); err != nil {
+				ws.Close() // ends the read loop below
+				return
+			}
+		}
+	}()
+	h.join(cl)
+	defer h.leave(cl)
+	defer parties.unfollow(cl)
+	for {
+		var msg syncMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		h.handle(cl, msg)
+	}
+}
+
+// syncHandshake accepts same-origin pages, clients without an Origin and CORS_ALLOWED_ORIGINS
+func syncHandshake(_ *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" || corsOriginAllowed(origin) {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return nil
+	}
+	return errors.New("origin not allowed")
+}
+
+// handleSync connects a device to the user's now-playing sync (GET /ws?user=&device=)
+func handleSync(c *gin.Context) {
+	user, addr := requestUser(c), c.ClientIP()
+	access, _ := requestAccess(c)
+	device := strings.TrimSpace(c.Query("device"))
+	if len(device) > MAX_SYNC_DEVICE_LEN {
+		device = device[:MAX_SYNC_DEVICE_LEN]
+	}
+	websocket.Server{
+		Handshake: syncHandshake,
+		Handler:   func(ws *websocket.Conn) { syncClients.serve(ws, user, access, device, addr) },
+	}.ServeHTTP(c.Writer, c.Request)
+}
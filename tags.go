@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TAGS_OBJECT     = "tags.json"
+	TAGS_SAVE_EVERY = 500       // read tracks between intermediate saves
+	TAGS_HEAD_BYTES = 256 << 10 // read from the start of FLAC and Ogg files for their comments
+	MAX_TAG_VALUE   = 1024      // longer values are cut
+)
+
+// Tag scanning: TAG_SCAN=true reads the title, artist, album artist, album, genre,
+// year and track number tags of new and changed tracks at startup and every
+// TAG_SCAN_INTERVAL. MP3 (ID3v2, ID3v1), FLAC and Ogg Vorbis/Opus are read.
+var (
+	tagScan         = os.Getenv("TAG_SCAN") == "true"
+	tagScanInterval time.Duration
+)
+
+func initTagScan() error {
+	if v := os.Getenv("TAG_SCAN_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid TAG_SCAN_INTERVAL: %q", v)
+		}
+		tagScanInterval = d
+	}
+	return nil
+}
+
+// trackTags are the tags of one object version
+type trackTags struct {
+	ETag        string `json:"etag,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Artist      string `json:"artist,omitempty"`
+	AlbumArtist string `json:"albumArtist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Track       int    `json:"track,omitempty"`
+	Disc        int    `json:"disc,omitempty"`
+	Compilation bool   `json:"compilation,omitempty"`
+	Failed      bool   `json:"failed,omitempty"`
+	// Set from fingerprinting when tags are read, never stored
+	RecordingID string `json:"recordingId,omitempty"`
+}
+
+// empty reports whether t names nothing to group or search by
+func (t trackTags) empty() bool {
+	return t.Title == "" && t.Artist == "" && t.AlbumArtist == "" && t.Album == ""
+}
+
+// identified completes t with what fingerprinting found; a manual correction replaces
+// the fields it sets
+func (t *trackTags) identified(m *trackMatch) {
+	set := func(dst *string, v string) {
+		if v != "" && (*dst == "" || m.Manual) {
+			*dst = v
+		}
+	}
+	set(&t.Title, m.Title)
+	set(&t.Artist, m.Artist)
+	set(&t.Album, m.Album)
+	if m.Year > 0 && (t.Year == 0 || m.Manual) {
+		t.Year = m.Year
+	}
+	t.RecordingID = m.RecordingID
+}
+
+// tagIndex holds the tags per library and key, persisted as one metadata object
+type tagIndex struct {
+	mu        sync.RWMutex
+	libraries map[string]map[string]trackTags
+	saveMu    sync.Mutex
+	scanning  atomic.Bool
+}
+
+var tagsIndex = &tagIndex{libraries: make(map[string]map[string]trackTags)}
+
+// load reads the index from the bucket; a missing object means nothing was read yet
+func (ti *tagIndex) load(ctx context.Context) error {
+	libs := make(map[string]map[string]trackTags)
+	if err := s3GetJSON(ctx, TAGS_OBJECT, &libs); err != nil {
+		if isNoSuchKey(err) {
+			return nil
+		}
+		return err
+	}
+	ti.mu.Lock()
+	ti.libraries = libs
+	ti.mu.Unlock()
+	return nil
+}
+
+func (ti *tagIndex) save(ctx context.Context) error {
+	ti.saveMu.Lock()
+	defer ti.saveMu.Unlock()
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	return s3PutJSON(ctx, TAGS_OBJECT, ti.libraries)
+}
+
+// get returns the tags of key in lib, completed by what fingerprinting identified
+func (ti *tagIndex) get(lib *library, key string) (trackTags, bool) {
+	ti.mu.RLock()
+	t := ti.libraries[lib.Name][key]
+	ti.mu.RUnlock()
+	if m := fingerprints.match(lib, key); m != nil {
+		t.identified(m)
+	}
+	return t, !t.empty()
+}
+
+// all returns the tags of every track of lib that has any
+func (ti *tagIndex) all(lib *library) map[string]trackTags {
+	ti.mu.RLock()
+	out := make(map[string]trackTags, len(ti.libraries[lib.Name]))
+	for key, t := range ti.libraries[lib.Name] {
+		out[key] = t
+	}
+	ti.mu.RUnlock()
+	for key, t := range out {
+		if m := fingerprints.match(lib, key); m != nil {
+			t.identified(m)
+		}
+		if t.empty() {
+			delete(out, key)
+		} else {
+			out[key] = t
+		}
+	}
+	return out
+}
+
+// rename moves the tags of a renamed object; the copy keeps the content
+func (ti *tagIndex) rename(lib *library, from, to string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if t, ok := ti.libraries[lib.Name][from]; ok {
+		ti.libraries[lib.Name][to] = t
+		delete(ti.libraries[lib.Name], from)
+	}
+}
+
+// status reports the tracks with tags per library
+func (ti *tagIndex) status() gin.H {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	libs := gin.H{}
+	for name, entries := range ti.libraries {
+		tagged := 0
+		for _, t := range entries {
+			if !t.empty() {
+				tagged++
+			}
+		}
+		libs[name] = gin.H{"tracks": len(entries), "tagged": tagged}
+	}
+	return gin.H{"scanning": ti.scanning.Load(), "libraries": libs}
+}
+
+// scan reads the tags of every new or changed object of lib and drops entries of deleted ones
+func (ti *tagIndex) scan(ctx context.Context, lib *library) (read, failed int, err error) {
+	ctx, err = s3Meter.guardScan(withLibrary(ctx, lib), "tags")
+	if err != nil {
+		return 0, 0, err
+	}
+	objects, err := s3ListAudioObjects(ctx, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	ti.mu.Lock()
+	old := ti.libraries[lib.Name]
+	fresh := make(map[string]trackTags, len(objects))
+	var todo []audioObject
+	for _, obj := range objects {
+		if t, ok := old[obj.Key]; ok && t.ETag == obj.ETag {
+			fresh[obj.Key] = t
+		} else {
+			todo = append(todo, obj)
+		}
+	}
+	ti.libraries[lib.Name] = fresh
+	ti.mu.Unlock()
+
+	var (
+		wg        sync.WaitGroup
+		done      atomic.Int64
+		failCount atomic.Int64
+	)
+	sem := make(chan struct{}, walkConcurrency)
+	for _, obj := range todo {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(obj audioObject) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t, err := readTags(ctx, obj)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				failCount.Add(1)
+				// Remember the failure so unchanged files aren't read again
+				t = trackTags{Failed: true}
+			}
+			t.ETag = obj.ETag
+			ti.mu.Lock()
+			ti.libraries[lib.Name][obj.Key] = t
+			ti.mu.Unlock()
+			if n := done.Add(1); n%TAGS_SAVE_EVERY == 0 {
+				log.Printf("Tag scan of %s: %d/%d tracks read", lib.Name, n, len(todo))
+				if err := ti.save(ctx); err != nil {
+					log.Printf("Tag index save error: %v", err)
+				}
+			}
+		}(obj)
+	}
+	wg.Wait()
+	if err := ti.save(context.WithoutCancel(ctx)); err != nil {
+		return int(done.Load()), int(failCount.Load()), err
+	}
+	return int(done.Load()), int(failCount.Load()), ctx.Err()
+}
+
+// scanAll scans every library unless a scan is already running
+func (ti *tagIndex) scanAll(ctx context.Context) {
+	if !ti.scanning.CompareAndSwap(false, true) {
+		return
+	}
+	defer ti.scanning.Store(false)
+	for _, lib := range libraries {
+		start := time.Now()
+		read, failed, err := ti.scan(ctx, lib)
+		if err != nil {
+			log.Printf("Tag scan of %s failed: %v", lib.Name, err)
+			continue
+		}
+		log.Printf("Tag scan of %s finished: %d tracks read (%d unreadable) in %s", lib.Name, read, failed, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// run loads the index, scans once and then every TAG_SCAN_INTERVAL
+func (ti *tagIndex) run(ctx context.Context) {
+	if err := ti.load(ctx); err != nil {
+		log.Printf("Failed to load tag index: %v", err)
+	}
+	if !tagScan {
+		return
+	}
+	ti.scanAll(ctx)
+	if tagScanInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(tagScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ti.scanAll(ctx)
+		}
+	}
+}
+
+// readTags reads the tags of an object; formats without a supported tag give none
+func readTags(ctx context.Context, obj audioObject) (trackTags, error) {
+	switch strings.ToLower(path.Ext(obj.Key)) {
+	case ".mp3":
+		tag, err := readID3Tag(ctx, obj.Key)
+		if err != nil {
+			return trackTags{}, err
+		}
+		if t := id3Tags(tag); !t.empty() {
+			return t, nil
+		}
+		if obj.Size < 128 {
+			return trackTags{}, nil
+		}
+		tail, err := s3GetRange(ctx, obj.Key, "bytes=-128")
+		if err != nil {
+			return trackTags{}, err
+		}
+		return id3v1Tags(tail), nil
+	case ".flac", ".ogg", ".oga", ".opus":
+		head, err := s3GetRange(ctx, obj.Key, fmt.Sprintf("bytes=0-%d", TAGS_HEAD_BYTES-1))
+		if err != nil {
+			return trackTags{}, err
+		}
+		return vorbisTags(head), nil
+	}
+	return trackTags{}, nil
+}
+
+var (
+	tagYear   = regexp.MustCompile(`\b(\d{4})\b`)
+	id3Genre  = regexp.MustCompile(`^\((\d+)\)`)
+	tagNumber = regexp.MustCompile(`^\s*(\d+)`)
+)
+
+// id3v1Genres are the genres ID3v1 numbers and ID3v2 may refer to as "(n)"
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// tagValue cleans up a tag value
+func tagValue(s string) string {
+	s = strings.TrimSpace(strings.Trim(s, "\x00"))
+	if len(s) > MAX_TAG_VALUE {
+		s = s[:MAX_TAG_VALUE]
+	}
+	return s
+}
+
+// genreName resolves ID3 genre references such as "(17)" or "17"
+func genreName(s string) string {
+	if m := id3Genre.FindStringSubmatch(s); m != nil {
+		if rest := strings.TrimSpace(s[len(m[0]):]); rest != "" {
+			return rest
+		}
+		s = m[1]
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n >= 0 && n < len(id3v1Genres) {
+			return id3v1Genres[n]
+		}
+		return ""
+	}
+	return s
+}
+
+// tagInt reads the leading number of values such as "3/12" or "1959-03-02"
+func tagInt(s string) int {
+	if m := tagNumber.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return 0
+}
+
+// set fills the field a tag name stands for; names are Vorbis comment field names
+func (t *trackTags) set(name, value string) {
+	value = tagValue(value)
+	if value == "" {
+		return
+	}
+	add := func(dst *string) {
+		if *dst == "" {
+			*dst = value
+		} else if !strings.Contains(*dst, value) {
+			*dst += "; " + value // multiple values
+		}
+	}
+	switch strings.ToUpper(name) {
+	case "TITLE":
+		add(&t.Title)
+	case "ARTIST":
+		add(&t.Artist)
+	case "ALBUMARTIST", "ALBUM ARTIST":
+		add(&t.AlbumArtist)
+	case "ALBUM":
+		add(&t.Album)
+	case "GENRE":
+		if g := genreName(value); g != "" {
+			value = g
+			add(&t.Genre)
+		}
+	case "DATE", "YEAR", "ORIGINALDATE":
+		if m := tagYear.FindStringSubmatch(value); m != nil && t.Year == 0 {
+			t.Year, _ = strconv.Atoi(m[1])
+		}
+	case "TRACKNUMBER":
+		t.Track = tagInt(value)
+	case "DISCNUMBER":
+		t.Disc = tagInt(value)
+	case "COMPILATION":
+		t.Compilation = value == "1" || strings.EqualFold(value, "true")
+	}
+}
+
+// id3FrameNames maps ID3v2.3/2.4 text frames to the Vorbis names set understands
+var id3FrameNames = map[string]string{
+	"TIT2": "TITLE", "TPE1": "ARTIST", "TPE2": "ALBUMARTIST", "TALB": "ALBUM", "TCON": "GENRE",
+	"TYER": "YEAR", "TDRC": "DATE", "TDOR": "ORIGINALDATE", "TRCK": "TRACKNUMBER", "TPOS": "DISCNUMBER", "TCMP": "COMPILATION",
+}
+
+// id3Tags reads the text frames of an ID3v2 tag; v2.4 separates multiple values with NULs
+func id3Tags(tag []byte) trackTags {
+	var t trackTags
+	ids := make([]string, 0, len(id3FrameNames))
+	for id := range id3FrameNames {
+		ids = append(ids, id)
+	}
+	for id, frame := range id3Frames(tag, ids...) {
+		if len(frame) < 2 {
+			continue
+		}
+		enc := frame[0]
+		rest := frame[1:]
+		for len(rest) > 0 {
+			var value []byte
+			value, rest = id3Cut(enc, rest)
+			t.set(id3FrameNames[id], id3Text(enc, value))
+		}
+	}
+	return t
+}
+
+// id3v1Tags reads the fixed-size tag in the last 128 bytes of an MP3
+func id3v1Tags(tail []byte) trackTags {
+	var t trackTags
+	if len(tail) != 128 || string(tail[:3]) != "TAG" {
+		return t
+	}
+	field := func(b []byte) string { return id3Text(0, bytes.TrimRight(b, "\x00 ")) }
+	t.set("TITLE", field(tail[3:33]))
+	t.set("ARTIST", field(tail[33:63]))
+	t.set("ALBUM", field(tail[63:93]))
+	t.set("YEAR", field(tail[93:97]))
+	if tail[125] == 0 && tail[126] != 0 {
+		t.Track = int(tail[126]) // ID3v1.1
+	}
+	if int(tail[127]) < len(id3v1Genres) {
+		t.Genre = id3v1Genres[tail[127]]
+	}
+	return t
+}
+
+// vorbisTags finds the Vorbis comment block of a FLAC file, or the comment header of
+// an Ogg Vorbis or Opus stream, in the start of the file
+func vorbisTags(head []byte) trackTags {
+	if bytes.HasPrefix(head, []byte("fLaC")) {
+		for b := head[4:]; len(b) >= 4; {
+			last, kind, n := b[0]&0x80 != 0, b[0]&0x7f, int(b[1])<<16|int(b[2])<<8|int(b[3])
+			if kind == 4 && 4+n <= len(b) {
+				return vorbisComments(b[4 : 4+n])
+			}
+			if last || 4+n > len(b) {
+				break
+			}
+			b = b[4+n:]
+		}
+		return trackTags{}
+	}
+	for _, marker := range []string{"\x03vorbis", "OpusTags"} {
+		if i := bytes.Index(head, []byte(marker)); i >= 0 {
+			return vorbisComments(head[i+len(marker):])
+		}
+	}
+	return trackTags{}
+}
+
+// vorbisComments reads a vendor string and the NAME=value comments after it
+func vorbisComments(b []byte) trackTags {
+	var t trackTags
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n < 0 || 4+n > len(b) {
+			return nil, false
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, true
+	}
+	if _, ok := next(); !ok || len(b) < 4 {
+		return t
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	for i := 0; i < count; i++ {
+		c, ok := next()
+		if !ok {
+			break
+		}
+		if name, value, ok := strings.Cut(string(c), "="); ok {
+			t.set(name, value)
+		}
+	}
+	return t
+}
+
+// --- TAG SEARCH ---
+
+var (
+	tagFilterRe = regexp.MustCompile(`(?i)(?:^|\s)(title|artist|album|genre|year):(?:"([^"]*)"|(\S*))`)
+	yearRangeRe = regexp.MustCompile(`^(\d{4})(?:-(\d{4}))?$`)
+)
+
+// tagFilter limits a title search to tracks whose tag contains Value, ignoring case.
+// An empty value matches tracks without the tag; year takes a year or a range.
+type tagFilter struct {
+	Field    string
+	Value    string
+	From, To int
+}
+
+// cutTagFilters removes the field:value and field:"quoted value" tokens from a search
+// string and returns them
+func cutTagFilters(s string) (string, []tagFilter, error) {
+	var filters []tagFilter
+	for {
+		m := tagFilterRe.FindStringSubmatchIndex(s)
+		if m == nil {
+			return strings.TrimSpace(s), filters, nil
+		}
+		f := tagFilter{Field: strings.ToLower(s[m[2]:m[3]])}
+		if m[4] >= 0 {
+			f.Value = strings.TrimSpace(s[m[4]:m[5]])
+		} else {
+			f.Value = s[m[6]:m[7]]
+		}
+		if f.Field == "year" && f.Value != "" {
+			y := yearRangeRe.FindStringSubmatch(f.Value)
+			if y == nil {
+				return "", nil, fmt.Errorf("year:%s is neither a year nor a range such as 1955-1960", f.Value)
+			}
+			f.From, _ = strconv.Atoi(y[1])
+			f.To = f.From
+			if y[2] != "" {
+				f.To, _ = strconv.Atoi(y[2])
+			}
+		}
+		filters = append(filters, f)
+		s = s[:m[0]] + " " + s[m[1]:]
+	}
+}
+
+// match reports whether t passes the filter, adding the matched part of each field
+// to spans when that is set
+func (f tagFilter) match(t trackTags, spans map[string][][2]int) bool {
+	if f.Field == "year" {
+		if f.Value == "" {
+			return t.Year == 0
+		}
+		if t.Year < f.From || t.Year > f.To {
+			return false
+		}
+		if spans != nil {
+			spans["year"] = append(spans["year"], [2]int{0, len(strconv.Itoa(t.Year))})
+		}
+		return true
+	}
+	var fields [][2]string // JSON name and value
+	switch f.Field {
+	case "title":
+		fields = [][2]string{{"title", t.Title}}
+	case "artist":
+		fields = [][2]string{{"artist", t.Artist}, {"albumArtist", t.AlbumArtist}}
+	case "album":
+		fields = [][2]string{{"album", t.Album}}
+	case "genre":
+		fields = [][2]string{{"genre", t.Genre}}
+	}
+	found := false
+	for _, field := range fields {
+		if f.Value == "" {
+			if field[1] != "" {
+				return false
+			}
+			found = true
+			continue
+		}
+		if i, j, ok := foldIndex(field[1], f.Value); ok {
+			found = true
+			if spans != nil {
+				spans[field[0]] = append(spans[field[0]], utf16Span(field[1], i, j))
+			}
+		}
+	}
+	return found
+}
+
+// foldIndex returns the byte offsets of the first match of sub in s, ignoring case
+func foldIndex(s, sub string) (int, int, bool) {
+	for i := range s {
+		if j := i + len(sub); j <= len(s) && strings.EqualFold(s[i:j], sub) {
+			return i, j, true
+		}
+	}
+	return 0, 0, false
+}
+
+// utf16Span converts the byte offsets of a match in s to UTF-16 code units, the way
+// JavaScript indexes strings
+func utf16Span(s string, i, j int) [2]int {
+	n := 0
+	for _, r := range s[:i] {
+		n += utf16.RuneLen(r)
+	}
+	m := n
+	for _, r := range s[i:j] {
+		m += utf16.RuneLen(r)
+	}
+	return [2]int{n, m}
+}
+
+// tagHit is a result of a search with tag filters: the track's tags and the parts of
+// them and of its path the search matched, as [start, end) UTF-16 offsets
+type tagHit struct {
+	Title       string              `json:"title,omitempty"`
+	Artist      string              `json:"artist,omitempty"`
+	AlbumArtist string              `json:"albumArtist,omitempty"`
+	Album       string              `json:"album,omitempty"`
+	Genre       string              `json:"genre,omitempty"`
+	Year        int                 `json:"year,omitempty"`
+	Matches     map[string][][2]int `json:"matches"`
+}
+
+// tagSearch matches the tracks of a library against tag filters
+type tagSearch struct {
+	filters []tagFilter
+	text    string // free text of a substring search, highlighted in paths
+	tags    map[string]trackTags
+}
+
+func newTagSearch(lib *library, filters []tagFilter, text, mode string) *tagSearch {
+	ts := &tagSearch{filters: filters, tags: tagsIndex.all(lib)}
+	if mode == "" || mode == SEARCH_MODE_SUBSTRING {
+		ts.text = text
+	}
+	return ts
+}
+
+func (ts *tagSearch) match(key string) bool {
+	t := ts.tags[key]
+	for _, f := range ts.filters {
+		if !f.match(t, nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// hits returns the tags and matched parts of the given results
+func (ts *tagSearch) hits(keys []string) []tagHit {
+	hits := make([]tagHit, len(keys))
+	for i, key := range keys {
+		t := ts.tags[key]
+		h := tagHit{Title: t.Title, Artist: t.Artist, AlbumArtist: t.AlbumArtist, Album: t.Album, Genre: t.Genre, Year: t.Year, Matches: map[string][][2]int{}}
+		for _, f := range ts.filters {
+			f.match(t, h.Matches)
+		}
+		if ts.text != "" {
+			if a, b, ok := foldIndex(key, ts.text); ok {
+				h.Matches["path"] = [][2]int{utf16Span(key, a, b)}
+			}
+		}
+		hits[i] = h
+	}
+	return hits
+}
+
+// handleTagScan starts a background tag scan (POST /admin/tags/scan)
+func handleTagScan(c *gin.Context) {
+	if tagsIndex.scanning.Load() {
+		c.JSON(http.StatusConflict, gin.H{"error": "scan already running"})
+		return
+	}
+	go tagsIndex.scanAll(context.Background())
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// id3v24 builds an ID3v2.4 tag of UTF-8 text frames
+func id3v24(frames ...[2]string) []byte {
+	syncsafe := func(n int) []byte {
+		return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+	}
+	var body []byte
+	for _, f := range frames {
+		text := append([]byte{3}, f[1]...)
+		body = append(body, f[0]...)
+		body = append(body, syncsafe(len(text))...)
+		body = append(body, 0, 0)
+		body = append(body, text...)
+	}
+	return append(append([]byte("ID3\x04\x00\x00"), syncsafe(len(body))...), body...)
+}
+
+// TestID3Tags checks text frames, v2.4 multiple values and genre references
+func TestID3Tags(t *testing.T) {
+	got := id3Tags(id3v24(
+		[2]string{"TIT2", "So What"},
+		[2]string{"TPE1", "Miles Davis\x00John Coltrane"},
+		[2]string{"TALB", "Kind of Blue"},
+		[2]string{"TCON", "(8)"},
+		[2]string{"TDRC", "1959-08-17"},
+		[2]string{"TRCK", "1/5"},
+		[2]string{"TCMP", "1"},
+	))
+	want := trackTags{Title: "So What", Artist: "Miles Davis; John Coltrane", Album: "Kind of Blue", Genre: "Jazz", Year: 1959, Track: 1, Compilation: true}
+	if got != want {
+		t.Errorf("id3Tags = %+v, want %+v", got, want)
+	}
+}
+
+// TestID3v1Tags checks the fixed fields of an ID3v1.1 tail
+func TestID3v1Tags(t *testing.T) {
+	tail := make([]byte, 128)
+	copy(tail, "TAG")
+	copy(tail[3:], "Blue in Green")
+	copy(tail[33:], "Miles Davis")
+	copy(tail[63:], "Kind of Blue")
+	copy(tail[93:], "1959")
+	tail[126] = 3
+	tail[127] = 8
+	want := trackTags{Title: "Blue in Green", Artist: "Miles Davis", Album: "Kind of Blue", Genre: "Jazz", Year: 1959, Track: 3}
+	if got := id3v1Tags(tail); got != want {
+		t.Errorf("id3v1Tags = %+v, want %+v", got, want)
+	}
+	if got := id3v1Tags(make([]byte, 128)); !got.empty() {
+		t.Errorf("id3v1Tags without TAG = %+v", got)
+	}
+}
+
+// TestVorbisTags checks the comment block of a FLAC file and an Opus header
+func TestVorbisTags(t *testing.T) {
+	comments := func(fields ...string) []byte {
+		le := func(n int) []byte { return binary.LittleEndian.AppendUint32(nil, uint32(n)) }
+		b := append(le(6), "vendor"...)
+		b = append(b, le(len(fields))...)
+		for _, f := range fields {
+			b = append(append(b, le(len(f))...), f...)
+		}
+		return b
+	}
+	block := comments("TITLE=Freddie Freeloader", "ARTIST=Miles Davis", "DISCNUMBER=1/1", "TRACKNUMBER=2")
+	info := make([]byte, 34)
+	flac := append([]byte("fLaC\x00\x00\x00\x22"), info...)
+	flac = append(flac, 0x84, byte(len(block)>>16), byte(len(block)>>8), byte(len(block)))
+	flac = append(flac, block...)
+	want := trackTags{Title: "Freddie Freeloader", Artist: "Miles Davis", Track: 2, Disc: 1}
+	if got := vorbisTags(flac); got != want {
+		t.Errorf("FLAC = %+v, want %+v", got, want)
+	}
+	opus := append([]byte("OggS....OpusTags"), comments("album=Kind of Blue", "date=1959")...)
+	if got := vorbisTags(opus); got.Album != "Kind of Blue" || got.Year != 1959 {
+		t.Errorf("Opus = %+v", got)
+	}
+}
+
+// TestDedupeRecordings checks that a recording on a studio album and a compilation is
+// kept on the studio album only
+func TestDedupeRecordings(t *testing.T) {
+	track := func(key, title string, duration int) artistTrack {
+		return artistTrack{Key: key, Title: title, Artist: "Miles Davis", Duration: duration}
+	}
+	best := &artistAlbum{Title: "Best Of", Kind: ALBUM_COMPILATION, Year: 1990, Tracks: []artistTrack{track("best/01.mp3", "So What", 563), track("best/02.mp3", "Milestones", 345)}}
+	kind := &artistAlbum{Title: "Kind of Blue", Kind: ALBUM_STUDIO, Year: 1959, Tracks: []artistTrack{track("kob/01.mp3", "So What", 562), track("kob/02.mp3", "Freddie Freeloader", 586)}}
+	albums := []*artistAlbum{best, kind}
+	if dropped := dedupeRecordings(albums); dropped != 1 {
+		t.Fatalf("dropped %d, want 1", dropped)
+	}
+	if albums[0] != kind || len(kind.Tracks) != 2 || len(best.Tracks) != 1 || best.Tracks[0].Title != "Milestones" {
+		t.Errorf("albums after dedupe: %+v %+v", kind, best)
+	}
+	if also := kind.Tracks[0].AlsoOn; len(also) != 1 || also[0] != "best/01.mp3" {
+		t.Errorf("AlsoOn = %v", also)
+	}
+}
+
+// TestCutTagFilters checks field tokens, quoted values and year ranges
+func TestCutTagFilters(t *testing.T) {
+	rest, filters, err := cutTagFilters(`blue artist:"Miles Davis" Year:1955-1960 album: genre:jazz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tagFilter{
+		{Field: "artist", Value: "Miles Davis"},
+		{Field: "year", Value: "1955-1960", From: 1955, To: 1960},
+		{Field: "album"},
+		{Field: "genre", Value: "jazz"},
+	}
+	if rest != "blue" || len(filters) != len(want) {
+		t.Fatalf("cutTagFilters = %q %+v", rest, filters)
+	}
+	for i := range want {
+		if filters[i] != want[i] {
+			t.Errorf("filter %d = %+v, want %+v", i, filters[i], want[i])
+		}
+	}
+	if _, _, err := cutTagFilters("year:fifties"); err == nil {
+		t.Error("year:fifties accepted")
+	}
+}
+
+// TestTagFilterMatch checks matching and the UTF-16 offsets of highlights
+func TestTagFilterMatch(t *testing.T) {
+	tags := trackTags{Title: "Déjà Vu", Artist: "Crosby, Stills, Nash & Young", Year: 1970}
+	spans := map[string][][2]int{}
+	for _, f := range []tagFilter{{Field: "title", Value: "vu"}, {Field: "artist", Value: "NASH"}, {Field: "year", Value: "1970", From: 1970, To: 1970}, {Field: "album"}} {
+		if !f.match(tags, spans) {
+			t.Errorf("%+v does not match", f)
+		}
+	}
+	if s := spans["title"]; len(s) != 1 || s[0] != [2]int{5, 7} {
+		t.Errorf("title spans = %v", s)
+	}
+	if s := spans["artist"]; len(s) != 1 || s[0] != [2]int{16, 20} {
+		t.Errorf("artist spans = %v", s)
+	}
+	for _, f := range []tagFilter{{Field: "genre", Value: "rock"}, {Field: "title"}, {Field: "year", Value: "1960-1969", From: 1960, To: 1969}} {
+		if f.match(tags, nil) {
+			t.Errorf("%+v matches", f)
+		}
+	}
+}
+
+// TestTrackCredits checks featured artists in artist and title tags and that Various
+// Artists is no album artist
+func TestTrackCredits(t *testing.T) {
+	main, album, featured := trackCredits(trackTags{Artist: "Cannonball Adderley feat. Miles Davis & Bill Evans", AlbumArtist: "Various Artists", Title: "Autumn Leaves (ft. Sam Jones)"})
+	if len(main) != 1 || main[0] != "Cannonball Adderley" || len(album) != 0 {
+		t.Errorf("main %q, album %q", main, album)
+	}
+	if want := []string{"Miles Davis", "Bill Evans", "Sam Jones"}; len(featured) != len(want) || featured[0] != want[0] || featured[1] != want[1] || featured[2] != want[2] {
+		t.Errorf("featured %q, want %q", featured, want)
+	}
+	if role, name := artistRole(trackTags{Artist: "Cannonball Adderley ft. miles davis"}, "Miles Davis"); role != ROLE_FEATURED || name != "miles davis" {
+		t.Errorf("artistRole = %q %q", role, name)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const THROTTLE_CHUNK = 16 << 10 // bytes read per throttled Read call, keeps pacing smooth
+
+// Bandwidth limits from environment variables (0 = unlimited)
+var (
+	maxKbpsPerStream int64 // MAX_KBPS_PER_STREAM
+	maxKbpsTotal     int64 // MAX_KBPS_TOTAL
+)
+
+// totalBandwidth is shared by every audio stream when MAX_KBPS_TOTAL is set
+var totalBandwidth *byteRateLimiter
+
+func initThrottle() error {
+	for _, opt := range []struct {
+		name string
+		dst  *int64
+	}{{"MAX_KBPS_PER_STREAM", &maxKbpsPerStream}, {"MAX_KBPS_TOTAL", &maxKbpsTotal}} {
+		v := os.Getenv(opt.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s: %q", opt.name, v)
+		}
+		*opt.dst = n
+	}
+	if maxKbpsTotal > 0 {
+		totalBandwidth = newByteRateLimiter(maxKbpsTotal)
+	}
+	return nil
+}
+
+// byteRateLimiter is a token bucket measured in bytes per second
+type byteRateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteRateLimiter(kbps int64) *byteRateLimiter {
+	rate := float64(kbps) * 1000 / 8
+	burst := rate / 4 // quarter of a second worth of data
+	if burst < THROTTLE_CHUNK {
+		burst = THROTTLE_CHUNK
+	}
+	return &byteRateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent
+func (l *byteRateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledReader paces reads through the per-stream and global limiters
+type throttledReader struct {
+	r       io.Reader
+	limiter *byteRateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > THROTTLE_CHUNK {
+		p = p[:THROTTLE_CHUNK]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if t.limiter != nil {
+			t.limiter.wait(n)
+		}
+		if totalBandwidth != nil {
+			totalBandwidth.wait(n)
+		}
+	}
+	return n, err
+}
+
+// throttledReadSeeker keeps http.ServeContent working for cached files
+type throttledReadSeeker struct {
+	throttledReader
+	s io.Seeker
+}
+
+func (t *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return t.s.Seek(offset, whence)
+}
+
+func bandwidthLimited() bool {
+	return maxKbpsPerStream > 0 || totalBandwidth != nil
+}
+
+func newStreamLimiter() *byteRateLimiter {
+	if maxKbpsPerStream > 0 {
+		return newByteRateLimiter(maxKbpsPerStream)
+	}
+	return nil
+}
+
+// throttleReadCloser applies the bandwidth limits to an S3 body
+func throttleReadCloser(rc io.ReadCloser) io.ReadCloser {
+	if !bandwidthLimited() {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&throttledReader{r: rc, limiter: newStreamLimiter()}, rc}
+}
+
+// throttleReadSeeker applies the bandwidth limits to a cached file
+func throttleReadSeeker(rs io.ReadSeeker) io.ReadSeeker {
+	if !bandwidthLimited() {
+		return rs
+	}
+	return &throttledReadSeeker{throttledReader{r: rs, limiter: newStreamLimiter()}, rs}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MAX_THUMBNAIL_SOURCE = 32 << 20 // bytes of a cover read for resizing
+	MAX_THUMBNAIL_PIXELS = 50e6     // larger covers are served as they are
+	THUMBNAIL_QUALITY    = 82
+	THUMBNAIL_WORKERS    = 2 // concurrent decodes; a large scan takes ~100 MB while resized
+)
+
+// artworkSizes are the widths /artwork serves with ?size=, for srcset candidates
+var artworkSizes = []int{64, 256, 1024}
+
+var thumbnailSlots = make(chan struct{}, THUMBNAIL_WORKERS)
+
+// resizeImage scales src so its longer side is size pixels by averaging the source pixels
+// each target pixel covers. Images that aren't larger are returned unchanged.
+func resizeImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	tw, th := size, max(1, h*size/w)
+	if h > w {
+		tw, th = max(1, w*size/h), size
+	}
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src) // fast paths for YCbCr and paletted images
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, max(y*h/th+1, (y+1)*h/th)
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, max(x*w/tw+1, (x+1)*w/tw)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride+x0*4 : sy*rgba.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			p[0], p[1], p[2], p[3] = uint8(sum[0]/n), uint8(sum[1]/n), uint8(sum[2]/n), uint8(sum[3]/n)
+		}
+	}
+	return dst
+}
+
+// makeThumbnail decodes a cover image and encodes it at size: JPEG, or PNG when it has
+// transparency. ok is false for formats the server can't decode, such as WebP.
+func makeThumbnail(data []byte, size int) (thumb []byte, ctype string, ok bool, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > MAX_THUMBNAIL_PIXELS {
+		return nil, "", false, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false, err
+	}
+	img = resizeImage(img, size)
+	var buf bytes.Buffer
+	if o, isOpaque := img.(interface{ Opaque() bool }); isOpaque && !o.Opaque() {
+		err, ctype = png.Encode(&buf, img), "image/png"
+	} else {
+		err, ctype = jpeg.Encode(&buf, img, &jpeg.Options{Quality: THUMBNAIL_QUALITY}), "image/jpeg"
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	return buf.Bytes(), ctype, true, nil
+}
+
+// artworkSize reads ?size=, 0 for the original image
+func artworkSize(c *gin.Context) (int, error) {
+	v := c.Query("size")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	for _, s := range artworkSizes {
+		if err == nil && n == s {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("size must be one of %v", artworkSizes)
+}
+
+// serveThumbnail answers an artwork request for a resized cover. Thumbnails are cached
+// by the ETag of the cover, so a replaced image gets new ones; clients revalidate with
+// If-None-Match against the same ETag. It returns false to serve the original instead.
+func serveThumbnail(c *gin.Context, key string, size int) bool {
+	ctx := c.Request.Context()
+	lib := libraryFrom(ctx)
+	etag, _, _, err := s3HeadAudioFile(ctx, key)
+	if err != nil {
+		return false
+	}
+	tag := fmt.Sprintf(`"%s-%d"`, normalizeETag(etag), size)
+	serve := func(ctype string, img []byte) {
+		c.Header("ETag", tag)
+		c.Header("Cache-Control", "public, max-age=86400")
+		c.Data(http.StatusOK, ctype, img)
+	}
+	if c.GetHeader("If-None-Match") == tag {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	cacheKey := lib.Name + "\x00" + key + "\x00" + tag
+	if data, ok := thumbnailCache.Get(cacheKey); ok {
+		if ctype, img, found := bytes.Cut(data, []byte("\n")); found {
+			serve(string(ctype), img)
+			return true
+		}
+	}
+	select {
+	case thumbnailSlots <- struct{}{}:
+	case <-ctx.Done():
+		return true
+	}
+	defer func() { <-thumbnailSlots }()
+	body, _, _, err := s3GetAudioFile(ctx, key)
+	if err != nil {
+		return false
+	}
+	data, err := io.ReadAll(io.LimitReader(body, MAX_THUMBNAIL_SOURCE+1))
+	body.Close()
+	if err != nil || len(data) > MAX_THUMBNAIL_SOURCE {
+		return false
+	}
+	thumb, ctype, ok, err := makeThumbnail(data, size)
+	if err != nil {
+		log.Printf("Thumbnail of %s failed: %v", key, err)
+	}
+	if !ok {
+		return false
+	}
+	thumbnailCache.Set(cacheKey, append([]byte(ctype+"\n"), thumb...))
+	serve(ctype, thumb)
+	return true
+}
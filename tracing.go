@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const TRACER_NAME = "go-music"
+
+// Tracing is enabled when an OTLP endpoint is configured; the exporter reads the
+// standard OTEL_EXPORTER_OTLP_* variables (headers, timeout, TLS) itself
+var tracingEnabled = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+
+// tracer is a no-op until initTracing installs a provider
+var tracer = otel.Tracer(TRACER_NAME)
+
+// initTracing installs the global OTLP/HTTP tracer provider and returns its shutdown func
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	if !tracingEnabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(TRACER_NAME),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracer = tp.Tracer(TRACER_NAME)
+	return tp.Shutdown, nil
+}
+
+// Tracing middleware creates a server span per request, skipping static files and event streams
+func Tracing() gin.HandlerFunc {
+	if !tracingEnabled {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return otelgin.Middleware(TRACER_NAME, otelgin.WithFilter(func(r *http.Request) bool {
+		path := strings.TrimPrefix(r.URL.Path, basePath)
+		return !strings.HasPrefix(path, "/static/") && path != "/events" && path != "/ws"
+	}))
+}
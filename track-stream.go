@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamedTrack is one line (or array element) of a streamed track listing
+type streamedTrack struct {
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	Duration int    `json:"duration,omitempty"` // seconds, when the manifest knows it
+	// ReplayGain-style adjustments in dB, once the loudness scan has analyzed the track
+	TrackGain *float64 `json:"trackGain,omitempty"`
+	AlbumGain *float64 `json:"albumGain,omitempty"`
+	Rating    int      `json:"rating,omitempty"` // stars given by the requesting user
+	// Where the audible part starts and ends in seconds, for gapless playback and crossfades
+	AudioStart float64 `json:"audioStart,omitempty"`
+	AudioEnd   float64 `json:"audioEnd,omitempty"`
+}
+
+// handleStreamTracks streams every track under ?prefix= as S3 pagination proceeds
+// (GET /api/v1/tracks). format=ndjson (default) writes one object per line and
+// reports a failure as a final {"error":...} line; format=json writes a JSON array
+// and drops the connection on failure so a truncated array can't pass as complete.
+// Tracks come in bucket order, since sorting would mean holding the whole list.
+func handleStreamTracks(c *gin.Context) {
+	format := c.DefaultQuery("format", "ndjson")
+	if format != "ndjson" && format != "json" {
+		apiError(c, http.StatusBadRequest, MSG_FORMAT_INVALID)
+		return
+	}
+	prefix := strings.Trim(c.Query("prefix"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	ctx := c.Request.Context()
+	lib := libraryFrom(ctx)
+	rated := ratings.list(requestUser(c), lib)
+	if format == "json" {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	first := true
+	if format == "json" {
+		c.Writer.WriteString("[")
+	}
+	err := s3WalkAudioObjects(ctx, prefix, func(page []audioObject) error {
+		keys := make([]string, len(page))
+		for i, obj := range page {
+			keys[i] = obj.Key
+		}
+		durations := manifest.durations(lib, keys)
+		for i, obj := range page {
+			if !folderVisible(ctx, obj.Key, false) {
+				continue
+			}
+			if format == "json" && !first {
+				c.Writer.WriteString(",")
+			}
+			first = false
+			t := streamedTrack{Key: obj.Key, Size: obj.Size, Duration: durations[i], Rating: rated[obj.Key]}
+			if track, album, ok := loudness.gains(lib, obj.Key); ok {
+				t.TrackGain, t.AlbumGain = &track, &album
+			}
+			t.AudioStart, t.AudioEnd = loudness.silence(lib, obj.Key)
+			if err := enc.Encode(t); err != nil {
+				return err
+			}
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Track stream error: %v", err)
+		}
+		if format == "json" {
+			panic(http.ErrAbortHandler)
+		}
+		enc.Encode(gin.H{"error": msg(c, MSG_LISTING_FAILED), "code": MSG_LISTING_FAILED})
+		return
+	}
+	if format == "json" {
+		c.Writer.WriteString("]")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TRASH_PURGE_INTERVAL = 6 * time.Hour
+	MAX_TRASH_KEYS       = 1000 // keys per restore or purge request
+)
+
+// Deleted tracks are moved under TRASH_PREFIX (default ".trash") of their library and
+// purged after TRASH_DAYS (default 30, 0 keeps them). TRASH_PREFIX=off deletes right
+// away, e.g. for buckets that keep noncurrent versions anyway.
+var (
+	trashPrefix = ".trash"
+	trashDays   = 30
+)
+
+func initTrash() error {
+	if v, ok := os.LookupEnv("TRASH_PREFIX"); ok {
+		v = strings.Trim(v, "/")
+		switch {
+		case v == "off":
+			v = ""
+		case v == "" || isMetaDir(v) || strings.Contains(v, "/"):
+			return fmt.Errorf("invalid TRASH_PREFIX: %q, expected a folder name or off", v)
+		}
+		trashPrefix = v
+	}
+	if v := os.Getenv("TRASH_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid TRASH_DAYS: %q", v)
+		}
+		trashDays = n
+	}
+	return nil
+}
+
+// isTrashed reports whether a library-relative path is in the trash
+func isTrashed(name string) bool {
+	return trashPrefix != "" && (name == trashPrefix || strings.HasPrefix(name, trashPrefix+"/"))
+}
+
+// s3TrashObject moves a track of the request's library with its sidecars to the trash,
+// or deletes them when there is no trash
+func s3TrashObject(ctx context.Context, key string) error {
+	if trashPrefix == "" {
+		return s3DeleteTrack(ctx, key)
+	}
+	return s3MoveTrack(ctx, key, trashPrefix+"/"+key)
+}
+
+// trashedObject is a track in the trash; Deleted is when it was moved there
+type trashedObject struct {
+	Key     string     `json:"key"` // where it is restored to
+	Size    int64      `json:"size"`
+	Deleted time.Time  `json:"deleted"`
+	PurgeAt *time.Time `json:"purgeAt,omitempty"`
+}
+
+// listTrash lists the tracks in the trash of the context's library, leaving out their
+// sidecars. The copy into the trash sets the modification time, so it tells when a track
+// was deleted.
+func listTrash(ctx context.Context) ([]trashedObject, error) {
+	lib := libraryFrom(ctx)
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(lib.Bucket),
+		Prefix: aws.String(lib.Prefix + trashPrefix + "/"),
+	})
+	out := []trashedObject{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			t := trashedObject{
+				Key:     strings.TrimPrefix(aws.ToString(obj.Key), lib.Prefix+trashPrefix+"/"),
+				Size:    aws.ToInt64(obj.Size),
+				Deleted: aws.ToTime(obj.LastModified),
+			}
+			if trashDays > 0 {
+				purge := t.Deleted.AddDate(0, 0, trashDays)
+				t.PurgeAt = &purge
+			}
+			out = append(out, t)
+		}
+	}
+	// Sidecars moved along with their track are restored and purged with it
+	sidecars := make(map[string]bool)
+	for _, t := range out {
+		if isAudioFile(t.Key) {
+			for _, sc := range trackSidecars(t.Key) {
+				sidecars[sc] = true
+			}
+		}
+	}
+	tracks := out[:0]
+	for _, t := range out {
+		if !sidecars[t.Key] {
+			tracks = append(tracks, t)
+		}
+	}
+	out = tracks
+	return out, nil
+}
+
+// purgeExpiredTrash deletes what has been in the trash of every library, and of every
+// user home in USER_HOMES mode, for TRASH_DAYS
+func purgeExpiredTrash(ctx context.Context) {
+	now := time.Now()
+	libs := libraries
+	if userHomes {
+		homes, err := homeLibraryList(ctx)
+		if err != nil {
+			log.Printf("Listing user homes for the trash purge failed: %v", err)
+		}
+		libs = append(append([]*library(nil), libraries...), homes...)
+	}
+	for _, lib := range libs {
+		lctx := withLibrary(ctx, lib)
+		trashed, err := listTrash(lctx)
+		if err != nil {
+			log.Printf("Trash listing of %s failed: %v", lib.Name, err)
+			continue
+		}
+		purged := 0
+		for _, t := range trashed {
+			if t.PurgeAt == nil || t.PurgeAt.After(now) {
+				continue
+			}
+			if err := s3DeleteTrack(lctx, trashPrefix+"/"+t.Key); err != nil {
+				log.Printf("Trash purge of %s failed: %v", t.Key, err)
+				continue
+			}
+			purged++
+		}
+		if purged > 0 {
+			log.Printf("Purged %d tracks from the trash of %s", purged, lib.Name)
+		}
+	}
+}
+
+// runTrashPurge purges expired trash at startup and every TRASH_PURGE_INTERVAL
+func runTrashPurge(ctx context.Context) {
+	if trashPrefix == "" || trashDays == 0 {
+		return
+	}
+	ctx = withS3Feature(ctx, "trash")
+	ticker := time.NewTicker(TRASH_PURGE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		purgeExpiredTrash(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// trashRequest resolves the library of a trash request and, for restore and purge, the
+// keys it names; answering the error itself
+func trashRequest(c *gin.Context, withKeys bool) (context.Context, []string, bool) {
+	if trashPrefix == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "trash is off"})
+		return nil, nil, false
+	}
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return nil, nil, false
+	}
+	ctx := withLibrary(c.Request.Context(), lib)
+	if !withKeys {
+		return ctx, nil, true
+	}
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Keys) == 0 || len(req.Keys) > MAX_TRASH_KEYS {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("keys are required, at most %d", MAX_TRASH_KEYS)})
+		return nil, nil, false
+	}
+	return ctx, req.Keys, true
+}
+
+// handleListTrash lists the trash of a library (GET /admin/trash?library=)
+func handleListTrash(c *gin.Context) {
+	ctx, _, ok := trashRequest(c, false)
+	if !ok {
+		return
+	}
+	trashed, err := listTrash(ctx)
+	if err != nil {
+		log.Printf("Trash listing error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list trash"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"library": libraryFrom(ctx).Name, "days": trashDays, "tracks": trashed})
+}
+
+// handleRestoreTrash moves tracks back from the trash (POST /admin/trash/restore
+// {"keys":[...]}). A track whose key was taken again in the meantime stays in the trash.
+func handleRestoreTrash(c *gin.Context) {
+	ctx, keys, ok := trashRequest(c, true)
+	if !ok {
+		return
+	}
+	lib := libraryFrom(ctx)
+	restored, conflicts, missing := []string{}, []string{}, []string{}
+	failed := 0
+	for _, key := range keys {
+		if _, _, _, err := s3HeadAudioFile(ctx, key); err == nil {
+			conflicts = append(conflicts, key)
+			continue
+		} else if !isNoSuchKey(err) {
+			log.Printf("Restore %s failed: %v", key, err)
+			failed++
+			continue
+		}
+		if err := s3MoveTrack(ctx, trashPrefix+"/"+key, key); isNoSuchKey(err) {
+			missing = append(missing, key)
+			continue
+		} else if err != nil {
+			log.Printf("Restore %s failed: %v", key, err)
+			failed++
+			continue
+		}
+		audit.record(c, "track.restore", lib.Name, key, "")
+		restored = append(restored, key)
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "restored": restored, "conflicts": conflicts, "missing": missing, "failed": failed})
+}
+
+// handlePurgeTrash deletes tracks from the trash for good (POST /admin/trash/purge
+// {"keys":[...]}); all=1 empties the trash of the library
+func handlePurgeTrash(c *gin.Context) {
+	all := c.Query("all") == "1"
+	ctx, keys, ok := trashRequest(c, !all)
+	if !ok {
+		return
+	}
+	lib := libraryFrom(ctx)
+	if all {
+		trashed, err := listTrash(ctx)
+		if err != nil {
+			log.Printf("Trash listing error: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list trash"})
+			return
+		}
+		for _, t := range trashed {
+			keys = append(keys, t.Key)
+		}
+	}
+	purged := []string{}
+	failed := 0
+	for _, key := range keys {
+		if err := s3DeleteTrack(ctx, trashPrefix+"/"+key); err != nil {
+			log.Printf("Trash purge of %s failed: %v", key, err)
+			failed++
+			continue
+		}
+		purged = append(purged, key)
+	}
+	if len(purged) > 0 {
+		audit.record(c, "trash.purge", lib.Name, "", strconv.Itoa(len(purged))+" tracks")
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "purged": purged, "failed": failed})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const TRIMS_OBJECT = "trims.json"
+
+// trimPoint plays only part of a track (long intros/outros, hidden tracks after silence)
+type trimPoint struct {
+	Start float64 `json:"start"`         // seconds skipped at the beginning
+	End   float64 `json:"end,omitempty"` // position to stop at in seconds, 0 plays to the end
+}
+
+// length returns the trimmed length of a track that is full seconds long
+func (t trimPoint) length(full float64) float64 {
+	if t.End > 0 && t.End < full {
+		full = t.End
+	}
+	if full <= t.Start {
+		return 0
+	}
+	return full - t.Start
+}
+
+// trimStore holds trim points per library and key
+type trimStore struct {
+	mu        sync.Mutex
+	libraries map[string]map[string]trimPoint
+	doc       stateDoc
+}
+
+var trims = &trimStore{libraries: make(map[string]map[string]trimPoint), doc: stateDoc{name: TRIMS_OBJECT}}
+
+// load reads the trims object from the state store; a missing object means no trims
+func (ts *trimStore) load(ctx context.Context) error {
+	return ts.doc.load(ctx, &ts.mu, ts)
+}
+
+func (ts *trimStore) decode(data []byte) error {
+	libs := make(map[string]map[string]trimPoint)
+	if data != nil {
+		if err := json.Unmarshal(data, &libs); err != nil {
+			return err
+		}
+	}
+	ts.libraries = libs
+	return nil
+}
+
+func (ts *trimStore) encode() (interface{}, error) {
+	return ts.libraries, nil
+}
+
+func (ts *trimStore) get(lib *library, key string) (trimPoint, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.libraries[lib.Name][key]
+	return t, ok
+}
+
+func (ts *trimStore) list(lib *library) map[string]trimPoint {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := make(map[string]trimPoint, len(ts.libraries[lib.Name]))
+	for k, t := range ts.libraries[lib.Name] {
+		out[k] = t
+	}
+	return out
+}
+
+// set stores t for key, or removes the trim when t is nil
+func (ts *trimStore) set(ctx context.Context, lib *library, key string, t *trimPoint) (bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	existed := false
+	err := ts.doc.update(ctx, ts, func() bool {
+		entries := ts.libraries[lib.Name]
+		_, existed = entries[key]
+		if t == nil && !existed {
+			return false
+		}
+		if entries == nil {
+			entries = make(map[string]trimPoint)
+			ts.libraries[lib.Name] = entries
+		}
+		if t != nil {
+			entries[key] = *t
+		} else {
+			delete(entries, key)
+		}
+		return true
+	})
+	return existed, err
+}
+
+// --- TRIM HANDLERS ---
+
+// trimRequestLibrary resolves the ?library= query parameter of the trim endpoints
+func trimRequestLibrary(c *gin.Context) *library {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+	}
+	return lib
+}
+
+// handleListTrims lists the trim points of a library (GET /admin/trims?library=)
+func handleListTrims(c *gin.Context) {
+	if lib := trimRequestLibrary(c); lib != nil {
+		c.JSON(http.StatusOK, trims.list(lib))
+	}
+}
+
+// handlePutTrim sets the trim points of a track (PUT /admin/trims/*path)
+func handlePutTrim(c *gin.Context) {
+	lib := trimRequestLibrary(c)
+	if lib == nil {
+		return
+	}
+	var t trimPoint
+	if err := c.ShouldBindJSON(&t); err != nil || t.Start < 0 || t.End < 0 || (t.End > 0 && t.End <= t.Start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start and end must be seconds with end after start"})
+		return
+	}
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	if _, _, _, err := s3HeadAudioFile(withLibrary(c.Request.Context(), lib), key); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown track"})
+		return
+	}
+	if _, err := trims.set(c.Request.Context(), lib, key, &t); err != nil {
+		log.Printf("Trim save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save trims"})
+		return
+	}
+	audit.record(c, "trim.put", lib.Name, key, fmt.Sprintf("%g-%g", t.Start, t.End))
+	if ffmpegPath == "" {
+		log.Printf("Trim saved for %s, but ffmpeg isn't available so it's streamed untrimmed", key)
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// handleDeleteTrim removes the trim points of a track (DELETE /admin/trims/*path)
+func handleDeleteTrim(c *gin.Context) {
+	lib := trimRequestLibrary(c)
+	if lib == nil {
+		return
+	}
+	found, err := trims.set(c.Request.Context(), lib, strings.TrimPrefix(c.Param("path"), "/"), nil)
+	if err != nil {
+		log.Printf("Trim save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save trims"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no trim for track"})
+		return
+	}
+	audit.record(c, "trim.delete", lib.Name, strings.TrimPrefix(c.Param("path"), "/"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
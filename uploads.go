@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MIN_UPLOAD_PART_BYTES = 5 << 20   // S3's minimum for every part but the last
+	MAX_UPLOAD_PART_BYTES = 512 << 20 // parts are spooled to a temp file before going to S3
+	MAX_UPLOAD_PARTS      = 10000     // S3's limit per multipart upload
+)
+
+// uploadSidecarExts are the non-audio files an upload may add next to tracks
+var uploadSidecarExts = map[string]bool{".lrc": true, CUE_EXT: true, ".txt": true}
+
+// uploadToken identifies a multipart upload; clients keep it to resume after an
+// interruption. It only carries what S3 needs to find the upload again.
+type uploadToken struct {
+	Library  string `json:"l"`
+	Key      string `json:"k"`
+	UploadID string `json:"u"`
+}
+
+func (t uploadToken) String() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseUploadToken(s string) (uploadToken, *library, bool) {
+	var t uploadToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &t) != nil || t.UploadID == "" || checkKey(t.Key) != "" {
+		return t, nil, false
+	}
+	lib := findLibrary(t.Library)
+	return t, lib, lib != nil
+}
+
+// uploadable reports whether an upload may create key: an audio file, cover image or
+// track sidecar outside the trash and the meta folder
+func uploadable(key string) bool {
+	ext := strings.ToLower(path.Ext(key))
+	if checkKey(key) != "" || strings.HasSuffix(key, "/") || isMetaDir(key) || isTrashed(key) {
+		return false
+	}
+	return isAudioFile(key) || artworkExts[ext] || uploadSidecarExts[ext]
+}
+
+// uploadRequest resolves the token of an upload route, answering the error itself
+func uploadRequest(c *gin.Context) (uploadToken, context.Context, bool) {
+	t, lib, ok := parseUploadToken(c.Param("token"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown upload"})
+		return t, nil, false
+	}
+	return t, withLibrary(c.Request.Context(), lib), true
+}
+
+// uploadedParts lists the parts S3 holds for an upload, in part order
+func uploadedParts(ctx context.Context, t uploadToken) ([]types.Part, error) {
+	lib := libraryFrom(ctx)
+	var parts []types.Part
+	paginator := s3.NewListPartsPaginator(s3Client, &s3.ListPartsInput{
+		Bucket:   aws.String(lib.Bucket),
+		Key:      aws.String(lib.Prefix + t.Key),
+		UploadId: aws.String(t.UploadID),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, resp.Parts...)
+	}
+	sort.Slice(parts, func(i, j int) bool { return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber) })
+	return parts, nil
+}
+
+// isNoSuchUpload reports whether err means S3 doesn't know the upload (any more)
+func isNoSuchUpload(err error) bool {
+	var nsu *types.NoSuchUpload
+	var apiErr smithy.APIError
+	return errors.As(err, &nsu) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload")
+}
+
+// handleCreateUpload starts a multipart upload (POST /admin/uploads?library=
+// {"key":"Artist/Album/01.flac","overwrite":false}) and returns its resume token
+func handleCreateUpload(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	var req struct {
+		Key         string `json:"key"`
+		ContentType string `json:"contentType"`
+		Overwrite   bool   `json:"overwrite"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !uploadable(req.Key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "key must name an audio file, cover image or sidecar"})
+		return
+	}
+	ctx := withLibrary(c.Request.Context(), lib)
+	if !req.Overwrite {
+		if _, _, _, err := s3HeadAudioFile(ctx, req.Key); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "key exists; set overwrite to replace it"})
+			return
+		}
+	}
+	in := &s3.CreateMultipartUploadInput{Bucket: aws.String(lib.Bucket), Key: aws.String(lib.Prefix + req.Key)}
+	if req.ContentType != "" {
+		in.ContentType = aws.String(req.ContentType)
+	}
+	resp, err := s3Client.CreateMultipartUpload(ctx, in)
+	if err != nil {
+		log.Printf("Upload of %s could not start: %v", req.Key, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to start upload"})
+		return
+	}
+	t := uploadToken{Library: lib.Name, Key: req.Key, UploadID: aws.ToString(resp.UploadId)}
+	audit.record(c, "upload.start", lib.Name, req.Key, "")
+	c.JSON(http.StatusCreated, gin.H{"token": t.String(), "library": lib.Name, "key": req.Key, "minPartSize": MIN_UPLOAD_PART_BYTES, "maxPartSize": MAX_UPLOAD_PART_BYTES})
+}
+
+// handleListUploads lists the unfinished uploads of a library (GET /admin/uploads?library=),
+// so a client that lost its token can resume or abort
+func handleListUploads(c *gin.Context) {
+	lib := findLibrary(c.Query("library"))
+	if lib == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown library"})
+		return
+	}
+	uploads := []gin.H{}
+	paginator := s3.NewListMultipartUploadsPaginator(s3Client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(lib.Bucket),
+		Prefix: aws.String(lib.Prefix),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(c.Request.Context())
+		if err != nil {
+			log.Printf("Upload listing error: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list uploads"})
+			return
+		}
+		for _, u := range resp.Uploads {
+			key := strings.TrimPrefix(aws.ToString(u.Key), lib.Prefix)
+			t := uploadToken{Library: lib.Name, Key: key, UploadID: aws.ToString(u.UploadId)}
+			uploads = append(uploads, gin.H{"token": t.String(), "key": key, "started": u.Initiated})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "uploads": uploads})
+}
+
+// handleGetUpload lists the parts S3 already holds (GET /admin/uploads/:token), which a
+// resuming client skips
+func handleGetUpload(c *gin.Context) {
+	t, ctx, ok := uploadRequest(c)
+	if !ok {
+		return
+	}
+	parts, err := uploadedParts(ctx, t)
+	if isNoSuchUpload(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown upload"})
+		return
+	} else if err != nil {
+		log.Printf("Upload part listing error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list parts"})
+		return
+	}
+	list := make([]gin.H, len(parts))
+	for i, p := range parts {
+		list[i] = gin.H{"part": aws.ToInt32(p.PartNumber), "size": aws.ToInt64(p.Size), "etag": aws.ToString(p.ETag)}
+	}
+	c.JSON(http.StatusOK, gin.H{"library": t.Library, "key": t.Key, "parts": list})
+}
+
+// handleUploadPart stores one part (PUT /admin/uploads/:token/parts/:number). Parts may
+// arrive in any order and be sent again; S3 keeps the last copy of each number.
+func handleUploadPart(c *gin.Context) {
+	t, ctx, ok := uploadRequest(c)
+	if !ok {
+		return
+	}
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil || number < 1 || number > MAX_UPLOAD_PARTS {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "part number must be 1 to " + strconv.Itoa(MAX_UPLOAD_PARTS)})
+		return
+	}
+	size := c.Request.ContentLength
+	if size <= 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{"error": "parts need a Content-Length and must not be empty"})
+		return
+	} else if size > MAX_UPLOAD_PART_BYTES {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "parts may be at most " + strconv.Itoa(MAX_UPLOAD_PART_BYTES) + " bytes"})
+		return
+	}
+	// A seekable body lets the SDK sign and retry the part
+	spool, err := os.CreateTemp("", "go-music-part-*")
+	if err != nil {
+		log.Printf("Upload part spool error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store part"})
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if n, err := io.Copy(spool, http.MaxBytesReader(c.Writer, c.Request.Body, size)); err != nil || n != size {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "part body ended early"})
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store part"})
+		return
+	}
+	lib := libraryFrom(ctx)
+	resp, err := s3Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(lib.Bucket),
+		Key:           aws.String(lib.Prefix + t.Key),
+		UploadId:      aws.String(t.UploadID),
+		PartNumber:    aws.Int32(int32(number)),
+		ContentLength: aws.Int64(size),
+		Body:          spool,
+	})
+	if isNoSuchUpload(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown upload"})
+		return
+	} else if err != nil {
+		log.Printf("Upload part %d of %s failed: %v", number, t.Key, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to store part"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"part": number, "size": size, "etag": aws.ToString(resp.ETag)})
+}
+
+// handleCompleteUpload assembles the parts S3 holds into the object (POST
+// /admin/uploads/:token/complete); parts are taken in number order, gaps allowed
+func handleCompleteUpload(c *gin.Context) {
+	t, ctx, ok := uploadRequest(c)
+	if !ok {
+		return
+	}
+	parts, err := uploadedParts(ctx, t)
+	if isNoSuchUpload(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown upload"})
+		return
+	} else if err != nil {
+		log.Printf("Upload part listing error: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to list parts"})
+		return
+	}
+	if len(parts) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no parts uploaded"})
+		return
+	}
+	var size int64
+	completed := make([]types.CompletedPart, len(parts))
+	for i, p := range parts {
+		if i < len(parts)-1 && aws.ToInt64(p.Size) < MIN_UPLOAD_PART_BYTES {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "part " + strconv.Itoa(int(aws.ToInt32(p.PartNumber))) + " is below the 5 MiB minimum and not the last part"})
+			return
+		}
+		completed[i] = types.CompletedPart{PartNumber: p.PartNumber, ETag: p.ETag}
+		size += aws.ToInt64(p.Size)
+	}
+	lib := libraryFrom(ctx)
+	_, err = s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(lib.Bucket),
+		Key:             aws.String(lib.Prefix + t.Key),
+		UploadId:        aws.String(t.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		log.Printf("Upload of %s could not complete: %v", t.Key, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to complete upload"})
+		return
+	}
+	forgetObject(lib, t.Key)
+	audit.record(c, "upload.complete", lib.Name, t.Key, strconv.FormatInt(size, 10)+" bytes")
+	if isAudioFile(t.Key) {
+		eventBus.Publish(EVENT_TRACKS_ADDED, map[string]interface{}{"library": lib.Name, "count": 1, "tracks": []string{t.Key}})
+	}
+	c.JSON(http.StatusOK, gin.H{"library": lib.Name, "key": t.Key, "size": size, "parts": len(parts)})
+}
+
+// handleAbortUpload drops an upload and the parts S3 holds (DELETE /admin/uploads/:token)
+func handleAbortUpload(c *gin.Context) {
+	t, ctx, ok := uploadRequest(c)
+	if !ok {
+		return
+	}
+	lib := libraryFrom(ctx)
+	_, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(lib.Bucket),
+		Key:      aws.String(lib.Prefix + t.Key),
+		UploadId: aws.String(t.UploadID),
+	})
+	if err != nil && !isNoSuchUpload(err) {
+		log.Printf("Upload of %s could not be aborted: %v", t.Key, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to abort upload"})
+		return
+	}
+	audit.record(c, "upload.abort", lib.Name, t.Key, "")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+// TestUploadable checks which keys an upload may create
+func TestUploadable(t *testing.T) {
+	for key, want := range map[string]bool{
+		"Artist/Album/01.mp3":    true,
+		"Artist/Album/cover.jpg": true,
+		"Artist/Album/01.lrc":    true,
+		"Artist/Album/":          false,
+		"Artist/Album/notes.exe": false,
+		"../outside.mp3":         false,
+		META_DIR + "/x.mp3":      false,
+	} {
+		if got := uploadable(key); got != want {
+			t.Errorf("uploadable(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+// TestUploadToken checks that a token names its upload again and that forged ones
+// are refused
+func TestUploadToken(t *testing.T) {
+	defer func(prev []*library) { libraries = prev }(libraries)
+	lib := &library{Name: "Music", Bucket: "music"}
+	libraries = []*library{lib}
+	tok := uploadToken{Library: lib.Name, Key: "Artist/01.mp3", UploadID: "abc"}
+	got, found, ok := parseUploadToken(tok.String())
+	if !ok || got != tok || found != lib {
+		t.Errorf("round trip: %+v %v", got, ok)
+	}
+	for _, bad := range []string{
+		"not base64!",
+		uploadToken{Library: lib.Name, Key: "Artist/01.mp3"}.String(),
+		uploadToken{Library: lib.Name, Key: "../01.mp3", UploadID: "abc"}.String(),
+		uploadToken{Library: "nope", Key: "Artist/01.mp3", UploadID: "abc"}.String(),
+	} {
+		if _, _, ok := parseUploadToken(bad); ok {
+			t.Errorf("token %q accepted", bad)
+		}
+	}
+}
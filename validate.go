@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MAX_KEY_LEN          = 1024      // bytes, S3's own limit for object keys
+	MAX_DFDATA_LEN       = 256 << 10 // bytes of dfdata in one dffunc request
+	MAX_SELECTED_FOLDERS = 200       // folders of one getAllMp3InDirs or searchTitleIn request
+)
+
+var errInvalidKey = errors.New("invalid object key")
+
+// errServerOwned refuses reads of META_DIR objects; it is a not-found error to callers
+var errServerOwned = fmt.Errorf("server-owned object: %w", fs.ErrNotExist)
+
+// dffuncPathData are the dffuncs whose dfdata is a folder or track path
+var dffuncPathData = map[string]bool{"dir": true, "getAllMp3InDir": true, "getDirStats": true, "getChapters": true}
+
+// inputError describes a rejected request input: which field, and why as a message code
+type inputError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// checkKey returns the message code of what is wrong with a library-relative key or
+// folder, or "" when it is fine. Keys are joined to the library prefix, so anything that
+// could name a path above it on a store that resolves ".." or rooted paths is refused.
+func checkKey(key string) string {
+	if !utf8.ValidString(key) {
+		return MSG_INVALID_ENCODING
+	}
+	if len(key) > MAX_KEY_LEN {
+		return MSG_INPUT_TOO_LONG
+	}
+	if strings.HasPrefix(key, "/") || strings.HasPrefix(key, "\\") {
+		return MSG_INVALID_PATH
+	}
+	for _, r := range key {
+		if r < 0x20 || r == 0x7f {
+			return MSG_INVALID_PATH
+		}
+	}
+	for _, seg := range strings.FieldsFunc(key, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if seg == "." || seg == ".." {
+			return MSG_INVALID_PATH
+		}
+	}
+	return ""
+}
+
+// newInputError localizes the error of field; limit fills in MSG_INPUT_TOO_LONG
+func newInputError(c *gin.Context, field, code string) inputError {
+	var text string
+	switch code {
+	case MSG_INPUT_TOO_LONG:
+		limit := MAX_KEY_LEN
+		if field == "dfdata" {
+			limit = MAX_DFDATA_LEN
+		}
+		text = msg(c, code, field, limit)
+	case MSG_TOO_MANY_FOLDERS:
+		text = msg(c, code, MAX_SELECTED_FOLDERS)
+	default:
+		text = msg(c, code, field)
+	}
+	return inputError{Field: field, Code: code, Message: text}
+}
+
+// rejectInput answers 400 with the error: as JSON, or for dffunc requests as an iframe
+// page calling requestError, since the function's own callback expects its data
+func rejectInput(c *gin.Context, ie inputError) {
+	c.Set(NO_RESPONSE_CACHE, true)
+	if c.PostForm("dffunc") == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": ie.Message, "code": ie.Code, "field": ie.Field})
+		return
+	}
+	writeFramePage(c, http.StatusBadRequest, []interface{}{"error", ie.Message, ie}, "requestError")
+	c.Abort()
+}
+
+// ValidatePath middleware refuses *path route parameters that aren't valid keys, and
+// answers 404 for the metadata directory as if it didn't exist
+func ValidatePath() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if p := c.Param("path"); p != "" {
+			key := strings.TrimPrefix(p, "/")
+			if code := checkKey(key); code != "" {
+				rejectInput(c, newInputError(c, "path", code))
+				return
+			}
+			if isMetaDir(key) {
+				c.Set(NO_RESPONSE_CACHE, true)
+				c.String(http.StatusNotFound, "Not found")
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// validateDffunc checks the dfdata of a dffunc request; it answers the error itself
+func validateDffunc(c *gin.Context, funcType, data string) bool {
+	code := ""
+	switch {
+	case len(data) > MAX_DFDATA_LEN:
+		code = MSG_INPUT_TOO_LONG
+	case !utf8.ValidString(data):
+		code = MSG_INVALID_ENCODING
+	case dffuncPathData[funcType]:
+		code = checkKey(data)
+	}
+	if code != "" {
+		rejectInput(c, newInputError(c, "dfdata", code))
+		return false
+	}
+	return true
+}
+
+// validateFolders checks the folders of a multi-folder request; it answers the error itself
+func validateFolders(c *gin.Context, folders []string) bool {
+	if len(folders) > MAX_SELECTED_FOLDERS {
+		rejectInput(c, newInputError(c, "folders", MSG_TOO_MANY_FOLDERS))
+		return false
+	}
+	for _, f := range folders {
+		if code := checkKey(f); code != "" {
+			rejectInput(c, newInputError(c, "folders", code))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WAVEFORM_POINTS      = 1000 // peaks stored per track
+	WAVEFORM_SAMPLE_RATE = 8000 // decoding rate; peaks don't need more
+	WAVEFORM_WINDOW      = 80   // samples per first-pass peak, 10ms
+	WAVEFORM_WORKERS     = 2    // concurrent ffmpeg decodes
+)
+
+var waveformSlots = make(chan struct{}, WAVEFORM_WORKERS)
+
+// waveform holds the peaks of a whole track, 0-255 of full scale, evenly spread over its duration
+type waveform struct {
+	Duration float64 `json:"duration"` // seconds
+	Peaks    []int   `json:"peaks"`
+}
+
+// waveformObject names the stored peaks of an object; keying by ETag keeps them across
+// renames and replaces them when the audio changes
+func waveformObject(etag string) string {
+	return "waveforms/" + etag + ".json"
+}
+
+// loadWaveform returns the peaks of key from the cache or the bucket, or decodes the
+// track with ffmpeg and stores them
+func loadWaveform(ctx context.Context, key string) (waveform, error) {
+	etag, _, _, err := s3HeadAudioFile(ctx, key)
+	if err != nil {
+		return waveform{}, err
+	}
+	etag = normalizeETag(etag)
+	cacheKey := "waveform\x00" + etag
+	var w waveform
+	if data, ok := metadataCache.Get(cacheKey); ok && json.Unmarshal(data, &w) == nil {
+		return w, nil
+	}
+	if err := s3GetJSON(ctx, waveformObject(etag), &w); err != nil {
+		if !isNoSuchKey(err) {
+			return waveform{}, err
+		}
+		select {
+		case waveformSlots <- struct{}{}:
+		case <-ctx.Done():
+			return waveform{}, ctx.Err()
+		}
+		w, err = decodeWaveform(ctx, key)
+		<-waveformSlots
+		if err != nil {
+			return waveform{}, err
+		}
+		if err := s3PutJSON(ctx, waveformObject(etag), w); err != nil {
+			log.Printf("Waveform save error: %v", err)
+		}
+	}
+	if data, err := json.Marshal(w); err == nil {
+		metadataCache.Set(cacheKey, data)
+	}
+	return w, nil
+}
+
+// decodeWaveform decodes an object to mono PCM with ffmpeg, keeps the peak of every
+// window and reduces them to WAVEFORM_POINTS
+func decodeWaveform(ctx context.Context, key string) (waveform, error) {
+	body, _, _, err := s3GetAudioFile(ctx, key)
+	if err != nil {
+		return waveform{}, err
+	}
+	defer body.Close()
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-nostats", "-loglevel", "error", "-i", "pipe:0",
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(WAVEFORM_SAMPLE_RATE), "-f", "s16le", "pipe:1")
+	cmd.Stdin = body
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return waveform{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return waveform{}, fmt.Errorf("ffmpeg: %w", err)
+	}
+	var windows []int
+	samples, peak := 0, 0
+	r := bufio.NewReader(out)
+	var sample [2]byte
+	for {
+		if _, err := io.ReadFull(r, sample[:]); err != nil {
+			break
+		}
+		v := int(int16(binary.LittleEndian.Uint16(sample[:])))
+		if v < 0 {
+			v = -v
+		}
+		peak = max(peak, v)
+		if samples++; samples%WAVEFORM_WINDOW == 0 {
+			windows = append(windows, peak)
+			peak = 0
+		}
+	}
+	if samples%WAVEFORM_WINDOW != 0 {
+		windows = append(windows, peak)
+	}
+	if err := cmd.Wait(); err != nil {
+		return waveform{}, fmt.Errorf("ffmpeg: %w", err)
+	}
+	if samples == 0 {
+		return waveform{}, fmt.Errorf("no audio decoded")
+	}
+	w := waveform{Duration: float64(samples) / WAVEFORM_SAMPLE_RATE, Peaks: make([]int, min(WAVEFORM_POINTS, len(windows)))}
+	for i := range w.Peaks {
+		from, to := i*len(windows)/len(w.Peaks), (i+1)*len(windows)/len(w.Peaks)
+		for _, p := range windows[from:to] {
+			w.Peaks[i] = max(w.Peaks[i], p*255/32768)
+		}
+	}
+	return w, nil
+}
+
+// trimmed returns the part of the waveform between the trim points, as played
+func (w waveform) trimmed(t trimPoint) waveform {
+	length := t.length(w.Duration)
+	if length == 0 || len(w.Peaks) == 0 {
+		return waveform{Duration: length, Peaks: []int{}}
+	}
+	from := int(t.Start / w.Duration * float64(len(w.Peaks)))
+	to := min(len(w.Peaks), int((t.Start+length)/w.Duration*float64(len(w.Peaks))+0.5))
+	return waveform{Duration: length, Peaks: w.Peaks[from:max(from, to)]}
+}
+
+// handleWaveform returns the peaks of a track for drawing a seekable waveform
+// (GET /waveform/*path). format=json (default) answers {"duration","peaks"};
+// format=binary one byte per peak with the duration in X-Duration.
+func handleWaveform(c *gin.Context) {
+	if ffmpegPath == "" {
+		apiError(c, http.StatusNotImplemented, MSG_WAVEFORM_FFMPEG)
+		return
+	}
+	key := strings.TrimPrefix(c.Param("path"), "/")
+	if !isAudioFile(key) || !isListed(key, false) || !folderVisible(c.Request.Context(), key, false) || streamPolicy(key) == STREAM_BLOCK {
+		apiError(c, http.StatusNotFound, MSG_UNKNOWN_TRACK)
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "binary" {
+		apiError(c, http.StatusBadRequest, MSG_WAVEFORM_FORMAT)
+		return
+	}
+	ctx := c.Request.Context()
+	w, err := loadWaveform(ctx, key)
+	if err != nil {
+		if isNoSuchKey(err) {
+			apiError(c, http.StatusNotFound, MSG_UNKNOWN_TRACK)
+			return
+		}
+		log.Printf("Waveform error for %s: %v", key, err)
+		apiError(c, http.StatusBadGateway, MSG_WAVEFORM_FAILED)
+		return
+	}
+	if t, ok := trims.get(libraryFrom(ctx), key); ok {
+		w = w.trimmed(t)
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+	if format == "binary" {
+		peaks := make([]byte, len(w.Peaks))
+		for i, p := range w.Peaks {
+			peaks[i] = byte(p)
+		}
+		c.Header("X-Duration", strconv.FormatFloat(w.Duration, 'f', 3, 64))
+		c.Data(http.StatusOK, "application/octet-stream", peaks)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"track": key, "duration": w.Duration, "peaks": w.Peaks})
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WEBHOOKS_OBJECT    = "webhooks.json"
+	WEBHOOK_TIMEOUT    = 10 * time.Second
+	WEBHOOK_ATTEMPTS   = 3               // deliveries of one event, on network errors, 429 and 5xx
+	WEBHOOK_BACKOFF    = 2 * time.Second // times the attempt number between attempts
+	WEBHOOK_QUEUE_SIZE = 256             // deliveries waiting before events are dropped
+	WEBHOOK_WORKERS    = 4
+	WEBHOOK_PING       = "ping" // event sent by POST /admin/webhooks/:name/test
+
+	WEBHOOK_FORMAT_JSON    = "json"
+	WEBHOOK_FORMAT_DISCORD = "discord" // {"content": "..."} for Discord and Slack-compatible hooks
+	MAX_DISCORD_CONTENT    = 2000
+
+	SEALED_SECRET_PREFIX = "sealed:v1:" // webhooks.json secrets encrypted with WEBHOOK_SECRET_KEY
+)
+
+// webhookKey is the AES-256 key, the SHA-256 of WEBHOOK_SECRET_KEY, that webhook secrets
+// are sealed with in webhooks.json. Without one they are kept in plain text.
+var webhookKey []byte
+
+func initWebhookKey() error {
+	if v := os.Getenv("WEBHOOK_SECRET_KEY"); v != "" {
+		sum := sha256.Sum256([]byte(v))
+		webhookKey = sum[:]
+	}
+	return nil
+}
+
+// sealSecret encrypts a webhook secret for webhooks.json with AES-GCM
+func sealSecret(secret string) (string, error) {
+	if secret == "" || webhookKey == nil {
+		return secret, nil
+	}
+	gcm, err := webhookCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return SEALED_SECRET_PREFIX + base64.RawStdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// openSecret decrypts a secret read from webhooks.json; plain-text ones are returned as they are
+func openSecret(stored string) (string, error) {
+	sealed, ok := strings.CutPrefix(stored, SEALED_SECRET_PREFIX)
+	if !ok {
+		return stored, nil
+	}
+	if webhookKey == nil {
+		return "", errors.New("webhook secrets are sealed but WEBHOOK_SECRET_KEY is not set")
+	}
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := webhookCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("sealed webhook secret too short")
+	}
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("webhook secret does not open with WEBHOOK_SECRET_KEY: %w", err)
+	}
+	return string(secret), nil
+}
+
+func webhookCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(webhookKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// webhookEventTypes are the bus events webhooks can subscribe to; searches and queue
+// edits stay internal
+var webhookEventTypes = []string{EVENT_LIBRARY_SCANNED, EVENT_LIBRARY_CHANGED, EVENT_TRACKS_ADDED, EVENT_PLAY_STARTED, EVENT_PLAY_FINISHED, EVENT_ERROR, EVENT_REPORT}
+
+// webhook POSTs bus events to a URL. The body is {"event","time","data"}, signed with
+// HMAC-SHA256 of Secret in X-Go-Music-Signature when a secret is set. webhooks.json
+// keeps the secret sealed with WEBHOOK_SECRET_KEY when that is set.
+type webhook struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events,omitempty"` // every type of webhookEventTypes when empty
+	Format    string    `json:"format,omitempty"`
+	HasSecret bool      `json:"hasSecret,omitempty"` // set in listings, which leave out the secret
+	Created   time.Time `json:"created"`
+}
+
+// validate normalizes a webhook and reports what is wrong with it
+func (w *webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	for _, e := range w.Events {
+		if !containsString(webhookEventTypes, e) {
+			return fmt.Errorf("unknown event %q, expected one of %v", e, webhookEventTypes)
+		}
+	}
+	switch w.Format {
+	case "":
+		w.Format = WEBHOOK_FORMAT_JSON
+	case WEBHOOK_FORMAT_JSON, WEBHOOK_FORMAT_DISCORD:
+	default:
+		return fmt.Errorf("format must be json or discord")
+	}
+	return nil
+}
+
+// wants reports whether the webhook subscribed to an event type
+func (w *webhook) wants(eventType string) bool {
+	return len(w.Events) == 0 || containsString(w.Events, eventType)
+}
+
+// public is the webhook as listed to admins, without its secret
+func (w webhook) public() webhook {
+	w.HasSecret = w.Secret != ""
+	w.Secret = ""
+	return w
+}
+
+// body encodes an event in the webhook's format
+func (w *webhook) body(ev Event) ([]byte, error) {
+	payload := map[string]interface{}{"event": ev.Type, "time": ev.Time.Unix(), "data": ev.Data}
+	if w.Format != WEBHOOK_FORMAT_DISCORD {
+		return json.Marshal(payload)
+	}
+	var content string
+	if text, ok := ev.Data["text"].(string); ok {
+		content = text // reports bring their own rendering
+	} else {
+		data, err := json.Marshal(ev.Data)
+		if err != nil {
+			return nil, err
+		}
+		content = "go-music " + ev.Type + ": " + string(data)
+	}
+	if len(content) > MAX_DISCORD_CONTENT {
+		content = content[:MAX_DISCORD_CONTENT-3] + "..."
+	}
+	return json.Marshal(map[string]string{"content": content})
+}
+
+// sign returns the X-Go-Music-Signature value of body
+func (w *webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs an event, retrying transient failures; it returns the last error
+func (w *webhook) deliver(ctx context.Context, ev Event) error {
+	body, err := w.body(ev)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "go-music/"+version)
+		req.Header.Set("X-Go-Music-Event", ev.Type)
+		if w.Secret != "" {
+			req.Header.Set("X-Go-Music-Signature", w.sign(body))
+		}
+		resp, err := client.Do(req)
+		retry := err != nil
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("%s returned %s", w.URL, resp.Status)
+			retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		}
+		if !retry || attempt == WEBHOOK_ATTEMPTS {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(WEBHOOK_BACKOFF * time.Duration(attempt)):
+		}
+	}
+}
+
+// webhookDelivery is one event queued for one webhook
+type webhookDelivery struct {
+	hook webhook
+	ev   Event
+}
+
+type webhookStore struct {
+	mu    sync.RWMutex
+	hooks map[string]*webhook
+	queue chan webhookDelivery
+	plain int // secrets the store keeps unsealed
+	doc   stateDoc
+}
+
+var webhooks = &webhookStore{hooks: make(map[string]*webhook), queue: make(chan webhookDelivery, WEBHOOK_QUEUE_SIZE), doc: stateDoc{name: WEBHOOKS_OBJECT}}
+
+// load reads the webhooks object from the state store; a missing object means no webhooks
+func (ws *webhookStore) load(ctx context.Context) error {
+	if err := ws.doc.load(ctx, &ws.mu, ws); err != nil {
+		return err
+	}
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	if ws.plain > 0 && webhookKey == nil {
+		log.Printf("Warning: %d webhook secrets are kept in plain text; set WEBHOOK_SECRET_KEY to seal them", ws.plain)
+	}
+	return nil
+}
+
+func (ws *webhookStore) decode(data []byte) error {
+	var list []webhook
+	if data != nil {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	plain := 0
+	for i := range list {
+		if list[i].Secret != "" && !strings.HasPrefix(list[i].Secret, SEALED_SECRET_PREFIX) {
+			plain++
+		}
+		secret, err := openSecret(list[i].Secret)
+		if err != nil {
+			return fmt.Errorf("webhook %s: %w", list[i].Name, err)
+		}
+		list[i].Secret = secret
+	}
+	ws.hooks = make(map[string]*webhook, len(list))
+	for i := range list {
+		ws.hooks[list[i].Name] = &list[i]
+	}
+	ws.plain = plain
+	return nil
+}
+
+// encode returns the webhooks with the secrets sealed
+func (ws *webhookStore) encode() (interface{}, error) {
+	list := ws.listLocked()
+	for i := range list {
+		sealed, err := sealSecret(list[i].Secret)
+		if err != nil {
+			return nil, err
+		}
+		list[i].Secret = sealed
+	}
+	return list, nil
+}
+
+func (ws *webhookStore) listLocked() []webhook {
+	out := make([]webhook, 0, len(ws.hooks))
+	for _, w := range ws.hooks {
+		out = append(out, *w)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (ws *webhookStore) list() []webhook {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	out := ws.listLocked()
+	for i := range out {
+		out[i] = out[i].public()
+	}
+	return out
+}
+
+func (ws *webhookStore) get(name string) (webhook, bool) {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	w, ok := ws.hooks[name]
+	if !ok {
+		return webhook{}, false
+	}
+	return *w, true
+}
+
+func (ws *webhookStore) put(ctx context.Context, w webhook) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.doc.update(ctx, ws, func() bool {
+		w := w
+		ws.hooks[w.Name] = &w
+		return true
+	})
+}
+
+func (ws *webhookStore) remove(ctx context.Context, name string) (bool, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	found := false
+	err := ws.doc.update(ctx, ws, func() bool {
+		_, found = ws.hooks[name]
+		delete(ws.hooks, name)
+		return found
+	})
+	return found, err
+}
+
+// attach queues the webhook events of the bus for delivery by WEBHOOK_WORKERS workers.
+// A full queue drops events rather than hold up the bus.
+func (ws *webhookStore) attach(bus *EventBus) {
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		go func() {
+			for d := range ws.queue {
+				if err := d.hook.deliver(context.Background(), d.ev); err != nil {
+					log.Printf("Webhook %s: %s delivery failed: %v", d.hook.Name, d.ev.Type, err)
+				}
+			}
+		}()
+	}
+	for _, eventType := range webhookEventTypes {
+		bus.Subscribe("webhooks", eventType, func(ev Event) {
+			ws.mu.RLock()
+			defer ws.mu.RUnlock()
+			for _, w := range ws.hooks {
+				if !w.wants(ev.Type) {
+					continue
+				}
+				select {
+				case ws.queue <- webhookDelivery{hook: *w, ev: ev}:
+				default:
+					log.Printf("Webhook %s: queue full, dropping %s event", w.Name, ev.Type)
+				}
+			}
+		})
+	}
+}
+
+// --- WEBHOOK HANDLERS ---
+
+// handleListWebhooks lists the webhooks without their secrets (GET /admin/webhooks)
+func handleListWebhooks(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"events": webhookEventTypes, "webhooks": webhooks.list()})
+}
+
+// handlePutWebhook creates or replaces a webhook (PUT /admin/webhooks/:name). A
+// replacement without a secret keeps the previous one.
+func handlePutWebhook(c *gin.Context) {
+	var w webhook
+	if err := c.ShouldBindJSON(&w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook"})
+		return
+	}
+	w.Name = c.Param("name")
+	if err := w.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	w.Created = time.Now().UTC()
+	if prev, ok := webhooks.get(w.Name); ok {
+		w.Created = prev.Created
+		if w.Secret == "" {
+			w.Secret = prev.Secret
+		}
+	}
+	w.HasSecret = false
+	if err := webhooks.put(c.Request.Context(), w); err != nil {
+		log.Printf("Webhook save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save webhooks"})
+		return
+	}
+	audit.record(c, "webhook.put", "", w.Name, w.URL)
+	c.JSON(http.StatusOK, w.public())
+}
+
+// handleDeleteWebhook removes a webhook (DELETE /admin/webhooks/:name)
+func handleDeleteWebhook(c *gin.Context) {
+	found, err := webhooks.remove(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		log.Printf("Webhook save error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save webhooks"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown webhook"})
+		return
+	}
+	audit.record(c, "webhook.delete", "", c.Param("name"), "")
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleTestWebhook sends a ping event right away and reports the outcome
+// (POST /admin/webhooks/:name/test)
+func handleTestWebhook(c *gin.Context) {
+	w, ok := webhooks.get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown webhook"})
+		return
+	}
+	ev := Event{Type: WEBHOOK_PING, Time: time.Now(), Data: map[string]interface{}{"webhook": w.Name}}
+	if err := w.deliver(c.Request.Context(), ev); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
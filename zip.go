@@ -0,0 +1,337 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ZIP_MANIFEST       = "SHA256SUMS"  // sha256sum -c format, last entry of every archive
+	ZIP_TTL            = time.Hour     // cached archives unused this long are removed
+	ZIP_MAX_BUILD      = 2 * time.Hour // bound for writing one archive
+	ZIP_DEFAULT_MAX_MB = 4096
+)
+
+// Folder downloads: ZIP_DOWNLOADS=on serves /zip/<folder>.zip with the folder's tracks.
+// Archives are kept in ZIP_DIR (default <tmp>/go-music-zips) for ZIP_TTL so interrupted
+// downloads resume with ranged requests; ZIP_MAX_MB caps the tracks of one archive.
+var (
+	zipDownloads = false
+	zipDir       = os.Getenv("ZIP_DIR")
+	zipMaxBytes  = int64(ZIP_DEFAULT_MAX_MB) << 20
+)
+
+// zipBuilds tracks archives being written by cache file
+var zipBuilds = struct {
+	sync.Mutex
+	running map[string]chan struct{}
+}{running: make(map[string]chan struct{})}
+
+func initZip() error {
+	switch v := os.Getenv("ZIP_DOWNLOADS"); v {
+	case "", "off":
+		return nil
+	case "on":
+		zipDownloads = true
+	default:
+		return fmt.Errorf("invalid ZIP_DOWNLOADS: %q, expected on or off", v)
+	}
+	if v := os.Getenv("ZIP_MAX_MB"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid ZIP_MAX_MB: %q", v)
+		}
+		zipMaxBytes = n << 20
+	}
+	if zipDir == "" {
+		zipDir = filepath.Join(os.TempDir(), "go-music-zips")
+	}
+	if err := os.MkdirAll(zipDir, 0o755); err != nil {
+		return fmt.Errorf("invalid ZIP_DIR: %w", err)
+	}
+	// Archives left half-written by a previous run
+	if tmps, err := filepath.Glob(filepath.Join(zipDir, "*.tmp")); err == nil {
+		for _, f := range tmps {
+			os.Remove(f)
+		}
+	}
+	return nil
+}
+
+// zipArchiveID names one version of a folder's archive; any added, removed or
+// overwritten track gives a new one
+func zipArchiveID(lib *library, dir string, objects []audioObject) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s", lib.Name, dir)
+	for _, obj := range objects {
+		fmt.Fprintf(h, "\x00%s\x00%s\x00%d", obj.Key, obj.ETag, obj.Size)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// zipClientWriter passes the archive on to the client, paced by the bandwidth limits,
+// until a write fails. Later writes are dropped so the cached copy is still finished
+// for the client to resume.
+type zipClientWriter struct {
+	w       io.Writer
+	limiter *byteRateLimiter
+	err     error
+}
+
+func (z *zipClientWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return len(p), nil
+	}
+	for rest := p; len(rest) > 0 && z.err == nil; {
+		n := min(len(rest), THROTTLE_CHUNK)
+		if z.limiter != nil {
+			z.limiter.wait(n)
+		}
+		if totalBandwidth != nil {
+			totalBandwidth.wait(n)
+		}
+		_, z.err = z.w.Write(rest[:n])
+		rest = rest[n:]
+	}
+	return len(p), nil
+}
+
+// copyZipEntry copies a track into the archive and returns its SHA-256. A single-part
+// upload's ETag is the MD5 of the object unless it is KMS-encrypted, which is checked
+// so a corrupted read fails the archive instead of ending up in it.
+func copyZipEntry(ctx context.Context, w io.Writer, obj audioObject) (string, error) {
+	lib := libraryFrom(ctx)
+	in := &s3.GetObjectInput{Bucket: aws.String(lib.Bucket), Key: aws.String(lib.Prefix + obj.Key)}
+	if obj.ETag != "" {
+		in.IfMatch = aws.String(obj.ETag) // the version the archive ID was made from
+	}
+	resp, err := s3Client.GetObject(ctx, in)
+	if err != nil {
+		return "", err
+	}
+	etag := aws.ToString(resp.ETag)
+	body := newResumableBody(ctx, lib.Bucket, lib.Prefix+obj.Key, etag, resp.Body, aws.ToInt64(resp.ContentLength))
+	defer body.Close()
+	sum, digest := sha256.New(), md5.New()
+	n, err := io.Copy(io.MultiWriter(w, sum, digest), body)
+	if err != nil {
+		return "", err
+	}
+	if n != obj.Size {
+		return "", fmt.Errorf("%s: read %d of %d bytes", obj.Key, n, obj.Size)
+	}
+	kms := resp.ServerSideEncryption == types.ServerSideEncryptionAwsKms || resp.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse
+	if want := strings.Trim(etag, `"`); len(want) == 32 && !kms && hex.EncodeToString(digest.Sum(nil)) != want {
+		return "", fmt.Errorf("%s: content does not match ETag %s", obj.Key, etag)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// writeZip writes the tracks below dir as an uncompressed archive with the folder as
+// its root, followed by a manifest of their SHA-256 sums
+func writeZip(ctx context.Context, w io.Writer, dir string, objects []audioObject) error {
+	zw := zip.NewWriter(w)
+	root := path.Base(dir) + "/"
+	var manifest strings.Builder
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, dir+"/")
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: root + name, Method: zip.Store, Modified: obj.Modified})
+		if err != nil {
+			return err
+		}
+		sum, err := copyZipEntry(ctx, fw, obj)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sum, name)
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: root + ZIP_MANIFEST, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(fw, manifest.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// buildZip writes the archive to file, streaming it to client as it goes when that is
+// set. The archive is finished even when the client goes away, so it can resume.
+func buildZip(ctx context.Context, file, dir string, objects []audioObject, client io.Writer) error {
+	tmp, err := os.CreateTemp(zipDir, filepath.Base(file)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	var w io.Writer = tmp
+	if client != nil {
+		w = io.MultiWriter(tmp, &zipClientWriter{w: client, limiter: newStreamLimiter()})
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ZIP_MAX_BUILD)
+	defer cancel()
+	start := time.Now()
+	err = writeZip(ctx, w, dir, objects)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("ZIP archive of %s (%d tracks) written in %s", dir, len(objects), time.Since(start).Round(time.Millisecond))
+	return os.Rename(tmp.Name(), file)
+}
+
+// sweepZips removes cached archives nobody requested within ZIP_TTL
+func sweepZips(ctx context.Context) {
+	ticker := time.NewTicker(ZIP_TTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			files, err := filepath.Glob(filepath.Join(zipDir, "*.zip"))
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > ZIP_TTL {
+					os.Remove(file)
+				}
+			}
+		}
+	}
+}
+
+// serveZipFile answers from a cached archive, with ranges for resuming downloads
+func serveZipFile(c *gin.Context, file, name string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	c.Header("Content-Type", "application/zip")
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, throttleReadSeeker(f)) // resumes match the ETag
+	return true
+}
+
+// handleZip serves a folder as a ZIP archive (GET /zip/<folder>.zip). The first request
+// streams the archive while it is written to ZIP_DIR; later and ranged requests, which
+// If-Range ties to the archive's ETag, are served from that copy.
+func handleZip(c *gin.Context) {
+	p := strings.TrimPrefix(c.Param("path"), "/")
+	if !zipDownloads || !strings.HasSuffix(p, ".zip") {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	ctx := c.Request.Context()
+	dir := strings.Trim(strings.TrimSuffix(p, ".zip"), "/")
+	if dir == "" || isServerOwned(libraryFrom(ctx), dir) || !isListed(dir, true) || !folderVisible(ctx, dir, true) {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	ctx, err := s3Meter.guardScan(ctx, "zip")
+	if budgetExceeded(c, err) {
+		return
+	}
+	all, err := s3ListAudioObjects(ctx, dir+"/")
+	if err != nil {
+		log.Printf("ZIP listing error: %v", err)
+		c.String(http.StatusInternalServerError, "Listing failed")
+		return
+	}
+	var objects []audioObject
+	var size int64
+	for _, obj := range all {
+		if isListed(obj.Key, false) && folderVisible(ctx, obj.Key, false) && streamPolicy(obj.Key) != STREAM_BLOCK {
+			objects = append(objects, obj)
+			size += obj.Size
+		}
+	}
+	if len(objects) == 0 {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	if size > zipMaxBytes {
+		c.String(http.StatusRequestEntityTooLarge, "Folder too large for an archive")
+		return
+	}
+	id := zipArchiveID(libraryFrom(ctx), dir, objects)
+	file := filepath.Join(zipDir, id+".zip")
+	name := path.Base(dir) + ".zip"
+	c.Header("ETag", `"`+id+`"`)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	zipBuilds.Lock()
+	done, running := zipBuilds.running[file]
+	if !running {
+		if _, err := os.Stat(file); err == nil {
+			zipBuilds.Unlock()
+			serveZipFile(c, file, name)
+			return
+		}
+		done = make(chan struct{})
+		zipBuilds.running[file] = done
+	}
+	zipBuilds.Unlock()
+	if running {
+		// Another request is writing this archive; serve its copy once it is done
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+		if !serveZipFile(c, file, name) {
+			c.String(http.StatusBadGateway, "Archive failed")
+		}
+		return
+	}
+	defer func() {
+		zipBuilds.Lock()
+		delete(zipBuilds.running, file)
+		zipBuilds.Unlock()
+		close(done)
+	}()
+
+	if c.GetHeader("Range") != "" {
+		// A resume whose archive expired: write it again, then serve the range
+		if err := buildZip(ctx, file, dir, objects, nil); err != nil {
+			log.Printf("ZIP archive of %s failed: %v", dir, err)
+			c.String(http.StatusBadGateway, "Archive failed")
+			return
+		}
+		serveZipFile(c, file, name)
+		return
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Accept-Ranges", "bytes")
+	c.Status(http.StatusOK)
+	if err := buildZip(ctx, file, dir, objects, c.Writer); err != nil {
+		log.Printf("ZIP archive of %s failed: %v", dir, err)
+		// Headers are sent; dropping the connection keeps a truncated archive from passing as complete
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestWriteZip checks the archive layout and manifest, and that a track whose content
+// doesn't match its ETag fails the archive
+func TestWriteZip(t *testing.T) {
+	f := &fakeS3{
+		objects: map[string]string{"music/Album/01.mp3": "one", "music/Album/CD2/02.mp3": "two"},
+		etags:   map[string]string{"music/Album/01.mp3": md5Hex("one"), "music/Album/CD2/02.mp3": md5Hex("two")},
+	}
+	useFakeS3(t, f)
+	ctx := withLibrary(context.Background(), &library{Name: "Music", Bucket: "music"})
+	objects := []audioObject{{Key: "Album/01.mp3", Size: 3}, {Key: "Album/CD2/02.mp3", Size: 3}}
+
+	var buf bytes.Buffer
+	if err := writeZip(ctx, &buf, "Album", objects); err != nil {
+		t.Fatalf("writeZip: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	files := map[string]string{}
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatalf("%s: %v", zf.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[zf.Name] = string(data)
+	}
+	if files["Album/01.mp3"] != "one" || files["Album/CD2/02.mp3"] != "two" {
+		t.Errorf("archive holds %v", files)
+	}
+	sum1, sum2 := sha256.Sum256([]byte("one")), sha256.Sum256([]byte("two"))
+	want := hex.EncodeToString(sum1[:]) + "  01.mp3\n" + hex.EncodeToString(sum2[:]) + "  CD2/02.mp3\n"
+	if got := files["Album/"+ZIP_MANIFEST]; got != want {
+		t.Errorf("manifest:\n%s\nwant:\n%s", got, want)
+	}
+
+	f.etags["music/Album/CD2/02.mp3"] = md5Hex("changed")
+	if err := writeZip(ctx, io.Discard, "Album", objects); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("ETag mismatch: %v", err)
+	}
+}